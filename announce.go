@@ -0,0 +1,167 @@
+package clusterf
+/*
+ * Announcement drivers for the VIPs of the healthy services.
+ *
+ * Each frontend can select the announcer used for its VIPs, allowing anycast VIPs announced as routes to be mixed with failover VIPs
+ * announced as interface addresses within the same daemon.
+ */
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "sort"
+    "strings"
+)
+
+const INJECT_ARPING_PATH = "arping"
+
+// Announce the healthy VIPs
+type Announcer interface {
+    // Announce any new VIPs, and withdraw any previously announced VIPs that are no longer given
+    Announce(vips map[string]net.IP) error
+
+    String() string
+}
+
+// The VIPs announced by an announcer
+type announced map[string]net.IP
+
+// Call up for any new VIPs, and down for any removed VIPs, returning true if anything changed
+func (self announced) update(name string, vips map[string]net.IP, up func(vip net.IP) error, down func(vip net.IP) error) (changed bool, err error) {
+    for key, vip := range vips {
+        if _, exists := self[key]; exists {
+            continue
+        }
+
+        log.Printf("clusterf:Injector %s: up %s\n", name, vip)
+
+        if err = up(vip); err != nil {
+            return
+        }
+
+        self[key] = vip
+        changed = true
+    }
+
+    for key, vip := range self {
+        if _, exists := vips[key]; exists {
+            continue
+        }
+
+        log.Printf("clusterf:Injector %s: down %s\n", name, vip)
+
+        if err = down(vip); err != nil {
+            return
+        }
+
+        delete(self, key)
+        changed = true
+    }
+
+    return
+}
+
+// Return the sorted VIPs
+func (self announced) sorted() []string {
+    var vips []string
+
+    for vip, _ := range self {
+        vips = append(vips, vip)
+    }
+
+    sort.Strings(vips)
+
+    return vips
+}
+
+func vipPrefix(vip net.IP) string {
+    if vip.To4() != nil {
+        return vip.String() + "/32"
+    } else {
+        return vip.String() + "/128"
+    }
+}
+
+/* addr: interface addresses, for failover VIPs */
+type announceAddr struct {
+    ipPath      string
+    dev         string
+    arping      bool
+    commands    injectCommands
+
+    vips        announced
+}
+
+func (self *announceAddr) String() string {
+    if self.arping {
+        return fmt.Sprintf("addr dev %s arping", self.dev)
+    } else {
+        return fmt.Sprintf("addr dev %s", self.dev)
+    }
+}
+
+func (self *announceAddr) up(vip net.IP) error {
+    if err := self.commands.Run(self.ipPath, "addr", "replace", vipPrefix(vip), "dev", self.dev); err != nil {
+        return err
+    }
+
+    // gratuitous ARP to update the neighbors, as the kernel does not send any for the new address
+    if !self.arping || vip.To4() == nil {
+
+    } else if err := self.commands.Run(INJECT_ARPING_PATH, "-U", "-c", "1", "-I", self.dev, vip.String()); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (self *announceAddr) down(vip net.IP) error {
+    return self.commands.Run(self.ipPath, "addr", "del", vipPrefix(vip), "dev", self.dev)
+}
+
+func (self *announceAddr) Announce(vips map[string]net.IP) error {
+    _, err := self.vips.update(self.String(), vips, self.up, self.down)
+
+    return err
+}
+
+/* exec: external command, e.g. for VRRP or BGP speakers */
+type announceExec struct {
+    command     string
+    commands    injectCommands
+
+    vips        announced
+}
+
+func (self *Injector) openExec() (*announceExec, error) {
+    announcer := &announceExec{
+        command:    self.config.Exec,
+        commands:   self.commands,
+        vips:       make(announced),
+    }
+
+    // withdraw any VIPs left over from a previous run
+    if err := announcer.run("flush"); err != nil {
+        return nil, err
+    }
+
+    return announcer, nil
+}
+
+func (self *announceExec) String() string {
+    return fmt.Sprintf("exec %s", self.command)
+}
+
+func (self *announceExec) run(args ...string) error {
+    return self.commands.Run("/bin/sh", "-c", self.command + " " + strings.Join(args, " "))
+}
+
+func (self *announceExec) Announce(vips map[string]net.IP) error {
+    _, err := self.vips.update(self.String(), vips,
+        func(vip net.IP) error { return self.run("up", vip.String()) },
+        func(vip net.IP) error { return self.run("down", vip.String()) },
+    )
+
+    return err
+}
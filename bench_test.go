@@ -0,0 +1,210 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "syscall"
+    "testing"
+)
+
+// Scale used for benchmarks: services x backends per service
+const benchServices = 1000
+const benchBackends = 100
+
+func benchFrontend(service int) config.ServiceFrontend {
+    return config.ServiceFrontend{IPv4: fmt.Sprintf("10.0.%d.%d", service / 256, service % 256), TCP: 80}
+}
+
+func benchBackend(service int, backend int) config.ServiceBackend {
+    return config.ServiceBackend{IPv4: fmt.Sprintf("10.%d.%d.%d", 1 + backend, service / 256, service % 256), TCP: 8080}
+}
+
+// Generate the initial config for services x backends
+func benchConfig(services *Services, serviceCount int, backendCount int) {
+    for service := 0; service < serviceCount; service++ {
+        serviceName := fmt.Sprintf("test%d", service)
+
+        services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: serviceName, Frontend: benchFrontend(service)})
+
+        for backend := 0; backend < backendCount; backend++ {
+            services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: serviceName, BackendName: fmt.Sprintf("test%d", backend), Backend: benchBackend(service, backend)})
+        }
+    }
+}
+
+// The services code logs every change, which would dominate the benchmarks
+func benchLog(b *testing.B) {
+    log.SetOutput(ioutil.Discard)
+
+    b.ReportAllocs()
+}
+
+func benchDone() {
+    log.SetOutput(os.Stderr)
+}
+
+// Full-scan apply of the initial config
+func BenchmarkSyncIPVS(b *testing.B) {
+    benchLog(b)
+    defer benchDone()
+
+    for i := 0; i < b.N; i++ {
+        b.StopTimer()
+        services := NewServices()
+        benchConfig(services, benchServices, benchBackends)
+        b.StartTimer()
+
+        if _, err := services.SyncIPVS(IpvsConfig{Mock: true}); err != nil {
+            b.Fatalf("services.SyncIPVS: %v", err)
+        }
+    }
+}
+
+// Full-scan apply of a single service with thousands of backends, which must stay linear in the backends
+const benchLargeBackends = 4000
+
+func BenchmarkSyncIPVSLargeService(b *testing.B) {
+    benchLog(b)
+    defer benchDone()
+
+    for i := 0; i < b.N; i++ {
+        b.StopTimer()
+        services := NewServices()
+        services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "test", Frontend: benchFrontend(0)})
+
+        for backend := 0; backend < benchLargeBackends; backend++ {
+            services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "test", BackendName: fmt.Sprintf("test%d", backend), Backend: config.ServiceBackend{IPv4: fmt.Sprintf("10.1.%d.%d", backend / 256, backend % 256), TCP: 8080}})
+        }
+        b.StartTimer()
+
+        if _, err := services.SyncIPVS(IpvsConfig{Mock: true}); err != nil {
+            b.Fatalf("services.SyncIPVS: %v", err)
+        }
+    }
+}
+
+// Incremental config event latency for a backend weight change
+func BenchmarkConfigEventBackend(b *testing.B) {
+    benchLog(b)
+    defer benchDone()
+
+    services := NewServices()
+    benchConfig(services, benchServices, benchBackends)
+
+    if _, err := services.SyncIPVS(IpvsConfig{Mock: true}); err != nil {
+        b.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        service := i % benchServices
+        backend := config.ServiceBackend{IPv4: benchBackend(service, 0).IPv4, TCP: 8080, Weight: uint(1 + i % 10)}
+
+        services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: fmt.Sprintf("test%d", service), BackendName: "test0", Backend: backend}})
+    }
+}
+
+// Incremental config event latency for adding and removing a backend
+func BenchmarkConfigEventBackendAddDel(b *testing.B) {
+    benchLog(b)
+    defer benchDone()
+
+    services := NewServices()
+    benchConfig(services, benchServices, benchBackends)
+
+    if _, err := services.SyncIPVS(IpvsConfig{Mock: true}); err != nil {
+        b.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        service := i % benchServices
+        serviceName := fmt.Sprintf("test%d", service)
+
+        services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: serviceName, BackendName: "bench", Backend: benchBackend(service, benchBackends)}})
+        services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: serviceName, BackendName: "bench"}})
+    }
+}
+
+// Incremental config event latency for replacing a frontend with all of its backends
+func BenchmarkConfigEventFrontend(b *testing.B) {
+    benchLog(b)
+    defer benchDone()
+
+    services := NewServices()
+    benchConfig(services, benchServices, benchBackends)
+
+    if _, err := services.SyncIPVS(IpvsConfig{Mock: true}); err != nil {
+        b.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        service := i % benchServices
+        frontend := benchFrontend(service)
+        frontend.TCP = uint16(81 + i % 2)
+
+        services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: fmt.Sprintf("test%d", service), Frontend: frontend}})
+    }
+}
+
+// Gate regressions in the allocations for the most common incremental config event
+const benchConfigEventBackendAllocs = 100
+
+func TestConfigEventBackendAllocs(t *testing.T) {
+    log.SetOutput(ioutil.Discard)
+    defer benchDone()
+
+    services := NewServices()
+    benchConfig(services, 10, 10)
+
+    if _, err := services.SyncIPVS(IpvsConfig{Mock: true}); err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    weight := uint(1)
+    event := config.Event{Action: config.SetConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "test0", BackendName: "test0"}}
+
+    allocs := testing.AllocsPerRun(100, func() {
+        weight = 1 + weight % 10
+        event.Config.(*config.ConfigServiceBackend).Backend = config.ServiceBackend{IPv4: benchBackend(0, 0).IPv4, TCP: 8080, Weight: weight}
+
+        services.ConfigEvent(event)
+    })
+
+    if allocs > benchConfigEventBackendAllocs {
+        t.Errorf("ConfigEvent backend: %v allocs > %v", allocs, benchConfigEventBackendAllocs)
+    }
+}
+
+// Lookup of merged dests, as done for every dest update
+func BenchmarkDestLookup(b *testing.B) {
+    benchLog(b)
+    defer benchDone()
+
+    services := NewServices()
+    benchConfig(services, benchServices, benchBackends)
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        b.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    service := services.services["test0"]
+    ipvsService := service.driverFrontend.state[ipvsType{syscall.AF_INET, syscall.IPPROTO_TCP}]
+    ipvsDest := service.driverBackends["test0"].state[ipvsType{syscall.AF_INET, syscall.IPPROTO_TCP}]
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        if ipvsDriver.dests[makeKey(ipvsService, ipvsDest)] != ipvsDest {
+            b.Fatalf("invalid dest lookup")
+        }
+    }
+}
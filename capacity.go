@@ -0,0 +1,256 @@
+package clusterf
+/*
+ * Capacity events for autoscalers, closing the loop between the backend health and provisioning more backends.
+ *
+ * An event is published whenever a service drops below the threshold of active backends, whenever the number of active backends
+ * changes while under the threshold, and once the service has recovered. The events are POSTed to any webhook, and streamed to any
+ * HTTP subscribers as newline-delimited JSON.
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Buffered events for each subscriber, any further events are dropped for slow subscribers
+const CAPACITY_BUFFER = 100
+
+type CapacityConfig struct {
+    NodeName    string          // default: hostname
+
+    // Publish events for services with fewer active backends
+    Threshold   uint
+
+    // POST each event to the webhook as JSON, failing unless the webhook returns a 2xx status
+    Webhook     string
+    Timeout     time.Duration   // default: 10s
+}
+
+type CapacityEvent struct {
+    Node        string      `json:"node"`
+    Service     string      `json:"service"`
+    Backends    uint        `json:"backends"`
+    Threshold   uint        `json:"threshold"`
+
+    // false once the service has recovered to the threshold
+    Low         bool        `json:"low"`
+    Time        time.Time   `json:"time"`
+}
+
+type CapacityWatcher struct {
+    config      CapacityConfig
+    client      *http.Client
+
+    mutex       sync.Mutex
+    low         map[string]CapacityEvent
+    subscribers map[chan CapacityEvent]bool
+}
+
+func (self CapacityConfig) Open() (*CapacityWatcher, error) {
+    capacityWatcher := &CapacityWatcher{
+        config:         self,
+        low:            make(map[string]CapacityEvent),
+        subscribers:    make(map[chan CapacityEvent]bool),
+    }
+
+    if self.Threshold == 0 {
+        return nil, fmt.Errorf("Capacity threshold must be at least 1")
+    }
+
+    if capacityWatcher.config.Timeout == 0 {
+        capacityWatcher.config.Timeout = 10 * time.Second
+    }
+
+    if capacityWatcher.config.NodeName != "" {
+
+    } else if hostname, err := os.Hostname(); err != nil {
+        return nil, err
+    } else {
+        capacityWatcher.config.NodeName = hostname
+    }
+
+    if self.Webhook != "" {
+        capacityWatcher.client = &http.Client{Timeout: capacityWatcher.config.Timeout}
+    }
+
+    return capacityWatcher, nil
+}
+
+func (self *CapacityWatcher) String() string {
+    return fmt.Sprintf("capacity/%s threshold=%d", self.config.NodeName, self.config.Threshold)
+}
+
+// Return the events for any changed services, and update the low services
+func (self *CapacityWatcher) update(now time.Time, statuses map[string]config.ServiceStatus) []CapacityEvent {
+    var events []CapacityEvent
+    var serviceNames []string
+
+    for serviceName, _ := range statuses {
+        serviceNames = append(serviceNames, serviceName)
+    }
+
+    sort.Strings(serviceNames)
+
+    for _, serviceName := range serviceNames {
+        status := statuses[serviceName]
+        event := CapacityEvent{
+            Node:       self.config.NodeName,
+            Service:    serviceName,
+            Backends:   status.Backends,
+            Threshold:  self.config.Threshold,
+            Low:        status.Backends < self.config.Threshold,
+            Time:       now,
+        }
+
+        if low, exists := self.low[serviceName]; !event.Low && !exists {
+            // ok
+            continue
+        } else if event.Low && exists && low.Backends == event.Backends {
+            // unchanged
+            continue
+        } else if event.Low {
+            self.low[serviceName] = event
+        } else {
+            delete(self.low, serviceName)
+        }
+
+        events = append(events, event)
+    }
+
+    for serviceName, _ := range self.low {
+        if _, exists := statuses[serviceName]; !exists {
+            log.Printf("clusterf:CapacityWatcher %s: forget removed service %s\n", self, serviceName)
+
+            delete(self.low, serviceName)
+        }
+    }
+
+    return events
+}
+
+func (self *CapacityWatcher) webhook(event CapacityEvent) error {
+    var buf bytes.Buffer
+
+    if err := json.NewEncoder(&buf).Encode(event); err != nil {
+        return err
+    }
+
+    response, err := self.client.Post(self.config.Webhook, "application/json", &buf)
+    if err != nil {
+        return fmt.Errorf("webhook: %v", err)
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode >= 200 && response.StatusCode < 300 {
+        return nil
+    } else if body, _ := ioutil.ReadAll(response.Body); len(body) > 0 {
+        return fmt.Errorf("webhook: %s: %s", response.Status, strings.TrimSpace(string(body)))
+    } else {
+        return fmt.Errorf("webhook: %s", response.Status)
+    }
+}
+
+// Publish events for any changed services to the subscribers and webhook
+func (self *CapacityWatcher) Update(statuses map[string]config.ServiceStatus) error {
+    self.mutex.Lock()
+
+    events := self.update(time.Now(), statuses)
+
+    for _, event := range events {
+        log.Printf("clusterf:CapacityWatcher %s: %s backends=%d low=%v\n", self, event.Service, event.Backends, event.Low)
+
+        for subscriber, _ := range self.subscribers {
+            select {
+            case subscriber <- event:
+            default:
+                log.Printf("clusterf:CapacityWatcher %s: drop event for slow subscriber\n", self)
+            }
+        }
+    }
+
+    self.mutex.Unlock()
+
+    if self.client == nil {
+        return nil
+    }
+
+    for _, event := range events {
+        if err := self.webhook(event); err != nil {
+            return fmt.Errorf("%s: %v", event.Service, err)
+        }
+    }
+
+    return nil
+}
+
+// Subscribe to events, starting with the currently low services
+func (self *CapacityWatcher) Subscribe() chan CapacityEvent {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    var subscriber = make(chan CapacityEvent, CAPACITY_BUFFER + len(self.low))
+    var serviceNames []string
+
+    for serviceName, _ := range self.low {
+        serviceNames = append(serviceNames, serviceName)
+    }
+
+    sort.Strings(serviceNames)
+
+    for _, serviceName := range serviceNames {
+        subscriber <- self.low[serviceName]
+    }
+
+    self.subscribers[subscriber] = true
+
+    return subscriber
+}
+
+func (self *CapacityWatcher) Unsubscribe(subscriber chan CapacityEvent) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    delete(self.subscribers, subscriber)
+}
+
+// Stream events as newline-delimited JSON, until the client disconnects
+func (self *CapacityWatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming not supported", http.StatusInternalServerError)
+        return
+    }
+
+    subscriber := self.Subscribe()
+    defer self.Unsubscribe(subscriber)
+
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    encoder := json.NewEncoder(w)
+
+    for {
+        select {
+        case event := <-subscriber:
+            if err := encoder.Encode(event); err != nil {
+                return
+            }
+
+            flusher.Flush()
+
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
@@ -0,0 +1,104 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func TestCapacityWatcher(t *testing.T) {
+    var webhookEvents []CapacityEvent
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var event CapacityEvent
+
+        if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+        } else {
+            webhookEvents = append(webhookEvents, event)
+        }
+    }))
+    defer server.Close()
+
+    capacityWatcher, err := CapacityConfig{NodeName: "test", Threshold: 2, Webhook: server.URL}.Open()
+    if err != nil {
+        t.Fatalf("CapacityConfig.Open: %v", err)
+    }
+
+    for _, step := range []struct{
+        statuses    map[string]config.ServiceStatus
+        events      []string
+    }{
+        {
+            statuses:   map[string]config.ServiceStatus{"web": {Healthy: true, Backends: 3}, "dns": {Healthy: true, Backends: 1}},
+            events:     []string{"dns 1 true"},
+        },
+        {
+            statuses:   map[string]config.ServiceStatus{"web": {Healthy: true, Backends: 3}, "dns": {Healthy: true, Backends: 1}},
+            events:     []string{},
+        },
+        {
+            statuses:   map[string]config.ServiceStatus{"web": {Healthy: true, Backends: 1}, "dns": {Backends: 0}},
+            events:     []string{"dns 0 true", "web 1 true"},
+        },
+        {
+            statuses:   map[string]config.ServiceStatus{"web": {Healthy: true, Backends: 2}},
+            events:     []string{"web 2 false"},
+        },
+    } {
+        webhookEvents = nil
+
+        if err := capacityWatcher.Update(step.statuses); err != nil {
+            t.Errorf("Update %v: %v", step.statuses, err)
+        }
+
+        var events = []string{}
+
+        for _, event := range webhookEvents {
+            if event.Node != "test" || event.Threshold != 2 {
+                t.Errorf("Update %v: invalid event %#v", step.statuses, event)
+            }
+
+            events = append(events, fmt.Sprintf("%s %d %v", event.Service, event.Backends, event.Low))
+        }
+
+        if !reflect.DeepEqual(events, step.events) {
+            t.Errorf("Update %v: events %v != %v", step.statuses, events, step.events)
+        }
+    }
+
+    if len(capacityWatcher.low) != 0 {
+        t.Errorf("low services remain: %v", capacityWatcher.low)
+    }
+}
+
+func TestCapacitySubscribe(t *testing.T) {
+    capacityWatcher, err := CapacityConfig{NodeName: "test", Threshold: 1}.Open()
+    if err != nil {
+        t.Fatalf("CapacityConfig.Open: %v", err)
+    }
+
+    capacityWatcher.Update(map[string]config.ServiceStatus{"web": {Backends: 0}})
+
+    subscriber := capacityWatcher.Subscribe()
+
+    if event := <-subscriber; event.Service != "web" || !event.Low {
+        t.Errorf("initial event: %#v", event)
+    }
+
+    capacityWatcher.Update(map[string]config.ServiceStatus{"web": {Healthy: true, Backends: 1}})
+
+    if event := <-subscriber; event.Service != "web" || event.Low {
+        t.Errorf("recovered event: %#v", event)
+    }
+
+    capacityWatcher.Unsubscribe(subscriber)
+
+    if len(capacityWatcher.subscribers) != 0 {
+        t.Errorf("unsubscribe: %v", capacityWatcher.subscribers)
+    }
+}
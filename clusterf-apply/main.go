@@ -0,0 +1,224 @@
+package main
+
+import (
+    "bytes"
+    "github.com/qmsk/clusterf"
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/flags"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "gopkg.in/yaml.v2"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+)
+
+var (
+    etcdConfig  config.EtcdConfig
+    applyFile   string
+    prune       bool
+    dryRun      bool
+    planURL     string
+    adminTokenFile  string
+    policyConfig    config.PolicyConfig
+)
+
+func init() {
+    flag.StringVar(&etcdConfig.Machines, "etcd-machines", "http://127.0.0.1:2379",
+        "Client endpoint for etcd")
+    flag.StringVar(&etcdConfig.Prefix, "etcd-prefix", "/clusterf",
+        "Etcd tree prefix")
+
+    flag.StringVar(&applyFile, "f", "",
+        "YAML file with the desired services")
+    flag.BoolVar(&prune, "prune", false,
+        "Remove any other backends for the named services")
+    flag.BoolVar(&dryRun, "dry-run", false,
+        "Only list the changes to apply")
+    flag.StringVar(&planURL, "plan-url", "",
+        "Only POST the desired services to the clusterf-ipvs -http-listen /plan URL, e.g. http://127.0.0.1:9100/plan, and write the plan as JSON")
+    flag.StringVar(&adminTokenFile, "admin-token-file", "",
+        "Send the bearer token from the given file to the -plan-url, for the clusterf-ipvs -http-admin-token-file")
+
+    flag.StringVar(&policyConfig.FrontendPrefixes, "policy-frontend-prefixes", "",
+        "Reject frontends with addresses outside of the given CIDR prefixes: prefix[,prefix...]")
+    flag.UintVar(&policyConfig.MaxWeight, "policy-max-weight", 0,
+        "Reject backends with a weight over the given maximum")
+    flag.StringVar(&policyConfig.WebhookURL, "policy-webhook-url", "",
+        "Reject changes unless a POST of the change to the given URL returns 2xx")
+    flag.DurationVar(&policyConfig.WebhookTimeout, "policy-webhook-timeout", 5 * time.Second,
+        "Timeout for the policy webhook")
+}
+
+// Convert the YAML map[interface{}]interface{} values into JSON-compatible map[string]interface{} values
+func convertYAML(value interface{}) interface{} {
+    switch value := value.(type) {
+    case map[interface{}]interface{}:
+        jsonMap := make(map[string]interface{})
+
+        for key, item := range value {
+            jsonMap[fmt.Sprintf("%v", key)] = convertYAML(item)
+        }
+
+        return jsonMap
+
+    case []interface{}:
+        jsonList := make([]interface{}, len(value))
+
+        for i, item := range value {
+            jsonList[i] = convertYAML(item)
+        }
+
+        return jsonList
+
+    default:
+        return value
+    }
+}
+
+// Load the ApplyConfig from YAML, using the same field names as the JSON config
+func loadApplyConfig(path string) (applyConfig config.ApplyConfig, err error) {
+    var yamlValue interface{}
+
+    if buf, err := ioutil.ReadFile(path); err != nil {
+        return applyConfig, err
+    } else if err := yaml.Unmarshal(buf, &yamlValue); err != nil {
+        return applyConfig, fmt.Errorf("%s: %v", path, err)
+    } else if jsonValue, err := json.Marshal(convertYAML(yamlValue)); err != nil {
+        return applyConfig, fmt.Errorf("%s: %v", path, err)
+    } else if err := json.Unmarshal(jsonValue, &applyConfig); err != nil {
+        return applyConfig, fmt.Errorf("%s: %v", path, err)
+    }
+
+    return applyConfig, nil
+}
+
+// Set the 'Authorization: Bearer <token>' header using the -admin-token-file, if any
+func authorizeAdmin(request *http.Request) error {
+    if adminTokenFile == "" {
+        return nil
+    } else if buf, err := ioutil.ReadFile(adminTokenFile); err != nil {
+        return err
+    } else if token := strings.TrimSpace(string(buf)); token == "" {
+        return fmt.Errorf("empty token file: %s", adminTokenFile)
+    } else {
+        request.Header.Set("Authorization", "Bearer " + token)
+    }
+
+    return nil
+}
+
+// POST the desired services to the planURL, returning the plan as JSON
+func requestPlan(applyConfig config.ApplyConfig) ([]byte, clusterf.Plan, error) {
+    var plan clusterf.Plan
+    var query = make(url.Values)
+
+    if prune {
+        query.Set("prune", "true")
+    }
+
+    requestBody, err := json.Marshal(applyConfig)
+    if err != nil {
+        return nil, plan, err
+    }
+
+    request, err := http.NewRequest("POST", planURL + "?" + query.Encode(), bytes.NewReader(requestBody))
+    if err != nil {
+        return nil, plan, err
+    }
+
+    request.Header.Set("Content-Type", "application/json")
+
+    if err := authorizeAdmin(request); err != nil {
+        return nil, plan, err
+    }
+
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+        return nil, plan, err
+    }
+    defer response.Body.Close()
+
+    body, err := ioutil.ReadAll(response.Body)
+    if err != nil {
+        return nil, plan, err
+    } else if response.StatusCode != 200 {
+        return nil, plan, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+    } else if err := json.Unmarshal(body, &plan); err != nil {
+        return nil, plan, err
+    } else if output, err := json.MarshalIndent(plan, "", "  "); err != nil {
+        return nil, plan, err
+    } else {
+        return output, plan, nil
+    }
+}
+
+func main() {
+    flags.Parse()
+
+    if len(flag.Args()) > 0 || applyFile == "" {
+        flag.Usage()
+        os.Exit(1)
+    }
+
+    applyConfig, err := loadApplyConfig(applyFile)
+    if err != nil {
+        log.Fatalf("load %s: %v\n", applyFile, err)
+    }
+
+    if planURL != "" {
+        output, plan, err := requestPlan(applyConfig)
+        if err != nil {
+            log.Fatalf("plan %s: %v\n", planURL, err)
+        }
+
+        fmt.Printf("%s\n", output)
+
+        if len(plan.Errors) > 0 {
+            log.Fatalf("plan %s: errors: %v\n", planURL, plan.Errors)
+        }
+
+        return
+    }
+
+    policy, err := policyConfig.Open()
+    if err != nil {
+        log.Fatalf("config:Policy.Open: %v\n", err)
+    }
+
+    configEtcd, err := etcdConfig.Open()
+    if err != nil {
+        log.Fatalf("config:Etcd.Open: %v\n", err)
+    } else {
+        log.Printf("config:Etcd.Open: %v\n", configEtcd)
+    }
+
+    nodes, err := configEtcd.Nodes()
+    if err != nil {
+        log.Fatalf("config:Etcd.Nodes: %v\n", err)
+    }
+
+    changes, err := applyConfig.Plan(nodes, prune)
+    if err != nil {
+        log.Fatalf("config:ApplyConfig.Plan: %v\n", err)
+    }
+
+    if err := policy.CheckChanges(changes); err != nil {
+        log.Fatalf("config:Policy.CheckChanges: %v\n", err)
+    }
+
+    if dryRun {
+        for _, change := range changes {
+            fmt.Printf("%v\n", change)
+        }
+    } else if err := config.Apply(configEtcd, changes); err != nil {
+        log.Fatalf("config.Apply: %v\n", err)
+    } else {
+        log.Printf("Applied %d changes\n", len(changes))
+    }
+}
@@ -35,10 +35,14 @@ func configContainer (container *docker.Container) (configs []config.Config) {
         }{
             {"tcp", "net.qmsk.clusterf.backend.tcp"},
             {"udp", "net.qmsk.clusterf.backend.udp"},
+            {"sctp", "net.qmsk.clusterf.backend.sctp"},
             {"tcp", fmt.Sprintf("net.qmsk.clusterf.backend:%s.tcp", serviceName)},
             {"udp", fmt.Sprintf("net.qmsk.clusterf.backend:%s.udp", serviceName)},
+            {"sctp", fmt.Sprintf("net.qmsk.clusterf.backend:%s.sctp", serviceName)},
         }
 
+        var portLabelFound bool
+
         for _, portLabel := range portLabels {
             // lookup exposed docker.Port
             portName, labelFound := container.Labels[portLabel.label]
@@ -46,6 +50,8 @@ func configContainer (container *docker.Container) (configs []config.Config) {
                 continue
             }
 
+            portLabelFound = true
+
             port, portFound := containerPorts[fmt.Sprintf("%s:%s", portLabel.proto, portName)]
             if !portFound {
                 log.Printf("configContainer %v: service %v port %v is not exposed\n", container, serviceName, portName)
@@ -58,10 +64,19 @@ func configContainer (container *docker.Container) (configs []config.Config) {
                 configBackend.Backend.TCP = port.Port
             case "udp":
                 configBackend.Backend.UDP = port.Port
+            case "sctp":
+                configBackend.Backend.SCTP = port.Port
             }
         }
 
-        if configBackend.Backend.TCP != 0 || configBackend.Backend.UDP != 0 {
+        if !portLabelFound {
+            log.Printf("configContainer %v: service %v without port labels uses the frontend ports\n", container, serviceName)
+        } else if configBackend.Backend.TCP == 0 && configBackend.Backend.UDP == 0 && configBackend.Backend.SCTP == 0 {
+            // only skip the service if none of the labelled ports are exposed
+            continue
+        }
+
+        if configBackend.Backend.IPv4 != "" {
             configs = append(configs, configBackend)
         }
     }
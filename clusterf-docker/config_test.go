@@ -0,0 +1,45 @@
+package main
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/docker"
+    "net"
+    "testing"
+)
+
+func TestConfigContainer(t *testing.T) {
+    for _, test := range []struct{
+        labels  map[string]string
+        backend *config.ServiceBackend
+    }{
+        // unlabelled ports default to the frontend ports
+        {map[string]string{"net.qmsk.clusterf.service": "test"}, &config.ServiceBackend{IPv4: "172.17.0.2"}},
+        {map[string]string{"net.qmsk.clusterf.service": "test", "net.qmsk.clusterf.backend.tcp": "8080"}, &config.ServiceBackend{IPv4: "172.17.0.2", TCP: 8080}},
+        {map[string]string{"net.qmsk.clusterf.service": "test", "net.qmsk.clusterf.backend:test.tcp": "8080", "net.qmsk.clusterf.backend.udp": "53"}, &config.ServiceBackend{IPv4: "172.17.0.2", TCP: 8080}},
+
+        // labelled ports that are not exposed
+        {map[string]string{"net.qmsk.clusterf.service": "test", "net.qmsk.clusterf.backend.tcp": "80"}, nil},
+        {map[string]string{"net.qmsk.clusterf.service": "test", "net.qmsk.clusterf.backend.udp": "53"}, nil},
+    } {
+        container := &docker.Container{
+            ID:     "test1",
+            IPv4:   net.ParseIP("172.17.0.2"),
+            Ports:  []docker.Port{{Proto: "tcp", Port: 8080}},
+            Labels: test.labels,
+        }
+
+        configs := configContainer(container)
+
+        if test.backend == nil {
+            if len(configs) != 0 {
+                t.Errorf("configContainer %v: unexpected configs: %v", test.labels, configs)
+            }
+        } else if len(configs) != 1 {
+            t.Errorf("configContainer %v: configs: %v", test.labels, configs)
+        } else if configBackend, ok := configs[0].(config.ConfigServiceBackend); !ok {
+            t.Errorf("configContainer %v: config: %#v", test.labels, configs[0])
+        } else if configBackend.ServiceName != "test" || configBackend.BackendName != "test1" || configBackend.Backend != *test.backend {
+            t.Errorf("configContainer %v: backend: %#v", test.labels, configBackend)
+        }
+    }
+}
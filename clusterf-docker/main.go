@@ -3,7 +3,9 @@ package main
 import (
     "github.com/qmsk/clusterf/config"
     "github.com/qmsk/clusterf/docker"
+    "github.com/qmsk/clusterf/flags"
     "flag"
+    "github.com/qmsk/clusterf/logging"
     "log"
     "os"
 )
@@ -11,6 +13,7 @@ import (
 var (
     dockerConfig docker.DockerConfig
     etcdConfig  config.EtcdConfig
+    logConfig   logging.Config
 )
 
 func init() {
@@ -21,6 +24,8 @@ func init() {
         "Client endpoint for etcd")
     flag.StringVar(&etcdConfig.Prefix, "etcd-prefix", "/clusterf",
         "Etcd tree prefix")
+
+    logConfig.Flags(flag.CommandLine)
 }
 
 type self struct {
@@ -67,13 +72,17 @@ func main() {
         containers:    make(map[string]*containerState),
     }
 
-    flag.Parse()
+    flags.Parse()
 
     if len(flag.Args()) > 0 {
         flag.Usage()
         os.Exit(1)
     }
 
+    if err := logConfig.Setup(); err != nil {
+        log.Fatalf("logging: %v\n", err)
+    }
+
     if configEtcd, err := etcdConfig.Open(); err != nil {
         log.Fatalf("config:etcd.Open: %v\n", err)
     } else {
@@ -3,9 +3,26 @@ package main
 import (
     "github.com/qmsk/clusterf/config"
     "github.com/qmsk/clusterf"
+    "github.com/qmsk/clusterf/conntrack"
+    "github.com/qmsk/clusterf/errs"
+    "github.com/qmsk/clusterf/flags"
+    "encoding/json"
+    "errors"
     "flag"
+    "github.com/qmsk/clusterf/ipvs"
+    "github.com/qmsk/clusterf/logging"
+    "github.com/qmsk/clusterf/tasks"
+    "fmt"
+    "io/ioutil"
     "log"
+    "net"
+    "net/http"
     "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
 )
 
 var (
@@ -13,8 +30,38 @@ var (
     etcdConfig  config.EtcdConfig
     ipvsConfig  clusterf.IpvsConfig
     ipvsConfigPrint bool
+    ipvsStatsInterval   time.Duration
+    httpListen  string
+    httpPprof   pprofConfig
+    httpResourcesTokenFile  string
+    httpAdminTokenFile  string
     advertiseRouteConfig     config.ConfigRoute
     filterEtcdRoutes    bool
+    shardSpec   string
+    limits      clusterf.Limits
+    tasksConfig     tasks.Config
+    tasksInterval   time.Duration
+    policyConfig    config.PolicyConfig
+    configPolicy    *config.Policy
+    freezeConfig    config.FreezeConfig
+    configFreeze    *config.Freeze
+    hooksConfig     config.HooksConfig
+    configHooks     *config.Hooks
+    recordConfig    config.RecordConfig
+    cacheConfig     config.CacheConfig
+    etcdStartup     string
+    etcdStartupWait time.Duration
+    conntrackLogConfig  conntrack.LogConfig
+    injectConfig    clusterf.InjectConfig
+    statusPublish   bool
+    statusConfig    clusterf.StatusConfig
+    statusInterval  time.Duration
+    capacityConfig  clusterf.CapacityConfig
+    capacityInterval    time.Duration
+    shiftInterval   time.Duration
+    localInterval   time.Duration
+    pinInterval     time.Duration
+    logConfig       logging.Config
 )
 
 func init() {
@@ -25,15 +72,74 @@ func init() {
         "Client endpoint for etcd")
     flag.StringVar(&etcdConfig.Prefix, "etcd-prefix", "/clusterf",
         "Etcd tree prefix")
+    flag.DurationVar(&etcdConfig.WatchBackoff, "etcd-watch-backoff", 1 * time.Second,
+        "Initial backoff for retrying etcd watch errors")
+    flag.DurationVar(&etcdConfig.WatchBackoffMax, "etcd-watch-backoff-max", 60 * time.Second,
+        "Maximum backoff for retrying etcd watch errors")
 
     flag.BoolVar(&ipvsConfig.Debug, "ipvs-debug", false,
-        "IPVS debugging")
+        "IPVS debugging, also toggled at runtime using SIGUSR1 or POST /debug")
         flag.BoolVar(&ipvsConfigPrint, "ipvs-print", false,
         "Dump initial IPVS config")
     flag.StringVar(&ipvsConfig.FwdMethod, "ipvs-fwd-method", "masq",
         "IPVS Forwarding method: masq tunnel droute")
+    flag.BoolVar(&ipvsConfig.IPv6Only, "ipvs-ipv6-only", false,
+        "Refuse any IPv4 frontends and backends, for IPv6-only deployments")
+    flag.StringVar(&ipvsConfig.TunType, "ipvs-tun-type", "",
+        "IPVS tunnel encapsulation for tunnel dests: ipip gue gre (linux 5.2+)")
+    flag.UintVar(&ipvsConfig.TunPort, "ipvs-tun-port", 0,
+        "IPVS tunnel UDP port for -ipvs-tun-type=gue")
+    flag.StringVar(&ipvsConfig.TunFlags, "ipvs-tun-flags", "",
+        "IPVS tunnel checksum for -ipvs-tun-type=gue or gre: nocsum csum remcsum (linux 5.3+)")
     flag.StringVar(&ipvsConfig.SchedName, "ipvs-sched-name", clusterf.IPVS_SCHED_NAME,
         "IPVS Service Scheduler")
+    flag.DurationVar(&ipvsConfig.TimeoutTCP, "ipvs-timeout-tcp", 0,
+        "Set the IPVS TCP connection timeout, like ipvsadm --set (default unchanged)")
+    flag.DurationVar(&ipvsConfig.TimeoutTCPFin, "ipvs-timeout-tcpfin", 0,
+        "Set the IPVS TCP connection timeout after a FIN, like ipvsadm --set (default unchanged)")
+    flag.DurationVar(&ipvsConfig.TimeoutUDP, "ipvs-timeout-udp", 0,
+        "Set the IPVS UDP timeout, like ipvsadm --set (default unchanged)")
+    flag.StringVar(&ipvsConfig.Netns, "ipvs-netns", "",
+        "Manage the IPVS table of the network namespace at the given path, e.g. /var/run/netns/$name (default current)")
+    flag.DurationVar(&ipvsConfig.CommandTimeout, "ipvs-command-timeout", 0,
+        "Fail any IPVS service or dest command taking longer than the timeout, e.g. a stuck netlink dump (default none)")
+    flag.StringVar(&ipvsConfig.SyncMaster, "ipvs-sync-master", "",
+        "Start the IPVS master connection sync daemon on the given multicast interface")
+    flag.StringVar(&ipvsConfig.SyncBackup, "ipvs-sync-backup", "",
+        "Start the IPVS backup connection sync daemon on the given multicast interface")
+    flag.UintVar(&ipvsConfig.SyncID, "ipvs-sync-id", 0,
+        "Sync ID for the IPVS connection sync daemons")
+    flag.StringVar(&ipvsConfig.NodeName, "ipvs-node-name", "",
+        "Node name for consistent hashing of backend subsets (default hostname)")
+    flag.StringVar(&ipvsConfig.ApplyOrder, "ipvs-apply-order", clusterf.ApplyAddFirst,
+        "Order of changes when replacing services or backends: add-first or del-first")
+    flag.BoolVar(&ipvsConfig.Strict, "ipvs-strict", false,
+        "Reject any overlapping IPVS services and dests of different frontends and backends, instead of merging them")
+    flag.StringVar(&ipvsConfig.NftPath, "ipvs-nft-path", clusterf.NFT_PATH,
+        "nft command for frontend mirror, allow and deny rules")
+    flag.StringVar(&ipvsConfig.IPPath, "ipvs-ip-path", clusterf.INJECT_IP_PATH,
+        "ip command for the local addresses of any frontends with an interface")
+    flag.BoolVar(&ipvsConfig.KubeProxy, "ipvs-kube-proxy", false,
+        "Never modify or flush any kube-proxy IPVS services on the same node")
+    flag.StringVar(&ipvsConfig.KubeProxyDev, "ipvs-kube-proxy-dev", clusterf.KUBE_PROXY_DEV,
+        "kube-proxy dummy interface, with the addresses of the kube-proxy services")
+    flag.StringVar(&ipvsConfig.KubeProxyPorts, "ipvs-kube-proxy-ports", clusterf.KUBE_PROXY_PORTS,
+        "kube-proxy NodePort range: min-max")
+
+    flag.DurationVar(&ipvsStatsInterval, "ipvs-stats-interval", 10 * time.Second,
+        "Interval for updating IPVS stats")
+    flag.StringVar(&httpListen, "http-listen", "",
+        "Serve HTTP /metrics, /version, /stats, /experiments, /vips, /dests, /capacity, /trace, /conns, /pin, /resources/, POST /plan, POST /resync, POST /verify and POST /zero on [host]:port")
+    flag.StringVar(&httpResourcesTokenFile, "http-resources-token-file", "",
+        "Allow -http-listen /resources/ PUT and DELETE for requests with an 'Authorization: Bearer <token>' header, using the tokens from the given file, one per line, each followed by any service name prefixes it is limited to; default: read-only")
+    flag.StringVar(&httpAdminTokenFile, "http-admin-token-file", "",
+        "Allow the -http-listen POST /freeze, /resync, /zero, /verify, /debug, /plan and POST or DELETE /pin for requests with an 'Authorization: Bearer <token>' header, using the token from the given file; default: refused")
+    flag.StringVar(&httpPprof.TokenFile, "http-pprof-token-file", "",
+        "Serve the -http-listen /debug/pprof/ profiles for requests with an 'Authorization: Bearer <token>' header, using the token from the given file")
+    flag.IntVar(&httpPprof.MutexFraction, "http-pprof-mutex-fraction", 100,
+        "Sample 1/n of the contended mutexes for /debug/pprof/mutex, with -http-pprof-token-file")
+    flag.IntVar(&httpPprof.BlockRate, "http-pprof-block-rate", 0,
+        "Sample blocking events of at least the given nanoseconds for /debug/pprof/block, with -http-pprof-token-file; default: disabled")
 
     flag.StringVar(&advertiseRouteConfig.RouteName, "advertise-route-name", "",
         "Advertise route by name")
@@ -46,6 +152,111 @@ func init() {
 
     flag.BoolVar(&filterEtcdRoutes, "filter-etcd-routes", false,
         "Filter out etcd routes")
+
+    flag.StringVar(&shardSpec, "shard", "",
+        "Only handle the shard of services with a name hash modulo count equal to index: index[,index...]/count")
+
+    flag.IntVar(&limits.Services, "limit-services", 0,
+        "Reject any new services over the given number of services (default unlimited)")
+    flag.IntVar(&limits.Backends, "limit-backends", 0,
+        "Reject any new backends over the given number of backends per service (default unlimited)")
+
+    flag.IntVar(&tasksConfig.Goroutines, "soft-limit-goroutines", 10000,
+        "Warn once the process has more than the given number of goroutines; 0 to disable")
+    flag.IntVar(&tasksConfig.FDs, "soft-limit-fds", 0,
+        "Warn once the process has more than the given number of open files (default 80% of the RLIMIT_NOFILE)")
+    flag.DurationVar(&tasksInterval, "soft-limit-interval", 10 * time.Second,
+        "Interval for checking the -soft-limit-goroutines and -soft-limit-fds")
+
+    flag.StringVar(&policyConfig.FrontendPrefixes, "policy-frontend-prefixes", "",
+        "Reject etcd frontends with addresses outside of the given CIDR prefixes: prefix[,prefix...]")
+    flag.UintVar(&policyConfig.MaxWeight, "policy-max-weight", 0,
+        "Reject etcd backends with a weight over the given maximum")
+    flag.StringVar(&policyConfig.WebhookURL, "policy-webhook-url", "",
+        "Reject etcd config changes unless a POST of the change to the given URL returns 2xx")
+    flag.DurationVar(&policyConfig.WebhookTimeout, "policy-webhook-timeout", 5 * time.Second,
+        "Timeout for the policy webhook")
+    flag.StringVar(&policyConfig.StatePath, "policy-state-path", "",
+        "Persist the last admitted etcd configs to the given file, keeping any rejected changes ignored across restarts")
+
+    flag.StringVar(&freezeConfig.Windows, "freeze-windows", "",
+        "Queue any etcd config changes during the given windows, and apply them once the window ends: minute hour day month weekday duration[;...]")
+
+    flag.StringVar(&hooksConfig.PreExec, "hook-pre-exec", "",
+        "Run the given shell command before applying etcd config changes to any hooked services")
+    flag.StringVar(&hooksConfig.PostExec, "hook-post-exec", "",
+        "Run the given shell command after applying etcd config changes to any hooked services")
+    flag.StringVar(&hooksConfig.PreURL, "hook-pre-url", "",
+        "POST etcd config changes to any hooked services to the given URL before applying them")
+    flag.StringVar(&hooksConfig.PostURL, "hook-post-url", "",
+        "POST etcd config changes to any hooked services to the given URL after applying them")
+    flag.StringVar(&hooksConfig.Services, "hook-services", "",
+        "Only run the hooks for the given services: name[,name...] (default all)")
+    flag.DurationVar(&hooksConfig.Timeout, "hook-timeout", 10 * time.Second,
+        "Timeout for each hook")
+    flag.StringVar(&hooksConfig.Failure, "hook-failure", config.HOOK_ABORT,
+        "Skip the change if any pre hook fails (abort), or apply it anyways (continue)")
+
+    flag.StringVar(&recordConfig.Path, "record-path", "",
+        "Record the raw etcd config events to the given file, for clusterf replay")
+    flag.Int64Var(&recordConfig.MaxSize, "record-max-size", config.RECORD_MAX_SIZE,
+        "Rotate the -record-path file to .1 once over the given size in bytes")
+
+    flag.StringVar(&cacheConfig.Path, "etcd-cache-path", "",
+        "Cache the etcd config tree to the given file, for -etcd-startup")
+    flag.StringVar(&etcdStartup, "etcd-startup", "cached",
+        "Startup if etcd is unreachable: fail, cached (start with any -etcd-cache-path, or fail), degraded (start with any -etcd-cache-path, or without any etcd config)")
+    flag.DurationVar(&etcdStartupWait, "etcd-startup-wait", 0,
+        "Retry the initial etcd scan for up to the given time, before falling back to the -etcd-startup")
+
+    flag.StringVar(&conntrackLogConfig.Path, "conntrack-log", "",
+        "Log connections to the IPVS services from conntrack events to the given file, or - for stdout")
+
+    flag.BoolVar(&statusPublish, "status-publish", false,
+        "Publish the VIPs and health of each service into etcd at status/<node>/<service>, for external integrations")
+    flag.DurationVar(&statusConfig.TTL, "status-ttl", clusterf.STATUS_TTL,
+        "Expire the published status of a stopped node after the given TTL")
+    flag.DurationVar(&statusInterval, "status-interval", 10 * time.Second,
+        "Interval for publishing any changed service statuses")
+
+    flag.UintVar(&capacityConfig.Threshold, "capacity-threshold", 0,
+        "Publish capacity events for autoscalers whenever a service has fewer than the given number of active backends")
+    flag.StringVar(&capacityConfig.Webhook, "capacity-webhook", "",
+        "POST each capacity event to the given URL as JSON")
+    flag.DurationVar(&capacityConfig.Timeout, "capacity-webhook-timeout", 10 * time.Second,
+        "Timeout for the -capacity-webhook")
+    flag.DurationVar(&capacityInterval, "capacity-interval", 10 * time.Second,
+        "Interval for checking the active backends of each service for -capacity-threshold")
+
+    flag.DurationVar(&shiftInterval, "shift-interval", 10 * time.Second,
+        "Interval for updating the backend weights of any services shifting between groups")
+    flag.DurationVar(&localInterval, "local-interval", 10 * time.Second,
+        "Interval for checking the listening sockets of the local backends of any frontends with an interface")
+    flag.DurationVar(&pinInterval, "pin-interval", 10 * time.Second,
+        "Interval for removing any expired client pins")
+
+    logConfig.Flags(flag.CommandLine)
+
+    flag.BoolVar(&injectConfig.Routes, "inject-routes", false,
+        "Inject kernel routes for the VIPs of the services with any active backends")
+    flag.StringVar(&injectConfig.RouteTable, "inject-route-table", clusterf.INJECT_ROUTE_TABLE,
+        "Kernel routing table for -inject-routes")
+    flag.StringVar(&injectConfig.RouteDev, "inject-route-dev", clusterf.INJECT_ROUTE_DEV,
+        "Interface for -inject-routes")
+    flag.StringVar(&injectConfig.RouteProto, "inject-route-proto", clusterf.INJECT_ROUTE_PROTO,
+        "Routing protocol for -inject-routes, used to flush any old routes on startup")
+    flag.StringVar(&injectConfig.BirdPath, "inject-bird-path", "",
+        "Write bird static routes for the VIPs of the services with any active backends to the given file")
+    flag.StringVar(&injectConfig.BirdReload, "inject-bird-reload", "",
+        "Run the given shell command after writing the -inject-bird-path, e.g. 'birdc configure'")
+    flag.StringVar(&injectConfig.AddrDev, "inject-addr-dev", "",
+        "Add the VIPs of the frontends with \"announce\": \"addr\" as interface addresses on the given interface, for failover VIPs")
+    flag.BoolVar(&injectConfig.AddrArping, "inject-addr-arping", false,
+        "Send a gratuitous ARP for each IPv4 address added by -inject-addr-dev")
+    flag.StringVar(&injectConfig.Exec, "inject-exec", "",
+        "Run the given shell command with 'up <vip>', 'down <vip>' and 'flush' for the VIPs of the frontends with \"announce\": \"exec\", e.g. for VRRP or BGP speakers")
+    flag.StringVar(&injectConfig.Announce, "inject-announce", "",
+        "Comma-separated announcers for the VIPs of any frontends without an announce option: route, bird, addr, exec (default route and/or bird)")
 }
 
 // Apply filtering for etcdConfig sourced Config's
@@ -56,25 +267,681 @@ func filterConfigEtcd(baseConfig config.Config) bool {
         if filterEtcdRoutes {
             return true
         }
+    case *config.ConfigStatus:
+        // published for external integrations, not used by clusterf itself
+        return true
     }
 
     return false
 }
 
+// Apply the admission policy for etcdConfig sourced Config changes
+// Returns false if the change is rejected, and should be ignored
+func admitConfigEtcd(action config.Action, baseConfig config.Config) bool {
+    if err := configPolicy.Admit(action, baseConfig); err != nil {
+        log.Printf("config:Policy.Admit %s: %v\n", action, err)
+        return false
+    } else {
+        return true
+    }
+}
+
+// Apply the admission policy for a full scan of the etcdConfig sourced Configs
+// Any rejected configs are replaced by the last admitted config
+// Fails if the policy webhook is unreachable
+func admitConfigsEtcd(configs []config.Config) ([]config.Config, error) {
+    return configPolicy.AdmitScan(filterConfigsEtcd(configs))
+}
+
+// Skip any etcdConfig sourced Configs rejected by the filter
+func filterConfigsEtcd(configs []config.Config) []config.Config {
+    var filterConfigs []config.Config
+
+    for _, cfg := range configs {
+        if !filterConfigEtcd(cfg) {
+            filterConfigs = append(filterConfigs, cfg)
+        }
+    }
+
+    return filterConfigs
+}
+
+// Apply the initial etcd configs, without running any hooks
+// Fails before applying any configs if the policy webhook is unreachable
+func newConfigsEtcd(services *clusterf.Services, configs []config.Config) error {
+    newConfigs, err := admitConfigsEtcd(configs)
+    if err != nil {
+        return fmt.Errorf("config:Policy.AdmitScan: %s", err)
+    }
+
+    configHooks.Scan(newConfigs)
+
+    for _, cfg := range newConfigs {
+        services.NewConfig(cfg)
+    }
+
+    return nil
+}
+
+// Return the cached etcd configs, for starting while etcd is unreachable
+func loadCache(configCache *config.Cache) ([]config.Config, error) {
+    if configCache == nil {
+        return nil, fmt.Errorf("no -etcd-cache-path")
+    } else if configs, cacheTime, err := configCache.Load(); err != nil {
+        return nil, fmt.Errorf("config:Cache.Load: %s", err)
+    } else {
+        log.Printf("config:Cache.Load: %d configs from %v\n", len(configs), cacheTime)
+
+        return configs, nil
+    }
+}
+
+// Scan the current configs, skipping any etcd configs rejected by the filter, and keeping the last admitted etcd config for any rejected by the policy
+func scanConfigs(configFiles *config.Files, configEtcd *config.Etcd) ([]config.Config, error) {
+    var configs []config.Config
+
+    if configFiles == nil {
+
+    } else if fileConfigs, err := configFiles.Scan(); err != nil {
+        return nil, fmt.Errorf("config:Files.Scan: %s", err)
+    } else {
+        configs = append(configs, fileConfigs...)
+    }
+
+    if configEtcd == nil {
+
+    } else if etcdConfigs, err := configEtcd.List(); err != nil {
+        return nil, fmt.Errorf("config:Etcd.List: %s", err)
+    } else if admitConfigs, err := admitConfigsEtcd(etcdConfigs); err != nil {
+        return nil, fmt.Errorf("config:Policy.AdmitScan: %s", err)
+    } else {
+        configs = append(configs, admitConfigs...)
+    }
+
+    return configs, nil
+}
+
+// Scan the current configs like scanConfigs, checking the etcd configs against the policy without admitting them, for a dry run
+func planConfigs(configFiles *config.Files, configEtcd *config.Etcd) ([]config.Config, error) {
+    var configs []config.Config
+
+    if configFiles == nil {
+
+    } else if fileConfigs, err := configFiles.Scan(); err != nil {
+        return nil, fmt.Errorf("config:Files.Scan: %s", err)
+    } else {
+        configs = append(configs, fileConfigs...)
+    }
+
+    if configEtcd == nil {
+
+    } else if etcdConfigs, err := configEtcd.List(); err != nil {
+        return nil, fmt.Errorf("config:Etcd.List: %s", err)
+    } else if checkConfigs, err := configPolicy.CheckScan(filterConfigsEtcd(etcdConfigs)); err != nil {
+        return nil, fmt.Errorf("config:Policy.CheckScan: %s", err)
+    } else {
+        configs = append(configs, checkConfigs...)
+    }
+
+    return configs, nil
+}
+
+// Re-scan the full config, and verify the IPVS state against it
+func resync(services *clusterf.Services, ipvsDriver *clusterf.IPVSDriver, configFiles *config.Files, configEtcd *config.Etcd) {
+    configs, err := scanConfigs(configFiles, configEtcd)
+    if err != nil {
+        log.Printf("resync: %s\n", err)
+        return
+    }
+
+    log.Printf("resync: %d configs\n", len(configs))
+
+    // run the hooks for any changes, keeping the previous config for any aborted changes
+    configs, events := configHooks.Resync(configs)
+
+    services.Resync(configs)
+
+    for _, event := range events {
+        configHooks.Post(event)
+    }
+
+    if repairs, err := ipvsDriver.Verify(); err != nil {
+        log.Printf("resync: IPVSDriver.Verify: %s\n", err)
+    } else {
+        log.Printf("resync: IPVSDriver.Verify: %d repairs\n", repairs)
+    }
+}
+
+// Publish the -shard and -advertise-route-* into etcd
+func advertise(configEtcd *config.Etcd) {
+    if shardSpec == "" {
+
+    } else if err := configEtcd.Publish(config.ConfigShard{NodeName: ipvsConfig.NodeName, Shard: config.Shard{Shard: shardSpec}}); err != nil {
+        log.Fatalf("config:Etcd.Publish shard %s: %v\n", shardSpec, err)
+    } else {
+        log.Printf("config:Etcd.Publish shard %s\n", shardSpec)
+    }
+
+    if advertiseRouteConfig.RouteName == "" {
+
+    } else if err := configEtcd.Publish(advertiseRouteConfig); err != nil {
+        log.Fatalf("config:Etcd.Publish advertiseRoute %#v: %v\n", advertiseRouteConfig, err)
+    } else {
+        log.Printf("config:Etcd.Publish advertiseRoute %#v\n", advertiseRouteConfig)
+    }
+}
+
+// Trigger a resync via HTTP POST, waiting for it to complete, unless deferred by a freeze window
+type resyncHandler func() (deferred bool, ok bool)
+
+func (self resyncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "POST only", http.StatusMethodNotAllowed)
+    } else if deferred, ok := self(); !ok {
+        http.Error(w, "stopped", http.StatusServiceUnavailable)
+    } else if deferred {
+        http.Error(w, "Resync deferred until the freeze window ends, or POST /freeze", http.StatusAccepted)
+    } else {
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// Require the -http-admin-token-file bearer token for any requests other than GET
+type adminHandler struct {
+    handler     http.Handler
+    token       string  // empty if refused
+}
+
+func (self adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "GET" || r.Method == "HEAD" {
+        self.handler.ServeHTTP(w, r)
+    } else if self.token == "" {
+        http.Error(w, "Refused without -http-admin-token-file", http.StatusForbidden)
+    } else if !bearerAuthorized(r, self.token) {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    } else {
+        self.handler.ServeHTTP(w, r)
+    }
+}
+
+// Reset the IPVS counters via HTTP POST, for all services or the ?service=name
+type zeroHandler func(serviceName string) (int, error)
+
+func (self zeroHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "POST only", http.StatusMethodNotAllowed)
+    } else if count, err := self(r.FormValue("service")); err != nil && errs.Classify(err) == errs.Config {
+        http.Error(w, err.Error(), http.StatusNotFound)
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    } else {
+        log.Printf("zero %s: %d services\n", r.FormValue("service"), count)
+
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// Verify the IPVS services for the ?service=name via HTTP POST, or only the dests for the &backend=name
+type verifyHandler func(serviceName string, backendName string) (int, error)
+
+func (self verifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "POST only", http.StatusMethodNotAllowed)
+    } else if r.FormValue("service") == "" {
+        http.Error(w, "Missing service=", http.StatusBadRequest)
+    } else if repairs, err := self(r.FormValue("service"), r.FormValue("backend")); err != nil && errs.Classify(err) == errs.Config {
+        http.Error(w, err.Error(), http.StatusNotFound)
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    } else {
+        log.Printf("verify %s/%s: %d repairs\n", r.FormValue("service"), r.FormValue("backend"), repairs)
+
+        fmt.Fprintf(w, "%d\n", repairs)
+    }
+}
+
+// Trace the client through the services of the vip via HTTP GET ?client=&vip=[&port=]
+type traceHandler func(client net.IP, vip net.IP, port uint16) ([]clusterf.TraceResult, error)
+
+func (self traceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var port uint64
+
+    client := net.ParseIP(r.FormValue("client"))
+    vip := net.ParseIP(r.FormValue("vip"))
+
+    if r.Method != "GET" {
+        http.Error(w, "GET only", http.StatusMethodNotAllowed)
+        return
+    } else if client == nil {
+        http.Error(w, fmt.Sprintf("Invalid client=%#v", r.FormValue("client")), http.StatusBadRequest)
+        return
+    } else if vip == nil {
+        http.Error(w, fmt.Sprintf("Invalid vip=%#v", r.FormValue("vip")), http.StatusBadRequest)
+        return
+    } else if r.FormValue("port") == "" {
+
+    } else if value, err := strconv.ParseUint(r.FormValue("port"), 10, 16); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid port=%#v", r.FormValue("port")), http.StatusBadRequest)
+        return
+    } else {
+        port = value
+    }
+
+    if results, err := self(client, vip, uint16(port)); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    } else if len(results) == 0 {
+        http.Error(w, fmt.Sprintf("No services for vip %s", vip), http.StatusNotFound)
+    } else {
+        w.Header().Set("Content-Type", "application/json")
+
+        if err := json.NewEncoder(w).Encode(results); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+    }
+}
+
+// List the client pins via HTTP GET, pin a client via POST ?service=&backend=&client=[&ttl=], or unpin via DELETE ?service=&client=
+type pinHandler struct {
+    pin     func(serviceName string, backendName string, client net.IP, ttl time.Duration) (clusterf.PinStatus, error)
+    unpin   func(serviceName string, client net.IP) error
+    pins    func() ([]clusterf.PinStatus, error)
+}
+
+func (self pinHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var ttl time.Duration
+    var result interface{}
+    var err error
+
+    client := net.ParseIP(r.FormValue("client"))
+
+    if r.Method == "GET" {
+
+    } else if r.Method != "POST" && r.Method != "DELETE" {
+        http.Error(w, "GET, POST or DELETE only", http.StatusMethodNotAllowed)
+        return
+    } else if r.FormValue("service") == "" {
+        http.Error(w, "Missing service=", http.StatusBadRequest)
+        return
+    } else if client == nil {
+        http.Error(w, fmt.Sprintf("Invalid client=%#v", r.FormValue("client")), http.StatusBadRequest)
+        return
+    } else if r.Method == "DELETE" {
+
+    } else if r.FormValue("backend") == "" {
+        http.Error(w, "Missing backend=", http.StatusBadRequest)
+        return
+    } else if r.FormValue("ttl") == "" {
+
+    } else if value, err := time.ParseDuration(r.FormValue("ttl")); err != nil || value <= 0 || value > clusterf.PIN_TTL_MAX {
+        http.Error(w, fmt.Sprintf("Invalid ttl=%#v: must be at most %v", r.FormValue("ttl"), clusterf.PIN_TTL_MAX), http.StatusBadRequest)
+        return
+    } else {
+        ttl = value
+    }
+
+    switch r.Method {
+    case "GET":
+        result, err = self.pins()
+    case "POST":
+        result, err = self.pin(r.FormValue("service"), r.FormValue("backend"), client, ttl)
+    case "DELETE":
+        err = self.unpin(r.FormValue("service"), client)
+    }
+
+    if err != nil && errs.Classify(err) == errs.Config {
+        http.Error(w, err.Error(), http.StatusNotFound)
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    } else if result == nil {
+        log.Printf("unpin %s: %s\n", r.FormValue("service"), client)
+
+        w.WriteHeader(http.StatusNoContent)
+    } else {
+        if r.Method == "POST" {
+            log.Printf("pin %s/%s: %s\n", r.FormValue("service"), r.FormValue("backend"), client)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+
+        if err := json.NewEncoder(w).Encode(result); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+    }
+}
+
+// Plan the changes for the desired services via HTTP POST of the JSON config, as used by clusterf-apply, with any ?prune=true
+type planHandler func(applyConfig config.ApplyConfig, prune bool) (clusterf.Plan, error)
+
+func (self planHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var applyConfig config.ApplyConfig
+    var prune bool
+
+    if r.Method != "POST" {
+        http.Error(w, "POST only", http.StatusMethodNotAllowed)
+        return
+    } else if r.URL.Query().Get("prune") == "" {
+
+    } else if value, err := strconv.ParseBool(r.URL.Query().Get("prune")); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid prune=%#v", r.URL.Query().Get("prune")), http.StatusBadRequest)
+        return
+    } else {
+        prune = value
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&applyConfig); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+    } else if plan, err := self(applyConfig, prune); err != nil && errs.Classify(err) == errs.Config {
+        http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    } else {
+        log.Printf("plan: %d changes, %d operations\n", len(plan.Changes), len(plan.Operations))
+
+        w.Header().Set("Content-Type", "application/json")
+
+        if err := json.NewEncoder(w).Encode(plan); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+    }
+}
+
+// CRUD for the service, server and route resources via HTTP GET, PUT and DELETE of /resources/$id, or GET of a collection, e.g.
+// /resources/services or /resources/services/$service/backends, as used by infrastructure-as-code tools.
+//
+// The PUT and DELETE writes require a bearer token, and are refused if no tokens are configured. Any token with service name prefixes
+// can only write the services and servers of the matching services, and not any routes.
+type resourcesHandler struct {
+    resources   *config.Resources
+    tokens      []resourcesToken    // empty if read-only
+}
+
+type resourcesToken struct {
+    token       string
+    prefixes    []string    // nil for all resources
+}
+
+// Read the tokens from the file, one per line, each followed by any whitespace-separated service name prefixes
+func readResourcesTokens(path string) ([]resourcesToken, error) {
+    var tokens []resourcesToken
+
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, line := range strings.Split(string(buf), "\n") {
+        fields := strings.Fields(line)
+
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+            continue
+        } else if len(fields) == 1 {
+            tokens = append(tokens, resourcesToken{token: fields[0]})
+        } else {
+            tokens = append(tokens, resourcesToken{token: fields[0], prefixes: fields[1:]})
+        }
+    }
+
+    if len(tokens) == 0 {
+        return nil, fmt.Errorf("empty token file: %s", path)
+    }
+
+    return tokens, nil
+}
+
+// The token allows writing the resource
+func (self resourcesToken) allows(id string) bool {
+    if self.prefixes == nil {
+        return true
+    } else if serviceName := config.ResourceServiceName(id); serviceName == "" {
+        return false
+    } else {
+        for _, prefix := range self.prefixes {
+            if strings.HasPrefix(serviceName, prefix) {
+                return true
+            }
+        }
+
+        return false
+    }
+}
+
+// Return the token of the request, or nil if unauthorized
+func (self resourcesHandler) authorize(r *http.Request) *resourcesToken {
+    for i, token := range self.tokens {
+        if bearerAuthorized(r, token.token) {
+            return &self.tokens[i]
+        }
+    }
+
+    return nil
+}
+
+func (self resourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var result interface{}
+    var err error
+
+    id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/resources/"), "/")
+
+    if self.resources == nil {
+        http.Error(w, "Resources require the etcd config", http.StatusNotFound)
+        return
+    }
+
+    if r.Method != "PUT" && r.Method != "DELETE" {
+
+    } else if len(self.tokens) == 0 {
+        http.Error(w, "Resources are read-only without -http-resources-token-file", http.StatusForbidden)
+        return
+    } else if token := self.authorize(r); token == nil {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    } else if !token.allows(id) {
+        http.Error(w, fmt.Sprintf("Resource %s is not within the service name prefixes of the token: %s", id, strings.Join(token.prefixes, " ")), http.StatusForbidden)
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        if parts := strings.Split(id, "/"); id == "services" || id == "routes" || (len(parts) == 3 && parts[2] == "backends") {
+            result, err = self.resources.List(id)
+        } else {
+            result, err = self.resources.Get(id)
+        }
+    case "PUT":
+        var resource config.Resource
+        var changed bool
+
+        if body, readErr := ioutil.ReadAll(r.Body); readErr != nil {
+            http.Error(w, readErr.Error(), http.StatusBadRequest)
+            return
+        } else if resource, changed, err = self.resources.Put(id, body); err == nil && changed {
+            log.Printf("resources: put %s\n", id)
+        }
+
+        result = resource
+    case "DELETE":
+        if deleted, deleteErr := self.resources.Delete(id); deleteErr != nil {
+            err = deleteErr
+        } else if deleted {
+            log.Printf("resources: delete %s\n", id)
+        }
+    default:
+        http.Error(w, "GET, PUT or DELETE only", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if err != nil && errors.Is(err, config.ErrResourceNotFound) {
+        http.Error(w, err.Error(), http.StatusNotFound)
+    } else if err != nil && errs.Classify(err) == errs.Config {
+        http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    } else if result == nil {
+        w.WriteHeader(http.StatusNoContent)
+    } else {
+        w.Header().Set("Content-Type", "application/json")
+
+        if err := json.NewEncoder(w).Encode(result); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+    }
+}
+
+// Sample the kernel conn table via HTTP GET ?window=&interval=[&format=csv], returning the timeline at the end of the window
+type connsHandler func(timeline *clusterf.ConnTimeline) error
+
+func (self connsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var window = 60 * time.Second
+    var interval = 1 * time.Second
+
+    if r.Method != "GET" {
+        http.Error(w, "GET only", http.StatusMethodNotAllowed)
+        return
+    }
+
+    for _, param := range []struct{
+        name    string
+        value   *time.Duration
+    }{
+        {"window", &window},
+        {"interval", &interval},
+    } {
+        if r.FormValue(param.name) == "" {
+
+        } else if value, err := time.ParseDuration(r.FormValue(param.name)); err != nil || value <= 0 {
+            http.Error(w, fmt.Sprintf("Invalid %s=%#v", param.name, r.FormValue(param.name)), http.StatusBadRequest)
+            return
+        } else {
+            *param.value = value
+        }
+    }
+
+    if window > clusterf.CONN_WINDOW_MAX || interval > window {
+        http.Error(w, fmt.Sprintf("Invalid window=%v interval=%v", window, interval), http.StatusBadRequest)
+        return
+    }
+
+    switch r.FormValue("format") {
+    case "", "json", "csv":
+    default:
+        http.Error(w, fmt.Sprintf("Invalid format=%#v", r.FormValue("format")), http.StatusBadRequest)
+        return
+    }
+
+    var timeline clusterf.ConnTimeline
+
+    deadline := time.Now().Add(window)
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        if err := self(&timeline); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        if !time.Now().Before(deadline) {
+            break
+        }
+
+        select {
+        case <-ticker.C:
+        case <-r.Context().Done():
+            return
+        }
+    }
+
+    if r.FormValue("format") == "csv" {
+        w.Header().Set("Content-Type", "text/csv")
+
+        if err := timeline.WriteCSV(w); err != nil {
+            log.Printf("conns: %v\n", err)
+        }
+    } else {
+        w.Header().Set("Content-Type", "application/json")
+
+        if err := json.NewEncoder(w).Encode(timeline.Samples); err != nil {
+            log.Printf("conns: %v\n", err)
+        }
+    }
+}
+
+// Show the ipvs netlink debug state via HTTP GET, or enable/disable it via HTTP POST ?debug=true/false
+type debugHandler func(set *bool) (bool, error)
+
+func (self debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var set *bool
+
+    if r.Method == "GET" {
+
+    } else if r.Method != "POST" {
+        http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+        return
+    } else if debug, err := strconv.ParseBool(r.FormValue("debug")); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid debug=%#v", r.FormValue("debug")), http.StatusBadRequest)
+        return
+    } else {
+        set = &debug
+    }
+
+    if debug, err := self(set); err != nil {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+    } else {
+        fmt.Fprintf(w, "%v\n", debug)
+    }
+}
+
 func main() {
-    flag.Parse()
+    flags.Parse()
 
     if len(flag.Args()) > 0 {
         flag.Usage()
         os.Exit(1)
     }
 
+    if err := logConfig.Setup(); err != nil {
+        log.Fatalf("logging: %s\n", err)
+    }
+
+    tasks.Setup(tasksConfig)
+
+    switch etcdStartup {
+    case "fail", "cached", "degraded":
+    default:
+        log.Fatalf("-etcd-startup: invalid value: %s\n", etcdStartup)
+    }
+
+    log.Printf("clusterf-ipvs %s\n", clusterf.GetBuildInfo())
+
     // setup
     services := clusterf.NewServices()
+    services.SetLimits(limits)
+
+    if shardSpec == "" {
+
+    } else if shard, err := clusterf.ParseShard(shardSpec); err != nil {
+        log.Fatalf("-shard: %v\n", err)
+    } else {
+        if ipvsConfig.NodeName == "" {
+            if hostname, err := os.Hostname(); err != nil {
+                log.Fatalf("os.Hostname: %v\n", err)
+            } else {
+                ipvsConfig.NodeName = hostname
+            }
+        }
+
+        services.SetShard(ipvsConfig.NodeName, shard)
+
+        log.Printf("Services.SetShard %s: %v\n", ipvsConfig.NodeName, shard)
+    }
 
     // config
     var configFiles *config.Files
     var configEtcd *config.Etcd
+    var configCache *config.Cache
+    var etcdDegraded bool
 
     if filesConfig.Path != "" {
         if files, err := filesConfig.Open(); err != nil {
@@ -97,6 +964,24 @@ func main() {
         }
     }
 
+    if policy, err := policyConfig.Open(); err != nil {
+        log.Fatalf("config:Policy.Open: %s\n", err)
+    } else {
+        configPolicy = policy
+    }
+
+    if freeze, err := freezeConfig.Open(); err != nil {
+        log.Fatalf("config:Freeze.Open: %s\n", err)
+    } else {
+        configFreeze = freeze
+    }
+
+    if hooks, err := hooksConfig.Open(); err != nil {
+        log.Fatalf("config:Hooks.Open: %s\n", err)
+    } else {
+        configHooks = hooks
+    }
+
     if etcdConfig.Prefix != "" {
         if etcd, err := etcdConfig.Open(); err != nil {
             log.Fatalf("config:etcd.Open: %s\n", err)
@@ -106,55 +991,554 @@ func main() {
             log.Printf("config:etcd.Open: %s\n", configEtcd)
         }
 
-        if configs, err := configEtcd.Scan(); err != nil {
-            log.Fatalf("config:Etcd.Scan: %s\n", err)
+        if recordConfig.Path == "" {
+
+        } else if recorder, err := recordConfig.Open(); err != nil {
+            log.Fatalf("config:Recorder.Open: %s\n", err)
+        } else {
+            log.Printf("config:Recorder.Open: %s\n", recorder)
+
+            configEtcd.SetRecorder(recorder)
+        }
+
+        if cacheConfig.Path == "" {
+
+        } else if cache, err := cacheConfig.Open(); err != nil {
+            log.Fatalf("config:Cache.Open: %s\n", err)
         } else {
+            log.Printf("config:Cache.Open: %s\n", cache)
+
+            configCache = cache
+            configEtcd.SetCache(cache)
+        }
+
+        if configs, err := configEtcd.WaitScan(etcdStartupWait); err == nil {
             log.Printf("config:Etcd.Scan: %d configs\n", len(configs))
 
-            // iterate initial set of services
-            for _, cfg := range configs {
-                if filterConfigEtcd(cfg) {
-                    continue
-                }
+            // iterate initial set of services, before flushing the IPVS state in SyncIPVS
+            if err := newConfigsEtcd(services, configs); err != nil {
+                log.Fatalf("%s\n", err)
+            }
 
-                services.NewConfig(cfg)
+        } else if etcdStartup == "fail" || errs.Classify(err) != errs.Backend {
+            log.Fatalf("config:Etcd.Scan: %s\n", err)
+
+        } else if configs, cacheErr := loadCache(configCache); cacheErr == nil {
+            log.Printf("config:Etcd.Scan: %s\n", err)
+
+            // resync once etcd is reachable
+            etcdDegraded = true
+
+            if err := newConfigsEtcd(services, configs); err != nil {
+                log.Fatalf("%s\n", err)
             }
+
+        } else if etcdStartup == "degraded" {
+            log.Printf("config:Etcd.Scan: %s\n", err)
+            log.Printf("config:Etcd.Scan: starting without any etcd config (%s)\n", cacheErr)
+
+            etcdDegraded = true
+
+        } else {
+            log.Fatalf("config:Etcd.Scan: %s (%s)\n", err, cacheErr)
         }
     }
 
+    // inject
+    if !injectConfig.Routes && injectConfig.BirdPath == "" && injectConfig.AddrDev == "" && injectConfig.Exec == "" {
+
+    } else if injector, err := injectConfig.Open(); err != nil {
+        log.Fatalf("clusterf:Injector.Open: %s\n", err)
+    } else {
+        log.Printf("clusterf:Injector.Open: %s\n", injector)
+
+        services.SetInjector(injector)
+    }
+
     // sync
-    if ipvsDriver, err := services.SyncIPVS(ipvsConfig); err != nil {
+    var ipvsDriver *clusterf.IPVSDriver
+
+    if driver, err := services.SyncIPVS(ipvsConfig); err != nil {
         log.Fatalf("SyncIPVS: %s\n", err)
     } else {
+        ipvsDriver = driver
+
         if ipvsConfigPrint {
             ipvsDriver.Print()
         }
     }
 
-    // advertise
-    if advertiseRouteConfig.RouteName == "" || configEtcd == nil {
+    // all changes after the initial sync are applied via the writer
+    writer := clusterf.NewWriter()
 
-    } else if err := configEtcd.Publish(advertiseRouteConfig); err != nil {
-        log.Fatalf("config:Etcd.Publish advertiseRoute %#v: %v\n", advertiseRouteConfig, err)
+    doResync := func() bool {
+        return writer.Do("resync", func() {
+            resync(services, ipvsDriver, configFiles, configEtcd)
+        })
+    }
+
+    // resync, unless deferred until the end of any freeze window
+    freezeResync := func() (deferred bool, ok bool) {
+        ok = true
+        deferred = configFreeze.Resync(time.Now(), func() {
+            ok = doResync()
+        })
+
+        if deferred {
+            log.Printf("resync: deferred by freeze window\n")
+        }
+
+        return
+    }
+
+    // apply the etcd config changes, running any hooks
+    applyConfig := func(event config.Event) {
+        if err := configHooks.Pre(event); err != nil {
+            log.Printf("config:Hooks.Pre %s: %v, skipping\n", event.Action, err)
+            return
+        }
+
+        writer.Do("config", func() {
+            services.ConfigEvent(event)
+        })
+
+        configHooks.Post(event)
+    }
+
+    // token for the http admin requests
+    var adminToken string
+
+    if httpAdminTokenFile == "" {
+
+    } else if token, err := readTokenFile(httpAdminTokenFile); err != nil {
+        log.Fatalf("-http-admin-token-file: %s\n", err)
     } else {
-        log.Printf("config:Etcd.Publish advertiseRoute %#v\n", advertiseRouteConfig)
+        adminToken = token
     }
 
-    if configEtcd != nil {
-        // read channel for changes
-        log.Printf("config:Etcd.Sync...\n")
+    // serve the http handler, requiring the admin token for any requests other than GET
+    adminHandle := func(path string, handler http.Handler) {
+        http.Handle(path, adminHandler{handler: handler, token: adminToken})
+    }
+
+    // stats
+    var ipvsStats *clusterf.IPVSStats
+
+    if httpListen != "" {
+        ipvsStats = ipvsDriver.NewStats()
 
-        for event := range configEtcd.Sync() {
-            if filterConfigEtcd(event.Config) {
-                continue
+        if err := ipvsStats.Update(); err != nil {
+            log.Fatalf("IPVSStats.Update: %s\n", err)
+        }
+
+        tasks.Go("stats", func() {
+            for _ = range time.Tick(ipvsStatsInterval) {
+                writer.Do("stats", func() {
+                    if err := ipvsStats.Update(); err != nil {
+                        log.Printf("IPVSStats.Update: %s\n", err)
+                    }
+                })
             }
+        })
 
-            log.Printf("config.Sync: %+v\n", event)
+        http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+            ipvsStats.ServeHTTP(w, r)
+            services.LimitStats().WriteMetrics(w)
+            services.ErrorStats().WriteMetrics(w)
+            clusterf.GetBuildInfo().WriteMetrics(w)
+            tasks.GetStats().WriteMetrics(w)
 
-            services.ConfigEvent(event)
+            if configEtcd != nil {
+                configEtcd.WriteMetrics(w)
+            }
+        })
+        http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Content-Type", "application/json")
+
+            if err := json.NewEncoder(w).Encode(clusterf.GetBuildInfo()); err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+            }
+        })
+        http.HandleFunc("/stats", ipvsStats.ServeJSON)
+        http.HandleFunc("/experiments", ipvsStats.ServeExperiments)
+        http.HandleFunc("/vips", func(w http.ResponseWriter, r *http.Request) {
+            var vips []clusterf.VIPStatus
+
+            if !writer.Do("vips", func() {
+                vips = services.VIPStatus()
+            }) {
+                http.Error(w, "stopped", http.StatusServiceUnavailable)
+                return
+            }
+
+            w.Header().Set("Content-Type", "application/json")
+
+            if err := json.NewEncoder(w).Encode(vips); err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+            }
+        })
+        http.HandleFunc("/dests", func(w http.ResponseWriter, r *http.Request) {
+            var dests []clusterf.DestStatus
+
+            if !writer.Do("dests", func() {
+                dests = services.DestStatus(r.FormValue("service"))
+            }) {
+                http.Error(w, "stopped", http.StatusServiceUnavailable)
+                return
+            }
+
+            w.Header().Set("Content-Type", "application/json")
+
+            if err := json.NewEncoder(w).Encode(dests); err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+            }
+        })
+        adminHandle("/resync", resyncHandler(freezeResync))
+        adminHandle("/debug", debugHandler(func(set *bool) (debug bool, err error) {
+            if !writer.Do("debug", func() {
+                if set != nil {
+                    ipvsDriver.SetDebug(*set)
+                }
+                debug = ipvsDriver.Debug()
+            }) {
+                err = fmt.Errorf("stopped")
+            }
+            return
+        }))
+        adminHandle("/freeze", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == "POST" {
+                configFreeze.Override(time.Now(), applyConfig)
+            } else if r.Method != "GET" {
+                http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+                return
+            }
+
+            w.Header().Set("Content-Type", "application/json")
+
+            if err := json.NewEncoder(w).Encode(configFreeze.Status(time.Now())); err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+            }
+        }))
+        adminHandle("/zero", zeroHandler(func(serviceName string) (count int, err error) {
+            if !writer.Do("zero", func() {
+                count, err = ipvsDriver.Zero(serviceName)
+            }) {
+                err = fmt.Errorf("stopped")
+            }
+            return
+        }))
+        adminHandle("/verify", verifyHandler(func(serviceName string, backendName string) (repairs int, err error) {
+            if !writer.Do("verify", func() {
+                repairs, err = ipvsDriver.VerifyService(serviceName, backendName)
+            }) {
+                err = fmt.Errorf("stopped")
+            }
+            return
+        }))
+        http.Handle("/conns", connsHandler(func(timeline *clusterf.ConnTimeline) (err error) {
+            if !writer.Do("conns", func() {
+                err = ipvsDriver.SampleConns(timeline)
+            }) {
+                err = fmt.Errorf("stopped")
+            }
+            return
+        }))
+        http.Handle("/trace", traceHandler(func(client net.IP, vip net.IP, port uint16) (results []clusterf.TraceResult, err error) {
+            if !writer.Do("trace", func() {
+                results, err = ipvsDriver.Trace(client, vip, port)
+            }) {
+                err = fmt.Errorf("stopped")
+            }
+            return
+        }))
+
+        adminHandle("/pin", pinHandler{
+            pin: func(serviceName string, backendName string, client net.IP, ttl time.Duration) (status clusterf.PinStatus, err error) {
+                if !writer.Do("pin", func() {
+                    status, err = services.Pin(serviceName, backendName, client, ttl)
+                }) {
+                    err = fmt.Errorf("stopped")
+                }
+                return
+            },
+            unpin: func(serviceName string, client net.IP) (err error) {
+                if !writer.Do("unpin", func() {
+                    err = services.Unpin(serviceName, client)
+                }) {
+                    err = fmt.Errorf("stopped")
+                }
+                return
+            },
+            pins: func() (statuses []clusterf.PinStatus, err error) {
+                if !writer.Do("pins", func() {
+                    statuses = services.Pins()
+                }) {
+                    err = fmt.Errorf("stopped")
+                }
+                return
+            },
+        })
+
+        adminHandle("/plan", planHandler(func(applyConfig config.ApplyConfig, prune bool) (plan clusterf.Plan, err error) {
+            if configEtcd == nil {
+                return plan, errs.ConfigError(fmt.Errorf("Plans require the etcd config"))
+            }
+
+            nodes, err := configEtcd.Nodes()
+            if err != nil {
+                return plan, err
+            }
+
+            changes, err := applyConfig.Plan(nodes, prune)
+            if err != nil {
+                return plan, errs.ConfigError(err)
+            } else if err := configPolicy.CheckChanges(changes); err != nil {
+                return plan, errs.ConfigError(fmt.Errorf("Policy: %v", err))
+            }
+
+            configs, err := planConfigs(configFiles, configEtcd)
+            if err != nil {
+                return plan, err
+            }
+
+            return clusterf.PlanChanges(configs, changes, ipvsConfig)
+        }))
+
+        if configEtcd == nil {
+            http.Handle("/resources/", resourcesHandler{})
+        } else if httpResourcesTokenFile == "" {
+            http.Handle("/resources/", resourcesHandler{resources: config.NewResources(configEtcd, configPolicy)})
+        } else if tokens, err := readResourcesTokens(httpResourcesTokenFile); err != nil {
+            log.Fatalf("-http-resources-token-file: %s\n", err)
+        } else {
+            http.Handle("/resources/", resourcesHandler{resources: config.NewResources(configEtcd, configPolicy), tokens: tokens})
+
+            log.Printf("http: serving /resources/ writes for %d tokens\n", len(tokens))
+        }
+
+        httpHandler, err := httpPprof.Handler(http.DefaultServeMux)
+        if err != nil {
+            log.Fatalf("-http-pprof-token-file: %s\n", err)
+        } else if httpHandler.Enabled() {
+            log.Printf("http: serving %s\n", PPROF_PATH)
+        }
+
+        tasks.Go("http", func() {
+            log.Fatal(http.ListenAndServe(httpListen, httpHandler))
+        })
+
+        log.Printf("http.ListenAndServe: %s\n", httpListen)
+    }
+
+    // connection logs
+    if conntrackLogConfig.Path == "" {
+
+    } else if conntrackLogger, err := conntrackLogConfig.Open(); err != nil {
+        log.Fatalf("conntrack:Logger.Open: %s\n", err)
+    } else {
+        updateVIPs := func() {
+            vips := make(map[conntrack.VIP]string)
+
+            writer.Do("conntrack", func() {
+                ipvsDriver.EachService(func(ipvsService ipvs.Service, serviceName string) {
+                    vips[conntrack.MakeVIP(uint8(ipvsService.Protocol), ipvsService.Addr, ipvsService.Port)] = serviceName
+                })
+            })
+
+            conntrackLogger.SetVIPs(vips)
+        }
+
+        tasks.Go("conntrack", func() {
+            for _ = range time.Tick(ipvsStatsInterval) {
+                updateVIPs()
+            }
+        })
+
+        tasks.Go("conntrack", func() {
+            updateVIPs()
+
+            if err := conntrackLogger.Run(); err != nil {
+                log.Printf("conntrack:Logger.Run: %s\n", err)
+            }
+        })
+
+        log.Printf("conntrack:Logger.Open: %s\n", conntrackLogConfig.Path)
+    }
+
+    // status
+    statusConfig.NodeName = ipvsConfig.NodeName
+
+    if !statusPublish {
+
+    } else if configEtcd == nil {
+        log.Fatalf("-status-publish requires etcd\n")
+    } else if statusWriter, err := statusConfig.Open(configEtcd); err != nil {
+        log.Fatalf("clusterf:StatusWriter.Open: %s\n", err)
+    } else {
+        tasks.Go("status", func() {
+            for _ = range time.Tick(statusInterval) {
+                var statuses map[string]config.ServiceStatus
+
+                writer.Do("status", func() {
+                    statuses = services.Status()
+                })
+
+                if err := statusWriter.Update(statuses); err != nil {
+                    log.Printf("clusterf:StatusWriter.Update: %s\n", err)
+                }
+            }
+        })
+
+        log.Printf("clusterf:StatusWriter.Open: %s\n", statusWriter)
+    }
+
+    // capacity events
+    capacityConfig.NodeName = ipvsConfig.NodeName
+
+    if capacityConfig.Threshold == 0 {
+
+    } else if capacityWatcher, err := capacityConfig.Open(); err != nil {
+        log.Fatalf("clusterf:CapacityWatcher.Open: %s\n", err)
+    } else {
+        if httpListen != "" {
+            http.Handle("/capacity", capacityWatcher)
         }
+
+        tasks.Go("capacity", func() {
+            for _ = range time.Tick(capacityInterval) {
+                var statuses map[string]config.ServiceStatus
+
+                writer.Do("capacity", func() {
+                    statuses = services.Status()
+                })
+
+                if err := capacityWatcher.Update(statuses); err != nil {
+                    log.Printf("clusterf:CapacityWatcher.Update: %s\n", err)
+                }
+            }
+        })
+
+        log.Printf("clusterf:CapacityWatcher.Open: %s\n", capacityWatcher)
     }
 
+    // soft limits
+    tasks.Go("tasks", func() {
+        for _ = range time.Tick(tasksInterval) {
+            tasks.Check()
+        }
+    })
+
+    // shifts
+    tasks.Go("shift", func() {
+        for now := range time.Tick(shiftInterval) {
+            writer.Do("shift", func() {
+                services.UpdateShifts(now)
+            })
+        }
+    })
+
+    // local backends
+    tasks.Go("local", func() {
+        for _ = range time.Tick(localInterval) {
+            writer.Do("local", func() {
+                services.UpdateLocal()
+            })
+        }
+    })
+
+    // client pins
+    tasks.Go("pin", func() {
+        for now := range time.Tick(pinInterval) {
+            writer.Do("pin", func() {
+                services.ExpirePins(now)
+            })
+        }
+    })
+
+    // apply any changes queued during a freeze window, once it ends
+    tasks.Go("freeze", func() {
+        for now := range time.Tick(config.FREEZE_INTERVAL) {
+            configFreeze.Release(now, applyConfig)
+        }
+    })
+
+    // resync on SIGHUP
+    resyncSignal := make(chan os.Signal, 1)
+
+    signal.Notify(resyncSignal, syscall.SIGHUP)
+
+    tasks.Go("signal", func() {
+        for _ = range resyncSignal {
+            log.Printf("resync: SIGHUP\n")
+
+            freezeResync()
+        }
+    })
+
+    // toggle the ipvs debug dumps on SIGUSR1
+    debugSignal := make(chan os.Signal, 1)
+
+    signal.Notify(debugSignal, syscall.SIGUSR1)
+
+    tasks.Go("signal", func() {
+        for _ = range debugSignal {
+            writer.Do("debug", func() {
+                ipvsDriver.SetDebug(!ipvsDriver.Debug())
+            })
+        }
+    })
+
+    // advertise, once etcd is reachable
+    if configEtcd != nil && !etcdDegraded {
+        advertise(configEtcd)
+    }
+
+    if overlaps := services.ShardOverlaps(); len(overlaps) > 0 {
+        log.Printf("Services.ShardOverlaps: shard %s overlaps with nodes: %v\n", shardSpec, overlaps)
+    }
+
+    if configEtcd != nil {
+        // read channel for changes, until etcd sync ends
+        log.Printf("config:Etcd.Sync...\n")
+
+        tasks.Go("etcd-sync", func() {
+            if etcdDegraded {
+                if configs, err := configEtcd.WaitScan(-1); err != nil {
+                    log.Fatalf("config:Etcd.Scan: %s\n", err)
+                } else {
+                    log.Printf("config:Etcd.Scan: %d configs, replacing the startup config\n", len(configs))
+                }
+
+                // the startup config is only a stale copy of the etcd config, and is replaced regardless of any freeze window
+                advertise(configEtcd)
+                doResync()
+            }
+
+            for event := range configEtcd.Sync() {
+                if filterConfigEtcd(event.Config) || !admitConfigEtcd(event.Action, event.Config) {
+                    continue
+                }
+
+                log.Printf("config.Sync: %+v\n", event)
+
+                applyEvent := event
+
+                if configFreeze.Apply(applyEvent, time.Now(), applyConfig) {
+                    log.Printf("config:Freeze: queued %s %s\n", applyEvent.Action, applyEvent.Config.Path())
+                }
+            }
+
+            log.Printf("config:Etcd.Sync: closed\n")
+
+            writer.Stop()
+        })
+
+        writer.Run()
+
+    } else if ipvsStats != nil {
+        // keep running for stats if not using etcd
+        writer.Run()
+    }
 
     log.Printf("Exit\n")
 }
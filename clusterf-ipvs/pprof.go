@@ -0,0 +1,91 @@
+package main
+/*
+ * Runtime profiling of the daemon using the net/http/pprof /debug/pprof/ endpoints on the -http-listen, for investigating the
+ * config watch and IPVS sync loops in production.
+ *
+ * Importing net/http/pprof always registers the endpoints on the http.DefaultServeMux, so they are instead guarded by wrapping
+ * the whole mux, only serving them to requests with the bearer token from the -http-pprof-token-file.
+ */
+
+import (
+    "crypto/subtle"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    _ "net/http/pprof"
+    "runtime"
+    "strings"
+)
+
+const PPROF_PATH = "/debug/pprof/"
+
+type pprofConfig struct {
+    TokenFile       string  // default: disabled
+    MutexFraction   int     // runtime.SetMutexProfileFraction
+    BlockRate       int     // runtime.SetBlockProfileRate
+}
+
+// Guards the PPROF_PATH endpoints of the wrapped handler
+type pprofHandler struct {
+    handler     http.Handler
+    token       string  // empty if disabled
+}
+
+// Wrap the given handler, enabling the pprof endpoints if configured
+func (self pprofConfig) Handler(handler http.Handler) (*pprofHandler, error) {
+    var pprofHandler = pprofHandler{handler: handler}
+
+    if self.TokenFile == "" {
+        return &pprofHandler, nil
+    }
+
+    if token, err := readTokenFile(self.TokenFile); err != nil {
+        return nil, err
+    } else {
+        pprofHandler.token = token
+    }
+
+    runtime.SetMutexProfileFraction(self.MutexFraction)
+    runtime.SetBlockProfileRate(self.BlockRate)
+
+    return &pprofHandler, nil
+}
+
+// Read the bearer token from the file, which must not be empty
+func readTokenFile(path string) (string, error) {
+    if buf, err := ioutil.ReadFile(path); err != nil {
+        return "", err
+    } else if token := strings.TrimSpace(string(buf)); token == "" {
+        return "", fmt.Errorf("empty token file: %s", path)
+    } else {
+        return token, nil
+    }
+}
+
+// Check the request for an 'Authorization: Bearer <token>' header with the given token
+func bearerAuthorized(r *http.Request, token string) bool {
+    auth := r.Header.Get("Authorization")
+
+    if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+        return false
+    }
+
+    return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+func (self pprofHandler) Enabled() bool {
+    return self.token != ""
+}
+
+func (self pprofHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if !strings.HasPrefix(r.URL.Path, PPROF_PATH) {
+        self.handler.ServeHTTP(w, r)
+    } else if !self.Enabled() {
+        http.NotFound(w, r)
+    } else if !bearerAuthorized(r, self.token) {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    } else {
+        self.handler.ServeHTTP(w, r)
+    }
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/flags"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+)
+
+var (
+    etcdConfig  config.EtcdConfig
+    etcd3Config config.Etcd3Config
+    dryRun      bool
+)
+
+func init() {
+    flag.StringVar(&etcdConfig.Machines, "etcd-machines", "http://127.0.0.1:2379",
+        "Client endpoint for etcd v2")
+    flag.StringVar(&etcdConfig.Prefix, "etcd-prefix", "/clusterf",
+        "Etcd v2 tree prefix")
+
+    flag.StringVar(&etcd3Config.Endpoint, "etcd3-endpoint", "http://127.0.0.1:2379",
+        "Client endpoint for the etcd v3 JSON gateway")
+    flag.StringVar(&etcd3Config.Prefix, "etcd3-prefix", "/clusterf",
+        "Etcd v3 key prefix")
+
+    flag.BoolVar(&dryRun, "dry-run", false,
+        "Only list the nodes to copy")
+}
+
+func main() {
+    flags.Parse()
+
+    if len(flag.Args()) > 0 {
+        flag.Usage()
+        os.Exit(1)
+    }
+
+    configEtcd, err := etcdConfig.Open()
+    if err != nil {
+        log.Fatalf("config:Etcd.Open: %v\n", err)
+    } else {
+        log.Printf("config:Etcd.Open: %v\n", configEtcd)
+    }
+
+    configEtcd3, err := etcd3Config.Open()
+    if err != nil {
+        log.Fatalf("config:Etcd3.Open: %v\n", err)
+    } else {
+        log.Printf("config:Etcd3.Open: %v\n", configEtcd3)
+    }
+
+    nodes, err := configEtcd.Nodes()
+    if err != nil {
+        log.Fatalf("config:Etcd.Nodes: %v\n", err)
+    }
+
+    // copy
+    for _, node := range nodes {
+        if dryRun {
+            fmt.Printf("%s %s\n", node.Path, node.Value)
+        } else if err := configEtcd3.Put(node); err != nil {
+            log.Fatalf("config:Etcd3.Put %s: %v\n", node.Path, err)
+        } else {
+            log.Printf("config:Etcd3.Put %s\n", node.Path)
+        }
+    }
+
+    if dryRun {
+        return
+    }
+
+    // verify
+    etcd3Nodes, err := configEtcd3.Nodes()
+    if err != nil {
+        log.Fatalf("config:Etcd3.Nodes: %v\n", err)
+    }
+
+    if diff, err := config.DiffConfigs(config.ScanNodes(nodes), config.ScanNodes(etcd3Nodes)); err != nil {
+        log.Fatalf("config.DiffConfigs: %v\n", err)
+    } else if len(diff) > 0 {
+        for _, line := range diff {
+            fmt.Printf("%s\n", line)
+        }
+
+        log.Fatalf("Migrated %d nodes, with %d differences\n", len(nodes), len(diff))
+    } else {
+        log.Printf("Migrated %d nodes\n", len(nodes))
+    }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/flags"
+    "github.com/qmsk/clusterf/health"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "time"
+)
+
+var (
+    etcdConfig      config.EtcdConfig
+    healthOptions   health.Options
+    interval        time.Duration
+    once            bool
+)
+
+func init() {
+    flag.StringVar(&etcdConfig.Machines, "etcd-machines", "http://127.0.0.1:2379",
+        "Client endpoint for etcd")
+    flag.StringVar(&etcdConfig.Prefix, "etcd-prefix", "/clusterf",
+        "Etcd tree prefix")
+
+    flag.DurationVar(&interval, "interval", 5 * time.Second,
+        "Interval for checking the backends")
+    flag.BoolVar(&once, "once", false,
+        "Only check the backends once, and exit")
+
+    // the check is for the primary, and every backend accepts TCP connections
+    healthOptions.Flags(flag.CommandLine, false)
+}
+
+func update(configEtcd *config.Etcd, configs []config.Config, primaryConfig config.PrimaryConfig, serviceName string) error {
+    backends := config.RollingBackends(configs, serviceName)
+
+    if len(backends) == 0 {
+        return fmt.Errorf("No backends for service: %s", serviceName)
+    }
+
+    if primaryName, err := primaryConfig.Update(configEtcd, backends); err != nil {
+        return err
+    } else {
+        log.Printf("config:Primary %s: %s\n", serviceName, primaryName)
+    }
+
+    return nil
+}
+
+func main() {
+    flag.Usage = func() {
+        fmt.Fprintf(os.Stderr, "Usage: %s [options] <service>...\n", os.Args[0])
+        flag.PrintDefaults()
+    }
+    flags.Parse()
+
+    if len(flag.Args()) == 0 {
+        flag.Usage()
+        os.Exit(1)
+    }
+
+    serviceNames := flag.Args()
+
+    check, err := healthOptions.Open()
+    if err != nil {
+        log.Fatalf("health:Options.Open: %v\n", err)
+    } else if check == nil {
+        log.Fatalf("Missing -health-* check for the primary\n")
+    }
+
+    configEtcd, err := etcdConfig.Open()
+    if err != nil {
+        log.Fatalf("config:etcd.Open: %v\n", err)
+    } else {
+        log.Printf("config:etcd.Open: %v\n", configEtcd)
+    }
+
+    for {
+        var failed bool
+
+        // each backend host:port shared by multiple services is only checked once per interval
+        primaryConfig := config.PrimaryConfig{Primary: check.Cached()}
+
+        if configs, err := configEtcd.List(); err != nil {
+            log.Printf("config:etcd.List: %v\n", err)
+            failed = true
+        } else {
+            for _, serviceName := range serviceNames {
+                if err := update(configEtcd, configs, primaryConfig, serviceName); err != nil {
+                    log.Printf("config:Primary %s: %v\n", serviceName, err)
+                    failed = true
+                }
+            }
+        }
+
+        if !once {
+
+        } else if failed {
+            os.Exit(1)
+        } else {
+            break
+        }
+
+        time.Sleep(interval)
+    }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/flags"
+    "github.com/qmsk/clusterf/health"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "time"
+)
+
+var (
+    etcdConfig      config.EtcdConfig
+    rollingConfig   config.RollingConfig
+    restartCommand  string
+    healthOptions   health.Options
+)
+
+func init() {
+    flag.StringVar(&etcdConfig.Machines, "etcd-machines", "http://127.0.0.1:2379",
+        "Client endpoint for etcd")
+    flag.StringVar(&etcdConfig.Prefix, "etcd-prefix", "/clusterf",
+        "Etcd tree prefix")
+
+    flag.DurationVar(&rollingConfig.DrainTime, "drain-time", 30 * time.Second,
+        "Wait for existing connections after draining each backend")
+    flag.DurationVar(&rollingConfig.HealthTimeout, "health-timeout", 60 * time.Second,
+        "Wait for each restarted backend to become healthy")
+    flag.StringVar(&restartCommand, "restart-command", "",
+        "Shell command to restart each backend, with $CLUSTERF_SERVICE, $CLUSTERF_BACKEND, $CLUSTERF_BACKEND_IPV4 in the environment")
+
+    healthOptions.Flags(flag.CommandLine, true)
+}
+
+// Run the -restart-command for the backend
+func restart(backendConfig config.ConfigServiceBackend) error {
+    cmd := exec.Command("/bin/sh", "-c", restartCommand)
+    cmd.Env = append(os.Environ(),
+        "CLUSTERF_SERVICE=" + backendConfig.ServiceName,
+        "CLUSTERF_BACKEND=" + backendConfig.BackendName,
+        "CLUSTERF_BACKEND_IPV4=" + backendConfig.Backend.IPv4,
+    )
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+
+    return cmd.Run()
+}
+
+func main() {
+    flag.Usage = func() {
+        fmt.Fprintf(os.Stderr, "Usage: %s [options] <service>\n", os.Args[0])
+        flag.PrintDefaults()
+    }
+    flags.Parse()
+
+    if len(flag.Args()) != 1 {
+        flag.Usage()
+        os.Exit(1)
+    }
+
+    serviceName := flag.Arg(0)
+
+    if restartCommand != "" {
+        rollingConfig.Restart = restart
+    }
+    if check, err := healthOptions.Open(); err != nil {
+        log.Fatalf("health:Options.Open: %v\n", err)
+    } else if check != nil {
+        rollingConfig.Health = check
+    }
+
+    configEtcd, err := etcdConfig.Open()
+    if err != nil {
+        log.Fatalf("config:etcd.Open: %v\n", err)
+    } else {
+        log.Printf("config:etcd.Open: %v\n", configEtcd)
+    }
+
+    configs, err := configEtcd.Scan()
+    if err != nil {
+        log.Fatalf("config:etcd.Scan: %v\n", err)
+    }
+
+    backends := config.RollingBackends(configs, serviceName)
+
+    if len(backends) == 0 {
+        log.Fatalf("No backends for service: %s\n", serviceName)
+    }
+
+    if err := rollingConfig.Run(configEtcd, backends); err != nil {
+        log.Fatalf("config:Rolling: %v\n", err)
+    } else {
+        log.Printf("config:Rolling %s: done\n", serviceName)
+    }
+}
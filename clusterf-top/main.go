@@ -0,0 +1,353 @@
+package main
+
+import (
+    "bytes"
+    "github.com/qmsk/clusterf"
+    "github.com/qmsk/clusterf/flags"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "os/exec"
+    "os/signal"
+    "sort"
+    "strings"
+    "syscall"
+    "text/tabwriter"
+    "time"
+)
+
+var (
+    statsURL        string
+    refreshInterval time.Duration
+    sortBy          string
+    sortReverse     bool
+    filter          string
+    once            bool
+)
+
+func init() {
+    flag.StringVar(&statsURL, "stats-url", "http://127.0.0.1:9100/stats",
+        "clusterf-ipvs -http-listen /stats URL")
+    flag.DurationVar(&refreshInterval, "interval", 2 * time.Second,
+        "Refresh interval")
+    flag.StringVar(&sortBy, "sort", "name",
+        "Sort services and backends by: name conns bytes active")
+    flag.BoolVar(&sortReverse, "reverse", false,
+        "Reverse sort order")
+    flag.StringVar(&filter, "filter", "",
+        "Only show services and backends matching the name or address")
+    flag.BoolVar(&once, "once", false,
+        "Print the stats once, without any interactive terminal UI")
+}
+
+/* Sorting */
+var sortKeys = []string{"name", "conns", "bytes", "active"}
+
+// Return the sort value for the given rates and active conns, or zero to sort by name
+func sortValue(rates clusterf.StatsRates, active uint32) float64 {
+    switch sortBy {
+    case "conns":
+        return rates.Conns
+    case "bytes":
+        return rates.InBytes + rates.OutBytes
+    case "active":
+        return float64(active)
+    default:
+        return 0
+    }
+}
+
+// Compare two sort values, with the highest rates first, and then by name
+func sortLess(aName string, aValue float64, bName string, bValue float64) bool {
+    var less bool
+
+    if aValue != bValue {
+        less = aValue > bValue
+    } else {
+        less = aName < bName
+    }
+
+    if sortReverse {
+        return !less
+    } else {
+        return less
+    }
+}
+
+func serviceActive(service clusterf.StatsService) (active uint32, inactive uint32) {
+    for _, dest := range service.Dests {
+        active += dest.ActiveConns
+        inactive += dest.InactConns
+    }
+
+    return
+}
+
+// Return the number of up dests, out of all dests
+func serviceHealth(service clusterf.StatsService) string {
+    var up int
+
+    for _, dest := range service.Dests {
+        if dest.Health == clusterf.HealthUp {
+            up++
+        }
+    }
+
+    return fmt.Sprintf("%d/%d up", up, len(service.Dests))
+}
+
+type serviceList []clusterf.StatsService
+
+func (self serviceList) Len() int      { return len(self) }
+func (self serviceList) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self serviceList) Less(i, j int) bool {
+    iActive, _ := serviceActive(self[i])
+    jActive, _ := serviceActive(self[j])
+
+    return sortLess(self[i].Name + self[i].Service, sortValue(self[i].Rates, iActive), self[j].Name + self[j].Service, sortValue(self[j].Rates, jActive))
+}
+
+type destList []clusterf.StatsDest
+
+func (self destList) Len() int      { return len(self) }
+func (self destList) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self destList) Less(i, j int) bool {
+    return sortLess(self[i].Name + self[i].Dest, sortValue(self[i].Rates, self[i].ActiveConns), self[j].Name + self[j].Dest, sortValue(self[j].Rates, self[j].ActiveConns))
+}
+
+/* Filtering */
+func matchFilter(name string, addr string) bool {
+    return filter == "" || strings.Contains(name, filter) || strings.Contains(addr, filter)
+}
+
+// Return the services matching the filter, with only the matching dests for any services that do not match by themselves
+func filterServices(services []clusterf.StatsService) []clusterf.StatsService {
+    var filtered []clusterf.StatsService
+
+    for _, service := range services {
+        if matchFilter(service.Name, service.Service) {
+            filtered = append(filtered, service)
+            continue
+        }
+
+        var dests []clusterf.StatsDest
+
+        for _, dest := range service.Dests {
+            if matchFilter(dest.Name, dest.Dest) {
+                dests = append(dests, dest)
+            }
+        }
+
+        if dests != nil {
+            service.Dests = dests
+            filtered = append(filtered, service)
+        }
+    }
+
+    return filtered
+}
+
+/* Display */
+func fetch(client *http.Client) (snapshot clusterf.StatsSnapshot, err error) {
+    response, err := client.Get(statsURL)
+    if err != nil {
+        return snapshot, err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode != 200 {
+        return snapshot, fmt.Errorf("%s: %s", statsURL, response.Status)
+    }
+
+    err = json.NewDecoder(response.Body).Decode(&snapshot)
+
+    return
+}
+
+func render(snapshot clusterf.StatsSnapshot) string {
+    var buf bytes.Buffer
+
+    services := serviceList(filterServices(snapshot.Services))
+
+    sort.Sort(services)
+
+    fmt.Fprintf(&buf, "%s @ %s: %d services, sort=%s reverse=%v filter=%q\n\n", statsURL, snapshot.Time.Format(time.Stamp), len(services), sortBy, sortReverse, filter)
+
+    w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+
+    fmt.Fprintf(w, "NAME\tADDRESS\tSCHED/WEIGHT\tHEALTH\tACTIVE\tINACTIVE\tCONNS/S\tIN KB/S\tOUT KB/S\t\n")
+
+    for _, service := range services {
+        active, inactive := serviceActive(service)
+
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t\n",
+            service.Name, service.Service, service.SchedName, serviceHealth(service), active, inactive,
+            service.Rates.Conns, service.Rates.InBytes / 1000, service.Rates.OutBytes / 1000,
+        )
+
+        dests := destList(service.Dests)
+
+        sort.Sort(dests)
+
+        for _, dest := range dests {
+            fmt.Fprintf(w, "  %s\t%s\t%d\t%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t\n",
+                dest.Name, dest.Dest, dest.Weight, dest.Health, dest.ActiveConns, dest.InactConns,
+                dest.Rates.Conns, dest.Rates.InBytes / 1000, dest.Rates.OutBytes / 1000,
+            )
+        }
+    }
+
+    w.Flush()
+
+    return buf.String()
+}
+
+/* Terminal */
+func stty(args ...string) error {
+    cmd := exec.Command("stty", args...)
+    cmd.Stdin = os.Stdin
+
+    return cmd.Run()
+}
+
+// Read single keypresses from the terminal
+func readKeys() chan byte {
+    keys := make(chan byte)
+
+    go func() {
+        defer close(keys)
+
+        buf := make([]byte, 1)
+
+        for {
+            if n, err := os.Stdin.Read(buf); err != nil {
+                return
+            } else if n > 0 {
+                keys <- buf[0]
+            }
+        }
+    }()
+
+    return keys
+}
+
+func cycleSort() {
+    for i, key := range sortKeys {
+        if key == sortBy {
+            sortBy = sortKeys[(i + 1) % len(sortKeys)]
+            return
+        }
+    }
+
+    sortBy = sortKeys[0]
+}
+
+func main() {
+    flags.Parse()
+
+    if len(flag.Args()) > 0 {
+        flag.Usage()
+        os.Exit(1)
+    }
+
+    client := &http.Client{Timeout: refreshInterval}
+
+    if once {
+        if snapshot, err := fetch(client); err != nil {
+            log.Fatalf("fetch: %v\n", err)
+        } else {
+            fmt.Print(render(snapshot))
+        }
+        return
+    }
+
+    // restore the terminal before exiting, including on ^C
+    signals := make(chan os.Signal, 1)
+
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+    if err := stty("cbreak", "-echo"); err != nil {
+        log.Fatalf("stty: %v\n", err)
+    }
+
+    run(client, signals)
+
+    if err := stty("-cbreak", "echo"); err != nil {
+        log.Fatalf("stty: %v\n", err)
+    }
+}
+
+// Run the interactive terminal UI until quit, or any signal
+func run(client *http.Client, signals chan os.Signal) {
+    keys := readKeys()
+    ticker := time.NewTicker(refreshInterval)
+    defer ticker.Stop()
+
+    var snapshot clusterf.StatsSnapshot
+    var fetchErr error
+    var filtering bool
+
+    snapshot, fetchErr = fetch(client)
+
+    for {
+        // clear screen and redraw
+        fmt.Print("\033[H\033[2J")
+
+        if fetchErr != nil {
+            fmt.Printf("%s: %v\n\n", statsURL, fetchErr)
+        }
+
+        fmt.Print(render(snapshot))
+
+        if filtering {
+            fmt.Printf("\nfilter: %s", filter)
+        } else {
+            fmt.Printf("\n[s]ort [r]everse [/]filter [q]uit")
+        }
+
+        select {
+        case <-ticker.C:
+            if newSnapshot, err := fetch(client); err != nil {
+                fetchErr = err
+            } else {
+                snapshot, fetchErr = newSnapshot, nil
+            }
+
+        case <-signals:
+            fmt.Print("\n")
+            return
+
+        case key, ok := <-keys:
+            if !ok {
+                return
+            } else if filtering {
+                switch key {
+                case '\n', '\r':
+                    filtering = false
+                case 127, '\b':
+                    if len(filter) > 0 {
+                        filter = filter[:len(filter) - 1]
+                    }
+                default:
+                    filter += string(key)
+                }
+            } else {
+                switch key {
+                case 's':
+                    cycleSort()
+                case 'r':
+                    sortReverse = !sortReverse
+                case '/':
+                    filtering = true
+                    filter = ""
+                case 'q':
+                    fmt.Print("\n")
+                    return
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,993 @@
+package main
+
+import (
+    "github.com/qmsk/clusterf"
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/health"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var (
+    filesConfig config.FilesConfig
+    etcdConfig  config.EtcdConfig
+    secretsConfig   config.SecretsConfig
+    generateKeyFile string
+    healthOptions   health.Options
+    replayIPVSConfig    clusterf.IpvsConfig
+    zeroURL     string
+    adminTokenFile  string
+    versionURL  string
+    traceURL    string
+    pinURL      string
+    pinTTL      time.Duration
+    connsURL    string
+    connsWindow     time.Duration
+    connsInterval   time.Duration
+    connsFormat     string
+    hashingSchedName    string
+    hashingDelete       bool
+    shiftDuration   time.Duration
+    shiftFinish     bool
+    shiftAbort      bool
+    experimentStart     bool
+    experimentStop      bool
+    experimentDelete    bool
+    gcDelete    bool
+
+    checkFlags  = flag.NewFlagSet("check", flag.ExitOnError)
+    exportFlags = flag.NewFlagSet("export", flag.ExitOnError)
+    drainFlags  = flag.NewFlagSet("drain", flag.ExitOnError)
+    sealFlags   = flag.NewFlagSet("seal", flag.ExitOnError)
+    probeFlags  = flag.NewFlagSet("probe", flag.ExitOnError)
+    replayFlags = flag.NewFlagSet("replay", flag.ExitOnError)
+    hashingFlags    = flag.NewFlagSet("hashing", flag.ExitOnError)
+    zeroFlags   = flag.NewFlagSet("zero", flag.ExitOnError)
+    versionFlags    = flag.NewFlagSet("version", flag.ExitOnError)
+    traceFlags  = flag.NewFlagSet("trace", flag.ExitOnError)
+    pinFlags    = flag.NewFlagSet("pin", flag.ExitOnError)
+    connsFlags  = flag.NewFlagSet("conns", flag.ExitOnError)
+    shiftFlags  = flag.NewFlagSet("shift", flag.ExitOnError)
+    experimentFlags = flag.NewFlagSet("experiment", flag.ExitOnError)
+    gcFlags     = flag.NewFlagSet("gc", flag.ExitOnError)
+)
+
+func etcdFlags(flags *flag.FlagSet) {
+    flags.StringVar(&etcdConfig.Machines, "etcd-machines", "http://127.0.0.1:2379",
+        "Client endpoint for etcd")
+    flags.StringVar(&etcdConfig.Prefix, "etcd-prefix", "/clusterf",
+        "Etcd tree prefix")
+}
+
+func init() {
+    checkFlags.StringVar(&filesConfig.Path, "config-path", "",
+        "Also check the local config tree")
+
+    etcdFlags(checkFlags)
+    etcdFlags(exportFlags)
+    etcdFlags(drainFlags)
+    etcdFlags(probeFlags)
+    etcdFlags(hashingFlags)
+    etcdFlags(shiftFlags)
+    etcdFlags(experimentFlags)
+    etcdFlags(gcFlags)
+
+    healthOptions.Flags(probeFlags, true)
+
+    sealFlags.StringVar(&secretsConfig.PublicKey, "public-key", "",
+        "Seal using the given base64-encoded public key")
+    sealFlags.StringVar(&generateKeyFile, "generate-key-file", "",
+        "Write a new base64-encoded private key to the given file for the daemon -secret-key-file, and print the public key")
+
+    zeroFlags.StringVar(&zeroURL, "zero-url", "http://127.0.0.1:9100/zero",
+        "POST to the clusterf-ipvs -http-listen /zero URL")
+    zeroFlags.StringVar(&adminTokenFile, "admin-token-file", "",
+        "Send the bearer token from the given file, for the clusterf-ipvs -http-admin-token-file")
+
+    versionFlags.StringVar(&versionURL, "version-url", "",
+        "Also GET the version of a running clusterf-ipvs from the -http-listen /version URL, e.g. http://127.0.0.1:9100/version")
+
+    traceFlags.StringVar(&traceURL, "trace-url", "http://127.0.0.1:9100/trace",
+        "GET from the clusterf-ipvs -http-listen /trace URL")
+
+    pinFlags.StringVar(&pinURL, "pin-url", "http://127.0.0.1:9100/pin",
+        "POST or DELETE to the clusterf-ipvs -http-listen /pin URL")
+    pinFlags.DurationVar(&pinTTL, "ttl", clusterf.PIN_TTL,
+        "Remove the pin after the given duration")
+    pinFlags.StringVar(&adminTokenFile, "admin-token-file", "",
+        "Send the bearer token from the given file, for the clusterf-ipvs -http-admin-token-file")
+
+    connsFlags.StringVar(&connsURL, "conns-url", "http://127.0.0.1:9100/conns",
+        "GET from the clusterf-ipvs -http-listen /conns URL")
+    connsFlags.DurationVar(&connsWindow, "window", 60 * time.Second,
+        "Sample the IPVS connection table over the given window")
+    connsFlags.DurationVar(&connsInterval, "interval", 1 * time.Second,
+        "Sample the IPVS connection table at the given interval")
+    connsFlags.StringVar(&connsFormat, "format", "csv",
+        "Timeline output format: csv json")
+
+    hashingFlags.StringVar(&hashingSchedName, "sched-name", "mh",
+        "IPVS hashing scheduler: sh mh")
+    hashingFlags.BoolVar(&hashingDelete, "delete", false,
+        "Estimate removing the backend")
+
+    shiftFlags.DurationVar(&shiftDuration, "duration", 10 * time.Minute,
+        "Shift the backend weights over the given duration")
+    shiftFlags.BoolVar(&shiftFinish, "finish", false,
+        "Finish a completed shift, switching the frontend to the new group")
+    shiftFlags.BoolVar(&shiftAbort, "abort", false,
+        "Abort the shift, returning to the frontend group")
+
+    experimentFlags.BoolVar(&experimentStart, "start", false,
+        "Start the experiment, using the experiment weights")
+    experimentFlags.BoolVar(&experimentStop, "stop", false,
+        "Stop the experiment, returning to the configured weights")
+    experimentFlags.BoolVar(&experimentDelete, "delete", false,
+        "Delete the experiment")
+
+    gcFlags.BoolVar(&gcDelete, "delete", false,
+        "Remove the orphaned nodes, instead of only listing them")
+
+    replayFlags.StringVar(&replayIPVSConfig.FwdMethod, "ipvs-fwd-method", "masq",
+        "IPVS Forwarding method: masq tunnel droute")
+    replayFlags.StringVar(&replayIPVSConfig.SchedName, "ipvs-sched-name", clusterf.IPVS_SCHED_NAME,
+        "IPVS Service Scheduler")
+    replayFlags.StringVar(&replayIPVSConfig.NodeName, "ipvs-node-name", "",
+        "Node name for consistent hashing of backend subsets (default hostname)")
+    replayFlags.StringVar(&replayIPVSConfig.ApplyOrder, "ipvs-apply-order", clusterf.ApplyAddFirst,
+        "Order of changes when replacing services or backends: add-first or del-first")
+}
+
+/* check */
+func runCheck(args []string) error {
+    var errs []error
+
+    if len(args) > 0 {
+        return fmt.Errorf("Unexpected arguments: %v", args)
+    }
+
+    if filesConfig.Path == "" {
+
+    } else if files, err := filesConfig.Open(); err != nil {
+        return err
+    } else if _, err := files.Scan(); err != nil {
+        errs = append(errs, fmt.Errorf("%s: %v", files, err))
+    }
+
+    if etcdConfig.Prefix == "" {
+
+    } else if etcd, err := etcdConfig.Open(); err != nil {
+        return err
+    } else if nodes, err := etcd.Nodes(); err != nil {
+        return err
+    } else {
+        errs = append(errs, config.CheckNodes(nodes)...)
+
+        log.Printf("config:Etcd.Nodes %s: %d nodes\n", etcd, len(nodes))
+    }
+
+    for _, err := range errs {
+        fmt.Printf("%v\n", err)
+    }
+
+    if len(errs) > 0 {
+        return fmt.Errorf("%d invalid nodes", len(errs))
+    }
+
+    return nil
+}
+
+/* gc */
+func runGC(args []string) error {
+    if len(args) > 0 {
+        return fmt.Errorf("Unexpected arguments: %v", args)
+    }
+
+    etcd, err := etcdConfig.Open()
+    if err != nil {
+        return err
+    }
+
+    nodes, err := etcd.Nodes()
+    if err != nil {
+        return err
+    }
+
+    orphans := config.FindOrphans(nodes)
+
+    for _, orphan := range orphans {
+        fmt.Printf("%v\n", orphan)
+    }
+
+    if !gcDelete {
+        log.Printf("config:Etcd.Nodes %s: %d orphaned nodes of %d, use -delete to remove\n", etcd, len(orphans), len(nodes))
+    } else if count, err := config.RemoveOrphans(etcd, orphans); err != nil {
+        return err
+    } else {
+        log.Printf("config:Etcd.Remove %s: %d orphaned nodes\n", etcd, count)
+    }
+
+    return nil
+}
+
+/* export */
+func runExport(args []string) error {
+    if len(args) > 0 {
+        return fmt.Errorf("Unexpected arguments: %v", args)
+    }
+
+    etcd, err := etcdConfig.Open()
+    if err != nil {
+        return err
+    }
+
+    nodes, err := etcd.Nodes()
+    if err != nil {
+        return err
+    }
+
+    if applyConfig, err := config.ExportNodes(nodes); err != nil {
+        return err
+    } else if jsonValue, err := json.MarshalIndent(applyConfig, "", "  "); err != nil {
+        return err
+    } else {
+        fmt.Printf("%s\n", jsonValue)
+    }
+
+    return nil
+}
+
+/* probe */
+func runProbe(args []string) error {
+    var serviceName, backendName string
+    var checked, failed int
+
+    if len(args) == 1 {
+        serviceName = args[0]
+    } else if len(args) == 2 {
+        serviceName, backendName = args[0], args[1]
+    } else {
+        return fmt.Errorf("Usage: <service> [backend]")
+    }
+
+    check, err := healthOptions.Open()
+    if err != nil {
+        return err
+    } else if check == nil {
+        return fmt.Errorf("Missing -health-* check")
+    }
+
+    etcd, err := etcdConfig.Open()
+    if err != nil {
+        return err
+    }
+
+    configs, err := etcd.List()
+    if err != nil {
+        return err
+    }
+
+    backends := config.RollingBackends(configs, serviceName)
+
+    for _, backendConfig := range backends {
+        if backendName != "" && backendConfig.BackendName != backendName {
+            continue
+        }
+
+        result := check.Run(backendConfig)
+        checked++
+
+        if result.Error != nil {
+            failed++
+        }
+
+        fmt.Printf("%v\n", result)
+    }
+
+    if len(backends) == 0 {
+        return fmt.Errorf("No backends for service: %s", serviceName)
+    } else if checked == 0 {
+        return fmt.Errorf("Backend not found: %s/%s", serviceName, backendName)
+    } else if failed > 0 {
+        return fmt.Errorf("%d backends failed", failed)
+    }
+
+    return nil
+}
+
+/* drain */
+func setDrain(args []string, drain bool) error {
+    if len(args) != 2 {
+        return fmt.Errorf("Usage: <service> <backend>")
+    }
+
+    serviceName, backendName := args[0], args[1]
+
+    etcd, err := etcdConfig.Open()
+    if err != nil {
+        return err
+    }
+
+    configs, err := etcd.List()
+    if err != nil {
+        return err
+    }
+
+    for _, backendConfig := range config.RollingBackends(configs, serviceName) {
+        if backendConfig.BackendName != backendName {
+            continue
+        }
+
+        backendConfig.Backend.Drain = drain
+
+        if err := etcd.Publish(backendConfig); err != nil {
+            return err
+        }
+
+        log.Printf("config:Etcd.Publish %s/%s: drain=%v\n", serviceName, backendName, drain)
+
+        return nil
+    }
+
+    return fmt.Errorf("Backend not found: %s/%s", serviceName, backendName)
+}
+
+func runDrain(args []string) error {
+    return setDrain(args, true)
+}
+
+func runUndrain(args []string) error {
+    return setDrain(args, false)
+}
+
+/* hashing */
+func runHashing(args []string) error {
+    var serviceName, backendName string
+    var backend config.ServiceBackend
+    var found bool
+    var oldDests, newDests []clusterf.HashingDest
+
+    if len(args) == 2 && hashingDelete {
+        serviceName, backendName = args[0], args[1]
+    } else if len(args) == 3 && !hashingDelete {
+        serviceName, backendName = args[0], args[1]
+
+        if err := json.Unmarshal([]byte(args[2]), &backend); err != nil {
+            return fmt.Errorf("Invalid backend: %v", err)
+        }
+    } else {
+        return fmt.Errorf("Usage: <service> <backend> <json> | -delete <service> <backend>")
+    }
+
+    etcd, err := etcdConfig.Open()
+    if err != nil {
+        return err
+    }
+
+    configs, err := etcd.List()
+    if err != nil {
+        return err
+    }
+
+    // the kernel sh scheduler uses the dests in the order they were added, which is not known; assume the sorted order
+    for _, backendConfig := range config.RollingBackends(configs, serviceName) {
+        oldDests = append(oldDests, clusterf.MakeHashingDest(backendConfig.BackendName, backendConfig.Backend))
+
+        if backendConfig.BackendName != backendName {
+            newDests = append(newDests, clusterf.MakeHashingDest(backendConfig.BackendName, backendConfig.Backend))
+        } else if hashingDelete {
+            found = true
+        } else {
+            found = true
+            newDests = append(newDests, clusterf.MakeHashingDest(backendName, backend))
+        }
+    }
+
+    if hashingDelete && !found {
+        return fmt.Errorf("Backend not found: %s/%s", serviceName, backendName)
+    } else if !found {
+        newDests = append(newDests, clusterf.MakeHashingDest(backendName, backend))
+    }
+
+    report, err := clusterf.ReportHashing(hashingSchedName, oldDests, newDests)
+    if err != nil {
+        return err
+    }
+
+    for _, dest := range newDests {
+        fmt.Printf("%-20s %-24s %6d -> %d slots\n", dest.Name, dest.Addr, report.OldSlots[dest.Addr], report.NewSlots[dest.Addr])
+    }
+    for _, dest := range oldDests {
+        if _, exists := report.NewSlots[dest.Addr]; !exists {
+            fmt.Printf("%-20s %-24s %6d -> %d slots\n", dest.Name, dest.Addr, report.OldSlots[dest.Addr], 0)
+        }
+    }
+
+    fmt.Printf("%s/%s: %v\n", serviceName, backendName, report)
+
+    return nil
+}
+
+/* shift */
+
+// Return the current frontend and shift for the service, or nil
+func loadShift(configs []config.Config, serviceName string) (frontendConfig *config.ConfigServiceFrontend, shiftConfig *config.ConfigServiceShift) {
+    for _, baseConfig := range configs {
+        switch applyConfig := baseConfig.(type) {
+        case *config.ConfigServiceFrontend:
+            if applyConfig.ServiceName == serviceName {
+                frontendConfig = applyConfig
+            }
+        case *config.ConfigServiceShift:
+            if applyConfig.ServiceName == serviceName {
+                shiftConfig = applyConfig
+            }
+        }
+    }
+
+    return
+}
+
+func runShift(args []string) error {
+    var serviceName, fromGroup, toGroup string
+
+    if len(args) == 1 {
+        serviceName = args[0]
+    } else if len(args) == 3 && !shiftFinish && !shiftAbort {
+        serviceName, fromGroup, toGroup = args[0], args[1], args[2]
+    } else {
+        return fmt.Errorf("Usage: <service> [<from-group> <to-group>] | -finish <service> | -abort <service>")
+    }
+
+    etcd, err := etcdConfig.Open()
+    if err != nil {
+        return err
+    }
+
+    configs, err := etcd.List()
+    if err != nil {
+        return err
+    }
+
+    frontendConfig, shiftConfig := loadShift(configs, serviceName)
+
+    if frontendConfig == nil {
+        return fmt.Errorf("Service not found: %s", serviceName)
+    }
+
+    if toGroup != "" {
+        if frontendConfig.Frontend.Group != fromGroup {
+            return fmt.Errorf("Service %s frontend group is %#v, not %#v", serviceName, frontendConfig.Frontend.Group, fromGroup)
+        } else if shiftConfig != nil {
+            return fmt.Errorf("Service %s is already shifting: %v", serviceName, shiftConfig.Shift)
+        }
+
+        shiftConfig = &config.ConfigServiceShift{ServiceName: serviceName, Shift: config.ServiceShift{
+            From:       fromGroup,
+            To:         toGroup,
+            Start:      time.Now().UTC().Truncate(time.Second),
+            Duration:   config.Duration(shiftDuration),
+        }}
+
+        if err := etcd.Publish(shiftConfig); err != nil {
+            return err
+        }
+
+        log.Printf("config:Etcd.Publish %s: %v\n", shiftConfig.Path(), shiftConfig.Shift)
+
+    } else if shiftConfig == nil {
+        return fmt.Errorf("Service %s is not shifting", serviceName)
+
+    } else if shiftAbort {
+        if err := etcd.Retract(shiftConfig); err != nil {
+            return err
+        }
+
+        log.Printf("config:Etcd.Retract %s: aborted %v\n", shiftConfig.Path(), shiftConfig.Shift)
+
+    } else if shiftFinish {
+        if !shiftConfig.Shift.Done(time.Now()) {
+            return fmt.Errorf("Service %s shift is not yet done: %.0f%%", serviceName, shiftConfig.Shift.Progress(time.Now()) * 100)
+        }
+
+        // switch the frontend before removing the shift, so that the old group is not used in between
+        frontendConfig.Frontend.Group = shiftConfig.Shift.To
+
+        if err := etcd.Publish(frontendConfig); err != nil {
+            return err
+        } else if err := etcd.Retract(shiftConfig); err != nil {
+            return err
+        }
+
+        log.Printf("config:Etcd.Publish %s: group=%s\n", frontendConfig.Path(), frontendConfig.Frontend.Group)
+
+    } else {
+        fmt.Printf("%s: %v: %.0f%%\n", serviceName, shiftConfig.Shift, shiftConfig.Shift.Progress(time.Now()) * 100)
+    }
+
+    return nil
+}
+
+/* experiment */
+
+// Parse the backend=weight args
+func parseExperimentWeights(args []string) (map[string]uint, error) {
+    var weights = make(map[string]uint)
+
+    for _, arg := range args {
+        if parts := strings.SplitN(arg, "=", 2); len(parts) != 2 {
+            return nil, fmt.Errorf("Invalid weight, expected backend=weight: %s", arg)
+        } else if weight, err := strconv.ParseUint(parts[1], 10, 32); err != nil {
+            return nil, fmt.Errorf("Invalid weight %s: %v", arg, err)
+        } else {
+            weights[parts[0]] = uint(weight)
+        }
+    }
+
+    return weights, nil
+}
+
+func runExperiment(args []string) error {
+    if len(args) < 2 || (len(args) > 2 && (experimentStart || experimentStop || experimentDelete)) {
+        return fmt.Errorf("Usage: <service> <experiment> [backend=weight...] | -start|-stop|-delete <service> <experiment>")
+    }
+
+    var serviceName, experimentName = args[0], args[1]
+    var experimentConfig *config.ConfigServiceExperiment
+
+    weights, err := parseExperimentWeights(args[2:])
+    if err != nil {
+        return err
+    }
+
+    etcd, err := etcdConfig.Open()
+    if err != nil {
+        return err
+    }
+
+    configs, err := etcd.List()
+    if err != nil {
+        return err
+    }
+
+    for _, baseConfig := range configs {
+        if applyConfig, ok := baseConfig.(*config.ConfigServiceExperiment); ok && applyConfig.ServiceName == serviceName && applyConfig.ExperimentName == experimentName {
+            experimentConfig = applyConfig
+        }
+    }
+
+    if len(weights) > 0 {
+        if experimentConfig == nil {
+            experimentConfig = &config.ConfigServiceExperiment{ServiceName: serviceName, ExperimentName: experimentName}
+        }
+
+        // keep any active state
+        experimentConfig.Experiment.Weights = weights
+
+    } else if experimentConfig == nil {
+        return fmt.Errorf("Experiment not found: %s/%s", serviceName, experimentName)
+
+    } else if experimentDelete {
+        if err := etcd.Retract(experimentConfig); err != nil {
+            return err
+        }
+
+        log.Printf("config:Etcd.Retract %s: %v\n", experimentConfig.Path(), experimentConfig.Experiment)
+
+        return nil
+
+    } else if experimentStart {
+        experimentConfig.Experiment.Active = true
+
+    } else if experimentStop {
+        experimentConfig.Experiment.Active = false
+
+    } else {
+        fmt.Printf("%s/%s: %v\n", serviceName, experimentName, experimentConfig.Experiment)
+
+        return nil
+    }
+
+    if err := etcd.Publish(experimentConfig); err != nil {
+        return err
+    }
+
+    log.Printf("config:Etcd.Publish %s: %v\n", experimentConfig.Path(), experimentConfig.Experiment)
+
+    return nil
+}
+
+/* seal */
+func runSeal(args []string) error {
+    var plaintext string
+
+    if generateKeyFile != "" {
+        if publicKey, privateKey, err := config.GenerateSecretKeys(); err != nil {
+            return err
+        } else if file, err := os.OpenFile(generateKeyFile, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600); err != nil {
+            return err
+        } else if _, err := fmt.Fprintf(file, "%s\n", privateKey); err != nil {
+            file.Close()
+            return err
+        } else if err := file.Close(); err != nil {
+            return err
+        } else {
+            fmt.Printf("%s\n", publicKey)
+        }
+
+        return nil
+    }
+
+    if len(args) > 1 {
+        return fmt.Errorf("Usage: [value]")
+    } else if len(args) == 1 {
+        plaintext = args[0]
+    } else if buf, err := ioutil.ReadAll(os.Stdin); err != nil {
+        return err
+    } else {
+        plaintext = strings.TrimRight(string(buf), "\n")
+    }
+
+    if secretsConfig.PublicKey == "" {
+        return fmt.Errorf("Missing -public-key")
+    } else if secrets, err := secretsConfig.Open(); err != nil {
+        return err
+    } else if sealed, err := secrets.Seal(plaintext); err != nil {
+        return err
+    } else {
+        fmt.Printf("%s\n", sealed)
+    }
+
+    return nil
+}
+
+// Set the 'Authorization: Bearer <token>' header using the -admin-token-file, if any
+func authorizeAdmin(request *http.Request) error {
+    if adminTokenFile == "" {
+        return nil
+    } else if buf, err := ioutil.ReadFile(adminTokenFile); err != nil {
+        return err
+    } else if token := strings.TrimSpace(string(buf)); token == "" {
+        return fmt.Errorf("empty token file: %s", adminTokenFile)
+    } else {
+        request.Header.Set("Authorization", "Bearer " + token)
+    }
+
+    return nil
+}
+
+/* zero */
+func runZero(args []string) error {
+    var form = make(url.Values)
+
+    if len(args) > 1 {
+        return fmt.Errorf("Usage: [service]")
+    } else if len(args) == 1 {
+        form.Set("service", args[0])
+    }
+
+    request, err := http.NewRequest("POST", zeroURL, strings.NewReader(form.Encode()))
+    if err != nil {
+        return err
+    }
+
+    request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+    if err := authorizeAdmin(request); err != nil {
+        return err
+    }
+
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode >= 200 && response.StatusCode < 300 {
+        return nil
+    } else if body, _ := ioutil.ReadAll(response.Body); len(body) > 0 {
+        return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+    } else {
+        return fmt.Errorf("%s", response.Status)
+    }
+}
+
+/* version */
+func runVersion(args []string) error {
+    var buildInfo clusterf.BuildInfo
+
+    if len(args) > 0 {
+        return fmt.Errorf("Usage: no arguments")
+    }
+
+    fmt.Printf("clusterf %s\n", clusterf.GetBuildInfo())
+
+    if versionURL == "" {
+        return nil
+    }
+
+    response, err := http.Get(versionURL)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode != 200 {
+        return fmt.Errorf("%s", response.Status)
+    } else if err := json.NewDecoder(response.Body).Decode(&buildInfo); err != nil {
+        return err
+    }
+
+    fmt.Printf("clusterf-ipvs %s\n", buildInfo)
+
+    return nil
+}
+
+/* trace */
+func runTrace(args []string) error {
+    var query = make(url.Values)
+    var results []clusterf.TraceResult
+
+    if len(args) < 2 || len(args) > 3 {
+        return fmt.Errorf("Usage: <client> <vip> [port]")
+    }
+
+    query.Set("client", args[0])
+    query.Set("vip", args[1])
+
+    if len(args) == 3 {
+        query.Set("port", args[2])
+    }
+
+    response, err := http.Get(traceURL + "?" + query.Encode())
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode >= 200 && response.StatusCode < 300 {
+
+    } else if body, _ := ioutil.ReadAll(response.Body); len(body) > 0 {
+        return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+    } else {
+        return fmt.Errorf("%s", response.Status)
+    }
+
+    if err := json.NewDecoder(response.Body).Decode(&results); err != nil {
+        return err
+    }
+
+    for _, result := range results {
+        fmt.Printf("%s %s sched=%s", result.Name, result.Service, result.SchedName)
+
+        if result.Persistence > 0 {
+            fmt.Printf(" persistence=%ds", result.Persistence)
+        }
+
+        fmt.Printf("\n")
+
+        for _, conn := range result.Conns {
+            fmt.Printf("    %-5s %-24s -> %-24s %-8s %-12s %-12s expires=%ds\n", conn.Protocol, conn.Client, conn.Dest, conn.FwdMethod, conn.DestName, conn.State, conn.Expires)
+        }
+
+        if result.Dest != "" {
+            fmt.Printf("    new   %-24s -> %-24s %-8s %-12s (%s)\n", result.Client, result.Dest, result.FwdMethod, result.DestName, result.Reason)
+        } else {
+            fmt.Printf("    new   %-24s -> unknown: %s\n", result.Client, result.Reason)
+        }
+    }
+
+    return nil
+}
+
+/* pin */
+func requestPin(method string, form url.Values) (*http.Response, error) {
+    var requestURL = pinURL
+
+    if len(form) > 0 {
+        requestURL += "?" + form.Encode()
+    }
+
+    request, err := http.NewRequest(method, requestURL, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := authorizeAdmin(request); err != nil {
+        return nil, err
+    }
+
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+        return nil, err
+    }
+
+    if response.StatusCode >= 200 && response.StatusCode < 300 {
+        return response, nil
+    }
+
+    defer response.Body.Close()
+
+    if body, _ := ioutil.ReadAll(response.Body); len(body) > 0 {
+        return nil, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+    } else {
+        return nil, fmt.Errorf("%s", response.Status)
+    }
+}
+
+func printPin(pin clusterf.PinStatus) {
+    fmt.Printf("%s/%s %s expires=%s %s\n", pin.Service, pin.Backend, pin.Client, pin.Expires.Format(time.RFC3339), strings.Join(pin.Services, " "))
+}
+
+func runPin(args []string) error {
+    var form = make(url.Values)
+
+    if len(args) == 0 {
+        var pins []clusterf.PinStatus
+
+        response, err := requestPin("GET", form)
+        if err != nil {
+            return err
+        }
+        defer response.Body.Close()
+
+        if err := json.NewDecoder(response.Body).Decode(&pins); err != nil {
+            return err
+        }
+
+        for _, pin := range pins {
+            printPin(pin)
+        }
+
+        return nil
+
+    } else if len(args) != 3 {
+        return fmt.Errorf("Usage: [<service> <backend> <client>]")
+    }
+
+    var pin clusterf.PinStatus
+
+    form.Set("service", args[0])
+    form.Set("backend", args[1])
+    form.Set("client", args[2])
+    form.Set("ttl", pinTTL.String())
+
+    response, err := requestPin("POST", form)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if err := json.NewDecoder(response.Body).Decode(&pin); err != nil {
+        return err
+    }
+
+    printPin(pin)
+
+    return nil
+}
+
+func runUnpin(args []string) error {
+    var form = make(url.Values)
+
+    if len(args) != 2 {
+        return fmt.Errorf("Usage: <service> <client>")
+    }
+
+    form.Set("service", args[0])
+    form.Set("client", args[1])
+
+    response, err := requestPin("DELETE", form)
+    if err != nil {
+        return err
+    }
+
+    return response.Body.Close()
+}
+
+/* conns */
+func runConns(args []string) error {
+    var query = make(url.Values)
+
+    if len(args) > 0 {
+        return fmt.Errorf("Unexpected arguments: %v", args)
+    }
+
+    query.Set("window", connsWindow.String())
+    query.Set("interval", connsInterval.String())
+    query.Set("format", connsFormat)
+
+    response, err := http.Get(connsURL + "?" + query.Encode())
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode >= 200 && response.StatusCode < 300 {
+
+    } else if body, _ := ioutil.ReadAll(response.Body); len(body) > 0 {
+        return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+    } else {
+        return fmt.Errorf("%s", response.Status)
+    }
+
+    _, err = io.Copy(os.Stdout, response.Body)
+
+    return err
+}
+
+/* replay */
+func runReplay(args []string) error {
+    var services = clusterf.NewServices()
+    var driver *clusterf.IPVSDriver
+
+    if len(args) == 0 {
+        return fmt.Errorf("Usage: <file>...")
+    }
+
+    replayIPVSConfig.Mock = true
+
+    // the initial scan is loaded before syncing the driver, like clusterf-ipvs
+    syncDriver := func() error {
+        if driver != nil {
+            return nil
+        } else if ipvsDriver, err := services.SyncIPVS(replayIPVSConfig); err != nil {
+            return err
+        } else {
+            driver = ipvsDriver
+        }
+
+        return nil
+    }
+
+    replayRecord := func(record config.Record) error {
+        event, err := record.Event()
+        if err != nil {
+            log.Printf("replay @ %v: %s %s: %v\n", record.Time, record.Action, record.Path, err)
+            return nil
+        } else if event == nil {
+            return nil
+        }
+
+        log.Printf("replay @ %v: %s %s\n", record.Time, record.Action, record.Path)
+
+        if driver == nil && event.Action == config.NewConfig {
+            services.NewConfig(event.Config)
+        } else if err := syncDriver(); err != nil {
+            return err
+        } else {
+            services.ConfigEvent(*event)
+        }
+
+        return nil
+    }
+
+    for _, path := range args {
+        if file, err := os.Open(path); err != nil {
+            return err
+        } else if err := config.ReadRecords(file, replayRecord); err != nil {
+            file.Close()
+            return fmt.Errorf("%s: %v", path, err)
+        } else {
+            file.Close()
+        }
+    }
+
+    if err := syncDriver(); err != nil {
+        return err
+    }
+
+    driver.Print()
+
+    return nil
+}
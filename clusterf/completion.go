@@ -0,0 +1,109 @@
+package main
+/*
+ * Shell completion scripts, generated from the commands and their flags.
+ *
+ * The options for the separate clusterf-* commands are not known, so those complete filenames instead.
+ */
+
+import (
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+func commandNames() []string {
+    var names []string
+
+    for _, command := range commands {
+        names = append(names, command.name)
+    }
+
+    return names
+}
+
+// Return the flags and any positional args for the builtin command
+func commandWords(command command) []string {
+    return append(commandFlags(command), command.args...)
+}
+
+func commandFlags(command command) []string {
+    var flags []string
+
+    if command.flags != nil {
+        command.flags.VisitAll(func(f *flag.Flag) {
+            flags = append(flags, "-" + f.Name)
+        })
+    }
+
+    return flags
+}
+
+func writeBashCompletion(w io.Writer) {
+    fmt.Fprintf(w, "_clusterf() {\n")
+    fmt.Fprintf(w, "    local cur=${COMP_WORDS[COMP_CWORD]}\n\n")
+    fmt.Fprintf(w, "    if [ $COMP_CWORD -eq 1 ]; then\n")
+    fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(commandNames(), " "))
+    fmt.Fprintf(w, "        return\n")
+    fmt.Fprintf(w, "    fi\n\n")
+    fmt.Fprintf(w, "    case \"${COMP_WORDS[1]}\" in\n")
+
+    for _, command := range commands {
+        if command.exec != "" {
+            continue
+        }
+
+        fmt.Fprintf(w, "    %s)\n", command.name)
+        fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(commandWords(command), " "))
+        fmt.Fprintf(w, "        ;;\n")
+    }
+
+    fmt.Fprintf(w, "    *)\n")
+    fmt.Fprintf(w, "        COMPREPLY=($(compgen -f -- \"$cur\"))\n")
+    fmt.Fprintf(w, "        ;;\n")
+    fmt.Fprintf(w, "    esac\n")
+    fmt.Fprintf(w, "}\n\n")
+    fmt.Fprintf(w, "complete -F _clusterf clusterf\n")
+}
+
+func writeZshCompletion(w io.Writer) {
+    fmt.Fprintf(w, "autoload -U +X bashcompinit && bashcompinit\n\n")
+
+    writeBashCompletion(w)
+}
+
+func writeFishCompletion(w io.Writer) {
+    for _, command := range commands {
+        fmt.Fprintf(w, "complete -c clusterf -f -n __fish_use_subcommand -a %s -d %q\n", command.name, command.help)
+    }
+
+    for _, command := range commands {
+        for _, flag := range commandFlags(command) {
+            fmt.Fprintf(w, "complete -c clusterf -n \"__fish_seen_subcommand_from %s\" -o %s\n", command.name, strings.TrimPrefix(flag, "-"))
+        }
+
+        if command.args != nil {
+            fmt.Fprintf(w, "complete -c clusterf -f -n \"__fish_seen_subcommand_from %s\" -a %q\n", command.name, strings.Join(command.args, " "))
+        }
+    }
+}
+
+func runCompletion(args []string) error {
+    if len(args) != 1 {
+        return fmt.Errorf("Usage: <bash|zsh|fish>")
+    }
+
+    switch args[0] {
+    case "bash":
+        writeBashCompletion(os.Stdout)
+    case "zsh":
+        writeZshCompletion(os.Stdout)
+    case "fish":
+        writeFishCompletion(os.Stdout)
+    default:
+        return fmt.Errorf("Unknown shell: %s", args[0])
+    }
+
+    return nil
+}
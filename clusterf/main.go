@@ -0,0 +1,144 @@
+package main
+/*
+ * Single clusterf command, dispatching to the builtin subcommands, or the separate clusterf-* commands.
+ */
+
+import (
+    "github.com/qmsk/clusterf/flags"
+    "flag"
+    "fmt"
+    "os"
+    "os/exec"
+    "syscall"
+)
+
+type command struct {
+    name        string
+    help        string
+
+    // run the separate clusterf-* command with any extra args
+    exec        string
+    execArgs    []string
+
+    // builtin
+    usage       string
+    args        []string    // shell completion for any positional args
+    flags       *flag.FlagSet
+    run         func(args []string) error
+}
+
+var commands []command
+
+func init() {
+    commands = []command{
+        {name: "run",       help: "Run the IPVS daemon",                    exec: "clusterf-ipvs"},
+        {name: "docker",    help: "Run the Docker backend daemon",          exec: "clusterf-docker"},
+        {name: "check",     help: "Check the config for any invalid nodes", flags: checkFlags, run: runCheck},
+        {name: "diff",      help: "Show the changes for a YAML file",       exec: "clusterf-apply", execArgs: []string{"-dry-run"}},
+        {name: "apply",     help: "Apply the services from a YAML file",    exec: "clusterf-apply"},
+        {name: "gc",        help: "List or remove orphaned config nodes",  flags: gcFlags, run: runGC},
+        {name: "export",    help: "Export the services as JSON, for apply", flags: exportFlags, run: runExport},
+        {name: "status",    help: "Show the current IPVS stats",            exec: "clusterf-top", execArgs: []string{"-once"}},
+        {name: "top",       help: "Show the live IPVS stats",               exec: "clusterf-top"},
+        {name: "zero",      help: "Reset the IPVS stats counters",          usage: "[service]", flags: zeroFlags, run: runZero},
+        {name: "trace",     help: "Trace a client through the IPVS services", usage: "<client> <vip> [port]", flags: traceFlags, run: runTrace},
+        {name: "pin",       help: "List or pin a client to a service backend", usage: "[<service> <backend> <client>]", flags: pinFlags, run: runPin},
+        {name: "unpin",     help: "Remove the pin of a client",             usage: "<service> <client>", flags: pinFlags, run: runUnpin},
+        {name: "conns",     help: "Export a timeline of the IPVS connection table", flags: connsFlags, run: runConns},
+        {name: "drain",     help: "Drain a service backend",                usage: "<service> <backend>", flags: drainFlags, run: runDrain},
+        {name: "probe",     help: "Check the service backends now",         usage: "<service> [backend]", flags: probeFlags, run: runProbe},
+        {name: "undrain",   help: "Undrain a service backend",              usage: "<service> <backend>", flags: drainFlags, run: runUndrain},
+        {name: "hashing",   help: "Estimate the hash slots remapped by a change", usage: "<service> <backend> [json]", flags: hashingFlags, run: runHashing},
+        {name: "shift",     help: "Shift a service between backend groups", usage: "<service> [from-group to-group]", flags: shiftFlags, run: runShift},
+        {name: "experiment", help: "Define, start or stop an A/B weight experiment", usage: "<service> <experiment> [backend=weight...]", flags: experimentFlags, run: runExperiment},
+        {name: "seal",      help: "Seal a secret command-line value",       usage: "[value]", flags: sealFlags, run: runSeal},
+        {name: "replay",    help: "Replay recorded config events offline",  usage: "<file>...", flags: replayFlags, run: runReplay},
+        {name: "rolling",   help: "Rolling restart of service backends",    exec: "clusterf-rolling"},
+        {name: "primary",   help: "Drain all but the primary backend",      exec: "clusterf-primary"},
+        {name: "migrate",   help: "Migrate the config from etcd v2 to v3",  exec: "clusterf-migrate"},
+        {name: "version",   help: "Show the version of clusterf, and of any running clusterf-ipvs", flags: versionFlags, run: runVersion},
+        {name: "completion", help: "Generate shell completion for bash, zsh or fish", usage: "<shell>", args: []string{"bash", "zsh", "fish"}, flags: flag.NewFlagSet("completion", flag.ExitOnError), run: runCompletion},
+    }
+}
+
+func lookupCommand(name string) *command {
+    for i := range commands {
+        if commands[i].name == name {
+            return &commands[i]
+        }
+    }
+
+    return nil
+}
+
+func usage() {
+    fmt.Fprintf(os.Stderr, "Usage: %s <command> [options] [args]\n\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Commands:\n")
+
+    for _, command := range commands {
+        fmt.Fprintf(os.Stderr, "    %-12s %s\n", command.name, command.help)
+    }
+
+    fmt.Fprintf(os.Stderr, "\nUse %s <command> -help for the command options.\n", os.Args[0])
+}
+
+// Replace this process with the separate clusterf-* command
+func (self command) execCommand(args []string) error {
+    path, err := exec.LookPath(self.exec)
+    if err != nil {
+        return err
+    }
+
+    argv := append([]string{self.exec}, self.execArgs...)
+    argv = append(argv, args...)
+
+    return syscall.Exec(path, argv, os.Environ())
+}
+
+func (self command) runCommand(args []string) error {
+    self.flags.Usage = func() {
+        fmt.Fprintf(os.Stderr, "Usage: %s %s [options] %s\n\n", os.Args[0], self.name, self.usage)
+        self.flags.PrintDefaults()
+    }
+
+    if err := flags.ParseFlagSet(self.flags, args); err != nil {
+        return err
+    }
+
+    return self.run(self.flags.Args())
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        usage()
+        os.Exit(1)
+    }
+
+    name, args := os.Args[1], os.Args[2:]
+
+    if name == "help" || name == "-help" || name == "-h" {
+        usage()
+        return
+    }
+
+    command := lookupCommand(name)
+
+    if command == nil {
+        fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+        usage()
+        os.Exit(1)
+    }
+
+    var err error
+
+    if command.exec != "" {
+        err = command.execCommand(args)
+    } else {
+        err = command.runCommand(args)
+    }
+
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s %s: %v\n", os.Args[0], command.name, err)
+        os.Exit(1)
+    }
+}
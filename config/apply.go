@@ -0,0 +1,247 @@
+package config
+/*
+ * Declarative desired state for services, merged into the existing config tree.
+ */
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "reflect"
+    "sort"
+)
+
+// Desired state for the named services.
+//
+// The frontend and backend values are merged into any existing values as JSON merge patches: any given keys replace the existing values,
+// any null keys remove the existing values, and any other existing keys are kept as-is. A null backend removes the backend.
+type ApplyConfig struct {
+    Services    map[string]ApplyService     `json:"services"`
+}
+
+type ApplyService struct {
+    Frontend    map[string]interface{}              `json:"frontend,omitempty"`
+    Backends    map[string]map[string]interface{}   `json:"backends,omitempty"`
+}
+
+// A change to a config node
+type ApplyChange struct {
+    Action      Action  // SetConfig or DelConfig
+    Node        Node
+}
+
+func (self ApplyChange) String() string {
+    switch self.Action {
+    case DelConfig:
+        return fmt.Sprintf("- %s", self.Node.Path)
+    default:
+        return fmt.Sprintf("+ %s %s", self.Node.Path, self.Node.Value)
+    }
+}
+
+// Return the config event for the change, as it would be seen by the Sync() of the written node
+func (self ApplyChange) Event() (*Event, error) {
+    return syncEvent(self.Action, self.Node)
+}
+
+// Write and remove config nodes, implemented by Etcd
+type NodeWriter interface {
+    Put(node Node) error
+    Remove(node Node) error
+}
+
+type applyChanges []ApplyChange
+
+func (self applyChanges) Len() int            { return len(self) }
+func (self applyChanges) Swap(i, j int)       { self[i], self[j] = self[j], self[i] }
+func (self applyChanges) Less(i, j int) bool  { return self[i].Node.Path < self[j].Node.Path }
+
+// Merge the patch into the value, returning the merged value
+func mergePatch(value map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+    merged := make(map[string]interface{})
+
+    for key, item := range value {
+        merged[key] = item
+    }
+
+    for key, item := range patch {
+        if item == nil {
+            delete(merged, key)
+        } else if itemPatch, ok := item.(map[string]interface{}); !ok {
+            merged[key] = item
+        } else if itemValue, ok := merged[key].(map[string]interface{}); !ok {
+            merged[key] = mergePatch(nil, itemPatch)
+        } else {
+            merged[key] = mergePatch(itemValue, itemPatch)
+        }
+    }
+
+    return merged
+}
+
+// Return the change to merge the patch into the existing node, or nil if unchanged
+func applyNode(path string, nodes map[string]Node, patch map[string]interface{}) (*ApplyChange, error) {
+    var value map[string]interface{}
+
+    node, exists := nodes[path]
+
+    if !exists {
+
+    } else if err := json.Unmarshal([]byte(node.Value), &value); err != nil {
+        return nil, fmt.Errorf("%s: invalid existing value: %v", path, err)
+    }
+
+    merged := mergePatch(value, patch)
+
+    if exists && reflect.DeepEqual(merged, value) {
+        return nil, nil
+    }
+
+    change := ApplyChange{Action: SetConfig, Node: Node{Path: path}}
+
+    if jsonValue, err := json.Marshal(merged); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    } else {
+        change.Node.Value = string(jsonValue)
+    }
+
+    // validate
+    if _, err := syncConfig(change.Node); err != nil {
+        return nil, err
+    }
+
+    return &change, nil
+}
+
+/*
+ * Return the changes required to apply the desired state to the existing nodes, in path order.
+ *
+ * With prune, any existing backends for the named services that are not given are removed.
+ */
+func (self ApplyConfig) Plan(nodes []Node, prune bool) ([]ApplyChange, error) {
+    var changes applyChanges
+
+    nodeMap := make(map[string]Node)
+
+    for _, node := range nodes {
+        if !node.IsDir {
+            nodeMap[node.Path] = node
+        }
+    }
+
+    for serviceName, service := range self.Services {
+        if serviceName == "" {
+            return nil, fmt.Errorf("Invalid empty service name")
+        }
+
+        if service.Frontend == nil {
+
+        } else if change, err := applyNode(makePath("services", serviceName, "frontend"), nodeMap, service.Frontend); err != nil {
+            return nil, err
+        } else if change != nil {
+            changes = append(changes, *change)
+        }
+
+        for backendName, backend := range service.Backends {
+            path := makePath("services", serviceName, "backends", backendName)
+
+            if backendName == "" {
+                return nil, fmt.Errorf("Invalid empty backend name for service %s", serviceName)
+            } else if backend != nil {
+
+            } else if node, exists := nodeMap[path]; exists {
+                changes = append(changes, ApplyChange{Action: DelConfig, Node: node})
+                continue
+            } else {
+                continue
+            }
+
+            if change, err := applyNode(path, nodeMap, backend); err != nil {
+                return nil, err
+            } else if change != nil {
+                changes = append(changes, *change)
+            }
+        }
+
+        if !prune {
+            continue
+        }
+
+        for path, node := range nodeMap {
+            if config, err := syncConfig(node); err != nil {
+                // invalid nodes are left as-is
+            } else if backendConfig, ok := config.(*ConfigServiceBackend); !ok {
+
+            } else if backendConfig.ServiceName != serviceName || backendConfig.BackendName == "" {
+
+            } else if _, exists := service.Backends[backendConfig.BackendName]; !exists {
+                changes = append(changes, ApplyChange{Action: DelConfig, Node: nodeMap[path]})
+            }
+        }
+    }
+
+    sort.Sort(changes)
+
+    return changes, nil
+}
+
+// Return the services in the given nodes as an ApplyConfig, which can be applied to re-create them, skipping any invalid nodes
+func ExportNodes(nodes []Node) (ApplyConfig, error) {
+    applyConfig := ApplyConfig{Services: make(map[string]ApplyService)}
+
+    for _, node := range nodes {
+        var value map[string]interface{}
+
+        if node.IsDir {
+            continue
+        } else if config, err := syncConfig(node); err != nil {
+            log.Printf("config:ExportNodes %s: %v\n", node.Path, err)
+        } else if frontendConfig, ok := config.(*ConfigServiceFrontend); ok {
+            if err := json.Unmarshal([]byte(node.Value), &value); err != nil {
+                return applyConfig, fmt.Errorf("%s: %v", node.Path, err)
+            }
+
+            service := applyConfig.Services[frontendConfig.ServiceName]
+            service.Frontend = value
+            applyConfig.Services[frontendConfig.ServiceName] = service
+
+        } else if backendConfig, ok := config.(*ConfigServiceBackend); ok && backendConfig.BackendName != "" {
+            if err := json.Unmarshal([]byte(node.Value), &value); err != nil {
+                return applyConfig, fmt.Errorf("%s: %v", node.Path, err)
+            }
+
+            service := applyConfig.Services[backendConfig.ServiceName]
+            if service.Backends == nil {
+                service.Backends = make(map[string]map[string]interface{})
+            }
+            service.Backends[backendConfig.BackendName] = value
+            applyConfig.Services[backendConfig.ServiceName] = service
+        }
+    }
+
+    return applyConfig, nil
+}
+
+// Write the changes, stopping on the first error
+func Apply(writer NodeWriter, changes []ApplyChange) error {
+    for _, change := range changes {
+        var err error
+
+        switch change.Action {
+        case SetConfig:
+            err = writer.Put(change.Node)
+        case DelConfig:
+            err = writer.Remove(change.Node)
+        default:
+            err = fmt.Errorf("Invalid action: %v", change.Action)
+        }
+
+        if err != nil {
+            return fmt.Errorf("%s: %v", change.Node.Path, err)
+        }
+
+        log.Printf("config:Apply %v\n", change)
+    }
+
+    return nil
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+var testApplyNodes = []Node{
+    {Path: "services", IsDir: true},
+    {Path: "services/test", IsDir: true},
+    {Path: "services/test/frontend", Value: `{"ipv4":"10.0.1.1","tcp":80,"backend_tcp":8080}`},
+    {Path: "services/test/backends/test1", Value: `{"ipv4":"10.1.0.1","weight":10}`},
+    {Path: "services/test/backends/test2", Value: `{"ipv4":"10.1.0.2"}`},
+    {Path: "services/other/backends/test1", Value: `{"ipv4":"10.2.0.1"}`},
+}
+
+var testApply = []struct {
+    apply   string
+    prune   bool
+    changes []string
+    error   string
+}{
+    {
+        apply:  `{"services": {"test": {"frontend": {"ipv4": "10.0.1.1", "tcp": 80, "backend_tcp": 8080}, "backends": {"test1": {"ipv4": "10.1.0.1"}}}}}`,
+        changes: nil,
+    },
+    {
+        apply:  `{"services": {"test": {"frontend": {"backend_tcp": null}, "backends": {"test1": {"weight": 20}, "test3": {"ipv4": "10.1.0.3"}}}}}`,
+        changes: []string{
+            `+ services/test/backends/test1 {"ipv4":"10.1.0.1","weight":20}`,
+            `+ services/test/backends/test3 {"ipv4":"10.1.0.3"}`,
+            `+ services/test/frontend {"ipv4":"10.0.1.1","tcp":80}`,
+        },
+    },
+    {
+        apply:  `{"services": {"test": {"backends": {"test2": null, "test4": null}}}}`,
+        changes: []string{
+            `- services/test/backends/test2`,
+        },
+    },
+    {
+        apply:  `{"services": {"test": {"backends": {"test1": {}}}}}`,
+        prune:  true,
+        changes: []string{
+            `- services/test/backends/test2`,
+        },
+    },
+    {
+        apply:  `{"services": {"dns": {"frontend": {"ipv4": "10.0.1.53", "port": 53, "protocols": ["tcp", "udp"]}}}}`,
+        prune:  true,
+        changes: []string{
+            `+ services/dns/frontend {"ipv4":"10.0.1.53","port":53,"protocols":["tcp","udp"]}`,
+        },
+    },
+    {
+        apply:  `{"services": {"test": {"backends": {"test1": {"protocols": ["icmp"]}}}}}`,
+        error:  `service test backend test1: Invalid protocol: "icmp"`,
+    },
+}
+
+func TestApply(t *testing.T) {
+    for _, test := range testApply {
+        var applyConfig ApplyConfig
+        var changes []string
+
+        if err := json.Unmarshal([]byte(test.apply), &applyConfig); err != nil {
+            t.Fatalf("json.Unmarshal %v: %v", test.apply, err)
+        }
+
+        applyChanges, err := applyConfig.Plan(testApplyNodes, test.prune)
+
+        if err != nil {
+            if test.error == "" || !strings.Contains(err.Error(), test.error) {
+                t.Errorf("fail %v: error %v", test.apply, err)
+            }
+            continue
+        } else if test.error != "" {
+            t.Errorf("fail %v: error nil", test.apply)
+        }
+
+        for _, change := range applyChanges {
+            changes = append(changes, change.String())
+        }
+
+        if fmt.Sprintf("%#v", changes) != fmt.Sprintf("%#v", test.changes) {
+            t.Errorf("fail %v:\n\t%#v\n\t!=\n\t%#v", test.apply, changes, test.changes)
+        }
+    }
+}
+
+func TestExport(t *testing.T) {
+    applyConfig, err := ExportNodes(testApplyNodes)
+    if err != nil {
+        t.Fatalf("ExportNodes: %v", err)
+    }
+
+    if len(applyConfig.Services) != 2 {
+        t.Errorf("export services: %#v", applyConfig.Services)
+    }
+
+    // re-applying the export is a no-op, even with prune
+    if changes, err := applyConfig.Plan(testApplyNodes, true); err != nil {
+        t.Errorf("Plan: %v", err)
+    } else if len(changes) > 0 {
+        t.Errorf("Plan changes: %v", changes)
+    }
+}
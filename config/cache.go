@@ -0,0 +1,144 @@
+package config
+/*
+ * Cache the last-known etcd config tree on disk, so that the daemon can start using the cached config while etcd is unreachable.
+ *
+ * The raw nodes are cached, before any filtering or admission policy.
+ * The cache file is replaced after each change.
+ */
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+type CacheConfig struct {
+    Path        string
+}
+
+type cacheNode struct {
+    Path    string  `json:"path"`
+    IsDir   bool    `json:"dir,omitempty"`
+    Value   string  `json:"value,omitempty"`
+}
+
+type cacheFile struct {
+    Time    time.Time   `json:"time"`
+    Nodes   []cacheNode `json:"nodes"`
+}
+
+type Cache struct {
+    config      CacheConfig
+
+    mutex       sync.Mutex
+    nodes       map[string]Node
+}
+
+func (self CacheConfig) Open() (*Cache, error) {
+    if self.Path == "" {
+        return nil, fmt.Errorf("Missing cache path")
+    }
+
+    return &Cache{config: self, nodes: make(map[string]Node)}, nil
+}
+
+func (self *Cache) String() string {
+    return self.config.Path
+}
+
+// Forget all nodes, before a new scan
+func (self *Cache) reset() {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.nodes = make(map[string]Node)
+}
+
+// Update the cached nodes for a scanned or synced node
+func (self *Cache) update(action Action, node Node) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    switch action {
+    case NewConfig, SetConfig:
+        self.nodes[node.Path] = node
+
+    case DelConfig:
+        delete(self.nodes, node.Path)
+
+        // recursive delete of a directory node
+        for path, _ := range self.nodes {
+            if strings.HasPrefix(path, node.Path + "/") {
+                delete(self.nodes, path)
+            }
+        }
+    }
+}
+
+// Replace the cache file with the current nodes
+func (self *Cache) write() error {
+    var file = cacheFile{Time: time.Now()}
+
+    self.mutex.Lock()
+
+    for _, node := range self.nodes {
+        file.Nodes = append(file.Nodes, cacheNode{Path: node.Path, IsDir: node.IsDir, Value: node.Value})
+    }
+
+    self.mutex.Unlock()
+
+    // parent directories before their children
+    sort.Slice(file.Nodes, func(i, j int) bool { return file.Nodes[i].Path < file.Nodes[j].Path })
+
+    buf, err := json.Marshal(file)
+    if err != nil {
+        return err
+    }
+
+    tmpPath := self.config.Path + ".tmp"
+
+    if err := ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+        return err
+    } else if err := os.Rename(tmpPath, self.config.Path); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// Load the cached configs, returning the time when the cache was last written.
+//
+// Any invalid cached nodes are logged and skipped, like for the etcd scan.
+func (self *Cache) Load() ([]Config, time.Time, error) {
+    var file cacheFile
+    var configs []Config
+
+    if buf, err := ioutil.ReadFile(self.config.Path); err != nil {
+        return nil, file.Time, err
+    } else if err := json.Unmarshal(buf, &file); err != nil {
+        return nil, file.Time, fmt.Errorf("%s: %v", self.config.Path, err)
+    }
+
+    for _, cacheNode := range file.Nodes {
+        node := Node{
+            Path:   cacheNode.Path,
+            IsDir:  cacheNode.IsDir,
+            Value:  cacheNode.Value,
+            Source: EtcdConfigSource,
+        }
+
+        if config, err := syncConfig(node); err != nil {
+            log.Printf("config:Cache.Load %s: %v\n", node.Path, err)
+        } else if config != nil {
+            configs = append(configs, config)
+        }
+    }
+
+    return configs, file.Time, nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestCache(t *testing.T) {
+    dir, err := ioutil.TempDir("", "clusterf-cache")
+    if err != nil {
+        t.Fatalf("ioutil.TempDir: %v", err)
+    }
+    defer os.RemoveAll(dir)
+
+    cache, err := CacheConfig{Path: filepath.Join(dir, "cache.json")}.Open()
+    if err != nil {
+        t.Fatalf("CacheConfig.Open: %v", err)
+    }
+
+    if _, _, err := cache.Load(); !os.IsNotExist(err) {
+        t.Errorf("Cache.Load missing: %v", err)
+    }
+
+    cache.reset()
+    cache.update(NewConfig, Node{Path: "services", IsDir: true, Source: EtcdConfigSource})
+    cache.update(NewConfig, Node{Path: "services/test/frontend", Value: `{"ipv4": "10.0.1.1", "tcp": 80}`, Source: EtcdConfigSource})
+    cache.update(NewConfig, Node{Path: "services/test/backends/test1", Value: `{"ipv4": "10.1.0.1", "tcp": 80}`, Source: EtcdConfigSource})
+    cache.update(NewConfig, Node{Path: "services/test2/frontend", Value: `{"ipv4": "10.0.1.2", "tcp": 80}`, Source: EtcdConfigSource})
+    cache.update(SetConfig, Node{Path: "services/test/backends/test2", Value: `{"ipv4": "10.1.0.2", "tcp": 80}`})
+    cache.update(DelConfig, Node{Path: "services/test/backends/test1"})
+    cache.update(DelConfig, Node{Path: "services/test2", IsDir: true})
+
+    if err := cache.write(); err != nil {
+        t.Fatalf("Cache.write: %v", err)
+    }
+
+    configs, cacheTime, err := cache.Load()
+    if err != nil {
+        t.Fatalf("Cache.Load: %v", err)
+    } else if cacheTime.IsZero() {
+        t.Errorf("Cache.Load: zero time")
+    }
+
+    expected := []Config{
+        &ConfigService{ConfigSource: EtcdConfigSource},
+        &ConfigServiceBackend{ConfigSource: EtcdConfigSource, ServiceName: "test", BackendName: "test2", Backend: ServiceBackend{IPv4: "10.1.0.2", TCP: 80}},
+        &ConfigServiceFrontend{ConfigSource: EtcdConfigSource, ServiceName: "test", Frontend: ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}},
+    }
+
+    if !reflect.DeepEqual(configs, expected) {
+        t.Errorf("Cache.Load:\n\t%#v\n!=\n\t%#v", configs, expected)
+    }
+}
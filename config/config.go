@@ -49,6 +49,46 @@ func (self ConfigServiceBackend) Source() ConfigSource {
     return self.ConfigSource
 }
 
+func (self ConfigServiceShift) Path() string {
+    return makePath("services", self.ServiceName, "shift")
+}
+func (self ConfigServiceShift) Value() interface{} {
+    return self.Shift
+}
+func (self ConfigServiceShift) Source() ConfigSource {
+    return self.ConfigSource
+}
+
+func (self ConfigServiceExperiment) Path() string {
+    return makePath("services", self.ServiceName, "experiments", self.ExperimentName)
+}
+func (self ConfigServiceExperiment) Value() interface{} {
+    return self.Experiment
+}
+func (self ConfigServiceExperiment) Source() ConfigSource {
+    return self.ConfigSource
+}
+
+func (self ConfigGroup) Path() string {
+    return makePath("groups", self.GroupName)
+}
+func (self ConfigGroup) Value() interface{} {
+    return nil
+}
+func (self ConfigGroup) Source() ConfigSource {
+    return self.ConfigSource
+}
+
+func (self ConfigGroupBackend) Path() string {
+    return makePath("groups", self.GroupName, "backends", self.BackendName)
+}
+func (self ConfigGroupBackend) Value() interface{} {
+    return self.Backend
+}
+func (self ConfigGroupBackend) Source() ConfigSource {
+    return self.ConfigSource
+}
+
 func (self ConfigRoute) Path() string {
     return makePath("routes", self.RouteName)
 }
@@ -58,3 +98,23 @@ func (self ConfigRoute) Value() interface{} {
 func (self ConfigRoute) Source() ConfigSource {
     return self.ConfigSource
 }
+
+func (self ConfigShard) Path() string {
+    return makePath("shards", self.NodeName)
+}
+func (self ConfigShard) Value() interface{} {
+    return self.Shard
+}
+func (self ConfigShard) Source() ConfigSource {
+    return self.ConfigSource
+}
+
+func (self ConfigStatus) Path() string {
+    return makePath("status", self.NodeName, self.ServiceName)
+}
+func (self ConfigStatus) Value() interface{} {
+    return self.Status
+}
+func (self ConfigStatus) Source() ConfigSource {
+    return self.ConfigSource
+}
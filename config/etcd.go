@@ -1,16 +1,33 @@
 package config
 
 import (
+    "github.com/qmsk/clusterf/errs"
     "github.com/coreos/go-etcd/etcd"
     etcdError "github.com/coreos/etcd/error"
     "fmt"
+    "io"
     "log"
+    "math/rand"
     "strings"
+    "sync"
+    "github.com/qmsk/clusterf/tasks"
+    "time"
 )
 
 type EtcdConfig struct {
     Machines    string
     Prefix      string
+
+    // Retry any failed watch with an exponential backoff, starting from WatchBackoff and capped at WatchBackoffMax
+    WatchBackoff    time.Duration   // default: 1s
+    WatchBackoffMax time.Duration   // default: 60s
+}
+
+// Watch reconnects after any errors
+type WatchStats struct {
+    Reconnects      uint64
+    LastReconnect   time.Time
+    LastError       string
 }
 
 type Etcd struct {
@@ -19,6 +36,12 @@ type Etcd struct {
 
     syncIndex   uint64
     watchChan   chan Event
+
+    watchMutex  sync.Mutex
+    watchStats  WatchStats
+
+    recorder    *Recorder
+    cache       *Cache
 }
 
 func (self *Etcd) String() string {
@@ -31,6 +54,13 @@ func (self *Etcd) String() string {
 func (self EtcdConfig) Open() (*Etcd, error) {
     e := &Etcd{config: self}
 
+    if e.config.WatchBackoff == 0 {
+        e.config.WatchBackoff = 1 * time.Second
+    }
+    if e.config.WatchBackoffMax == 0 {
+        e.config.WatchBackoffMax = 60 * time.Second
+    }
+
     machines := strings.Split(self.Machines, ",")
 
     e.client = etcd.NewClient(machines)
@@ -38,12 +68,47 @@ func (self EtcdConfig) Open() (*Etcd, error) {
     return e, nil
 }
 
+// Record the raw nodes from the initial Scan() and any Sync() events.
+//
+// Must be called before Scan().
+func (self *Etcd) SetRecorder(recorder *Recorder) {
+    self.recorder = recorder
+}
+
+func (self *Etcd) record(action Action, node Node) {
+    if self.recorder == nil {
+
+    } else if err := self.recorder.Record(action, node); err != nil {
+        log.Printf("config:etcd.record %s: %v\n", node.Path, err)
+    }
+
+    if self.cache != nil {
+        self.cache.update(action, node)
+    }
+}
+
+// Cache the raw nodes from the initial Scan() and any Sync() events.
+//
+// Must be called before Scan().
+func (self *Etcd) SetCache(cache *Cache) {
+    self.cache = cache
+}
+
+// Write out the cache after the Scan() or any Sync() event
+func (self *Etcd) writeCache() {
+    if self.cache == nil {
+
+    } else if err := self.cache.write(); err != nil {
+        log.Printf("config:etcd.writeCache %s: %v\n", self.cache, err)
+    }
+}
+
 /*
  * Initialize state in etcd
  */
 func (self *Etcd) Init() error {
     if response, err := self.client.CreateDir(self.config.Prefix, 0); err != nil {
-        return err
+        return errs.BackendError(err)
     } else {
         self.syncIndex = response.Node.CreatedIndex
     }
@@ -59,17 +124,28 @@ func (self *Etcd) Init() error {
  * Stores the current etcd-index from the snapshot in .syncIndex, so that .Sync() can be used to continue updating any changes.
  */
 func (self *Etcd) Scan() ([]Config, error) {
+    return self.get(true)
+}
+
+// Re-scan the current state in etcd, without affecting any running .Sync()
+func (self *Etcd) List() ([]Config, error) {
+    return self.get(false)
+}
+
+func (self *Etcd) get(sync bool) ([]Config, error) {
     response, err := self.client.Get(self.config.Prefix, false, /* recursive */ true)
 
     if err != nil {
         if etcdErr, ok := err.(*etcd.EtcdError); ok {
-            if etcdErr.ErrorCode == etcdError.EcodeKeyNotFound {
+            if etcdErr.ErrorCode == etcdError.EcodeKeyNotFound && !sync {
+                return nil, nil
+            } else if etcdErr.ErrorCode == etcdError.EcodeKeyNotFound {
                 // create directory instead
                 return nil, self.Init()
             }
         }
 
-        return nil, err
+        return nil, errs.BackendError(err)
     }
 
     if response.Node.Dir != true {
@@ -78,18 +154,58 @@ func (self *Etcd) Scan() ([]Config, error) {
 
     // the tree root's ModifiedTime may be a long long time in the past, so we can't want to use that for waits
     // we assume this enough to ensure atomic sync with .Watch() on the same tree..
-    self.syncIndex = response.EtcdIndex
+    if sync {
+        self.syncIndex = response.EtcdIndex
+    }
+
+    if sync && self.cache != nil {
+        self.cache.reset()
+    }
 
     // scan, collect and return
     var configs []Config
-    err = self.scan(response.Node, func (config Config) {
+    err = self.scan(response.Node, sync, func (config Config) {
         configs = append(configs, config)
     })
+
+    if sync && err == nil {
+        self.writeCache()
+    }
+
     return configs, err
 }
 
-// Scan through the recursive /clusterf node to return ConfigItem's
-func (self *Etcd) scan(node *etcd.Node, configHandler func(Config)) error {
+// Retry Scan() with backoff until it succeeds, or the timeout passes, returning the last error.
+//
+// A zero timeout only scans once, and a negative timeout retries forever. Only backend errors are retried.
+func (self *Etcd) WaitScan(timeout time.Duration) ([]Config, error) {
+    var waited time.Duration
+
+    for attempts := uint(1); ; attempts++ {
+        configs, err := self.Scan()
+        if err == nil {
+            return configs, nil
+        } else if errs.Classify(err) != errs.Backend {
+            return nil, err
+        } else if timeout >= 0 && waited >= timeout {
+            return nil, err
+        }
+
+        backoff := watchBackoff(self.config.WatchBackoff, self.config.WatchBackoffMax, attempts)
+
+        if timeout >= 0 && waited + backoff > timeout {
+            backoff = timeout - waited
+        }
+
+        log.Printf("config:etcd.Scan %s: %s (retry %d in %v)\n", self.config.Prefix, err, attempts, backoff)
+
+        time.Sleep(backoff)
+        waited += backoff
+    }
+}
+
+// Scan through the recursive /clusterf node to return ConfigItem's, recording the nodes for the initial sync
+func (self *Etcd) scan(node *etcd.Node, sync bool, configHandler func(Config)) error {
     // decode etcd path into config tree path
     path := node.Key
 
@@ -108,6 +224,10 @@ func (self *Etcd) scan(node *etcd.Node, configHandler func(Config)) error {
         Source: EtcdConfigSource,
     }
 
+    if sync {
+        self.record(NewConfig, configNode)
+    }
+
     if config, err := syncConfig(configNode); err != nil {
         log.Printf("config:etcd.scan %s: %v\n", node.Key, err)
     } else if config == nil {
@@ -120,7 +240,7 @@ func (self *Etcd) scan(node *etcd.Node, configHandler func(Config)) error {
 
     // recurse
     for _, childNode := range node.Nodes {
-        if err := self.scan(childNode, configHandler); err != nil {
+        if err := self.scan(childNode, sync, configHandler); err != nil {
             return err
         }
     }
@@ -128,6 +248,35 @@ func (self *Etcd) scan(node *etcd.Node, configHandler func(Config)) error {
     return nil
 }
 
+// Return all non-directory nodes in the /clusterf tree, without parsing them
+func (self *Etcd) Nodes() ([]Node, error) {
+    var nodes []Node
+
+    response, err := self.client.Get(self.config.Prefix, false, /* recursive */ true)
+    if err != nil {
+        return nil, errs.BackendError(err)
+    }
+
+    var walk func(node *etcd.Node)
+    walk = func(node *etcd.Node) {
+        if node.Dir {
+            for _, childNode := range node.Nodes {
+                walk(childNode)
+            }
+        } else {
+            nodes = append(nodes, Node{
+                Path:   strings.Trim(strings.TrimPrefix(node.Key, self.config.Prefix), "/"),
+                Value:  node.Value,
+                Source: EtcdConfigSource,
+            })
+        }
+    }
+
+    walk(response.Node)
+
+    return nodes, nil
+}
+
 /*
  * Watch for changes in etcd
  *
@@ -138,22 +287,82 @@ func (self *Etcd) Sync() chan Event {
         // kick off new goroutine to handle initial services and updates
         self.watchChan = make(chan Event)
 
-        go self.watch()
+        tasks.Go("etcd-watch", self.watch)
     }
 
     return self.watchChan
 }
 
-// Watch etcd for changes, and sync them
+// Return a random delay between half and all of the exponential backoff for the given number of failed attempts
+func watchBackoff(backoff time.Duration, backoffMax time.Duration, attempts uint) time.Duration {
+    for i := uint(1); i < attempts && backoff < backoffMax; i++ {
+        backoff *= 2
+    }
+
+    if backoff > backoffMax {
+        backoff = backoffMax
+    }
+
+    return backoff / 2 + time.Duration(rand.Int63n(int64(backoff / 2) + 1))
+}
+
+func (self *Etcd) watchReconnect(err error) {
+    self.watchMutex.Lock()
+    defer self.watchMutex.Unlock()
+
+    self.watchStats.Reconnects++
+    self.watchStats.LastReconnect = time.Now()
+    self.watchStats.LastError = err.Error()
+}
+
+// Return the current watch reconnect stats
+func (self *Etcd) WatchStats() WatchStats {
+    self.watchMutex.Lock()
+    defer self.watchMutex.Unlock()
+
+    return self.watchStats
+}
+
+// Write the watch reconnect stats in the Prometheus text format
+func (self *Etcd) WriteMetrics(w io.Writer) {
+    stats := self.WatchStats()
+
+    fmt.Fprintf(w, "# HELP clusterf_etcd_watch_reconnects_total Etcd watch reconnects after errors\n")
+    fmt.Fprintf(w, "# TYPE clusterf_etcd_watch_reconnects_total counter\n")
+    fmt.Fprintf(w, "clusterf_etcd_watch_reconnects_total %d\n", stats.Reconnects)
+
+    if !stats.LastReconnect.IsZero() {
+        fmt.Fprintf(w, "# HELP clusterf_etcd_watch_last_reconnect_timestamp_seconds Time of the last etcd watch reconnect\n")
+        fmt.Fprintf(w, "# TYPE clusterf_etcd_watch_last_reconnect_timestamp_seconds gauge\n")
+        fmt.Fprintf(w, "clusterf_etcd_watch_last_reconnect_timestamp_seconds %d\n", stats.LastReconnect.Unix())
+    }
+}
+
+// Watch etcd for changes, and sync them.
+//
+// Retries any errors with backoff, except if the sync index has been cleared, requiring a full re-scan.
 func (self *Etcd) watch() {
+    var attempts uint
+
     defer close(self.watchChan)
 
     for {
         response, err := self.client.Watch(self.config.Prefix, self.syncIndex + 1, true, nil, nil)
-        if err != nil {
+        if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == etcdError.EcodeEventIndexCleared {
             log.Printf("config:etcd.watch %s @ %d: %s\n", self.config.Prefix, self.syncIndex + 1, err)
             break
+        } else if err != nil {
+            attempts++
+            backoff := watchBackoff(self.config.WatchBackoff, self.config.WatchBackoffMax, attempts)
+
+            log.Printf("config:etcd.watch %s @ %d: %s (retry %d in %v)\n", self.config.Prefix, self.syncIndex + 1, err, attempts, backoff)
+
+            time.Sleep(backoff)
+
+            self.watchReconnect(err)
+            continue
         } else {
+            attempts = 0
             self.syncIndex = response.Node.ModifiedIndex
         }
 
@@ -206,6 +415,9 @@ func (self *Etcd) sync(action string, node *etcd.Node) (*Event, error) {
         Value:  node.Value,
     }
 
+    self.record(eventAction, eventNode)
+    self.writeCache()
+
     if event, err := syncEvent(eventAction, eventNode); err != nil {
         log.Printf("config:Etcd.sync %s %s: %v\n", action, node.Key, err)
         return nil, err
@@ -223,12 +435,15 @@ func (self *Etcd) path(parts ...string) string {
 
 // Publish a config into etcd
 func (self *Etcd) Publish(config Config) error {
-    var ttl uint64 = 0
+    return self.PublishTTL(config, 0)
+}
 
+// Publish a config into etcd, expiring after the given TTL unless published again
+func (self *Etcd) PublishTTL(config Config, ttl time.Duration) error {
     if node, err := makeNode(config); err != nil {
         return err
-    } else if _, err := self.client.Set(self.path(node.Path), node.Value, ttl); err != nil {
-        return err
+    } else if _, err := self.client.Set(self.path(node.Path), node.Value, uint64(ttl / time.Second)); err != nil {
+        return errs.BackendError(err)
     } else {
         return nil
     }
@@ -237,7 +452,25 @@ func (self *Etcd) Publish(config Config) error {
 // Retract a config from etcd
 func (self *Etcd) Retract(config Config) error {
     if _, err := self.client.Delete(self.path(config.Path()), false); err != nil {
-        return err
+        return errs.BackendError(err)
+    } else {
+        return nil
+    }
+}
+
+// Store a raw node value, without parsing it
+func (self *Etcd) Put(node Node) error {
+    if _, err := self.client.Set(self.path(node.Path), node.Value, 0); err != nil {
+        return errs.BackendError(err)
+    } else {
+        return nil
+    }
+}
+
+// Remove a raw node
+func (self *Etcd) Remove(node Node) error {
+    if _, err := self.client.Delete(self.path(node.Path), false); err != nil {
+        return errs.BackendError(err)
     } else {
         return nil
     }
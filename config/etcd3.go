@@ -0,0 +1,130 @@
+package config
+/*
+ * Minimal etcd v3 client, using the JSON gRPC gateway.
+ */
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+type Etcd3Config struct {
+    Endpoint    string
+    Prefix      string
+}
+
+type Etcd3 struct {
+    config      Etcd3Config
+    client      *http.Client
+}
+
+func (self *Etcd3) String() string {
+    return fmt.Sprintf("%s%s", self.config.Endpoint, self.config.Prefix)
+}
+
+func (self Etcd3Config) Open() (*Etcd3, error) {
+    if self.Endpoint == "" {
+        return nil, fmt.Errorf("No etcd3 endpoint given")
+    }
+
+    return &Etcd3{config: self, client: &http.Client{}}, nil
+}
+
+type etcd3KeyValue struct {
+    Key         string  `json:"key"`
+    Value       string  `json:"value,omitempty"`
+}
+
+type etcd3RangeRequest struct {
+    Key         string  `json:"key"`
+    RangeEnd    string  `json:"range_end"`
+}
+
+type etcd3RangeResponse struct {
+    Kvs         []etcd3KeyValue `json:"kvs"`
+}
+
+func (self *Etcd3) post(path string, request interface{}, response interface{}) error {
+    var buf bytes.Buffer
+
+    if err := json.NewEncoder(&buf).Encode(request); err != nil {
+        return err
+    }
+
+    httpResponse, err := self.client.Post(strings.TrimRight(self.config.Endpoint, "/") + path, "application/json", &buf)
+    if err != nil {
+        return err
+    }
+    defer httpResponse.Body.Close()
+
+    if httpResponse.StatusCode != 200 {
+        return fmt.Errorf("%s: %s", path, httpResponse.Status)
+    } else if response == nil {
+        return nil
+    } else if err := json.NewDecoder(httpResponse.Body).Decode(response); err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    } else {
+        return nil
+    }
+}
+
+func (self *Etcd3) key(path string) string {
+    return self.config.Prefix + "/" + path
+}
+
+// Store a node at the same path as in the etcd v2 tree. Directory nodes are implicit in etcd v3.
+func (self *Etcd3) Put(node Node) error {
+    if node.IsDir {
+        return nil
+    }
+
+    request := etcd3KeyValue{
+        Key:    base64.StdEncoding.EncodeToString([]byte(self.key(node.Path))),
+        Value:  base64.StdEncoding.EncodeToString([]byte(node.Value)),
+    }
+
+    return self.post("/v3/kv/put", request, nil)
+}
+
+// Return all nodes under the prefix
+func (self *Etcd3) Nodes() ([]Node, error) {
+    var nodes []Node
+    var response etcd3RangeResponse
+
+    // all keys with the prefix/, up to the next prefix0
+    prefix := self.config.Prefix + "/"
+    rangeEnd := self.config.Prefix + "0"
+
+    request := etcd3RangeRequest{
+        Key:        base64.StdEncoding.EncodeToString([]byte(prefix)),
+        RangeEnd:   base64.StdEncoding.EncodeToString([]byte(rangeEnd)),
+    }
+
+    if err := self.post("/v3/kv/range", request, &response); err != nil {
+        return nil, err
+    }
+
+    for _, kv := range response.Kvs {
+        node := Node{Source: EtcdConfigSource}
+
+        if key, err := base64.StdEncoding.DecodeString(kv.Key); err != nil {
+            return nil, fmt.Errorf("invalid key %v: %v", kv.Key, err)
+        } else {
+            node.Path = strings.TrimPrefix(string(key), prefix)
+        }
+
+        if value, err := base64.StdEncoding.DecodeString(kv.Value); err != nil {
+            return nil, fmt.Errorf("invalid value for %s: %v", node.Path, err)
+        } else {
+            node.Value = string(value)
+        }
+
+        nodes = append(nodes, node)
+    }
+
+    return nodes, nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestWatchBackoff(t *testing.T) {
+    tests := []struct{
+        attempts    uint
+        backoff     time.Duration
+    }{
+        {1, 1 * time.Second},
+        {2, 2 * time.Second},
+        {3, 4 * time.Second},
+        {6, 32 * time.Second},
+        {7, 60 * time.Second},
+        {100, 60 * time.Second},
+    }
+
+    for _, test := range tests {
+        for i := 0; i < 10; i++ {
+            if backoff := watchBackoff(1 * time.Second, 60 * time.Second, test.attempts); backoff < test.backoff / 2 || backoff > test.backoff {
+                t.Errorf("watchBackoff %d: %v is outside of %v/2", test.attempts, backoff, test.backoff)
+            }
+        }
+    }
+}
+
+func TestWatchMetrics(t *testing.T) {
+    var buf bytes.Buffer
+
+    etcd, _ := EtcdConfig{Prefix: "/clusterf"}.Open()
+    etcd.WriteMetrics(&buf)
+
+    if metrics := buf.String(); !strings.Contains(metrics, "clusterf_etcd_watch_reconnects_total 0\n") || strings.Contains(metrics, "last_reconnect") {
+        t.Errorf("WriteMetrics:\n%s", metrics)
+    }
+
+    etcd.watchReconnect(fmt.Errorf("test"))
+    buf.Reset()
+    etcd.WriteMetrics(&buf)
+
+    if metrics := buf.String(); !strings.Contains(metrics, "clusterf_etcd_watch_reconnects_total 1\n") || !strings.Contains(metrics, "clusterf_etcd_watch_last_reconnect_timestamp_seconds ") {
+        t.Errorf("WriteMetrics:\n%s", metrics)
+    }
+
+    if stats := etcd.WatchStats(); stats.LastError != "test" {
+        t.Errorf("WatchStats: %#v", stats)
+    }
+}
@@ -0,0 +1,53 @@
+package config
+/*
+ * A/B experiments with alternate backend weights.
+ */
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+func (self ServiceExperiment) String() string {
+    var weights []string
+
+    for backendName, weight := range self.Weights {
+        weights = append(weights, fmt.Sprintf("%s=%d", backendName, weight))
+    }
+
+    sort.Strings(weights)
+
+    if self.Active {
+        return strings.Join(weights, " ") + " (active)"
+    } else {
+        return strings.Join(weights, " ")
+    }
+}
+
+func (self ServiceExperiment) check() error {
+    if len(self.Weights) == 0 {
+        return fmt.Errorf("experiment requires weights")
+    }
+
+    for backendName, _ := range self.Weights {
+        if backendName == "" {
+            return fmt.Errorf("experiment weight without backend name")
+        }
+    }
+
+    return nil
+}
+
+// Return the backend with the experiment weight, if any
+func (self ServiceExperiment) Backend(backendName string, backend ServiceBackend) ServiceBackend {
+    if weight, exists := self.Weights[backendName]; !exists {
+
+    } else if weight == 0 {
+        backend.Drain = true
+    } else {
+        backend.Weight = weight
+    }
+
+    return backend
+}
@@ -0,0 +1,333 @@
+package config
+/*
+ * Change freeze windows, during which any config changes are queued, and only applied once the window ends.
+ *
+ * Each window is given as a cron-like "minute hour day-of-month month day-of-week" start time, followed by the duration of the window,
+ * e.g. "0 18 * * 5 62h" for the weekends from Friday 18:00 until Monday 08:00.
+ */
+
+import (
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Limit the duration of each window, as the start of any active window is looked up by stepping back over each minute
+const FREEZE_MAX = 31 * 24 * time.Hour
+
+// Windows start and end on whole minutes, and any queued changes are released within a minute of the window ending
+const FREEZE_INTERVAL = 1 * time.Minute
+
+type FreezeConfig struct {
+    // Semicolon-separated freeze windows
+    Windows     string
+}
+
+type freezeWindow struct {
+    spec        string
+    duration    time.Duration
+
+    // bitmasks of the matching values
+    minutes     uint64
+    hours       uint64
+    days        uint64
+    months      uint64
+    weekdays    uint64
+
+    // the day-of-month and day-of-week fields are unrestricted, and any restricted field matches as in cron
+    anyDay      bool
+    anyWeekday  bool
+}
+
+// Parse a "*", "a", "a-b", "*/n" or "a-b/n" cron field, or a comma-separated list of them
+func parseCronField(spec string, min int, max int) (uint64, error) {
+    var set uint64
+
+    for _, part := range strings.Split(spec, ",") {
+        var rangeSpec = part
+        var step = 1
+        var lo, hi int
+        var err error
+
+        if i := strings.Index(part, "/"); i >= 0 {
+            rangeSpec = part[:i]
+
+            if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+                return 0, fmt.Errorf("invalid step: %s", part)
+            }
+        }
+
+        if rangeSpec == "*" {
+            lo, hi = min, max
+        } else if i := strings.Index(rangeSpec, "-"); i >= 0 {
+            if lo, err = strconv.Atoi(rangeSpec[:i]); err != nil {
+                return 0, fmt.Errorf("invalid range: %s", part)
+            } else if hi, err = strconv.Atoi(rangeSpec[i+1:]); err != nil {
+                return 0, fmt.Errorf("invalid range: %s", part)
+            }
+        } else if lo, err = strconv.Atoi(rangeSpec); err != nil {
+            return 0, fmt.Errorf("invalid value: %s", part)
+        } else if step > 1 {
+            hi = max
+        } else {
+            hi = lo
+        }
+
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("value out of range %d-%d: %s", min, max, part)
+        }
+
+        for value := lo; value <= hi; value += step {
+            set |= 1 << uint(value)
+        }
+    }
+
+    return set, nil
+}
+
+func parseFreezeWindow(spec string) (window freezeWindow, err error) {
+    var fields = strings.Fields(spec)
+
+    window.spec = spec
+
+    if len(fields) != 6 {
+        return window, fmt.Errorf("expected \"minute hour day month weekday duration\": %#v", spec)
+    }
+
+    if window.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+        return window, fmt.Errorf("minute: %v", err)
+    } else if window.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+        return window, fmt.Errorf("hour: %v", err)
+    } else if window.days, err = parseCronField(fields[2], 1, 31); err != nil {
+        return window, fmt.Errorf("day: %v", err)
+    } else if window.months, err = parseCronField(fields[3], 1, 12); err != nil {
+        return window, fmt.Errorf("month: %v", err)
+    } else if window.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+        return window, fmt.Errorf("weekday: %v", err)
+    }
+
+    // both 0 and 7 are sunday
+    if window.weekdays & (1 << 7) != 0 {
+        window.weekdays |= 1 << 0
+    }
+
+    window.anyDay = strings.HasPrefix(fields[2], "*")
+    window.anyWeekday = strings.HasPrefix(fields[4], "*")
+
+    if window.duration, err = time.ParseDuration(fields[5]); err != nil {
+        return window, fmt.Errorf("duration: %v", err)
+    } else if window.duration <= 0 || window.duration > FREEZE_MAX {
+        return window, fmt.Errorf("duration %v is not within 0-%v", window.duration, FREEZE_MAX)
+    }
+
+    return window, nil
+}
+
+func (self freezeWindow) String() string {
+    return self.spec
+}
+
+// The window starts at the given minute
+func (self freezeWindow) match(t time.Time) bool {
+    var day = self.days & (1 << uint(t.Day())) != 0
+    var weekday = self.weekdays & (1 << uint(t.Weekday())) != 0
+
+    if self.minutes & (1 << uint(t.Minute())) == 0 {
+        return false
+    } else if self.hours & (1 << uint(t.Hour())) == 0 {
+        return false
+    } else if self.months & (1 << uint(t.Month())) == 0 {
+        return false
+    } else if self.anyDay && self.anyWeekday {
+        return true
+    } else if self.anyDay {
+        return weekday
+    } else if self.anyWeekday {
+        return day
+    } else {
+        return day || weekday
+    }
+}
+
+// Return the end of the window active at the given time, or zero if the window is not active
+func (self freezeWindow) active(now time.Time) time.Time {
+    for start := now.Truncate(time.Minute); start.Add(self.duration).After(now); start = start.Add(-time.Minute) {
+        if self.match(start) {
+            return start.Add(self.duration)
+        }
+    }
+
+    return time.Time{}
+}
+
+// The freeze state, exposed via the HTTP API
+type FreezeStatus struct {
+    Frozen      bool        `json:"frozen"`
+    Until       time.Time   `json:"until"`
+    Queued      int         `json:"queued"`
+
+    // a resync is deferred until the window ends
+    Resync      bool        `json:"resync,omitempty"`
+
+    // the current window was overridden
+    Override    bool        `json:"override,omitempty"`
+}
+
+type Freeze struct {
+    windows     []freezeWindow
+
+    // serialize the applied events, to keep them in order
+    mutex       sync.Mutex
+    queue       []Event
+    resync      func()
+    override    time.Time
+}
+
+func (self FreezeConfig) Open() (*Freeze, error) {
+    var freeze = &Freeze{}
+
+    for _, spec := range strings.Split(self.Windows, ";") {
+        if strings.TrimSpace(spec) == "" {
+            continue
+        } else if window, err := parseFreezeWindow(strings.TrimSpace(spec)); err != nil {
+            return nil, fmt.Errorf("Invalid freeze window: %v", err)
+        } else {
+            freeze.windows = append(freeze.windows, window)
+        }
+    }
+
+    return freeze, nil
+}
+
+// Return the end of the latest active window, or zero if not frozen
+func (self *Freeze) until(now time.Time) time.Time {
+    var until time.Time
+
+    for _, window := range self.windows {
+        if end := window.active(now); end.After(until) {
+            until = end
+        }
+    }
+
+    return until
+}
+
+func (self *Freeze) frozen(now time.Time) bool {
+    until := self.until(now)
+
+    return !until.IsZero() && until.After(self.override)
+}
+
+// Apply any queued events, followed by any deferred resync
+func (self *Freeze) flush(apply func(Event)) int {
+    var count = len(self.queue)
+
+    for _, event := range self.queue {
+        apply(event)
+    }
+
+    self.queue = nil
+
+    if resync := self.resync; resync != nil {
+        self.resync = nil
+
+        resync()
+    }
+
+    return count
+}
+
+func (self *Freeze) pending() bool {
+    return len(self.queue) > 0 || self.resync != nil
+}
+
+// Apply the event, unless a freeze window is active, or any earlier events are still queued.
+//
+// Returns true if the event was queued.
+func (self *Freeze) Apply(event Event, now time.Time, apply func(Event)) bool {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.frozen(now) || self.pending() {
+        self.queue = append(self.queue, event)
+
+        return true
+    }
+
+    apply(event)
+
+    return false
+}
+
+// Resync the full config, unless a freeze window is active, or any earlier events are still queued.
+//
+// A deferred resync runs once, after any queued events, when the window ends or is overridden.
+// Returns true if the resync was deferred.
+func (self *Freeze) Resync(now time.Time, resync func()) bool {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.frozen(now) || self.pending() {
+        self.resync = resync
+
+        return true
+    }
+
+    resync()
+
+    return false
+}
+
+// Apply any queued events and any deferred resync once the freeze window has ended.
+//
+// Returns the number of applied events.
+func (self *Freeze) Release(now time.Time, apply func(Event)) int {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if !self.pending() || self.frozen(now) {
+        return 0
+    }
+
+    log.Printf("config:Freeze: release %d changes, resync=%v\n", len(self.queue), self.resync != nil)
+
+    return self.flush(apply)
+}
+
+// Emergency override: apply any queued events and any deferred resync, and apply any further events until the current freeze window ends.
+//
+// Returns the number of applied events.
+func (self *Freeze) Override(now time.Time, apply func(Event)) int {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if until := self.until(now); until.After(self.override) {
+        self.override = until
+    }
+
+    log.Printf("config:Freeze: override until %v, applying %d changes\n", self.override, len(self.queue))
+
+    return self.flush(apply)
+}
+
+func (self *Freeze) Status(now time.Time) FreezeStatus {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    var status = FreezeStatus{Queued: len(self.queue), Resync: self.resync != nil}
+
+    if until := self.until(now); until.IsZero() {
+
+    } else if until.After(self.override) {
+        status.Frozen = true
+        status.Until = until
+    } else {
+        status.Override = true
+        status.Until = until
+    }
+
+    return status
+}
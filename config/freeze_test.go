@@ -0,0 +1,215 @@
+package config
+
+import (
+    "testing"
+    "time"
+)
+
+func TestFreezeWindow(t *testing.T) {
+    // friday 2016-01-01 18:00 until monday 08:00
+    window, err := parseFreezeWindow("0 18 * * 5 62h")
+    if err != nil {
+        t.Fatalf("parseFreezeWindow: %v", err)
+    }
+
+    friday := time.Date(2016, 1, 1, 18, 0, 0, 0, time.UTC)
+    until := friday.Add(62 * time.Hour)
+
+    for _, test := range []struct{
+        now     time.Time
+        until   time.Time
+    }{
+        {friday.Add(-1 * time.Minute),      time.Time{}},
+        {friday,                            until},
+        {friday.Add(30 * time.Second),      until},
+        {friday.Add(24 * time.Hour),        until},
+        {until.Add(-1 * time.Second),       until},
+        {until,                             time.Time{}},
+        {friday.Add(-24 * time.Hour),       time.Time{}},
+    } {
+        if active := window.active(test.now); !active.Equal(test.until) {
+            t.Errorf("active(%v): %v != %v", test.now, active, test.until)
+        }
+    }
+}
+
+func TestFreezeWindowParse(t *testing.T) {
+    for _, test := range []struct{
+        spec    string
+        match   []time.Time
+        nomatch []time.Time
+    }{
+        {"*/15 9-17 * * 1-5 1m",
+            []time.Time{time.Date(2016, 1, 4, 9, 0, 0, 0, time.UTC), time.Date(2016, 1, 8, 17, 45, 0, 0, time.UTC)},
+            []time.Time{time.Date(2016, 1, 4, 9, 5, 0, 0, time.UTC), time.Date(2016, 1, 9, 12, 0, 0, 0, time.UTC)},
+        },
+        {"0 0 24 12 * 48h",
+            []time.Time{time.Date(2016, 12, 24, 0, 0, 0, 0, time.UTC)},
+            []time.Time{time.Date(2016, 11, 24, 0, 0, 0, 0, time.UTC)},
+        },
+        {"0 0 1 * 7 1h",
+            []time.Time{time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2016, 1, 3, 0, 0, 0, 0, time.UTC)},
+            []time.Time{time.Date(2016, 1, 4, 0, 0, 0, 0, time.UTC)},
+        },
+    } {
+        window, err := parseFreezeWindow(test.spec)
+        if err != nil {
+            t.Errorf("parseFreezeWindow %#v: %v", test.spec, err)
+            continue
+        }
+
+        for _, match := range test.match {
+            if !window.match(match) {
+                t.Errorf("%#v should match %v", test.spec, match)
+            }
+        }
+        for _, nomatch := range test.nomatch {
+            if window.match(nomatch) {
+                t.Errorf("%#v should not match %v", test.spec, nomatch)
+            }
+        }
+    }
+
+    for _, spec := range []string{
+        "0 18 * * 5",
+        "60 18 * * 5 1h",
+        "0 18 * * 5-1 1h",
+        "0 18 * * */0 1h",
+        "0 18 * * 5 0s",
+        "0 18 * * 5 1000h",
+    } {
+        if _, err := parseFreezeWindow(spec); err == nil {
+            t.Errorf("parseFreezeWindow %#v: no error", spec)
+        }
+    }
+}
+
+func TestFreeze(t *testing.T) {
+    freeze, err := FreezeConfig{Windows: "0 18 * * 5 62h; 0 0 24 12 * 48h"}.Open()
+    if err != nil {
+        t.Fatalf("FreezeConfig.Open: %v", err)
+    }
+
+    var applied []string
+    var apply = func(event Event) { applied = append(applied, event.Config.Path()) }
+
+    friday := time.Date(2016, 1, 1, 18, 0, 0, 0, time.UTC)
+    event1 := Event{Action: SetConfig, Config: &ConfigServiceFrontend{ServiceName: "test1"}}
+    event2 := Event{Action: SetConfig, Config: &ConfigServiceFrontend{ServiceName: "test2"}}
+
+    if freeze.Apply(event1, friday.Add(-1 * time.Hour), apply) || len(applied) != 1 {
+        t.Errorf("Apply before freeze: %v", applied)
+    }
+
+    if !freeze.Apply(event2, friday.Add(1 * time.Hour), apply) || len(applied) != 1 {
+        t.Errorf("Apply during freeze: %v", applied)
+    }
+
+    if status := freeze.Status(friday.Add(1 * time.Hour)); !status.Frozen || status.Queued != 1 || !status.Until.Equal(friday.Add(62 * time.Hour)) {
+        t.Errorf("Status during freeze: %+v", status)
+    }
+
+    if count := freeze.Release(friday.Add(2 * time.Hour), apply); count != 0 {
+        t.Errorf("Release during freeze: %v", count)
+    }
+
+    // any further events are queued after the earlier events, until released
+    if !freeze.Apply(event1, friday.Add(62 * time.Hour), apply) || len(applied) != 1 {
+        t.Errorf("Apply before release: %v", applied)
+    }
+
+    if count := freeze.Release(friday.Add(62 * time.Hour), apply); count != 2 {
+        t.Errorf("Release after freeze: %v", count)
+    } else if applied[1] != "services/test2/frontend" || applied[2] != "services/test1/frontend" {
+        t.Errorf("Release order: %v", applied)
+    }
+
+    // emergency override
+    friday = friday.Add(7 * 24 * time.Hour)
+
+    if !freeze.Apply(event1, friday, apply) {
+        t.Errorf("Apply during next freeze")
+    }
+
+    if count := freeze.Override(friday.Add(1 * time.Hour), apply); count != 1 {
+        t.Errorf("Override: %v", count)
+    }
+
+    if freeze.Apply(event2, friday.Add(2 * time.Hour), apply) || len(applied) != 5 {
+        t.Errorf("Apply after override: %v", applied)
+    }
+
+    if status := freeze.Status(friday.Add(2 * time.Hour)); status.Frozen || !status.Override {
+        t.Errorf("Status after override: %+v", status)
+    }
+
+    // the override only applies to the current window
+    if !freeze.Apply(event1, friday.Add(7 * 24 * time.Hour), apply) {
+        t.Errorf("Apply during the window after the override")
+    }
+}
+
+func TestFreezeResync(t *testing.T) {
+    freeze, err := FreezeConfig{Windows: "0 18 * * 5 62h"}.Open()
+    if err != nil {
+        t.Fatalf("FreezeConfig.Open: %v", err)
+    }
+
+    var applied []string
+    var apply = func(event Event) { applied = append(applied, event.Config.Path()) }
+    var resync = func() { applied = append(applied, "resync") }
+
+    friday := time.Date(2016, 1, 1, 18, 0, 0, 0, time.UTC)
+    event := Event{Action: SetConfig, Config: &ConfigServiceFrontend{ServiceName: "test1"}}
+
+    if freeze.Resync(friday.Add(-1 * time.Hour), resync) || len(applied) != 1 {
+        t.Errorf("Resync before freeze: %v", applied)
+    }
+
+    if !freeze.Resync(friday.Add(1 * time.Hour), resync) || len(applied) != 1 {
+        t.Errorf("Resync during freeze: %v", applied)
+    }
+
+    // any further events are queued behind the deferred resync
+    if !freeze.Apply(event, friday.Add(1 * time.Hour), apply) || len(applied) != 1 {
+        t.Errorf("Apply during freeze: %v", applied)
+    }
+
+    // a repeated resync only runs once
+    if !freeze.Resync(friday.Add(2 * time.Hour), resync) || len(applied) != 1 {
+        t.Errorf("Resync during freeze: %v", applied)
+    }
+
+    if status := freeze.Status(friday.Add(2 * time.Hour)); !status.Frozen || !status.Resync || status.Queued != 1 {
+        t.Errorf("Status during freeze: %+v", status)
+    }
+
+    if count := freeze.Release(friday.Add(2 * time.Hour), apply); count != 0 || len(applied) != 1 {
+        t.Errorf("Release during freeze: %v", applied)
+    }
+
+    if count := freeze.Override(friday.Add(3 * time.Hour), apply); count != 1 {
+        t.Errorf("Override: %v", count)
+    } else if len(applied) != 3 || applied[1] != "services/test1/frontend" || applied[2] != "resync" {
+        t.Errorf("Override order: %v", applied)
+    }
+
+    if status := freeze.Status(friday.Add(3 * time.Hour)); status.Resync || status.Queued != 0 {
+        t.Errorf("Status after override: %+v", status)
+    }
+
+    if freeze.Resync(friday.Add(4 * time.Hour), resync) || len(applied) != 4 {
+        t.Errorf("Resync after override: %v", applied)
+    }
+
+    // a deferred resync with nothing queued is also released
+    friday = friday.Add(7 * 24 * time.Hour)
+
+    if !freeze.Resync(friday, resync) || len(applied) != 4 {
+        t.Errorf("Resync during next freeze: %v", applied)
+    }
+
+    if count := freeze.Release(friday.Add(62 * time.Hour), apply); count != 0 || len(applied) != 5 || applied[4] != "resync" {
+        t.Errorf("Release after freeze: %v", applied)
+    }
+}
@@ -0,0 +1,26 @@
+package config
+/*
+ * Frontends matching packets by the firewall mark set by iptables or nftables rules, instead of by the address and port.
+ */
+
+import (
+    "fmt"
+)
+
+// Check that fwmark frontends do not have any ports, mirror or shadow, and have the address families to use
+func (self *ServiceFrontend) checkFwMark() error {
+    if self.FwMark == 0 {
+        return nil
+    } else if self.TCP != 0 || self.UDP != 0 || self.SCTP != 0 || self.Port != 0 {
+        return fmt.Errorf("fwmark %d frontend cannot have any tcp, udp, sctp or port", self.FwMark)
+    } else if self.Mirror != "" {
+        // the mirror rules run before any mangle rules set the mark
+        return fmt.Errorf("fwmark %d frontend cannot have a mirror", self.FwMark)
+    } else if self.Shadow != "" {
+        return fmt.Errorf("fwmark %d frontend cannot have a shadow", self.FwMark)
+    } else if self.IPv4 == "" && self.IPv6 == "" {
+        return fmt.Errorf("fwmark %d frontend requires an ipv4 or ipv6 address for the address family", self.FwMark)
+    }
+
+    return nil
+}
@@ -0,0 +1,85 @@
+package config
+/*
+ * Garbage collection of orphaned nodes, left behind in the config tree by removed services or older clusterf versions.
+ */
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+type Orphan struct {
+    Node    Node
+    Reason  string
+}
+
+func (self Orphan) String() string {
+    return fmt.Sprintf("%s: %s", self.Node.Path, self.Reason)
+}
+
+type orphanList []Orphan
+
+func (self orphanList) Len() int            { return len(self) }
+func (self orphanList) Swap(i, j int)       { self[i], self[j] = self[j], self[i] }
+func (self orphanList) Less(i, j int) bool  { return self[i].Node.Path < self[j].Node.Path }
+
+// Return any empty, invalid or unknown nodes, and any service nodes for services without a frontend
+//
+// The nodes of services with an invalid frontend are not orphaned, only the frontend itself.
+func FindOrphans(nodes []Node) []Orphan {
+    var frontends = make(map[string]bool)
+    var orphans orphanList
+
+    for _, node := range nodes {
+        if nodePath := strings.Split(node.Path, "/"); len(nodePath) == 3 && nodePath[0] == "services" && nodePath[2] == "frontend" && node.Value != "" {
+            frontends[nodePath[1]] = true
+        }
+    }
+
+    for _, node := range nodes {
+        var serviceName string
+
+        if node.Value == "" {
+            orphans = append(orphans, Orphan{node, "empty value"})
+            continue
+        }
+
+        switch config, err := syncConfig(node); config := config.(type) {
+        case nil:
+            if err != nil {
+                orphans = append(orphans, Orphan{node, err.Error()})
+            }
+            continue
+        case *ConfigServiceBackend:
+            serviceName = config.ServiceName
+        case *ConfigServiceShift:
+            serviceName = config.ServiceName
+        case *ConfigServiceExperiment:
+            serviceName = config.ServiceName
+        case *ConfigStatus:
+            serviceName = config.ServiceName
+        default:
+            continue
+        }
+
+        if !frontends[serviceName] {
+            orphans = append(orphans, Orphan{node, fmt.Sprintf("service %s has no frontend", serviceName)})
+        }
+    }
+
+    sort.Sort(orphans)
+
+    return orphans
+}
+
+// Remove the orphaned nodes, returning the number of removed nodes
+func RemoveOrphans(writer NodeWriter, orphans []Orphan) (int, error) {
+    for i, orphan := range orphans {
+        if err := writer.Remove(orphan.Node); err != nil {
+            return i, fmt.Errorf("%s: %v", orphan.Node.Path, err)
+        }
+    }
+
+    return len(orphans), nil
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+    "reflect"
+    "testing"
+)
+
+type testNodeWriter []string
+
+func (self *testNodeWriter) Put(node Node) error {
+    *self = append(*self, "put " + node.Path)
+    return nil
+}
+
+func (self *testNodeWriter) Remove(node Node) error {
+    *self = append(*self, "remove " + node.Path)
+    return nil
+}
+
+func TestFindOrphans(t *testing.T) {
+    nodes := []Node{
+        {Path: "services/web/frontend", Value: `{"ipv4": "10.0.1.1", "tcp": 80}`},
+        {Path: "services/web/backends/web1", Value: `{"ipv4": "10.1.0.1", "tcp": 80}`},
+        {Path: "services/web/backends/web2", Value: ``},
+        {Path: "services/old/backends/old1", Value: `{"ipv4": "10.1.0.2", "tcp": 80}`},
+        {Path: "services/old/experiments/test", Value: `{"weights": {"old1": 10}}`},
+        {Path: "services/bad/frontend", Value: `{"ipv4": "10.0.1.2", "tcp": "x"}`},
+        {Path: "services/bad/backends/bad1", Value: `{"ipv4": "10.1.0.3", "tcp": 80}`},
+        {Path: "services/web/servers/web1", Value: `{}`},
+        {Path: "groups/web/backends/web3", Value: `{"ipv4": "10.1.0.4", "tcp": 80}`},
+        {Path: "status/node1/web", Value: `{"healthy": true, "backends": 1}`},
+        {Path: "status/node1/old", Value: `{"healthy": false}`},
+        {Path: "routes/test", Value: `{"Prefix4": "10.1.0.0/24", "IpvsMethod": "masq"}`},
+        {Path: "other", Value: `{}`},
+    }
+
+    var paths = []string{}
+
+    for _, orphan := range FindOrphans(nodes) {
+        paths = append(paths, orphan.Node.Path)
+    }
+
+    if !reflect.DeepEqual(paths, []string{
+        "other",
+        "services/bad/frontend",
+        "services/old/backends/old1",
+        "services/old/experiments/test",
+        "services/web/backends/web2",
+        "services/web/servers/web1",
+        "status/node1/old",
+    }) {
+        t.Errorf("FindOrphans: %#v", paths)
+    }
+}
+
+func TestRemoveOrphans(t *testing.T) {
+    var writer testNodeWriter
+
+    orphans := FindOrphans([]Node{
+        {Path: "services/old/backends/old1", Value: `{"ipv4": "10.1.0.2", "tcp": 80}`},
+        {Path: "status/node1/old", Value: `{"healthy": false}`},
+    })
+
+    if count, err := RemoveOrphans(&writer, orphans); err != nil {
+        t.Fatalf("RemoveOrphans: %v", err)
+    } else if count != 2 {
+        t.Errorf("RemoveOrphans: count %d", count)
+    }
+
+    if !reflect.DeepEqual([]string(writer), []string{"remove services/old/backends/old1", "remove status/node1/old"}) {
+        t.Errorf("RemoveOrphans: %v", writer)
+    }
+
+    if orphans[0].String() != "services/old/backends/old1: service old has no frontend" {
+        t.Errorf("Orphan.String: %s", orphans[0])
+    }
+}
@@ -0,0 +1,353 @@
+package config
+/*
+ * Hooks run before and after applying config changes to selected services, e.g. to notify the application or update a firewall.
+ *
+ * Each hook is either a shell command, or a webhook that is POSTed the change as JSON. Only service-scoped configs are hooked.
+ * A failing pre hook skips the change under the "abort" failure policy, and any failing post hooks are only logged.
+ *
+ * The last applied etcd config of each hooked path is remembered, so that a resync also runs the hooks for any changes it applies,
+ * including any earlier changes that were aborted. A change aborted by the pre hook is never applied without the pre hook succeeding,
+ * and is retried by the next resync.
+ */
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "os/exec"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+const (
+    HOOK_PRE        = "pre"
+    HOOK_POST       = "post"
+
+    HOOK_ABORT      = "abort"
+    HOOK_CONTINUE   = "continue"
+)
+
+type HooksConfig struct {
+    // Shell commands run with the CLUSTERF_HOOK, CLUSTERF_ACTION, CLUSTERF_SERVICE and CLUSTERF_PATH env vars
+    PreExec     string
+    PostExec    string
+
+    // POST each change to the webhooks as JSON, failing unless the webhook returns a 2xx status
+    PreURL      string
+    PostURL     string
+
+    // Comma-separated service names to run the hooks for, default all
+    Services    string
+
+    Timeout     time.Duration   // default: 10s
+
+    // Either "abort" to skip the change if a pre hook fails, or "continue" to apply it anyways
+    Failure     string          // default: abort
+}
+
+type Hooks struct {
+    config      HooksConfig
+    services    map[string]bool
+    client      *http.Client
+
+    // the last applied etcd config of each hooked path
+    mutex       sync.Mutex
+    applied     map[string]Config
+}
+
+// The JSON request sent to the webhooks
+type HookRequest struct {
+    Hook        string      `json:"hook"`
+    Action      Action      `json:"action"`
+    Service     string      `json:"service"`
+    Path        string      `json:"path"`
+}
+
+func (self HooksConfig) Open() (*Hooks, error) {
+    hooks := &Hooks{config: self, applied: make(map[string]Config)}
+
+    if hooks.config.Timeout == 0 {
+        hooks.config.Timeout = 10 * time.Second
+    }
+
+    switch self.Failure {
+    case "":
+        hooks.config.Failure = HOOK_ABORT
+    case HOOK_ABORT, HOOK_CONTINUE:
+
+    default:
+        return nil, fmt.Errorf("Invalid hook failure policy %#v: expected %s or %s", self.Failure, HOOK_ABORT, HOOK_CONTINUE)
+    }
+
+    if self.Services != "" {
+        hooks.services = make(map[string]bool)
+
+        for _, name := range strings.Split(self.Services, ",") {
+            hooks.services[strings.TrimSpace(name)] = true
+        }
+    }
+
+    if self.PreURL != "" || self.PostURL != "" {
+        hooks.client = &http.Client{Timeout: hooks.config.Timeout}
+    }
+
+    return hooks, nil
+}
+
+// Return the name of the service for service-scoped configs, or "" if the config is not hooked
+func (self *Hooks) serviceName(config Config) string {
+    var serviceName string
+
+    switch hookConfig := config.(type) {
+    case *ConfigService:
+        serviceName = hookConfig.ServiceName
+    case *ConfigServiceFrontend:
+        serviceName = hookConfig.ServiceName
+    case *ConfigServiceBackend:
+        serviceName = hookConfig.ServiceName
+    case *ConfigServiceShift:
+        serviceName = hookConfig.ServiceName
+    case *ConfigServiceExperiment:
+        serviceName = hookConfig.ServiceName
+    }
+
+    if serviceName == "" {
+        return ""
+    } else if self.services != nil && !self.services[serviceName] {
+        return ""
+    } else {
+        return serviceName
+    }
+}
+
+func (self *Hooks) enabled() bool {
+    return self.config.PreExec != "" || self.config.PostExec != "" || self.config.PreURL != "" || self.config.PostURL != ""
+}
+
+// The etcd config is hooked, and remembered once applied
+func (self *Hooks) hooked(config Config) bool {
+    return self.enabled() && config.Source() == EtcdConfigSource && self.serviceName(config) != ""
+}
+
+func equalConfig(a Config, b Config) bool {
+    if aNode, err := makeNode(a); err != nil {
+        return false
+    } else if bNode, err := makeNode(b); err != nil {
+        return false
+    } else {
+        return aNode == bNode
+    }
+}
+
+// Remember the applied event, including any child paths of a deleted directory
+func (self *Hooks) record(event Event) {
+    if !self.hooked(event.Config) {
+        return
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    path := event.Config.Path()
+
+    if event.Action != DelConfig {
+        if event.Config.Value() != nil {
+            self.applied[path] = event.Config
+        }
+
+        return
+    }
+
+    for appliedPath, _ := range self.applied {
+        if appliedPath == path || strings.HasPrefix(appliedPath, path + "/") {
+            delete(self.applied, appliedPath)
+        }
+    }
+}
+
+func (self *Hooks) exec(command string, request HookRequest) error {
+    var output bytes.Buffer
+
+    ctx, cancel := context.WithTimeout(context.Background(), self.config.Timeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+    cmd.Env = []string{
+        "PATH=" + os.Getenv("PATH"),
+        "CLUSTERF_HOOK=" + request.Hook,
+        "CLUSTERF_ACTION=" + string(request.Action),
+        "CLUSTERF_SERVICE=" + request.Service,
+        "CLUSTERF_PATH=" + request.Path,
+    }
+    cmd.Stdout = &output
+    cmd.Stderr = &output
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error {
+        // kill the entire process group
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+    cmd.WaitDelay = time.Second
+
+    if err := cmd.Run(); ctx.Err() == context.DeadlineExceeded {
+        return fmt.Errorf("exec: timeout after %v", self.config.Timeout)
+    } else if err != nil {
+        return fmt.Errorf("exec: %v: %s", err, strings.TrimSpace(output.String()))
+    }
+
+    return nil
+}
+
+func (self *Hooks) webhook(url string, request HookRequest) error {
+    var buf bytes.Buffer
+
+    if err := json.NewEncoder(&buf).Encode(request); err != nil {
+        return err
+    }
+
+    response, err := self.client.Post(url, "application/json", &buf)
+    if err != nil {
+        return fmt.Errorf("webhook: %v", err)
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode >= 200 && response.StatusCode < 300 {
+        return nil
+    } else if body, _ := ioutil.ReadAll(response.Body); len(body) > 0 {
+        return fmt.Errorf("webhook: %s: %s", response.Status, strings.TrimSpace(string(body)))
+    } else {
+        return fmt.Errorf("webhook: %s", response.Status)
+    }
+}
+
+func (self *Hooks) run(hook string, command string, url string, event Event) error {
+    if command == "" && url == "" {
+        return nil
+    }
+
+    serviceName := self.serviceName(event.Config)
+
+    if serviceName == "" {
+        return nil
+    }
+
+    request := HookRequest{
+        Hook:       hook,
+        Action:     event.Action,
+        Service:    serviceName,
+        Path:       event.Config.Path(),
+    }
+
+    if command == "" {
+
+    } else if err := self.exec(command, request); err != nil {
+        return fmt.Errorf("%s hook %s: %v", hook, request.Path, err)
+    }
+
+    if url == "" {
+
+    } else if err := self.webhook(url, request); err != nil {
+        return fmt.Errorf("%s hook %s: %v", hook, request.Path, err)
+    }
+
+    return nil
+}
+
+// Run the pre hooks for the event, before applying it.
+//
+// Returns an error if the change should be skipped, as per the failure policy.
+func (self *Hooks) Pre(event Event) error {
+    if err := self.run(HOOK_PRE, self.config.PreExec, self.config.PreURL, event); err == nil {
+        return nil
+    } else if self.config.Failure == HOOK_CONTINUE {
+        log.Printf("config:Hooks.Pre: %v, continuing\n", err)
+        return nil
+    } else {
+        return err
+    }
+}
+
+// Run the post hooks for the event, after applying it.
+//
+// Any failures are only logged, as the change has already been applied.
+func (self *Hooks) Post(event Event) {
+    self.record(event)
+
+    if err := self.run(HOOK_POST, self.config.PostExec, self.config.PostURL, event); err != nil {
+        log.Printf("config:Hooks.Post: %v\n", err)
+    }
+}
+
+// Remember the initially applied configs, without running any hooks
+func (self *Hooks) Scan(configs []Config) {
+    for _, config := range configs {
+        self.record(Event{NewConfig, config})
+    }
+}
+
+// Run the pre hooks for any changes to the hooked configs in the full scan, compared to the last applied configs.
+//
+// Returns the configs to resync, using the last applied config in place of any change aborted by the pre hooks, and the events
+// to pass to Post once the configs have been applied.
+func (self *Hooks) Resync(configs []Config) ([]Config, []Event) {
+    var resyncConfigs []Config
+    var events []Event
+    var paths = make(map[string]bool)
+
+    if !self.enabled() {
+        return configs, nil
+    }
+
+    self.mutex.Lock()
+    applied := make(map[string]Config, len(self.applied))
+    for path, config := range self.applied {
+        applied[path] = config
+    }
+    self.mutex.Unlock()
+
+    for _, config := range configs {
+        paths[config.Path()] = true
+
+        appliedConfig := applied[config.Path()]
+
+        if !self.hooked(config) || config.Value() == nil {
+            resyncConfigs = append(resyncConfigs, config)
+
+        } else if appliedConfig != nil && equalConfig(appliedConfig, config) {
+            resyncConfigs = append(resyncConfigs, config)
+
+        } else if err := self.Pre(Event{SetConfig, config}); err == nil {
+            resyncConfigs = append(resyncConfigs, config)
+            events = append(events, Event{SetConfig, config})
+
+        } else if appliedConfig != nil {
+            log.Printf("config:Hooks.Resync: %v, keeping the previous config\n", err)
+
+            resyncConfigs = append(resyncConfigs, appliedConfig)
+
+        } else {
+            log.Printf("config:Hooks.Resync: %v, skipping\n", err)
+        }
+    }
+
+    for path, appliedConfig := range applied {
+        if paths[path] {
+
+        } else if err := self.Pre(Event{DelConfig, appliedConfig}); err == nil {
+            events = append(events, Event{DelConfig, appliedConfig})
+
+        } else {
+            log.Printf("config:Hooks.Resync: %v, keeping the previous config\n", err)
+
+            resyncConfigs = append(resyncConfigs, appliedConfig)
+        }
+    }
+
+    return resyncConfigs, events
+}
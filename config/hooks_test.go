@@ -0,0 +1,217 @@
+package config
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestHooksExec(t *testing.T) {
+    output := filepath.Join(t.TempDir(), "output")
+
+    hooks, err := HooksConfig{
+        PreExec:    `echo "$CLUSTERF_HOOK $CLUSTERF_ACTION $CLUSTERF_SERVICE $CLUSTERF_PATH" >> ` + output,
+        PostExec:   `echo "$CLUSTERF_HOOK $CLUSTERF_ACTION $CLUSTERF_SERVICE $CLUSTERF_PATH" >> ` + output,
+        Services:   "test, test2",
+    }.Open()
+    if err != nil {
+        t.Fatalf("HooksConfig.Open: %v", err)
+    }
+
+    for _, event := range []Event{
+        {NewConfig, &ConfigServiceFrontend{ServiceName: "test", Frontend: ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}}},
+        {DelConfig, &ConfigServiceBackend{ServiceName: "test2", BackendName: "test1"}},
+        {NewConfig, &ConfigServiceBackend{ServiceName: "other", BackendName: "test1"}},
+        {NewConfig, &ConfigGroupBackend{GroupName: "test", BackendName: "test1"}},
+    } {
+        if err := hooks.Pre(event); err != nil {
+            t.Errorf("Pre %s %s: %v", event.Action, event.Config.Path(), err)
+        }
+
+        hooks.Post(event)
+    }
+
+    buf, err := os.ReadFile(output)
+    if err != nil {
+        t.Fatalf("ReadFile: %v", err)
+    }
+
+    expected := []string{
+        "pre new test services/test/frontend",
+        "post new test services/test/frontend",
+        "pre del test2 services/test2/backends/test1",
+        "post del test2 services/test2/backends/test1",
+    }
+
+    if lines := strings.Split(strings.TrimSpace(string(buf)), "\n"); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+        t.Errorf("hook output:\n%s\nexpected:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+    }
+}
+
+func TestHooksFailure(t *testing.T) {
+    event := Event{NewConfig, &ConfigService{ServiceName: "test"}}
+
+    for _, test := range []struct{
+        config  HooksConfig
+        error   string
+    }{
+        {HooksConfig{PreExec: "echo fail; exit 1"}, "pre hook services/test: exec: exit status 1: fail"},
+        {HooksConfig{PreExec: "echo fail; exit 1", Failure: HOOK_CONTINUE}, ""},
+        {HooksConfig{PreExec: "sleep 10", Timeout: 100 * time.Millisecond}, "pre hook services/test: exec: timeout after 100ms"},
+    } {
+        hooks, err := test.config.Open()
+        if err != nil {
+            t.Fatalf("HooksConfig.Open: %v", err)
+        }
+
+        err = hooks.Pre(event)
+
+        if err == nil && test.error != "" {
+            t.Errorf("Pre %#v: no error", test.config.PreExec)
+        } else if err != nil && err.Error() != test.error {
+            t.Errorf("Pre %#v: %v", test.config.PreExec, err)
+        }
+    }
+}
+
+func TestHooksOpenError(t *testing.T) {
+    if _, err := (HooksConfig{Failure: "ignore"}).Open(); err == nil {
+        t.Errorf("HooksConfig.Open: no error for invalid failure policy")
+    }
+}
+
+func TestHooksWebhook(t *testing.T) {
+    var requests []HookRequest
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var request HookRequest
+
+        if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        requests = append(requests, request)
+
+        if request.Service == "denied" {
+            http.Error(w, "denied", http.StatusForbidden)
+        }
+    }))
+    defer server.Close()
+
+    hooks, err := HooksConfig{PreURL: server.URL, PostURL: server.URL}.Open()
+    if err != nil {
+        t.Fatalf("HooksConfig.Open: %v", err)
+    }
+
+    event := Event{SetConfig, &ConfigServiceShift{ServiceName: "test"}}
+
+    if err := hooks.Pre(event); err != nil {
+        t.Errorf("Pre: %v", err)
+    }
+
+    hooks.Post(event)
+
+    if err := hooks.Pre(Event{SetConfig, &ConfigServiceShift{ServiceName: "denied"}}); err == nil {
+        t.Errorf("Pre denied: no error")
+    } else if err.Error() != "pre hook services/denied/shift: webhook: 403 Forbidden: denied" {
+        t.Errorf("Pre denied: %v", err)
+    }
+
+    if len(requests) != 3 {
+        t.Fatalf("webhook requests: %#v", requests)
+    }
+
+    if requests[0] != (HookRequest{Hook: HOOK_PRE, Action: SetConfig, Service: "test", Path: "services/test/shift"}) {
+        t.Errorf("webhook pre request: %#v", requests[0])
+    }
+    if requests[1] != (HookRequest{Hook: HOOK_POST, Action: SetConfig, Service: "test", Path: "services/test/shift"}) {
+        t.Errorf("webhook post request: %#v", requests[1])
+    }
+}
+
+// Test a resync after a change aborted by the pre hook, keeping the last applied config until the pre hook succeeds
+func TestHooksResync(t *testing.T) {
+    abort := filepath.Join(t.TempDir(), "abort")
+
+    hooks, err := HooksConfig{PreExec: `test ! -e ` + abort}.Open()
+    if err != nil {
+        t.Fatalf("HooksConfig.Open: %v", err)
+    }
+
+    frontendConfig := &ConfigServiceFrontend{ServiceName: "test", Frontend: ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}, ConfigSource: EtcdConfigSource}
+    backendConfig := &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 10}, ConfigSource: EtcdConfigSource}
+    fileConfig := &ConfigServiceFrontend{ServiceName: "file", Frontend: ServiceFrontend{IPv4: "10.0.1.2", TCP: 80}, ConfigSource: FileConfigSource}
+
+    hooks.Scan([]Config{frontendConfig, backendConfig})
+
+    if err := os.WriteFile(abort, nil, 0644); err != nil {
+        t.Fatalf("WriteFile: %v", err)
+    }
+
+    scanConfigs := []Config{
+        fileConfig,
+        frontendConfig,
+        &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 20}, ConfigSource: EtcdConfigSource},
+        &ConfigServiceBackend{ServiceName: "test", BackendName: "test2", Backend: ServiceBackend{IPv4: "10.1.0.2", Weight: 10}, ConfigSource: EtcdConfigSource},
+    }
+
+    formatConfigs := func(configs []Config) string {
+        var out []string
+
+        for _, config := range configs {
+            node, _ := makeNode(config)
+            out = append(out, node.Path + "=" + node.Value)
+        }
+
+        sort.Strings(out)
+
+        return strings.Join(out, ", ")
+    }
+
+    testResync := func(step string, scanConfigs []Config, expectedConfigs []Config, expectedEvents []string) {
+        configs, events := hooks.Resync(scanConfigs)
+
+        var eventStrings []string
+
+        for _, event := range events {
+            eventStrings = append(eventStrings, fmt.Sprintf("%s %s", event.Action, event.Config.Path()))
+
+            hooks.Post(event)
+        }
+
+        sort.Strings(eventStrings)
+
+        if formatConfigs(configs) != formatConfigs(expectedConfigs) {
+            t.Errorf("%s: configs %v != %v", step, formatConfigs(configs), formatConfigs(expectedConfigs))
+        }
+        if strings.Join(eventStrings, ", ") != strings.Join(expectedEvents, ", ") {
+            t.Errorf("%s: events %v != %v", step, eventStrings, expectedEvents)
+        }
+    }
+
+    // aborted changes keep the previous config
+    testResync("abort", scanConfigs, []Config{fileConfig, frontendConfig, backendConfig}, nil)
+
+    // the aborted changes are retried
+    os.Remove(abort)
+
+    testResync("retry", scanConfigs, scanConfigs, []string{"set services/test/backends/test1", "set services/test/backends/test2"})
+    testResync("unchanged", scanConfigs, scanConfigs, nil)
+
+    // aborted deletes keep the previous config
+    os.WriteFile(abort, nil, 0644)
+
+    testResync("abort delete", []Config{frontendConfig}, scanConfigs[1:], nil)
+
+    os.Remove(abort)
+
+    testResync("delete", []Config{frontendConfig}, []Config{frontendConfig}, []string{"del services/test/backends/test1", "del services/test/backends/test2"})
+}
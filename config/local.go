@@ -0,0 +1,29 @@
+package config
+/*
+ * Local frontends, exposing a daemon on the same host through IPVS, using the frontend IPs as local addresses on an interface.
+ */
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Linux IFNAMSIZ, including the NUL
+const INTERFACE_MAX = 15
+
+// Check that local frontends have an address and ports for the local daemon to listen on
+func (self *ServiceFrontend) checkInterface() error {
+    if self.Interface == "" {
+        return nil
+    } else if len(self.Interface) > INTERFACE_MAX || strings.ContainsAny(self.Interface, "/ \t\n") {
+        return fmt.Errorf("Invalid interface: %#v", self.Interface)
+    } else if self.FwMark != 0 {
+        return fmt.Errorf("interface %s frontend cannot have a fwmark", self.Interface)
+    } else if self.IPv4 == "" && self.IPv6 == "" {
+        return fmt.Errorf("interface %s frontend requires an ipv4 or ipv6 address", self.Interface)
+    } else if self.TCP == 0 && self.UDP == 0 && self.SCTP == 0 {
+        return fmt.Errorf("interface %s frontend requires a tcp, udp, sctp or port", self.Interface)
+    }
+
+    return nil
+}
@@ -0,0 +1,95 @@
+package config
+/*
+ * Migration between config stores.
+ */
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "sort"
+)
+
+// Parse the given nodes, skipping any invalid nodes
+func ScanNodes(nodes []Node) (configs []Config) {
+    for _, node := range nodes {
+        if config, err := syncConfig(node); err != nil {
+            log.Printf("config:ScanNodes %s: %v\n", node.Path, err)
+        } else if config != nil {
+            configs = append(configs, config)
+        }
+    }
+
+    return
+}
+
+// Return the errors for any invalid nodes skipped by ScanNodes
+func CheckNodes(nodes []Node) (errs []error) {
+    for _, node := range nodes {
+        if _, err := syncConfig(node); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %v", node.Path, err))
+        }
+    }
+
+    return
+}
+
+func configValues(configs []Config) (map[string]string, error) {
+    values := make(map[string]string)
+
+    for _, config := range configs {
+        if config.Value() == nil {
+            // directory
+        } else if jsonValue, err := json.Marshal(config.Value()); err != nil {
+            return nil, fmt.Errorf("%s: %v", config.Path(), err)
+        } else {
+            values[config.Path()] = string(jsonValue)
+        }
+    }
+
+    return values, nil
+}
+
+type configDiff []string
+
+func (self configDiff) Len() int            { return len(self) }
+func (self configDiff) Swap(i, j int)       { self[i], self[j] = self[j], self[i] }
+func (self configDiff) Less(i, j int) bool  { return self[i][1:] < self[j][1:] }
+
+/*
+ * Compare two sets of configs by path and value, ignoring any directories.
+ *
+ * Returns a list of differences, sorted by path:
+ *  -path   only in a
+ *  +path   only in b
+ *  ~path   different values
+ */
+func DiffConfigs(a []Config, b []Config) ([]string, error) {
+    var diff configDiff
+
+    aValues, err := configValues(a)
+    if err != nil {
+        return nil, err
+    }
+    bValues, err := configValues(b)
+    if err != nil {
+        return nil, err
+    }
+
+    for path, aValue := range aValues {
+        if bValue, exists := bValues[path]; !exists {
+            diff = append(diff, "-" + path)
+        } else if bValue != aValue {
+            diff = append(diff, "~" + path)
+        }
+    }
+    for path, _ := range bValues {
+        if _, exists := aValues[path]; !exists {
+            diff = append(diff, "+" + path)
+        }
+    }
+
+    sort.Sort(diff)
+
+    return diff, nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// Fake etcd v3 JSON gateway
+type testEtcd3 map[string]string
+
+func (self testEtcd3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Key         []byte  `json:"key"`
+        Value       []byte  `json:"value"`
+        RangeEnd    []byte  `json:"range_end"`
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+
+    switch r.URL.Path {
+    case "/v3/kv/put":
+        self[string(request.Key)] = string(request.Value)
+
+        fmt.Fprintf(w, "{}")
+
+    case "/v3/kv/range":
+        var response etcd3RangeResponse
+
+        for key, value := range self {
+            if key >= string(request.Key) && key < string(request.RangeEnd) {
+                response.Kvs = append(response.Kvs, etcd3KeyValue{
+                    Key:    base64.StdEncoding.EncodeToString([]byte(key)),
+                    Value:  base64.StdEncoding.EncodeToString([]byte(value)),
+                })
+            }
+        }
+
+        json.NewEncoder(w).Encode(response)
+
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+func TestMigrateEtcd3(t *testing.T) {
+    etcd3Server := testEtcd3{"/other/key": "{}"}
+    server := httptest.NewServer(etcd3Server)
+    defer server.Close()
+
+    etcd3, err := Etcd3Config{Endpoint: server.URL, Prefix: "/clusterf"}.Open()
+    if err != nil {
+        t.Fatalf("Etcd3Config.Open: %v", err)
+    }
+
+    nodes := []Node{
+        {Path: "services/test", IsDir: true},
+        {Path: "services/test/frontend", Value: `{"ipv4": "10.0.1.1", "tcp": 80}`},
+        {Path: "services/test/backends/test1", Value: `{"ipv4": "10.1.0.1", "tcp": 80}`},
+        {Path: "routes/test", Value: `{"Prefix4": "10.1.0.0/24", "IpvsMethod": "droute"}`},
+    }
+
+    for _, node := range nodes {
+        if err := etcd3.Put(node); err != nil {
+            t.Fatalf("Etcd3.Put %v: %v", node.Path, err)
+        }
+    }
+
+    if value := etcd3Server["/clusterf/services/test/backends/test1"]; value != nodes[2].Value {
+        t.Errorf("incorrect etcd3 value: %v", value)
+    }
+
+    etcd3Nodes, err := etcd3.Nodes()
+    if err != nil {
+        t.Fatalf("Etcd3.Nodes: %v", err)
+    }
+    if len(etcd3Nodes) != 3 {
+        t.Errorf("incorrect etcd3 nodes: %v", etcd3Nodes)
+    }
+
+    if diff, err := DiffConfigs(ScanNodes(nodes), ScanNodes(etcd3Nodes)); err != nil {
+        t.Fatalf("DiffConfigs: %v", err)
+    } else if len(diff) != 0 {
+        t.Errorf("DiffConfigs: %v", diff)
+    }
+}
+
+func TestDiffConfigs(t *testing.T) {
+    a := ScanNodes([]Node{
+        {Path: "services/test/frontend", Value: `{"ipv4": "10.0.1.1", "tcp": 80}`},
+        {Path: "services/test/backends/test1", Value: `{"ipv4": "10.1.0.1", "tcp": 80}`},
+        {Path: "services/test/backends/test2", Value: `{"ipv4": "10.1.0.2", "tcp": 80}`},
+    })
+    b := ScanNodes([]Node{
+        {Path: "services/test/frontend", Value: `{"tcp": 80, "ipv4": "10.0.1.1"}`},
+        {Path: "services/test/backends/test1", Value: `{"ipv4": "10.1.0.1", "tcp": 8080}`},
+        {Path: "services/test/backends/test3", Value: `{"ipv4": "10.1.0.3", "tcp": 80}`},
+    })
+
+    if diff, err := DiffConfigs(a, b); err != nil {
+        t.Fatalf("DiffConfigs: %v", err)
+    } else if fmt.Sprintf("%v", diff) != "[~services/test/backends/test1 -services/test/backends/test2 +services/test/backends/test3]" {
+        t.Errorf("DiffConfigs: %v", diff)
+    }
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+    "github.com/qmsk/clusterf/errs"
     "fmt"
     "encoding/json"
     "strings"
@@ -18,13 +19,57 @@ type Node struct {
 }
 
 func (self *Node) loadServiceFrontend() (frontend ServiceFrontend, err error) {
-    err = json.Unmarshal([]byte(self.Value), &frontend)
+    if err = json.Unmarshal([]byte(self.Value), &frontend); err != nil {
+        return
+    }
+
+    if err = frontend.expandPort(); err != nil {
+        return
+    }
+
+    if err = frontend.checkPersistence(); err != nil {
+        return
+    }
+
+    if err = frontend.checkFwMark(); err != nil {
+        return
+    }
+
+    err = frontend.checkInterface()
 
     return
 }
 
 func (self *Node) loadServiceBackend() (backend ServiceBackend, err error) {
-    err = json.Unmarshal([]byte(self.Value), &backend)
+    if err = json.Unmarshal([]byte(self.Value), &backend); err != nil {
+        return
+    }
+
+    if err = backend.expandPort(); err != nil {
+        return
+    }
+
+    err = backend.checkThresh()
+
+    return
+}
+
+func (self *Node) loadServiceShift() (shift ServiceShift, err error) {
+    if err = json.Unmarshal([]byte(self.Value), &shift); err != nil {
+        return
+    }
+
+    err = shift.check()
+
+    return
+}
+
+func (self *Node) loadServiceExperiment() (experiment ServiceExperiment, err error) {
+    if err = json.Unmarshal([]byte(self.Value), &experiment); err != nil {
+        return
+    }
+
+    err = experiment.check()
 
     return
 }
@@ -35,8 +80,26 @@ func (self *Node) loadRoute() (route Route, err error) {
     return
 }
 
-// map config node path and value to Config
+func (self *Node) loadStatus() (status ServiceStatus, err error) {
+    err = json.Unmarshal([]byte(self.Value), &status)
+
+    return
+}
+
+func (self *Node) loadShard() (shard Shard, err error) {
+    err = json.Unmarshal([]byte(self.Value), &shard)
+
+    return
+}
+
+// map config node path and value to Config, with any errors classified as config errors
 func syncConfig(node Node) (Config, error) {
+    config, err := loadConfig(node)
+
+    return config, errs.ConfigError(err)
+}
+
+func loadConfig(node Node) (Config, error) {
     nodePath := strings.Split(node.Path, "/")
 
     if len(node.Path) == 0 {
@@ -69,6 +132,16 @@ func syncConfig(node Node) (Config, error) {
                 return &ConfigServiceFrontend{ServiceName: serviceName, Frontend: frontend, ConfigSource: node.Source}, nil
             }
 
+        } else if len(nodePath) == 3 && nodePath[2] == "shift" && !node.IsDir {
+            if node.Value == "" {
+                // deleted node has empty value
+                return &ConfigServiceShift{ServiceName: serviceName, ConfigSource: node.Source}, nil
+            } else if shift, err := node.loadServiceShift(); err != nil {
+                return nil, fmt.Errorf("service %s shift: %s", serviceName, err)
+            } else {
+                return &ConfigServiceShift{ServiceName: serviceName, Shift: shift, ConfigSource: node.Source}, nil
+            }
+
         } else if len(nodePath) == 3 && nodePath[2] == "backends" && node.IsDir {
             // recursive on all backends
             return &ConfigServiceBackend{ServiceName: serviceName, ConfigSource: node.Source}, nil
@@ -90,10 +163,56 @@ func syncConfig(node Node) (Config, error) {
                 return nil, fmt.Errorf("Ignore unknown service %s backends node", serviceName)
             }
 
+        } else if len(nodePath) == 3 && nodePath[2] == "experiments" && node.IsDir {
+            // recursive on all experiments
+            return &ConfigServiceExperiment{ServiceName: serviceName, ConfigSource: node.Source}, nil
+
+        } else if len(nodePath) == 4 && nodePath[2] == "experiments" && !node.IsDir {
+            experimentName := nodePath[3]
+
+            if node.Value == "" {
+                // deleted node has empty value
+                return &ConfigServiceExperiment{ServiceName: serviceName, ExperimentName: experimentName, ConfigSource: node.Source}, nil
+            } else if experiment, err := node.loadServiceExperiment(); err != nil {
+                return nil, fmt.Errorf("service %s experiment %s: %s", serviceName, experimentName, err)
+            } else {
+                return &ConfigServiceExperiment{ServiceName: serviceName, ExperimentName: experimentName, Experiment: experiment, ConfigSource: node.Source}, nil
+            }
+
         } else {
             return nil, fmt.Errorf("Ignore unknown service %s node", serviceName)
         }
 
+    } else if len(nodePath) == 1 && nodePath[0] == "groups" && node.IsDir {
+        // recursive on all groups
+        return &ConfigGroup{ConfigSource: node.Source}, nil
+
+    } else if len(nodePath) >= 2 && nodePath[0] == "groups" {
+        groupName := nodePath[1]
+
+        if len(nodePath) == 2 && node.IsDir {
+            return &ConfigGroup{GroupName: groupName, ConfigSource: node.Source}, nil
+
+        } else if len(nodePath) == 3 && nodePath[2] == "backends" && node.IsDir {
+            // recursive on all backends
+            return &ConfigGroupBackend{GroupName: groupName, ConfigSource: node.Source}, nil
+
+        } else if len(nodePath) == 4 && nodePath[2] == "backends" && !node.IsDir {
+            backendName := nodePath[3]
+
+            if node.Value == "" {
+                // deleted node has empty value
+                return &ConfigGroupBackend{GroupName: groupName, BackendName: backendName, ConfigSource: node.Source}, nil
+            } else if backend, err := node.loadServiceBackend(); err != nil {
+                return nil, fmt.Errorf("group %s backend %s: %s", groupName, backendName, err)
+            } else {
+                return &ConfigGroupBackend{GroupName: groupName, BackendName: backendName, Backend: backend, ConfigSource: node.Source}, nil
+            }
+
+        } else {
+            return nil, fmt.Errorf("Ignore unknown group %s node", groupName)
+        }
+
     } else if len(nodePath) == 1 && nodePath[0] == "routes" && node.IsDir {
         // recursive on all routes
         return &ConfigRoute{ }, nil
@@ -113,6 +232,51 @@ func syncConfig(node Node) (Config, error) {
         } else {
             return nil, fmt.Errorf("Ignore unknown route node")
         }
+
+    } else if len(nodePath) == 1 && nodePath[0] == "shards" && node.IsDir {
+        // recursive on all shards
+        return &ConfigShard{ConfigSource: node.Source}, nil
+
+    } else if len(nodePath) >= 2 && nodePath[0] == "shards" {
+        nodeName := nodePath[1]
+
+        if len(nodePath) == 2 && !node.IsDir {
+            if node.Value == "" {
+                // deleted node has empty value
+                return &ConfigShard{NodeName: nodeName, ConfigSource: node.Source}, nil
+            } else if shard, err := node.loadShard(); err != nil {
+                return nil, fmt.Errorf("shard %s: %s", nodeName, err)
+            } else {
+                return &ConfigShard{NodeName: nodeName, Shard: shard, ConfigSource: node.Source}, nil
+            }
+        } else {
+            return nil, fmt.Errorf("Ignore unknown shard node")
+        }
+
+    } else if len(nodePath) == 1 && nodePath[0] == "status" && node.IsDir {
+        // recursive on all statuses
+        return &ConfigStatus{ConfigSource: node.Source}, nil
+
+    } else if len(nodePath) >= 2 && nodePath[0] == "status" {
+        nodeName := nodePath[1]
+
+        if len(nodePath) == 2 && node.IsDir {
+            return &ConfigStatus{NodeName: nodeName, ConfigSource: node.Source}, nil
+
+        } else if len(nodePath) == 3 && !node.IsDir {
+            serviceName := nodePath[2]
+
+            if node.Value == "" {
+                // deleted or expired node has empty value
+                return &ConfigStatus{NodeName: nodeName, ServiceName: serviceName, ConfigSource: node.Source}, nil
+            } else if status, err := node.loadStatus(); err != nil {
+                return nil, fmt.Errorf("status %s/%s: %s", nodeName, serviceName, err)
+            } else {
+                return &ConfigStatus{NodeName: nodeName, ServiceName: serviceName, Status: status, ConfigSource: node.Source}, nil
+            }
+        } else {
+            return nil, fmt.Errorf("Ignore unknown status node")
+        }
     } else {
         return nil, fmt.Errorf("Ignore unknown node")
     }
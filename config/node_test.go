@@ -1,10 +1,12 @@
 package config
 
 import (
+    "github.com/qmsk/clusterf/errs"
     "fmt"
     "log"
     "regexp"
     "testing"
+    "time"
 )
 
 func loadBackend (t *testing.T, value string) ServiceBackend {
@@ -26,6 +28,16 @@ func TestBackendLoad (t *testing.T) {
     }
 }
 
+func TestSyncConfigError (t *testing.T) {
+    node := Node{Source:"test", Path: "services/test/backends/test", Value: "{\"ipv4\": "}
+
+    if _, err := syncConfig(node); err == nil {
+        t.Errorf("syncConfig(%v): no error", node)
+    } else if class := errs.Classify(err); class != errs.Config {
+        t.Errorf("syncConfig(%v): %v error: %v", node, class, err)
+    }
+}
+
 var testSync = []struct {
     action  Action
     node    Node
@@ -146,6 +158,335 @@ var testSync = []struct {
             Frontend:    ServiceFrontend{IPv6: "2001:db8::1", TCP: 8080},
         }},
     },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test7/frontend", Value: "{\"ipv4\": \"127.0.0.7\", \"tcp\": 8080, \"group\": \"test\"}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "test7",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.7", TCP: 8080, Group: "test"},
+        }},
+    },
+    {
+        action: SetConfig,
+        node: Node{Source:"test", Path:"services/test7/shift", Value: "{\"from\": \"test\", \"to\": \"test2\", \"start\": \"2016-01-01T12:00:00Z\", \"duration\": \"10m\"}"},
+        event: Event{Action: SetConfig, Config: &ConfigServiceShift{
+            ConfigSource: "test",
+            ServiceName: "test7",
+            Shift:       ServiceShift{From: "test", To: "test2", Start: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC), Duration: Duration(10 * time.Minute)},
+        }},
+    },
+    {
+        action: SetConfig,
+        node: Node{Source:"test", Path:"services/test7/shift", Value: "{\"from\": \"test\", \"to\": \"test\", \"start\": \"2016-01-01T12:00:00Z\", \"duration\": \"10m\"}"},
+        error: "service test7 shift: shift from and to the same group test",
+    },
+    {
+        action: DelConfig,
+        node: Node{Source:"test", Path:"services/test7/shift"},
+        event: Event{Action: DelConfig, Config: &ConfigServiceShift{
+            ConfigSource: "test",
+            ServiceName: "test7",
+        }},
+    },
+    {
+        action: SetConfig,
+        node: Node{Source:"test", Path:"services/test7/experiments/canary", Value: "{\"weights\": {\"test1\": 5}, \"active\": true}"},
+        event: Event{Action: SetConfig, Config: &ConfigServiceExperiment{
+            ConfigSource: "test",
+            ServiceName: "test7",
+            ExperimentName: "canary",
+            Experiment:  ServiceExperiment{Weights: map[string]uint{"test1": 5}, Active: true},
+        }},
+    },
+    {
+        action: SetConfig,
+        node: Node{Source:"test", Path:"services/test7/experiments/canary", Value: "{\"active\": true}"},
+        error: "service test7 experiment canary: experiment requires weights",
+    },
+    {
+        action: DelConfig,
+        node: Node{Source:"test", Path:"services/test7/experiments/canary"},
+        event: Event{Action: DelConfig, Config: &ConfigServiceExperiment{
+            ConfigSource: "test",
+            ServiceName: "test7",
+            ExperimentName: "canary",
+        }},
+    },
+    {
+        action: DelConfig,
+        node: Node{Source:"test", Path:"services/test7/experiments", IsDir: true},
+        event: Event{Action: DelConfig, Config: &ConfigServiceExperiment{
+            ConfigSource: "test",
+            ServiceName: "test7",
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/dns/frontend", Value: "{\"ipv4\": \"127.0.0.53\", \"port\": 53, \"protocols\": [\"tcp\", \"udp\"]}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "dns",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.53", TCP: 53, UDP: 53, Port: 53, Protocols: ProtocolTCP | ProtocolUDP},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/dns/frontend", Value: "{\"ipv4\": \"127.0.0.53\", \"port\": 53}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "dns",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.53", TCP: 53, Port: 53},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/diameter/frontend", Value: "{\"ipv4\": \"127.0.0.1\", \"port\": 3868, \"protocols\": [\"tcp\", \"sctp\"]}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "diameter",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.1", TCP: 3868, SCTP: 3868, Port: 3868, Protocols: ProtocolTCP | ProtocolSCTP},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/dns/frontend", Value: "{\"ipv4\": \"127.0.0.53\", \"port\": 53, \"protocols\": [\"icmp\"]}"},
+        error: "service dns frontend: Invalid protocol: \"icmp\"",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/dns/frontend", Value: "{\"ipv4\": \"127.0.0.53\", \"protocols\": [\"udp\"]}"},
+        error: "service dns frontend: protocols given without a port",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/dns/frontend", Value: "{\"ipv4\": \"127.0.0.53\", \"udp\": 5353, \"port\": 53, \"protocols\": [\"udp\"]}"},
+        error: "service dns frontend: conflicting udp=5353 and port=53",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test8/frontend", Value: "{\"ipv4\": \"127.0.0.8\", \"tcp\": 80, \"allow\": [\"10.0.0.0/8\", \"192.0.2.1\"], \"deny\": [\"10.6.6.0/24\"]}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "test8",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.8", TCP: 80, Allow: "10.0.0.0/8,192.0.2.1/32", Deny: "10.6.6.0/24"},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test8/frontend", Value: "{\"ipv4\": \"127.0.0.8\", \"tcp\": 80, \"allow\": [\"10.0.0.0/33\"]}"},
+        error: "service test8 frontend: invalid CIDR address: 10.0.0.0/33",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test9/frontend", Value: "{\"ipv4\": \"127.0.0.9\", \"tcp\": 80, \"persistence\": \"5m\"}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "test9",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.9", TCP: 80, Persistence: Duration(5 * time.Minute)},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test9/frontend", Value: "{\"ipv4\": \"127.0.0.9\", \"tcp\": 80, \"persistence\": 300}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "test9",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.9", TCP: 80, Persistence: Duration(5 * time.Minute)},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test9/frontend", Value: "{\"ipv4\": \"127.0.0.9\", \"tcp\": 80, \"persistence\": \"500ms\"}"},
+        error: "service test9 frontend: persistence 500ms is under the minimum of 1s",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test9/frontend", Value: "{\"ipv4\": \"127.0.0.9\", \"tcp\": 80, \"persistence\": \"48h\"}"},
+        error: "service test9 frontend: persistence 48h0m0s is over the maximum of 24h0m0s",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test9/frontend", Value: "{\"ipv4\": \"127.0.0.9\", \"tcp\": 80, \"persistence\": \"5m\", \"persistence_netmask4\": 24, \"persistence_netmask6\": 64}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "test9",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.9", TCP: 80, Persistence: Duration(5 * time.Minute), PersistenceNetmask4: 24, PersistenceNetmask6: 64},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test9/frontend", Value: "{\"ipv4\": \"127.0.0.9\", \"tcp\": 80, \"persistence_netmask4\": 24}"},
+        error: "service test9 frontend: persistence_netmask requires persistence",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test9/frontend", Value: "{\"ipv4\": \"127.0.0.9\", \"tcp\": 80, \"persistence\": \"5m\", \"persistence_netmask4\": 64}"},
+        error: "service test9 frontend: persistence_netmask4 /64 is over the maximum of /32",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/dns/backends/test1", Value: "{\"ipv4\": \"127.0.0.1\", \"port\": 5353}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceBackend{
+            ConfigSource: "test",
+            ServiceName: "dns",
+            BackendName: "test1",
+            Backend:     ServiceBackend{IPv4: "127.0.0.1", TCP: 5353, UDP: 5353, SCTP: 5353, Port: 5353},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/dns/backends/test2", Value: "{\"ipv4\": \"127.0.0.2\", \"port\": 5353, \"protocols\": [\"udp\"]}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceBackend{
+            ConfigSource: "test",
+            ServiceName: "dns",
+            BackendName: "test2",
+            Backend:     ServiceBackend{IPv4: "127.0.0.2", UDP: 5353, Port: 5353, Protocols: ProtocolUDP},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test/backends/test3", Value: "{\"ipv4\": \"127.0.0.3\", \"tcp\": 8083, \"u_thresh\": 100, \"l_thresh\": 50}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceBackend{
+            ConfigSource: "test",
+            ServiceName: "test",
+            BackendName: "test3",
+            Backend:     ServiceBackend{IPv4: "127.0.0.3", TCP: 8083, UThresh: 100, LThresh: 50},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test/backends/test3", Value: "{\"ipv4\": \"127.0.0.3\", \"tcp\": 8083, \"l_thresh\": 50}"},
+        error: "service test backend test3: l_thresh requires u_thresh",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test/backends/test3", Value: "{\"ipv4\": \"127.0.0.3\", \"tcp\": 8083, \"u_thresh\": 50, \"l_thresh\": 50}"},
+        error: "service test backend test3: l_thresh 50 must be lower than u_thresh 50",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test10/frontend", Value: "{\"ipv4\": \"127.0.0.10\", \"fwmark\": 10}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "test10",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.10", FwMark: 10},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test10/frontend", Value: "{\"ipv4\": \"127.0.0.10\", \"fwmark\": 10, \"tcp\": 80}"},
+        error: "service test10 frontend: fwmark 10 frontend cannot have any tcp, udp, sctp or port",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test10/frontend", Value: "{\"fwmark\": 10}"},
+        error: "service test10 frontend: fwmark 10 frontend requires an ipv4 or ipv6 address for the address family",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test11/frontend", Value: "{\"ipv4\": \"127.0.0.11\", \"tcp\": 53, \"udp\": 53, \"interface\": \"lo\"}"},
+        event: Event{Action: NewConfig, Config: &ConfigServiceFrontend{
+            ConfigSource: "test",
+            ServiceName: "test11",
+            Frontend:    ServiceFrontend{IPv4: "127.0.0.11", TCP: 53, UDP: 53, Interface: "lo"},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test11/frontend", Value: "{\"ipv4\": \"127.0.0.11\", \"interface\": \"lo\"}"},
+        error: "service test11 frontend: interface lo frontend requires a tcp, udp, sctp or port",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test11/frontend", Value: "{\"ipv4\": \"127.0.0.11\", \"fwmark\": 11, \"interface\": \"lo\"}"},
+        error: "service test11 frontend: interface lo frontend cannot have a fwmark",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"services/test11/frontend", Value: "{\"ipv4\": \"127.0.0.11\", \"tcp\": 80, \"interface\": \"lo dev eth0\"}"},
+        error: "service test11 frontend: Invalid interface: \"lo dev eth0\"",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"shards/test1", Value: "{\"shard\": \"0/4\"}"},
+        event: Event{Action: NewConfig, Config: &ConfigShard{
+            ConfigSource: "test",
+            NodeName: "test1",
+            Shard:  Shard{Shard: "0/4"},
+        }},
+    },
+    {
+        action: DelConfig,
+        node: Node{Source:"test", Path:"shards/test1"},
+        event: Event{Action: DelConfig, Config: &ConfigShard{
+            ConfigSource: "test",
+            NodeName: "test1",
+        }},
+    },
+    {
+        action: SetConfig,
+        node: Node{Source:"test", Path:"status/test1/web", Value: "{\"ipv4\": \"10.0.1.1\", \"healthy\": true, \"backends\": 2}"},
+        event: Event{Action: SetConfig, Config: &ConfigStatus{
+            ConfigSource: "test",
+            NodeName: "test1",
+            ServiceName: "web",
+            Status: ServiceStatus{IPv4: "10.0.1.1", Healthy: true, Backends: 2},
+        }},
+    },
+    {
+        action: DelConfig,
+        node: Node{Source:"test", Path:"status/test1/web"},
+        event: Event{Action: DelConfig, Config: &ConfigStatus{
+            ConfigSource: "test",
+            NodeName: "test1",
+            ServiceName: "web",
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"groups", IsDir:true},
+        event: Event{Action: NewConfig, Config: &ConfigGroup{
+            ConfigSource: "test",
+            GroupName: "",
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"groups/test", IsDir:true},
+        event: Event{Action: NewConfig, Config: &ConfigGroup{
+            ConfigSource: "test",
+            GroupName: "test",
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"groups/test/backends", IsDir:true},
+        event: Event{Action: NewConfig, Config: &ConfigGroupBackend{
+            ConfigSource: "test",
+            GroupName: "test",
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"groups/test/backends/test1", Value: "{\"ipv4\": \"127.0.0.1\", \"tcp\": 8081}"},
+        event: Event{Action: NewConfig, Config: &ConfigGroupBackend{
+            ConfigSource: "test",
+            GroupName: "test",
+            BackendName: "test1",
+            Backend:     ServiceBackend{IPv4: "127.0.0.1", TCP: 8081},
+        }},
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"groups/test/frontend", Value: "{}"},
+        error: "Ignore unknown group test node",
+    },
+    {
+        action: NewConfig,
+        node: Node{Source:"test", Path:"groups/test/backends/test1", Value: "not json"},
+        error: "group test backend test1: invalid character",
+    },
 
     {
         action: DelConfig,
@@ -181,6 +522,15 @@ var testSync = []struct {
             ServiceName: "test",
         }},
     },
+    {
+        action: DelConfig,
+        node: Node{Source:"test", Path:"groups/test/backends/test1"},
+        event: Event{Action: DelConfig, Config: &ConfigGroupBackend{
+            ConfigSource: "test",
+            GroupName: "test",
+            BackendName: "test1",
+        }},
+    },
     {
         action: DelConfig,
         node: Node{Source:"test", Path:"services", IsDir:true},
@@ -0,0 +1,78 @@
+package config
+/*
+ * Frontend persistence timeouts, given as human-friendly durations, and netmasks, given as prefix lengths.
+ */
+
+import (
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+// Limits for the frontend persistence timeout
+const (
+    PERSISTENCE_MIN     = 1 * time.Second
+    PERSISTENCE_MAX     = 24 * time.Hour
+)
+
+// Duration encoded as a JSON string like "5m", or a number of seconds
+type Duration time.Duration
+
+func (self Duration) String() string {
+    return time.Duration(self).String()
+}
+
+// Return the duration in whole seconds, rounding up
+func (self Duration) Seconds() uint32 {
+    return uint32((time.Duration(self) + time.Second - 1) / time.Second)
+}
+
+func (self Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(self.String())
+}
+
+func (self *Duration) UnmarshalJSON(buf []byte) error {
+    var value interface{}
+
+    if err := json.Unmarshal(buf, &value); err != nil {
+        return err
+    }
+
+    switch value := value.(type) {
+    case float64:
+        *self = Duration(value * float64(time.Second))
+    case string:
+        if duration, err := time.ParseDuration(value); err != nil {
+            return err
+        } else {
+            *self = Duration(duration)
+        }
+    default:
+        return fmt.Errorf("Invalid duration: %s", buf)
+    }
+
+    return nil
+}
+
+// Check the persistence timeout is within the limits, and any netmasks are valid prefix lengths
+func (self *ServiceFrontend) checkPersistence() error {
+    persistence := time.Duration(self.Persistence)
+
+    if self.PersistenceNetmask4 > 32 {
+        return fmt.Errorf("persistence_netmask4 /%d is over the maximum of /32", self.PersistenceNetmask4)
+    } else if self.PersistenceNetmask6 > 128 {
+        return fmt.Errorf("persistence_netmask6 /%d is over the maximum of /128", self.PersistenceNetmask6)
+    }
+
+    if persistence == 0 && (self.PersistenceNetmask4 != 0 || self.PersistenceNetmask6 != 0) {
+        return fmt.Errorf("persistence_netmask requires persistence")
+    } else if persistence == 0 {
+        return nil
+    } else if persistence < PERSISTENCE_MIN {
+        return fmt.Errorf("persistence %v is under the minimum of %v", persistence, PERSISTENCE_MIN)
+    } else if persistence > PERSISTENCE_MAX {
+        return fmt.Errorf("persistence %v is over the maximum of %v", persistence, PERSISTENCE_MAX)
+    }
+
+    return nil
+}
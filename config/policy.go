@@ -0,0 +1,385 @@
+package config
+/*
+ * Admission policy for config changes.
+ *
+ * Any changes rejected by the policy are ignored, keeping the previous config.
+ *
+ * The last admitted config for each path is remembered, and replaces any rejected config in a full re-scan.
+ * These can also be persisted to a state file, to keep them across restarts.
+ */
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+type PolicyConfig struct {
+    // Comma-separated CIDR prefixes that any frontend addresses must be within
+    FrontendPrefixes    string
+
+    // Maximum backend weight
+    MaxWeight           uint
+
+    // POST each change to the webhook as JSON, rejecting the change unless the webhook returns a 2xx status
+    WebhookURL          string
+    WebhookTimeout      time.Duration   // default: 5s
+
+    // Persist the last admitted configs to the given file, keeping any rejected changes ignored across restarts
+    StatePath           string
+}
+
+type Policy struct {
+    config          PolicyConfig
+    frontendNets    []*net.IPNet
+    client          *http.Client
+
+    // last admitted config for each path, replacing any rejected configs in a scan
+    mutex           sync.Mutex
+    admitted        map[string]Config
+}
+
+// The JSON request sent to the webhook
+type PolicyRequest struct {
+    Action      Action      `json:"action"`
+    Path        string      `json:"path"`
+    Value       interface{} `json:"value,omitempty"`
+}
+
+func (self PolicyConfig) Open() (*Policy, error) {
+    policy := &Policy{config: self, admitted: make(map[string]Config)}
+
+    if self.FrontendPrefixes != "" {
+        for _, prefix := range strings.Split(self.FrontendPrefixes, ",") {
+            if _, ipNet, err := net.ParseCIDR(strings.TrimSpace(prefix)); err != nil {
+                return nil, fmt.Errorf("Invalid frontend prefix %#v: %v", prefix, err)
+            } else {
+                policy.frontendNets = append(policy.frontendNets, ipNet)
+            }
+        }
+    }
+
+    if self.WebhookURL != "" {
+        timeout := self.WebhookTimeout
+
+        if timeout == 0 {
+            timeout = 5 * time.Second
+        }
+
+        policy.client = &http.Client{Timeout: timeout}
+    }
+
+    if self.StatePath == "" {
+
+    } else if err := policy.loadState(); err != nil {
+        return nil, err
+    }
+
+    return policy, nil
+}
+
+func (self *Policy) checkFrontendAddr(addr string) error {
+    if addr == "" || self.frontendNets == nil {
+        return nil
+    }
+
+    ip := net.ParseIP(addr)
+
+    for _, ipNet := range self.frontendNets {
+        if ip != nil && ipNet.Contains(ip) {
+            return nil
+        }
+    }
+
+    return fmt.Errorf("frontend address %s is not within %s", addr, self.config.FrontendPrefixes)
+}
+
+func (self *Policy) checkFrontend(frontend ServiceFrontend) error {
+    if err := self.checkFrontendAddr(frontend.IPv4); err != nil {
+        return err
+    }
+    if err := self.checkFrontendAddr(frontend.IPv6); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (self *Policy) checkBackend(backend ServiceBackend) error {
+    if self.config.MaxWeight != 0 && backend.Weight > self.config.MaxWeight {
+        return fmt.Errorf("backend weight %d is over %d", backend.Weight, self.config.MaxWeight)
+    }
+
+    return nil
+}
+
+func (self *Policy) checkWebhook(action Action, config Config) error {
+    var buf bytes.Buffer
+
+    request := PolicyRequest{Action: action, Path: config.Path()}
+
+    if action != DelConfig {
+        request.Value = config.Value()
+    }
+
+    if err := json.NewEncoder(&buf).Encode(request); err != nil {
+        return err
+    }
+
+    response, err := self.client.Post(self.config.WebhookURL, "application/json", &buf)
+    if err != nil {
+        return errs.BackendError(fmt.Errorf("webhook: %v", err))
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode >= 200 && response.StatusCode < 300 {
+        return nil
+    } else if body, _ := ioutil.ReadAll(response.Body); len(body) > 0 {
+        return fmt.Errorf("webhook: %s: %s", response.Status, strings.TrimSpace(string(body)))
+    } else {
+        return fmt.Errorf("webhook: %s", response.Status)
+    }
+}
+
+// Return an error if the config change is rejected by the policy.
+//
+// Deletes are only checked by the webhook.
+func (self *Policy) Check(action Action, config Config) error {
+    var err error
+
+    if action == DelConfig {
+
+    } else {
+        switch applyConfig := config.(type) {
+        case *ConfigServiceFrontend:
+            err = self.checkFrontend(applyConfig.Frontend)
+        case *ConfigServiceBackend:
+            err = self.checkBackend(applyConfig.Backend)
+        case *ConfigGroupBackend:
+            err = self.checkBackend(applyConfig.Backend)
+        }
+    }
+
+    if err != nil {
+        return errs.ConfigError(fmt.Errorf("%s: %v", config.Path(), err))
+    }
+
+    if self.client == nil || config.Value() == nil {
+        // directories are not checked by the webhook
+    } else if err := self.checkWebhook(action, config); err != nil {
+        // a rejection by the webhook is a config error, any failure to reach it is a backend error
+        return errs.ConfigError(fmt.Errorf("%s: %w", config.Path(), err))
+    }
+
+    return nil
+}
+
+// Return an error for the first change rejected by the policy
+func (self *Policy) CheckChanges(changes []ApplyChange) error {
+    for _, change := range changes {
+        if config, err := syncConfig(change.Node); err != nil {
+            return err
+        } else if config == nil {
+
+        } else if err := self.Check(change.Action, config); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Check the config change, remembering the admitted config for the path.
+//
+// Returns an error if the change is rejected, and should be ignored.
+func (self *Policy) Admit(action Action, config Config) error {
+    if err := self.Check(action, config); err != nil {
+        return err
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.admit(action, config)
+    self.writeState()
+
+    return nil
+}
+
+// Check the configs of a full scan, replacing any rejected configs with the last admitted config for the same path.
+//
+// Any remembered paths missing from the scan are checked as deletes, keeping the last admitted config if the delete is rejected.
+// Rejected configs without any previously admitted config are skipped.
+//
+// Returns a backend error if the webhook is unreachable for any config without a previously admitted config, instead of skipping
+// the config: a scan without a policy state would otherwise skip every config during a webhook outage.
+func (self *Policy) AdmitScan(configs []Config) ([]Config, error) {
+    var admitConfigs []Config
+    var paths = make(map[string]bool)
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    for _, config := range configs {
+        paths[config.Path()] = true
+
+        if err := self.Check(NewConfig, config); err == nil {
+            self.admit(SetConfig, config)
+
+            admitConfigs = append(admitConfigs, config)
+
+        } else if admitConfig := self.admitted[config.Path()]; admitConfig != nil {
+            log.Printf("config:Policy.AdmitScan: %v, keeping the previous config\n", err)
+
+            admitConfigs = append(admitConfigs, admitConfig)
+
+        } else if errs.Classify(err) == errs.Backend {
+            return nil, err
+
+        } else {
+            log.Printf("config:Policy.AdmitScan: %v\n", err)
+        }
+    }
+
+    for path, admitConfig := range self.admitted {
+        if paths[path] {
+
+        } else if err := self.Check(DelConfig, admitConfig); err == nil {
+            delete(self.admitted, path)
+
+        } else {
+            log.Printf("config:Policy.AdmitScan: %v, keeping the previous config\n", err)
+
+            admitConfigs = append(admitConfigs, admitConfig)
+        }
+    }
+
+    self.writeState()
+
+    return admitConfigs, nil
+}
+
+// Check the configs of a full scan like AdmitScan, without remembering any admitted configs or writing the state file.
+//
+// The webhook is requested without holding the lock, so that any concurrent Admit is not blocked by a dry run.
+func (self *Policy) CheckScan(configs []Config) ([]Config, error) {
+    var checkConfigs []Config
+    var paths = make(map[string]bool)
+    var admitted = make(map[string]Config)
+
+    self.mutex.Lock()
+    for path, admitConfig := range self.admitted {
+        admitted[path] = admitConfig
+    }
+    self.mutex.Unlock()
+
+    for _, config := range configs {
+        paths[config.Path()] = true
+
+        if err := self.Check(NewConfig, config); err == nil {
+            checkConfigs = append(checkConfigs, config)
+
+        } else if admitConfig := admitted[config.Path()]; admitConfig != nil {
+            checkConfigs = append(checkConfigs, admitConfig)
+
+        } else if errs.Classify(err) == errs.Backend {
+            return nil, err
+        }
+    }
+
+    for path, admitConfig := range admitted {
+        if paths[path] {
+
+        } else if err := self.Check(DelConfig, admitConfig); err != nil {
+            checkConfigs = append(checkConfigs, admitConfig)
+        }
+    }
+
+    return checkConfigs, nil
+}
+
+// Remember the admitted config, or forget any deleted configs
+func (self *Policy) admit(action Action, config Config) {
+    path := config.Path()
+
+    switch action {
+    case NewConfig, SetConfig:
+        if config.Value() != nil {
+            self.admitted[path] = config
+        }
+
+    case DelConfig:
+        delete(self.admitted, path)
+
+        // recursive delete of a directory node
+        for admitPath, _ := range self.admitted {
+            if strings.HasPrefix(admitPath, strings.TrimSuffix(path, "/") + "/") {
+                delete(self.admitted, admitPath)
+            }
+        }
+    }
+}
+
+// Load the admitted configs from the state file, if it exists
+func (self *Policy) loadState() error {
+    var file cacheFile
+
+    if buf, err := ioutil.ReadFile(self.config.StatePath); os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    } else if err := json.Unmarshal(buf, &file); err != nil {
+        return fmt.Errorf("%s: %v", self.config.StatePath, err)
+    }
+
+    for _, stateNode := range file.Nodes {
+        node := Node{Path: stateNode.Path, Value: stateNode.Value, Source: EtcdConfigSource}
+
+        if config, err := syncConfig(node); err != nil {
+            log.Printf("config:Policy.loadState %s: %v\n", node.Path, err)
+        } else if config != nil {
+            self.admitted[node.Path] = config
+        }
+    }
+
+    return nil
+}
+
+// Replace the state file with the admitted configs, logging any errors
+func (self *Policy) writeState() {
+    var file = cacheFile{Time: time.Now()}
+
+    if self.config.StatePath == "" {
+        return
+    }
+
+    for _, config := range self.admitted {
+        if node, err := makeNode(config); err != nil {
+            log.Printf("config:Policy.writeState %s: %v\n", config.Path(), err)
+        } else {
+            file.Nodes = append(file.Nodes, cacheNode{Path: node.Path, Value: node.Value})
+        }
+    }
+
+    sort.Slice(file.Nodes, func(i, j int) bool { return file.Nodes[i].Path < file.Nodes[j].Path })
+
+    tmpPath := self.config.StatePath + ".tmp"
+
+    if buf, err := json.Marshal(file); err != nil {
+        log.Printf("config:Policy.writeState: %v\n", err)
+    } else if err := ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+        log.Printf("config:Policy.writeState: %v\n", err)
+    } else if err := os.Rename(tmpPath, self.config.StatePath); err != nil {
+        log.Printf("config:Policy.writeState: %v\n", err)
+    }
+}
@@ -0,0 +1,225 @@
+package config
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+)
+
+var testPolicy = []struct {
+    action  Action
+    config  Config
+    error   string
+}{
+    {NewConfig, &ConfigServiceFrontend{ServiceName: "test", Frontend: ServiceFrontend{IPv4: "10.200.1.1", TCP: 80}}, ""},
+    {NewConfig, &ConfigServiceFrontend{ServiceName: "test", Frontend: ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}}, "services/test/frontend: frontend address 10.0.1.1 is not within 10.200.0.0/16, fd00::/8"},
+    {SetConfig, &ConfigServiceFrontend{ServiceName: "test", Frontend: ServiceFrontend{IPv4: "10.200.1.1", IPv6: "2001:db8::1"}}, "services/test/frontend: frontend address 2001:db8::1 is not within 10.200.0.0/16, fd00::/8"},
+    {DelConfig, &ConfigServiceFrontend{ServiceName: "test", Frontend: ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}}, ""},
+    {NewConfig, &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 1000}}, ""},
+    {NewConfig, &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 1001}}, "services/test/backends/test1: backend weight 1001 is over 1000"},
+    {NewConfig, &ConfigGroupBackend{GroupName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 2000}}, "groups/test/backends/test1: backend weight 2000 is over 1000"},
+    {NewConfig, &ConfigService{ServiceName: "test"}, ""},
+}
+
+func TestPolicy(t *testing.T) {
+    policy, err := PolicyConfig{FrontendPrefixes: "10.200.0.0/16, fd00::/8", MaxWeight: 1000}.Open()
+    if err != nil {
+        t.Fatalf("PolicyConfig.Open: %v", err)
+    }
+
+    for _, test := range testPolicy {
+        err := policy.Check(test.action, test.config)
+
+        if err == nil && test.error != "" {
+            t.Errorf("Check %s %s: no error", test.action, test.config.Path())
+        } else if err != nil && err.Error() != test.error {
+            t.Errorf("Check %s %s: %v", test.action, test.config.Path(), err)
+        }
+    }
+}
+
+func TestPolicyOpenError(t *testing.T) {
+    if _, err := (PolicyConfig{FrontendPrefixes: "10.200.0.0"}).Open(); err == nil {
+        t.Errorf("PolicyConfig.Open: no error for invalid prefix")
+    }
+}
+
+func TestPolicyWebhook(t *testing.T) {
+    var requests []PolicyRequest
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var request PolicyRequest
+
+        if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        requests = append(requests, request)
+
+        if request.Action == DelConfig {
+            http.Error(w, "no deletes", http.StatusForbidden)
+        } else {
+            w.WriteHeader(http.StatusNoContent)
+        }
+    }))
+    defer server.Close()
+
+    policy, err := PolicyConfig{WebhookURL: server.URL}.Open()
+    if err != nil {
+        t.Fatalf("PolicyConfig.Open: %v", err)
+    }
+
+    changes := []ApplyChange{
+        {Action: SetConfig, Node: Node{Path: "services/test", IsDir: true}},
+        {Action: SetConfig, Node: Node{Path: "services/test/backends/test1", Value: `{"ipv4":"10.1.0.1"}`}},
+    }
+
+    if err := policy.CheckChanges(changes); err != nil {
+        t.Errorf("CheckChanges: %v", err)
+    }
+
+    if len(requests) != 1 {
+        t.Errorf("webhook requests: %#v", requests)
+    } else if requests[0].Action != SetConfig || requests[0].Path != "services/test/backends/test1" {
+        t.Errorf("webhook request: %#v", requests[0])
+    }
+
+    delChanges := []ApplyChange{
+        {Action: DelConfig, Node: Node{Path: "services/test/backends/test1", Value: `{"ipv4":"10.1.0.1"}`}},
+    }
+
+    if err := policy.CheckChanges(delChanges); err == nil {
+        t.Errorf("CheckChanges: no error for rejected delete")
+    } else if err.Error() != "services/test/backends/test1: webhook: 403 Forbidden: no deletes" {
+        t.Errorf("CheckChanges: %v", err)
+    }
+}
+
+func TestPolicyAdmitScan(t *testing.T) {
+    statePath := filepath.Join(t.TempDir(), "policy.json")
+
+    policy, err := PolicyConfig{MaxWeight: 100, StatePath: statePath}.Open()
+    if err != nil {
+        t.Fatalf("PolicyConfig.Open: %v", err)
+    }
+
+    admitConfig := &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 10}}
+    rejectConfig := &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 200}}
+
+    if err := policy.Admit(NewConfig, admitConfig); err != nil {
+        t.Fatalf("Admit: %v", err)
+    }
+    if err := policy.Admit(SetConfig, rejectConfig); err == nil {
+        t.Fatalf("Admit: no error for rejected weight")
+    }
+
+    // a new daemon using the persisted state
+    restartPolicy, err := PolicyConfig{MaxWeight: 100, StatePath: statePath}.Open()
+    if err != nil {
+        t.Fatalf("PolicyConfig.Open: %v", err)
+    }
+
+    for _, p := range []*Policy{policy, restartPolicy} {
+        configs, err := p.AdmitScan([]Config{
+            &ConfigService{ServiceName: "test"},
+            rejectConfig,
+            &ConfigServiceBackend{ServiceName: "test", BackendName: "test2", Backend: ServiceBackend{IPv4: "10.1.0.2", Weight: 200}},
+        })
+
+        if err != nil {
+            t.Errorf("AdmitScan: %v", err)
+        } else if len(configs) != 2 {
+            t.Errorf("AdmitScan: %#v", configs)
+        } else if backendConfig, ok := configs[1].(*ConfigServiceBackend); !ok || backendConfig.Backend.Weight != 10 {
+            t.Errorf("AdmitScan: rejected config %#v", configs[1])
+        }
+    }
+
+    // an admitted delete forgets the previous config
+    if err := policy.Admit(DelConfig, &ConfigService{ServiceName: "test"}); err != nil {
+        t.Fatalf("Admit: %v", err)
+    }
+    if configs, err := policy.AdmitScan([]Config{rejectConfig}); err != nil {
+        t.Errorf("AdmitScan: %v", err)
+    } else if len(configs) != 0 {
+        t.Errorf("AdmitScan: deleted config %#v", configs)
+    }
+}
+
+// A dry run scan does not change the admitted configs or the state file
+func TestPolicyCheckScan(t *testing.T) {
+    statePath := filepath.Join(t.TempDir(), "policy.json")
+
+    policy, err := PolicyConfig{MaxWeight: 100, StatePath: statePath}.Open()
+    if err != nil {
+        t.Fatalf("PolicyConfig.Open: %v", err)
+    }
+
+    admitConfig := &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 10}}
+    rejectConfig := &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 200}}
+    newConfig := &ConfigServiceBackend{ServiceName: "test", BackendName: "test2", Backend: ServiceBackend{IPv4: "10.1.0.2", Weight: 10}}
+
+    if err := policy.Admit(NewConfig, admitConfig); err != nil {
+        t.Fatalf("Admit: %v", err)
+    }
+
+    if configs, err := policy.CheckScan([]Config{rejectConfig, newConfig}); err != nil {
+        t.Errorf("CheckScan: %v", err)
+    } else if len(configs) != 2 || configs[0] != admitConfig || configs[1] != newConfig {
+        t.Errorf("CheckScan: %#v", configs)
+    }
+
+    if configs, err := policy.CheckScan(nil); err != nil {
+        t.Errorf("CheckScan: %v", err)
+    } else if len(configs) != 0 {
+        t.Errorf("CheckScan: deleted config %#v", configs)
+    }
+
+    if len(policy.admitted) != 1 || policy.admitted[admitConfig.Path()] != admitConfig {
+        t.Errorf("CheckScan: admitted %#v", policy.admitted)
+    }
+
+    restartPolicy, err := PolicyConfig{MaxWeight: 100, StatePath: statePath}.Open()
+    if err != nil {
+        t.Fatalf("PolicyConfig.Open: %v", err)
+    } else if len(restartPolicy.admitted) != 1 {
+        t.Errorf("CheckScan: state %#v", restartPolicy.admitted)
+    }
+}
+
+// An unreachable webhook fails the scan, instead of skipping every config without a previously admitted config
+func TestPolicyAdmitScanWebhookError(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }))
+
+    policy, err := PolicyConfig{WebhookURL: server.URL}.Open()
+    if err != nil {
+        t.Fatalf("PolicyConfig.Open: %v", err)
+    }
+
+    admitConfig := &ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1", Weight: 10}}
+    newConfig := &ConfigServiceBackend{ServiceName: "test", BackendName: "test2", Backend: ServiceBackend{IPv4: "10.1.0.2", Weight: 10}}
+
+    if err := policy.Admit(NewConfig, admitConfig); err != nil {
+        t.Fatalf("Admit: %v", err)
+    }
+
+    server.Close()
+
+    if configs, err := policy.AdmitScan([]Config{admitConfig}); err != nil {
+        t.Errorf("AdmitScan: %v", err)
+    } else if len(configs) != 1 || configs[0] != admitConfig {
+        t.Errorf("AdmitScan: previous config %#v", configs)
+    }
+
+    if configs, err := policy.AdmitScan([]Config{admitConfig, newConfig}); err == nil {
+        t.Errorf("AdmitScan: no error for unreachable webhook: %#v", configs)
+    } else if errs.Classify(err) != errs.Backend {
+        t.Errorf("AdmitScan: %v", err)
+    }
+}
@@ -0,0 +1,80 @@
+package config
+/*
+ * Lists of source IP prefixes for frontend filtering.
+ */
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "strings"
+)
+
+// List of IP prefixes, encoded as a JSON list of CIDR prefixes or plain addresses.
+//
+// Uses a comma-separated string rather than a slice, so that the ServiceFrontend remains comparable.
+type Prefixes string
+
+// Parse a CIDR prefix, or a plain address as a single-address prefix
+func parsePrefix(prefix string) (*net.IPNet, error) {
+    if strings.Contains(prefix, "/") {
+        _, ipNet, err := net.ParseCIDR(prefix)
+
+        return ipNet, err
+
+    } else if ip := net.ParseIP(prefix); ip == nil {
+        return nil, fmt.Errorf("Invalid prefix: %#v", prefix)
+
+    } else if ip4 := ip.To4(); ip4 != nil {
+        return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+
+    } else {
+        return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+    }
+}
+
+func (self Prefixes) Strings() []string {
+    if self == "" {
+        return nil
+    }
+
+    return strings.Split(string(self), ",")
+}
+
+func (self Prefixes) Parse() ([]*net.IPNet, error) {
+    var ipNets []*net.IPNet
+
+    for _, prefix := range self.Strings() {
+        if ipNet, err := parsePrefix(prefix); err != nil {
+            return nil, err
+        } else {
+            ipNets = append(ipNets, ipNet)
+        }
+    }
+
+    return ipNets, nil
+}
+
+func (self Prefixes) MarshalJSON() ([]byte, error) {
+    return json.Marshal(self.Strings())
+}
+
+func (self *Prefixes) UnmarshalJSON(buf []byte) error {
+    var prefixes []string
+
+    if err := json.Unmarshal(buf, &prefixes); err != nil {
+        return err
+    }
+
+    for i, prefix := range prefixes {
+        if ipNet, err := parsePrefix(strings.TrimSpace(prefix)); err != nil {
+            return err
+        } else {
+            prefixes[i] = ipNet.String()
+        }
+    }
+
+    *self = Prefixes(strings.Join(prefixes, ","))
+
+    return nil
+}
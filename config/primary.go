@@ -0,0 +1,74 @@
+package config
+/*
+ * Primary election for failover services, with all backends drained except for the single primary.
+ */
+
+import (
+    "fmt"
+    "log"
+    "strings"
+)
+
+type PrimaryConfig struct {
+    // Check if the backend is the primary
+    Primary     func(config ConfigServiceBackend) error
+}
+
+/*
+ * Check each backend, and drain all backends except for the single primary backend.
+ *
+ * Makes no changes unless exactly one backend is the primary, so that a failed check or split-brain keeps the current primary.
+ *
+ * Returns the name of the primary backend.
+ */
+func (self PrimaryConfig) Update(publisher Publisher, backends []ConfigServiceBackend) (string, error) {
+    var primaries []string
+    var primaryName string
+
+    for _, backendConfig := range backends {
+        if err := self.Primary(backendConfig); err != nil {
+            log.Printf("config:Primary %s/%s: not primary: %v\n", backendConfig.ServiceName, backendConfig.BackendName, err)
+        } else {
+            primaries = append(primaries, backendConfig.BackendName)
+        }
+    }
+
+    if len(primaries) == 0 {
+        return "", fmt.Errorf("No primary backend")
+    } else if len(primaries) > 1 {
+        return "", fmt.Errorf("Multiple primary backends: %s", strings.Join(primaries, " "))
+    } else {
+        primaryName = primaries[0]
+    }
+
+    // undrain the new primary before draining the others, to avoid having zero backends
+    for _, backendConfig := range backends {
+        if backendConfig.BackendName != primaryName || !backendConfig.Backend.Drain {
+            continue
+        }
+
+        backendConfig.Backend.Drain = false
+
+        log.Printf("config:Primary %s/%s: undrain primary\n", backendConfig.ServiceName, backendConfig.BackendName)
+
+        if err := publisher.Publish(backendConfig); err != nil {
+            return primaryName, fmt.Errorf("undrain %s: %v", backendConfig.BackendName, err)
+        }
+    }
+
+    for _, backendConfig := range backends {
+        if backendConfig.BackendName == primaryName || backendConfig.Backend.Drain {
+            continue
+        }
+
+        backendConfig.Backend.Drain = true
+
+        log.Printf("config:Primary %s/%s: drain\n", backendConfig.ServiceName, backendConfig.BackendName)
+
+        if err := publisher.Publish(backendConfig); err != nil {
+            return primaryName, fmt.Errorf("drain %s: %v", backendConfig.BackendName, err)
+        }
+    }
+
+    return primaryName, nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestPrimary(t *testing.T) {
+    backends := []ConfigServiceBackend{
+        {ServiceName: "test", BackendName: "test1", Backend: ServiceBackend{IPv4: "10.1.0.1"}},
+        {ServiceName: "test", BackendName: "test2", Backend: ServiceBackend{IPv4: "10.1.0.2", Drain: true}},
+        {ServiceName: "test", BackendName: "test3", Backend: ServiceBackend{IPv4: "10.1.0.3", Drain: true}},
+    }
+
+    tests := []struct{
+        primaries   map[string]bool
+        primary     string
+        error       string
+        log         []string
+    }{
+        {
+            primaries:  map[string]bool{"test1": true},
+            primary:    "test1",
+        },
+        {
+            primaries:  map[string]bool{"test2": true},
+            primary:    "test2",
+            log:        []string{"publish test2 drain=false", "publish test1 drain=true"},
+        },
+        {
+            primaries:  map[string]bool{},
+            error:      "No primary backend",
+        },
+        {
+            primaries:  map[string]bool{"test1": true, "test3": true},
+            error:      "Multiple primary backends: test1 test3",
+        },
+    }
+
+    for _, test := range tests {
+        publisher := &testPublisher{}
+        primaryConfig := PrimaryConfig{
+            Primary: func(config ConfigServiceBackend) error {
+                if test.primaries[config.BackendName] {
+                    return nil
+                } else {
+                    return fmt.Errorf("replica")
+                }
+            },
+        }
+
+        primary, err := primaryConfig.Update(publisher, backends)
+
+        if err != nil && err.Error() != test.error {
+            t.Errorf("Primary %v: %v", test.primaries, err)
+        } else if err == nil && test.error != "" {
+            t.Errorf("Primary %v: no error", test.primaries)
+        } else if primary != test.primary {
+            t.Errorf("Primary %v: %v != %v", test.primaries, primary, test.primary)
+        }
+
+        if fmt.Sprintf("%v", publisher.log) != fmt.Sprintf("%v", test.log) {
+            t.Errorf("Primary %v: publish %v != %v", test.primaries, publisher.log, test.log)
+        }
+    }
+}
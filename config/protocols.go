@@ -0,0 +1,142 @@
+package config
+/*
+ * Frontends and backends using the same port for multiple protocols.
+ */
+
+import (
+    "encoding/json"
+    "fmt"
+)
+
+// Set of protocols, encoded as a JSON list of protocol names.
+//
+// Uses a bitmask rather than a slice, so that the ServiceFrontend remains comparable.
+type Protocols uint
+
+const (
+    ProtocolTCP Protocols = 1 << iota
+    ProtocolUDP
+    ProtocolSCTP
+)
+
+var protocolNames = []struct{
+    protocol    Protocols
+    name        string
+}{
+    { ProtocolTCP,  "tcp" },
+    { ProtocolUDP,  "udp" },
+    { ProtocolSCTP, "sctp" },
+}
+
+func (self Protocols) Names() []string {
+    var names []string
+
+    for _, protocolName := range protocolNames {
+        if self & protocolName.protocol != 0 {
+            names = append(names, protocolName.name)
+        }
+    }
+
+    return names
+}
+
+func (self Protocols) MarshalJSON() ([]byte, error) {
+    return json.Marshal(self.Names())
+}
+
+func (self *Protocols) UnmarshalJSON(buf []byte) error {
+    var names []string
+    var protocols Protocols
+
+    if err := json.Unmarshal(buf, &names); err != nil {
+        return err
+    }
+
+    for _, name := range names {
+        var protocol Protocols
+
+        for _, protocolName := range protocolNames {
+            if protocolName.name == name {
+                protocol = protocolName.protocol
+            }
+        }
+
+        if protocol == 0 {
+            return fmt.Errorf("Invalid protocol: %#v", name)
+        }
+
+        protocols |= protocol
+    }
+
+    *self = protocols
+
+    return nil
+}
+
+// Expand the port for each of the protocols into the per-protocol ports.
+func (self *ServiceFrontend) expandPort() error {
+    protocols := self.Protocols
+
+    if self.Port == 0 {
+        if protocols != 0 {
+            return fmt.Errorf("protocols given without a port")
+        }
+
+        return nil
+    }
+
+    if protocols == 0 {
+        protocols = ProtocolTCP
+    }
+
+    if protocols & ProtocolTCP == 0 {
+
+    } else if self.TCP != 0 && self.TCP != self.Port {
+        return fmt.Errorf("conflicting tcp=%d and port=%d", self.TCP, self.Port)
+    } else {
+        self.TCP = self.Port
+    }
+
+    if protocols & ProtocolUDP == 0 {
+
+    } else if self.UDP != 0 && self.UDP != self.Port {
+        return fmt.Errorf("conflicting udp=%d and port=%d", self.UDP, self.Port)
+    } else {
+        self.UDP = self.Port
+    }
+
+    if protocols & ProtocolSCTP == 0 {
+
+    } else if self.SCTP != 0 && self.SCTP != self.Port {
+        return fmt.Errorf("conflicting sctp=%d and port=%d", self.SCTP, self.Port)
+    } else {
+        self.SCTP = self.Port
+    }
+
+    return nil
+}
+
+// Use the port for any of the backend protocols without their own port.
+func (self *ServiceBackend) expandPort() error {
+    protocols := self.Protocols
+
+    if self.Port == 0 {
+        return nil
+    }
+
+    if protocols == 0 {
+        protocols = ProtocolTCP | ProtocolUDP | ProtocolSCTP
+    }
+
+    if protocols & ProtocolTCP != 0 && self.TCP == 0 {
+        self.TCP = self.Port
+    }
+    if protocols & ProtocolUDP != 0 && self.UDP == 0 {
+        self.UDP = self.Port
+    }
+    if protocols & ProtocolSCTP != 0 && self.SCTP == 0 {
+        self.SCTP = self.Port
+    }
+
+    return nil
+}
@@ -0,0 +1,148 @@
+package config
+/*
+ * Record the raw stream of config events to disk, for replaying them offline to reproduce bugs.
+ *
+ * Each record is written as a line of JSON. The record file is rotated once it grows over the MaxSize, keeping one previous file.
+ */
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+const RECORD_MAX_SIZE = 10 * 1000 * 1000
+
+type RecordConfig struct {
+    Path        string
+    MaxSize     int64   // rotate to Path.1 once over the given size in bytes; default RECORD_MAX_SIZE
+}
+
+type Record struct {
+    Time    time.Time       `json:"time"`
+    Action  Action          `json:"action"`
+    Path    string          `json:"path"`
+    IsDir   bool            `json:"dir,omitempty"`
+    Value   string          `json:"value,omitempty"`
+    Source  ConfigSource    `json:"source,omitempty"`
+}
+
+// Return the config event for the record
+func (self Record) Event() (*Event, error) {
+    return syncEvent(self.Action, Node{Path: self.Path, IsDir: self.IsDir, Value: self.Value, Source: self.Source})
+}
+
+type Recorder struct {
+    config  RecordConfig
+
+    mutex   sync.Mutex
+    file    *os.File
+    size    int64
+}
+
+func (self RecordConfig) Open() (*Recorder, error) {
+    recorder := &Recorder{config: self}
+
+    if recorder.config.MaxSize == 0 {
+        recorder.config.MaxSize = RECORD_MAX_SIZE
+    }
+
+    if err := recorder.open(); err != nil {
+        return nil, err
+    }
+
+    return recorder, nil
+}
+
+func (self *Recorder) String() string {
+    return self.config.Path
+}
+
+func (self *Recorder) open() error {
+    if file, err := os.OpenFile(self.config.Path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600); err != nil {
+        return err
+    } else if stat, err := file.Stat(); err != nil {
+        file.Close()
+        return err
+    } else {
+        self.file = file
+        self.size = stat.Size()
+    }
+
+    return nil
+}
+
+// Replace any previous rotated file, and start a new file
+func (self *Recorder) rotate() error {
+    if err := self.file.Close(); err != nil {
+        return err
+    } else if err := os.Rename(self.config.Path, self.config.Path + ".1"); err != nil {
+        return err
+    }
+
+    log.Printf("config:Recorder %s: rotate at %d bytes\n", self.config.Path, self.size)
+
+    return self.open()
+}
+
+// Record a raw config node, as received from the config backend
+func (self *Recorder) Record(action Action, node Node) error {
+    record := Record{
+        Time:   time.Now(),
+        Action: action,
+        Path:   node.Path,
+        IsDir:  node.IsDir,
+        Value:  node.Value,
+        Source: node.Source,
+    }
+
+    buf, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    buf = append(buf, '\n')
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.size > 0 && self.size + int64(len(buf)) > self.config.MaxSize {
+        if err := self.rotate(); err != nil {
+            return err
+        }
+    }
+
+    n, err := self.file.Write(buf)
+    self.size += int64(n)
+
+    return err
+}
+
+func (self *Recorder) Close() error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.file.Close()
+}
+
+// Read each record in order
+func ReadRecords(reader io.Reader, handler func(Record) error) error {
+    scanner := bufio.NewScanner(reader)
+    scanner.Buffer(nil, 1024 * 1024)
+
+    for line := 1; scanner.Scan(); line++ {
+        var record Record
+
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            return fmt.Errorf("line %d: %v", line, err)
+        } else if err := handler(record); err != nil {
+            return fmt.Errorf("line %d: %v", line, err)
+        }
+    }
+
+    return scanner.Err()
+}
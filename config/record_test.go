@@ -0,0 +1,85 @@
+package config
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+var testRecordNodes = []struct{
+    action  Action
+    node    Node
+}{
+    {NewConfig, Node{Path: "services", IsDir: true, Source: EtcdConfigSource}},
+    {NewConfig, Node{Path: "services/test/frontend", Value: `{"ipv4": "10.0.1.1", "tcp": 80}`, Source: EtcdConfigSource}},
+    {SetConfig, Node{Path: "services/test/backends/test1", Value: `{"ipv4": "10.1.0.1", "tcp": 80}`}},
+    {DelConfig, Node{Path: "services/test/backends/test1"}},
+}
+
+func TestRecorder(t *testing.T) {
+    dir, err := ioutil.TempDir("", "clusterf-record")
+    if err != nil {
+        t.Fatalf("ioutil.TempDir: %v", err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "record")
+
+    // small enough to rotate after the first two records
+    recorder, err := RecordConfig{Path: path, MaxSize: 300}.Open()
+    if err != nil {
+        t.Fatalf("RecordConfig.Open: %v", err)
+    }
+
+    for _, test := range testRecordNodes {
+        if err := recorder.Record(test.action, test.node); err != nil {
+            t.Fatalf("Recorder.Record %v: %v", test.node, err)
+        }
+    }
+
+    if err := recorder.Close(); err != nil {
+        t.Fatalf("Recorder.Close: %v", err)
+    }
+
+    var events []Event
+
+    for _, readPath := range []string{path + ".1", path} {
+        file, err := os.Open(readPath)
+        if err != nil {
+            t.Fatalf("os.Open: %v", err)
+        }
+        defer file.Close()
+
+        if stat, err := file.Stat(); err != nil {
+            t.Fatalf("os.Stat: %v", err)
+        } else if stat.Size() > 300 {
+            t.Errorf("%s: size %d is over the limit", readPath, stat.Size())
+        }
+
+        if err := ReadRecords(file, func(record Record) error {
+            if event, err := record.Event(); err != nil {
+                return err
+            } else if event != nil {
+                events = append(events, *event)
+            }
+            return nil
+        }); err != nil {
+            t.Fatalf("ReadRecords %s: %v", readPath, err)
+        }
+    }
+
+    if len(events) != len(testRecordNodes) {
+        t.Fatalf("ReadRecords: %d events", len(events))
+    }
+
+    if frontendConfig, ok := events[1].Config.(*ConfigServiceFrontend); !ok || events[1].Action != NewConfig || frontendConfig.Frontend.IPv4 != "10.0.1.1" {
+        t.Errorf("ReadRecords frontend: %#v", events[1])
+    }
+    if backendConfig, ok := events[2].Config.(*ConfigServiceBackend); !ok || events[2].Action != SetConfig || backendConfig.Backend.IPv4 != "10.1.0.1" {
+        t.Errorf("ReadRecords backend: %#v", events[2])
+    }
+    if backendConfig, ok := events[3].Config.(*ConfigServiceBackend); !ok || events[3].Action != DelConfig || backendConfig.BackendName != "test1" {
+        t.Errorf("ReadRecords delete: %#v", events[3])
+    }
+}
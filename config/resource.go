@@ -0,0 +1,294 @@
+package config
+/*
+ * Stable CRUD API for the service, server and route resources, for managing the config tree from infrastructure-as-code tools,
+ * e.g. a Terraform provider.
+ *
+ * Each resource has a consistent ID given by its config path: services/$service for the service frontend,
+ * services/$service/backends/$backend for each server, and routes/$route for each route. The values are the ServiceFrontend,
+ * ServiceBackend and Route JSON, re-encoded in a canonical form, so that reading a resource returns the same value as written.
+ *
+ * Writes are idempotent: putting the same value again does not write anything, and deleting a missing resource is not an error.
+ * Deleting a service only removes its frontend, and any servers must be deleted separately.
+ */
+
+import (
+    "bytes"
+    "github.com/qmsk/clusterf/errs"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// Returned by Get for any missing resource, and for listing the servers of a missing service
+var ErrResourceNotFound = errors.New("resource not found")
+
+type ResourceType string
+
+const (
+    ServiceResource     ResourceType    = "service"
+    ServerResource      ResourceType    = "server"
+    RouteResource       ResourceType    = "route"
+)
+
+type Resource struct {
+    ID          string          `json:"id"`
+    Type        ResourceType    `json:"type"`
+    Value       json.RawMessage `json:"value"`
+}
+
+// Read and write raw nodes, implemented by Etcd
+type NodeStore interface {
+    Nodes() ([]Node, error)
+    NodeWriter
+}
+
+type Resources struct {
+    store       NodeStore
+    policy      *Policy
+}
+
+// Manage the resources in the store, checking any changes against the optional policy
+func NewResources(store NodeStore, policy *Policy) *Resources {
+    return &Resources{store: store, policy: policy}
+}
+
+// Return the resource type and config node path for the resource ID
+func resourcePath(id string) (ResourceType, string, error) {
+    parts := strings.Split(id, "/")
+
+    for _, part := range parts {
+        if part == "" {
+            return "", "", errs.ConfigError(fmt.Errorf("Invalid resource ID: %#v", id))
+        }
+    }
+
+    if len(parts) == 2 && parts[0] == "services" {
+        return ServiceResource, makePath("services", parts[1], "frontend"), nil
+    } else if len(parts) == 4 && parts[0] == "services" && parts[2] == "backends" {
+        return ServerResource, id, nil
+    } else if len(parts) == 2 && parts[0] == "routes" {
+        return RouteResource, id, nil
+    } else {
+        return "", "", errs.ConfigError(fmt.Errorf("Invalid resource ID: %#v", id))
+    }
+}
+
+// Return the resource ID for the config node path, or empty if the node is not a resource
+func resourceID(path string) string {
+    parts := strings.Split(path, "/")
+
+    if len(parts) == 3 && parts[0] == "services" && parts[2] == "frontend" {
+        return makePath("services", parts[1])
+    } else if len(parts) == 4 && parts[0] == "services" && parts[2] == "backends" {
+        return path
+    } else if len(parts) == 2 && parts[0] == "routes" {
+        return path
+    } else {
+        return ""
+    }
+}
+
+// Return the service name of a service or server resource ID, or empty for a route resource or an invalid ID
+func ResourceServiceName(id string) string {
+    if resourceType, _, err := resourcePath(id); err != nil || resourceType == RouteResource {
+        return ""
+    } else {
+        return strings.Split(id, "/")[1]
+    }
+}
+
+// Decode the JSON value for the resource type, refusing any unknown fields, and return it in the canonical form
+func resourceValue(resourceType ResourceType, value []byte) (json.RawMessage, error) {
+    var object interface{}
+
+    switch resourceType {
+    case ServiceResource:
+        object = &ServiceFrontend{}
+    case ServerResource:
+        object = &ServiceBackend{}
+    case RouteResource:
+        object = &Route{}
+    default:
+        return nil, fmt.Errorf("Invalid resource type: %v", resourceType)
+    }
+
+    decoder := json.NewDecoder(bytes.NewReader(value))
+    decoder.DisallowUnknownFields()
+
+    if err := decoder.Decode(object); err != nil {
+        return nil, err
+    } else if jsonValue, err := json.Marshal(object); err != nil {
+        return nil, err
+    } else {
+        return json.RawMessage(jsonValue), nil
+    }
+}
+
+// Return the resource for the node, or nil if the node is not a resource
+func loadResource(node Node) (*Resource, error) {
+    id := resourceID(node.Path)
+
+    if node.IsDir || id == "" {
+        return nil, nil
+    } else if resourceType, _, err := resourcePath(id); err != nil {
+        return nil, nil
+    } else if value, err := resourceValue(resourceType, []byte(node.Value)); err != nil {
+        return nil, errs.ConfigError(fmt.Errorf("%s: invalid existing value: %v", node.Path, err))
+    } else {
+        return &Resource{ID: id, Type: resourceType, Value: value}, nil
+    }
+}
+
+// Return the existing node at the path, if any
+func (self *Resources) node(path string) (*Node, error) {
+    nodes, err := self.store.Nodes()
+    if err != nil {
+        return nil, err
+    }
+
+    for _, node := range nodes {
+        if node.Path == path && !node.IsDir {
+            return &node, nil
+        }
+    }
+
+    return nil, nil
+}
+
+// Return the resource, failing with ErrResourceNotFound if it does not exist
+func (self *Resources) Get(id string) (Resource, error) {
+    if _, path, err := resourcePath(id); err != nil {
+        return Resource{}, err
+    } else if node, err := self.node(path); err != nil {
+        return Resource{}, err
+    } else if node == nil {
+        return Resource{}, fmt.Errorf("%s: %w", id, ErrResourceNotFound)
+    } else if resource, err := loadResource(*node); err != nil {
+        return Resource{}, err
+    } else {
+        return *resource, nil
+    }
+}
+
+/*
+ * Return the resources in the collection, sorted by ID.
+ *
+ * The collection is either services, routes or services/$service/backends, failing with ErrResourceNotFound if the service has no
+ * frontend. Any invalid existing values are skipped.
+ */
+func (self *Resources) List(collection string) ([]Resource, error) {
+    var resources = make([]Resource, 0)
+    var serviceExists bool
+
+    parts := strings.Split(collection, "/")
+
+    if collection == "services" || collection == "routes" {
+
+    } else if len(parts) == 3 && parts[0] == "services" && parts[1] != "" && parts[2] == "backends" {
+
+    } else {
+        return nil, errs.ConfigError(fmt.Errorf("Invalid resource collection: %#v", collection))
+    }
+
+    nodes, err := self.store.Nodes()
+    if err != nil {
+        return nil, err
+    }
+
+    for _, node := range nodes {
+        if len(parts) == 3 && node.Path == makePath("services", parts[1], "frontend") {
+            serviceExists = true
+        }
+
+        if resource, err := loadResource(node); err != nil {
+            continue
+        } else if resource == nil {
+
+        } else if strings.HasPrefix(resource.ID, collection + "/") && !strings.Contains(strings.TrimPrefix(resource.ID, collection + "/"), "/") {
+            resources = append(resources, *resource)
+        }
+    }
+
+    if len(parts) == 3 && !serviceExists {
+        return nil, fmt.Errorf("%s: %w", makePath(parts[0], parts[1]), ErrResourceNotFound)
+    }
+
+    sort.Slice(resources, func(i, j int) bool { return resources[i].ID < resources[j].ID })
+
+    return resources, nil
+}
+
+// Create or replace the resource with the given JSON value, returning the resource and whether it was changed.
+//
+// Any fields not given in the value are reset to their defaults, unlike the merged ApplyConfig.
+func (self *Resources) Put(id string, value []byte) (Resource, bool, error) {
+    resourceType, path, err := resourcePath(id)
+    if err != nil {
+        return Resource{}, false, err
+    }
+
+    resource := Resource{ID: id, Type: resourceType}
+
+    if resource.Value, err = resourceValue(resourceType, value); err != nil {
+        return resource, false, errs.ConfigError(fmt.Errorf("%s: %v", id, err))
+    }
+
+    change := ApplyChange{Action: SetConfig, Node: Node{Path: path, Value: string(resource.Value)}}
+
+    if _, err := syncConfig(change.Node); err != nil {
+        return resource, false, err
+    }
+
+    if node, err := self.node(path); err != nil {
+        return resource, false, err
+    } else if node == nil {
+
+    } else if existing, err := loadResource(*node); err != nil {
+        // replace any invalid existing value
+    } else if bytes.Equal(existing.Value, resource.Value) {
+        return resource, false, nil
+    }
+
+    if self.policy == nil {
+
+    } else if err := self.policy.CheckChanges([]ApplyChange{change}); err != nil {
+        return resource, false, err
+    }
+
+    if err := Apply(self.store, []ApplyChange{change}); err != nil {
+        return resource, false, err
+    }
+
+    return resource, true, nil
+}
+
+// Delete the resource, returning whether it existed
+func (self *Resources) Delete(id string) (bool, error) {
+    _, path, err := resourcePath(id)
+    if err != nil {
+        return false, err
+    }
+
+    node, err := self.node(path)
+    if err != nil {
+        return false, err
+    } else if node == nil {
+        return false, nil
+    }
+
+    change := ApplyChange{Action: DelConfig, Node: *node}
+
+    if self.policy == nil {
+
+    } else if err := self.policy.CheckChanges([]ApplyChange{change}); err != nil {
+        return false, err
+    }
+
+    if err := Apply(self.store, []ApplyChange{change}); err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
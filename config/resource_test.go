@@ -0,0 +1,135 @@
+package config
+
+import (
+    "errors"
+    "github.com/qmsk/clusterf/errs"
+    "sort"
+    "testing"
+)
+
+// In-memory node store, counting the writes
+type testNodeStore struct {
+    nodes   map[string]string
+    writes  int
+}
+
+func (self *testNodeStore) Nodes() (nodes []Node, err error) {
+    for path, value := range self.nodes {
+        nodes = append(nodes, Node{Path: path, Value: value})
+    }
+
+    sort.Slice(nodes, func(i, j int) bool { return nodes[i].Path < nodes[j].Path })
+
+    return nodes, nil
+}
+
+func (self *testNodeStore) Put(node Node) error {
+    self.nodes[node.Path] = node.Value
+    self.writes++
+
+    return nil
+}
+
+func (self *testNodeStore) Remove(node Node) error {
+    delete(self.nodes, node.Path)
+    self.writes++
+
+    return nil
+}
+
+func TestResources(t *testing.T) {
+    store := &testNodeStore{nodes: map[string]string{
+        "services/test/frontend":       `{"ipv4":"10.0.1.1","tcp":80}`,
+        "services/test/backends/test1": `{"ipv4":"10.1.0.1","tcp":8080}`,
+        "services/test/shift":          `{}`,
+        "routes/test":                  `{"Prefix4":"10.1.0.0/24","IpvsMethod":"droute"}`,
+        "routes/invalid":               `{"Prefix4":24}`,
+    }}
+    resources := NewResources(store, nil)
+
+    // canonical values
+    if resource, err := resources.Get("services/test"); err != nil {
+        t.Errorf("Get service: %v", err)
+    } else if resource.Type != ServiceResource || string(resource.Value) != `{"ipv4":"10.0.1.1","tcp":80}` {
+        t.Errorf("Get service: %#v", resource)
+    }
+    if resource, err := resources.Get("routes/test"); err != nil {
+        t.Errorf("Get route: %v", err)
+    } else if resource.Type != RouteResource || string(resource.Value) != `{"Prefix4":"10.1.0.0/24","Gateway4":"","IpvsMethod":"droute"}` {
+        t.Errorf("Get route: %#v", resource)
+    }
+
+    if _, err := resources.Get("services/other"); !errors.Is(err, ErrResourceNotFound) {
+        t.Errorf("Get missing: %v", err)
+    }
+    if _, err := resources.Get("routes/invalid"); errs.Classify(err) != errs.Config {
+        t.Errorf("Get invalid: %v", err)
+    }
+
+    // idempotent create
+    if resource, changed, err := resources.Put("services/test/backends/test2", []byte(`{"tcp": 8080, "ipv4": "10.1.0.2"}`)); err != nil || !changed {
+        t.Errorf("Put server: %v %v", changed, err)
+    } else if resource.ID != "services/test/backends/test2" || string(resource.Value) != `{"ipv4":"10.1.0.2","tcp":8080}` {
+        t.Errorf("Put server: %#v", resource)
+    }
+    if _, changed, err := resources.Put("services/test/backends/test2", []byte(`{"ipv4":"10.1.0.2","tcp":8080}`)); err != nil || changed {
+        t.Errorf("Put server again: %v %v", changed, err)
+    }
+    if store.writes != 1 {
+        t.Errorf("Put writes: %d", store.writes)
+    }
+
+    if _, _, err := resources.Put("services/test", []byte(`{"ipv4":"10.0.1.1","tpc":80}`)); errs.Classify(err) != errs.Config {
+        t.Errorf("Put unknown field: %v", err)
+    }
+    if _, _, err := resources.Put("services/test/backends/test2", []byte(`{"ipv4":"10.1.0.2","protocols":["icmp"]}`)); errs.Classify(err) != errs.Config {
+        t.Errorf("Put invalid: %v", err)
+    }
+
+    if list, err := resources.List("services/test/backends"); err != nil {
+        t.Errorf("List servers: %v", err)
+    } else if len(list) != 2 || list[0].ID != "services/test/backends/test1" || list[1].ID != "services/test/backends/test2" {
+        t.Errorf("List servers: %v", list)
+    }
+    if list, err := resources.List("services"); err != nil || len(list) != 1 || list[0].ID != "services/test" {
+        t.Errorf("List services: %v %v", list, err)
+    }
+    if list, err := resources.List("routes"); err != nil || len(list) != 1 || list[0].ID != "routes/test" {
+        t.Errorf("List routes: %v %v", list, err)
+    }
+    if _, err := resources.List("services/other/backends"); !errors.Is(err, ErrResourceNotFound) {
+        t.Errorf("List missing servers: %v", err)
+    }
+
+    // idempotent delete
+    if deleted, err := resources.Delete("services/test/backends/test1"); err != nil || !deleted {
+        t.Errorf("Delete server: %v %v", deleted, err)
+    }
+    if deleted, err := resources.Delete("services/test/backends/test1"); err != nil || deleted {
+        t.Errorf("Delete server again: %v %v", deleted, err)
+    }
+    if _, exists := store.nodes["services/test/backends/test1"]; exists {
+        t.Errorf("Delete server: %v", store.nodes)
+    }
+
+    for _, id := range []string{"", "services", "services/", "services/test/frontend", "groups/test", "services/test/backends/test1/x"} {
+        if _, err := resources.Get(id); errs.Classify(err) != errs.Config || errors.Is(err, ErrResourceNotFound) {
+            t.Errorf("Get %#v: %v", id, err)
+        }
+    }
+}
+
+func TestResourceServiceName(t *testing.T) {
+    for id, serviceName := range map[string]string{
+        "services/team-a-web":                  "team-a-web",
+        "services/team-a-web/backends/web1":    "team-a-web",
+        "routes/test":                          "",
+        "services/team-a-web/frontend":         "",
+        "services//backends/web1":             "",
+        "":                                     "",
+    } {
+        if name := ResourceServiceName(id); name != serviceName {
+            t.Errorf("ResourceServiceName %#v: %#v", id, name)
+        }
+    }
+}
@@ -0,0 +1,140 @@
+package config
+/*
+ * Rolling restarts of service backends, one at a time.
+ */
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "time"
+)
+
+// Publish configs, implemented by Etcd
+type Publisher interface {
+    Publish(config Config) error
+}
+
+type RollingConfig struct {
+    // Time to wait for existing connections after draining each backend
+    DrainTime       time.Duration
+
+    // Maximum time to wait for each restarted backend to become healthy
+    HealthTimeout   time.Duration
+    HealthInterval  time.Duration   // default: 1s
+
+    // Restart the drained backend; optional
+    Restart         func(config ConfigServiceBackend) error
+
+    // Check if the restarted backend is healthy; optional
+    Health          func(config ConfigServiceBackend) error
+
+    // used for testing
+    sleep           func(time.Duration)
+}
+
+type rollingBackends []ConfigServiceBackend
+
+func (self rollingBackends) Len() int           { return len(self) }
+func (self rollingBackends) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self rollingBackends) Less(i, j int) bool { return self[i].BackendName < self[j].BackendName }
+
+// Return the backends for the named service, in the order they are restarted
+func RollingBackends(configs []Config, serviceName string) []ConfigServiceBackend {
+    var backends rollingBackends
+
+    for _, config := range configs {
+        if backendConfig, ok := config.(*ConfigServiceBackend); !ok {
+
+        } else if backendConfig.ServiceName == serviceName && backendConfig.BackendName != "" {
+            backends = append(backends, *backendConfig)
+        }
+    }
+
+    sort.Sort(backends)
+
+    return backends
+}
+
+/*
+ * Drain, restart and undrain each backend in turn, waiting for the backend to become healthy before continuing with the next one.
+ *
+ * Only a single backend is ever drained at a time, which limits the connections remapped by any sh/mh scheduled services to that backend.
+ *
+ * Any backends that are already drained are skipped. Stops on the first error, leaving the failed backend drained.
+ */
+func (self RollingConfig) Run(publisher Publisher, backends []ConfigServiceBackend) error {
+    if self.sleep == nil {
+        self.sleep = time.Sleep
+    }
+    if self.HealthInterval == 0 {
+        self.HealthInterval = 1 * time.Second
+    }
+
+    for _, backendConfig := range backends {
+        if backendConfig.Backend.Drain {
+            log.Printf("config:Rolling %s/%s: skip drained\n", backendConfig.ServiceName, backendConfig.BackendName)
+            continue
+        }
+
+        if err := self.rollBackend(publisher, backendConfig); err != nil {
+            return fmt.Errorf("%s/%s: %v", backendConfig.ServiceName, backendConfig.BackendName, err)
+        }
+    }
+
+    return nil
+}
+
+func (self RollingConfig) rollBackend(publisher Publisher, backendConfig ConfigServiceBackend) error {
+    drainConfig := backendConfig
+    drainConfig.Backend.Drain = true
+
+    log.Printf("config:Rolling %s/%s: drain\n", backendConfig.ServiceName, backendConfig.BackendName)
+
+    if err := publisher.Publish(drainConfig); err != nil {
+        return fmt.Errorf("drain: %v", err)
+    }
+
+    self.sleep(self.DrainTime)
+
+    if self.Restart == nil {
+
+    } else if err := self.Restart(backendConfig); err != nil {
+        return fmt.Errorf("restart: %v", err)
+    } else {
+        log.Printf("config:Rolling %s/%s: restarted\n", backendConfig.ServiceName, backendConfig.BackendName)
+    }
+
+    if err := self.waitHealth(backendConfig); err != nil {
+        return fmt.Errorf("health: %v", err)
+    }
+
+    log.Printf("config:Rolling %s/%s: undrain\n", backendConfig.ServiceName, backendConfig.BackendName)
+
+    if err := publisher.Publish(backendConfig); err != nil {
+        return fmt.Errorf("undrain: %v", err)
+    }
+
+    return nil
+}
+
+func (self RollingConfig) waitHealth(backendConfig ConfigServiceBackend) error {
+    var waited time.Duration
+
+    if self.Health == nil {
+        return nil
+    }
+
+    for {
+        if err := self.Health(backendConfig); err == nil {
+            return nil
+        } else if waited >= self.HealthTimeout {
+            return err
+        } else {
+            log.Printf("config:Rolling %s/%s: unhealthy: %v\n", backendConfig.ServiceName, backendConfig.BackendName, err)
+        }
+
+        self.sleep(self.HealthInterval)
+        waited += self.HealthInterval
+    }
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+type testPublisher struct {
+    log     []string
+}
+
+func (self *testPublisher) Publish(config Config) error {
+    backendConfig := config.(ConfigServiceBackend)
+
+    self.log = append(self.log, fmt.Sprintf("publish %s drain=%v", backendConfig.BackendName, backendConfig.Backend.Drain))
+
+    return nil
+}
+
+func TestRollingBackends(t *testing.T) {
+    configs := []Config{
+        &ConfigServiceFrontend{ServiceName: "test"},
+        &ConfigServiceBackend{ServiceName: "test", BackendName: "test2"},
+        &ConfigServiceBackend{ServiceName: "other", BackendName: "other1"},
+        &ConfigServiceBackend{ServiceName: "test", BackendName: "test1"},
+        &ConfigServiceBackend{ServiceName: "test"},
+    }
+
+    backends := RollingBackends(configs, "test")
+
+    if len(backends) != 2 || backends[0].BackendName != "test1" || backends[1].BackendName != "test2" {
+        t.Errorf("incorrect backends: %v", backends)
+    }
+}
+
+func TestRolling(t *testing.T) {
+    publisher := &testPublisher{}
+    healthChecks := 0
+
+    rolling := RollingConfig{
+        DrainTime:      10 * time.Second,
+        HealthTimeout:  5 * time.Second,
+        Restart: func(config ConfigServiceBackend) error {
+            publisher.log = append(publisher.log, "restart " + config.BackendName)
+            return nil
+        },
+        Health: func(config ConfigServiceBackend) error {
+            if healthChecks++; healthChecks % 2 == 1 {
+                return fmt.Errorf("starting")
+            }
+            publisher.log = append(publisher.log, "healthy " + config.BackendName)
+            return nil
+        },
+        sleep: func(d time.Duration) {
+            publisher.log = append(publisher.log, fmt.Sprintf("sleep %v", d))
+        },
+    }
+
+    backends := []ConfigServiceBackend{
+        {ServiceName: "test", BackendName: "test1"},
+        {ServiceName: "test", BackendName: "test2", Backend: ServiceBackend{Drain: true}},
+        {ServiceName: "test", BackendName: "test3"},
+    }
+
+    if err := rolling.Run(publisher, backends); err != nil {
+        t.Fatalf("Run: %v", err)
+    }
+
+    expected := []string{
+        "publish test1 drain=true",
+        "sleep 10s",
+        "restart test1",
+        "sleep 1s",
+        "healthy test1",
+        "publish test1 drain=false",
+        "publish test3 drain=true",
+        "sleep 10s",
+        "restart test3",
+        "sleep 1s",
+        "healthy test3",
+        "publish test3 drain=false",
+    }
+
+    if fmt.Sprintf("%v", publisher.log) != fmt.Sprintf("%v", expected) {
+        t.Errorf("incorrect rolling:\n\t%v\n\t%v", publisher.log, expected)
+    }
+}
+
+func TestRollingHealthTimeout(t *testing.T) {
+    publisher := &testPublisher{}
+
+    rolling := RollingConfig{
+        HealthTimeout:  3 * time.Second,
+        Health: func(config ConfigServiceBackend) error {
+            return fmt.Errorf("down")
+        },
+        sleep: func(d time.Duration) { },
+    }
+
+    backends := []ConfigServiceBackend{
+        {ServiceName: "test", BackendName: "test1"},
+        {ServiceName: "test", BackendName: "test2"},
+    }
+
+    if err := rolling.Run(publisher, backends); err == nil {
+        t.Errorf("Run: no error")
+    } else if err.Error() != "test/test1: health: down" {
+        t.Errorf("Run: incorrect error: %v", err)
+    }
+
+    // left drained
+    if fmt.Sprintf("%v", publisher.log) != "[publish test1 drain=true]" {
+        t.Errorf("incorrect rolling: %v", publisher.log)
+    }
+}
@@ -0,0 +1,169 @@
+package config
+/*
+ * Sealed config values.
+ *
+ * Any Secret command-line value can be given as a "sealed:<base64>" string, which is a NaCl sealed box for the X25519 public key.
+ * Anyone with the public key can seal values, and only the hosts with the private key can unseal them. The etcd config tree does not
+ * have any Secret values.
+ *
+ * The unsealed Secret values are redacted when formatted, e.g. when logging the config.
+ */
+
+import (
+    "golang.org/x/crypto/curve25519"
+    "golang.org/x/crypto/nacl/box"
+    "crypto/rand"
+    "encoding/base64"
+    "fmt"
+    "io/ioutil"
+    "strings"
+)
+
+const SEALED_PREFIX = "sealed:"
+const SECRET_KEY_SIZE = 32
+
+// A sensitive config string, which may be sealed.
+//
+// Formatting the value redacts any unsealed value, but the JSON encoding is the value as-is.
+type Secret string
+
+func (self Secret) Sealed() bool {
+    return strings.HasPrefix(string(self), SEALED_PREFIX)
+}
+
+func (self Secret) String() string {
+    if self == "" || self.Sealed() {
+        return string(self)
+    } else {
+        return "<redacted>"
+    }
+}
+
+func (self Secret) GoString() string {
+    return fmt.Sprintf("%q", self.String())
+}
+
+type SecretsConfig struct {
+    // File containing the base64-encoded X25519 private key, for unsealing
+    KeyFile     string
+
+    // Base64-encoded X25519 public key, for sealing without the private key
+    PublicKey   string
+}
+
+type Secrets struct {
+    config      SecretsConfig
+    publicKey   *[SECRET_KEY_SIZE]byte
+    privateKey  *[SECRET_KEY_SIZE]byte
+}
+
+// Generate a new random key pair, returning the base64-encoded public and private keys
+func GenerateSecretKeys() (string, string, error) {
+    publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+    if err != nil {
+        return "", "", err
+    }
+
+    return base64.StdEncoding.EncodeToString(publicKey[:]), base64.StdEncoding.EncodeToString(privateKey[:]), nil
+}
+
+func decodeSecretKey(value string) (*[SECRET_KEY_SIZE]byte, error) {
+    var key [SECRET_KEY_SIZE]byte
+
+    if buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value)); err != nil {
+        return nil, err
+    } else if len(buf) != SECRET_KEY_SIZE {
+        return nil, fmt.Errorf("invalid key size %d, expected %d bytes", len(buf), SECRET_KEY_SIZE)
+    } else {
+        copy(key[:], buf)
+    }
+
+    return &key, nil
+}
+
+// Without any KeyFile, any sealed values will fail to unseal, and without any KeyFile or PublicKey, values cannot be sealed
+func (self SecretsConfig) Open() (*Secrets, error) {
+    secrets := &Secrets{config: self}
+
+    if self.KeyFile == "" {
+
+    } else if buf, err := ioutil.ReadFile(self.KeyFile); err != nil {
+        return nil, err
+    } else if privateKey, err := decodeSecretKey(string(buf)); err != nil {
+        return nil, fmt.Errorf("%s: %v", self.KeyFile, err)
+    } else if publicKey, err := curve25519.X25519(privateKey[:], curve25519.Basepoint); err != nil {
+        return nil, fmt.Errorf("%s: %v", self.KeyFile, err)
+    } else {
+        secrets.privateKey = privateKey
+        secrets.publicKey = &[SECRET_KEY_SIZE]byte{}
+
+        copy(secrets.publicKey[:], publicKey)
+    }
+
+    if self.PublicKey == "" {
+
+    } else if publicKey, err := decodeSecretKey(self.PublicKey); err != nil {
+        return nil, fmt.Errorf("Invalid public key: %v", err)
+    } else if secrets.publicKey != nil && *secrets.publicKey != *publicKey {
+        return nil, fmt.Errorf("Public key does not match the private key in %s", self.KeyFile)
+    } else {
+        secrets.publicKey = publicKey
+    }
+
+    return secrets, nil
+}
+
+func (self *Secrets) String() string {
+    return self.config.KeyFile
+}
+
+// Return the base64-encoded public key for sealing, or an empty string if none
+func (self *Secrets) PublicKey() string {
+    if self.publicKey == nil {
+        return ""
+    }
+
+    return base64.StdEncoding.EncodeToString(self.publicKey[:])
+}
+
+// Return the sealed "sealed:..." string for the plaintext
+func (self *Secrets) Seal(plaintext string) (string, error) {
+    if self.publicKey == nil {
+        return "", fmt.Errorf("No public key")
+    }
+
+    sealed, err := box.SealAnonymous(nil, []byte(plaintext), self.publicKey, rand.Reader)
+    if err != nil {
+        return "", err
+    }
+
+    return SEALED_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (self *Secrets) unsealString(value string) (string, error) {
+    if self.privateKey == nil {
+        return "", fmt.Errorf("No secret key for sealed value")
+    }
+
+    sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, SEALED_PREFIX))
+    if err != nil {
+        return "", fmt.Errorf("Invalid sealed value: %v", err)
+    }
+
+    if plaintext, ok := box.OpenAnonymous(nil, sealed, self.publicKey, self.privateKey); !ok {
+        return "", fmt.Errorf("Invalid sealed value: cannot be opened with the secret key")
+    } else {
+        return string(plaintext), nil
+    }
+}
+
+// Return the unsealed value of any sealed Secret, or the value as-is
+func (self *Secrets) UnsealSecret(secret Secret) (Secret, error) {
+    if !secret.Sealed() {
+        return secret, nil
+    } else if plaintext, err := self.unsealString(string(secret)); err != nil {
+        return "", err
+    } else {
+        return Secret(plaintext), nil
+    }
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func testSecretKeyFile(t *testing.T) string {
+    _, privateKey, err := GenerateSecretKeys()
+    if err != nil {
+        t.Fatalf("GenerateSecretKeys: %v", err)
+    }
+
+    path := filepath.Join(t.TempDir(), "secret.key")
+
+    if err := ioutil.WriteFile(path, []byte(privateKey + "\n"), 0600); err != nil {
+        t.Fatalf("ioutil.WriteFile: %v", err)
+    }
+
+    return path
+}
+
+func testSecrets(t *testing.T) *Secrets {
+    secrets, err := SecretsConfig{KeyFile: testSecretKeyFile(t)}.Open()
+    if err != nil {
+        t.Fatalf("SecretsConfig.Open: %v", err)
+    }
+
+    return secrets
+}
+
+type testSecretValue struct {
+    Name        string
+    Token       Secret
+    Headers     map[string]Secret
+    Keys        []Secret
+}
+
+func TestSecretsUnseal(t *testing.T) {
+    secrets := testSecrets(t)
+
+    // sealing only needs the public key
+    publicSecrets, err := SecretsConfig{PublicKey: secrets.PublicKey()}.Open()
+    if err != nil {
+        t.Fatalf("SecretsConfig.Open: %v", err)
+    }
+
+    sealed, err := publicSecrets.Seal("s3cret")
+    if err != nil {
+        t.Fatalf("Seal: %v", err)
+    } else if !strings.HasPrefix(sealed, SEALED_PREFIX) || strings.Contains(sealed, "s3cret") {
+        t.Fatalf("Seal: %v", sealed)
+    }
+
+    if _, err := publicSecrets.UnsealSecret(Secret(sealed)); err == nil {
+        t.Errorf("UnsealSecret: no error without the private key")
+    }
+
+    if unsealed, err := secrets.UnsealSecret(Secret(sealed)); err != nil {
+        t.Errorf("UnsealSecret: %v", err)
+    } else if unsealed != "s3cret" {
+        t.Errorf("UnsealSecret: %#v", unsealed)
+    }
+
+    if unsealed, err := secrets.UnsealSecret("test"); err != nil {
+        t.Errorf("UnsealSecret plain: %v", err)
+    } else if unsealed != "test" {
+        t.Errorf("UnsealSecret plain: %#v", unsealed)
+    }
+
+    // with the wrong key
+    if _, err := testSecrets(t).UnsealSecret(Secret(sealed)); err == nil {
+        t.Errorf("UnsealSecret: no error with wrong key")
+    }
+
+    // without any key
+    if noSecrets, err := (SecretsConfig{}).Open(); err != nil {
+        t.Fatalf("SecretsConfig.Open: %v", err)
+    } else if _, err := noSecrets.UnsealSecret(Secret(sealed)); err == nil {
+        t.Errorf("UnsealSecret: no error without key")
+    } else if _, err := noSecrets.Seal("s3cret"); err == nil {
+        t.Errorf("Seal: no error without key")
+    }
+}
+
+func TestSecretFormat(t *testing.T) {
+    value := testSecretValue{Token: "s3cret", Headers: map[string]Secret{"Authorization": "s3cret"}, Keys: []Secret{"sealed:test"}}
+
+    for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+        if formatted := fmt.Sprintf(format, value); strings.Contains(formatted, "s3cret") {
+            t.Errorf("Sprintf %s: %s", format, formatted)
+        } else if !strings.Contains(formatted, "sealed:test") {
+            t.Errorf("Sprintf %s: sealed value is not shown: %s", format, formatted)
+        }
+    }
+}
+
+func TestSecretsOpenError(t *testing.T) {
+    file, err := ioutil.TempFile("", "clusterf-secret-key")
+    if err != nil {
+        t.Fatalf("ioutil.TempFile: %v", err)
+    }
+    defer os.Remove(file.Name())
+
+    file.WriteString("dGVzdA==\n")
+    file.Close()
+
+    if _, err := (SecretsConfig{KeyFile: file.Name()}).Open(); err == nil {
+        t.Errorf("SecretsConfig.Open: no error for short key")
+    }
+
+    otherPublicKey, _, err := GenerateSecretKeys()
+    if err != nil {
+        t.Fatalf("GenerateSecretKeys: %v", err)
+    }
+
+    if _, err := (SecretsConfig{KeyFile: testSecretKeyFile(t), PublicKey: otherPublicKey}).Open(); err == nil {
+        t.Errorf("SecretsConfig.Open: no error for mismatching public key")
+    }
+}
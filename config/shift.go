@@ -0,0 +1,45 @@
+package config
+/*
+ * Gradual shifts of the service traffic between backend groups.
+ */
+
+import (
+    "fmt"
+    "time"
+)
+
+func (self ServiceShift) String() string {
+    return fmt.Sprintf("%s -> %s over %v from %v", self.From, self.To, self.Duration, self.Start.Format(time.RFC3339))
+}
+
+func (self ServiceShift) check() error {
+    if self.From == "" || self.To == "" {
+        return fmt.Errorf("shift requires both from and to groups")
+    } else if self.From == self.To {
+        return fmt.Errorf("shift from and to the same group %s", self.From)
+    } else if self.Start.IsZero() {
+        return fmt.Errorf("shift requires a start time")
+    } else if self.Duration < 0 {
+        return fmt.Errorf("shift duration %v is negative", self.Duration)
+    }
+
+    return nil
+}
+
+// Return the fraction of the traffic shifted to the To group at the given time, from 0.0 to 1.0
+func (self ServiceShift) Progress(now time.Time) float64 {
+    var elapsed = now.Sub(self.Start)
+
+    if elapsed >= time.Duration(self.Duration) {
+        return 1.0
+    } else if elapsed <= 0 {
+        return 0.0
+    } else {
+        return float64(elapsed) / float64(self.Duration)
+    }
+}
+
+// The shift has completed at the given time, and can be finished by switching the frontend to the To group
+func (self ServiceShift) Done(now time.Time) bool {
+    return self.Progress(now) >= 1.0
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+    "testing"
+    "time"
+)
+
+func TestShiftProgress(t *testing.T) {
+    start := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+    shift := ServiceShift{From: "blue", To: "green", Start: start, Duration: Duration(10 * time.Minute)}
+
+    for _, test := range []struct{
+        now         time.Time
+        progress    float64
+    }{
+        {start.Add(-1 * time.Minute),   0.0},
+        {start,                         0.0},
+        {start.Add(5 * time.Minute),    0.5},
+        {start.Add(10 * time.Minute),   1.0},
+        {start.Add(1 * time.Hour),      1.0},
+    } {
+        if progress := shift.Progress(test.now); progress != test.progress {
+            t.Errorf("Progress(%v): %v != %v", test.now, progress, test.progress)
+        }
+    }
+
+    // immediate shift
+    if progress := (ServiceShift{From: "blue", To: "green", Start: start}).Progress(start); progress != 1.0 {
+        t.Errorf("Progress without duration: %v", progress)
+    }
+}
@@ -0,0 +1,20 @@
+package config
+/*
+ * Per-backend connection thresholds, using the IPVS dest u_threshold/l_threshold.
+ */
+
+import (
+    "fmt"
+)
+
+func (self ServiceBackend) checkThresh() error {
+    if self.LThresh == 0 {
+
+    } else if self.UThresh == 0 {
+        return fmt.Errorf("l_thresh requires u_thresh")
+    } else if self.LThresh >= self.UThresh {
+        return fmt.Errorf("l_thresh %d must be lower than u_thresh %d", self.LThresh, self.UThresh)
+    }
+
+    return nil
+}
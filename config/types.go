@@ -3,11 +3,64 @@ package config
  * Externally exposed types.
  */
 
+import (
+    "time"
+)
+
 type ServiceFrontend struct {
     IPv4    string  `json:"ipv4,omitempty"`
     IPv6    string  `json:"ipv6,omitempty"`
     TCP     uint16  `json:"tcp,omitempty"`
     UDP     uint16  `json:"udp,omitempty"`
+    SCTP    uint16  `json:"sctp,omitempty"`
+
+    // Same port for each of the protocols, as an alternative to separate tcp/udp/sctp ports
+    Port        uint16      `json:"port,omitempty"`
+    Protocols   Protocols   `json:"protocols,omitempty"`  // default: tcp
+
+    // Match any packets with the firewall mark, for each address family of the ipv4/ipv6 addresses, instead of any ports
+    FwMark      uint32      `json:"fwmark,omitempty"`
+
+    // Also use the backends from the named /clusterf/groups/...
+    Group   string  `json:"group,omitempty"`
+
+    // Map to backend ports, for backends that do not configure any ports of their own
+    BackendTCP  uint16  `json:"backend_tcp,omitempty"`
+    BackendUDP  uint16  `json:"backend_udp,omitempty"`
+    BackendSCTP uint16  `json:"backend_sctp,omitempty"`
+    BackendPort uint16  `json:"backend_port,omitempty"`  // default for any protocol
+
+    // Minimum number of non-drained backends to use from the highest-priority tiers, before promoting lower-priority backends.
+    // The backends are not health-checked, so any failed backends must be drained to promote the lower-priority backends.
+    PriorityMinUndrained    uint    `json:"priority_min_undrained,omitempty"`    // default: 1
+
+    // Maximum number of backends to use on each node, chosen by consistent hashing
+    Subset      uint    `json:"subset,omitempty"`   // default: all
+
+    // Send each client to the same backend for the given duration after its last connection, e.g. "5m" or 300
+    Persistence Duration    `json:"persistence,omitempty"`
+
+    // Send all persistent clients within the same IPv4 or IPv6 prefix length to the same backend, e.g. 24 or 64
+    PersistenceNetmask4 uint    `json:"persistence_netmask4,omitempty"`  // default: 32
+    PersistenceNetmask6 uint    `json:"persistence_netmask6,omitempty"`  // default: 128
+
+    // Duplicate the frontend traffic to the given analysis host using nftables, for the frontend IPs of the same address family
+    Mirror      string  `json:"mirror,omitempty"`
+
+    // Duplicate the frontend traffic to the backends of the named /clusterf/groups/... using nftables, choosing one backend per
+    // connection, for load-testing with real traffic; any responses from the shadow backends must be dropped on the backend hosts
+    Shadow      string  `json:"shadow,omitempty"`
+
+    // Only accept clients from the allowed source prefixes, and drop any clients from the denied source prefixes, using nftables
+    Allow       Prefixes    `json:"allow,omitempty"`
+    Deny        Prefixes    `json:"deny,omitempty"`
+
+    // Announce the frontend IPs using the named clusterf-ipvs announcer, e.g. "route" or "addr"
+    Announce    string      `json:"announce,omitempty"`   // default: the -inject-announce announcers
+
+    // Add the frontend IPs as local addresses on the interface, e.g. "lo", and use the local host as a backend while it is
+    // listening on the frontend ports, for exposing host-local daemons
+    Interface   string      `json:"interface,omitempty"`
 }
 
 type ServiceBackend struct {
@@ -15,8 +68,40 @@ type ServiceBackend struct {
     IPv6    string  `json:"ipv6,omitempty"`
     TCP     uint16  `json:"tcp,omitempty"`
     UDP     uint16  `json:"udp,omitempty"`
+    SCTP    uint16  `json:"sctp,omitempty"`
+    Port    uint16  `json:"port,omitempty"`     // default for any protocol
+
+    // Only use the backend for the listed protocols, allowing separate sets of backends for each protocol
+    Protocols   Protocols   `json:"protocols,omitempty"`    // default: all
 
     Weight  uint    `json:"weight,omitempty"`   // default: 10
+
+    // Backends with a lower priority are standbys, used at zero weight
+    Priority    uint    `json:"priority,omitempty"` // default: 0
+
+    // Drained backends are used at zero weight, allowing existing connections to continue
+    Drain       bool    `json:"drain,omitempty"`
+
+    // Stop scheduling new connections to the backend once it has u_thresh active+inactive connections,
+    // until it drops below l_thresh connections
+    UThresh     uint    `json:"u_thresh,omitempty"` // default: 0 for unlimited
+    LThresh     uint    `json:"l_thresh,omitempty"` // default: 3/4 of u_thresh
+}
+
+// Shift the service from the backends of one group to another, by progressively scaling the backend weights over the duration.
+// The progress is given by the start time, so that any restarted nodes resume the shift.
+type ServiceShift struct {
+    From        string      `json:"from"`
+    To          string      `json:"to"`
+    Start       time.Time   `json:"start"`
+    Duration    Duration    `json:"duration"`
+}
+
+// An A/B experiment, using alternate weights for the named service backends while active.
+// Any backends not listed keep their configured weight, and a zero weight drains the backend.
+type ServiceExperiment struct {
+    Weights     map[string]uint `json:"weights"`
+    Active      bool            `json:"active,omitempty"`
 }
 
 type Route struct {
@@ -34,6 +119,21 @@ type Route struct {
     IpvsMethod  string
 }
 
+// The state of a service on a node, published for external integrations such as DNS controllers
+type ServiceStatus struct {
+    IPv4        string  `json:"ipv4,omitempty"`
+    IPv6        string  `json:"ipv6,omitempty"`
+
+    // The service has any active backends
+    Healthy     bool    `json:"healthy"`
+    Backends    uint    `json:"backends"`
+}
+
+type Shard struct {
+    // Services handled by the node, as indexes modulo a count, e.g. "0/4" or "0,1/4"
+    Shard       string  `json:"shard"`
+}
+
 /*
  * Events when config changes
  */
@@ -60,6 +160,8 @@ type Config interface {
 
     // JSON-encodeable value 
     Value() interface{}
+
+    Source() ConfigSource
 }
 
 /*
@@ -101,9 +203,62 @@ type ConfigServiceBackend struct {
     ConfigSource    ConfigSource
 }
 
+// An active shift between the backend groups of the service
+type ConfigServiceShift struct {
+    ServiceName     string
+
+    Shift           ServiceShift
+    ConfigSource    ConfigSource
+}
+
+// May be delivered with an empty ExperimentName:"" if *all* service experiments are to be deleted
+type ConfigServiceExperiment struct {
+    ServiceName     string
+    ExperimentName  string
+
+    Experiment      ServiceExperiment
+    ConfigSource    ConfigSource
+}
+
+// Used when a group directory is created or destroyed.
+// May be delivered with an empty GroupName:"" if *all* groups are to be deleted
+type ConfigGroup struct {
+    GroupName       string
+    ConfigSource    ConfigSource
+}
+
+// A backend shared by all services referencing the group.
+// May be delivered with an empty BackendName:"" if *all* group backends are to be deleted
+type ConfigGroupBackend struct {
+    GroupName       string
+    BackendName     string
+
+    Backend         ServiceBackend
+    ConfigSource    ConfigSource
+}
+
 type ConfigRoute struct {
     RouteName       string
 
     Route           Route
     ConfigSource    ConfigSource
 }
+
+// The shard of services used by a node, advertised for overlap detection.
+// May be delivered with an empty NodeName:"" if *all* shards are to be deleted
+type ConfigShard struct {
+    NodeName        string
+
+    Shard           Shard
+    ConfigSource    ConfigSource
+}
+
+// The status of a service published by a node, not used by clusterf itself.
+// May be delivered with an empty NodeName:"" or ServiceName:"" if *all* statuses are to be deleted
+type ConfigStatus struct {
+    NodeName        string
+    ServiceName     string
+
+    Status          ServiceStatus
+    ConfigSource    ConfigSource
+}
@@ -0,0 +1,149 @@
+package clusterf
+/*
+ * Timeline of the kernel conn table, sampled over a window, for tuning the capacity and persistence timeouts.
+ *
+ * Each sample counts the active, new and expired connections of each service, comparing the conns in the table with the previous
+ * sample. Any connections that are created and expire between two samples are not seen. Persistence templates are counted as
+ * separate ip:// services.
+ */
+
+import (
+    "encoding/csv"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Limit the sampling window for HTTP requests
+const CONN_WINDOW_MAX = 1 * time.Hour
+
+type ConnSample struct {
+    Time        time.Time   `json:"time"`
+    Service     string      `json:"service"`   // proto://vip:port
+    Name        string      `json:"name"`
+
+    Conns       uint        `json:"conns"`
+    New         uint        `json:"new"`
+    Expired     uint        `json:"expired"`
+}
+
+type ConnTimeline struct {
+    // service of each conn in the previous sample, or nil before the first sample
+    conns       map[string]string
+
+    Samples     []ConnSample
+}
+
+func connService(conn TraceConn) string {
+    return fmt.Sprintf("%s://%s", strings.ToLower(conn.Protocol), conn.Service)
+}
+
+func connKey(conn TraceConn) string {
+    return fmt.Sprintf("%s %s %s %s", conn.Protocol, conn.Client, conn.Service, conn.Dest)
+}
+
+// Return the config service names by proto://vip:port, including the ip:// persistence templates
+func (self *IPVSDriver) connNames() map[string]string {
+    var names = make(map[string]string)
+
+    for _, ipvsService := range self.sortedServices() {
+        if ipvsService.FwMark != 0 {
+            continue
+        }
+
+        name := self.serviceName(makeServiceKey(ipvsService))
+        addr := traceAddr(ipvsService.Addr, ipvsService.Port)
+
+        names[fmt.Sprintf("%s://%s", ipvsService.Protocol, addr)] = name
+
+        if ipvsService.Flags.Persistent {
+            names[fmt.Sprintf("ip://%s", addr)] = name
+        }
+    }
+
+    return names
+}
+
+// Add a sample of the kernel conn table to the timeline, using the current service names
+func (self *IPVSDriver) SampleConns(timeline *ConnTimeline) error {
+    if conns, err := self.traceConns(nil); err != nil {
+        return fmt.Errorf("ipvs.WalkConnections: %w", err)
+    } else {
+        timeline.update(time.Now(), self.connNames(), conns)
+    }
+
+    return nil
+}
+
+// Add a sample for each service with active or expired conns
+func (self *ConnTimeline) update(now time.Time, names map[string]string, conns []TraceConn) {
+    var services = make(map[string]*ConnSample)
+    var serviceNames []string
+    var nextConns = make(map[string]string)
+
+    serviceSample := func(service string) *ConnSample {
+        if services[service] == nil {
+            services[service] = &ConnSample{Time: now, Service: service, Name: names[service]}
+            serviceNames = append(serviceNames, service)
+        }
+        return services[service]
+    }
+
+    for _, conn := range conns {
+        key := connKey(conn)
+        service := connService(conn)
+
+        if _, exists := nextConns[key]; exists {
+            // duplicate
+            continue
+        }
+
+        nextConns[key] = service
+        sample := serviceSample(service)
+        sample.Conns++
+
+        if self.conns == nil {
+            // initial sample
+        } else if _, exists := self.conns[key]; !exists {
+            sample.New++
+        }
+    }
+
+    for key, service := range self.conns {
+        if _, exists := nextConns[key]; !exists {
+            serviceSample(service).Expired++
+        }
+    }
+
+    sort.Strings(serviceNames)
+
+    for _, service := range serviceNames {
+        self.Samples = append(self.Samples, *services[service])
+    }
+
+    self.conns = nextConns
+}
+
+func (self *ConnTimeline) WriteCSV(writer io.Writer) error {
+    csvWriter := csv.NewWriter(writer)
+
+    csvWriter.Write([]string{"time", "service", "name", "conns", "new", "expired"})
+
+    for _, sample := range self.Samples {
+        csvWriter.Write([]string{
+            sample.Time.Format(time.RFC3339),
+            sample.Service,
+            sample.Name,
+            strconv.FormatUint(uint64(sample.Conns), 10),
+            strconv.FormatUint(uint64(sample.New), 10),
+            strconv.FormatUint(uint64(sample.Expired), 10),
+        })
+    }
+
+    csvWriter.Flush()
+
+    return csvWriter.Error()
+}
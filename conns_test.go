@@ -0,0 +1,104 @@
+package clusterf
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/qmsk/clusterf/config"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestConnTimeline(t *testing.T) {
+    var now = time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+    var names = map[string]string{"tcp://10.0.1.1:80": "web", "ip://10.0.1.1:80": "web"}
+    var timeline ConnTimeline
+
+    for _, step := range []struct{
+        conns   []TraceConn
+        samples []string
+    }{
+        {
+            conns:  []TraceConn{
+                {Protocol: "TCP", Client: "10.0.0.1:1000", Service: "10.0.1.1:80", Dest: "10.1.0.1:80"},
+                {Protocol: "TCP", Client: "10.0.0.2:1000", Service: "10.0.1.1:80", Dest: "10.1.0.2:80"},
+                {Protocol: "IP", Client: "10.0.0.1:0", Service: "10.0.1.1:80", Dest: "10.1.0.1:80"},
+            },
+            samples: []string{"ip://10.0.1.1:80 web 1 0 0", "tcp://10.0.1.1:80 web 2 0 0"},
+        },
+        {
+            conns:  []TraceConn{
+                {Protocol: "TCP", Client: "10.0.0.2:1000", Service: "10.0.1.1:80", Dest: "10.1.0.2:80"},
+                {Protocol: "TCP", Client: "10.0.0.3:1000", Service: "10.0.1.1:80", Dest: "10.1.0.1:80"},
+                {Protocol: "TCP", Client: "10.0.0.4:1000", Service: "10.0.1.1:80", Dest: "10.1.0.2:80"},
+                {Protocol: "IP", Client: "10.0.0.1:0", Service: "10.0.1.1:80", Dest: "10.1.0.1:80"},
+                {Protocol: "UDP", Client: "10.0.0.1:1000", Service: "10.0.1.2:53", Dest: "10.1.0.1:53"},
+            },
+            samples: []string{"ip://10.0.1.1:80 web 1 0 0", "tcp://10.0.1.1:80 web 3 2 1", "udp://10.0.1.2:53  1 1 0"},
+        },
+        {
+            conns:  []TraceConn{},
+            samples: []string{"ip://10.0.1.1:80 web 0 0 1", "tcp://10.0.1.1:80 web 0 0 3", "udp://10.0.1.2:53  0 0 1"},
+        },
+        {
+            conns:  []TraceConn{},
+            samples: []string{},
+        },
+    } {
+        var samples = []string{}
+
+        now = now.Add(time.Second)
+        timeline.Samples = nil
+        timeline.update(now, names, step.conns)
+
+        for _, sample := range timeline.Samples {
+            if sample.Time != now {
+                t.Errorf("update %v: invalid sample time %v", step.conns, sample.Time)
+            }
+
+            samples = append(samples, fmt.Sprintf("%s %s %d %d %d", sample.Service, sample.Name, sample.Conns, sample.New, sample.Expired))
+        }
+
+        if !reflect.DeepEqual(samples, step.samples) {
+            t.Errorf("update %v: samples %v != %v", step.conns, samples, step.samples)
+        }
+    }
+}
+
+func TestConnTimelineCSV(t *testing.T) {
+    var buf bytes.Buffer
+    var timeline ConnTimeline
+
+    timeline.update(time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC), nil, []TraceConn{{Protocol: "TCP", Client: "10.0.0.1:1000", Service: "10.0.1.1:80", Dest: "10.1.0.1:80"}})
+
+    if err := timeline.WriteCSV(&buf); err != nil {
+        t.Fatalf("WriteCSV: %v", err)
+    }
+
+    if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); !reflect.DeepEqual(lines, []string{"time,service,name,conns,new,expired", "2016-03-01T12:00:00Z,tcp://10.0.1.1:80,,1,0,0"}) {
+        t.Errorf("WriteCSV: %#v", lines)
+    }
+}
+
+func TestConnNames(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"web", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", IPv6:"2001:db8::1", TCP:80, Persistence:config.Duration(5 * time.Minute)}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"dns", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", UDP:53}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    if names := ipvsDriver.connNames(); !reflect.DeepEqual(names, map[string]string{
+        "tcp://10.0.1.1:80":        "web",
+        "ip://10.0.1.1:80":         "web",
+        "tcp://[2001:db8::1]:80":   "web",
+        "ip://[2001:db8::1]:80":    "web",
+        "udp://10.0.1.2:53":        "dns",
+    }) {
+        t.Errorf("connNames: %v", names)
+    }
+}
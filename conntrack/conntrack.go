@@ -0,0 +1,350 @@
+package conntrack
+/*
+ * Conntrack events from the kernel ctnetlink multicast groups.
+ *
+ * IPVS only creates conntrack entries for its connections with the net.ipv4.vs.conntrack=1 sysctl. The byte counters and timestamps
+ * also require the net.netfilter.nf_conntrack_acct=1 and net.netfilter.nf_conntrack_timestamp=1 sysctls.
+ */
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "encoding/binary"
+    "fmt"
+    "net"
+    "syscall"
+    "github.com/qmsk/clusterf/tasks"
+    "time"
+)
+
+const (
+    NETLINK_NETFILTER               = 12
+
+    NF_NETLINK_CONNTRACK_NEW        = 0x1
+    NF_NETLINK_CONNTRACK_UPDATE     = 0x2
+    NF_NETLINK_CONNTRACK_DESTROY    = 0x4
+
+    NFNL_SUBSYS_CTNETLINK           = 1
+
+    IPCTNL_MSG_CT_NEW               = 0
+    IPCTNL_MSG_CT_GET               = 1
+    IPCTNL_MSG_CT_DELETE            = 2
+
+    NLA_F_NESTED                    = 0x8000
+    NLA_F_NET_BYTEORDER             = 0x4000
+    NLA_TYPE_MASK                   = 0x3fff
+)
+
+const (
+    CTA_UNSPEC          = iota
+    CTA_TUPLE_ORIG
+    CTA_TUPLE_REPLY
+    CTA_STATUS
+    CTA_PROTOINFO
+    CTA_HELP
+    CTA_NAT_SRC
+    CTA_TIMEOUT
+    CTA_MARK
+    CTA_COUNTERS_ORIG
+    CTA_COUNTERS_REPLY
+    CTA_USE
+    CTA_ID
+    CTA_NAT_DST
+    CTA_TUPLE_MASTER
+    CTA_SEQ_ADJ_ORIG
+    CTA_SEQ_ADJ_REPLY
+    CTA_SECMARK
+    CTA_ZONE
+    CTA_SECCTX
+    CTA_TIMESTAMP
+)
+
+const (
+    CTA_TUPLE_UNSPEC    = iota
+    CTA_TUPLE_IP
+    CTA_TUPLE_PROTO
+)
+
+const (
+    CTA_IP_UNSPEC       = iota
+    CTA_IP_V4_SRC
+    CTA_IP_V4_DST
+    CTA_IP_V6_SRC
+    CTA_IP_V6_DST
+)
+
+const (
+    CTA_PROTO_UNSPEC    = iota
+    CTA_PROTO_NUM
+    CTA_PROTO_SRC_PORT
+    CTA_PROTO_DST_PORT
+)
+
+const (
+    CTA_COUNTERS_UNSPEC     = iota
+    CTA_COUNTERS_PACKETS
+    CTA_COUNTERS_BYTES
+)
+
+const (
+    CTA_TIMESTAMP_UNSPEC    = iota
+    CTA_TIMESTAMP_START
+    CTA_TIMESTAMP_STOP
+)
+
+// Receive buffer for bursts of events
+const RECV_BUFFER = 4 * 1024 * 1024
+
+type EventType int
+
+const (
+    NewEvent        EventType   = iota
+    DestroyEvent
+)
+
+func (self EventType) String() string {
+    switch self {
+    case NewEvent:
+        return "new"
+    case DestroyEvent:
+        return "destroy"
+    default:
+        return fmt.Sprintf("EventType(%d)", int(self))
+    }
+}
+
+type Tuple struct {
+    Src         net.IP
+    Dst         net.IP
+    Protocol    uint8
+    SrcPort     uint16
+    DstPort     uint16
+}
+
+type Counters struct {
+    Packets     uint64
+    Bytes       uint64
+}
+
+type Event struct {
+    Type        EventType
+    ID          uint32
+
+    // client -> vip
+    Orig        Tuple
+
+    // backend -> client
+    Reply       Tuple
+
+    OrigCounters    Counters
+    ReplyCounters   Counters
+
+    // zero unless the kernel has conntrack timestamps enabled
+    Start       time.Time
+    Stop        time.Time
+}
+
+// Parse the nlattrs from the buffer, by type
+func parseAttrs(buf []byte) (map[uint16][]byte, error) {
+    var attrs = make(map[uint16][]byte)
+
+    for len(buf) >= syscall.SizeofNlAttr {
+        attrLen := int(binary.LittleEndian.Uint16(buf[0:2]))
+        attrType := binary.LittleEndian.Uint16(buf[2:4]) & NLA_TYPE_MASK
+
+        if attrLen < syscall.SizeofNlAttr || attrLen > len(buf) {
+            return nil, fmt.Errorf("Invalid nlattr length %d for %d bytes", attrLen, len(buf))
+        }
+
+        attrs[attrType] = buf[syscall.SizeofNlAttr:attrLen]
+
+        // attrs are aligned to 4 bytes
+        if alignLen := (attrLen + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1); alignLen >= len(buf) {
+            break
+        } else {
+            buf = buf[alignLen:]
+        }
+    }
+
+    return attrs, nil
+}
+
+// The attr buffers are re-used for each read
+func copyIP(buf []byte) net.IP {
+    return net.IP(append([]byte(nil), buf...))
+}
+
+func parseTuple(buf []byte) (tuple Tuple, err error) {
+    attrs, err := parseAttrs(buf)
+    if err != nil {
+        return tuple, err
+    }
+
+    if ipAttrs, err := parseAttrs(attrs[CTA_TUPLE_IP]); err != nil {
+        return tuple, err
+    } else if src, exists := ipAttrs[CTA_IP_V4_SRC]; exists {
+        tuple.Src = copyIP(src)
+        tuple.Dst = copyIP(ipAttrs[CTA_IP_V4_DST])
+    } else if src, exists := ipAttrs[CTA_IP_V6_SRC]; exists {
+        tuple.Src = copyIP(src)
+        tuple.Dst = copyIP(ipAttrs[CTA_IP_V6_DST])
+    }
+
+    if protoAttrs, err := parseAttrs(attrs[CTA_TUPLE_PROTO]); err != nil {
+        return tuple, err
+    } else {
+        if num := protoAttrs[CTA_PROTO_NUM]; len(num) >= 1 {
+            tuple.Protocol = num[0]
+        }
+        if port := protoAttrs[CTA_PROTO_SRC_PORT]; len(port) >= 2 {
+            tuple.SrcPort = binary.BigEndian.Uint16(port)
+        }
+        if port := protoAttrs[CTA_PROTO_DST_PORT]; len(port) >= 2 {
+            tuple.DstPort = binary.BigEndian.Uint16(port)
+        }
+    }
+
+    return tuple, nil
+}
+
+func parseCounters(buf []byte) (counters Counters, err error) {
+    attrs, err := parseAttrs(buf)
+    if err != nil {
+        return counters, err
+    }
+
+    if packets := attrs[CTA_COUNTERS_PACKETS]; len(packets) >= 8 {
+        counters.Packets = binary.BigEndian.Uint64(packets)
+    }
+    if bytes := attrs[CTA_COUNTERS_BYTES]; len(bytes) >= 8 {
+        counters.Bytes = binary.BigEndian.Uint64(bytes)
+    }
+
+    return counters, nil
+}
+
+func parseTimestamp(buf []byte) (start time.Time, stop time.Time, err error) {
+    attrs, err := parseAttrs(buf)
+    if err != nil {
+        return
+    }
+
+    if ts := attrs[CTA_TIMESTAMP_START]; len(ts) >= 8 {
+        start = time.Unix(0, int64(binary.BigEndian.Uint64(ts)))
+    }
+    if ts := attrs[CTA_TIMESTAMP_STOP]; len(ts) >= 8 {
+        stop = time.Unix(0, int64(binary.BigEndian.Uint64(ts)))
+    }
+
+    return
+}
+
+// Parse a ctnetlink event message, returning nil for any other messages
+func parseEvent(msg syscall.NetlinkMessage) (*Event, error) {
+    var event Event
+
+    if msg.Header.Type >> 8 != NFNL_SUBSYS_CTNETLINK {
+        return nil, nil
+    }
+
+    switch msg.Header.Type & 0xff {
+    case IPCTNL_MSG_CT_NEW:
+        event.Type = NewEvent
+    case IPCTNL_MSG_CT_DELETE:
+        event.Type = DestroyEvent
+    default:
+        return nil, nil
+    }
+
+    // struct nfgenmsg
+    if len(msg.Data) < 4 {
+        return nil, fmt.Errorf("Short nfgenmsg: %d bytes", len(msg.Data))
+    }
+
+    attrs, err := parseAttrs(msg.Data[4:])
+    if err != nil {
+        return nil, err
+    }
+
+    if id := attrs[CTA_ID]; len(id) >= 4 {
+        event.ID = binary.BigEndian.Uint32(id)
+    }
+
+    if event.Orig, err = parseTuple(attrs[CTA_TUPLE_ORIG]); err != nil {
+        return nil, fmt.Errorf("CTA_TUPLE_ORIG: %v", err)
+    }
+    if event.Reply, err = parseTuple(attrs[CTA_TUPLE_REPLY]); err != nil {
+        return nil, fmt.Errorf("CTA_TUPLE_REPLY: %v", err)
+    }
+    if event.OrigCounters, err = parseCounters(attrs[CTA_COUNTERS_ORIG]); err != nil {
+        return nil, fmt.Errorf("CTA_COUNTERS_ORIG: %v", err)
+    }
+    if event.ReplyCounters, err = parseCounters(attrs[CTA_COUNTERS_REPLY]); err != nil {
+        return nil, fmt.Errorf("CTA_COUNTERS_REPLY: %v", err)
+    }
+    if event.Start, event.Stop, err = parseTimestamp(attrs[CTA_TIMESTAMP]); err != nil {
+        return nil, fmt.Errorf("CTA_TIMESTAMP: %v", err)
+    }
+
+    return &event, nil
+}
+
+// Netlink socket subscribed to the conntrack new and destroy events
+type Conn struct {
+    fd      int
+    buf     []byte
+    release func()
+}
+
+func Open() (*Conn, error) {
+    fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW | syscall.SOCK_CLOEXEC, NETLINK_NETFILTER)
+    if err != nil {
+        return nil, errs.KernelError(err)
+    }
+
+    conn := &Conn{fd: fd, buf: make([]byte, syscall.Getpagesize() * 16), release: tasks.Open("conntrack")}
+
+    if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, RECV_BUFFER); err != nil {
+        conn.Close()
+        return nil, errs.KernelError(err)
+    }
+
+    if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: NF_NETLINK_CONNTRACK_NEW | NF_NETLINK_CONNTRACK_DESTROY}); err != nil {
+        conn.Close()
+        return nil, errs.KernelError(err)
+    }
+
+    return conn, nil
+}
+
+// Read the next batch of events.
+//
+// Returns a syscall.ENOBUFS error if the kernel dropped any events, which is safe to continue from.
+func (self *Conn) Read() ([]Event, error) {
+    var events []Event
+
+    n, _, err := syscall.Recvfrom(self.fd, self.buf, 0)
+    if err != nil {
+        return nil, errs.KernelError(err)
+    }
+
+    msgs, err := syscall.ParseNetlinkMessage(self.buf[:n])
+    if err != nil {
+        return nil, errs.InternalError(err)
+    }
+
+    for _, msg := range msgs {
+        if event, err := parseEvent(msg); err != nil {
+            return events, errs.InternalError(err)
+        } else if event != nil {
+            events = append(events, *event)
+        }
+    }
+
+    return events, nil
+}
+
+func (self *Conn) Close() error {
+    self.release()
+
+    return syscall.Close(self.fd)
+}
@@ -0,0 +1,166 @@
+package conntrack
+
+import (
+    "encoding/binary"
+    "net"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// Build an nlattr, padded to the alignment
+func testAttr(typ uint16, data ...[]byte) []byte {
+    var value []byte
+
+    for _, buf := range data {
+        value = append(value, buf...)
+    }
+
+    buf := make([]byte, syscall.SizeofNlAttr, syscall.SizeofNlAttr + len(value) + syscall.NLA_ALIGNTO)
+    binary.LittleEndian.PutUint16(buf[0:2], uint16(syscall.SizeofNlAttr + len(value)))
+    binary.LittleEndian.PutUint16(buf[2:4], typ)
+    buf = append(buf, value...)
+
+    for len(buf) % syscall.NLA_ALIGNTO != 0 {
+        buf = append(buf, 0)
+    }
+
+    return buf
+}
+
+func testU16(value uint16) []byte {
+    buf := make([]byte, 2)
+    binary.BigEndian.PutUint16(buf, value)
+    return buf
+}
+
+func testU32(value uint32) []byte {
+    buf := make([]byte, 4)
+    binary.BigEndian.PutUint32(buf, value)
+    return buf
+}
+
+func testU64(value uint64) []byte {
+    buf := make([]byte, 8)
+    binary.BigEndian.PutUint64(buf, value)
+    return buf
+}
+
+func testTuple(typ uint16, src string, srcPort uint16, dst string, dstPort uint16) []byte {
+    return testAttr(typ | NLA_F_NESTED,
+        testAttr(CTA_TUPLE_IP | NLA_F_NESTED,
+            testAttr(CTA_IP_V4_SRC, net.ParseIP(src).To4()),
+            testAttr(CTA_IP_V4_DST, net.ParseIP(dst).To4()),
+        ),
+        testAttr(CTA_TUPLE_PROTO | NLA_F_NESTED,
+            testAttr(CTA_PROTO_NUM, []byte{syscall.IPPROTO_TCP}),
+            testAttr(CTA_PROTO_SRC_PORT | NLA_F_NET_BYTEORDER, testU16(srcPort)),
+            testAttr(CTA_PROTO_DST_PORT | NLA_F_NET_BYTEORDER, testU16(dstPort)),
+        ),
+    )
+}
+
+func testMessage(msgType uint16, attrs ...[]byte) syscall.NetlinkMessage {
+    data := []byte{syscall.AF_INET, 0, 0, 0}
+
+    for _, attr := range attrs {
+        data = append(data, attr...)
+    }
+
+    return syscall.NetlinkMessage{
+        Header: syscall.NlMsghdr{Type: NFNL_SUBSYS_CTNETLINK << 8 | msgType},
+        Data:   data,
+    }
+}
+
+var testStart = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestParseEvent(t *testing.T) {
+    msg := testMessage(IPCTNL_MSG_CT_DELETE,
+        testTuple(CTA_TUPLE_ORIG, "192.0.2.1", 40000, "10.0.1.1", 80),
+        testTuple(CTA_TUPLE_REPLY, "10.1.0.1", 8080, "192.0.2.1", 40000),
+        testAttr(CTA_ID, testU32(1337)),
+        testAttr(CTA_COUNTERS_ORIG | NLA_F_NESTED, testAttr(CTA_COUNTERS_PACKETS, testU64(10)), testAttr(CTA_COUNTERS_BYTES, testU64(1000))),
+        testAttr(CTA_COUNTERS_REPLY | NLA_F_NESTED, testAttr(CTA_COUNTERS_PACKETS, testU64(20)), testAttr(CTA_COUNTERS_BYTES, testU64(20000))),
+        testAttr(CTA_TIMESTAMP | NLA_F_NESTED,
+            testAttr(CTA_TIMESTAMP_START, testU64(uint64(testStart.UnixNano()))),
+            testAttr(CTA_TIMESTAMP_STOP, testU64(uint64(testStart.Add(1500 * time.Millisecond).UnixNano()))),
+        ),
+    )
+
+    event, err := parseEvent(msg)
+    if err != nil {
+        t.Fatalf("parseEvent: %v", err)
+    } else if event == nil {
+        t.Fatalf("parseEvent: nil")
+    }
+
+    if event.Type != DestroyEvent || event.ID != 1337 {
+        t.Errorf("parseEvent: %v %d", event.Type, event.ID)
+    }
+    if !event.Orig.Src.Equal(net.ParseIP("192.0.2.1")) || event.Orig.SrcPort != 40000 || !event.Orig.Dst.Equal(net.ParseIP("10.0.1.1")) || event.Orig.DstPort != 80 || event.Orig.Protocol != syscall.IPPROTO_TCP {
+        t.Errorf("parseEvent orig: %+v", event.Orig)
+    }
+    if !event.Reply.Src.Equal(net.ParseIP("10.1.0.1")) || event.Reply.SrcPort != 8080 {
+        t.Errorf("parseEvent reply: %+v", event.Reply)
+    }
+    if event.OrigCounters != (Counters{10, 1000}) || event.ReplyCounters != (Counters{20, 20000}) {
+        t.Errorf("parseEvent counters: %+v %+v", event.OrigCounters, event.ReplyCounters)
+    }
+    if !event.Start.Equal(testStart) || event.Stop.Sub(event.Start) != 1500 * time.Millisecond {
+        t.Errorf("parseEvent timestamp: %v %v", event.Start, event.Stop)
+    }
+
+    // other messages are ignored
+    if event, err := parseEvent(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.NLMSG_DONE}}); err != nil || event != nil {
+        t.Errorf("parseEvent NLMSG_DONE: %v %v", event, err)
+    }
+
+    if _, err := parseEvent(testMessage(IPCTNL_MSG_CT_NEW, []byte{0xff, 0x00, 0x01, 0x00})); err == nil {
+        t.Errorf("parseEvent invalid: no error")
+    }
+}
+
+func TestLoggerEvent(t *testing.T) {
+    logger := &Logger{starts: make(map[uint32]time.Time)}
+
+    logger.SetVIPs(map[VIP]string{
+        MakeVIP(syscall.IPPROTO_TCP, net.ParseIP("10.0.1.1"), 80): "web",
+    })
+
+    newEvent := Event{
+        Type:   NewEvent,
+        ID:     1,
+        Orig:   Tuple{Src: net.ParseIP("192.0.2.1").To4(), Dst: net.ParseIP("10.0.1.1").To4(), Protocol: syscall.IPPROTO_TCP, SrcPort: 40000, DstPort: 80},
+        Reply:  Tuple{Src: net.ParseIP("10.1.0.1").To4(), Dst: net.ParseIP("192.0.2.1").To4(), Protocol: syscall.IPPROTO_TCP, SrcPort: 8080, DstPort: 40000},
+    }
+    destroyEvent := newEvent
+    destroyEvent.Type = DestroyEvent
+    destroyEvent.OrigCounters = Counters{10, 1000}
+    destroyEvent.ReplyCounters = Counters{20, 20000}
+
+    otherEvent := destroyEvent
+    otherEvent.Orig.DstPort = 443
+
+    if connection := logger.event(newEvent, testStart); connection != nil {
+        t.Errorf("new: %+v", connection)
+    }
+    if connection := logger.event(otherEvent, testStart.Add(1 * time.Second)); connection != nil {
+        t.Errorf("other VIP: %+v", connection)
+    }
+
+    connection := logger.event(destroyEvent, testStart.Add(2 * time.Second))
+
+    if connection == nil {
+        t.Fatalf("destroy: nil")
+    }
+    if connection.Service != "web" || connection.Protocol != "tcp" || connection.Client != "192.0.2.1:40000" || connection.VIP != "10.0.1.1:80" || connection.Backend != "10.1.0.1:8080" {
+        t.Errorf("destroy: %+v", connection)
+    }
+    if connection.Duration != 2.0 || connection.InBytes != 1000 || connection.OutBytes != 20000 || connection.OutPackets != 20 {
+        t.Errorf("destroy counters: %+v", connection)
+    }
+    if len(logger.starts) != 0 {
+        t.Errorf("starts: %v", logger.starts)
+    }
+}
@@ -0,0 +1,206 @@
+package conntrack
+/*
+ * Structured connection logs for the conntrack events of the managed VIPs, as L4 access logs.
+ */
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net"
+    "os"
+    "strconv"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// Limit the NEW event times tracked for kernels without conntrack timestamps
+const LOG_MAX_STARTS = 1000 * 1000
+
+// Comparable key for a VIP
+type VIP struct {
+    Protocol    uint8
+    Addr        [16]byte
+    Port        uint16
+}
+
+func MakeVIP(protocol uint8, addr net.IP, port uint16) (vip VIP) {
+    vip.Protocol = protocol
+    copy(vip.Addr[:], addr.To16())
+    vip.Port = port
+
+    return
+}
+
+// A logged connection, written as a line of JSON
+type Connection struct {
+    Time        time.Time   `json:"time"`
+    Service     string      `json:"service"`
+    Protocol    string      `json:"protocol"`
+    Client      string      `json:"client"`
+    VIP         string      `json:"vip"`
+    Backend     string      `json:"backend"`
+    Duration    float64     `json:"duration,omitempty"`     // seconds; zero if unknown
+    InPackets   uint64      `json:"in_packets"`
+    InBytes     uint64      `json:"in_bytes"`
+    OutPackets  uint64      `json:"out_packets"`
+    OutBytes    uint64      `json:"out_bytes"`
+}
+
+func protocolName(protocol uint8) string {
+    switch protocol {
+    case syscall.IPPROTO_TCP:
+        return "tcp"
+    case syscall.IPPROTO_UDP:
+        return "udp"
+    case syscall.IPPROTO_SCTP:
+        return "sctp"
+    default:
+        return strconv.Itoa(int(protocol))
+    }
+}
+
+func hostPort(ip net.IP, port uint16) string {
+    return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+type LogConfig struct {
+    Path        string      // append to file, or "-" for stdout
+}
+
+type Logger struct {
+    conn        *Conn
+    file        io.WriteCloser
+    encoder     *json.Encoder
+
+    mutex       sync.Mutex
+    vips        map[VIP]string
+
+    // NEW event times by conntrack ID, used if the kernel does not have conntrack timestamps
+    starts      map[uint32]time.Time
+}
+
+func (self LogConfig) Open() (*Logger, error) {
+    logger := &Logger{
+        vips:   make(map[VIP]string),
+        starts: make(map[uint32]time.Time),
+    }
+
+    if self.Path == "-" {
+        logger.file = os.Stdout
+    } else if file, err := os.OpenFile(self.Path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644); err != nil {
+        return nil, err
+    } else {
+        logger.file = file
+    }
+
+    if conn, err := Open(); err != nil {
+        logger.file.Close()
+        return nil, err
+    } else {
+        logger.conn = conn
+    }
+
+    logger.encoder = json.NewEncoder(logger.file)
+
+    return logger, nil
+}
+
+// Replace the set of VIPs to log, by service name; safe to call from any goroutine
+func (self *Logger) SetVIPs(vips map[VIP]string) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.vips = vips
+}
+
+func (self *Logger) lookup(tuple Tuple) (string, bool) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    name, exists := self.vips[MakeVIP(tuple.Protocol, tuple.Dst, tuple.DstPort)]
+
+    return name, exists
+}
+
+// Log the connection for any DestroyEvent for a managed VIP, returning nil if ignored
+func (self *Logger) event(event Event, now time.Time) *Connection {
+    serviceName, exists := self.lookup(event.Orig)
+    if !exists {
+        return nil
+    }
+
+    switch event.Type {
+    case NewEvent:
+        if event.Start.IsZero() && len(self.starts) < LOG_MAX_STARTS {
+            self.starts[event.ID] = now
+        }
+
+        return nil
+
+    case DestroyEvent:
+        connection := Connection{
+            Time:       now,
+            Service:    serviceName,
+            Protocol:   protocolName(event.Orig.Protocol),
+            Client:     hostPort(event.Orig.Src, event.Orig.SrcPort),
+            VIP:        hostPort(event.Orig.Dst, event.Orig.DstPort),
+            Backend:    hostPort(event.Reply.Src, event.Reply.SrcPort),
+            InPackets:  event.OrigCounters.Packets,
+            InBytes:    event.OrigCounters.Bytes,
+            OutPackets: event.ReplyCounters.Packets,
+            OutBytes:   event.ReplyCounters.Bytes,
+        }
+
+        if !event.Start.IsZero() && !event.Stop.IsZero() {
+            connection.Duration = event.Stop.Sub(event.Start).Seconds()
+        } else if start, exists := self.starts[event.ID]; exists {
+            connection.Duration = now.Sub(start).Seconds()
+        }
+
+        delete(self.starts, event.ID)
+
+        return &connection
+
+    default:
+        return nil
+    }
+}
+
+// Read and log events until the conntrack socket fails
+func (self *Logger) Run() error {
+    for {
+        events, err := self.conn.Read()
+
+        if errors.Is(err, syscall.ENOBUFS) {
+            log.Printf("conntrack:Logger: dropped events\n")
+            continue
+        } else if err == nil {
+
+        } else if errs.Classify(err) == errs.Internal {
+            // skip any invalid messages
+            log.Printf("conntrack:Logger: %v\n", err)
+        } else {
+            return err
+        }
+
+        now := time.Now()
+
+        for _, event := range events {
+            if connection := self.event(event, now); connection == nil {
+
+            } else if err := self.encoder.Encode(connection); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+func (self *Logger) Close() error {
+    self.conn.Close()
+
+    return self.file.Close()
+}
@@ -0,0 +1,132 @@
+package clusterf
+/*
+ * The merging of config backends into the IPVS dests, exposed via the HTTP API.
+ *
+ * Backends of the same or different services resolving to the same IPVS service and dest are merged into a single dest, using the
+ * sum of their weights, which can be surprising when debugging the balancing between backends.
+ */
+
+import (
+    "sort"
+)
+
+// A config backend merged into a dest
+type DestBackend struct {
+    Service     string  `json:"service"`
+    Backend     string  `json:"backend"`   // group/backend for any group backends
+    Weight      uint32  `json:"weight"`    // zero for standby or drained backends
+
+    Standby     bool    `json:"standby,omitempty"`
+    Drain       bool    `json:"drain,omitempty"`
+}
+
+// The state of a programmed dest, and the config backends merged into it
+type DestStatus struct {
+    Service     string  `json:"service"`   // ipvs service, e.g. inet+tcp://10.0.1.1:80
+    Dest        string  `json:"dest"`
+    FwdMethod   string  `json:"fwd_method"`
+    Weight      uint32  `json:"weight"`    // effective weight, the sum of the backend weights
+    Merged      bool    `json:"merged"`
+
+    Backends    []DestBackend   `json:"backends"`
+}
+
+// Call the given func for each active driver backend of the service
+func (self *Service) eachDriverBackend(f func(backendName string, driverBackend *ipvsBackend)) {
+    for backendName, driverBackend := range self.driverBackends {
+        f(backendName, driverBackend)
+    }
+    for groupKey, driverBackend := range self.driverGroupBackends {
+        f(groupKey, driverBackend)
+    }
+    if self.driverLocal != nil {
+        f(LOCAL_BACKEND, self.driverLocal)
+    }
+}
+
+// Return the status of each dest, with the backends merged into it, sorted by service and dest.
+//
+// Only returns the dests with any backends of the named service, if given.
+func (self *Services) DestStatus(serviceName string) []DestStatus {
+    var dests = make(map[ipvsKey]*DestStatus)
+    var keys []ipvsKey
+    var statuses = make([]DestStatus, 0)
+
+    for _, service := range self.services {
+        if service.driverFrontend == nil {
+            continue
+        }
+
+        service.eachDriverBackend(func(backendName string, driverBackend *ipvsBackend) {
+            for ipvsType, ipvsDest := range driverBackend.state {
+                ipvsService := service.driverFrontend.state[ipvsType]
+
+                if ipvsDest == nil || ipvsService == nil {
+                    continue
+                }
+
+                key := makeKey(ipvsService, ipvsDest)
+                dest := dests[key]
+
+                if dest == nil {
+                    dest = &DestStatus{
+                        Service:    ipvsService.String(),
+                        Dest:       ipvsDest.String(),
+                        FwdMethod:  ipvsDest.FwdMethod.String(),
+                        Weight:     ipvsDest.Weight,
+                    }
+                    dests[key] = dest
+                    keys = append(keys, key)
+                }
+
+                dest.Backends = append(dest.Backends, DestBackend{
+                    Service:    service.Name,
+                    Backend:    backendName,
+                    Weight:     driverBackend.weight,
+                    Standby:    driverBackend.standby,
+                    Drain:      driverBackend.drain,
+                })
+            }
+        })
+    }
+
+    for _, key := range keys {
+        dest := dests[key]
+
+        if serviceName != "" && !dest.hasService(serviceName) {
+            continue
+        }
+
+        sort.Slice(dest.Backends, func(i, j int) bool {
+            if dest.Backends[i].Service != dest.Backends[j].Service {
+                return dest.Backends[i].Service < dest.Backends[j].Service
+            } else {
+                return dest.Backends[i].Backend < dest.Backends[j].Backend
+            }
+        })
+
+        dest.Merged = len(dest.Backends) > 1
+
+        statuses = append(statuses, *dest)
+    }
+
+    sort.Slice(statuses, func(i, j int) bool {
+        if statuses[i].Service != statuses[j].Service {
+            return statuses[i].Service < statuses[j].Service
+        } else {
+            return statuses[i].Dest < statuses[j].Dest
+        }
+    })
+
+    return statuses
+}
+
+func (self DestStatus) hasService(serviceName string) bool {
+    for _, backend := range self.Backends {
+        if backend.Service == serviceName {
+            return true
+        }
+    }
+
+    return false
+}
@@ -0,0 +1,55 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "reflect"
+    "testing"
+)
+
+func TestDestStatus(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Group:"web"}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight: 20}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Drain: true}})
+    services.NewConfig(&config.ConfigGroupBackend{ConfigSource:"test", GroupName:"web", BackendName:"web1", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"alias", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"alias", BackendName:"alias1", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"other", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"other", BackendName:"other1", Backend:config.ServiceBackend{IPv4:"10.1.0.3", TCP:80}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", Mock: true}); err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    var dests []string
+
+    for _, dest := range services.DestStatus("test") {
+        str := fmt.Sprintf("%s %s %s %d merged=%v:", dest.Service, dest.Dest, dest.FwdMethod, dest.Weight, dest.Merged)
+
+        for _, backend := range dest.Backends {
+            str += fmt.Sprintf(" %s/%s=%d", backend.Service, backend.Backend, backend.Weight)
+
+            if backend.Drain {
+                str += " drain"
+            }
+        }
+
+        dests = append(dests, str)
+    }
+
+    if !reflect.DeepEqual(dests, []string{
+        "inet+tcp://10.0.1.1:80 10.1.0.1:80 masq 20 merged=true: test/test1=20 test/test2=0 drain",
+        "inet+tcp://10.0.1.1:80 10.1.0.2:80 masq 20 merged=true: alias/alias1=10 test/web/web1=10",
+    }) {
+        t.Errorf("DestStatus test: %#v", dests)
+    }
+
+    if statuses := services.DestStatus(""); len(statuses) != 3 || statuses[2].Dest != "10.1.0.3:80" || statuses[2].Merged {
+        t.Errorf("DestStatus: %#v", statuses)
+    }
+    if statuses := services.DestStatus("missing"); len(statuses) != 0 {
+        t.Errorf("DestStatus missing: %#v", statuses)
+    }
+}
@@ -0,0 +1,138 @@
+package errs
+/*
+ * Error classes shared across the config, ipvs and clusterf packages.
+ *
+ * Errors are wrapped with their class where they originate, so that callers can decide whether to retry, and count errors by class,
+ * without matching on the error strings.
+ */
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "sync/atomic"
+)
+
+type Class int
+
+const (
+    Internal    Class   = iota  // bugs or unexpected errors, including any unclassified errors
+    Config                      // invalid or rejected configuration, not fixed by retrying
+    Backend                     // failed requests to the config backend (etcd) or any other external service
+    Kernel                      // failed netlink requests to the kernel
+)
+
+var classNames = []string{"internal", "config", "backend", "kernel"}
+
+func (self Class) String() string {
+    if self >= 0 && int(self) < len(classNames) {
+        return classNames[self]
+    } else {
+        return fmt.Sprintf("Class(%d)", int(self))
+    }
+}
+
+// Backend and kernel errors may succeed on retry; invalid configs and internal errors will not.
+func (self Class) Temporary() bool {
+    return self == Backend || self == Kernel
+}
+
+// Classified error, wrapping the original error
+type Error struct {
+    Class   Class
+    Err     error
+}
+
+func (self *Error) Error() string {
+    return self.Err.Error()
+}
+
+func (self *Error) Unwrap() error {
+    return self.Err
+}
+
+// Wrap the error with the given class, unless nil or already classified
+func Wrap(class Class, err error) error {
+    var classErr *Error
+
+    if err == nil {
+        return nil
+    } else if errors.As(err, &classErr) {
+        return err
+    } else {
+        return &Error{Class: class, Err: err}
+    }
+}
+
+func ConfigError(err error) error {
+    return Wrap(Config, err)
+}
+
+func BackendError(err error) error {
+    return Wrap(Backend, err)
+}
+
+func KernelError(err error) error {
+    return Wrap(Kernel, err)
+}
+
+func InternalError(err error) error {
+    return Wrap(Internal, err)
+}
+
+// Return the class of the error, or Internal for any unclassified errors
+func Classify(err error) Class {
+    var classErr *Error
+
+    if errors.As(err, &classErr) {
+        return classErr.Class
+    } else {
+        return Internal
+    }
+}
+
+// Return true if the error may succeed on retry
+func Temporary(err error) bool {
+    return Classify(err).Temporary()
+}
+
+// Count errors by class, safe to use from any goroutine
+type Counter struct {
+    counts  [4]uint64
+}
+
+func (self *Counter) Count(err error) Class {
+    class := Classify(err)
+
+    if class >= 0 && int(class) < len(self.counts) {
+        atomic.AddUint64(&self.counts[class], 1)
+    }
+
+    return class
+}
+
+func (self *Counter) Stats() Stats {
+    return Stats{
+        Internal:   atomic.LoadUint64(&self.counts[Internal]),
+        Config:     atomic.LoadUint64(&self.counts[Config]),
+        Backend:    atomic.LoadUint64(&self.counts[Backend]),
+        Kernel:     atomic.LoadUint64(&self.counts[Kernel]),
+    }
+}
+
+type Stats struct {
+    Internal    uint64
+    Config      uint64
+    Backend     uint64
+    Kernel      uint64
+}
+
+// Write the error stats in the Prometheus text format
+func (self Stats) WriteMetrics(w io.Writer) {
+    fmt.Fprintf(w, "# HELP clusterf_errors_total Errors by class\n")
+    fmt.Fprintf(w, "# TYPE clusterf_errors_total counter\n")
+    fmt.Fprintf(w, "clusterf_errors_total{class=\"%s\"} %d\n", Internal, self.Internal)
+    fmt.Fprintf(w, "clusterf_errors_total{class=\"%s\"} %d\n", Config, self.Config)
+    fmt.Fprintf(w, "clusterf_errors_total{class=\"%s\"} %d\n", Backend, self.Backend)
+    fmt.Fprintf(w, "clusterf_errors_total{class=\"%s\"} %d\n", Kernel, self.Kernel)
+}
@@ -0,0 +1,65 @@
+package errs
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "strings"
+    "syscall"
+    "testing"
+)
+
+func TestClassify(t *testing.T) {
+    tests := []struct{
+        err         error
+        class       Class
+        temporary   bool
+    }{
+        {fmt.Errorf("test"), Internal, false},
+        {InternalError(fmt.Errorf("test")), Internal, false},
+        {ConfigError(fmt.Errorf("test")), Config, false},
+        {BackendError(fmt.Errorf("test")), Backend, true},
+        {KernelError(syscall.ENOENT), Kernel, true},
+        {fmt.Errorf("wrapped: %w", KernelError(syscall.ENOENT)), Kernel, true},
+
+        // the original class is kept
+        {ConfigError(fmt.Errorf("wrapped: %w", BackendError(fmt.Errorf("test")))), Backend, true},
+    }
+
+    for _, test := range tests {
+        if class := Classify(test.err); class != test.class {
+            t.Errorf("Classify %v: %v != %v", test.err, class, test.class)
+        }
+        if temporary := Temporary(test.err); temporary != test.temporary {
+            t.Errorf("Temporary %v: %v != %v", test.err, temporary, test.temporary)
+        }
+    }
+
+    if err := KernelError(nil); err != nil {
+        t.Errorf("KernelError nil: %#v", err)
+    }
+    if err := KernelError(syscall.ENOENT); !errors.Is(err, syscall.ENOENT) || err.Error() != syscall.ENOENT.Error() {
+        t.Errorf("KernelError ENOENT: %v", err)
+    }
+}
+
+func TestCounter(t *testing.T) {
+    var counter Counter
+
+    counter.Count(fmt.Errorf("test"))
+    counter.Count(ConfigError(fmt.Errorf("test")))
+    counter.Count(KernelError(syscall.EEXIST))
+    counter.Count(KernelError(syscall.ENOENT))
+
+    if stats := counter.Stats(); stats != (Stats{Internal: 1, Config: 1, Kernel: 2}) {
+        t.Errorf("Stats: %#v", stats)
+    }
+
+    var buf bytes.Buffer
+
+    counter.Stats().WriteMetrics(&buf)
+
+    if metrics := buf.String(); !strings.Contains(metrics, "clusterf_errors_total{class=\"kernel\"} 2\n") || !strings.Contains(metrics, "clusterf_errors_total{class=\"backend\"} 0\n") {
+        t.Errorf("WriteMetrics:\n%s", metrics)
+    }
+}
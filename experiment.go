@@ -0,0 +1,298 @@
+package clusterf
+/*
+ * A/B weight experiments, using the alternate backend weights of the active experiment for the service.
+ *
+ * The start and stop of each experiment is recorded by the driver, and the per-backend traffic stats before and after the start are
+ * recorded by IPVSStats, so that any changes in the traffic can be attributed to the experiment. The stats are only recorded to within
+ * the stats update interval.
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "encoding/json"
+    "github.com/qmsk/clusterf/ipvs"
+    "log"
+    "net/http"
+    "sort"
+    "time"
+)
+
+/* Service experiments */
+func (self *Service) configExperiment(experimentName string, action config.Action, experimentConfig *config.ConfigServiceExperiment) {
+    log.Printf("clusterf:Service %s: Experiment %s: %s %v <- %v\n", self.Name, experimentName, action, experimentConfig.Experiment, self.Experiments[experimentName])
+
+    switch action {
+    case config.NewConfig, config.SetConfig:
+        self.Experiments[experimentName] = experimentConfig.Experiment
+
+    case config.DelConfig:
+        delete(self.Experiments, experimentName)
+    }
+
+    if action != config.NewConfig {
+        self.syncExperiment()
+    }
+}
+
+// Return the name of the active experiment, or "". Only the first active experiment by name is used.
+func (self *Service) activeExperiment() string {
+    var names []string
+
+    for experimentName, experiment := range self.Experiments {
+        if experiment.Active {
+            names = append(names, experimentName)
+        }
+    }
+
+    if len(names) == 0 {
+        return ""
+    }
+
+    sort.Strings(names)
+
+    return names[0]
+}
+
+// Return the backend with the weight of the active experiment, if any.
+// Group backends are named by group/backend.
+func (self *Service) experimentBackend(backendName string, backend config.ServiceBackend) config.ServiceBackend {
+    if experimentName := self.activeExperiment(); experimentName == "" {
+        return backend
+    } else {
+        return self.Experiments[experimentName].Backend(backendName, backend)
+    }
+}
+
+// Record the start or stop of the active experiment, and update the backend weights
+func (self *Service) syncExperiment() {
+    driver := self.driverFrontend.driver
+
+    if experimentName := self.activeExperiment(); experimentName != self.experiment {
+        log.Printf("clusterf:Service %s: active experiment %#v <- %#v\n", self.Name, experimentName, self.experiment)
+
+        if self.experiment != "" {
+            driver.stopExperiment(self.Name)
+        }
+        if experimentName != "" {
+            driver.startExperiment(self.Name, experimentName)
+        }
+
+        self.experiment = experimentName
+    }
+
+    if self.Frontend == nil {
+        return
+    }
+
+    for backendName, driverBackend := range self.driverBackends {
+        backend := self.experimentBackend(backendName, self.Backends[backendName])
+
+        if driverBackend.configWeight == backend.Weight && driverBackend.drain == backend.Drain {
+            // unchanged
+        } else if err := driverBackend.set(backend); err != nil {
+            self.driverError(err)
+        }
+    }
+
+    self.syncGroupBackends()
+    self.syncBackends()
+}
+
+// Record the stop of any active experiment, when deleting the service
+func (self *Service) delExperiment() {
+    if self.experiment != "" {
+        self.driverFrontend.driver.stopExperiment(self.Name)
+    }
+
+    self.experiment = ""
+}
+
+/* Driver experiments */
+type driverExperiment struct {
+    name        string
+    start       time.Time
+    stop        time.Time
+}
+
+func (self *IPVSDriver) startExperiment(serviceName string, experimentName string) {
+    log.Printf("clusterf:ipvs %s: start experiment %s\n", serviceName, experimentName)
+
+    self.experiments[serviceName] = &driverExperiment{name: experimentName, start: time.Now()}
+}
+
+func (self *IPVSDriver) stopExperiment(serviceName string) {
+    if experiment := self.experiments[serviceName]; experiment != nil && experiment.stop.IsZero() {
+        log.Printf("clusterf:ipvs %s: stop experiment %s\n", serviceName, experiment.name)
+
+        experiment.stop = time.Now()
+    }
+}
+
+/* Experiment stats */
+type ExperimentBackend struct {
+    Name        string      `json:"name"`
+
+    // rates over the stats interval before the experiment started
+    Before      StatsRates  `json:"before"`
+
+    // average rates since the experiment started, until it was stopped
+    After       StatsRates  `json:"after"`
+
+    // counters at the start of the experiment, or when the backend was first seen
+    start       ipvs.Stats
+    time        time.Time
+}
+
+// The stats of an experiment, exposed via the HTTP API
+type ExperimentResult struct {
+    Service     string      `json:"service"`
+    Name        string      `json:"name"`
+    Active      bool        `json:"active"`
+    Start       time.Time   `json:"start"`
+    Stop        time.Time   `json:"stop"`
+
+    Backends    []ExperimentBackend `json:"backends"`
+
+    backends    map[string]*ExperimentBackend
+}
+
+type experimentStats struct {
+    stats       ipvs.Stats
+    rates       StatsRates
+}
+
+// Sum up the stats of the dests for each backend of the named service
+func serviceBackendStats(services map[ipvsServiceKey]*serviceStats, serviceName string) map[string]*experimentStats {
+    var backends = make(map[string]*experimentStats)
+
+    for _, service := range services {
+        if service.Name != serviceName {
+            continue
+        }
+
+        for _, dest := range service.dests {
+            if dest.Name == "" {
+                continue
+            }
+
+            backend := backends[dest.Name]
+
+            if backend == nil {
+                backend = &experimentStats{}
+                backends[dest.Name] = backend
+            }
+
+            backend.stats.Conns += dest.Dest.Stats.Conns
+            backend.stats.InPkts += dest.Dest.Stats.InPkts
+            backend.stats.OutPkts += dest.Dest.Stats.OutPkts
+            backend.stats.InBytes += dest.Dest.Stats.InBytes
+            backend.stats.OutBytes += dest.Dest.Stats.OutBytes
+
+            backend.rates.Conns += dest.Rates.Conns
+            backend.rates.InPkts += dest.Rates.InPkts
+            backend.rates.OutPkts += dest.Rates.OutPkts
+            backend.rates.InBytes += dest.Rates.InBytes
+            backend.rates.OutBytes += dest.Rates.OutBytes
+        }
+    }
+
+    return backends
+}
+
+// Update the experiment stats from the new snapshot, before replacing the previous snapshot
+func (self *IPVSStats) updateExperiments(now time.Time, services map[ipvsServiceKey]*serviceStats) {
+    for serviceName, experiment := range self.driver.experiments {
+        key := serviceName + "/" + experiment.name
+        result := self.experiments[key]
+
+        if result == nil || !result.Start.Equal(experiment.start) {
+            // started since the previous snapshot, which has the rates before the start
+            result = &ExperimentResult{
+                Service:    serviceName,
+                Name:       experiment.name,
+                Start:      experiment.start,
+                backends:   make(map[string]*ExperimentBackend),
+            }
+
+            for backendName, stats := range serviceBackendStats(self.services, serviceName) {
+                result.backends[backendName] = &ExperimentBackend{Name: backendName, Before: stats.rates, start: stats.stats, time: self.time}
+            }
+
+            self.experiments[key] = result
+
+        } else if !result.Active {
+            // already stopped
+            continue
+        }
+
+        for backendName, stats := range serviceBackendStats(services, serviceName) {
+            backend := result.backends[backendName]
+
+            if backend == nil {
+                backend = &ExperimentBackend{Name: backendName, start: stats.stats, time: now}
+                result.backends[backendName] = backend
+            }
+
+            backend.After = makeRates(backend.start, stats.stats, now.Sub(backend.time).Seconds())
+        }
+
+        result.Active = experiment.stop.IsZero()
+        result.Stop = experiment.stop
+    }
+
+    // any experiments replaced by another experiment since the previous snapshot
+    for _, result := range self.experiments {
+        if experiment := self.driver.experiments[result.Service]; !result.Active {
+
+        } else if experiment == nil || experiment.name != result.Name || !experiment.start.Equal(result.Start) {
+            result.Active = false
+            result.Stop = now
+        }
+    }
+}
+
+// Return the stats of the current and previous experiments, sorted by service and name
+func (self *IPVSStats) Experiments() []ExperimentResult {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    var results = make([]ExperimentResult, 0, len(self.experiments))
+
+    for _, result := range self.experiments {
+        var backendNames []string
+
+        for backendName, _ := range result.backends {
+            backendNames = append(backendNames, backendName)
+        }
+
+        sort.Strings(backendNames)
+
+        experimentResult := *result
+        experimentResult.Backends = make([]ExperimentBackend, 0, len(backendNames))
+
+        for _, backendName := range backendNames {
+            experimentResult.Backends = append(experimentResult.Backends, *result.backends[backendName])
+        }
+
+        results = append(results, experimentResult)
+    }
+
+    sort.Slice(results, func(i, j int) bool {
+        if results[i].Service != results[j].Service {
+            return results[i].Service < results[j].Service
+        } else {
+            return results[i].Name < results[j].Name
+        }
+    })
+
+    return results
+}
+
+// Serve the /experiments endpoint
+func (self *IPVSStats) ServeExperiments(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if err := json.NewEncoder(w).Encode(self.Experiments()); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
@@ -0,0 +1,117 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "testing"
+    "time"
+)
+
+func TestServiceExperiment(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+    services.NewConfig(&config.ConfigServiceExperiment{ConfigSource:"test", ServiceName:"test", ExperimentName:"canary", Experiment:config.ServiceExperiment{Weights:map[string]uint{"test1": 30, "test2": 0}}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    test1Key := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
+    test2Key := testKey("inet+tcp://10.0.1.1:80", "10.1.0.2:80")
+
+    for _, step := range []struct{
+        active      bool
+        weight1     uint32
+        weight2     uint32
+    }{
+        {false, 10, 10},
+        {true,  30, 0},
+        {false, 10, 10},
+    } {
+        services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceExperiment{ConfigSource:"test", ServiceName:"test", ExperimentName:"canary", Experiment:config.ServiceExperiment{Weights:map[string]uint{"test1": 30, "test2": 0}, Active:step.active}}})
+
+        if dest := ipvsDriver.dests[test1Key]; dest == nil || dest.Weight != step.weight1 {
+            t.Errorf("experiment active=%v: test1 dest weight != %d: %v", step.active, step.weight1, dest)
+        }
+        if dest := ipvsDriver.dests[test2Key]; dest == nil || dest.Weight != step.weight2 {
+            t.Errorf("experiment active=%v: test2 dest weight != %d: %v", step.active, step.weight2, dest)
+        }
+    }
+
+    if experiment := ipvsDriver.experiments["test"]; experiment == nil || experiment.name != "canary" {
+        t.Errorf("driver experiment: %#v", experiment)
+    } else if experiment.start.IsZero() || experiment.stop.IsZero() {
+        t.Errorf("driver experiment not started and stopped: %#v", experiment)
+    }
+
+    // backend changes apply at the experiment weight
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceExperiment{ConfigSource:"test", ServiceName:"test", ExperimentName:"canary", Experiment:config.ServiceExperiment{Weights:map[string]uint{"test1": 30}, Active:true}}})
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:20}}})
+
+    if dest := ipvsDriver.dests[test1Key]; dest == nil || dest.Weight != 30 {
+        t.Errorf("set backend during experiment: %v", dest)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceExperiment{ConfigSource:"test", ServiceName:"test", ExperimentName:"canary"}})
+
+    if dest := ipvsDriver.dests[test1Key]; dest == nil || dest.Weight != 20 {
+        t.Errorf("delete experiment: %v", dest)
+    }
+}
+
+func TestExperimentStats(t *testing.T) {
+    driver := &IPVSDriver{experiments: make(map[string]*driverExperiment)}
+    stats := driver.NewStats()
+    now := time.Now()
+
+    stats.update(now, testStats(10, 1000))
+    stats.update(now.Add(10 * time.Second), testStats(30, 6000))
+
+    driver.experiments["test"] = &driverExperiment{name: "canary", start: now.Add(15 * time.Second)}
+
+    for _, step := range []struct{
+        elapsed     time.Duration
+        conns       uint64
+        inBytes     uint64
+        stop        bool
+
+        active      bool
+        after       StatsRates
+    }{
+        {20 * time.Second, 50, 7000, false,     true, StatsRates{Conns: 2, InBytes: 100}},
+        {30 * time.Second, 90, 8000, false,     true, StatsRates{Conns: 3, InBytes: 100}},
+        {40 * time.Second, 120, 9000, true,     false, StatsRates{Conns: 3, InBytes: 100}},
+        {50 * time.Second, 500, 9000, false,    false, StatsRates{Conns: 3, InBytes: 100}},
+    } {
+        if step.stop {
+            driver.experiments["test"].stop = now.Add(step.elapsed)
+        }
+
+        stats.update(now.Add(step.elapsed), testStats(step.conns, step.inBytes))
+
+        results := stats.Experiments()
+
+        if len(results) != 1 {
+            t.Fatalf("experiment results: %#v", results)
+        }
+
+        result := results[0]
+
+        if result.Service != "test" || result.Name != "canary" || result.Active != step.active {
+            t.Errorf("experiment %v: result: %#v", step.elapsed, result)
+        }
+
+        if len(result.Backends) != 1 {
+            t.Errorf("experiment %v: backends: %#v", step.elapsed, result.Backends)
+        } else if backend := result.Backends[0]; backend.Name != "test1" {
+            t.Errorf("experiment %v: backend name: %v", step.elapsed, backend.Name)
+        } else if backend.Before != (StatsRates{Conns: 2, InBytes: 500}) {
+            t.Errorf("experiment %v: before rates: %+v", step.elapsed, backend.Before)
+        } else if backend.After != step.after {
+            t.Errorf("experiment %v: after rates: %+v", step.elapsed, backend.After)
+        }
+    }
+}
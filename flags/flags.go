@@ -0,0 +1,120 @@
+package flags
+/*
+ * Command line flags, with defaults from the environment or a flags file.
+ *
+ * Any flag not given on the command line is taken from the CLUSTERF_* environment variable, e.g. CLUSTERF_ETCD_MACHINES for -etcd-machines,
+ * and then from the -flags-file, in that order of precedence.
+ */
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+)
+
+const ENV_PREFIX = "CLUSTERF_"
+
+// Return the environment variable name for the given flag
+func EnvName(name string) string {
+    return ENV_PREFIX + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Parse the command line flags, exiting on errors
+func Parse() {
+    if err := ParseFlagSet(flag.CommandLine, os.Args[1:]); err != nil {
+        fmt.Fprintf(os.Stderr, "%v\n", err)
+        flag.Usage()
+        os.Exit(2)
+    }
+}
+
+// Parse the args, and set any remaining flags from the environment and the -flags-file.
+func ParseFlagSet(flags *flag.FlagSet, args []string) error {
+    var flagsFile string
+
+    flags.StringVar(&flagsFile, "flags-file", "",
+        "Read any other flags from file, with one name=value per line")
+
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+
+    set := make(map[string]bool)
+
+    flags.Visit(func(f *flag.Flag) {
+        set[f.Name] = true
+    })
+
+    if err := parseEnv(flags, set); err != nil {
+        return err
+    }
+
+    if flagsFile == "" {
+        return nil
+    } else if err := parseFile(flags, set, flagsFile); err != nil {
+        return fmt.Errorf("%s: %v", flagsFile, err)
+    }
+
+    return nil
+}
+
+func parseEnv(flags *flag.FlagSet, set map[string]bool) error {
+    var err error
+
+    flags.VisitAll(func(f *flag.Flag) {
+        envName := EnvName(f.Name)
+
+        if set[f.Name] || err != nil {
+            return
+        } else if value, ok := os.LookupEnv(envName); !ok {
+            return
+        } else if setErr := flags.Set(f.Name, value); setErr != nil {
+            err = fmt.Errorf("%s=%s: %v", envName, value, setErr)
+        } else {
+            set[f.Name] = true
+        }
+    })
+
+    return err
+}
+
+// Read flags from the file, with one name=value per line. Empty lines and # comments are ignored.
+func parseFile(flags *flag.FlagSet, set map[string]bool, path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+
+    for lineNumber := 1; scanner.Scan(); lineNumber++ {
+        line := strings.TrimSpace(scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        parts := strings.SplitN(line, "=", 2)
+        name := strings.TrimPrefix(strings.TrimSpace(parts[0]), "-")
+        value := "true"
+
+        if len(parts) > 1 {
+            value = strings.TrimSpace(parts[1])
+        }
+
+        if flags.Lookup(name) == nil {
+            return fmt.Errorf("line %d: unknown flag: %s", lineNumber, name)
+        } else if set[name] {
+            continue
+        } else if err := flags.Set(name, value); err != nil {
+            return fmt.Errorf("line %d: %s=%s: %v", lineNumber, name, value, err)
+        } else {
+            set[name] = true
+        }
+    }
+
+    return scanner.Err()
+}
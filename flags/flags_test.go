@@ -0,0 +1,82 @@
+package flags
+
+import (
+    "flag"
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+func TestEnvName(t *testing.T) {
+    if envName := EnvName("etcd-machines"); envName != "CLUSTERF_ETCD_MACHINES" {
+        t.Errorf("EnvName: %v", envName)
+    }
+}
+
+func TestParse(t *testing.T) {
+    file, err := ioutil.TempFile("", "clusterf-flags")
+    if err != nil {
+        t.Fatalf("ioutil.TempFile: %v", err)
+    }
+    defer os.Remove(file.Name())
+
+    file.WriteString("# test\n\ntest-file=file\ntest-env=file\n-test-args=file\ntest-bool\n")
+    file.Close()
+
+    os.Setenv("CLUSTERF_TEST_ENV", "env")
+    os.Setenv("CLUSTERF_TEST_ARGS", "env")
+    os.Setenv("CLUSTERF_FLAGS_FILE", file.Name())
+    defer os.Unsetenv("CLUSTERF_TEST_ENV")
+    defer os.Unsetenv("CLUSTERF_TEST_ARGS")
+    defer os.Unsetenv("CLUSTERF_FLAGS_FILE")
+
+    flags := flag.NewFlagSet("test", flag.ContinueOnError)
+
+    testDefault := flags.String("test-default", "default", "")
+    testFile := flags.String("test-file", "default", "")
+    testEnv := flags.String("test-env", "default", "")
+    testArgs := flags.String("test-args", "default", "")
+    testBool := flags.Bool("test-bool", false, "")
+
+    if err := ParseFlagSet(flags, []string{"-test-args=args", "arg"}); err != nil {
+        t.Fatalf("ParseFlagSet: %v", err)
+    }
+
+    if *testDefault != "default" {
+        t.Errorf("test-default: %v", *testDefault)
+    }
+    if *testFile != "file" {
+        t.Errorf("test-file: %v", *testFile)
+    }
+    if *testEnv != "env" {
+        t.Errorf("test-env: %v", *testEnv)
+    }
+    if *testArgs != "args" {
+        t.Errorf("test-args: %v", *testArgs)
+    }
+    if *testBool != true {
+        t.Errorf("test-bool: %v", *testBool)
+    }
+    if args := flags.Args(); len(args) != 1 || args[0] != "arg" {
+        t.Errorf("args: %v", args)
+    }
+}
+
+func TestParseFileError(t *testing.T) {
+    file, err := ioutil.TempFile("", "clusterf-flags")
+    if err != nil {
+        t.Fatalf("ioutil.TempFile: %v", err)
+    }
+    defer os.Remove(file.Name())
+
+    file.WriteString("test-unknown=1\n")
+    file.Close()
+
+    flags := flag.NewFlagSet("test", flag.ContinueOnError)
+
+    if err := ParseFlagSet(flags, []string{"-flags-file=" + file.Name()}); err == nil {
+        t.Errorf("ParseFlagSet: no error for unknown flag")
+    } else if err.Error() != file.Name() + ": line 1: unknown flag: test-unknown" {
+        t.Errorf("ParseFlagSet: %v", err)
+    }
+}
@@ -0,0 +1,362 @@
+package clusterf
+/*
+ * Golden tests for the driver operations used to repair the kernel IPVS state.
+ *
+ * Each testdata/golden/* case has a config tree, the existing kernel state, and the expected operations from IPVSDriver.Verify().
+ * The kernel services may have flags=, timeout= and netmask= values, defaulting to a non-persistent service.
+ * Use `go test -run TestGolden -update` to rewrite the expected operations after any intended changes.
+ */
+
+import (
+    "context"
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/errs"
+    "flag"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "io/ioutil"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+    "testing"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the testdata/golden expected operations")
+
+// Fake kernel IPVS state, logging each operation
+type testClient struct {
+    services    map[string]ipvs.Service
+    dests       map[string]map[string]ipvs.Dest
+    daemons     []ipvs.Daemon
+    conns       []ipvs.Connection
+
+    ops         []string
+}
+
+func makeTestClient() *testClient {
+    return &testClient{
+        services:   make(map[string]ipvs.Service),
+        dests:      make(map[string]map[string]ipvs.Dest),
+    }
+}
+
+func (self *testClient) op(format string, args ...interface{}) {
+    self.ops = append(self.ops, fmt.Sprintf(format, args...))
+}
+
+func (self *testClient) SetDebugEnabled(enabled bool) { }
+
+func (self *testClient) GetInfo() (ipvs.Info, error) {
+    return ipvs.Info{}, nil
+}
+
+func (self *testClient) Flush() error {
+    self.op("flush")
+    self.services = make(map[string]ipvs.Service)
+    self.dests = make(map[string]map[string]ipvs.Dest)
+    return nil
+}
+
+func (self *testClient) ZeroService(service ipvs.Service) error {
+    self.op("zero-service %v", service)
+    return nil
+}
+
+func (self *testClient) ZeroAll() error {
+    self.op("zero")
+    return nil
+}
+
+func (self *testClient) GetTimeout() (ipvs.Timeout, error) {
+    return ipvs.Timeout{}, nil
+}
+
+func (self *testClient) SetTimeout(timeout ipvs.Timeout) error {
+    self.op("set-timeout %v", timeout)
+    return nil
+}
+
+func (self *testClient) ListDaemons() ([]ipvs.Daemon, error) {
+    return self.daemons, nil
+}
+
+func (self *testClient) NewDaemon(daemon ipvs.Daemon) error {
+    self.op("new-daemon %v", daemon)
+    self.daemons = append(self.daemons, daemon)
+    return nil
+}
+
+func (self *testClient) DelDaemon(state ipvs.DaemonState) error {
+    var daemons []ipvs.Daemon
+
+    self.op("del-daemon %v", state)
+
+    for _, daemon := range self.daemons {
+        if daemon.State != state {
+            daemons = append(daemons, daemon)
+        }
+    }
+
+    self.daemons = daemons
+    return nil
+}
+
+func (self *testClient) ListServices() (services []ipvs.Service, err error) {
+    for _, service := range self.services {
+        services = append(services, service)
+    }
+
+    sort.Slice(services, func(i, j int) bool { return services[i].String() < services[j].String() })
+
+    return services, nil
+}
+
+func (self *testClient) GetService(id ipvs.Service) (ipvs.Service, error) {
+    self.op("get-service %v", id)
+
+    if service, exists := self.services[id.String()]; !exists {
+        return service, errs.KernelError(ipvs.ErrServiceNotFound)
+    } else {
+        return service, nil
+    }
+}
+
+func (self *testClient) NewService(service ipvs.Service) error {
+    self.op("new-service %v %s", service, service.SchedName)
+
+    if _, exists := self.services[service.String()]; exists {
+        return errs.KernelError(ipvs.ErrServiceExists)
+    }
+
+    self.services[service.String()] = service
+    self.dests[service.String()] = make(map[string]ipvs.Dest)
+    return nil
+}
+
+func (self *testClient) SetService(service ipvs.Service) error {
+    self.op("set-service %v %s", service, service.SchedName)
+
+    if _, exists := self.services[service.String()]; !exists {
+        return errs.KernelError(ipvs.ErrServiceNotFound)
+    }
+
+    self.services[service.String()] = service
+    return nil
+}
+
+func (self *testClient) DelService(service ipvs.Service) error {
+    self.op("del-service %v", service)
+
+    if _, exists := self.services[service.String()]; !exists {
+        return errs.KernelError(ipvs.ErrServiceNotFound)
+    }
+
+    delete(self.services, service.String())
+    delete(self.dests, service.String())
+    return nil
+}
+
+func (self *testClient) ListDests(service ipvs.Service) (dests []ipvs.Dest, err error) {
+    for _, dest := range self.dests[service.String()] {
+        dests = append(dests, dest)
+    }
+
+    sort.Slice(dests, func(i, j int) bool { return dests[i].String() < dests[j].String() })
+
+    return dests, nil
+}
+
+func (self *testClient) GetDest(service ipvs.Service, id ipvs.Dest) (ipvs.Dest, error) {
+    self.op("get-dest %v %v", service, id)
+
+    if dest, exists := self.dests[service.String()][id.String()]; !exists {
+        return dest, errs.KernelError(ipvs.ErrDestNotFound)
+    } else {
+        return dest, nil
+    }
+}
+
+func (self *testClient) NewDest(service ipvs.Service, dest ipvs.Dest) error {
+    self.op("new-dest %v %v %v %d", service, dest, dest.FwdMethod, dest.Weight)
+
+    if dests, exists := self.dests[service.String()]; !exists {
+        return errs.KernelError(ipvs.ErrServiceNotFound)
+    } else if _, exists := dests[dest.String()]; exists {
+        return errs.KernelError(ipvs.ErrDestExists)
+    }
+
+    self.dests[service.String()][dest.String()] = dest
+    return nil
+}
+
+func (self *testClient) SetDest(service ipvs.Service, dest ipvs.Dest) error {
+    self.op("set-dest %v %v %v %d", service, dest, dest.FwdMethod, dest.Weight)
+
+    if dests, exists := self.dests[service.String()]; !exists {
+        return errs.KernelError(ipvs.ErrServiceNotFound)
+    } else if _, exists := dests[dest.String()]; !exists {
+        return errs.KernelError(ipvs.ErrDestNotFound)
+    }
+
+    self.dests[service.String()][dest.String()] = dest
+    return nil
+}
+
+func (self *testClient) DelDest(service ipvs.Service, dest ipvs.Dest) error {
+    self.op("del-dest %v %v", service, dest)
+
+    if dests, exists := self.dests[service.String()]; !exists {
+        return errs.KernelError(ipvs.ErrServiceNotFound)
+    } else if _, exists := dests[dest.String()]; !exists {
+        return errs.KernelError(ipvs.ErrDestNotFound)
+    }
+
+    delete(self.dests[service.String()], dest.String())
+    return nil
+}
+
+func (self *testClient) WalkConnections(ctx context.Context, walkFunc func(ipvs.Connection) error) error {
+    for _, conn := range self.conns {
+        if err := walkFunc(conn); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Replace the kernel state with the new-service and new-dest operations from the given file
+func (self *testClient) load(path string) error {
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+
+    self.Flush()
+
+    for _, line := range strings.Split(string(buf), "\n") {
+        fields := strings.Fields(line)
+
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+
+        } else if fields[0] == "new-service" && len(fields) >= 3 {
+            service := testService(fields[1])
+            service.SchedName = fields[2]
+
+            // the kernel defaults for the services added by the driver
+            switch service.Af {
+            case syscall.AF_INET:
+                service.Netmask = 0xffffffff
+            case syscall.AF_INET6:
+                service.Netmask = 128
+            }
+
+            // optional flags=, timeout= and netmask= values
+            for _, field := range fields[3:] {
+                parts := strings.SplitN(field, "=", 2)
+
+                if len(parts) != 2 {
+                    return fmt.Errorf("invalid new-service option: %s", line)
+                } else if value, err := strconv.ParseUint(parts[1], 0, 32); err != nil {
+                    return fmt.Errorf("invalid new-service option: %s: %v", line, err)
+                } else if parts[0] == "flags" {
+                    service.Flags = ipvs.MakeFlags(uint32(value))
+                } else if parts[0] == "timeout" {
+                    service.Timeout = uint32(value)
+                } else if parts[0] == "netmask" {
+                    service.Netmask = uint32(value)
+                } else {
+                    return fmt.Errorf("invalid new-service option: %s", line)
+                }
+            }
+
+            self.NewService(service)
+
+        } else if fields[0] == "new-dest" && len(fields) == 5 {
+            dest := testDest(fields[2])
+
+            if fwdMethod, err := ipvs.ParseFwdMethod(fields[3]); err != nil {
+                return err
+            } else if weight, err := strconv.ParseUint(fields[4], 10, 32); err != nil {
+                return err
+            } else {
+                dest.FwdMethod = fwdMethod
+                dest.Weight = uint32(weight)
+            }
+
+            if _, exists := self.dests[fields[1]]; !exists {
+                return fmt.Errorf("new-dest for unknown service: %s", line)
+            }
+
+            self.NewDest(self.services[fields[1]], dest)
+
+        } else {
+            return fmt.Errorf("invalid line: %s", line)
+        }
+    }
+
+    self.ops = nil
+
+    return nil
+}
+
+func testGolden(t *testing.T, dir string) {
+    var services = NewServices()
+    var client = makeTestClient()
+
+    if files, err := (config.FilesConfig{Path: filepath.Join(dir, "config")}).Open(); err != nil {
+        t.Fatalf("config:Files.Open: %v", err)
+    } else if configs, err := files.Scan(); err != nil {
+        t.Fatalf("config:Files.Scan: %v", err)
+    } else {
+        for _, cfg := range configs {
+            services.NewConfig(cfg)
+        }
+    }
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    if err := client.load(filepath.Join(dir, "kernel")); err != nil {
+        t.Fatalf("load kernel: %v", err)
+    }
+
+    if _, err := ipvsDriver.Verify(); err != nil {
+        t.Fatalf("IPVSDriver.Verify: %v", err)
+    }
+
+    var ops string
+    for _, op := range client.ops {
+        ops += op + "\n"
+    }
+
+    goldenPath := filepath.Join(dir, "verify")
+
+    if *updateGolden {
+        if err := ioutil.WriteFile(goldenPath, []byte(ops), 0644); err != nil {
+            t.Fatalf("write %s: %v", goldenPath, err)
+        }
+    } else if golden, err := ioutil.ReadFile(goldenPath); err != nil {
+        t.Fatalf("read %s: %v", goldenPath, err)
+    } else if string(golden) != ops {
+        t.Errorf("Verify operations differ from %s:\n%s", goldenPath, ops)
+    }
+}
+
+func TestGolden(t *testing.T) {
+    dirs, err := filepath.Glob("testdata/golden/*")
+    if err != nil {
+        t.Fatalf("filepath.Glob: %v", err)
+    } else if len(dirs) == 0 {
+        t.Fatalf("no testdata/golden cases")
+    }
+
+    for _, dir := range dirs {
+        t.Run(filepath.Base(dir), func(t *testing.T) {
+            testGolden(t, dir)
+        })
+    }
+}
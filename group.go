@@ -0,0 +1,48 @@
+package clusterf
+/*
+ * Named backend groups, shared between multiple services.
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+)
+
+type Groups map[string]*Group
+
+func makeGroups() Groups {
+    return Groups(make(map[string]*Group))
+}
+
+// Return Group for named group, possibly creating a new (empty) Group.
+func (self Groups) get(name string) *Group {
+    if group, exists := self[name]; exists {
+        return group
+    } else {
+        group := &Group{
+            Name:       name,
+            Backends:   make(map[string]config.ServiceBackend),
+        }
+        self[name] = group
+
+        return group
+    }
+}
+
+func (self Groups) del(name string) {
+    delete(self, name)
+}
+
+// Return the backends for the named group, or nil if the group does not exist.
+func (self Groups) backends(name string) map[string]config.ServiceBackend {
+    if group, exists := self[name]; !exists {
+        return nil
+    } else {
+        return group.Backends
+    }
+}
+
+type Group struct {
+    Name        string
+
+    Backends    map[string]config.ServiceBackend
+}
@@ -0,0 +1,207 @@
+package clusterf
+/*
+ * Estimate the remapped hash slots, and thus client sessions, for a change to the backends of a service using a hashing scheduler.
+ *
+ * The sh scheduler assigns its 256 slots to each dest in turn, by weight, so any change to the weights or order of the dests shifts the
+ * slots of any later dests. The mh scheduler uses a Maglev lookup table, which mostly only remaps the slots of the changed dests.
+ *
+ * The kernel orders the sh dests by when they were added, and hashes the mh dests using a random per-service key, so the results are
+ * estimates, using the dests in the given order, and a fixed hash.
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "hash/fnv"
+    "net"
+    "strconv"
+)
+
+// Size of the kernel lookup tables, with the default CONFIG_IP_VS_SH_TAB_BITS=8 and CONFIG_IP_VS_MH_TAB_INDEX=12
+const HASHING_SH_SLOTS = 256
+const HASHING_MH_SLOTS = 4093
+
+type HashingDest struct {
+    Name    string
+    Addr    string  // host:port
+    Weight  uint32  // zero for drained or standby dests, which do not get any clients
+}
+
+// Return the dest for a service backend, weighted like the ipvsBackend
+func MakeHashingDest(name string, backend config.ServiceBackend) HashingDest {
+    var host string
+    var port uint16
+    var weight uint32
+
+    if backend.IPv4 != "" {
+        host = backend.IPv4
+    } else {
+        host = backend.IPv6
+    }
+
+    if backend.TCP != 0 {
+        port = backend.TCP
+    } else if backend.UDP != 0 {
+        port = backend.UDP
+    } else if backend.SCTP != 0 {
+        port = backend.SCTP
+    } else {
+        port = backend.Port
+    }
+
+    if backend.Drain {
+        weight = 0
+    } else if backend.Weight == 0 {
+        weight = IPVS_WEIGHT
+    } else {
+        weight = uint32(backend.Weight)
+    }
+
+    return HashingDest{Name: name, Addr: net.JoinHostPort(host, strconv.Itoa(int(port))), Weight: weight}
+}
+
+// Return the dest Addr used for each slot of the sh lookup table, or "" for slots without any dest
+func shSlots(dests []HashingDest) []string {
+    slots := make([]string, HASHING_SH_SLOTS)
+
+    if len(dests) == 0 {
+        return slots
+    }
+
+    // like ip_vs_sh_reassign(): zero-weight dests still take a single slot, but are unavailable for lookups
+    for i, d, count := 0, 0, uint32(0); i < len(slots); i++ {
+        dest := dests[d]
+
+        if dest.Weight > 0 {
+            slots[i] = dest.Addr
+        }
+
+        if count++; count >= dest.Weight {
+            d = (d + 1) % len(dests)
+            count = 0
+        }
+    }
+
+    return slots
+}
+
+func mhHash(addr string, salt string) uint64 {
+    hash := fnv.New64a()
+    hash.Write([]byte(salt))
+    hash.Write([]byte(addr))
+
+    return hash.Sum64()
+}
+
+// Return the dest Addr used for each slot of the Maglev lookup table, or "" for slots without any dest
+func mhSlots(dests []HashingDest) []string {
+    var slots = make([]string, HASHING_MH_SLOTS)
+    var active []HashingDest
+    var weightGCD uint
+
+    // like ip_vs_mh_populate(): zero-weight dests are skipped, and the other dests take turns by their relative weight
+    for _, dest := range dests {
+        if dest.Weight > 0 {
+            active = append(active, dest)
+            weightGCD = gcd(weightGCD, uint(dest.Weight))
+        }
+    }
+
+    if len(active) == 0 {
+        return slots
+    }
+
+    offsets := make([]uint64, len(active))
+    skips := make([]uint64, len(active))
+    nexts := make([]uint64, len(active))
+
+    for i, dest := range active {
+        offsets[i] = mhHash(dest.Addr, "offset") % HASHING_MH_SLOTS
+        skips[i] = mhHash(dest.Addr, "skip") % (HASHING_MH_SLOTS - 1) + 1
+    }
+
+    for filled := 0; filled < len(slots); {
+        for i, dest := range active {
+            for turn := uint32(0); turn < dest.Weight / uint32(weightGCD) && filled < len(slots); turn++ {
+                slot := (offsets[i] + nexts[i] * skips[i]) % HASHING_MH_SLOTS
+
+                for slots[slot] != "" {
+                    nexts[i]++
+                    slot = (offsets[i] + nexts[i] * skips[i]) % HASHING_MH_SLOTS
+                }
+
+                slots[slot] = dest.Addr
+                nexts[i]++
+                filled++
+            }
+        }
+    }
+
+    return slots
+}
+
+// Return the lookup table for the hashing scheduler
+func HashingSlots(schedName string, dests []HashingDest) ([]string, error) {
+    switch schedName {
+    case "sh":
+        return shSlots(dests), nil
+    case "mh":
+        return mhSlots(dests), nil
+    default:
+        return nil, fmt.Errorf("Unsupported hashing scheduler: %s", schedName)
+    }
+}
+
+type HashingReport struct {
+    SchedName   string
+    Slots       int
+    Remapped    int
+
+    // number of slots for each dest Addr, before and after the change
+    OldSlots    map[string]int
+    NewSlots    map[string]int
+}
+
+func (self HashingReport) Fraction() float64 {
+    if self.Slots == 0 {
+        return 0
+    }
+
+    return float64(self.Remapped) / float64(self.Slots)
+}
+
+func (self HashingReport) String() string {
+    return fmt.Sprintf("%s: %d/%d slots remapped (%.1f%%)", self.SchedName, self.Remapped, self.Slots, self.Fraction() * 100)
+}
+
+// Estimate the slots remapped by changing the service dests from the old to the new dests
+func ReportHashing(schedName string, oldDests []HashingDest, newDests []HashingDest) (HashingReport, error) {
+    report := HashingReport{
+        SchedName:  schedName,
+        OldSlots:   make(map[string]int),
+        NewSlots:   make(map[string]int),
+    }
+
+    oldSlots, err := HashingSlots(schedName, oldDests)
+    if err != nil {
+        return report, err
+    }
+
+    newSlots, err := HashingSlots(schedName, newDests)
+    if err != nil {
+        return report, err
+    }
+
+    report.Slots = len(oldSlots)
+
+    for i := range oldSlots {
+        if oldSlots[i] != newSlots[i] {
+            report.Remapped++
+        }
+
+        report.OldSlots[oldSlots[i]]++
+        report.NewSlots[newSlots[i]]++
+    }
+
+    return report, nil
+}
@@ -0,0 +1,96 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "testing"
+)
+
+func makeHashingDests(names ...string) []HashingDest {
+    var dests []HashingDest
+
+    for i, name := range names {
+        dests = append(dests, MakeHashingDest(name, config.ServiceBackend{IPv4: "10.1.0." + string('1' + byte(i)), TCP: 80}))
+    }
+
+    return dests
+}
+
+func TestMakeHashingDest(t *testing.T) {
+    if dest := MakeHashingDest("test", config.ServiceBackend{IPv6: "2001:db8::1", Port: 8080}); dest.Addr != "[2001:db8::1]:8080" || dest.Weight != IPVS_WEIGHT {
+        t.Errorf("default: %#v", dest)
+    }
+    if dest := MakeHashingDest("test", config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80, Weight: 20, Drain: true}); dest.Addr != "10.1.0.1:80" || dest.Weight != 0 {
+        t.Errorf("drain: %#v", dest)
+    }
+}
+
+func TestHashingSlots(t *testing.T) {
+    dests := makeHashingDests("a", "b", "c")
+
+    for _, schedName := range []string{"sh", "mh"} {
+        slots, err := HashingSlots(schedName, dests)
+        if err != nil {
+            t.Fatalf("HashingSlots %s: %v", schedName, err)
+        }
+
+        counts := make(map[string]int)
+        for _, slot := range slots {
+            counts[slot]++
+        }
+
+        // the slots are evenly shared between the equally weighted dests, give or take a turn
+        for _, dest := range dests {
+            if count := counts[dest.Addr]; count < len(slots) / 3 - int(dest.Weight) || count > len(slots) / 3 + int(dest.Weight) {
+                t.Errorf("HashingSlots %s: %s has %d/%d slots", schedName, dest.Addr, count, len(slots))
+            }
+        }
+        if counts[""] != 0 {
+            t.Errorf("HashingSlots %s: %d empty slots", schedName, counts[""])
+        }
+    }
+
+    if _, err := HashingSlots("wlc", dests); err == nil {
+        t.Errorf("HashingSlots wlc: no error")
+    }
+}
+
+func TestReportHashing(t *testing.T) {
+    oldDests := makeHashingDests("a", "b", "c", "d")
+    newDests := append([]HashingDest{}, oldDests...)
+    newDests[1].Weight = 0
+
+    // draining a sh dest leaves it with a single unavailable slot per turn, shifting the slots of the later dests
+    if report, err := ReportHashing("sh", oldDests, newDests); err != nil {
+        t.Fatalf("ReportHashing sh: %v", err)
+    } else if report.NewSlots[""] != 8 || report.Remapped <= 64 {
+        t.Errorf("ReportHashing sh drain: %v", report)
+    }
+
+    // draining a mh dest mostly remaps its own slots
+    if report, err := ReportHashing("mh", oldDests, newDests); err != nil {
+        t.Fatalf("ReportHashing mh: %v", err)
+    } else if report.NewSlots[""] != 0 || report.Remapped < report.OldSlots[oldDests[1].Addr] || report.Fraction() > 0.3 {
+        t.Errorf("ReportHashing mh drain: %v", report)
+    }
+
+    // removing a sh dest shifts the slots of all later dests
+    if report, err := ReportHashing("sh", oldDests, oldDests[:3]); err != nil {
+        t.Fatalf("ReportHashing sh: %v", err)
+    } else if report.Remapped < 128 {
+        t.Errorf("ReportHashing sh delete: %v", report)
+    }
+
+    // removing a mh dest mostly remaps its own slots
+    if report, err := ReportHashing("mh", oldDests, append(append([]HashingDest{}, oldDests[:1]...), oldDests[2:]...)); err != nil {
+        t.Fatalf("ReportHashing mh: %v", err)
+    } else if report.OldSlots[oldDests[1].Addr] > report.Remapped || report.Fraction() > 0.35 {
+        t.Errorf("ReportHashing mh delete: %v", report)
+    }
+
+    // unchanged
+    if report, err := ReportHashing("mh", oldDests, oldDests); err != nil {
+        t.Fatalf("ReportHashing mh: %v", err)
+    } else if report.Remapped != 0 {
+        t.Errorf("ReportHashing mh unchanged: %v", report)
+    }
+}
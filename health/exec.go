@@ -0,0 +1,96 @@
+package health
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "bytes"
+    "context"
+    "fmt"
+    "os/exec"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+const EXEC_PATH = "/usr/local/bin:/usr/bin:/bin"
+
+// Check the backend by running a shell command, expecting a zero exit status.
+//
+// The command is run with only PATH and the CLUSTERF_* backend variables in the environment, in a separate process group that is killed on timeout.
+type ExecConfig struct {
+    Command     string
+    Dir         string          // default: /
+    Timeout     time.Duration   // default: TIMEOUT
+    Concurrency int             // maximum number of concurrent commands, default 1
+}
+
+type Exec struct {
+    config      ExecConfig
+    semaphore   chan struct{}
+}
+
+func (self ExecConfig) Open() (*Exec, error) {
+    if self.Command == "" {
+        return nil, fmt.Errorf("Missing command")
+    }
+
+    if self.Dir == "" {
+        self.Dir = "/"
+    }
+    if self.Timeout == 0 {
+        self.Timeout = TIMEOUT
+    }
+    if self.Concurrency <= 0 {
+        self.Concurrency = 1
+    }
+
+    return &Exec{
+        config:     self,
+        semaphore:  make(chan struct{}, self.Concurrency),
+    }, nil
+}
+
+func (self *Exec) env(backendConfig config.ConfigServiceBackend) []string {
+    backend := backendConfig.Backend
+
+    return []string{
+        "PATH=" + EXEC_PATH,
+        "CLUSTERF_SERVICE=" + backendConfig.ServiceName,
+        "CLUSTERF_BACKEND=" + backendConfig.BackendName,
+        "CLUSTERF_BACKEND_IPV4=" + backend.IPv4,
+        "CLUSTERF_BACKEND_IPV6=" + backend.IPv6,
+        "CLUSTERF_BACKEND_TCP=" + strconv.Itoa(int(backend.TCP)),
+        "CLUSTERF_BACKEND_UDP=" + strconv.Itoa(int(backend.UDP)),
+        "CLUSTERF_BACKEND_SCTP=" + strconv.Itoa(int(backend.SCTP)),
+    }
+}
+
+func (self *Exec) Check(backendConfig config.ConfigServiceBackend) error {
+    var output bytes.Buffer
+
+    self.semaphore <- struct{}{}
+    defer func() { <-self.semaphore }()
+
+    ctx, cancel := context.WithTimeout(context.Background(), self.config.Timeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, "/bin/sh", "-c", self.config.Command)
+    cmd.Dir = self.config.Dir
+    cmd.Env = self.env(backendConfig)
+    cmd.Stdout = &output
+    cmd.Stderr = &output
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error {
+        // kill the entire process group
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+    cmd.WaitDelay = time.Second
+
+    if err := cmd.Run(); ctx.Err() == context.DeadlineExceeded {
+        return fmt.Errorf("timeout after %v", self.config.Timeout)
+    } else if err != nil {
+        return fmt.Errorf("%v: %s", err, strings.TrimSpace(output.String()))
+    }
+
+    return nil
+}
@@ -0,0 +1,68 @@
+package health
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "sync"
+    "testing"
+    "time"
+)
+
+var testExecBackend = config.ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80}}
+
+func TestExec(t *testing.T) {
+    tests := []struct{
+        config  ExecConfig
+        error   string
+    }{
+        {ExecConfig{Command: `test "$CLUSTERF_BACKEND_IPV4:$CLUSTERF_BACKEND_TCP" = "10.1.0.1:80"`}, ""},
+        {ExecConfig{Command: `test "$CLUSTERF_SERVICE/$CLUSTERF_BACKEND" = "test/test1"`}, ""},
+        {ExecConfig{Command: `test -z "$HOME"`}, ""},
+        {ExecConfig{Command: `echo down; exit 1`}, "exit status 1: down"},
+        {ExecConfig{Command: `sleep 10`, Timeout: 100 * time.Millisecond}, "timeout after 100ms"},
+        {ExecConfig{Command: `sleep 10 & wait`, Timeout: 100 * time.Millisecond}, "timeout after 100ms"},
+    }
+
+    for _, test := range tests {
+        check, err := test.config.Open()
+        if err != nil {
+            t.Fatalf("ExecConfig.Open: %v", err)
+        }
+
+        if err := check.Check(testExecBackend); err != nil && err.Error() != test.error {
+            t.Errorf("Exec %#v: %v", test.config.Command, err)
+        } else if err == nil && test.error != "" {
+            t.Errorf("Exec %#v: no error", test.config.Command)
+        }
+    }
+
+    if _, err := (ExecConfig{}).Open(); err == nil {
+        t.Errorf("ExecConfig.Open: no error for missing command")
+    }
+}
+
+func TestExecConcurrency(t *testing.T) {
+    check, err := ExecConfig{Command: `sleep 0.1`, Concurrency: 2}.Open()
+    if err != nil {
+        t.Fatalf("ExecConfig.Open: %v", err)
+    }
+
+    var wg sync.WaitGroup
+    start := time.Now()
+
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            if err := check.Check(testExecBackend); err != nil {
+                t.Errorf("Exec: %v", err)
+            }
+        }()
+    }
+
+    wg.Wait()
+
+    if duration := time.Since(start); duration < 200 * time.Millisecond {
+        t.Errorf("Exec concurrency: 4 commands completed in %v", duration)
+    }
+}
@@ -0,0 +1,217 @@
+package health
+/*
+ * The standard grpc.health.v1 checking protocol, using HTTP/2 directly.
+ *
+ *  message HealthCheckRequest { string service = 1; }
+ *  message HealthCheckResponse { ServingStatus status = 1; }
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "time"
+)
+
+const GRPC_HEALTH_PATH = "/grpc.health.v1.Health/Check"
+
+type GRPCStatus uint64
+
+const (
+    GRPCUnknown         GRPCStatus = 0
+    GRPCServing         GRPCStatus = 1
+    GRPCNotServing      GRPCStatus = 2
+    GRPCServiceUnknown  GRPCStatus = 3
+)
+
+func (self GRPCStatus) String() string {
+    switch self {
+    case GRPCUnknown:
+        return "UNKNOWN"
+    case GRPCServing:
+        return "SERVING"
+    case GRPCNotServing:
+        return "NOT_SERVING"
+    case GRPCServiceUnknown:
+        return "SERVICE_UNKNOWN"
+    default:
+        return fmt.Sprintf("%d", uint64(self))
+    }
+}
+
+// Check the backend using the grpc.health.v1 Health/Check method on its TCP port, expecting SERVING
+type GRPCConfig struct {
+    Service     string      // optional service name, default is the overall server health
+    TLS         bool        // default is unencrypted HTTP/2
+    Host        string      // optional :authority and TLS server name, default is the backend address
+    Headers     Headers     // extra metadata, e.g. Authorization
+    Timeout     time.Duration   // default: TIMEOUT
+
+    TLSConfig
+}
+
+type GRPC struct {
+    config      GRPCConfig
+    client      *http.Client
+}
+
+func (self GRPCConfig) Open() (*GRPC, error) {
+    tlsConfig, err := self.TLSConfig.load(self.Host)
+    if err != nil {
+        return nil, err
+    }
+
+    timeout := self.Timeout
+
+    if timeout == 0 {
+        timeout = TIMEOUT
+    }
+
+    protocols := new(http.Protocols)
+
+    if self.TLS {
+        protocols.SetHTTP2(true)
+    } else {
+        protocols.SetUnencryptedHTTP2(true)
+    }
+
+    return &GRPC{
+        config: self,
+        client: &http.Client{
+            Transport:  &http.Transport{TLSClientConfig: tlsConfig, Protocols: protocols},
+            Timeout:    timeout,
+        },
+    }, nil
+}
+
+// Encode the length-prefixed HealthCheckRequest message
+func (self *GRPC) request() []byte {
+    var message bytes.Buffer
+    var buf = make([]byte, binary.MaxVarintLen64)
+
+    if self.config.Service != "" {
+        message.WriteByte(1 << 3 | 2) // field 1, length-delimited
+        message.Write(buf[:binary.PutUvarint(buf, uint64(len(self.config.Service)))])
+        message.WriteString(self.config.Service)
+    }
+
+    var request bytes.Buffer
+
+    request.WriteByte(0) // uncompressed
+    binary.Write(&request, binary.BigEndian, uint32(message.Len()))
+    request.Write(message.Bytes())
+
+    return request.Bytes()
+}
+
+// Decode the length-prefixed HealthCheckResponse message
+func parseGRPCResponse(buf []byte) (GRPCStatus, error) {
+    var status GRPCStatus
+
+    if len(buf) < 5 {
+        return status, fmt.Errorf("short response")
+    } else if buf[0] != 0 {
+        return status, fmt.Errorf("compressed response")
+    } else if length := binary.BigEndian.Uint32(buf[1:5]); int(length) != len(buf) - 5 {
+        return status, fmt.Errorf("invalid response length %d", length)
+    }
+
+    message := bytes.NewReader(buf[5:])
+
+    for message.Len() > 0 {
+        tag, err := binary.ReadUvarint(message)
+        if err != nil {
+            return status, err
+        }
+
+        switch tag & 0x7 {
+        case 0:
+            if value, err := binary.ReadUvarint(message); err != nil {
+                return status, err
+            } else if tag >> 3 == 1 {
+                status = GRPCStatus(value)
+            }
+        case 2:
+            if length, err := binary.ReadUvarint(message); err != nil {
+                return status, err
+            } else if _, err := message.Seek(int64(length), io.SeekCurrent); err != nil {
+                return status, err
+            }
+        default:
+            return status, fmt.Errorf("unsupported wire type %d", tag & 0x7)
+        }
+    }
+
+    return status, nil
+}
+
+func (self *GRPC) URL(backend config.ServiceBackend) string {
+    scheme := "http"
+
+    if self.config.TLS {
+        scheme = "https"
+    }
+
+    return fmt.Sprintf("%s://%s%s", scheme, backendAddr(backend), GRPC_HEALTH_PATH)
+}
+
+func (self *GRPC) Check(backendConfig config.ConfigServiceBackend) error {
+    if backendAddr(backendConfig.Backend) == "" {
+        // no port to check
+        return nil
+    }
+
+    request, err := http.NewRequest("POST", self.URL(backendConfig.Backend), bytes.NewReader(self.request()))
+    if err != nil {
+        return err
+    }
+
+    if self.config.Host != "" {
+        request.Host = self.config.Host
+    }
+
+    for name, value := range self.config.Headers {
+        request.Header.Set(name, string(value))
+    }
+
+    request.Header.Set("Content-Type", "application/grpc")
+    request.Header.Set("TE", "trailers")
+
+    response, err := self.client.Do(request)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode != 200 {
+        return fmt.Errorf("%s: %s", request.URL, response.Status)
+    }
+
+    body, err := ioutil.ReadAll(response.Body)
+    if err != nil {
+        return err
+    }
+
+    // a trailers-only response has the grpc-status in the headers
+    grpcStatus := response.Trailer.Get("Grpc-Status")
+    grpcMessage := response.Trailer.Get("Grpc-Message")
+
+    if grpcStatus == "" {
+        grpcStatus = response.Header.Get("Grpc-Status")
+        grpcMessage = response.Header.Get("Grpc-Message")
+    }
+
+    if grpcStatus != "0" {
+        return fmt.Errorf("%s: grpc-status %s: %s", request.URL, grpcStatus, grpcMessage)
+    } else if status, err := parseGRPCResponse(body); err != nil {
+        return fmt.Errorf("%s: %v", request.URL, err)
+    } else if status != GRPCServing {
+        return fmt.Errorf("%s: %v", request.URL, status)
+    }
+
+    return nil
+}
@@ -0,0 +1,103 @@
+package health
+
+import (
+    "encoding/binary"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// Fake grpc.health.v1 server, with the status for each service name
+type testGRPCHandler map[string]GRPCStatus
+
+func (self testGRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+
+    if r.ProtoMajor != 2 || r.URL.Path != GRPC_HEALTH_PATH || r.Header.Get("Content-Type") != "application/grpc" {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    var service string
+
+    if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body) - 5 {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    } else if len(body) > 7 {
+        service = string(body[7:])
+    }
+
+    w.Header().Set("Content-Type", "application/grpc")
+    w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+    if status, exists := self[service]; !exists {
+        w.Header().Set("Grpc-Status", "5")
+        w.Header().Set("Grpc-Message", "unknown service")
+        w.WriteHeader(200)
+    } else {
+        w.WriteHeader(200)
+        w.Write([]byte{0, 0, 0, 0, 2, 1 << 3, byte(status)})
+        w.Header().Set("Grpc-Status", "0")
+    }
+}
+
+func TestGRPC(t *testing.T) {
+    server := httptest.NewUnstartedServer(testGRPCHandler{"": GRPCServing, "test": GRPCServing, "other": GRPCNotServing})
+    server.Config.Protocols = new(http.Protocols)
+    server.Config.Protocols.SetUnencryptedHTTP2(true)
+    server.Start()
+    defer server.Close()
+
+    backendConfig := testBackend(t, server)
+
+    tests := []struct{
+        config  GRPCConfig
+        error   string
+    }{
+        {GRPCConfig{}, ""},
+        {GRPCConfig{Service: "test"}, ""},
+        {GRPCConfig{Service: "other"}, "http://" + server.Listener.Addr().String() + "/grpc.health.v1.Health/Check: NOT_SERVING"},
+        {GRPCConfig{Service: "missing"}, "http://" + server.Listener.Addr().String() + "/grpc.health.v1.Health/Check: grpc-status 5: unknown service"},
+    }
+
+    for _, test := range tests {
+        check, err := test.config.Open()
+        if err != nil {
+            t.Fatalf("GRPCConfig.Open: %v", err)
+        }
+
+        if err := check.Check(backendConfig); err != nil && err.Error() != test.error {
+            t.Errorf("GRPC %#v: %v", test.config, err)
+        } else if err == nil && test.error != "" {
+            t.Errorf("GRPC %#v: no error", test.config)
+        }
+    }
+}
+
+func TestParseGRPCResponse(t *testing.T) {
+    tests := []struct{
+        buf     []byte
+        status  GRPCStatus
+        error   bool
+    }{
+        {[]byte{0, 0, 0, 0, 0}, GRPCUnknown, false},
+        {[]byte{0, 0, 0, 0, 2, 0x08, 1}, GRPCServing, false},
+        {[]byte{0, 0, 0, 0, 5, 0x12, 1, 'x', 0x08, 2}, GRPCNotServing, false},
+        {[]byte{1, 0, 0, 0, 2, 0x08, 1}, GRPCUnknown, true},
+        {[]byte{0, 0, 0, 0, 3, 0x08, 1}, GRPCUnknown, true},
+        {[]byte{0, 0, 0}, GRPCUnknown, true},
+    }
+
+    for _, test := range tests {
+        if status, err := parseGRPCResponse(test.buf); err != nil {
+            if !test.error {
+                t.Errorf("parseGRPCResponse(%v): %v", test.buf, err)
+            }
+        } else if test.error {
+            t.Errorf("parseGRPCResponse(%v): no error", test.buf)
+        } else if status != test.status {
+            t.Errorf("parseGRPCResponse(%v): %v != %v", test.buf, status, test.status)
+        }
+    }
+}
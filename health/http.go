@@ -0,0 +1,134 @@
+package health
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// Extra HTTP request headers, as a repeatable "Name: value" flag.
+//
+// The values may be sealed, and are redacted when formatted.
+type Headers map[string]config.Secret
+
+func (self Headers) String() string {
+    var headers []string
+
+    for name, value := range self {
+        headers = append(headers, name + ": " + value.String())
+    }
+
+    return strings.Join(headers, ", ")
+}
+
+func (self Headers) Set(header string) error {
+    parts := strings.SplitN(header, ":", 2)
+
+    if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+        return fmt.Errorf("Invalid header %#v: expected Name: value", header)
+    }
+
+    self[strings.TrimSpace(parts[0])] = config.Secret(strings.TrimSpace(parts[1]))
+
+    return nil
+}
+
+// Return a copy of the headers with any sealed values unsealed
+func (self Headers) unseal(secrets *config.Secrets) (Headers, error) {
+    var headers = make(Headers)
+
+    for name, value := range self {
+        if unsealed, err := secrets.UnsealSecret(value); err != nil {
+            return nil, fmt.Errorf("header %s: %v", name, err)
+        } else {
+            headers[name] = unsealed
+        }
+    }
+
+    return headers, nil
+}
+
+// Check the backend by making a HTTP GET request to its TCP port, expecting a 2xx or 3xx response
+type HTTPConfig struct {
+    Path        string
+    HTTPS       bool
+    Host        string      // optional Host header, default is the backend address
+    Headers     Headers     // e.g. Authorization
+    Timeout     time.Duration   // default: TIMEOUT
+
+    TLSConfig
+}
+
+type HTTP struct {
+    config      HTTPConfig
+    client      *http.Client
+}
+
+func (self HTTPConfig) Open() (*HTTP, error) {
+    tlsConfig, err := self.TLSConfig.load(self.Host)
+    if err != nil {
+        return nil, err
+    }
+
+    timeout := self.Timeout
+
+    if timeout == 0 {
+        timeout = TIMEOUT
+    }
+
+    return &HTTP{
+        config: self,
+        client: &http.Client{
+            Transport:  &http.Transport{TLSClientConfig: tlsConfig},
+            Timeout:    timeout,
+            CheckRedirect: func(req *http.Request, via []*http.Request) error {
+                // a redirect is a healthy response
+                return http.ErrUseLastResponse
+            },
+        },
+    }, nil
+}
+
+func (self *HTTP) URL(backend config.ServiceBackend) string {
+    scheme := "http"
+
+    if self.config.HTTPS {
+        scheme = "https"
+    }
+
+    return fmt.Sprintf("%s://%s/%s", scheme, backendAddr(backend), strings.TrimPrefix(self.config.Path, "/"))
+}
+
+func (self *HTTP) Check(backendConfig config.ConfigServiceBackend) error {
+    if backendAddr(backendConfig.Backend) == "" {
+        // no port to check
+        return nil
+    }
+
+    request, err := http.NewRequest("GET", self.URL(backendConfig.Backend), nil)
+    if err != nil {
+        return err
+    }
+
+    if self.config.Host != "" {
+        request.Host = self.config.Host
+    }
+
+    for name, value := range self.config.Headers {
+        request.Header.Set(name, string(value))
+    }
+
+    response, err := self.client.Do(request)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode >= 200 && response.StatusCode < 400 {
+        return nil
+    } else {
+        return fmt.Errorf("%s: %s", request.URL, response.Status)
+    }
+}
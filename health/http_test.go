@@ -0,0 +1,139 @@
+package health
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/pem"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strconv"
+    "testing"
+)
+
+func testBackend(t *testing.T, server *httptest.Server) config.ConfigServiceBackend {
+    host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+    if err != nil {
+        t.Fatalf("net.SplitHostPort: %v", err)
+    }
+
+    tcp, _ := strconv.Atoi(port)
+
+    return config.ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: config.ServiceBackend{IPv4: host, TCP: uint16(tcp)}}
+}
+
+func testHandler(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/health" {
+        http.NotFound(w, r)
+    } else if r.Header.Get("Authorization") != "Bearer test" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    } else {
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+func TestHTTPHeaders(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(testHandler))
+    defer server.Close()
+
+    backendConfig := testBackend(t, server)
+
+    headers := make(Headers)
+
+    if err := headers.Set("Authorization: Bearer test"); err != nil {
+        t.Fatalf("Headers.Set: %v", err)
+    }
+    if err := headers.Set("Authorization"); err == nil {
+        t.Errorf("Headers.Set: no error for invalid header")
+    }
+
+    tests := []struct{
+        config  HTTPConfig
+        error   bool
+    }{
+        {HTTPConfig{Path: "/health", Headers: headers}, false},
+        {HTTPConfig{Path: "health", Headers: headers}, false},
+        {HTTPConfig{Path: "/health"}, true},
+        {HTTPConfig{Path: "/", Headers: headers}, true},
+    }
+
+    for _, test := range tests {
+        check, err := test.config.Open()
+        if err != nil {
+            t.Fatalf("HTTPConfig.Open: %v", err)
+        }
+
+        if err := check.Check(backendConfig); err != nil && !test.error {
+            t.Errorf("HTTP %#v: %v", test.config, err)
+        } else if err == nil && test.error {
+            t.Errorf("HTTP %#v: no error", test.config)
+        }
+    }
+
+    if err := (TCPConfig{}).Check(backendConfig); err != nil {
+        t.Errorf("TCP: %v", err)
+    }
+}
+
+func writePEM(t *testing.T, blockType string, bytes []byte) string {
+    file, err := ioutil.TempFile("", "clusterf-health")
+    if err != nil {
+        t.Fatalf("ioutil.TempFile: %v", err)
+    }
+    defer file.Close()
+
+    if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: bytes}); err != nil {
+        t.Fatalf("pem.Encode: %v", err)
+    }
+
+    return file.Name()
+}
+
+func TestHTTPSClientCert(t *testing.T) {
+    server := httptest.NewUnstartedServer(http.HandlerFunc(testHandler))
+    server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+    server.StartTLS()
+    defer server.Close()
+
+    // use the server's own cert as the client cert and CA
+    cert := server.TLS.Certificates[0]
+
+    keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+    if err != nil {
+        t.Fatalf("x509.MarshalPKCS8PrivateKey: %v", err)
+    }
+
+    certFile := writePEM(t, "CERTIFICATE", cert.Certificate[0])
+    keyFile := writePEM(t, "PRIVATE KEY", keyBytes)
+    defer os.Remove(certFile)
+    defer os.Remove(keyFile)
+
+    backendConfig := testBackend(t, server)
+    headers := Headers{"Authorization": "Bearer test"}
+
+    tests := []struct{
+        config  HTTPConfig
+        error   bool
+    }{
+        {HTTPConfig{Path: "/health", HTTPS: true, Headers: headers, TLSConfig: TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: certFile}}, false},
+        {HTTPConfig{Path: "/health", HTTPS: true, Headers: headers, TLSConfig: TLSConfig{CAFile: certFile}}, true},
+        {HTTPConfig{Path: "/health", HTTPS: true, Headers: headers, TLSConfig: TLSConfig{CertFile: certFile, KeyFile: keyFile}}, true},
+        {HTTPConfig{Path: "/health", HTTPS: true, Headers: headers, TLSConfig: TLSConfig{CertFile: certFile, KeyFile: keyFile, Insecure: true}}, false},
+    }
+
+    for _, test := range tests {
+        check, err := test.config.Open()
+        if err != nil {
+            t.Fatalf("HTTPConfig.Open: %v", err)
+        }
+
+        if err := check.Check(backendConfig); err != nil && !test.error {
+            t.Errorf("HTTPS %#v: %v", test.config, err)
+        } else if err == nil && test.error {
+            t.Errorf("HTTPS %#v: no error", test.config)
+        }
+    }
+}
@@ -0,0 +1,194 @@
+package health
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "flag"
+    "fmt"
+    "sync"
+    "time"
+)
+
+type Check func(backendConfig config.ConfigServiceBackend) error
+
+// Command-line -health-* options for choosing one of the health checks
+type Options struct {
+    TCP                 bool
+    HTTP                HTTPConfig
+    GRPC                bool
+    GRPCService         string
+    TLS                 bool
+    TLSExpiryWarning    time.Duration
+    Protocol            ProtocolConfig
+    Exec                ExecConfig
+    Secrets             config.SecretsConfig
+}
+
+// Register the -health-* flags, with -health-tcp as the default check if tcp is given
+func (self *Options) Flags(flags *flag.FlagSet, tcp bool) {
+    self.HTTP.Headers = make(Headers)
+
+    flags.BoolVar(&self.TCP, "health-tcp", tcp,
+        "Check each backend by connecting to its TCP port")
+    flags.StringVar(&self.HTTP.Path, "health-http-path", "",
+        "Check each backend by a HTTP GET of the given path on its TCP port, instead of -health-tcp")
+    flags.BoolVar(&self.GRPC, "health-grpc", false,
+        "Check each backend using the grpc.health.v1 protocol on its TCP port, instead of -health-tcp")
+    flags.StringVar(&self.GRPCService, "health-grpc-service", "",
+        "Service name for -health-grpc, default is the overall server health")
+    flags.BoolVar(&self.TLS, "health-tls", false,
+        "Check each backend by completing a TLS handshake on its TCP port, instead of -health-tcp")
+    flags.DurationVar(&self.TLSExpiryWarning, "health-tls-expiry-warning", 14 * 24 * time.Hour,
+        "Warn about any -health-tls certificates expiring within the given duration")
+    flags.StringVar(&self.Protocol.Protocol, "health-protocol", "",
+        "Check each backend using the redis, mysql or postgres protocol on its TCP port, instead of -health-tcp")
+    flags.StringVar(&self.Protocol.User, "health-postgres-user", POSTGRES_USER,
+        "Startup user for -health-protocol=postgres")
+    flags.StringVar(&self.Exec.Command, "health-exec", "",
+        "Check each backend using a shell command, with $CLUSTERF_SERVICE, $CLUSTERF_BACKEND, $CLUSTERF_BACKEND_IPV4, $CLUSTERF_BACKEND_TCP in the environment, instead of -health-tcp")
+    flags.DurationVar(&self.Exec.Timeout, "health-exec-timeout", TIMEOUT,
+        "Kill the -health-exec command after the given timeout")
+    flags.BoolVar(&self.HTTP.HTTPS, "health-https", false,
+        "Use HTTPS for -health-http-path, or TLS for -health-grpc")
+    flags.StringVar(&self.HTTP.Host, "health-http-host", "",
+        "Host header and TLS server name for -health-http-path, -health-grpc or -health-tls")
+    flags.Var(self.HTTP.Headers, "health-http-header",
+        "Extra header for -health-http-path or -health-grpc, e.g. 'Authorization: Bearer ...' (repeatable)")
+    flags.StringVar(&self.HTTP.CertFile, "health-tls-cert", "",
+        "TLS client certificate file for -health-https or -health-tls")
+    flags.StringVar(&self.HTTP.KeyFile, "health-tls-key", "",
+        "TLS client private key file for -health-https or -health-tls")
+    flags.StringVar(&self.HTTP.CAFile, "health-tls-ca", "",
+        "TLS CA certificate file for verifying -health-https or -health-tls, default system roots")
+    flags.BoolVar(&self.HTTP.Insecure, "health-tls-insecure", false,
+        "Do not verify the -health-https or -health-tls server certificate")
+    flags.StringVar(&self.Secrets.KeyFile, "secret-key-file", "",
+        "Unseal any sealed -health-http-header values or -health-tls-key file using the base64-encoded private key from the given file")
+}
+
+// Return the chosen check, or nil if none
+func (self Options) Open() (Check, error) {
+    if secrets, err := self.Secrets.Open(); err != nil {
+        return nil, err
+    } else if headers, err := self.HTTP.Headers.unseal(secrets); err != nil {
+        return nil, err
+    } else {
+        self.HTTP.Headers = headers
+        self.HTTP.TLSConfig.Secrets = secrets
+    }
+
+    if self.Protocol.Protocol != "" {
+        if check, err := self.Protocol.Open(); err != nil {
+            return nil, err
+        } else {
+            return check.Check, nil
+        }
+    } else if self.Exec.Command != "" {
+        if check, err := self.Exec.Open(); err != nil {
+            return nil, err
+        } else {
+            return check.Check, nil
+        }
+    } else if self.GRPC {
+        grpcConfig := GRPCConfig{
+            Service:    self.GRPCService,
+            TLS:        self.HTTP.HTTPS,
+            Host:       self.HTTP.Host,
+            Headers:    self.HTTP.Headers,
+            TLSConfig:  self.HTTP.TLSConfig,
+        }
+
+        if check, err := grpcConfig.Open(); err != nil {
+            return nil, err
+        } else {
+            return check.Check, nil
+        }
+    } else if self.TLS {
+        handshakeConfig := HandshakeConfig{
+            Host:           self.HTTP.Host,
+            ExpiryWarning:  self.TLSExpiryWarning,
+            TLSConfig:      self.HTTP.TLSConfig,
+        }
+
+        if check, err := handshakeConfig.Open(); err != nil {
+            return nil, err
+        } else {
+            return check.Check, nil
+        }
+    } else if self.HTTP.Path != "" {
+        if check, err := self.HTTP.Open(); err != nil {
+            return nil, err
+        } else {
+            return check.Check, nil
+        }
+    } else if self.TCP {
+        return TCPConfig{}.Check, nil
+    } else {
+        return nil, nil
+    }
+}
+
+// Detailed result of running a check on a backend
+type Result struct {
+    ServiceName string
+    BackendName string
+    Addr        string
+    Latency     time.Duration
+    Error       error
+}
+
+func (self Result) String() string {
+    if self.Error != nil {
+        return fmt.Sprintf("%s/%s %s: error after %v: %v", self.ServiceName, self.BackendName, self.Addr, self.Latency, self.Error)
+    } else {
+        return fmt.Sprintf("%s/%s %s: ok in %v", self.ServiceName, self.BackendName, self.Addr, self.Latency)
+    }
+}
+
+// Run the check on the backend
+func (self Check) Run(backendConfig config.ConfigServiceBackend) Result {
+    start := time.Now()
+    err := self(backendConfig)
+
+    return Result{
+        ServiceName:    backendConfig.ServiceName,
+        BackendName:    backendConfig.BackendName,
+        Addr:           backendAddr(backendConfig.Backend),
+        Latency:        time.Since(start),
+        Error:          err,
+    }
+}
+
+type cacheEntry struct {
+    once    sync.Once
+    err     error
+}
+
+// Return a check that only runs once for each backend host:port, sharing the result with any other backends using the same host:port.
+//
+// The cached results never expire, so a new cached check should be used for each interval.
+func (self Check) Cached() Check {
+    var mutex sync.Mutex
+    var cache = make(map[string]*cacheEntry)
+
+    return func(backendConfig config.ConfigServiceBackend) error {
+        addr := backendAddr(backendConfig.Backend)
+
+        if addr == "" {
+            return self(backendConfig)
+        }
+
+        mutex.Lock()
+        entry := cache[addr]
+        if entry == nil {
+            entry = &cacheEntry{}
+            cache[addr] = entry
+        }
+        mutex.Unlock()
+
+        entry.once.Do(func() {
+            entry.err = self(backendConfig)
+        })
+
+        return entry.err
+    }
+}
@@ -0,0 +1,161 @@
+package health
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "bytes"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/pem"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+)
+
+func TestOptions(t *testing.T) {
+    var options Options
+
+    flags := flag.NewFlagSet("test", flag.ContinueOnError)
+    options.Flags(flags, false)
+
+    if check, err := options.Open(); err != nil {
+        t.Errorf("Options.Open: %v", err)
+    } else if check != nil {
+        t.Errorf("Options.Open: unexpected default check")
+    }
+
+    if err := flags.Parse([]string{"-health-protocol=memcache"}); err != nil {
+        t.Fatalf("FlagSet.Parse: %v", err)
+    } else if _, err := options.Open(); err == nil {
+        t.Errorf("Options.Open: no error for invalid -health-protocol")
+    }
+}
+
+// Sealed -health-http-header values and -health-tls-key files are unsealed using the -secret-key-file
+func TestOptionsSecrets(t *testing.T) {
+    server := httptest.NewUnstartedServer(http.HandlerFunc(testHandler))
+    server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+    server.StartTLS()
+    defer server.Close()
+
+    dir := t.TempDir()
+    cert := server.TLS.Certificates[0]
+    secretKeyFile := filepath.Join(dir, "secret.key")
+    certFile := filepath.Join(dir, "client.crt")
+    keyFile := filepath.Join(dir, "client.key")
+
+    _, privateKey, err := config.GenerateSecretKeys()
+    if err != nil {
+        t.Fatalf("GenerateSecretKeys: %v", err)
+    } else if err := ioutil.WriteFile(secretKeyFile, []byte(privateKey), 0600); err != nil {
+        t.Fatalf("ioutil.WriteFile: %v", err)
+    }
+
+    secrets, err := config.SecretsConfig{KeyFile: secretKeyFile}.Open()
+    if err != nil {
+        t.Fatalf("SecretsConfig.Open: %v", err)
+    }
+
+    keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+    if err != nil {
+        t.Fatalf("x509.MarshalPKCS8PrivateKey: %v", err)
+    }
+
+    var keyPEM bytes.Buffer
+
+    pem.Encode(&keyPEM, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+
+    if sealedKey, err := secrets.Seal(keyPEM.String()); err != nil {
+        t.Fatalf("Seal: %v", err)
+    } else if err := ioutil.WriteFile(keyFile, []byte(sealedKey + "\n"), 0600); err != nil {
+        t.Fatalf("ioutil.WriteFile: %v", err)
+    } else if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+        t.Fatalf("ioutil.WriteFile: %v", err)
+    }
+
+    sealedHeader, err := secrets.Seal("Bearer test")
+    if err != nil {
+        t.Fatalf("Seal: %v", err)
+    }
+
+    args := []string{"-health-http-path=/health", "-health-https", "-health-tls-insecure",
+        "-health-http-header=Authorization: " + sealedHeader,
+        "-health-tls-cert=" + certFile,
+        "-health-tls-key=" + keyFile,
+    }
+
+    // without the secret key
+    var options Options
+
+    flags := flag.NewFlagSet("test", flag.ContinueOnError)
+    options.Flags(flags, false)
+
+    if err := flags.Parse(args); err != nil {
+        t.Fatalf("FlagSet.Parse: %v", err)
+    } else if _, err := options.Open(); err == nil {
+        t.Errorf("Options.Open: no error without -secret-key-file")
+    }
+
+    if err := flags.Parse([]string{"-secret-key-file=" + secretKeyFile}); err != nil {
+        t.Fatalf("FlagSet.Parse: %v", err)
+    } else if check, err := options.Open(); err != nil {
+        t.Fatalf("Options.Open: %v", err)
+    } else if err := check(testBackend(t, server)); err != nil {
+        t.Errorf("Check: %v", err)
+    }
+
+    if headers := options.HTTP.Headers.String(); headers != "Authorization: " + sealedHeader {
+        t.Errorf("Headers.String: %v", headers)
+    }
+}
+
+func TestCheckRun(t *testing.T) {
+    check := Check(func(backendConfig config.ConfigServiceBackend) error {
+        return fmt.Errorf("down")
+    })
+
+    result := check.Run(testExecBackend)
+
+    if result.Error == nil || result.Addr != "10.1.0.1:80" || result.Latency <= 0 {
+        t.Errorf("Check.Run: %#v", result)
+    } else if result.String() != fmt.Sprintf("test/test1 10.1.0.1:80: error after %v: down", result.Latency) {
+        t.Errorf("Result.String: %v", result)
+    }
+}
+
+func TestCheckCached(t *testing.T) {
+    var checks []string
+
+    check := Check(func(backendConfig config.ConfigServiceBackend) error {
+        checks = append(checks, backendConfig.ServiceName + "/" + backendConfig.BackendName)
+
+        if backendConfig.Backend.IPv4 == "10.1.0.2" {
+            return fmt.Errorf("down")
+        }
+
+        return nil
+    }).Cached()
+
+    backends := []config.ConfigServiceBackend{
+        {ServiceName: "test", BackendName: "test1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80}},
+        {ServiceName: "test", BackendName: "test2", Backend: config.ServiceBackend{IPv4: "10.1.0.2", TCP: 80}},
+        {ServiceName: "other", BackendName: "test1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80}},
+        {ServiceName: "other", BackendName: "test2", Backend: config.ServiceBackend{IPv4: "10.1.0.2", TCP: 80}},
+        {ServiceName: "other", BackendName: "test3", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 8080}},
+    }
+
+    for _, backendConfig := range backends {
+        err := check(backendConfig)
+
+        if (err != nil) != (backendConfig.Backend.IPv4 == "10.1.0.2") {
+            t.Errorf("Check %s/%s: %v", backendConfig.ServiceName, backendConfig.BackendName, err)
+        }
+    }
+
+    if fmt.Sprintf("%v", checks) != "[test/test1 test/test2 other/test3]" {
+        t.Errorf("Check.Cached: checks %v", checks)
+    }
+}
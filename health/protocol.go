@@ -0,0 +1,211 @@
+package health
+/*
+ * Protocol-level checks for common datastores, which only check that the server is ready to accept clients, without authenticating.
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "github.com/qmsk/clusterf/tasks"
+    "time"
+)
+
+const (
+    ProtocolRedis       = "redis"
+    ProtocolMySQL       = "mysql"
+    ProtocolPostgres    = "postgres"
+)
+
+const POSTGRES_USER = "clusterf"
+
+// Check the backend by speaking the datastore protocol on its TCP port
+type ProtocolConfig struct {
+    Protocol    string
+    User        string          // postgres startup user, default: POSTGRES_USER
+    Timeout     time.Duration   // default: TIMEOUT
+}
+
+type Protocol struct {
+    config      ProtocolConfig
+    check       func(conn net.Conn) error
+}
+
+func (self ProtocolConfig) Open() (*Protocol, error) {
+    protocol := &Protocol{config: self}
+
+    if self.User == "" {
+        protocol.config.User = POSTGRES_USER
+    }
+    if self.Timeout == 0 {
+        protocol.config.Timeout = TIMEOUT
+    }
+
+    switch self.Protocol {
+    case ProtocolRedis:
+        protocol.check = protocol.checkRedis
+    case ProtocolMySQL:
+        protocol.check = protocol.checkMySQL
+    case ProtocolPostgres:
+        protocol.check = protocol.checkPostgres
+    default:
+        return nil, fmt.Errorf("Invalid protocol: %#v", self.Protocol)
+    }
+
+    return protocol, nil
+}
+
+func (self *Protocol) Check(backendConfig config.ConfigServiceBackend) error {
+    addr := backendAddr(backendConfig.Backend)
+
+    if addr == "" {
+        // no port to check
+        return nil
+    }
+
+    defer tasks.Open("health")()
+
+    conn, err := net.DialTimeout("tcp", addr, self.config.Timeout)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    conn.SetDeadline(time.Now().Add(self.config.Timeout))
+
+    if err := self.check(conn); err != nil {
+        return fmt.Errorf("%s %s: %v", self.config.Protocol, addr, err)
+    }
+
+    return nil
+}
+
+// PING, expecting PONG, or a NOAUTH error if the server requires authentication
+func (self *Protocol) checkRedis(conn net.Conn) error {
+    if _, err := io.WriteString(conn, "*1\r\n$4\r\nPING\r\n"); err != nil {
+        return err
+    }
+
+    line, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil {
+        return err
+    }
+
+    line = strings.TrimSpace(line)
+
+    if line == "+PONG" || strings.HasPrefix(line, "-NOAUTH") {
+        return nil
+    } else {
+        return fmt.Errorf("%s", line)
+    }
+}
+
+// Read the initial handshake packet, failing on any error packet
+func (self *Protocol) checkMySQL(conn net.Conn) error {
+    var header [4]byte
+
+    if _, err := io.ReadFull(conn, header[:]); err != nil {
+        return err
+    }
+
+    payload := make([]byte, int(header[0]) | int(header[1]) << 8 | int(header[2]) << 16)
+
+    if _, err := io.ReadFull(conn, payload); err != nil {
+        return err
+    } else if len(payload) == 0 {
+        return fmt.Errorf("empty handshake")
+    }
+
+    switch payload[0] {
+    case 10:
+        // protocol version 10 handshake
+        return nil
+
+    case 0xff:
+        // error packet: code, optional #sqlstate, message
+        if len(payload) < 3 {
+            return fmt.Errorf("invalid error packet")
+        }
+
+        code, message := binary.LittleEndian.Uint16(payload[1:3]), payload[3:]
+
+        if len(message) > 6 && message[0] == '#' {
+            message = message[6:]
+        }
+
+        return fmt.Errorf("error %d: %s", code, message)
+
+    default:
+        return fmt.Errorf("unsupported protocol version %d", payload[0])
+    }
+}
+
+// Send a startup message, expecting an authentication request.
+//
+// Authentication errors mean that the server is ready, any other errors are returned.
+func (self *Protocol) checkPostgres(conn net.Conn) error {
+    var params bytes.Buffer
+
+    binary.Write(&params, binary.BigEndian, uint32(196608)) // protocol version 3.0
+    params.WriteString("user\x00" + self.config.User + "\x00")
+    params.WriteString("database\x00" + self.config.User + "\x00")
+    params.WriteByte(0)
+
+    var startup bytes.Buffer
+
+    binary.Write(&startup, binary.BigEndian, uint32(4 + params.Len()))
+    startup.Write(params.Bytes())
+
+    if _, err := conn.Write(startup.Bytes()); err != nil {
+        return err
+    }
+
+    var header [5]byte
+
+    if _, err := io.ReadFull(conn, header[:]); err != nil {
+        return err
+    }
+
+    length := binary.BigEndian.Uint32(header[1:5])
+
+    if length < 4 || length > 8192 {
+        return fmt.Errorf("invalid message length %d", length)
+    }
+
+    body := make([]byte, length - 4)
+
+    if _, err := io.ReadFull(conn, body); err != nil {
+        return err
+    }
+
+    switch header[0] {
+    case 'R':
+        // authentication request
+        return nil
+
+    case 'E':
+        // error fields: type byte, null-terminated value
+        fields := make(map[byte]string)
+
+        for _, field := range bytes.Split(body, []byte{0}) {
+            if len(field) > 0 {
+                fields[field[0]] = string(field[1:])
+            }
+        }
+
+        if code := fields['C']; strings.HasPrefix(code, "28") || code == "3D000" {
+            // invalid authorization or database
+            return nil
+        } else {
+            return fmt.Errorf("%s %s: %s", fields['S'], code, fields['M'])
+        }
+
+    default:
+        return fmt.Errorf("unexpected message %#v", string(header[0]))
+    }
+}
@@ -0,0 +1,81 @@
+package health
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "net"
+    "strconv"
+    "testing"
+)
+
+// Serve a single connection, writing the response after reading any request
+func testProtocolServer(t *testing.T, request bool, response string) config.ConfigServiceBackend {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen: %v", err)
+    }
+
+    go func() {
+        defer listener.Close()
+
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+
+        if request {
+            buf := make([]byte, 1024)
+            conn.Read(buf)
+        }
+
+        conn.Write([]byte(response))
+    }()
+
+    host, port, _ := net.SplitHostPort(listener.Addr().String())
+    tcp, _ := strconv.Atoi(port)
+
+    return config.ConfigServiceBackend{ServiceName: "test", BackendName: "test1", Backend: config.ServiceBackend{IPv4: host, TCP: uint16(tcp)}}
+}
+
+func TestProtocol(t *testing.T) {
+    tests := []struct{
+        protocol    string
+        request     bool
+        response    string
+        error       string
+    }{
+        {ProtocolRedis, true, "+PONG\r\n", ""},
+        {ProtocolRedis, true, "-NOAUTH Authentication required.\r\n", ""},
+        {ProtocolRedis, true, "-LOADING Redis is loading the dataset in memory\r\n", "-LOADING Redis is loading the dataset in memory"},
+
+        {ProtocolMySQL, false, "\x0b\x00\x00\x00\x0a5.7.30\x00\x01\x00\x00\x00", ""},
+        {ProtocolMySQL, false, "\x17\x00\x00\x00\xff\x10\x04Too many connections", "error 1040: Too many connections"},
+        {ProtocolMySQL, false, "\x16\x00\x00\x00\xff\x15\x04#28000Access denied", "error 1045: Access denied"},
+        {ProtocolMySQL, false, "\x01\x00", "unexpected EOF"},
+
+        {ProtocolPostgres, true, "R\x00\x00\x00\x0c\x00\x00\x00\x05salt", ""},
+        {ProtocolPostgres, true, "E\x00\x00\x00\x29SFATAL\x00C28000\x00Mno pg_hba.conf entry\x00\x00", ""},
+        {ProtocolPostgres, true, "E\x00\x00\x00\x37SFATAL\x00C57P03\x00Mthe database system is starting up\x00\x00", "FATAL 57P03: the database system is starting up"},
+        {ProtocolPostgres, true, "N", "unexpected EOF"},
+    }
+
+    for _, test := range tests {
+        backendConfig := testProtocolServer(t, test.request, test.response)
+        addr := backendAddr(backendConfig.Backend)
+
+        check, err := ProtocolConfig{Protocol: test.protocol}.Open()
+        if err != nil {
+            t.Fatalf("ProtocolConfig.Open: %v", err)
+        }
+
+        if err := check.Check(backendConfig); err == nil && test.error != "" {
+            t.Errorf("Protocol %s %#v: no error", test.protocol, test.response)
+        } else if err != nil && err.Error() != test.protocol + " " + addr + ": " + test.error {
+            t.Errorf("Protocol %s %#v: %v", test.protocol, test.response, err)
+        }
+    }
+
+    if _, err := (ProtocolConfig{Protocol: "memcache"}).Open(); err == nil {
+        t.Errorf("ProtocolConfig.Open: no error for invalid protocol")
+    }
+}
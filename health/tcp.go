@@ -0,0 +1,50 @@
+package health
+/*
+ * Health checks for service backends.
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "net"
+    "strconv"
+    "github.com/qmsk/clusterf/tasks"
+    "time"
+)
+
+const TIMEOUT = 5 * time.Second
+
+// Return the host:port for checking the backend, or the empty string if the backend does not have any TCP port
+func backendAddr(backend config.ServiceBackend) string {
+    if backend.IPv4 == "" || backend.TCP == 0 {
+        return ""
+    }
+
+    return net.JoinHostPort(backend.IPv4, strconv.Itoa(int(backend.TCP)))
+}
+
+// Check the backend by connecting to its TCP port
+type TCPConfig struct {
+    Timeout     time.Duration   // default: TIMEOUT
+}
+
+func (self TCPConfig) Check(backendConfig config.ConfigServiceBackend) error {
+    addr := backendAddr(backendConfig.Backend)
+    timeout := self.Timeout
+
+    if addr == "" {
+        // no port to check
+        return nil
+    }
+
+    if timeout == 0 {
+        timeout = TIMEOUT
+    }
+
+    defer tasks.Open("health")()
+
+    if conn, err := net.DialTimeout("tcp", addr, timeout); err != nil {
+        return err
+    } else {
+        return conn.Close()
+    }
+}
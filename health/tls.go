@@ -0,0 +1,149 @@
+package health
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "strings"
+    "github.com/qmsk/clusterf/tasks"
+    "time"
+)
+
+type TLSConfig struct {
+    // client certificate
+    CertFile    string
+    KeyFile     string      // may contain a sealed key
+    Secrets     *config.Secrets // for unsealing the KeyFile
+
+    // server certificate verification
+    CAFile      string      // default: system roots
+    Insecure    bool        // skip verification
+}
+
+func (self TLSConfig) load(serverName string) (*tls.Config, error) {
+    tlsConfig := &tls.Config{
+        ServerName:         serverName,
+        InsecureSkipVerify: self.Insecure,
+    }
+
+    if self.CertFile == "" && self.KeyFile == "" {
+
+    } else if cert, err := self.loadCert(); err != nil {
+        return nil, err
+    } else {
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+
+    if self.CAFile == "" {
+
+    } else if buf, err := ioutil.ReadFile(self.CAFile); err != nil {
+        return nil, err
+    } else {
+        tlsConfig.RootCAs = x509.NewCertPool()
+
+        if !tlsConfig.RootCAs.AppendCertsFromPEM(buf) {
+            return nil, fmt.Errorf("%s: no certificates", self.CAFile)
+        }
+    }
+
+    return tlsConfig, nil
+}
+
+// Load the client certificate, unsealing any sealed KeyFile
+func (self TLSConfig) loadCert() (tls.Certificate, error) {
+    var cert tls.Certificate
+
+    certPEM, err := ioutil.ReadFile(self.CertFile)
+    if err != nil {
+        return cert, err
+    }
+
+    keyPEM, err := ioutil.ReadFile(self.KeyFile)
+    if err != nil {
+        return cert, err
+    }
+
+    if key := config.Secret(strings.TrimSpace(string(keyPEM))); !key.Sealed() {
+
+    } else if self.Secrets == nil {
+        return cert, fmt.Errorf("%s: no secret key for sealed key", self.KeyFile)
+    } else if unsealed, err := self.Secrets.UnsealSecret(key); err != nil {
+        return cert, fmt.Errorf("%s: %v", self.KeyFile, err)
+    } else {
+        keyPEM = []byte(unsealed)
+    }
+
+    return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Check the backend by completing a TLS handshake on its TCP port, and warn about any certificate expiring within ExpiryWarning
+type HandshakeConfig struct {
+    Host            string  // optional TLS server name, default is the backend address
+    ExpiryWarning   time.Duration
+    Timeout         time.Duration   // default: TIMEOUT
+
+    TLSConfig
+}
+
+type Handshake struct {
+    config      HandshakeConfig
+    tlsConfig   *tls.Config
+}
+
+func (self HandshakeConfig) Open() (*Handshake, error) {
+    tlsConfig, err := self.TLSConfig.load(self.Host)
+    if err != nil {
+        return nil, err
+    }
+
+    if self.Timeout == 0 {
+        self.Timeout = TIMEOUT
+    }
+
+    return &Handshake{config: self, tlsConfig: tlsConfig}, nil
+}
+
+// Complete a TLS handshake with the backend, returning the earliest expiry time of the certificate chain
+func (self *Handshake) Expiry(backend config.ServiceBackend) (expiry time.Time, err error) {
+    dialer := &net.Dialer{Timeout: self.config.Timeout}
+
+    defer tasks.Open("health")()
+
+    conn, err := tls.DialWithDialer(dialer, "tcp", backendAddr(backend), self.tlsConfig)
+    if err != nil {
+        return expiry, err
+    }
+    defer conn.Close()
+
+    for _, cert := range conn.ConnectionState().PeerCertificates {
+        if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+            expiry = cert.NotAfter
+        }
+    }
+
+    return expiry, nil
+}
+
+func (self *Handshake) Check(backendConfig config.ConfigServiceBackend) error {
+    if backendAddr(backendConfig.Backend) == "" {
+        // no port to check
+        return nil
+    }
+
+    expiry, err := self.Expiry(backendConfig.Backend)
+    if err != nil {
+        return err
+    }
+
+    if expiresIn := expiry.Sub(time.Now()); expiresIn < 0 {
+        return fmt.Errorf("%s: certificate expired at %v", backendAddr(backendConfig.Backend), expiry)
+    } else if expiresIn < self.config.ExpiryWarning {
+        log.Printf("health:Handshake %s/%s: certificate expires in %v at %v\n", backendConfig.ServiceName, backendConfig.BackendName, expiresIn, expiry)
+    }
+
+    return nil
+}
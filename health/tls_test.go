@@ -0,0 +1,43 @@
+package health
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestHandshake(t *testing.T) {
+    server := httptest.NewTLSServer(http.HandlerFunc(testHandler))
+    defer server.Close()
+
+    backendConfig := testBackend(t, server)
+    expiry := server.Certificate().NotAfter
+
+    tests := []struct{
+        config  HandshakeConfig
+        error   bool
+    }{
+        {HandshakeConfig{}, true},
+        {HandshakeConfig{TLSConfig: TLSConfig{Insecure: true}}, false},
+        {HandshakeConfig{Host: "example.com", TLSConfig: TLSConfig{Insecure: true}}, false},
+    }
+
+    for _, test := range tests {
+        check, err := test.config.Open()
+        if err != nil {
+            t.Fatalf("HandshakeConfig.Open: %v", err)
+        }
+
+        if err := check.Check(backendConfig); err != nil && !test.error {
+            t.Errorf("Handshake %#v: %v", test.config, err)
+        } else if err == nil && test.error {
+            t.Errorf("Handshake %#v: no error", test.config)
+        } else if err != nil {
+
+        } else if checkExpiry, err := check.Expiry(backendConfig.Backend); err != nil {
+            t.Errorf("Handshake %#v: Expiry: %v", test.config, err)
+        } else if !checkExpiry.Equal(expiry) {
+            t.Errorf("Handshake %#v: Expiry %v != %v", test.config, checkExpiry, expiry)
+        }
+    }
+}
@@ -0,0 +1,397 @@
+package clusterf
+/*
+ * Inject routes for the VIPs of the healthy services, for an adjacent routing daemon to redistribute, as a simpler alternative to BGP.
+ *
+ * A VIP is healthy while any of its IPVS services has a dest with a non-zero weight. The routes are injected into the kernel routing table
+ * using the ip(8) command, and/or written to a file of bird static routes. Any other announcers from announce.go can be selected for the
+ * VIPs of each frontend.
+ */
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "os/exec"
+    "strings"
+)
+
+const INJECT_IP_PATH = "ip"
+const INJECT_ROUTE_TABLE = "main"
+const INJECT_ROUTE_DEV = "lo"
+
+// Unassigned routing protocol number, used to identify and flush the injected routes
+const INJECT_ROUTE_PROTO = "250"
+
+type InjectConfig struct {
+    Routes      bool        // inject kernel routes
+    IPPath      string      // default: INJECT_IP_PATH
+    RouteTable  string      // default: INJECT_ROUTE_TABLE
+    RouteDev    string      // default: INJECT_ROUTE_DEV
+    RouteProto  string      // default: INJECT_ROUTE_PROTO
+
+    BirdPath    string      // write bird static routes to the file
+    BirdReload  string      // shell command run after writing the BirdPath, e.g. `birdc configure`
+
+    AddrDev     string      // add the VIPs as interface addresses on the dev, for failover VIPs
+    AddrArping  bool        // send a gratuitous ARP for each added IPv4 address
+
+    Exec        string      // shell command run with `up <vip>`, `down <vip>`, and `flush` on startup, e.g. for VRRP or BGP speakers
+
+    // Comma-separated announcers for the VIPs of any frontends without an announce option
+    Announce    string      // default: route and/or bird
+
+    commands    injectCommands  // used for testing; instead of exec
+}
+
+// The commands used by the injector, replaced by a fake for testing
+type injectCommands interface {
+    Run(name string, args ...string) error
+}
+
+type injectExec struct { }
+
+func (self injectExec) Run(name string, args ...string) error {
+    cmd := exec.Command(name, args...)
+
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return errs.KernelError(fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output))))
+    }
+
+    return nil
+}
+
+// The names of the builtin announcers, in the order they are updated
+var announcerNames = []string{"route", "bird", "addr", "exec"}
+
+type Injector struct {
+    config      InjectConfig
+    commands    injectCommands
+
+    announcers  map[string]Announcer
+    names       []string
+    defaults    []string
+
+    // unknown announcers used by any frontends, logged once
+    unknown     map[string]bool
+
+    // the announcers for each announced VIP, as of the last Update
+    announced   map[string][]string
+}
+
+func (self InjectConfig) Open() (*Injector, error) {
+    injector := &Injector{
+        config:     self,
+        commands:   self.commands,
+        announcers: make(map[string]Announcer),
+        unknown:    make(map[string]bool),
+        announced:  make(map[string][]string),
+    }
+
+    if injector.commands == nil {
+        injector.commands = injectExec{}
+    }
+    if injector.config.IPPath == "" {
+        injector.config.IPPath = INJECT_IP_PATH
+    }
+    if injector.config.RouteTable == "" {
+        injector.config.RouteTable = INJECT_ROUTE_TABLE
+    }
+    if injector.config.RouteDev == "" {
+        injector.config.RouteDev = INJECT_ROUTE_DEV
+    }
+    if injector.config.RouteProto == "" {
+        injector.config.RouteProto = INJECT_ROUTE_PROTO
+    }
+
+    // remove any routes left over from a previous run
+    if !injector.config.Routes {
+
+    } else if routes, err := injector.openRoutes(); err != nil {
+        return nil, err
+    } else {
+        injector.AddAnnouncer("route", routes)
+    }
+
+    if injector.config.BirdPath == "" {
+
+    } else if bird, err := injector.openBird(); err != nil {
+        return nil, err
+    } else {
+        injector.AddAnnouncer("bird", bird)
+    }
+
+    if injector.config.AddrDev != "" {
+        injector.AddAnnouncer("addr", &announceAddr{ipPath: injector.config.IPPath, dev: injector.config.AddrDev, arping: injector.config.AddrArping, commands: injector.commands, vips: make(announced)})
+    }
+
+    if injector.config.Exec == "" {
+
+    } else if announcer, err := injector.openExec(); err != nil {
+        return nil, err
+    } else {
+        injector.AddAnnouncer("exec", announcer)
+    }
+
+    if injector.config.Announce == "" {
+        for _, name := range []string{"route", "bird"} {
+            if injector.announcers[name] != nil {
+                injector.defaults = append(injector.defaults, name)
+            }
+        }
+    } else {
+        for _, name := range strings.Split(injector.config.Announce, ",") {
+            if injector.announcers[name] == nil {
+                return nil, errs.ConfigError(fmt.Errorf("Unknown announcer: %s", name))
+            }
+
+            injector.defaults = append(injector.defaults, name)
+        }
+    }
+
+    return injector, nil
+}
+
+// Add a named announcer, which can be selected using the frontend announce option
+func (self *Injector) AddAnnouncer(name string, announcer Announcer) {
+    if _, exists := self.announcers[name]; !exists {
+        self.names = append(self.names, name)
+    }
+
+    self.announcers[name] = announcer
+}
+
+func (self *Injector) String() string {
+    var targets []string
+
+    for _, name := range self.names {
+        targets = append(targets, self.announcers[name].String())
+    }
+
+    return strings.Join(targets, ", ")
+}
+
+// Return the announcers for a VIP, given the announce options of the frontends using the VIP
+func (self *Injector) vipAnnouncers(announce []string) map[string]bool {
+    var names = make(map[string]bool)
+
+    if len(announce) == 0 {
+        announce = []string{""}
+    }
+
+    for _, name := range announce {
+        if name == "" {
+            for _, name := range self.defaults {
+                names[name] = true
+            }
+        } else if self.announcers[name] != nil {
+            names[name] = true
+        } else if !self.unknown[name] {
+            log.Printf("clusterf:Injector %s: unknown announcer: %s\n", self, name)
+
+            self.unknown[name] = true
+        }
+    }
+
+    return names
+}
+
+// Announce any new healthy VIPs, and withdraw any VIPs that are no longer healthy, using the announcers for each VIP
+func (self *Injector) Update(vips map[string]*VIP) error {
+    var announceVIPs = make(map[string]map[string]net.IP)
+    var announced = make(map[string][]string)
+
+    for _, name := range self.names {
+        announceVIPs[name] = make(map[string]net.IP)
+    }
+
+    for key, vip := range vips {
+        if !vip.Healthy {
+            continue
+        }
+
+        for name, _ := range self.vipAnnouncers(vip.Announce) {
+            announceVIPs[name][key] = vip.IP
+        }
+    }
+
+    for _, name := range self.names {
+        if err := self.announcers[name].Announce(announceVIPs[name]); err != nil {
+            return err
+        }
+
+        for key, _ := range announceVIPs[name] {
+            announced[key] = append(announced[key], name)
+        }
+    }
+
+    self.announced = announced
+
+    return nil
+}
+
+// Return the names of the announcers for the announced VIP, or nil
+func (self *Injector) Announced(key string) []string {
+    return self.announced[key]
+}
+
+/* route: kernel routes */
+type announceRoutes struct {
+    ipPath      string
+    table       string
+    dev         string
+    proto       string
+    commands    injectCommands
+
+    vips        announced
+}
+
+func (self *Injector) openRoutes() (*announceRoutes, error) {
+    routes := &announceRoutes{
+        ipPath:     self.config.IPPath,
+        table:      self.config.RouteTable,
+        dev:        self.config.RouteDev,
+        proto:      self.config.RouteProto,
+        commands:   self.commands,
+        vips:       make(announced),
+    }
+
+    if err := routes.flush(); err != nil {
+        return nil, err
+    }
+
+    return routes, nil
+}
+
+func (self *announceRoutes) String() string {
+    return fmt.Sprintf("table %s dev %s proto %s", self.table, self.dev, self.proto)
+}
+
+func (self *announceRoutes) routeArgs(cmd string, vip net.IP) []string {
+    return []string{"route", cmd, vipPrefix(vip), "dev", self.dev, "table", self.table, "proto", self.proto}
+}
+
+func (self *announceRoutes) flush() error {
+    for _, family := range []string{"-4", "-6"} {
+        if err := self.commands.Run(self.ipPath, family, "route", "flush", "table", self.table, "proto", self.proto); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (self *announceRoutes) Announce(vips map[string]net.IP) error {
+    _, err := self.vips.update(self.String(), vips,
+        func(vip net.IP) error { return self.commands.Run(self.ipPath, self.routeArgs("replace", vip)...) },
+        func(vip net.IP) error { return self.commands.Run(self.ipPath, self.routeArgs("del", vip)...) },
+    )
+
+    return err
+}
+
+/* bird: static routes file */
+type announceBird struct {
+    path        string
+    reload      string
+    commands    injectCommands
+
+    vips        announced
+}
+
+func (self *Injector) openBird() (*announceBird, error) {
+    bird := &announceBird{
+        path:       self.config.BirdPath,
+        reload:     self.config.BirdReload,
+        commands:   self.commands,
+        vips:       make(announced),
+    }
+
+    if err := bird.write(); err != nil {
+        return nil, err
+    }
+
+    return bird, nil
+}
+
+func (self *announceBird) String() string {
+    return self.path
+}
+
+// Replace the bird routes file, and reload bird
+func (self *announceBird) write() error {
+    var buf strings.Builder
+
+    fmt.Fprintf(&buf, "# healthy clusterf VIPs\n")
+
+    for _, vip := range self.vips.sorted() {
+        fmt.Fprintf(&buf, "route %s blackhole;\n", vipPrefix(self.vips[vip]))
+    }
+
+    tmpPath := self.path + ".tmp"
+
+    if err := ioutil.WriteFile(tmpPath, []byte(buf.String()), 0644); err != nil {
+        return err
+    } else if err := os.Rename(tmpPath, self.path); err != nil {
+        return err
+    }
+
+    if self.reload == "" {
+        return nil
+    } else if err := self.commands.Run("/bin/sh", "-c", self.reload); err != nil {
+        return errs.BackendError(err)
+    }
+
+    return nil
+}
+
+func (self *announceBird) Announce(vips map[string]net.IP) error {
+    nop := func(vip net.IP) error { return nil }
+
+    if changed, err := self.vips.update(self.String(), vips, nop, nop); err != nil {
+        return err
+    } else if changed {
+        return self.write()
+    }
+
+    return nil
+}
+
+// Return the VIPs of the services with any active dests
+func (self *IPVSDriver) healthyVIPs() map[string]net.IP {
+    vips := make(map[string]net.IP)
+
+    for ipvsKey, ipvsDest := range self.dests {
+        if ipvsDest.Weight == 0 {
+            continue
+        } else if ipvsService := self.services[ipvsKey.Service]; ipvsService == nil || ipvsService.FwMark != 0 {
+            continue
+        } else {
+            vips[ipvsService.Addr.String()] = ipvsService.Addr
+        }
+    }
+
+    return vips
+}
+
+// Inject routes for the VIPs of the healthy services.
+//
+// Must be called before SyncIPVS().
+func (self *Services) SetInjector(injector *Injector) {
+    self.injector = injector
+}
+
+// Update the injected routes after any changes
+func (self *Services) inject() {
+    if self.injector == nil || self.driver == nil {
+        return
+    }
+
+    if err := self.injector.Update(self.VIPs()); err != nil {
+        class := self.errors.Count(err)
+
+        log.Printf("clusterf:Services: Injector Error (%s): %s\n", class, err)
+    }
+}
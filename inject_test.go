@@ -0,0 +1,162 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+type testInjectCommands struct {
+    commands    []string
+}
+
+func (self *testInjectCommands) Run(name string, args ...string) error {
+    self.commands = append(self.commands, name + " " + strings.Join(args, " "))
+    return nil
+}
+
+func (self *testInjectCommands) take() []string {
+    commands := self.commands
+    self.commands = nil
+    return commands
+}
+
+func TestInjector(t *testing.T) {
+    dir, err := ioutil.TempDir("", "clusterf-inject")
+    if err != nil {
+        t.Fatalf("ioutil.TempDir: %v", err)
+    }
+    defer os.RemoveAll(dir)
+
+    var services = NewServices()
+    var commands = &testInjectCommands{}
+    var birdPath = filepath.Join(dir, "bird.conf")
+
+    injector, err := InjectConfig{Routes: true, BirdPath: birdPath, BirdReload: "birdc configure", commands: commands}.Open()
+    if err != nil {
+        t.Fatalf("InjectConfig.Open: %v", err)
+    }
+
+    if flush := commands.take(); !reflect.DeepEqual(flush, []string{
+        "ip -4 route flush table main proto 250",
+        "ip -6 route flush table main proto 250",
+        "/bin/sh -c birdc configure",
+    }) {
+        t.Errorf("Open: %#v", flush)
+    }
+
+    services.SetInjector(injector)
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", IPv6: "2001:db8::1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "dns", Frontend: config.ServiceFrontend{IPv4: "10.0.1.2", UDP: 53}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Mock: true}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    // the dns service does not have any backends
+    if sync := commands.take(); !reflect.DeepEqual(sync, []string{
+        "ip route replace 10.0.1.1/32 dev lo table main proto 250",
+        "/bin/sh -c birdc configure",
+    }) {
+        t.Errorf("SyncIPVS: %#v", sync)
+    }
+
+    if buf, err := ioutil.ReadFile(birdPath); err != nil {
+        t.Errorf("read %s: %v", birdPath, err)
+    } else if string(buf) != "# healthy clusterf VIPs\nroute 10.0.1.1/32 blackhole;\n" {
+        t.Errorf("bird:\n%s", buf)
+    }
+
+    // drained backends are not healthy
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80, Drain: true}}})
+
+    if drain := commands.take(); !reflect.DeepEqual(drain, []string{
+        "ip route del 10.0.1.1/32 dev lo table main proto 250",
+        "/bin/sh -c birdc configure",
+    }) {
+        t.Errorf("drain: %#v", drain)
+    }
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "dns", BackendName: "dns1", Backend: config.ServiceBackend{IPv4: "10.1.0.2", UDP: 53}}})
+
+    if up := commands.take(); !reflect.DeepEqual(up, []string{
+        "ip route replace 10.0.1.2/32 dev lo table main proto 250",
+        "/bin/sh -c birdc configure",
+    }) {
+        t.Errorf("up: %#v", up)
+    }
+
+    // unrelated changes do not reload bird
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "dns", BackendName: "dns2", Backend: config.ServiceBackend{IPv4: "10.1.0.3", UDP: 53}}})
+
+    if other := commands.take(); len(other) != 0 {
+        t.Errorf("other: %#v", other)
+    }
+}
+
+func TestInjectorAnnounce(t *testing.T) {
+    var services = NewServices()
+    var commands = &testInjectCommands{}
+
+    if _, err := (InjectConfig{Routes: true, Announce: "bgp", commands: commands}).Open(); err == nil {
+        t.Errorf("InjectConfig.Open with unknown announcer: no error")
+    }
+    commands.take()
+
+    injector, err := InjectConfig{Routes: true, AddrDev: "eth0", AddrArping: true, Exec: "announce-hook", Announce: "route", commands: commands}.Open()
+    if err != nil {
+        t.Fatalf("InjectConfig.Open: %v", err)
+    }
+
+    if flush := commands.take(); !reflect.DeepEqual(flush, []string{
+        "ip -4 route flush table main proto 250",
+        "ip -6 route flush table main proto 250",
+        "/bin/sh -c announce-hook flush",
+    }) {
+        t.Errorf("Open: %#v", flush)
+    }
+
+    services.SetInjector(injector)
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "anycast", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "anycast", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "failover", Frontend: config.ServiceFrontend{IPv4: "10.0.2.1", TCP: 80, Announce: "addr"}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "failover", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "bgp", Frontend: config.ServiceFrontend{IPv4: "10.0.3.1", TCP: 80, Announce: "exec"}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "bgp", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Mock: true}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    if sync := commands.take(); !reflect.DeepEqual(sync, []string{
+        "ip route replace 10.0.1.1/32 dev lo table main proto 250",
+        "ip addr replace 10.0.2.1/32 dev eth0",
+        "arping -U -c 1 -I eth0 10.0.2.1",
+        "/bin/sh -c announce-hook up 10.0.3.1",
+    }) {
+        t.Errorf("SyncIPVS: %#v", sync)
+    }
+
+    // changing the announcer does not replace the IPVS service
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "failover", Frontend: config.ServiceFrontend{IPv4: "10.0.2.1", TCP: 80}}})
+
+    if set := commands.take(); !reflect.DeepEqual(set, []string{
+        "ip route replace 10.0.2.1/32 dev lo table main proto 250",
+        "ip addr del 10.0.2.1/32 dev eth0",
+    }) {
+        t.Errorf("set announce: %#v", set)
+    }
+
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "bgp"}})
+
+    if del := commands.take(); !reflect.DeepEqual(del, []string{
+        "/bin/sh -c announce-hook down 10.0.3.1",
+    }) {
+        t.Errorf("del: %#v", del)
+    }
+}
@@ -1,15 +1,34 @@
 package clusterf
 
 import (
+    "context"
+    "errors"
     "fmt"
+    "github.com/qmsk/clusterf/errs"
     "github.com/qmsk/clusterf/ipvs"
     "log"
+    "net"
+    "os"
+    "os/exec"
+    "sort"
+    "strings"
     "syscall"
+    "time"
 )
 
 const IPVS_FWD_METHOD = ipvs.IP_VS_CONN_F_MASQ
 const IPVS_SCHED_NAME = "wlc"
 
+// Order of changes when replacing a service frontend or backend subset
+const (
+    // Setup the new service and dests before removing the old ones, merging any overlapping services and dests.
+    // The service never has zero dests during the change, but merged dests will temporarily have a higher weight.
+    ApplyAddFirst   = "add-first"
+
+    // Remove the old service and dests before setting up the new ones.
+    ApplyDelFirst   = "del-first"
+)
+
 type ipvsType struct {
     Af          ipvs.Af
     Protocol    ipvs.Protocol
@@ -20,40 +39,266 @@ var ipvsTypes = []ipvsType {
     { syscall.AF_INET6,     syscall.IPPROTO_TCP },
     { syscall.AF_INET,      syscall.IPPROTO_UDP },
     { syscall.AF_INET6,     syscall.IPPROTO_UDP },
+    { syscall.AF_INET,      syscall.IPPROTO_SCTP },
+    { syscall.AF_INET6,     syscall.IPPROTO_SCTP },
+}
+
+// The ipvsTypes to setup services for, skipping AF_INET in IPv6-only mode
+func (self *IPVSDriver) activeTypes() []ipvsType {
+    if !self.ipv6Only {
+        return ipvsTypes
+    }
+
+    var types []ipvsType
+
+    for _, ipvsType := range ipvsTypes {
+        if ipvsType.Af == syscall.AF_INET6 {
+            types = append(types, ipvsType)
+        }
+    }
+
+    return types
+}
+
+// Refuse any IPv4 address in IPv6-only mode
+func (self *IPVSDriver) checkIPv4(name string, ipv4 string) error {
+    if self.ipv6Only && ipv4 != "" {
+        return errs.ConfigError(fmt.Errorf("%s: IPv4 %s is not allowed in IPv6-only mode", name, ipv4))
+    }
+
+    return nil
+}
+
+// Comparable map keys for ipvs.Service/Dest ids, without allocating
+type ipvsServiceKey struct {
+    Af          ipvs.Af
+    Protocol    ipvs.Protocol
+    Addr        [16]byte
+    Port        uint16
+    FwMark      uint32
+}
+
+type ipvsDestKey struct {
+    Addr        [16]byte
+    Port        uint16
 }
 
 type ipvsKey struct {
-    Service     string
-    Dest        string
+    Service     ipvsServiceKey
+    Dest        ipvsDestKey
+}
+
+func makeServiceKey(ipvsService *ipvs.Service) (key ipvsServiceKey) {
+    key.Af = ipvsService.Af
+
+    if ipvsService.FwMark != 0 {
+        key.FwMark = ipvsService.FwMark
+    } else {
+        key.Protocol = ipvsService.Protocol
+        copy(key.Addr[:], ipvsService.Addr.To16())
+        key.Port = ipvsService.Port
+    }
+
+    return
+}
+
+func makeDestKey(ipvsDest *ipvs.Dest) (key ipvsDestKey) {
+    copy(key.Addr[:], ipvsDest.Addr.To16())
+    key.Port = ipvsDest.Port
+
+    return
+}
+
+func makeKey(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) ipvsKey {
+    return ipvsKey{makeServiceKey(ipvsService), makeDestKey(ipvsDest)}
+}
+
+// The ipvs.Client commands used by the driver, implemented by the in-memory ipvs.FakeClient for testing without a kernel
+type IPVSClient interface {
+    SetDebugEnabled(bool)
+    GetInfo() (ipvs.Info, error)
+    Flush() error
+    ZeroService(ipvs.Service) error
+    ZeroAll() error
+    GetTimeout() (ipvs.Timeout, error)
+    SetTimeout(ipvs.Timeout) error
+
+    ListDaemons() ([]ipvs.Daemon, error)
+    NewDaemon(ipvs.Daemon) error
+    DelDaemon(ipvs.DaemonState) error
+
+    ListServices() ([]ipvs.Service, error)
+    GetService(ipvs.Service) (ipvs.Service, error)
+    NewService(ipvs.Service) error
+    SetService(ipvs.Service) error
+    DelService(ipvs.Service) error
+
+    ListDests(ipvs.Service) ([]ipvs.Dest, error)
+    GetDest(ipvs.Service, ipvs.Dest) (ipvs.Dest, error)
+    NewDest(ipvs.Service, ipvs.Dest) error
+    SetDest(ipvs.Service, ipvs.Dest) error
+    DelDest(ipvs.Service, ipvs.Dest) error
+
+    WalkConnections(context.Context, func(ipvs.Connection) error) error
 }
 
 type IpvsConfig struct {
     Debug       bool
     FwdMethod   string
     SchedName   string
-    mock        bool        // used for testing; do not actually setup the ipvsClient
+    NodeName    string      // used for backend subsetting; default: hostname
+    ApplyOrder  string      // ApplyAddFirst or ApplyDelFirst; default: ApplyAddFirst
+    NftPath     string      // nft command used for any frontend mirror, allow or deny rules; default: NFT_PATH
+    PinFwMark   uint32      // first fwmark used for the services of any client pins; default: PIN_FWMARK, within PIN_FWMARK_MASK
+    Mock        bool        // used for testing and replay; do not actually setup the ipvsClient
+
+    // Kernel connection timeouts shared by all services, rounded up to whole seconds; default: unchanged
+    TimeoutTCP      time.Duration
+    TimeoutTCPFin   time.Duration
+    TimeoutUDP      time.Duration
+
+    // Refuse any IPv4 frontends and backends, and only setup AF_INET6 services
+    IPv6Only        bool
+
+    // Encapsulation for any tunnel dests, using TunPort for GUE and TunFlags for the GUE/GRE checksums; default: ipip
+    TunType         string
+    TunPort         uint
+    TunFlags        string
+
+    // Start the connection sync daemons on the given multicast interfaces; default: not started
+    SyncMaster      string
+    SyncBackup      string
+    SyncID          uint
+
+    // Never modify or flush any kube-proxy services on the same node
+    KubeProxy       bool
+    KubeProxyDev    string  // default: KUBE_PROXY_DEV
+    KubeProxyPorts  string  // NodePort range; default: KUBE_PROXY_PORTS
+
+    // ip command used for the local addresses of any frontends with an interface; default: INJECT_IP_PATH
+    IPPath          string
+
+    // Reject any overlapping services and dests of different frontends and backends as config errors, instead of merging them
+    Strict          bool
+
+    // Manage the IPVS table of the network namespace at the given path, e.g. /var/run/netns/$name; default: current namespace
+    Netns           string
+
+    // Deadline for each kernel IPVS service and dest command; default: none
+    CommandTimeout  time.Duration
+
+    // Use the given client, e.g. an ipvs.FakeClient for testing; instead of ipvs.Open()
+    Client          IPVSClient
+
+    nft         nftCommands     // used for testing; instead of the NftPath command
+    kubeProxyAddrs  func(dev string) ([]net.IP, error)  // used for testing; instead of the KubeProxyDev addresses
+    local       injectCommands  // used for testing; instead of the IPPath command
+    localListening  func(ipvs.Protocol, net.IP, uint16) (bool, error)  // used for testing; instead of the /proc/net sockets
 }
 
 type IPVSDriver struct {
-    ipvsClient *ipvs.Client
+    ipvsClient IPVSClient
+    nft         nftCommands
 
     // global state
     routes      Routes
 
-    // deduplicate overlapping destinations
+    // deduplicate overlapping services and destinations
+    services    map[ipvsServiceKey]*ipvs.Service
+    serviceRefs map[ipvsServiceKey]uint
     dests       map[ipvsKey]*ipvs.Dest
+    destRefs    map[ipvsKey]uint
+
+    // config service/backend names, used to label stats
+    serviceNames    map[ipvsServiceKey][]string
+    destNames       map[ipvsKey][]string
+
+    // the params of each merged service, in the same order as the serviceNames; the most recent one is applied
+    serviceMerges   map[ipvsServiceKey][]*ipvs.Service
+
+    // frontends with nft mirror or filter rules
+    nftFrontends    map[*ipvsFrontend]bool
+
+    // temporary client pins by service name and client, with the first and next fwmark for their services
+    pins        map[pinKey]*ipvsPin
+    pinFwMarkFirst  uint32
+    pinFwMark   uint32
+
+    // ignore any kube-proxy services
+    kubeProxy   *kubeProxy
+
+    // queued service and dest commands during the initial sync, if supported by the ipvsClient
+    batch       *ipvs.Batch
+
+    // local addresses of any frontends with an interface, counted by frontend
+    ipPath      string
+    local       injectCommands
+    localAddrs  map[localAddr]uint
+    localListening  func(ipvs.Protocol, net.IP, uint16) (bool, error)
 
     // global defaults
+    ipv6Only    bool
     fwdMethod   ipvs.FwdMethod
+    tunType     ipvs.TunType
+    tunPort     uint16
+    tunFlags    ipvs.TunFlags
     schedName   string
+    nodeName    string
+    applyOrder  string
+    strict      bool
+    mixedAf     bool    // kernel supports IPVS_DEST_ATTR_ADDR_FAMILY for tunnel dests
+
+    // netlink debug dumps, toggled at runtime
+    debug       bool
+
+    // A/B weight experiments by service name, recorded by IPVSStats
+    experiments map[string]*driverExperiment
+
+    // used for testing; called after each change
+    trace       func(action string, ipvsService *ipvs.Service, ipvsDest *ipvs.Dest)
+}
+
+func timeoutSeconds(timeout time.Duration) uint32 {
+    return uint32((timeout + time.Second - 1) / time.Second)
+}
+
+// Return the configured kernel timeouts, with zero for any unchanged timeouts
+func (self IpvsConfig) timeout() ipvs.Timeout {
+    return ipvs.Timeout{
+        TCP:        timeoutSeconds(self.TimeoutTCP),
+        TCPFin:     timeoutSeconds(self.TimeoutTCPFin),
+        UDP:        timeoutSeconds(self.TimeoutUDP),
+    }
+}
+
+func (self IpvsConfig) openIPVS() (*ipvs.Client, error) {
+    if self.Netns != "" {
+        log.Printf("ipvs.OpenInNamespace: %s\n", self.Netns)
+
+        return ipvs.OpenInNamespace(self.Netns)
+    } else {
+        return ipvs.Open()
+    }
 }
 
 func (self IpvsConfig) setup(routes Routes) (*IPVSDriver, error) {
     driver := &IPVSDriver{
         routes: routes,
+        services:       make(map[ipvsServiceKey]*ipvs.Service),
+        serviceRefs:    make(map[ipvsServiceKey]uint),
         dests:  make(map[ipvsKey]*ipvs.Dest),
+        destRefs:   make(map[ipvsKey]uint),
+        serviceNames:   make(map[ipvsServiceKey][]string),
+        serviceMerges:  make(map[ipvsServiceKey][]*ipvs.Service),
+        destNames:      make(map[ipvsKey][]string),
+        nftFrontends:   make(map[*ipvsFrontend]bool),
+        pins:           make(map[pinKey]*ipvsPin),
+        experiments:    make(map[string]*driverExperiment),
+        localAddrs:     make(map[localAddr]uint),
     }
 
+    driver.ipv6Only = self.IPv6Only
+
     if self.FwdMethod == "" {
         driver.fwdMethod = IPVS_FWD_METHOD
     } else if fwdMethod, err := ipvs.ParseFwdMethod(self.FwdMethod); err != nil {
@@ -62,17 +307,94 @@ func (self IpvsConfig) setup(routes Routes) (*IPVSDriver, error) {
         driver.fwdMethod = fwdMethod
     }
 
+    if self.TunType == "" {
+
+    } else if tunType, err := ipvs.ParseTunType(self.TunType); err != nil {
+        return nil, err
+    } else {
+        driver.tunType = tunType
+    }
+
+    if self.TunFlags == "" {
+
+    } else if tunFlags, err := ipvs.ParseTunFlags(self.TunFlags); err != nil {
+        return nil, err
+    } else {
+        driver.tunFlags = tunFlags
+    }
+
+    if self.TunPort > 65535 {
+        return nil, errs.ConfigError(fmt.Errorf("Invalid TunPort: %d", self.TunPort))
+    } else if driver.tunType == ipvs.IP_VS_CONN_F_TUNNEL_TYPE_GUE && self.TunPort == 0 {
+        return nil, errs.ConfigError(fmt.Errorf("TunType gue requires a TunPort"))
+    } else if driver.tunType != ipvs.IP_VS_CONN_F_TUNNEL_TYPE_GUE && self.TunPort != 0 {
+        return nil, errs.ConfigError(fmt.Errorf("TunPort is only used for TunType gue"))
+    } else if driver.tunType == ipvs.IP_VS_CONN_F_TUNNEL_TYPE_IPIP && driver.tunFlags != 0 {
+        return nil, errs.ConfigError(fmt.Errorf("TunFlags are only used for TunType gue or gre"))
+    } else {
+        driver.tunPort = uint16(self.TunPort)
+    }
+
     if self.SchedName == "" {
         driver.schedName = IPVS_SCHED_NAME
     } else {
         driver.schedName = self.SchedName
     }
 
+    switch self.ApplyOrder {
+    case "":
+        driver.applyOrder = ApplyAddFirst
+    case ApplyAddFirst, ApplyDelFirst:
+        driver.applyOrder = self.ApplyOrder
+    default:
+        return nil, errs.ConfigError(fmt.Errorf("Invalid ApplyOrder: %s", self.ApplyOrder))
+    }
+
+    driver.strict = self.Strict
+
+    if self.PinFwMark == 0 {
+        driver.pinFwMarkFirst = PIN_FWMARK
+    } else if self.PinFwMark & ^PIN_FWMARK_MASK != 0 {
+        return nil, errs.ConfigError(fmt.Errorf("Invalid PinFwMark 0x%08x: outside of the mask 0x%08x", self.PinFwMark, PIN_FWMARK_MASK))
+    } else {
+        driver.pinFwMarkFirst = self.PinFwMark
+    }
+
+    driver.pinFwMark = driver.pinFwMarkFirst
+
+    if self.NodeName != "" {
+        driver.nodeName = self.NodeName
+    } else if hostname, err := os.Hostname(); err != nil {
+        return nil, err
+    } else {
+        driver.nodeName = hostname
+    }
+
+    if !self.KubeProxy {
+
+    } else if kubeProxy, err := makeKubeProxy(self.KubeProxyDev, self.KubeProxyPorts); err != nil {
+        return nil, err
+    } else {
+        if self.kubeProxyAddrs != nil {
+            kubeProxy.addrs = self.kubeProxyAddrs
+        }
+
+        log.Printf("clusterf:ipvs: coexist with %s\n", kubeProxy)
+
+        driver.kubeProxy = kubeProxy
+    }
+
     // IPVS
-    if self.mock {
+    if self.Client != nil {
+        driver.ipvsClient = self.Client
+    } else if self.Mock {
 
-    } else if ipvsClient, err := ipvs.Open(); err != nil {
+    } else if ipvsClient, err := self.openIPVS(); err != nil {
         return nil, err
+    } else if self.CommandTimeout > 0 {
+        log.Printf("ipvs.Open: %+v: timeout %v\n", ipvsClient, self.CommandTimeout)
+
+        driver.ipvsClient = ipvsDeadline{ipvsClient, self.CommandTimeout}
     } else {
         log.Printf("ipvs.Open: %+v\n", ipvsClient)
 
@@ -80,83 +402,382 @@ func (self IpvsConfig) setup(routes Routes) (*IPVSDriver, error) {
     }
 
     if driver.ipvsClient != nil && self.Debug {
-        driver.ipvsClient.SetDebug()
+        driver.ipvsClient.SetDebugEnabled(true)
     }
 
+    driver.debug = self.Debug
+
     if driver.ipvsClient == nil {
         // mock'd
+        driver.mixedAf = true
     } else if info, err := driver.ipvsClient.GetInfo(); err != nil {
         return nil, err
     } else {
-        log.Printf("ipvs.GetInfo: version=%s, conn_tab_size=%d\n", info.Version, info.ConnTabSize)
+        log.Printf("ipvs.GetInfo: %s\n", info)
+
+        driver.mixedAf = info.HasDestAttr(ipvs.IPVS_DEST_ATTR_ADDR_FAMILY)
+
+        if !info.HasDestAttr(ipvs.IPVS_DEST_ATTR_STATS64) {
+            log.Printf("ipvs.GetInfo: kernel %s does not support 64-bit stats\n", info.KernelVersion)
+        }
+
+        if driver.tunType != 0 && !info.HasDestAttr(ipvs.IPVS_DEST_ATTR_TUN_TYPE) {
+            return nil, errs.KernelError(fmt.Errorf("kernel %s does not support tunnel type %v", info.KernelVersion, driver.tunType))
+        }
+        if driver.tunFlags != 0 && !info.HasDestAttr(ipvs.IPVS_DEST_ATTR_TUN_FLAGS) {
+            return nil, errs.KernelError(fmt.Errorf("kernel %s does not support tunnel flags %v", info.KernelVersion, driver.tunFlags))
+        }
+    }
+
+    if timeout := self.timeout(); driver.ipvsClient == nil || timeout == (ipvs.Timeout{}) {
+
+    } else if err := driver.ipvsClient.SetTimeout(timeout); err != nil {
+        return nil, fmt.Errorf("ipvs.SetTimeout %v: %w", timeout, err)
+    } else if timeout, err := driver.ipvsClient.GetTimeout(); err != nil {
+        return nil, fmt.Errorf("ipvs.GetTimeout: %w", err)
+    } else {
+        log.Printf("ipvs.SetTimeout: %v\n", timeout)
+    }
+
+    if self.SyncID > 255 {
+        return nil, errs.ConfigError(fmt.Errorf("Invalid SyncID: %d is over 255", self.SyncID))
+    }
+
+    for _, daemon := range self.syncDaemons() {
+        if err := driver.StartSync(daemon); err != nil {
+            return nil, err
+        }
+    }
+
+    // nftables
+    if self.NftPath == "" {
+        self.NftPath = NFT_PATH
+    }
+
+    if self.nft != nil {
+        driver.nft = self.nft
+    } else if self.Mock {
+
+    } else if nftPath, err := exec.LookPath(self.NftPath); err != nil {
+        log.Printf("clusterf:ipvs: %v: frontend mirror, allow and deny are not supported\n", err)
+    } else {
+        driver.nft = nftExec{path: nftPath}
+    }
+
+    // local frontends
+    if self.IPPath == "" {
+        driver.ipPath = INJECT_IP_PATH
+    } else {
+        driver.ipPath = self.IPPath
+    }
+
+    if self.local != nil {
+        driver.local = self.local
+    } else if self.Mock {
+
+    } else {
+        driver.local = injectExec{}
+    }
+
+    if self.localListening != nil {
+        driver.localListening = self.localListening
+    } else if self.Mock {
+
+    } else {
+        driver.localListening = procListening
     }
 
     return driver, nil
 }
 
-// Begin initial config sync by flushing the system state
+// Begin initial config sync by flushing the system state, except for any kube-proxy services
 func (self *IPVSDriver) sync() error {
     if self.ipvsClient == nil {
 
+    } else if self.kubeProxy != nil {
+        if err := self.kubeProxy.flush(self.ipvsClient); err != nil {
+            return err
+        }
     } else if err := self.ipvsClient.Flush(); err != nil {
         return err
     } else {
         log.Printf("ipvs.Flush")
     }
 
+    // remove any nft rules left over from a previous run
+    if err := self.applyNft(); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (self *IPVSDriver) newFrontend(name string) *ipvsFrontend {
+    return makeFrontend(self, name)
+}
+
+// Return the config service name for the given ipvs.Service, or ""
+//
+// Merged services are named by the most recently added service that is still up.
+func (self *IPVSDriver) serviceName(serviceKey ipvsServiceKey) string {
+    names := self.serviceNames[serviceKey]
+
+    if len(names) == 0 {
+        return ""
+    }
+
+    return names[len(names) - 1]
+}
+
+// Return the config backend name(s) for the given ipvs.Dest, or ""
+//
+// Merged dests are named by their comma-separated backend names.
+func (self *IPVSDriver) destName(ipvsKey ipvsKey) string {
+    names := self.destNames[ipvsKey]
+
+    if len(names) == 1 {
+        return names[0]
+    }
+
+    sortedNames := append([]string(nil), names...)
+    sort.Strings(sortedNames)
+
+    return strings.Join(sortedNames, ",")
+}
+
+// Return a service/backend name for the given ipvs.Service/Dest, for logging
+func (self *IPVSDriver) keyName(ipvsKey ipvsKey) string {
+    return fmt.Sprintf("%s/%s", self.serviceName(ipvsKey.Service), self.destName(ipvsKey))
+}
+
+func (self *IPVSDriver) traceChange(action string, ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) {
+    if self.trace != nil {
+        self.trace(action, ipvsService, ipvsDest)
+    }
+}
+
+// Create the kernel service, or update any existing service, e.g. one left over from a previous run
+func (self *IPVSDriver) newService(ipvsService *ipvs.Service) error {
+    if self.batch != nil {
+        self.batch.NewService(*ipvsService)
+
+        return nil
+    }
+
+    if err := self.ipvsClient.NewService(*ipvsService); !errors.Is(err, ipvs.ErrServiceExists) {
+        return err
+    }
+
+    log.Printf("clusterf:ipvs newService %v: already exists, set\n", ipvsService)
+
+    return self.ipvsClient.SetService(*ipvsService)
+}
+
+// Update the kernel service, or create it if it has been removed
+func (self *IPVSDriver) setService(ipvsService *ipvs.Service) error {
+    if self.batch != nil {
+        self.batch.SetService(*ipvsService)
+
+        return nil
+    }
+
+    if err := self.ipvsClient.SetService(*ipvsService); !errors.Is(err, ipvs.ErrServiceNotFound) {
+        return err
+    }
+
+    log.Printf("clusterf:ipvs setService %v: not found, new\n", ipvsService)
+
+    return self.ipvsClient.NewService(*ipvsService)
+}
+
+// Remove the kernel service, unless it has already been removed
+func (self *IPVSDriver) delService(ipvsService *ipvs.Service) error {
+    if self.batch != nil {
+        self.batch.DelService(*ipvsService)
+
+        return nil
+    }
+
+    if err := self.ipvsClient.DelService(*ipvsService); errors.Is(err, ipvs.ErrServiceNotFound) {
+        log.Printf("clusterf:ipvs delService %v: already removed\n", ipvsService)
+    } else if err != nil {
+        return err
+    }
+
     return nil
 }
 
-func (self *IPVSDriver) newFrontend() *ipvsFrontend {
-    return makeFrontend(self)
+// Create the kernel dest, or update any existing dest
+func (self *IPVSDriver) newDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) error {
+    if self.batch != nil {
+        self.batch.NewDest(*ipvsService, *ipvsDest)
+
+        return nil
+    }
+
+    if err := self.ipvsClient.NewDest(*ipvsService, *ipvsDest); !errors.Is(err, ipvs.ErrDestExists) {
+        return err
+    }
+
+    log.Printf("clusterf:ipvs newDest %v %v: already exists, set\n", ipvsService, ipvsDest)
+
+    return self.ipvsClient.SetDest(*ipvsService, *ipvsDest)
+}
+
+// Update the kernel dest, or create it if it has been removed
+func (self *IPVSDriver) setDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) error {
+    if self.batch != nil {
+        self.batch.SetDest(*ipvsService, *ipvsDest)
+
+        return nil
+    }
+
+    if err := self.ipvsClient.SetDest(*ipvsService, *ipvsDest); !errors.Is(err, ipvs.ErrDestNotFound) {
+        return err
+    }
+
+    log.Printf("clusterf:ipvs setDest %v %v: not found, new\n", ipvsService, ipvsDest)
+
+    return self.ipvsClient.NewDest(*ipvsService, *ipvsDest)
+}
+
+// Remove the kernel dest, unless it or the service has already been removed
+func (self *IPVSDriver) delDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) error {
+    if self.batch != nil {
+        self.batch.DelDest(*ipvsService, *ipvsDest)
+
+        return nil
+    }
+
+    if err := self.ipvsClient.DelDest(*ipvsService, *ipvsDest); errors.Is(err, ipvs.ErrNotFound) {
+        log.Printf("clusterf:ipvs delDest %v %v: already removed\n", ipvsService, ipvsDest)
+    } else if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// bring up a service, merging if necessary.
+//
+// The params of any merged service are only applied by syncService, once its dests are up.
+func (self *IPVSDriver) upService(ipvsService *ipvs.Service, name string) error {
+    serviceKey := makeServiceKey(ipvsService)
+
+    if mergeService := self.services[serviceKey]; mergeService == nil {
+        log.Printf("clusterf:ipvs upService %s: new %v\n", name, ipvsService)
+
+        if self.kubeProxy == nil {
+
+        } else if err := self.kubeProxy.checkService(ipvsService); err != nil {
+            return err
+        }
+
+        if self.ipvsClient == nil {
+
+        } else if err := self.newService(ipvsService); err != nil  {
+            return err
+        }
+
+        self.services[serviceKey] = ipvsService
+
+    } else if mergeNames := self.serviceNames[serviceKey]; self.strict && !hasName(mergeNames, name) {
+        return errs.ConfigError(fmt.Errorf("Service %v of %s overlaps with %s", ipvsService, name, strings.Join(mergeNames, ",")))
+
+    } else {
+        log.Printf("clusterf:ipvs upService %s: merge %v\n", name, ipvsService)
+    }
+
+    self.serviceRefs[serviceKey]++
+    self.serviceNames[serviceKey] = append(self.serviceNames[serviceKey], name)
+    self.serviceMerges[serviceKey] = append(self.serviceMerges[serviceKey], ipvsService)
+    self.traceChange("upService", ipvsService, nil)
+
+    return nil
 }
 
-func (self *IPVSDriver) upService(ipvsService *ipvs.Service) error {
+// apply the params of the most recently merged service that is still up, if they differ from the current params
+func (self *IPVSDriver) syncService(ipvsService *ipvs.Service) error {
+    serviceKey := makeServiceKey(ipvsService)
+    merges := self.serviceMerges[serviceKey]
+
+    if len(merges) == 0 {
+        return nil
+    }
+
+    mergeService := merges[len(merges) - 1]
+
+    if currentService := self.services[serviceKey]; currentService == mergeService {
+        return nil
+    } else if !verifyServiceDiffers(*mergeService, *currentService) {
+        self.services[serviceKey] = mergeService
+
+        return nil
+    }
+
+    log.Printf("clusterf:ipvs syncService %s: set %v\n", self.serviceName(serviceKey), mergeService)
+
     if self.ipvsClient == nil {
 
-    } else if err := self.ipvsClient.NewService(*ipvsService); err != nil  {
+    } else if err := self.setService(mergeService); err != nil  {
         return err
     }
 
+    self.services[serviceKey] = mergeService
+    self.traceChange("syncService", mergeService, nil)
+
     return nil
 }
 
 // bring up a service-dest with given weight, mergeing if necessary
-func (self *IPVSDriver) upDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest, weight uint32) (*ipvs.Dest, error) {
-    ipvsKey := ipvsKey{ipvsService.String(), ipvsDest.String()}
+func (self *IPVSDriver) upDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest, weight uint32, name string) (*ipvs.Dest, error) {
+    ipvsKey := makeKey(ipvsService, ipvsDest)
 
     if mergeDest, mergeExists := self.dests[ipvsKey]; !mergeExists {
         ipvsDest.Weight = weight
 
-        log.Printf("clusterf:ipvs upDest: new %v %v\n", ipvsService, ipvsDest)
+        log.Printf("clusterf:ipvs upDest %s/%s: new %v %v\n", self.serviceName(ipvsKey.Service), name, ipvsService, ipvsDest)
 
         if self.ipvsClient == nil {
-        } else if err := self.ipvsClient.NewDest(*ipvsService, *ipvsDest); err != nil {
+        } else if err := self.newDest(ipvsService, ipvsDest); err != nil {
             return ipvsDest, err
         }
 
         self.dests[ipvsKey] = ipvsDest
+        self.destRefs[ipvsKey] = 1
+        self.destNames[ipvsKey] = []string{name}
+        self.traceChange("upDest", ipvsService, ipvsDest)
 
         return ipvsDest, nil
 
+    } else if mergeNames := self.destNames[ipvsKey]; self.strict && !hasName(mergeNames, name) {
+        return nil, errs.ConfigError(fmt.Errorf("Dest %v %v of %s/%s overlaps with %s", ipvsService, ipvsDest, self.serviceName(ipvsKey.Service), name, strings.Join(mergeNames, ",")))
+
     } else {
-        log.Printf("clusterf:ipvs upDest: merge %v %v +%d\n", ipvsService, mergeDest, weight)
+        log.Printf("clusterf:ipvs upDest %s: merge %s %v %v +%d\n", self.keyName(ipvsKey), name, ipvsService, mergeDest, weight)
 
         mergeDest.Weight += weight
+        // merged dests use the thresholds of the most recent backend
+        mergeDest.UThresh = ipvsDest.UThresh
+        mergeDest.LThresh = ipvsDest.LThresh
+        self.destRefs[ipvsKey]++
+        self.destNames[ipvsKey] = append(self.destNames[ipvsKey], name)
 
         if self.ipvsClient == nil {
 
-        } else if err := self.ipvsClient.SetDest(*ipvsService, *mergeDest); err != nil {
+        } else if err := self.setDest(ipvsService, mergeDest); err != nil {
             return mergeDest, err
         }
 
+        self.traceChange("upDest", ipvsService, mergeDest)
+
         return mergeDest, nil
     }
 }
 
-// update an existing dest with a new weight
+// update an existing dest with a new weight, and any thresholds already set on the dest
 func (self *IPVSDriver) adjustDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest, weightDelta int) error {
-    ipvsKey := ipvsKey{ipvsService.String(), ipvsDest.String()}
+    ipvsKey := makeKey(ipvsService, ipvsDest)
 
     if mergeDest := self.dests[ipvsKey]; mergeDest != ipvsDest {
         panic(fmt.Errorf("invalid dest %#v should be %#v", ipvsDest, mergeDest))
@@ -167,92 +788,578 @@ func (self *IPVSDriver) adjustDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Des
     // reconfigure active in-place
     if self.ipvsClient == nil {
 
-    } else if err := self.ipvsClient.SetDest(*ipvsService, *ipvsDest); err != nil  {
+    } else if err := self.setDest(ipvsService, ipvsDest); err != nil  {
         return err
     }
 
+    self.traceChange("adjustDest", ipvsService, ipvsDest)
+
     return nil
 }
 
 // bring down a service-dest with given weight, merging if necessary
-func (self *IPVSDriver) downDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest, weight uint32) error {
-    ipvsKey := ipvsKey{ipvsService.String(), ipvsDest.String()}
+func (self *IPVSDriver) downDest(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest, weight uint32, name string) error {
+    ipvsKey := makeKey(ipvsService, ipvsDest)
 
     if mergeDest := self.dests[ipvsKey]; mergeDest != ipvsDest {
         panic(fmt.Errorf("invalid dest %#v should be %#v", ipvsDest, mergeDest))
     }
 
-    if ipvsDest.Weight > weight {
-        log.Printf("clusterf:ipvs downDest: merge %v %v -%d\n", ipvsService, ipvsDest, weight)
+    if ipvsDest.Weight < weight {
+        panic(fmt.Errorf("invalid weight %d for dest %#v", weight, ipvsDest))
+
+    } else if self.destRefs[ipvsKey] > 1 {
+        log.Printf("clusterf:ipvs downDest %s: merge %s %v %v -%d\n", self.keyName(ipvsKey), name, ipvsService, ipvsDest, weight)
 
         ipvsDest.Weight -= weight
+        self.destRefs[ipvsKey]--
+        self.destNames[ipvsKey] = removeName(self.destNames[ipvsKey], name)
 
         if self.ipvsClient == nil {
 
-        } else if err := self.ipvsClient.SetDest(*ipvsService, *ipvsDest); err != nil {
+        } else if err := self.setDest(ipvsService, ipvsDest); err != nil {
             return err
         }
 
-    } else if ipvsDest.Weight < weight {
-        panic(fmt.Errorf("invalid weight %d for dest %#v", weight, ipvsDest))
+        self.traceChange("downDest", ipvsService, ipvsDest)
 
     } else {
-        log.Printf("clusterf:ipvs downdest: del %v %v\n", ipvsService, ipvsDest)
+        log.Printf("clusterf:ipvs downDest %s: del %v %v\n", self.keyName(ipvsKey), ipvsService, ipvsDest)
 
         if self.ipvsClient == nil {
 
-        } else if err := self.ipvsClient.DelDest(*ipvsService, *ipvsDest); err != nil  {
+        } else if err := self.delDest(ipvsService, ipvsDest); err != nil  {
             return err
         }
 
         delete(self.dests, ipvsKey)
+        delete(self.destRefs, ipvsKey)
+        delete(self.destNames, ipvsKey)
+
+        self.traceChange("downDest", ipvsService, ipvsDest)
     }
 
     return nil
 }
 
-func (self *IPVSDriver) downService(ipvsService *ipvs.Service) error {
+func hasName(names []string, name string) bool {
+    for _, n := range names {
+        if n == name {
+            return true
+        }
+    }
+
+    return false
+}
+
+func removeName(names []string, name string) []string {
+    for i, n := range names {
+        if n == name {
+            return append(names[:i], names[i+1:]...)
+        }
+    }
+
+    return names
+}
+
+// remove the name and params of the merged service, matching the same name by the service added by upService
+func (self *IPVSDriver) removeServiceMerge(serviceKey ipvsServiceKey, ipvsService *ipvs.Service, name string) {
+    names := self.serviceNames[serviceKey]
+    merges := self.serviceMerges[serviceKey]
+    index := -1
+
+    for i, mergeService := range merges {
+        if names[i] != name {
+            continue
+        } else if index < 0 || mergeService == ipvsService {
+            index = i
+        }
+    }
+
+    if index < 0 {
+        return
+    }
+
+    self.serviceNames[serviceKey] = append(names[:index], names[index+1:]...)
+    self.serviceMerges[serviceKey] = append(merges[:index], merges[index+1:]...)
+}
+
+// bring down a service, merging if necessary
+func (self *IPVSDriver) downService(ipvsService *ipvs.Service, name string) error {
+    serviceKey := makeServiceKey(ipvsService)
+
+    if self.serviceRefs[serviceKey] > 1 {
+        log.Printf("clusterf:ipvs downService %s: merge %s %v\n", self.serviceName(serviceKey), name, ipvsService)
+
+        self.serviceRefs[serviceKey]--
+        self.removeServiceMerge(serviceKey, ipvsService, name)
+        self.traceChange("downService", ipvsService, nil)
+
+        // restore the params of the remaining services
+        return self.syncService(ipvsService)
+    }
+
+    log.Printf("clusterf:ipvs downService %s: del %v\n", self.serviceName(serviceKey), ipvsService)
+
     if self.ipvsClient == nil {
 
-    } else if err := self.ipvsClient.DelService(*ipvsService); err != nil {
+    } else if err := self.delService(ipvsService); err != nil {
         return err
     }
 
     // flush any dests, since the kernel will also clear them out
+
     for ipvsKey, _ := range self.dests {
-        if ipvsService.String() == ipvsKey.Service {
+        if ipvsKey.Service == serviceKey {
             delete(self.dests, ipvsKey)
+            delete(self.destRefs, ipvsKey)
+            delete(self.destNames, ipvsKey)
         }
     }
 
+    delete(self.services, serviceKey)
+    delete(self.serviceRefs, serviceKey)
+    delete(self.serviceNames, serviceKey)
+    delete(self.serviceMerges, serviceKey)
+
+    self.traceChange("downService", ipvsService, nil)
+
     return nil
 }
 
+// Compare the kernel dests for a service against the driver dests, returning the dests to add, update or remove in the kernel.
+func verifyDests(kernelDests []ipvs.Dest, driverDests map[ipvsDestKey]*ipvs.Dest) (newDests []*ipvs.Dest, setDests []*ipvs.Dest, delDests []*ipvs.Dest) {
+    kernelKeys := make(map[ipvsDestKey]bool)
+
+    for i, _ := range kernelDests {
+        kernelDest := &kernelDests[i]
+        destKey := makeDestKey(kernelDest)
+
+        kernelKeys[destKey] = true
+
+        if driverDest := driverDests[destKey]; driverDest == nil {
+            delDests = append(delDests, kernelDest)
+        } else if driverDest.Weight != kernelDest.Weight || driverDest.FwdMethod & ipvs.IP_VS_CONN_F_FWD_MASK != kernelDest.FwdMethod & ipvs.IP_VS_CONN_F_FWD_MASK {
+            setDests = append(setDests, driverDest)
+        } else if driverDest.UThresh != kernelDest.UThresh || driverDest.LThresh != kernelDest.LThresh {
+            setDests = append(setDests, driverDest)
+        } else if driverDest.TunType != kernelDest.TunType || driverDest.TunPort != kernelDest.TunPort || driverDest.TunFlags != kernelDest.TunFlags {
+            setDests = append(setDests, driverDest)
+        }
+    }
+
+    for destKey, driverDest := range driverDests {
+        if !kernelKeys[destKey] {
+            newDests = append(newDests, driverDest)
+        }
+    }
+
+    // apply in a consistent order
+    sort.Slice(newDests, func(i, j int) bool { return newDests[i].String() < newDests[j].String() })
+
+    return
+}
+
+// Compare the service parameters set by the driver, ignoring the Hashed flag that is always set by the kernel
+func verifyServiceDiffers(driverService ipvs.Service, kernelService ipvs.Service) bool {
+    driverFlags, kernelFlags := driverService.Flags, kernelService.Flags
+    driverFlags.Hashed = false
+    kernelFlags.Hashed = false
+
+    return driverService.SchedName != kernelService.SchedName || driverFlags != kernelFlags || driverService.Timeout != kernelService.Timeout || driverService.Netmask != kernelService.Netmask
+}
+
+// Verify the kernel IPVS state against the driver state, repairing any differences.
+//
+// Returns the number of repaired services and dests.
+func (self *IPVSDriver) Verify() (int, error) {
+    var repairs int
+
+    if self.ipvsClient == nil {
+        // mock'd
+        return 0, nil
+    }
+
+    kernelServices, err := self.ipvsClient.ListServices()
+    if err != nil {
+        return repairs, fmt.Errorf("ipvs.ListServices: %w", err)
+    }
+
+    var kubeProxyAddrs map[string]bool
+
+    if self.kubeProxy == nil {
+
+    } else if kubeProxyAddrs, err = self.kubeProxy.loadAddrs(); err != nil {
+        return repairs, err
+    }
+
+    // driver dests by service
+    driverDests := make(map[ipvsServiceKey]map[ipvsDestKey]*ipvs.Dest)
+
+    for serviceKey, _ := range self.services {
+        driverDests[serviceKey] = make(map[ipvsDestKey]*ipvs.Dest)
+    }
+    for ipvsKey, ipvsDest := range self.dests {
+        driverDests[ipvsKey.Service][ipvsKey.Dest] = ipvsDest
+    }
+
+    kernelKeys := make(map[ipvsServiceKey]bool)
+
+    for _, kernelService := range kernelServices {
+        serviceKey := makeServiceKey(&kernelService)
+        driverService := self.services[serviceKey]
+
+        kernelKeys[serviceKey] = true
+
+        if self.kubeProxy != nil && self.kubeProxy.owns(kubeProxyAddrs, kernelService) {
+            if driverService != nil {
+                log.Printf("clusterf:ipvs Verify %s: skip %v owned by %s\n", self.serviceName(serviceKey), kernelService, self.kubeProxy)
+            }
+
+            continue
+
+        } else if driverService == nil {
+            log.Printf("clusterf:ipvs Verify: del %v\n", kernelService)
+
+            if err := self.ipvsClient.DelService(kernelService); err != nil {
+                return repairs, err
+            }
+
+            repairs++
+            continue
+
+        } else if verifyServiceDiffers(*driverService, kernelService) {
+            log.Printf("clusterf:ipvs Verify %s: set %v\n", self.serviceName(serviceKey), driverService)
+
+            if err := self.ipvsClient.SetService(*driverService); err != nil {
+                return repairs, err
+            }
+
+            repairs++
+        }
+
+        kernelDests, err := self.ipvsClient.ListDests(kernelService)
+        if err != nil {
+            return repairs, fmt.Errorf("ipvs.ListDests %v: %w", kernelService, err)
+        }
+
+        if n, err := self.repairDests(driverService, kernelDests, driverDests[serviceKey]); err != nil {
+            return repairs, err
+        } else {
+            repairs += n
+        }
+    }
+
+    for _, driverService := range self.sortedServices() {
+        serviceKey := makeServiceKey(driverService)
+
+        if kernelKeys[serviceKey] {
+            continue
+        }
+
+        log.Printf("clusterf:ipvs Verify %s: new %v\n", self.serviceName(serviceKey), driverService)
+
+        if err := self.ipvsClient.NewService(*driverService); err != nil {
+            return repairs, err
+        }
+
+        repairs++
+
+        if n, err := self.repairDests(driverService, nil, driverDests[serviceKey]); err != nil {
+            return repairs, err
+        } else {
+            repairs += n
+        }
+    }
+
+    return repairs, nil
+}
+
+// Verify the kernel IPVS services for the named service, or only the dests for the named backend, repairing any differences.
+//
+// Unlike Verify, this only looks up the individual kernel services, and for a backend, the individual dests. Any other services
+// or dests in the kernel are not removed.
+func (self *IPVSDriver) VerifyService(serviceName string, backendName string) (int, error) {
+    var repairs, count, destCount int
+
+    for _, driverService := range self.sortedServices() {
+        serviceKey := makeServiceKey(driverService)
+        driverDests := make(map[ipvsDestKey]*ipvs.Dest)
+        allDests := make(map[ipvsDestKey]*ipvs.Dest)
+
+        if !hasName(self.serviceNames[serviceKey], serviceName) {
+            continue
+        }
+
+        for ipvsKey, ipvsDest := range self.dests {
+            if ipvsKey.Service != serviceKey {
+                continue
+            }
+
+            allDests[ipvsKey.Dest] = ipvsDest
+
+            for _, name := range self.destNames[ipvsKey] {
+                if backendName == "" || name == backendName {
+                    driverDests[ipvsKey.Dest] = ipvsDest
+                }
+            }
+        }
+
+        count++
+        destCount += len(driverDests)
+
+        if self.ipvsClient == nil {
+            // mock'd
+            continue
+        }
+
+        kernelService, err := self.ipvsClient.GetService(*driverService)
+        if errors.Is(err, ipvs.ErrServiceNotFound) {
+            log.Printf("clusterf:ipvs VerifyService %s: new %v\n", serviceName, driverService)
+
+            if err := self.ipvsClient.NewService(*driverService); err != nil {
+                return repairs, err
+            }
+
+            repairs++
+
+            if n, err := self.repairDests(driverService, nil, allDests); err != nil {
+                return repairs, err
+            } else {
+                repairs += n
+            }
+
+            continue
+
+        } else if err != nil {
+            return repairs, fmt.Errorf("ipvs.GetService %v: %w", driverService, err)
+
+        } else if verifyServiceDiffers(*driverService, kernelService) {
+            log.Printf("clusterf:ipvs VerifyService %s: set %v\n", serviceName, driverService)
+
+            if err := self.ipvsClient.SetService(*driverService); err != nil {
+                return repairs, err
+            }
+
+            repairs++
+        }
+
+        var kernelDests []ipvs.Dest
+
+        if backendName == "" {
+            if kernelDests, err = self.ipvsClient.ListDests(*driverService); err != nil {
+                return repairs, fmt.Errorf("ipvs.ListDests %v: %w", driverService, err)
+            }
+        } else {
+            for _, driverDest := range driverDests {
+                if kernelDest, err := self.ipvsClient.GetDest(*driverService, *driverDest); errors.Is(err, ipvs.ErrDestNotFound) {
+                    continue
+                } else if err != nil {
+                    return repairs, fmt.Errorf("ipvs.GetDest %v %v: %w", driverService, driverDest, err)
+                } else {
+                    kernelDests = append(kernelDests, kernelDest)
+                }
+            }
+        }
+
+        if n, err := self.repairDests(driverService, kernelDests, driverDests); err != nil {
+            return repairs, err
+        } else {
+            repairs += n
+        }
+    }
+
+    if count == 0 {
+        return 0, errs.ConfigError(fmt.Errorf("Service not found: %s", serviceName))
+    } else if backendName != "" && destCount == 0 {
+        return 0, errs.ConfigError(fmt.Errorf("Backend not found: %s/%s", serviceName, backendName))
+    }
+
+    return repairs, nil
+}
+
+func (self *IPVSDriver) repairDests(ipvsService *ipvs.Service, kernelDests []ipvs.Dest, driverDests map[ipvsDestKey]*ipvs.Dest) (int, error) {
+    newDests, setDests, delDests := verifyDests(kernelDests, driverDests)
+
+    for _, ipvsDest := range newDests {
+        log.Printf("clusterf:ipvs Verify %s: new %v %v\n", self.keyName(makeKey(ipvsService, ipvsDest)), ipvsService, ipvsDest)
+
+        if err := self.ipvsClient.NewDest(*ipvsService, *ipvsDest); err != nil {
+            return 0, err
+        }
+    }
+    for _, ipvsDest := range setDests {
+        log.Printf("clusterf:ipvs Verify %s: set %v %v\n", self.keyName(makeKey(ipvsService, ipvsDest)), ipvsService, ipvsDest)
+
+        if err := self.ipvsClient.SetDest(*ipvsService, *ipvsDest); err != nil {
+            return 0, err
+        }
+    }
+    for _, ipvsDest := range delDests {
+        log.Printf("clusterf:ipvs Verify: del %v %v\n", ipvsService, ipvsDest)
+
+        if err := self.ipvsClient.DelDest(*ipvsService, *ipvsDest); err != nil {
+            return 0, err
+        }
+    }
+
+    return len(newDests) + len(setDests) + len(delDests), nil
+}
+
+// Enable or disable the ipvs netlink debug dumps, without restarting the daemon
+func (self *IPVSDriver) SetDebug(debug bool) {
+    if self.ipvsClient != nil {
+        self.ipvsClient.SetDebugEnabled(debug)
+    }
+
+    log.Printf("clusterf:ipvs SetDebug: %v\n", debug)
+
+    self.debug = debug
+}
+
+func (self *IPVSDriver) Debug() bool {
+    return self.debug
+}
+
+// Reset the kernel counters for the IPVS services of the named config service, or all services if empty.
+//
+// Returns the number of IPVS services reset.
+func (self *IPVSDriver) Zero(serviceName string) (int, error) {
+    var count int
+
+    if serviceName == "" && self.kubeProxy != nil {
+        // only zero our own services
+        for _, ipvsService := range self.sortedServices() {
+            if self.ipvsClient == nil {
+
+            } else if err := self.ipvsClient.ZeroService(*ipvsService); err != nil {
+                return count, err
+            }
+
+            count++
+        }
+
+        log.Printf("clusterf:ipvs Zero: all %d services\n", count)
+
+        return count, nil
+
+    } else if serviceName == "" {
+        if self.ipvsClient == nil {
+
+        } else if err := self.ipvsClient.ZeroAll(); err != nil {
+            return 0, err
+        }
+
+        log.Printf("clusterf:ipvs Zero: all\n")
+
+        return len(self.services), nil
+    }
+
+    for _, ipvsService := range self.sortedServices() {
+        if self.serviceName(makeServiceKey(ipvsService)) != serviceName {
+            continue
+        }
+
+        if self.ipvsClient == nil {
+
+        } else if err := self.ipvsClient.ZeroService(*ipvsService); err != nil {
+            return count, err
+        }
+
+        log.Printf("clusterf:ipvs Zero %s: %v\n", serviceName, ipvsService)
+
+        count++
+    }
+
+    if count == 0 {
+        return 0, errs.ConfigError(fmt.Errorf("Service not found: %s", serviceName))
+    }
+
+    return count, nil
+}
+
+// Return the driver's services, in a consistent order
+func (self *IPVSDriver) sortedServices() []*ipvs.Service {
+    var services []*ipvs.Service
+
+    for _, service := range self.services {
+        services = append(services, service)
+    }
+
+    sort.Slice(services, func(i, j int) bool { return services[i].String() < services[j].String() })
+
+    return services
+}
+
+// Call the given func for each IPVS service, in a consistent order, with the config service name
+func (self *IPVSDriver) EachService(f func(ipvsService ipvs.Service, serviceName string)) {
+    for _, ipvsService := range self.sortedServices() {
+        f(*ipvsService, self.serviceName(makeServiceKey(ipvsService)))
+    }
+}
+
+// Return the driver's dests for the service, in a consistent order
+func (self *IPVSDriver) sortedDests(service *ipvs.Service) []*ipvs.Dest {
+    var dests []*ipvs.Dest
+    var serviceKey = makeServiceKey(service)
+
+    for key, dest := range self.dests {
+        if key.Service == serviceKey {
+            dests = append(dests, dest)
+        }
+    }
+
+    sort.Slice(dests, func(i, j int) bool { return dests[i].String() < dests[j].String() })
+
+    return dests
+}
+
 func (self *IPVSDriver) Print() {
+    var services []ipvs.Service
+
     if self.ipvsClient == nil {
-        fmt.Printf("Mock'd\n")
-    } else if services, err := self.ipvsClient.ListServices(); err != nil {
+        for _, service := range self.sortedServices() {
+            services = append(services, *service)
+        }
+    } else if listServices, err := self.ipvsClient.ListServices(); err != nil {
         log.Fatalf("ipvs.ListServices: %v\n", err)
     } else {
-        fmt.Printf("Proto                           Addr:Port\n")
-        for _, service := range services {
-            fmt.Printf("%-5v %30s:%-5d %s\n",
-                service.Protocol,
-                service.Addr, service.Port,
-                service.SchedName,
-            )
+        services = listServices
+    }
 
-            if dests, err := self.ipvsClient.ListDests(service); err != nil {
-                log.Fatalf("ipvs.ListDests: %v\n", err)
-            } else {
-                for _, dest := range dests {
-                    fmt.Printf("%5s %30s:%-5d %v\n",
-                        "",
-                        dest.Addr, dest.Port,
-                        dest.FwdMethod,
-                    )
-                }
+    fmt.Printf("Proto                           Addr:Port\n")
+    fmt.Printf("                                Dest:Port  Forward  Weight ActiveConn InActConn PersistConn\n")
+    for _, service := range services {
+        var dests []ipvs.Dest
+
+        serviceKey := makeServiceKey(&service)
+
+        fmt.Printf("%-5v %30s:%-5d %-8s %s\n",
+            service.Protocol,
+            service.Addr, service.Port,
+            service.SchedName,
+            self.serviceName(serviceKey),
+        )
+
+        if self.ipvsClient == nil {
+            for _, dest := range self.sortedDests(&service) {
+                dests = append(dests, *dest)
             }
+        } else if listDests, err := self.ipvsClient.ListDests(service); err != nil {
+            log.Fatalf("ipvs.ListDests: %v\n", err)
+        } else {
+            dests = listDests
+        }
+
+        for _, dest := range dests {
+            fmt.Printf("%5s %30s:%-5d %-8v %-6d %-10d %-9d %-11d %s\n",
+                "",
+                dest.Addr, dest.Port,
+                dest.FwdMethod,
+                dest.Weight,
+                dest.ActiveConns, dest.InactConns, dest.PersistConns,
+                self.destName(ipvsKey{serviceKey, makeDestKey(&dest)}),
+            )
         }
     }
 }
@@ -1,8 +1,6 @@
 package ipvs
 
 import (
-    "encoding/binary"
-    "bytes"
     "fmt"
     "net"
     "github.com/hkwi/nlgo"
@@ -14,21 +12,6 @@ func nlattr (typ uint16, value nlgo.NlaValue) nlgo.Attr {
     return nlgo.Attr{Header: syscall.NlAttr{Type: typ}, Value: value}
 }
 
-// Helpers for struct <-> nlgo.Binary
-func unpack(value nlgo.Binary, out interface{}) error {
-    return binary.Read(bytes.NewReader(([]byte)(value)), binary.BigEndian, out)
-}
-
-func pack (in interface{}) nlgo.Binary {
-    var buf bytes.Buffer
-
-    if err := binary.Write(&buf, binary.BigEndian, in); err != nil {
-        panic(err)
-    }
-
-    return nlgo.Binary(buf.Bytes())
-}
-
 // Helpers for net.IP <-> nlgo.Binary
 func unpackAddr (value nlgo.Binary, af Af) (net.IP, error) {
     buf := ([]byte)(value)
@@ -73,6 +56,30 @@ func ntohs (value uint16) uint16 {
     return ((value & 0x00ff) << 8) | ((value & 0xff00) >> 8)
 }
 
+// Helpers for uint32 <-> network byte order
+func htonl (value uint32) uint32 {
+    return ((value & 0x000000ff) << 24) | ((value & 0x0000ff00) << 8) | ((value & 0x00ff0000) >> 8) | ((value & 0xff000000) >> 24)
+}
+func ntohl (value uint32) uint32 {
+    return htonl(value)
+}
+
+// Helpers for the persistence netmask <-> nlgo.U32, in network byte order for AF_INET, or as a prefix length for AF_INET6
+func unpackNetmask (val nlgo.U32, af Af) uint32 {
+    if af == syscall.AF_INET {
+        return ntohl((uint32)(val))
+    } else {
+        return (uint32)(val)
+    }
+}
+func packNetmask (af Af, netmask uint32) nlgo.U32 {
+    if af == syscall.AF_INET {
+        return nlgo.U32(htonl(netmask))
+    } else {
+        return nlgo.U32(netmask)
+    }
+}
+
 func unpackPort (val nlgo.U16) uint16 {
     return ntohs((uint16)(val))
 }
@@ -43,6 +43,45 @@ func TestInfo (t *testing.T) {
     }
 }
 
+var testKernelVersion = []struct { release string; version KernelVersion } {
+    { "3.16.0-4-amd64", KernelVersion{3, 16} },
+    { "5.15.0-91-generic", KernelVersion{5, 15} },
+    { "6.1", KernelVersion{6, 1} },
+    { "4.1rc1", KernelVersion{4, 1} },
+}
+
+func TestKernelVersion (t *testing.T) {
+    for _, test := range testKernelVersion {
+        if version, err := ParseKernelVersion(test.release); err != nil {
+            t.Errorf("fail ParseKernelVersion(%s): %v", test.release, err)
+        } else if version != test.version {
+            t.Errorf("fail ParseKernelVersion(%s): %v != %v", test.release, version, test.version)
+        }
+    }
+
+    if _, err := ParseKernelVersion("linux"); err == nil {
+        t.Errorf("fail ParseKernelVersion(linux): no error")
+    }
+}
+
+func TestInfoAttrs (t *testing.T) {
+    oldInfo := Info{KernelVersion: KernelVersion{3, 16}}
+    newInfo := Info{KernelVersion: KernelVersion{5, 2}}
+
+    if !oldInfo.HasServiceAttr(IPVS_SVC_ATTR_STATS) || !oldInfo.HasDestAttr(IPVS_DEST_ATTR_WEIGHT) {
+        t.Errorf("fail Info %v: missing attrs", oldInfo.KernelVersion)
+    }
+    if oldInfo.HasServiceAttr(IPVS_SVC_ATTR_STATS64) || oldInfo.HasDestAttr(IPVS_DEST_ATTR_ADDR_FAMILY) || oldInfo.HasDestAttr(IPVS_DEST_ATTR_STATS64) || oldInfo.HasDestAttr(IPVS_DEST_ATTR_TUN_TYPE) {
+        t.Errorf("fail Info %v: unexpected attrs", oldInfo.KernelVersion)
+    }
+    if !newInfo.HasServiceAttr(IPVS_SVC_ATTR_STATS64) || !newInfo.HasDestAttr(IPVS_DEST_ATTR_ADDR_FAMILY) || !newInfo.HasDestAttr(IPVS_DEST_ATTR_TUN_PORT) {
+        t.Errorf("fail Info %v: missing attrs", newInfo.KernelVersion)
+    }
+    if newInfo.HasDestAttr(IPVS_DEST_ATTR_TUN_FLAGS) {
+        t.Errorf("fail Info %v: unexpected attrs", newInfo.KernelVersion)
+    }
+}
+
 func testServiceEquals (t *testing.T, testService Service, service Service) {
     if service.Af != testService.Af {
         t.Errorf("fail Service.Af: %s", service.Af)
@@ -59,7 +98,7 @@ func testServiceEquals (t *testing.T, testService Service, service Service) {
     if service.SchedName != testService.SchedName {
         t.Errorf("fail Service.SchedName: %s", service.SchedName)
     }
-    if service.Flags.Flags != testService.Flags.Flags || service.Flags.Mask != testService.Flags.Mask {
+    if service.Flags != testService.Flags {
         t.Errorf("fail Service.Flags: %+v", service.Flags)
     }
     if service.Timeout != testService.Timeout {
@@ -77,7 +116,7 @@ func TestService (t *testing.T) {
         Addr:       net.ParseIP("10.107.107.0"),
         Port:       1337,
         SchedName:  "wlc",
-        Flags:      Flags{0, 0},
+        Flags:      Flags{},
         Timeout:    0,
         Netmask:    0x00000000,
     }
@@ -89,7 +128,7 @@ func TestService (t *testing.T) {
          0x08,0x00, 0x03,0x00,   0x0a,0x6b,0x6b,0x00,   // IPVS_SVC_ATTR_ADDR       10.107.107.0
          0x06,0x00, 0x04,0x00,   0x05,0x39, 0x00,0x00,   // IPVS_SVC_ATTR_PORT       1337
          0x08,0x00, 0x06,0x00,   'w','l','c',0x00,      // IPVS_SVC_ATTR_SCHED_NAME wlc
-         0x0c,0x00, 0x07,0x00,   0x00,0x00,0x00,0x00, 0x00,0x00,0x00,0x00,    // IPVS_SVC_ATTR_FLAGS 0:0
+         0x0c,0x00, 0x07,0x00,   0x00,0x00,0x00,0x00, 0xfd,0xff,0xff,0xff,    // IPVS_SVC_ATTR_FLAGS 0:~hashed
          0x08,0x00, 0x08,0x00,   0x00,0x00,0x00,0x00,    // IPVS_SVC_ATTR_TIMEOUT    0
          0x08,0x00, 0x09,0x00,   0x00,0x00,0x00,0x00,    // IPVS_SVC_ATTR_NETMASK    0
     }
@@ -112,6 +151,36 @@ func TestService (t *testing.T) {
     }
 }
 
+func TestServiceFwMark (t *testing.T) {
+    testAttrs := nlgo.AttrMap{Policy: ipvs_service_policy, AttrSlice: nlgo.AttrSlice{
+        {Header: syscall.NlAttr{Type: IPVS_SVC_ATTR_AF}, Value: nlgo.U16(syscall.AF_INET)},
+        {Header: syscall.NlAttr{Type: IPVS_SVC_ATTR_FWMARK}, Value: nlgo.U32(0xcf000100)},
+        {Header: syscall.NlAttr{Type: IPVS_SVC_ATTR_SCHED_NAME}, Value: nlgo.NulString("wlc")},
+        {Header: syscall.NlAttr{Type: IPVS_SVC_ATTR_FLAGS}, Value: Flags{}.pack()},
+    }}
+
+    if service, err := unpackService(testAttrs); err != nil {
+        t.Errorf("error unpackService: %s", err)
+    } else if service.Af != syscall.AF_INET || service.FwMark != 0xcf000100 || service.SchedName != "wlc" {
+        t.Errorf("fail unpackService: %#v", service)
+    } else if service.Addr != nil || service.Protocol != 0 || service.Port != 0 {
+        t.Errorf("fail unpackService: unexpected addr fields: %#v", service)
+    } else if service.String() != "inet+fwmark://3472883968" {
+        t.Errorf("fail unpackService: %s", service)
+    }
+
+    // without a fwmark, the protocol and port are required
+    testAttrs = nlgo.AttrMap{Policy: ipvs_service_policy, AttrSlice: nlgo.AttrSlice{
+        {Header: syscall.NlAttr{Type: IPVS_SVC_ATTR_AF}, Value: nlgo.U16(syscall.AF_INET)},
+        {Header: syscall.NlAttr{Type: IPVS_SVC_ATTR_ADDR}, Value: nlgo.Binary{10, 107, 107, 0}},
+        {Header: syscall.NlAttr{Type: IPVS_SVC_ATTR_FLAGS}, Value: Flags{}.pack()},
+    }}
+
+    if service, err := unpackService(testAttrs); err == nil {
+        t.Errorf("fail unpackService: expected error, got %v", service)
+    }
+}
+
 func testDestEquals (t *testing.T, testDest Dest, dest Dest) {
     if dest.Addr.String() != testDest.Addr.String() {
         t.Errorf("fail testDest.unpack(): Addr %v", dest.Addr.String())
@@ -119,6 +188,9 @@ func testDestEquals (t *testing.T, testDest Dest, dest Dest) {
     if dest.Port != testDest.Port {
         t.Errorf("fail testDest.unpack(): Port %v", dest.Port)
     }
+    if dest.Af != testDest.Af {
+        t.Errorf("fail testDest.unpack(): Af %v", dest.Af)
+    }
     if dest.FwdMethod != testDest.FwdMethod {
         t.Errorf("fail testDest.unpack(): FwdMethod %v", dest.FwdMethod)
     }
@@ -131,6 +203,58 @@ func testDestEquals (t *testing.T, testDest Dest, dest Dest) {
     if dest.LThresh != testDest.LThresh {
         t.Errorf("fail testDest.unpack(): LThresh %v", dest.LThresh)
     }
+    if dest.TunType != testDest.TunType {
+        t.Errorf("fail testDest.unpack(): TunType %v", dest.TunType)
+    }
+    if dest.TunPort != testDest.TunPort {
+        t.Errorf("fail testDest.unpack(): TunPort %v", dest.TunPort)
+    }
+    if dest.TunFlags != testDest.TunFlags {
+        t.Errorf("fail testDest.unpack(): TunFlags %v", dest.TunFlags)
+    }
+    if dest.ActiveConns != testDest.ActiveConns {
+        t.Errorf("fail testDest.unpack(): ActiveConns %v", dest.ActiveConns)
+    }
+    if dest.InactConns != testDest.InactConns {
+        t.Errorf("fail testDest.unpack(): InactConns %v", dest.InactConns)
+    }
+    if dest.PersistConns != testDest.PersistConns {
+        t.Errorf("fail testDest.unpack(): PersistConns %v", dest.PersistConns)
+    }
+}
+
+func TestFlags (t *testing.T) {
+    testFlags := Flags{Persistent: true, SchedFallback: true}
+
+    if bits := testFlags.Bits(); bits != IP_VS_SVC_F_PERSISTENT | IP_VS_SVC_F_SCHED_SH_FALLBACK {
+        t.Errorf("fail Flags.Bits(): %#x", bits)
+    } else if flags := MakeFlags(bits); flags != testFlags {
+        t.Errorf("fail MakeFlags(): %+v", flags)
+    }
+    if str := testFlags.String(); str != "persistent,flag-1" {
+        t.Errorf("fail Flags.String(): %v", str)
+    }
+
+    // deprecated bitmask conversions
+    if bitmask := testFlags.Bitmask(); bitmask != (FlagsBitmask{Flags: IP_VS_SVC_F_PERSISTENT | IP_VS_SVC_F_SCHED_SH_FALLBACK, Mask: 0xfffffffd}) {
+        t.Errorf("fail Flags.Bitmask(): %+v", bitmask)
+    } else if flags := FlagsFromBitmask(FlagsBitmask{Flags: 0xffffffff, Mask: IP_VS_SVC_F_PERSISTENT}); flags != (Flags{Persistent: true}) {
+        t.Errorf("fail FlagsFromBitmask(): %+v", flags)
+    }
+
+    // pack in host byte order, without the kernel hashed flag
+    packBytes := ([]byte)(Flags{Persistent: true, Hashed: true}.pack())
+
+    if !bytes.Equal(packBytes, []byte{0x01,0x00,0x00,0x00, 0xfd,0xff,0xff,0xff}) {
+        t.Errorf("fail Flags.pack(): \n%s", hex.Dump(packBytes))
+    }
+
+    // unpack the kernel flags
+    if flags, err := unpackFlags(nlgo.Binary{0x03,0x00,0x00,0x00, 0xff,0xff,0xff,0xff}); err != nil {
+        t.Errorf("error unpackFlags: %s", err)
+    } else if flags != (Flags{Persistent: true, Hashed: true}) {
+        t.Errorf("fail unpackFlags: %+v", flags)
+    }
 }
 
 func TestDest (t *testing.T) {
@@ -172,3 +296,261 @@ func TestDest (t *testing.T) {
         testDestEquals(t, testDest, unpackedDest)
     }
 }
+
+func TestDestConns (t *testing.T) {
+    testService := Service {
+        Af:     syscall.AF_INET,
+    }
+    testDest := Dest{
+        Addr:   net.ParseIP("10.1.0.1"),
+        Port:   8080,
+
+        FwdMethod:  IP_VS_CONN_F_MASQ,
+        Weight:     10,
+
+        ActiveConns:    3,
+        InactConns:     12,
+        PersistConns:   7,
+    }
+    testAttrs := nlgo.AttrSlice{
+        nlattr(IPVS_DEST_ATTR_ADDR, nlgo.Binary([]byte{10, 1, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})),
+        nlattr(IPVS_DEST_ATTR_PORT, nlgo.U16(0x901f)),
+        nlattr(IPVS_DEST_ATTR_FWD_METHOD, nlgo.U32(IP_VS_CONN_F_MASQ)),
+        nlattr(IPVS_DEST_ATTR_WEIGHT, nlgo.U32(10)),
+        nlattr(IPVS_DEST_ATTR_ACTIVE_CONNS, nlgo.U32(3)),
+        nlattr(IPVS_DEST_ATTR_INACT_CONNS, nlgo.U32(12)),
+        nlattr(IPVS_DEST_ATTR_PERSIST_CONNS, nlgo.U32(7)),
+    }
+
+    // the counters are only returned by the kernel
+    if unpackedAttrs, err := ipvs_dest_policy.Parse(testAttrs.Bytes()); err != nil {
+        t.Fatalf("error ipvs_dest_policy.Parse: %s", err)
+    } else if unpackedDest, err := unpackDest(testService, unpackedAttrs.(nlgo.AttrMap)); err != nil {
+        t.Fatalf("error unpackDest: %s", err)
+    } else {
+        testDestEquals(t, testDest, unpackedDest)
+    }
+}
+
+func TestDestTunnel (t *testing.T) {
+    testService := Service {
+        Af:     syscall.AF_INET,
+    }
+    testDest := Dest{
+        Addr:   net.ParseIP("10.107.107.1"),
+        Port:   1337,
+
+        FwdMethod:  IP_VS_CONN_F_TUNNEL,
+        Weight:     10,
+        TunType:    IP_VS_CONN_F_TUNNEL_TYPE_GUE,
+        TunPort:    6080,
+        TunFlags:   IP_VS_TUNNEL_ENCAP_FLAG_CSUM,
+    }
+    testAttrs := nlgo.AttrSlice{
+        nlattr(IPVS_DEST_ATTR_ADDR, nlgo.Binary([]byte{10, 107, 107, 1})),
+        nlattr(IPVS_DEST_ATTR_PORT, nlgo.U16(0x3905)),
+        nlattr(IPVS_DEST_ATTR_FWD_METHOD, nlgo.U32(IP_VS_CONN_F_TUNNEL)),
+        nlattr(IPVS_DEST_ATTR_WEIGHT, nlgo.U32(10)),
+        nlattr(IPVS_DEST_ATTR_U_THRESH, nlgo.U32(0)),
+        nlattr(IPVS_DEST_ATTR_L_THRESH, nlgo.U32(0)),
+        nlattr(IPVS_DEST_ATTR_TUN_TYPE, nlgo.U8(IP_VS_CONN_F_TUNNEL_TYPE_GUE)),
+        nlattr(IPVS_DEST_ATTR_TUN_PORT, nlgo.U16(0xc017)),
+        nlattr(IPVS_DEST_ATTR_TUN_FLAGS, nlgo.U16(IP_VS_TUNNEL_ENCAP_FLAG_CSUM)),
+    }
+
+    // pack
+    packAttrs := testDest.attrs(&testService, true)
+    packBytes := packAttrs.Bytes()
+
+    if !bytes.Equal(packBytes, testAttrs.Bytes()) {
+        t.Errorf("fail Dest.attrs(): \n%s", hex.Dump(packBytes))
+    }
+
+    // unpack
+    if unpackedAttrs, err := ipvs_dest_policy.Parse(packBytes); err != nil {
+        t.Fatalf("error ipvs_dest_policy.Parse: %s", err)
+    } else if unpackedDest, err := unpackDest(testService, unpackedAttrs.(nlgo.AttrMap)); err != nil {
+        t.Fatalf("error unpackDest: %s", err)
+    } else {
+        testDestEquals(t, testDest, unpackedDest)
+    }
+}
+
+func TestDestMixedAf (t *testing.T) {
+    testService := Service {
+        Af:     syscall.AF_INET6,
+    }
+    testDest := Dest{
+        Addr:   net.ParseIP("10.107.107.1"),
+        Port:   1337,
+        Af:     syscall.AF_INET,
+
+        FwdMethod:  IP_VS_CONN_F_TUNNEL,
+        Weight:     10,
+    }
+    testAttrs := nlgo.AttrSlice{
+        nlattr(IPVS_DEST_ATTR_ADDR, nlgo.Binary([]byte{10, 107, 107, 1})),
+        nlattr(IPVS_DEST_ATTR_PORT, nlgo.U16(0x3905)),
+        nlattr(IPVS_DEST_ATTR_ADDR_FAMILY, nlgo.U16(syscall.AF_INET)),
+        nlattr(IPVS_DEST_ATTR_FWD_METHOD, nlgo.U32(IP_VS_CONN_F_TUNNEL)),
+        nlattr(IPVS_DEST_ATTR_WEIGHT, nlgo.U32(10)),
+        nlattr(IPVS_DEST_ATTR_U_THRESH, nlgo.U32(0)),
+        nlattr(IPVS_DEST_ATTR_L_THRESH, nlgo.U32(0)),
+    }
+
+    // pack
+    packAttrs := testDest.attrs(&testService, true)
+    packBytes := packAttrs.Bytes()
+
+    if !bytes.Equal(packBytes, testAttrs.Bytes()) {
+        t.Errorf("fail Dest.attrs(): \n%s", hex.Dump(packBytes))
+    }
+
+    // unpack
+    if unpackedAttrs, err := ipvs_dest_policy.Parse(packBytes); err != nil {
+        t.Fatalf("error ipvs_dest_policy.Parse: %s", err)
+    } else if unpackedDest, err := unpackDest(testService, unpackedAttrs.(nlgo.AttrMap)); err != nil {
+        t.Fatalf("error unpackDest: %s", err)
+    } else {
+        testDestEquals(t, testDest, unpackedDest)
+    }
+}
+
+func TestTimeout (t *testing.T) {
+    testTimeout := Timeout{TCP: 900, UDP: 300}
+    testAttrs := nlgo.AttrSlice{
+        nlattr(IPVS_CMD_ATTR_TIMEOUT_TCP, nlgo.U32(900)),
+        nlattr(IPVS_CMD_ATTR_TIMEOUT_UDP, nlgo.U32(300)),
+    }
+
+    // pack, omitting the unchanged tcpfin timeout
+    if packBytes := testTimeout.attrs().Bytes(); !bytes.Equal(packBytes, testAttrs.Bytes()) {
+        t.Errorf("fail Timeout.attrs(): \n%s", hex.Dump(packBytes))
+    }
+
+    // unpack
+    if unpackedAttrs, err := ipvs_cmd_policy.Parse(testAttrs.Bytes()); err != nil {
+        t.Fatalf("error ipvs_cmd_policy.Parse: %s", err)
+    } else if timeout, err := unpackTimeout(unpackedAttrs.(nlgo.AttrMap)); err != nil {
+        t.Fatalf("error unpackTimeout: %s", err)
+    } else if timeout != testTimeout {
+        t.Errorf("fail unpackTimeout: %+v", timeout)
+    }
+}
+
+func TestDaemon (t *testing.T) {
+    testDaemon := Daemon{State: IP_VS_STATE_BACKUP, McastIfn: "eth1", SyncID: 7}
+    testBytes := []byte{
+        0x08,0x00, 0x01,0x00,   0x02,0x00,0x00,0x00,    // IPVS_DAEMON_ATTR_STATE backup
+        0x09,0x00, 0x02,0x00,   'e','t','h','1',        // IPVS_DAEMON_ATTR_MCAST_IFN eth1
+                                0x00,0x00,0x00,0x00,
+        0x08,0x00, 0x03,0x00,   0x07,0x00,0x00,0x00,    // IPVS_DAEMON_ATTR_SYNC_ID 7
+    }
+
+    // pack
+    if packBytes := testDaemon.attrs().Bytes(); !bytes.Equal(packBytes, testBytes) {
+        t.Errorf("fail Daemon.attrs(): \n%s", hex.Dump(packBytes))
+    }
+
+    // unpack
+    if unpackedAttrs, err := ipvs_daemon_policy.Parse(testBytes); err != nil {
+        t.Fatalf("error ipvs_daemon_policy.Parse: %s", err)
+    } else if daemon, err := unpackDaemon(unpackedAttrs.(nlgo.AttrMap)); err != nil {
+        t.Fatalf("error unpackDaemon: %s", err)
+    } else if daemon != testDaemon {
+        t.Errorf("fail unpackDaemon: %+v", daemon)
+    }
+}
+
+func TestStats (t *testing.T) {
+    testAttrs := nlgo.AttrSlice{
+        nlattr(IPVS_STATS_ATTR_CONNS, nlgo.U32(1)),
+        nlattr(IPVS_STATS_ATTR_INPKTS, nlgo.U32(2)),
+        nlattr(IPVS_STATS_ATTR_OUTPKTS, nlgo.U32(3)),
+        nlattr(IPVS_STATS_ATTR_INBYTES, nlgo.U64(4)),
+        nlattr(IPVS_STATS_ATTR_OUTBYTES, nlgo.U64(0x100000000)),
+        nlattr(IPVS_STATS_ATTR_CPS, nlgo.U32(6)),
+    }
+    testStats := Stats{Conns: 1, InPkts: 2, OutPkts: 3, InBytes: 4, OutBytes: 0x100000000, CPS: 6}
+
+    if unpackedAttrs, err := ipvs_stats_policy.Parse(testAttrs.Bytes()); err != nil {
+        t.Fatalf("error ipvs_stats_policy.Parse: %s", err)
+    } else if stats, err := unpackStats(unpackedAttrs.(nlgo.AttrMap)); err != nil {
+        t.Fatalf("error unpackStats: %s", err)
+    } else if stats != testStats {
+        t.Errorf("fail unpackStats: %+v", stats)
+    }
+}
+
+// The STATS64 are used instead of the STATS, regardless of the order
+func TestDestStats64 (t *testing.T) {
+    testService := Service {
+        Af:     syscall.AF_INET,
+    }
+    stats := nlgo.AttrSlice{
+        nlattr(IPVS_STATS_ATTR_CONNS, nlgo.U32(1)),
+        nlattr(IPVS_STATS_ATTR_INPKTS, nlgo.U32(2)),
+    }
+    stats64 := nlgo.AttrSlice{
+        nlattr(IPVS_STATS_ATTR_CONNS, nlgo.U64(0x100000001)),
+        nlattr(IPVS_STATS_ATTR_INPKTS, nlgo.U64(0x100000002)),
+        nlattr(IPVS_STATS_ATTR_CPS, nlgo.U64(3)),
+    }
+    testStats := Stats{Conns: 0x100000001, InPkts: 0x100000002, CPS: 3}
+
+    for _, testAttrs := range []nlgo.AttrSlice{
+        nlgo.AttrSlice{
+            nlattr(IPVS_DEST_ATTR_ADDR, nlgo.Binary([]byte{10, 107, 107, 1})),
+            nlattr(IPVS_DEST_ATTR_STATS, stats),
+            nlattr(IPVS_DEST_ATTR_STATS64, stats64),
+        },
+        nlgo.AttrSlice{
+            nlattr(IPVS_DEST_ATTR_ADDR, nlgo.Binary([]byte{10, 107, 107, 1})),
+            nlattr(IPVS_DEST_ATTR_STATS64, stats64),
+            nlattr(IPVS_DEST_ATTR_STATS, stats),
+        },
+    } {
+        if unpackedAttrs, err := ipvs_dest_policy.Parse(testAttrs.Bytes()); err != nil {
+            t.Fatalf("error ipvs_dest_policy.Parse: %s", err)
+        } else if dest, err := unpackDest(testService, unpackedAttrs.(nlgo.AttrMap)); err != nil {
+            t.Fatalf("error unpackDest: %s", err)
+        } else if dest.Stats != testStats {
+            t.Errorf("fail unpackDest stats64: %+v", dest.Stats)
+        }
+    }
+
+    // older kernels without STATS64
+    if unpackedAttrs, err := ipvs_dest_policy.Parse(nlgo.AttrSlice{
+        nlattr(IPVS_DEST_ATTR_ADDR, nlgo.Binary([]byte{10, 107, 107, 1})),
+        nlattr(IPVS_DEST_ATTR_STATS, stats),
+    }.Bytes()); err != nil {
+        t.Fatalf("error ipvs_dest_policy.Parse: %s", err)
+    } else if dest, err := unpackDest(testService, unpackedAttrs.(nlgo.AttrMap)); err != nil {
+        t.Fatalf("error unpackDest: %s", err)
+    } else if dest.Stats != (Stats{Conns: 1, InPkts: 2}) {
+        t.Errorf("fail unpackDest stats: %+v", dest.Stats)
+    }
+}
+
+func TestServiceNetmask (t *testing.T) {
+    for _, test := range []struct{
+        af      Af
+        netmask uint32
+        bytes   []byte
+    }{
+        {syscall.AF_INET,   0xffffffff, []byte{0xff,0xff,0xff,0xff}},
+        {syscall.AF_INET,   0xffffff00, []byte{0xff,0xff,0xff,0x00}},
+        {syscall.AF_INET6,  128,        []byte{0x80,0x00,0x00,0x00}},
+        {syscall.AF_INET6,  64,         []byte{0x40,0x00,0x00,0x00}},
+    } {
+        packed := packNetmask(test.af, test.netmask)
+
+        if packBytes := (nlgo.AttrSlice{nlattr(IPVS_SVC_ATTR_NETMASK, packed)}).Bytes()[4:]; !bytes.Equal(packBytes, test.bytes) {
+            t.Errorf("fail packNetmask %v %#08x: %v", test.af, test.netmask, packBytes)
+        }
+
+        if netmask := unpackNetmask(packed, test.af); netmask != test.netmask {
+            t.Errorf("fail unpackNetmask %v %v: %#08x", test.af, packed, netmask)
+        }
+    }
+}
@@ -0,0 +1,266 @@
+package ipvs
+/*
+ * Batches of service and dest commands, sent using a single netlink write for each BATCH_SIZE commands.
+ *
+ * The nlgo transport waits for the response to each request before sending the next one, which is too slow for the initial sync of
+ * thousands of dests. The batch is instead sent on its own generic netlink socket, and the acks for each command are collected
+ * in a single pass. The batch is not atomic: the kernel applies each command in order, also after any failed commands.
+ */
+
+import (
+    "context"
+    "encoding/binary"
+    "fmt"
+    "github.com/qmsk/clusterf/errs"
+    "syscall"
+    "github.com/qmsk/clusterf/tasks"
+)
+
+// Maximum number of commands in each netlink write, within the default socket buffer sizes
+const BATCH_SIZE = 500
+
+const (
+    nlmsgHdrLen     = syscall.NLMSG_HDRLEN
+    genlmsgHdrLen   = 4
+)
+
+// Errors for the failed commands of the batch
+type BatchError struct {
+    Count   int         // number of commands in the batch
+    Errors  []error     // nil for each successful command, in the batch order
+}
+
+func (self *BatchError) failed() (errs []error) {
+    for _, err := range self.Errors {
+        if err != nil {
+            errs = append(errs, err)
+        }
+    }
+
+    return
+}
+
+func (self *BatchError) Error() string {
+    failed := self.failed()
+
+    if len(failed) == 0 {
+        return fmt.Sprintf("ipvs: batch of %d commands", self.Count)
+    } else {
+        return fmt.Sprintf("ipvs: %d of %d batch commands failed: %v", len(failed), self.Count, failed[0])
+    }
+}
+
+// Match any of the failed commands using errors.Is, e.g. ErrDestExists
+func (self *BatchError) Unwrap() []error {
+    return self.failed()
+}
+
+// Queued service and dest commands, not safe for concurrent use
+type Batch struct {
+    client      *Client
+    requests    []Request
+}
+
+// Return a new empty batch of commands, sent using Flush
+func (client *Client) Batch() *Batch {
+    return &Batch{client: client}
+}
+
+func (self *Batch) NewService(service Service) *Batch {
+    self.requests = append(self.requests, newServiceRequest(service))
+
+    return self
+}
+
+func (self *Batch) SetService(service Service) *Batch {
+    self.requests = append(self.requests, setServiceRequest(service))
+
+    return self
+}
+
+func (self *Batch) DelService(service Service) *Batch {
+    self.requests = append(self.requests, delServiceRequest(service))
+
+    return self
+}
+
+func (self *Batch) NewDest(service Service, dest Dest) *Batch {
+    self.requests = append(self.requests, newDestRequest(service, dest))
+
+    return self
+}
+
+func (self *Batch) SetDest(service Service, dest Dest) *Batch {
+    self.requests = append(self.requests, setDestRequest(service, dest))
+
+    return self
+}
+
+func (self *Batch) DelDest(service Service, dest Dest) *Batch {
+    self.requests = append(self.requests, delDestRequest(service, dest))
+
+    return self
+}
+
+// Number of queued commands
+func (self *Batch) Len() int {
+    return len(self.requests)
+}
+
+// Send the queued commands, clearing the batch
+//
+// Returns a *BatchError for any failed commands, after applying all of the commands.
+func (self *Batch) Flush() error {
+    return self.FlushContext(context.Background())
+}
+
+// Send the queued commands, clearing the batch, until the context is done
+func (self *Batch) FlushContext(ctx context.Context) error {
+    var requests = self.requests
+    var batchError = BatchError{Count: len(requests), Errors: make([]error, len(requests))}
+
+    self.requests = nil
+
+    if len(requests) == 0 {
+        return nil
+    }
+
+    self.client.logDebug.Printf("Batch.Flush: %d commands", len(requests))
+
+    err := self.client.serialize(ctx, requests[0].Cmd, func() error {
+        return self.client.sendBatch(requests, batchError.Errors)
+    })
+    if err != nil {
+        return err
+    }
+
+    for _, err := range batchError.Errors {
+        if err != nil {
+            return errs.KernelError(&batchError)
+        }
+    }
+
+    return nil
+}
+
+// Encode the requests as netlink messages, using sequence numbers from the given seq
+func (self *Client) batchMessages(requests []Request, seq uint32) []byte {
+    var buf []byte
+
+    for i, request := range requests {
+        attrs := request.Attrs.Bytes()
+        msgLen := nlmsgHdrLen + genlmsgHdrLen + len(attrs)
+        msg := make([]byte, nlmsgAlign(msgLen))
+
+        // struct nlmsghdr
+        binary.NativeEndian.PutUint32(msg[0:4], uint32(msgLen))
+        binary.NativeEndian.PutUint16(msg[4:6], self.genlFamily.Id)
+        binary.NativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | request.Flags)
+        binary.NativeEndian.PutUint32(msg[8:12], seq + uint32(i))
+        binary.NativeEndian.PutUint32(msg[12:16], 0)
+
+        // struct genlmsghdr
+        msg[nlmsgHdrLen + 0] = request.Cmd
+        msg[nlmsgHdrLen + 1] = self.genlFamily.Version
+
+        copy(msg[nlmsgHdrLen + genlmsgHdrLen:], attrs)
+
+        buf = append(buf, msg...)
+    }
+
+    return buf
+}
+
+func nlmsgAlign(len int) int {
+    return (len + syscall.NLMSG_ALIGNTO - 1) & ^(syscall.NLMSG_ALIGNTO - 1)
+}
+
+// Parse the acks for the requests with sequence numbers from the given seq, returning the number of acks
+func parseBatchAcks(buf []byte, requests []Request, seq uint32, errors []error) (int, error) {
+    var count int
+
+    msgs, err := syscall.ParseNetlinkMessage(buf)
+    if err != nil {
+        return count, errs.InternalError(fmt.Errorf("ipvs: batch ack: %v", err))
+    }
+
+    for _, msg := range msgs {
+        i := int(msg.Header.Seq - seq)
+
+        if msg.Header.Type != syscall.NLMSG_ERROR || msg.Header.Seq < seq || i >= len(requests) {
+            continue
+        } else if len(msg.Data) < 4 {
+            return count, errs.InternalError(fmt.Errorf("ipvs: batch ack: short NLMSG_ERROR"))
+        } else if errno := -int32(binary.NativeEndian.Uint32(msg.Data[0:4])); errno != 0 {
+            errors[i] = errs.KernelError(commandError(requests[i].Cmd, syscall.Errno(errno)))
+        }
+
+        count++
+    }
+
+    return count, nil
+}
+
+// Send the requests on a new netlink socket in chunks of BATCH_SIZE, collecting the errors for each request
+func (self *Client) sendBatch(requests []Request, errors []error) error {
+    fd, err := self.batchSocket()
+    if err != nil {
+        return err
+    }
+    defer syscall.Close(fd)
+    defer tasks.Open("ipvs")()
+
+    var buf = make([]byte, syscall.Getpagesize() * 16)
+
+    for offset := 0; offset < len(requests); offset += BATCH_SIZE {
+        chunk := requests[offset:]
+
+        if len(chunk) > BATCH_SIZE {
+            chunk = chunk[:BATCH_SIZE]
+        }
+
+        seq := uint32(offset + 1)
+
+        if err := syscall.Sendto(fd, self.batchMessages(chunk, seq), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+            return errs.KernelError(fmt.Errorf("ipvs: batch send: %v", err))
+        }
+
+        for acks := 0; acks < len(chunk); {
+            n, _, err := syscall.Recvfrom(fd, buf, 0)
+            if err != nil {
+                return errs.KernelError(fmt.Errorf("ipvs: batch recv: %v", err))
+            }
+
+            if count, err := parseBatchAcks(buf[:n], chunk, seq, errors[offset:]); err != nil {
+                return err
+            } else {
+                acks += count
+            }
+        }
+    }
+
+    return nil
+}
+
+// Open a generic netlink socket in the client network namespace
+func (self *Client) batchSocket() (fd int, err error) {
+    open := func() error {
+        if fd, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW | syscall.SOCK_CLOEXEC, syscall.NETLINK_GENERIC); err != nil {
+            return errs.KernelError(fmt.Errorf("ipvs: batch socket: %v", err))
+        } else if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+            syscall.Close(fd)
+
+            return errs.KernelError(fmt.Errorf("ipvs: batch bind: %v", err))
+        }
+
+        return nil
+    }
+
+    if self.nsPath == "" {
+        err = open()
+    } else {
+        err = inNamespace(self.nsPath, open)
+    }
+
+    return
+}
@@ -0,0 +1,69 @@
+package ipvs
+
+import (
+    "encoding/binary"
+    "errors"
+    "github.com/hkwi/nlgo"
+    "net"
+    "syscall"
+    "testing"
+)
+
+func testAck(seq uint32, errno syscall.Errno) []byte {
+    msg := make([]byte, nlmsgHdrLen + 4 + nlmsgHdrLen)
+
+    binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+    binary.NativeEndian.PutUint16(msg[4:6], syscall.NLMSG_ERROR)
+    binary.NativeEndian.PutUint32(msg[8:12], seq)
+    binary.NativeEndian.PutUint32(msg[16:20], uint32(-int32(errno)))
+
+    return msg
+}
+
+func TestBatch(t *testing.T) {
+    var client = Client{genlFamily: nlgo.GenlFamily{Id: 0x20, Version: 1}}
+    var service = Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("10.0.1.1"), Port: 80, SchedName: "wlc"}
+    var dest = Dest{Addr: net.ParseIP("10.1.0.1"), Port: 80, Weight: 10}
+
+    batch := client.Batch().NewService(service).NewDest(service, dest).DelDest(service, dest)
+
+    if batch.Len() != 3 {
+        t.Fatalf("batch len: %d", batch.Len())
+    }
+
+    msgs, err := syscall.ParseNetlinkMessage(client.batchMessages(batch.requests, 1))
+    if err != nil {
+        t.Fatalf("batch messages: %v", err)
+    } else if len(msgs) != 3 {
+        t.Fatalf("batch messages: %d", len(msgs))
+    }
+
+    for i, cmd := range []uint8{IPVS_CMD_NEW_SERVICE, IPVS_CMD_NEW_DEST, IPVS_CMD_DEL_DEST} {
+        if msg := msgs[i]; msg.Header.Type != 0x20 || msg.Header.Seq != uint32(1 + i) || msg.Header.Flags & syscall.NLM_F_ACK == 0 {
+            t.Errorf("batch message %d header: %+v", i, msg.Header)
+        } else if msg.Data[0] != cmd || msg.Data[1] != 1 {
+            t.Errorf("batch message %d genl header: %v", i, msg.Data[0:4])
+        }
+    }
+
+    var acks []byte
+    var errs = make([]error, 3)
+
+    acks = append(acks, testAck(1, 0)...)
+    acks = append(acks, testAck(2, syscall.EEXIST)...)
+    acks = append(acks, testAck(7, syscall.ENOENT)...) // unrelated seq
+
+    if count, err := parseBatchAcks(acks, batch.requests, 1, errs); err != nil || count != 2 {
+        t.Errorf("parseBatchAcks: %d %v", count, err)
+    } else if errs[0] != nil || !errors.Is(errs[1], ErrDestExists) || errs[2] != nil {
+        t.Errorf("parseBatchAcks errors: %v", errs)
+    }
+
+    batchError := &BatchError{Count: 3, Errors: errs}
+
+    if !errors.Is(batchError, ErrDestExists) || errors.Is(batchError, ErrServiceExists) {
+        t.Errorf("BatchError Is: %v", batchError)
+    } else if str := batchError.Error(); str != "ipvs: 1 of 3 batch commands failed: ipvs: dest already exists: file exists" {
+        t.Errorf("BatchError: %s", str)
+    }
+}
@@ -1,6 +1,8 @@
 package ipvs
 
 import (
+    "context"
+    "github.com/qmsk/clusterf/errs"
     "encoding/hex"
     "fmt"
     "io/ioutil"
@@ -8,21 +10,41 @@ import (
     "github.com/hkwi/nlgo"
     "os"
     "syscall"
+    "github.com/qmsk/clusterf/tasks"
 )
 
+// A netlink client for the kernel IPVS commands, safe for concurrent use by multiple goroutines.
+//
+// Each netlink request and its response messages are serialized within the client, so that concurrent requests never interleave
+// their messages on the shared socket.
 type Client struct {
     genlHub         *nlgo.GenlHub
     genlFamily      nlgo.GenlFamily
 
+    // network namespace of the genlHub socket, if not the current one
+    nsPath          string
+
+    // one request at a time, including any cancelled requests that are still running
+    sem             chan struct{}
+
+    // used for testing; instead of the genlHub
+    send            func(request Request) ([]nlgo.GenlMessage, error)
+
     logDebug        *log.Logger
     logWarning      *log.Logger
 }
 
-func Open() (*Client, error) {
-    client := &Client{
+func makeClient() *Client {
+    return &Client{
         logDebug:   log.New(ioutil.Discard, "DEBUG ipvs:", 0),
         logWarning: log.New(os.Stderr, "WARN ipvs:", 0),
+        sem:        make(chan struct{}, 1),
     }
+}
+
+// Open a client for the IPVS table of the current network namespace
+func Open() (*Client, error) {
+    client := makeClient()
 
     if err := client.init(); err != nil {
         return nil, err
@@ -33,16 +55,16 @@ func Open() (*Client, error) {
 
 func (self *Client) init () error {
     if genlHub, err := nlgo.NewGenlHub(); err != nil {
-        return err
+        return errs.KernelError(err)
     } else {
         self.genlHub = genlHub
     }
 
     // lookup family
     if genlFamily := self.genlHub.Family(IPVS_GENL_NAME); genlFamily.Id == 0 {
-        return fmt.Errorf("Invalid genl family: %v", IPVS_GENL_NAME)
+        return errs.KernelError(fmt.Errorf("Invalid genl family: %v", IPVS_GENL_NAME))
     } else if genlFamily.Version != IPVS_GENL_VERSION {
-        return fmt.Errorf("Unsupported ipvs genl family: %+v", genlFamily)
+        return errs.KernelError(fmt.Errorf("Unsupported ipvs genl family: %+v", genlFamily))
     } else {
         self.logDebug.Printf("genlFamily: %+v\n", genlFamily)
 
@@ -54,7 +76,16 @@ func (self *Client) init () error {
 
 // Output debugging messages.
 func (client *Client) SetDebug() {
-    client.logDebug = log.New(os.Stderr, "DEBUG ipvs:", 0)
+    client.SetDebugEnabled(true)
+}
+
+// Enable or disable the debugging messages, including the netlink message dumps. Safe to call while any requests are running.
+func (client *Client) SetDebugEnabled(enabled bool) {
+    if enabled {
+        client.logDebug.SetOutput(os.Stderr)
+    } else {
+        client.logDebug.SetOutput(ioutil.Discard)
+    }
 }
 
 type Request struct {
@@ -63,19 +94,81 @@ type Request struct {
     Attrs   nlgo.AttrSlice
 }
 
-// Execute a command with return messages (via handler) , returning error
-func (self *Client) request (request Request, responsePolicy nlgo.MapPolicy, responseHandler func (attrs nlgo.AttrMap) error) error {
-    self.logDebug.Printf("Client.request: cmd=%02x flags=%04x attrs=%v", request.Cmd, request.Flags, request.Attrs)
+// Run the function while holding the request semaphore, until the context is done.
+//
+// The nlgo transport cannot cancel a running request: a cancelled request keeps running in the background, and any later requests
+// wait for it to complete. The kernel may still apply the command after returning the context error.
+func (self *Client) serialize(ctx context.Context, cmd uint8, f func() error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    select {
+    case self.sem <- struct{}{}:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+
+    var done = make(chan error, 1)
+
+    tasks.Go("ipvs", func() {
+        defer func() { <-self.sem }()
+
+        done <- f()
+    })
+
+    select {
+    case err := <-done:
+        return err
+    case <-ctx.Done():
+        self.logWarning.Printf("Client.serialize: cmd=%02x: %v", cmd, ctx.Err())
+
+        return ctx.Err()
+    }
+}
+
+// Send the request and wait for the response messages, until the context is done.
+func (self *Client) sync(ctx context.Context, request Request) ([]nlgo.GenlMessage, error) {
+    var out []nlgo.GenlMessage
+
+    err := self.serialize(ctx, request.Cmd, func() (err error) {
+        if out, err = self.sendRequest(request); err != nil {
+            return errs.KernelError(err)
+        } else {
+            return nil
+        }
+    })
+
+    if err != nil {
+        // any cancelled request may still be running
+        return nil, err
+    }
+
+    return out, nil
+}
+
+// Send the request on the netlink socket, and receive all of its response messages
+func (self *Client) sendRequest(request Request) ([]nlgo.GenlMessage, error) {
+    if self.send != nil {
+        return self.send(request)
+    }
 
     msg := self.genlFamily.Request(request.Cmd, request.Flags, nil, request.Attrs.Bytes())
 
-    if out, err := self.genlHub.Sync(msg); err != nil {
+    return self.genlHub.Sync(msg)
+}
+
+// Execute a command with return messages (via handler) , returning error
+func (self *Client) request (ctx context.Context, request Request, responsePolicy nlgo.MapPolicy, responseHandler func (attrs nlgo.AttrMap) error) error {
+    self.logDebug.Printf("Client.request: cmd=%02x flags=%04x attrs=%v", request.Cmd, request.Flags, request.Attrs)
+
+    if out, err := self.sync(ctx, request); err != nil {
         return err
     } else {
         for _, msg := range out {
             if msg.Header.Type == syscall.NLMSG_ERROR {
                 if msgErr := nlgo.NlMsgerr(msg.NetlinkMessage); msgErr.Payload().Error != 0 {
-                    return msgErr
+                    return errs.KernelError(commandError(request.Cmd, syscall.Errno(-msgErr.Payload().Error)))
                 } else {
                     // ack
                 }
@@ -84,14 +177,14 @@ func (self *Client) request (request Request, responsePolicy nlgo.MapPolicy, res
 
             } else if msg.Family == self.genlFamily {
                 if attrsValue, err := responsePolicy.Parse(msg.Body()); err != nil {
-                    return fmt.Errorf("ipvs:Client.request: Invalid response: %s\n%s", err, hex.Dump(msg.Data))
+                    return errs.InternalError(fmt.Errorf("ipvs:Client.request: Invalid response: %s\n%s", err, hex.Dump(msg.Data)))
                 } else if attrMap, ok := attrsValue.(nlgo.AttrMap); !ok {
-                    return fmt.Errorf("ipvs:Client.request: Invalid attrs value: %v", attrsValue)
+                    return errs.InternalError(fmt.Errorf("ipvs:Client.request: Invalid attrs value: %v", attrsValue))
                 } else {
                     self.logDebug.Printf("Client.request: \t%v\n", attrMap)
 
                     if err := responseHandler(attrMap); err != nil {
-                        return err
+                        return errs.InternalError(err)
                     }
                 }
             } else {
@@ -104,18 +197,16 @@ func (self *Client) request (request Request, responsePolicy nlgo.MapPolicy, res
 }
 
 // Execute a command with success/error, no return messages
-func (self *Client) exec (request Request) error {
+func (self *Client) exec (ctx context.Context, request Request) error {
     self.logDebug.Printf("Client.exec: cmd=%02x flags=%04x...", request.Cmd, request.Flags)
 
-    msg := self.genlFamily.Request(request.Cmd, request.Flags, nil, request.Attrs.Bytes())
-
-    if out, err := self.genlHub.Sync(msg); err != nil {
+    if out, err := self.sync(ctx, request); err != nil {
         return err
     } else {
         for _, msg := range out {
             if msg.Header.Type == syscall.NLMSG_ERROR {
                 if msgErr := nlgo.NlMsgerr(msg.NetlinkMessage); msgErr.Payload().Error != 0 {
-                    return msgErr
+                    return errs.KernelError(commandError(request.Cmd, syscall.Errno(-msgErr.Payload().Error)))
                 } else {
                     // ack
                 }
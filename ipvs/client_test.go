@@ -0,0 +1,79 @@
+package ipvs
+
+import (
+    "context"
+    "github.com/hkwi/nlgo"
+    "io/ioutil"
+    "log"
+    "net"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestClientContext(t *testing.T) {
+    var client = Client{logDebug: log.New(ioutil.Discard, "", 0), logWarning: log.New(ioutil.Discard, "", 0), sem: make(chan struct{}, 1)}
+    var service = Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("10.0.1.1"), Port: 80}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    if err := client.NewServiceContext(ctx, service); err != context.Canceled {
+        t.Errorf("NewServiceContext canceled: %v", err)
+    }
+    if _, err := client.ListServicesContext(ctx); err != context.Canceled {
+        t.Errorf("ListServicesContext canceled: %v", err)
+    }
+
+    // a cancelled request still running in the background
+    client.sem <- struct{}{}
+
+    ctx, cancel = context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+
+    if _, err := client.GetDestContext(ctx, service, Dest{Addr: net.ParseIP("10.1.0.1"), Port: 80}); err != context.DeadlineExceeded {
+        t.Errorf("GetDestContext running: %v", err)
+    }
+}
+
+func TestClientConcurrent(t *testing.T) {
+    var client = Client{logDebug: log.New(ioutil.Discard, "", 0), logWarning: log.New(ioutil.Discard, "", 0), sem: make(chan struct{}, 1)}
+    var active, overlaps, count int32
+
+    client.send = func(request Request) ([]nlgo.GenlMessage, error) {
+        if atomic.AddInt32(&active, 1) > 1 {
+            atomic.AddInt32(&overlaps, 1)
+        }
+
+        time.Sleep(time.Millisecond)
+
+        atomic.AddInt32(&count, 1)
+        atomic.AddInt32(&active, -1)
+
+        return nil, nil
+    }
+
+    var wg sync.WaitGroup
+
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+
+        go func(port uint16) {
+            defer wg.Done()
+
+            service := Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("10.0.1.1"), Port: port}
+
+            if err := client.NewService(service); err != nil {
+                t.Errorf("NewService %v: %v", service, err)
+            }
+        }(uint16(8000 + i))
+    }
+
+    wg.Wait()
+
+    if count != 20 || overlaps != 0 {
+        t.Errorf("concurrent requests: count=%d overlaps=%d", count, overlaps)
+    }
+}
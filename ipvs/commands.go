@@ -1,9 +1,10 @@
 package ipvs
 
 import (
+    "context"
+    "github.com/qmsk/clusterf/errs"
     "fmt"
     "github.com/hkwi/nlgo"
-    "syscall"
 )
 
 type command struct {
@@ -28,84 +29,183 @@ func (self command) attrs() nlgo.AttrSlice {
     return attrs
 }
 
-func (client *Client) NewService(service Service) error {
-    return client.exec(Request{
+// The service and dest commands, also used by the Batch
+func newServiceRequest(service Service) Request {
+    return Request{
         Cmd:        IPVS_CMD_NEW_SERVICE,
         Attrs:      command{service: &service, serviceFull: true}.attrs(),
-    })
+    }
 }
 
-func (client *Client) SetService(service Service) error {
-    return client.exec(Request{
+func setServiceRequest(service Service) Request {
+    return Request{
         Cmd:        IPVS_CMD_SET_SERVICE,
         Attrs:      command{service: &service, serviceFull: true}.attrs(),
-    })
+    }
 }
 
-func (client *Client) DelService(service Service) error {
-    return client.exec(Request{
+func delServiceRequest(service Service) Request {
+    return Request{
         Cmd:        IPVS_CMD_DEL_SERVICE,
         Attrs:      command{service: &service}.attrs(),
-    })
+    }
+}
+
+func newDestRequest(service Service, dest Dest) Request {
+    return Request{
+        Cmd:        IPVS_CMD_NEW_DEST,
+        Attrs:      command{service: &service, dest: &dest, destFull: true}.attrs(),
+    }
+}
+
+func setDestRequest(service Service, dest Dest) Request {
+    return Request{
+        Cmd:        IPVS_CMD_SET_DEST,
+        Attrs:      command{service: &service, dest: &dest, destFull: true}.attrs(),
+    }
+}
+
+func delDestRequest(service Service, dest Dest) Request {
+    return Request{
+        Cmd:        IPVS_CMD_DEL_DEST,
+        Attrs:      command{service: &service, dest: &dest}.attrs(),
+    }
+}
+
+func (client *Client) NewService(service Service) error {
+    return client.NewServiceContext(context.Background(), service)
+}
+
+func (client *Client) NewServiceContext(ctx context.Context, service Service) error {
+    return client.exec(ctx, newServiceRequest(service))
+}
+
+func (client *Client) SetService(service Service) error {
+    return client.SetServiceContext(context.Background(), service)
+}
+
+func (client *Client) SetServiceContext(ctx context.Context, service Service) error {
+    return client.exec(ctx, setServiceRequest(service))
+}
+
+func (client *Client) DelService(service Service) error {
+    return client.DelServiceContext(context.Background(), service)
+}
+
+func (client *Client) DelServiceContext(ctx context.Context, service Service) error {
+    return client.exec(ctx, delServiceRequest(service))
 }
 
 func (client *Client) ListServices() (services []Service, err error) {
+    return client.ListServicesContext(context.Background())
+}
+
+func (client *Client) ListServicesContext(ctx context.Context) (services []Service, err error) {
+    err = client.WalkServices(ctx, func(service Service) error {
+        services = append(services, service)
+
+        return nil
+    })
+
+    return
+}
+
+// Return the kernel IPVS services with the given address family and protocol, with a zero Af or Protocol matching any.
+//
+// The kernel does not filter the service dump, so the full table is still received, but any other services are skipped without
+// unpacking them.
+func (client *Client) ListServicesFiltered(af Af, protocol Protocol) (services []Service, err error) {
+    return client.ListServicesFilteredContext(context.Background(), af, protocol)
+}
+
+func (client *Client) ListServicesFilteredContext(ctx context.Context, af Af, protocol Protocol) (services []Service, err error) {
+    filter := func(serviceAttrs nlgo.AttrMap) bool {
+        if af != 0 && serviceAttrs.Get(IPVS_SVC_ATTR_AF) != nlgo.U16(af) {
+            return false
+        } else if protocol != 0 && serviceAttrs.Get(IPVS_SVC_ATTR_PROTOCOL) != nlgo.U16(protocol) {
+            return false
+        } else {
+            return true
+        }
+    }
+
+    err = client.walkServices(ctx, filter, func(service Service) error {
+        services = append(services, service)
+
+        return nil
+    })
+
+    return
+}
+
+// Return the kernel IPVS service with the same identifying fields, including its stats, without listing all services.
+//
+// Fails with ErrServiceNotFound if there is no such service.
+func (client *Client) GetService(id Service) (service Service, err error) {
+    return client.GetServiceContext(context.Background(), id)
+}
+
+func (client *Client) GetServiceContext(ctx context.Context, id Service) (service Service, err error) {
+    var found bool
+
     request := Request{
-        Cmd:    IPVS_CMD_GET_SERVICE,
-        Flags:  syscall.NLM_F_DUMP,
+        Cmd:        IPVS_CMD_GET_SERVICE,
+        Attrs:      command{service: &id}.attrs(),
     }
 
-    err = client.request(request, ipvs_cmd_policy, func (cmdAttrs nlgo.AttrMap) error {
+    err = client.request(ctx, request, ipvs_cmd_policy, func (cmdAttrs nlgo.AttrMap) error {
         if serviceAttrs := cmdAttrs.Get(IPVS_CMD_ATTR_SERVICE); serviceAttrs == nil {
             return fmt.Errorf("IPVS_CMD_GET_SERVICE without IPVS_CMD_ATTR_SERVICE")
-        } else if service, err := unpackService(serviceAttrs.(nlgo.AttrMap)); err != nil {
+        } else if cmdService, err := unpackService(serviceAttrs.(nlgo.AttrMap)); err != nil {
             return err
         } else {
-            services = append(services, service)
+            service = cmdService
+            found = true
         }
 
         return nil
     })
 
-    return
+    if err != nil {
+        return service, err
+    } else if !found {
+        return service, errs.KernelError(ErrServiceNotFound)
+    }
+
+    return service, nil
 }
 
 func (client *Client) NewDest(service Service, dest Dest) error {
-    return client.exec(Request{
-        Cmd:        IPVS_CMD_NEW_DEST,
-        Attrs:      command{service: &service, dest: &dest, destFull: true}.attrs(),
-    })
+    return client.NewDestContext(context.Background(), service, dest)
+}
+
+func (client *Client) NewDestContext(ctx context.Context, service Service, dest Dest) error {
+    return client.exec(ctx, newDestRequest(service, dest))
 }
 
 func (client *Client) SetDest(service Service, dest Dest) error {
-    return client.exec(Request{
-        Cmd:        IPVS_CMD_SET_DEST,
-        Attrs:      command{service: &service, dest: &dest, destFull: true}.attrs(),
-    })
+    return client.SetDestContext(context.Background(), service, dest)
+}
+
+func (client *Client) SetDestContext(ctx context.Context, service Service, dest Dest) error {
+    return client.exec(ctx, setDestRequest(service, dest))
 }
 
 func (client *Client) DelDest(service Service, dest Dest) error {
-    return client.exec(Request{
-        Cmd:        IPVS_CMD_DEL_DEST,
-        Attrs:      command{service: &service, dest: &dest}.attrs(),
-    })
+    return client.DelDestContext(context.Background(), service, dest)
+}
+
+func (client *Client) DelDestContext(ctx context.Context, service Service, dest Dest) error {
+    return client.exec(ctx, delDestRequest(service, dest))
 }
 
 func (client *Client) ListDests(service Service) (dests []Dest, err error) {
-    request := Request{
-        Cmd:    IPVS_CMD_GET_DEST,
-        Flags:  syscall.NLM_F_DUMP,
-        Attrs:  command{service: &service}.attrs(),
-    }
+    return client.ListDestsContext(context.Background(), service)
+}
 
-    err = client.request(request, ipvs_cmd_policy, func (cmdAttrs nlgo.AttrMap) error {
-        if destAttrs := cmdAttrs.Get(IPVS_CMD_ATTR_DEST); destAttrs == nil {
-            return fmt.Errorf("IPVS_CMD_GET_DEST without IPVS_CMD_ATTR_DEST")
-        } else if dest, err := unpackDest(service, destAttrs.(nlgo.AttrMap)); err != nil {
-            return err
-        } else {
-            dests = append(dests, dest)
-        }
+func (client *Client) ListDestsContext(ctx context.Context, service Service) (dests []Dest, err error) {
+    err = client.WalkDests(ctx, service, func(dest Dest) error {
+        dests = append(dests, dest)
 
         return nil
     })
@@ -113,12 +213,48 @@ func (client *Client) ListDests(service Service) (dests []Dest, err error) {
     return
 }
 
+// Return the kernel IPVS dest of the service with the same addr and port, including its stats.
+//
+// The kernel only supports dumping all of the dests of a service, so this walks the dests until the matching dest, skipping
+// the unpacking of any later dests. Fails with ErrDestNotFound if the service has no such dest, or if there is no such service.
+func (client *Client) GetDest(service Service, id Dest) (dest Dest, err error) {
+    return client.GetDestContext(context.Background(), service, id)
+}
+
+func (client *Client) GetDestContext(ctx context.Context, service Service, id Dest) (dest Dest, err error) {
+    var found bool
+
+    err = client.WalkDests(ctx, service, func(walkDest Dest) error {
+        if walkDest.Addr.Equal(id.Addr) && walkDest.Port == id.Port {
+            dest = walkDest
+            found = true
+
+            return SkipAll
+        }
+
+        return nil
+    })
+
+    if err != nil {
+        return dest, err
+    } else if !found {
+        return dest, errs.KernelError(ErrDestNotFound)
+    }
+
+    return dest, nil
+}
+
+// Return the IPVS version and conn tab size, along with the genetlink family version and kernel version for checking attribute availability
 func (client *Client) GetInfo() (info Info, err error) {
+    return client.GetInfoContext(context.Background())
+}
+
+func (client *Client) GetInfoContext(ctx context.Context) (info Info, err error) {
     request := Request{
         Cmd:    IPVS_CMD_GET_INFO,
     }
 
-    err = client.request(request, ipvs_info_policy, func (infoAttrs nlgo.AttrMap) error {
+    err = client.request(ctx, request, ipvs_info_policy, func (infoAttrs nlgo.AttrMap) error {
         if cmdInfo, err := unpackInfo(infoAttrs); err != nil {
             return err
         } else {
@@ -127,10 +263,46 @@ func (client *Client) GetInfo() (info Info, err error) {
 
         return nil
     })
+    if err != nil {
+        return
+    }
+
+    info.FamilyVersion = uint32(client.genlFamily.Version)
+
+    if kernelVersion, err := unameKernelVersion(); err != nil {
+        client.logWarning.Printf("Client.GetInfo: uname: %v\n", err)
+    } else {
+        info.KernelVersion = kernelVersion
+    }
 
     return
 }
 
+// Reset the counters and stats for the service and its dests
+func (client *Client) ZeroService(service Service) error {
+    return client.ZeroServiceContext(context.Background(), service)
+}
+
+func (client *Client) ZeroServiceContext(ctx context.Context, service Service) error {
+    return client.exec(ctx, Request{
+        Cmd:        IPVS_CMD_ZERO,
+        Attrs:      command{service: &service}.attrs(),
+    })
+}
+
+// Reset the counters and stats for all services and dests
+func (client *Client) ZeroAll() error {
+    return client.ZeroAllContext(context.Background())
+}
+
+func (client *Client) ZeroAllContext(ctx context.Context) error {
+    return client.exec(ctx, Request{Cmd: IPVS_CMD_ZERO})
+}
+
 func (client *Client) Flush() error {
-    return client.exec(Request{Cmd: IPVS_CMD_FLUSH})
+    return client.FlushContext(context.Background())
+}
+
+func (client *Client) FlushContext(ctx context.Context) error {
+    return client.exec(ctx, Request{Cmd: IPVS_CMD_FLUSH})
 }
@@ -0,0 +1,210 @@
+package ipvs
+/*
+ * The kernel IPVS connection table, which is not available via genetlink, and is read from /proc/net/ip_vs_conn instead.
+ */
+
+import (
+    "bufio"
+    "context"
+    "encoding/hex"
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+const IPVS_CONN_PATH = "/proc/net/ip_vs_conn"
+
+var connProtocols = map[string]Protocol{
+    "IP":   syscall.IPPROTO_IP, // persistence templates
+    "TCP":  syscall.IPPROTO_TCP,
+    "UDP":  syscall.IPPROTO_UDP,
+    "SCTP": syscall.IPPROTO_SCTP,
+    "AH":   syscall.IPPROTO_AH,
+    "ESP":  syscall.IPPROTO_ESP,
+}
+
+// Connection entry, with the client, virtual service and real server endpoints
+type Connection struct {
+    Protocol    Protocol
+
+    ClientAddr  net.IP
+    ClientPort  uint16
+    VirtualAddr net.IP
+    VirtualPort uint16
+    DestAddr    net.IP
+    DestPort    uint16
+
+    // protocol state, e.g. ESTABLISHED or FIN_WAIT
+    State       string
+
+    // remaining time until the entry expires
+    Expires     time.Duration
+}
+
+func (self Connection) String() string {
+    return fmt.Sprintf("%v %s -> %s -> %s %s", self.Protocol,
+        net.JoinHostPort(self.ClientAddr.String(), strconv.Itoa(int(self.ClientPort))),
+        net.JoinHostPort(self.VirtualAddr.String(), strconv.Itoa(int(self.VirtualPort))),
+        net.JoinHostPort(self.DestAddr.String(), strconv.Itoa(int(self.DestPort))),
+        self.State,
+    )
+}
+
+// Persistence templates use the IP protocol, and a zero client port
+func (self Connection) Template() bool {
+    return self.Protocol == syscall.IPPROTO_IP
+}
+
+// The Service the connection belongs to, for matching against the ListServices
+func (self Connection) Service() Service {
+    var service = Service{Protocol: self.Protocol, Addr: self.VirtualAddr, Port: self.VirtualPort}
+
+    if self.VirtualAddr.To4() != nil {
+        service.Af = syscall.AF_INET
+    } else {
+        service.Af = syscall.AF_INET6
+    }
+
+    return service
+}
+
+// IPv4 addresses are formatted as %08X in host order, and IPv6 addresses as %pI6
+func parseConnAddr(field string) (net.IP, error) {
+    if strings.Contains(field, ":") {
+        if ip := net.ParseIP(field); ip == nil {
+            return nil, fmt.Errorf("invalid IPv6 address: %s", field)
+        } else {
+            return ip, nil
+        }
+    } else if buf, err := hex.DecodeString(field); err != nil || len(buf) != 4 {
+        return nil, fmt.Errorf("invalid IPv4 address: %s", field)
+    } else {
+        return net.IP(buf), nil
+    }
+}
+
+func parseConnPort(field string) (uint16, error) {
+    if port, err := strconv.ParseUint(field, 16, 16); err != nil {
+        return 0, fmt.Errorf("invalid port: %s", field)
+    } else {
+        return uint16(port), nil
+    }
+}
+
+// Parse a line of the form:
+//  Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+func parseConnection(line string) (conn Connection, err error) {
+    var fields = strings.Fields(line)
+
+    if len(fields) < 9 {
+        return conn, fmt.Errorf("invalid connection: %#v", line)
+    }
+
+    if protocol, exists := connProtocols[fields[0]]; !exists {
+        return conn, fmt.Errorf("invalid protocol: %s", fields[0])
+    } else {
+        conn.Protocol = protocol
+    }
+
+    if conn.ClientAddr, err = parseConnAddr(fields[1]); err != nil {
+        return
+    } else if conn.ClientPort, err = parseConnPort(fields[2]); err != nil {
+        return
+    } else if conn.VirtualAddr, err = parseConnAddr(fields[3]); err != nil {
+        return
+    } else if conn.VirtualPort, err = parseConnPort(fields[4]); err != nil {
+        return
+    } else if conn.DestAddr, err = parseConnAddr(fields[5]); err != nil {
+        return
+    } else if conn.DestPort, err = parseConnPort(fields[6]); err != nil {
+        return
+    }
+
+    conn.State = fields[7]
+
+    if expires, err := strconv.ParseUint(fields[8], 10, 32); err != nil {
+        return conn, fmt.Errorf("invalid expires: %s", fields[8])
+    } else {
+        conn.Expires = time.Duration(expires) * time.Second
+    }
+
+    return conn, nil
+}
+
+// Read the connections after the header line
+func readConnections(ctx context.Context, reader io.Reader, walkFunc func(conn Connection) error) error {
+    var walker = walker{ctx: ctx}
+    var scanner = bufio.NewScanner(reader)
+
+    for header := true; scanner.Scan(); header = false {
+        if header {
+            continue
+        }
+
+        err := walker.walk(func() error {
+            if conn, err := parseConnection(scanner.Text()); err != nil {
+                return errs.InternalError(fmt.Errorf("ipvs: %s: %v", IPVS_CONN_PATH, err))
+            } else {
+                return walkFunc(conn)
+            }
+        })
+        if err != nil {
+            break
+        }
+    }
+
+    return walker.result(errs.KernelError(scanner.Err()))
+}
+
+// The connection table of the client network namespace, which remains bound to the namespace once opened
+func (client *Client) openConnections() (file *os.File, err error) {
+    if client.nsPath == "" {
+        file, err = os.Open(IPVS_CONN_PATH)
+    } else {
+        err = inNamespace(client.nsPath, func() (err error) {
+            file, err = os.Open(IPVS_CONN_THREAD_PATH)
+
+            return
+        })
+    }
+
+    if err != nil {
+        return nil, errs.KernelError(err)
+    }
+
+    return file, nil
+}
+
+// Call the given function for each kernel IPVS connection, until it returns an error, or the context is done.
+//
+// Returns SkipAll from the callback to stop the walk without any error.
+func (client *Client) WalkConnections(ctx context.Context, walkFunc func(conn Connection) error) error {
+    file, err := client.openConnections()
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    return readConnections(ctx, file, walkFunc)
+}
+
+// Return the active kernel IPVS connections, e.g. for draining backends once their connections have closed
+func (client *Client) ListConnections() (conns []Connection, err error) {
+    return client.ListConnectionsContext(context.Background())
+}
+
+func (client *Client) ListConnectionsContext(ctx context.Context) (conns []Connection, err error) {
+    err = client.WalkConnections(ctx, func(conn Connection) error {
+        conns = append(conns, conn)
+
+        return nil
+    })
+
+    return
+}
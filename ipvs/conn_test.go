@@ -0,0 +1,64 @@
+package ipvs
+
+import (
+    "context"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+const testConnections = `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP 0A000201 D431 0A6B6B6B 0050 0A036B01 1F90 ESTABLISHED     899
+UDP 0A000202 A1B2 0A6B6B35 0035 0A036B02 0035 UDP             298
+TCP 2001:0db8:0000:0000:0000:0000:0000:0002 D432 2001:0db8:0000:0000:0000:0000:0000:006b 01BB 2001:0db8:0000:0000:0000:0000:0003:0001 01BB FIN_WAIT         60
+TCP 0A000203 D433 0A6B6B6B 0050 0A036B01 1F90 ESTABLISHED     10 sip 1234@example.com
+IP  0A000201 0000 0A6B6B6B 0050 0A036B01 1F90 NONE            299
+`
+
+func TestConnections(t *testing.T) {
+    var conns []Connection
+
+    if err := readConnections(context.Background(), strings.NewReader(testConnections), func(conn Connection) error {
+        conns = append(conns, conn)
+        return nil
+    }); err != nil {
+        t.Fatalf("readConnections: %v", err)
+    }
+
+    if len(conns) != 5 {
+        t.Fatalf("readConnections: %#v", conns)
+    }
+
+    if conn := conns[0]; conn.String() != "tcp 10.0.2.1:54321 -> 10.107.107.107:80 -> 10.3.107.1:8080 ESTABLISHED" || conn.Expires != 899 * time.Second {
+        t.Errorf("fail conn: %v expires=%v", conn, conn.Expires)
+    }
+    if conn := conns[1]; conn.Protocol != syscall.IPPROTO_UDP || conn.DestPort != 53 {
+        t.Errorf("fail udp conn: %v", conn)
+    }
+    if conn := conns[2]; conn.String() != "tcp [2001:db8::2]:54322 -> [2001:db8::6b]:443 -> [2001:db8::3:1]:443 FIN_WAIT" {
+        t.Errorf("fail inet6 conn: %v", conn)
+    }
+    if service := conns[2].Service(); service.String() != "inet6+tcp://2001:db8::6b:443" {
+        t.Errorf("fail inet6 conn service: %v", service)
+    }
+    if conn := conns[3]; conn.Expires != 10 * time.Second {
+        t.Errorf("fail pe conn: %v expires=%v", conn, conn.Expires)
+    }
+    if conn := conns[4]; !conn.Template() || conn.ClientPort != 0 || conns[0].Template() {
+        t.Errorf("fail template conn: %v", conn)
+    }
+}
+
+func TestConnectionsInvalid(t *testing.T) {
+    for _, line := range []string{
+        "TCP 0A000201 D431 0A6B6B6B 0050",
+        "ICMP 0A000201 D431 0A6B6B6B 0050 0A036B01 1F90 ESTABLISHED     899",
+        "TCP 0A0002 D431 0A6B6B6B 0050 0A036B01 1F90 ESTABLISHED     899",
+        "TCP 0A000201 D431 0A6B6B6B 10000 0A036B01 1F90 ESTABLISHED     899",
+    } {
+        if _, err := parseConnection(line); err == nil {
+            t.Errorf("parseConnection %#v: no error", line)
+        }
+    }
+}
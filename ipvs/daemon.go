@@ -0,0 +1,129 @@
+package ipvs
+/*
+ * The kernel IPVS connection synchronization daemons, like `ipvsadm --start-daemon`.
+ *
+ * The master daemon multicasts the connection table on the given interface, and the backup daemon receives it, allowing a passive
+ * director to take over the existing connections on failover. Both daemons can run at the same time, one of each state.
+ */
+
+import (
+    "context"
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "github.com/hkwi/nlgo"
+    "syscall"
+)
+
+type DaemonState uint32
+
+func (self DaemonState) String() string {
+    switch self {
+    case IP_VS_STATE_NONE:
+        return "none"
+    case IP_VS_STATE_MASTER:
+        return "master"
+    case IP_VS_STATE_BACKUP:
+        return "backup"
+    default:
+        return fmt.Sprintf("%#04x", uint32(self))
+    }
+}
+
+func ParseDaemonState(value string) (DaemonState, error) {
+    switch value {
+    case "master":
+        return IP_VS_STATE_MASTER, nil
+    case "backup":
+        return IP_VS_STATE_BACKUP, nil
+    default:
+        return 0, errs.ConfigError(fmt.Errorf("Invalid DaemonState: %s", value))
+    }
+}
+
+type Daemon struct {
+    State       DaemonState
+
+    // multicast interface name
+    McastIfn    string
+
+    // only connections with the same sync ID are synchronized
+    SyncID      uint32
+}
+
+func (self Daemon) String() string {
+    return fmt.Sprintf("%v %s syncid %d", self.State, self.McastIfn, self.SyncID)
+}
+
+func unpackDaemon(attrs nlgo.AttrMap) (daemon Daemon, err error) {
+    for _, attr := range attrs.Slice() {
+        switch attr.Field() {
+        case IPVS_DAEMON_ATTR_STATE:        daemon.State = (DaemonState)(attr.Value.(nlgo.U32))
+        case IPVS_DAEMON_ATTR_MCAST_IFN:    daemon.McastIfn = (string)(attr.Value.(nlgo.NulString))
+        case IPVS_DAEMON_ATTR_SYNC_ID:      daemon.SyncID = (uint32)(attr.Value.(nlgo.U32))
+        }
+    }
+
+    return
+}
+
+func (self Daemon) attrs() nlgo.AttrSlice {
+    return nlgo.AttrSlice{
+        nlattr(IPVS_DAEMON_ATTR_STATE,      nlgo.U32(self.State)),
+        nlattr(IPVS_DAEMON_ATTR_MCAST_IFN,  nlgo.NulString(self.McastIfn)),
+        nlattr(IPVS_DAEMON_ATTR_SYNC_ID,    nlgo.U32(self.SyncID)),
+    }
+}
+
+// Return the running sync daemons, using IPVS_CMD_GET_DAEMON
+func (client *Client) ListDaemons() (daemons []Daemon, err error) {
+    return client.ListDaemonsContext(context.Background())
+}
+
+func (client *Client) ListDaemonsContext(ctx context.Context) (daemons []Daemon, err error) {
+    request := Request{
+        Cmd:    IPVS_CMD_GET_DAEMON,
+        Flags:  syscall.NLM_F_DUMP,
+    }
+
+    err = client.request(ctx, request, ipvs_cmd_policy, func (cmdAttrs nlgo.AttrMap) error {
+        if daemonAttrs := cmdAttrs.Get(IPVS_CMD_ATTR_DAEMON); daemonAttrs == nil {
+            return errs.InternalError(fmt.Errorf("IPVS_CMD_GET_DAEMON without IPVS_CMD_ATTR_DAEMON"))
+        } else if daemon, err := unpackDaemon(daemonAttrs.(nlgo.AttrMap)); err != nil {
+            return errs.InternalError(err)
+        } else {
+            daemons = append(daemons, daemon)
+        }
+
+        return nil
+    })
+
+    return
+}
+
+// Start a sync daemon, using IPVS_CMD_NEW_DAEMON.
+//
+// Fails with EEXIST if a daemon with the same state is already running.
+func (client *Client) NewDaemon(daemon Daemon) error {
+    return client.NewDaemonContext(context.Background(), daemon)
+}
+
+func (client *Client) NewDaemonContext(ctx context.Context, daemon Daemon) error {
+    return client.exec(ctx, Request{
+        Cmd:    IPVS_CMD_NEW_DAEMON,
+        Attrs:  nlgo.AttrSlice{nlattr(IPVS_CMD_ATTR_DAEMON, daemon.attrs())},
+    })
+}
+
+// Stop the sync daemon with the given state, using IPVS_CMD_DEL_DAEMON
+func (client *Client) DelDaemon(state DaemonState) error {
+    return client.DelDaemonContext(context.Background(), state)
+}
+
+func (client *Client) DelDaemonContext(ctx context.Context, state DaemonState) error {
+    return client.exec(ctx, Request{
+        Cmd:    IPVS_CMD_DEL_DAEMON,
+        Attrs:  nlgo.AttrSlice{nlattr(IPVS_CMD_ATTR_DAEMON, nlgo.AttrSlice{
+            nlattr(IPVS_DAEMON_ATTR_STATE,  nlgo.U32(state)),
+        })},
+    })
+}
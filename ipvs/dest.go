@@ -1,6 +1,7 @@
 package ipvs
 
 import (
+    "github.com/qmsk/clusterf/errs"
     "fmt"
     "net"
     "github.com/hkwi/nlgo"
@@ -34,26 +35,90 @@ func ParseFwdMethod(value string) (FwdMethod, error) {
     case "droute":
         return IP_VS_CONN_F_DROUTE, nil
     default:
-        return 0, fmt.Errorf("Invalid FwdMethod: %s", value)
+        return 0, errs.ConfigError(fmt.Errorf("Invalid FwdMethod: %s", value))
+    }
+}
+
+type TunType uint8
+
+func (self TunType) String() string {
+    switch self {
+    case IP_VS_CONN_F_TUNNEL_TYPE_IPIP:
+        return "ipip"
+    case IP_VS_CONN_F_TUNNEL_TYPE_GUE:
+        return "gue"
+    case IP_VS_CONN_F_TUNNEL_TYPE_GRE:
+        return "gre"
+    default:
+        return fmt.Sprintf("%#02x", uint8(self))
+    }
+}
+
+func ParseTunType(value string) (TunType, error) {
+    switch value {
+    case "ipip":
+        return IP_VS_CONN_F_TUNNEL_TYPE_IPIP, nil
+    case "gue":
+        return IP_VS_CONN_F_TUNNEL_TYPE_GUE, nil
+    case "gre":
+        return IP_VS_CONN_F_TUNNEL_TYPE_GRE, nil
+    default:
+        return 0, errs.ConfigError(fmt.Errorf("Invalid TunType: %s", value))
+    }
+}
+
+type TunFlags uint16
+
+func (self TunFlags) String() string {
+    switch self {
+    case IP_VS_TUNNEL_ENCAP_FLAG_NOCSUM:
+        return "nocsum"
+    case IP_VS_TUNNEL_ENCAP_FLAG_CSUM:
+        return "csum"
+    case IP_VS_TUNNEL_ENCAP_FLAG_REMCSUM:
+        return "remcsum"
+    default:
+        return fmt.Sprintf("%#04x", uint16(self))
+    }
+}
+
+func ParseTunFlags(value string) (TunFlags, error) {
+    switch value {
+    case "nocsum":
+        return IP_VS_TUNNEL_ENCAP_FLAG_NOCSUM, nil
+    case "csum":
+        return IP_VS_TUNNEL_ENCAP_FLAG_CSUM, nil
+    case "remcsum":
+        return IP_VS_TUNNEL_ENCAP_FLAG_REMCSUM, nil
+    default:
+        return 0, errs.ConfigError(fmt.Errorf("Invalid TunFlags: %s", value))
     }
 }
 
 type Dest struct {
     // id
-    // TODO: IPVS_DEST_ATTR_ADDR_FAMILY
     Addr        net.IP
     Port        uint16
 
+    // address family of a tunnel dest with a different Af than the service, linux 3.18+; zero for the service Af
+    Af          Af
+
     // params
     FwdMethod   FwdMethod
     Weight      uint32
     UThresh     uint32
     LThresh     uint32
 
+    // tunnel encapsulation for the tunnel FwdMethod, linux 5.2+
+    TunType     TunType
+    TunPort     uint16
+    TunFlags    TunFlags    // linux 5.3+
+
     // info
     ActiveConns     uint32
     InactConns      uint32
     PersistConns    uint32
+    Stats           Stats
 }
 
 // Acts as an unique identifier for the Service
@@ -61,25 +126,59 @@ func (self Dest) String() string {
     return fmt.Sprintf("%s:%d", self.Addr, self.Port)
 }
 
+// Parse the identifying fields of a Dest from its String(), e.g. 10.1.0.1:8080 or 2001:db8::1:8080.
+//
+// The Af is left as zero, for the Af of the service.
+func ParseDest(value string) (Dest, error) {
+    if ip, port, err := parseAddrPort(value); err != nil {
+        return Dest{}, errs.ConfigError(fmt.Errorf("Invalid Dest %s: %v", value, err))
+    } else {
+        return Dest{Addr: ip, Port: port}, nil
+    }
+}
+
 func unpackDest(service Service, attrs nlgo.AttrMap) (Dest, error) {
     var dest Dest
     var addr []byte
+    var af = service.Af
+    var stats64 bool
 
     for _, attr := range attrs.Slice() {
         switch attr.Field() {
         case IPVS_DEST_ATTR_ADDR:       addr = ([]byte)(attr.Value.(nlgo.Binary))
         case IPVS_DEST_ATTR_PORT:       dest.Port = unpackPort(attr.Value.(nlgo.U16))
+        case IPVS_DEST_ATTR_ADDR_FAMILY: af = (Af)(attr.Value.(nlgo.U16))
         case IPVS_DEST_ATTR_FWD_METHOD: dest.FwdMethod = (FwdMethod)(attr.Value.(nlgo.U32))
         case IPVS_DEST_ATTR_WEIGHT:     dest.Weight = (uint32)(attr.Value.(nlgo.U32))
         case IPVS_DEST_ATTR_U_THRESH:   dest.UThresh = (uint32)(attr.Value.(nlgo.U32))
         case IPVS_DEST_ATTR_L_THRESH:   dest.LThresh = (uint32)(attr.Value.(nlgo.U32))
+        case IPVS_DEST_ATTR_TUN_TYPE:   dest.TunType = (TunType)(attr.Value.(nlgo.U8))
+        case IPVS_DEST_ATTR_TUN_PORT:   dest.TunPort = unpackPort(attr.Value.(nlgo.U16))
+        case IPVS_DEST_ATTR_TUN_FLAGS:  dest.TunFlags = (TunFlags)(attr.Value.(nlgo.U16))
         case IPVS_DEST_ATTR_ACTIVE_CONNS:   dest.ActiveConns = (uint32)(attr.Value.(nlgo.U32))
         case IPVS_DEST_ATTR_INACT_CONNS:    dest.InactConns = (uint32)(attr.Value.(nlgo.U32))
         case IPVS_DEST_ATTR_PERSIST_CONNS:  dest.PersistConns = (uint32)(attr.Value.(nlgo.U32))
+        case IPVS_DEST_ATTR_STATS:
+            if stats, err := unpackStats(attr.Value.(nlgo.AttrMap)); err != nil {
+                return dest, fmt.Errorf("ipvs:Dest.unpack: stats: %s", err)
+            } else if !stats64 {
+                dest.Stats = stats
+            }
+        case IPVS_DEST_ATTR_STATS64:
+            if stats, err := unpackStats(attr.Value.(nlgo.AttrMap)); err != nil {
+                return dest, fmt.Errorf("ipvs:Dest.unpack: stats64: %s", err)
+            } else {
+                dest.Stats = stats
+                stats64 = true
+            }
         }
     }
 
-    if addrIP, err := unpackAddr(addr, service.Af); err != nil {
+    if af != service.Af {
+        dest.Af = af
+    }
+
+    if addrIP, err := unpackAddr(addr, af); err != nil {
         return dest, fmt.Errorf("ipvs:Dest.unpack: addr: %s", err)
     } else {
         dest.Addr = addrIP
@@ -88,15 +187,24 @@ func unpackDest(service Service, attrs nlgo.AttrMap) (Dest, error) {
     return dest, nil
 }
 
-// Dump Dest as nl attrs, using the Af of the corresponding Service.
+// Dump Dest as nl attrs, using the Af of the corresponding Service, unless the Dest has a different Af.
 // If full, includes Dest setting attrs, otherwise only identifying attrs.
 func (self *Dest) attrs(service *Service, full bool) nlgo.AttrSlice {
     var attrs nlgo.AttrSlice
 
-    attrs = append(attrs,
-        nlattr(IPVS_DEST_ATTR_ADDR, packAddr(service.Af, self.Addr)),
-        nlattr(IPVS_DEST_ATTR_PORT, packPort(self.Port)),
-    )
+    // the IPVS_DEST_ATTR_ADDR_FAMILY is omitted for the same Af, for older kernels
+    if self.Af == 0 || self.Af == service.Af {
+        attrs = append(attrs,
+            nlattr(IPVS_DEST_ATTR_ADDR, packAddr(service.Af, self.Addr)),
+            nlattr(IPVS_DEST_ATTR_PORT, packPort(self.Port)),
+        )
+    } else {
+        attrs = append(attrs,
+            nlattr(IPVS_DEST_ATTR_ADDR, packAddr(self.Af, self.Addr)),
+            nlattr(IPVS_DEST_ATTR_PORT, packPort(self.Port)),
+            nlattr(IPVS_DEST_ATTR_ADDR_FAMILY, nlgo.U16(self.Af)),
+        )
+    }
 
     if full {
         attrs = append(attrs,
@@ -105,6 +213,19 @@ func (self *Dest) attrs(service *Service, full bool) nlgo.AttrSlice {
             nlattr(IPVS_DEST_ATTR_U_THRESH,     nlgo.U32(self.UThresh)),
             nlattr(IPVS_DEST_ATTR_L_THRESH,     nlgo.U32(self.LThresh)),
         )
+
+        // omitted for older kernels, which default to IPIP
+        if self.TunType != 0 || self.TunPort != 0 {
+            attrs = append(attrs,
+                nlattr(IPVS_DEST_ATTR_TUN_TYPE,     nlgo.U8(self.TunType)),
+                nlattr(IPVS_DEST_ATTR_TUN_PORT,     packPort(self.TunPort)),
+            )
+        }
+        if self.TunFlags != 0 {
+            attrs = append(attrs,
+                nlattr(IPVS_DEST_ATTR_TUN_FLAGS,    nlgo.U16(self.TunFlags)),
+            )
+        }
     }
 
     return attrs
@@ -0,0 +1,40 @@
+// Package ipvs is a netlink client for the Linux IPVS kernel module.
+//
+// The package is usable on its own, without importing the clusterf daemon: it only depends on github.com/hkwi/nlgo for the netlink
+// transport, and github.com/qmsk/clusterf/errs for classifying any kernel errors.
+//
+// The repository is not a versioned Go module, and there are no compatibility guarantees: any exported names may still change
+// between commits, so any other projects should pin a specific commit.
+//
+// The Service.Flags are named booleans for the IP_VS_SVC_F_* bits, replacing the previous Flags{Flags, Mask} bitmask type. This was
+// a breaking change, and any existing bitmasks can be converted using the deprecated FlagsFromBitmask and Flags.Bitmask.
+//
+// The Service.String() of e.g. inet+tcp://10.0.1.1:80 or inet+fwmark://1 identifies the service in logs and metric labels, and is
+// parsed back using ParseService. Likewise, the Dest.String() of 10.1.0.1:8080 is parsed using ParseDest.
+//
+// The ListServices and ListDests methods return the full kernel tables, whereas WalkServices and WalkDests call a function for each
+// entry, and can be stopped early by returning SkipAll or cancelling the context. The ListServicesFiltered method only returns the
+// services for the given address family and protocol; the kernel still dumps the full table, but any other services are not unpacked.
+// The GetService and GetDest methods look up a single entry, failing with ErrNotFound.
+//
+// The Client is safe for concurrent use by multiple goroutines, serializing each netlink request and its response messages.
+//
+// Each command also has a ...Context variant, e.g. NewServiceContext or ListServicesContext, returning the context error once the
+// context is done. The client only runs one netlink request at a time, and any cancelled request keeps running in the background,
+// so the kernel may still apply a cancelled command. The plain methods use context.Background().
+//
+// The Batch returned by Client.Batch queues service and dest commands, sending them with a single netlink write for each BATCH_SIZE
+// commands in Flush. The batch is not atomic, and any failed commands are returned as a *BatchError after applying the others.
+//
+// Any netlink error replies are returned as a *CommandError, matching the Err* errors for the command using errors.Is, e.g.
+// ErrServiceExists or ErrDestNotFound.
+//
+// The connection table is not available via genetlink, and the ListConnections and WalkConnections read /proc/net/ip_vs_conn instead.
+//
+// The OpenInNamespace function opens a client for the IPVS table of another network namespace, e.g. /var/run/netns/$name.
+//
+// The FakeClient implements the same plain methods as the Client using in-memory tables, for testing without root or the ip_vs
+// kernel module. It is also accepted as the clusterf.IpvsConfig Client.
+//
+// The ListDaemons, NewDaemon and DelDaemon methods control the connection sync daemons used for failover between directors.
+package ipvs
@@ -0,0 +1,116 @@
+package ipvs
+/*
+ * Typed errors for the netlink error replies to the IPVS commands.
+ *
+ * The kernel replies with a bare errno, whose meaning depends on the command: ENOENT is a missing scheduler for the service commands,
+ * but a missing dest for the dest commands. The errors are mapped to the Err* errors by the command, for callers to handle using
+ * errors.Is, e.g. to ignore a dest that was already removed.
+ */
+
+import (
+    "errors"
+    "fmt"
+    "syscall"
+)
+
+// Returned by GetService and GetDest for any missing service or dest, classified as a kernel error.
+// Also matches ErrServiceNotFound and ErrDestNotFound.
+var ErrNotFound = errors.New("ipvs: not found")
+
+type notFoundError string
+
+func (self notFoundError) Error() string {
+    return string(self)
+}
+
+func (self notFoundError) Is(target error) bool {
+    return target == ErrNotFound
+}
+
+var (
+    ErrServiceExists            = errors.New("ipvs: service already exists")
+    ErrServiceNotFound  error   = notFoundError("ipvs: service not found")
+    ErrDestExists               = errors.New("ipvs: dest already exists")
+    ErrDestNotFound     error   = notFoundError("ipvs: dest not found")
+    ErrSchedulerNotSupported    = errors.New("ipvs: scheduler not supported")
+)
+
+var cmdNames = map[uint8]string{
+    IPVS_CMD_NEW_SERVICE:   "NEW_SERVICE",
+    IPVS_CMD_SET_SERVICE:   "SET_SERVICE",
+    IPVS_CMD_DEL_SERVICE:   "DEL_SERVICE",
+    IPVS_CMD_GET_SERVICE:   "GET_SERVICE",
+    IPVS_CMD_NEW_DEST:      "NEW_DEST",
+    IPVS_CMD_SET_DEST:      "SET_DEST",
+    IPVS_CMD_DEL_DEST:      "DEL_DEST",
+    IPVS_CMD_GET_DEST:      "GET_DEST",
+    IPVS_CMD_NEW_DAEMON:    "NEW_DAEMON",
+    IPVS_CMD_DEL_DAEMON:    "DEL_DAEMON",
+    IPVS_CMD_GET_DAEMON:    "GET_DAEMON",
+    IPVS_CMD_SET_TIMEOUT:   "SET_TIMEOUT",
+    IPVS_CMD_GET_TIMEOUT:   "GET_TIMEOUT",
+    IPVS_CMD_GET_INFO:      "GET_INFO",
+    IPVS_CMD_ZERO:          "ZERO",
+    IPVS_CMD_FLUSH:         "FLUSH",
+}
+
+// Netlink error reply to a command, matching both the errno and any Err* error using errors.Is
+type CommandError struct {
+    Cmd     uint8
+    Errno   syscall.Errno
+
+    // one of the Err* errors, or nil for any other errors
+    Err     error
+}
+
+func (self *CommandError) Error() string {
+    if self.Err != nil {
+        return fmt.Sprintf("%v: %v", self.Err, self.Errno)
+    } else if name, exists := cmdNames[self.Cmd]; exists {
+        return fmt.Sprintf("ipvs: IPVS_CMD_%s: %v", name, self.Errno)
+    } else {
+        return fmt.Sprintf("ipvs: IPVS_CMD %d: %v", self.Cmd, self.Errno)
+    }
+}
+
+func (self *CommandError) Unwrap() error {
+    return self.Err
+}
+
+func (self *CommandError) Is(target error) bool {
+    return target == self.Errno
+}
+
+// Map the errno of the kernel reply to the command, following net/netfilter/ipvs/ip_vs_ctl.c
+func commandError(cmd uint8, errno syscall.Errno) *CommandError {
+    var err = CommandError{Cmd: cmd, Errno: errno}
+
+    switch cmd {
+    case IPVS_CMD_NEW_SERVICE, IPVS_CMD_SET_SERVICE:
+        switch errno {
+        case syscall.EEXIST:
+            err.Err = ErrServiceExists
+        case syscall.ESRCH:
+            err.Err = ErrServiceNotFound
+        case syscall.ENOENT, syscall.ENOPROTOOPT:
+            // missing ip_vs_* scheduler module
+            err.Err = ErrSchedulerNotSupported
+        }
+    case IPVS_CMD_DEL_SERVICE, IPVS_CMD_GET_SERVICE, IPVS_CMD_ZERO:
+        switch errno {
+        case syscall.ESRCH:
+            err.Err = ErrServiceNotFound
+        }
+    case IPVS_CMD_NEW_DEST, IPVS_CMD_SET_DEST, IPVS_CMD_DEL_DEST:
+        switch errno {
+        case syscall.EEXIST:
+            err.Err = ErrDestExists
+        case syscall.ESRCH:
+            err.Err = ErrServiceNotFound
+        case syscall.ENOENT:
+            err.Err = ErrDestNotFound
+        }
+    }
+
+    return &err
+}
@@ -0,0 +1,48 @@
+package ipvs
+
+import (
+    "errors"
+    "github.com/qmsk/clusterf/errs"
+    "syscall"
+    "testing"
+)
+
+func TestCommandError(t *testing.T) {
+    for _, test := range []struct{
+        cmd     uint8
+        errno   syscall.Errno
+        err     error
+        str     string
+    }{
+        {IPVS_CMD_NEW_SERVICE, syscall.EEXIST, ErrServiceExists, "ipvs: service already exists: file exists"},
+        {IPVS_CMD_NEW_SERVICE, syscall.ENOENT, ErrSchedulerNotSupported, "ipvs: scheduler not supported: no such file or directory"},
+        {IPVS_CMD_SET_SERVICE, syscall.ENOPROTOOPT, ErrSchedulerNotSupported, "ipvs: scheduler not supported: protocol not available"},
+        {IPVS_CMD_DEL_SERVICE, syscall.ESRCH, ErrServiceNotFound, "ipvs: service not found: no such process"},
+        {IPVS_CMD_NEW_DEST, syscall.EEXIST, ErrDestExists, "ipvs: dest already exists: file exists"},
+        {IPVS_CMD_NEW_DEST, syscall.ESRCH, ErrServiceNotFound, "ipvs: service not found: no such process"},
+        {IPVS_CMD_DEL_DEST, syscall.ENOENT, ErrDestNotFound, "ipvs: dest not found: no such file or directory"},
+        {IPVS_CMD_NEW_DAEMON, syscall.EEXIST, nil, "ipvs: IPVS_CMD_NEW_DAEMON: file exists"},
+    } {
+        var err error = errs.KernelError(commandError(test.cmd, test.errno))
+
+        if test.err != nil && !errors.Is(err, test.err) {
+            t.Errorf("commandError %d %v: %v is not %v", test.cmd, test.errno, err, test.err)
+        }
+        if !errors.Is(err, test.errno) {
+            t.Errorf("commandError %d %v: %v is not errno", test.cmd, test.errno, err)
+        }
+        if err.Error() != test.str {
+            t.Errorf("commandError %d %v: %#v != %#v", test.cmd, test.errno, err.Error(), test.str)
+        }
+        if errs.Classify(err) != errs.Kernel {
+            t.Errorf("commandError %d %v: class %v", test.cmd, test.errno, errs.Classify(err))
+        }
+    }
+
+    if err := commandError(IPVS_CMD_DEL_DEST, syscall.ENOENT); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrServiceNotFound) {
+        t.Errorf("commandError dest not found: %v", err)
+    }
+    if errors.Is(ErrServiceExists, ErrNotFound) {
+        t.Errorf("ErrServiceExists is ErrNotFound")
+    }
+}
@@ -0,0 +1,330 @@
+package ipvs
+/*
+ * In-memory fake of the kernel IPVS state, for testing any code using the Client without root or the ip_vs module.
+ *
+ * The FakeClient implements the same plain methods as the Client, returning the same *CommandError errors as the kernel would for
+ * any existing or missing services and dests, but without any validation of the service or dest params.
+ */
+
+import (
+    "context"
+    "github.com/qmsk/clusterf/errs"
+    "sort"
+    "sync"
+    "syscall"
+)
+
+// In-memory IPVS services and dests, safe for concurrent use
+type FakeClient struct {
+    // returned by GetInfo
+    Info        Info
+
+    // returned by WalkConnections
+    Connections []Connection
+
+    mutex       sync.Mutex
+    services    map[string]Service
+    dests       map[string]map[string]Dest
+    daemons     []Daemon
+    timeout     Timeout
+}
+
+// Return a new FakeClient with empty IPVS tables
+func NewFakeClient() *FakeClient {
+    return &FakeClient{
+        services:   make(map[string]Service),
+        dests:      make(map[string]map[string]Dest),
+    }
+}
+
+func fakeError(cmd uint8, errno syscall.Errno) error {
+    return errs.KernelError(commandError(cmd, errno))
+}
+
+func (self *FakeClient) SetDebugEnabled(enabled bool) { }
+
+func (self *FakeClient) GetInfo() (Info, error) {
+    return self.Info, nil
+}
+
+func (self *FakeClient) Flush() error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.services = make(map[string]Service)
+    self.dests = make(map[string]map[string]Dest)
+
+    return nil
+}
+
+func (self *FakeClient) ZeroService(service Service) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if _, exists := self.services[service.String()]; !exists {
+        return fakeError(IPVS_CMD_ZERO, syscall.ESRCH)
+    }
+
+    self.zeroService(service.String())
+
+    return nil
+}
+
+func (self *FakeClient) ZeroAll() error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    for key, _ := range self.services {
+        self.zeroService(key)
+    }
+
+    return nil
+}
+
+func (self *FakeClient) zeroService(key string) {
+    service := self.services[key]
+    service.Stats = Stats{}
+    self.services[key] = service
+
+    for destKey, dest := range self.dests[key] {
+        dest.Stats = Stats{}
+        self.dests[key][destKey] = dest
+    }
+}
+
+func (self *FakeClient) GetTimeout() (Timeout, error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.timeout, nil
+}
+
+// Any zero values are left unchanged
+func (self *FakeClient) SetTimeout(timeout Timeout) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if timeout.TCP != 0 {
+        self.timeout.TCP = timeout.TCP
+    }
+    if timeout.TCPFin != 0 {
+        self.timeout.TCPFin = timeout.TCPFin
+    }
+    if timeout.UDP != 0 {
+        self.timeout.UDP = timeout.UDP
+    }
+
+    return nil
+}
+
+func (self *FakeClient) ListDaemons() ([]Daemon, error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return append([]Daemon(nil), self.daemons...), nil
+}
+
+func (self *FakeClient) NewDaemon(daemon Daemon) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    for _, d := range self.daemons {
+        if d.State == daemon.State {
+            return fakeError(IPVS_CMD_NEW_DAEMON, syscall.EEXIST)
+        }
+    }
+
+    self.daemons = append(self.daemons, daemon)
+
+    return nil
+}
+
+func (self *FakeClient) DelDaemon(state DaemonState) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    for i, daemon := range self.daemons {
+        if daemon.State == state {
+            self.daemons = append(self.daemons[:i:i], self.daemons[i+1:]...)
+
+            return nil
+        }
+    }
+
+    return fakeError(IPVS_CMD_DEL_DAEMON, syscall.ESRCH)
+}
+
+// Return the services, sorted by String()
+func (self *FakeClient) ListServices() (services []Service, err error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    for _, service := range self.services {
+        services = append(services, service)
+    }
+
+    sort.Slice(services, func(i, j int) bool { return services[i].String() < services[j].String() })
+
+    return services, nil
+}
+
+// Return the services with the given address family and protocol, with a zero Af or Protocol matching any, sorted by String()
+func (self *FakeClient) ListServicesFiltered(af Af, protocol Protocol) (services []Service, err error) {
+    if listServices, err := self.ListServices(); err != nil {
+        return nil, err
+    } else {
+        for _, service := range listServices {
+            if af != 0 && service.Af != af {
+
+            } else if protocol != 0 && service.Protocol != protocol {
+
+            } else {
+                services = append(services, service)
+            }
+        }
+    }
+
+    return services, nil
+}
+
+func (self *FakeClient) GetService(id Service) (Service, error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if service, exists := self.services[id.String()]; !exists {
+        return service, errs.KernelError(ErrServiceNotFound)
+    } else {
+        return service, nil
+    }
+}
+
+func (self *FakeClient) NewService(service Service) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if _, exists := self.services[service.String()]; exists {
+        return fakeError(IPVS_CMD_NEW_SERVICE, syscall.EEXIST)
+    }
+
+    self.services[service.String()] = service
+    self.dests[service.String()] = make(map[string]Dest)
+
+    return nil
+}
+
+func (self *FakeClient) SetService(service Service) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if _, exists := self.services[service.String()]; !exists {
+        return fakeError(IPVS_CMD_SET_SERVICE, syscall.ESRCH)
+    }
+
+    self.services[service.String()] = service
+
+    return nil
+}
+
+func (self *FakeClient) DelService(service Service) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if _, exists := self.services[service.String()]; !exists {
+        return fakeError(IPVS_CMD_DEL_SERVICE, syscall.ESRCH)
+    }
+
+    delete(self.services, service.String())
+    delete(self.dests, service.String())
+
+    return nil
+}
+
+// Return the dests of the service, sorted by String()
+func (self *FakeClient) ListDests(service Service) (dests []Dest, err error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if _, exists := self.services[service.String()]; !exists {
+        return nil, fakeError(IPVS_CMD_GET_DEST, syscall.ESRCH)
+    }
+
+    for _, dest := range self.dests[service.String()] {
+        dests = append(dests, dest)
+    }
+
+    sort.Slice(dests, func(i, j int) bool { return dests[i].String() < dests[j].String() })
+
+    return dests, nil
+}
+
+func (self *FakeClient) GetDest(service Service, id Dest) (Dest, error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if dests, exists := self.dests[service.String()]; !exists {
+        return Dest{}, fakeError(IPVS_CMD_GET_DEST, syscall.ESRCH)
+    } else if dest, exists := dests[id.String()]; !exists {
+        return dest, errs.KernelError(ErrDestNotFound)
+    } else {
+        return dest, nil
+    }
+}
+
+func (self *FakeClient) NewDest(service Service, dest Dest) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if dests, exists := self.dests[service.String()]; !exists {
+        return fakeError(IPVS_CMD_NEW_DEST, syscall.ESRCH)
+    } else if _, exists := dests[dest.String()]; exists {
+        return fakeError(IPVS_CMD_NEW_DEST, syscall.EEXIST)
+    } else {
+        dests[dest.String()] = dest
+    }
+
+    return nil
+}
+
+func (self *FakeClient) SetDest(service Service, dest Dest) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if dests, exists := self.dests[service.String()]; !exists {
+        return fakeError(IPVS_CMD_SET_DEST, syscall.ESRCH)
+    } else if _, exists := dests[dest.String()]; !exists {
+        return fakeError(IPVS_CMD_SET_DEST, syscall.ENOENT)
+    } else {
+        dests[dest.String()] = dest
+    }
+
+    return nil
+}
+
+func (self *FakeClient) DelDest(service Service, dest Dest) error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if dests, exists := self.dests[service.String()]; !exists {
+        return fakeError(IPVS_CMD_DEL_DEST, syscall.ESRCH)
+    } else if _, exists := dests[dest.String()]; !exists {
+        return fakeError(IPVS_CMD_DEL_DEST, syscall.ENOENT)
+    } else {
+        delete(dests, dest.String())
+    }
+
+    return nil
+}
+
+func (self *FakeClient) WalkConnections(ctx context.Context, walkFunc func(conn Connection) error) error {
+    for _, conn := range self.Connections {
+        if err := ctx.Err(); err != nil {
+            return err
+        } else if err := walkFunc(conn); err == SkipAll {
+            return nil
+        } else if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,106 @@
+package ipvs
+
+import (
+    "errors"
+    "github.com/qmsk/clusterf/errs"
+    "net"
+    "syscall"
+    "testing"
+)
+
+func TestFakeClient(t *testing.T) {
+    var client = NewFakeClient()
+    var service = Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("10.0.1.1"), Port: 80, SchedName: "wlc"}
+    var dest = Dest{Addr: net.ParseIP("10.1.0.1"), Port: 80, FwdMethod: IP_VS_CONN_F_MASQ, Weight: 10}
+
+    if err := client.NewDest(service, dest); !errors.Is(err, ErrServiceNotFound) {
+        t.Errorf("NewDest without service: %v", err)
+    }
+    if err := client.NewService(service); err != nil {
+        t.Fatalf("NewService: %v", err)
+    }
+    if err := client.NewService(service); !errors.Is(err, ErrServiceExists) || errs.Classify(err) != errs.Kernel {
+        t.Errorf("NewService exists: %v", err)
+    }
+    if err := client.SetDest(service, dest); !errors.Is(err, ErrDestNotFound) || !errors.Is(err, syscall.ENOENT) {
+        t.Errorf("SetDest missing: %v", err)
+    }
+    if err := client.NewDest(service, dest); err != nil {
+        t.Fatalf("NewDest: %v", err)
+    }
+    if err := client.NewDest(service, dest); !errors.Is(err, ErrDestExists) {
+        t.Errorf("NewDest exists: %v", err)
+    }
+
+    dest.Weight = 20
+
+    if err := client.SetDest(service, dest); err != nil {
+        t.Errorf("SetDest: %v", err)
+    }
+    if getDest, err := client.GetDest(service, Dest{Addr: dest.Addr, Port: dest.Port}); err != nil || getDest.Weight != 20 {
+        t.Errorf("GetDest: %v %v", getDest, err)
+    }
+
+    if err := client.DelDest(service, dest); err != nil {
+        t.Errorf("DelDest: %v", err)
+    }
+    if _, err := client.GetDest(service, dest); !errors.Is(err, ErrNotFound) {
+        t.Errorf("GetDest deleted: %v", err)
+    }
+
+    if err := client.DelService(service); err != nil {
+        t.Errorf("DelService: %v", err)
+    }
+    if _, err := client.GetService(service); !errors.Is(err, ErrServiceNotFound) {
+        t.Errorf("GetService deleted: %v", err)
+    }
+    if services, err := client.ListServices(); err != nil || len(services) != 0 {
+        t.Errorf("ListServices: %v %v", services, err)
+    }
+}
+
+func TestFakeClientListServicesFiltered(t *testing.T) {
+    var client = NewFakeClient()
+
+    for _, service := range []Service{
+        Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("10.0.1.1").To4(), Port: 80, SchedName: "wlc"},
+        Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_UDP, Addr: net.ParseIP("10.0.1.1").To4(), Port: 53, SchedName: "wlc"},
+        Service{Af: syscall.AF_INET6, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("2001:db8::1"), Port: 80, SchedName: "wlc"},
+    } {
+        if err := client.NewService(service); err != nil {
+            t.Fatalf("NewService %v: %v", service, err)
+        }
+    }
+
+    for _, test := range []struct{
+        af          Af
+        protocol    Protocol
+        services    []string
+    }{
+        {syscall.AF_INET, syscall.IPPROTO_TCP, []string{"inet+tcp://10.0.1.1:80"}},
+        {syscall.AF_INET6, syscall.IPPROTO_UDP, nil},
+        {syscall.AF_INET, 0, []string{"inet+tcp://10.0.1.1:80", "inet+udp://10.0.1.1:53"}},
+        {0, syscall.IPPROTO_TCP, []string{"inet+tcp://10.0.1.1:80", "inet6+tcp://2001:db8::1:80"}},
+    } {
+        services, err := client.ListServicesFiltered(test.af, test.protocol)
+        if err != nil {
+            t.Errorf("ListServicesFiltered %v %v: %v", test.af, test.protocol, err)
+            continue
+        }
+
+        var names []string
+        for _, service := range services {
+            names = append(names, service.String())
+        }
+
+        if len(names) != len(test.services) {
+            t.Errorf("ListServicesFiltered %v %v: %v", test.af, test.protocol, names)
+            continue
+        }
+        for i, name := range names {
+            if name != test.services[i] {
+                t.Errorf("ListServicesFiltered %v %v: %v", test.af, test.protocol, names)
+            }
+        }
+    }
+}
@@ -0,0 +1,123 @@
+package ipvs
+/*
+ * Service flags, as named booleans for the IP_VS_SVC_F_* bits of the struct ip_vs_flags attr.
+ */
+
+import (
+    "bytes"
+    "encoding/binary"
+    "github.com/hkwi/nlgo"
+    "strings"
+)
+
+type Flags struct {
+    Persistent      bool    // IP_VS_SVC_F_PERSISTENT
+    Hashed          bool    // IP_VS_SVC_F_HASHED, only set by the kernel
+    OnePacket       bool    // IP_VS_SVC_F_ONEPACKET, schedule each UDP packet separately
+
+    // Scheduler flags, used by the sh and mh schedulers
+    SchedFallback   bool    // IP_VS_SVC_F_SCHED1, skip any overloaded or zero-weight dests
+    SchedPort       bool    // IP_VS_SVC_F_SCHED2, also hash the source port
+    Sched3          bool    // IP_VS_SVC_F_SCHED3
+}
+
+var flagNames = []struct{
+    bit     uint32
+    name    string
+}{
+    {IP_VS_SVC_F_PERSISTENT,    "persistent"},
+    {IP_VS_SVC_F_HASHED,        "hashed"},
+    {IP_VS_SVC_F_ONEPACKET,     "ops"},
+    {IP_VS_SVC_F_SCHED1,        "flag-1"},
+    {IP_VS_SVC_F_SCHED2,        "flag-2"},
+    {IP_VS_SVC_F_SCHED3,        "flag-3"},
+}
+
+func MakeFlags(bits uint32) Flags {
+    return Flags{
+        Persistent:     bits & IP_VS_SVC_F_PERSISTENT != 0,
+        Hashed:         bits & IP_VS_SVC_F_HASHED != 0,
+        OnePacket:      bits & IP_VS_SVC_F_ONEPACKET != 0,
+        SchedFallback:  bits & IP_VS_SVC_F_SCHED1 != 0,
+        SchedPort:      bits & IP_VS_SVC_F_SCHED2 != 0,
+        Sched3:         bits & IP_VS_SVC_F_SCHED3 != 0,
+    }
+}
+
+func (self Flags) Bits() (bits uint32) {
+    for _, flag := range []struct{
+        set     bool
+        bit     uint32
+    }{
+        {self.Persistent,       IP_VS_SVC_F_PERSISTENT},
+        {self.Hashed,           IP_VS_SVC_F_HASHED},
+        {self.OnePacket,        IP_VS_SVC_F_ONEPACKET},
+        {self.SchedFallback,    IP_VS_SVC_F_SCHED1},
+        {self.SchedPort,        IP_VS_SVC_F_SCHED2},
+        {self.Sched3,           IP_VS_SVC_F_SCHED3},
+    } {
+        if flag.set {
+            bits |= flag.bit
+        }
+    }
+
+    return
+}
+
+// Comma-separated flag names, like ipvsadm
+func (self Flags) String() string {
+    var names []string
+    var bits = self.Bits()
+
+    for _, flag := range flagNames {
+        if bits & flag.bit != 0 {
+            names = append(names, flag.name)
+        }
+    }
+
+    return strings.Join(names, ",")
+}
+
+// The struct ip_vs_flags, in host byte order.
+//
+// Deprecated: this was the Service.Flags type before the named booleans, and is only kept for converting any existing bitmasks
+// using FlagsFromBitmask and Flags.Bitmask.
+type FlagsBitmask struct {
+    Flags   uint32
+    Mask    uint32
+}
+
+// Deprecated: use the named Flags, or MakeFlags for the IP_VS_SVC_F_* bits.
+func FlagsFromBitmask(bitmask FlagsBitmask) Flags {
+    return MakeFlags(bitmask.Flags & bitmask.Mask)
+}
+
+// Set all flags, except for the hashed flag managed by the kernel.
+//
+// Deprecated: use the named Flags, or Flags.Bits for the IP_VS_SVC_F_* bits.
+func (self Flags) Bitmask() FlagsBitmask {
+    return FlagsBitmask{
+        Flags:  self.Bits() &^ IP_VS_SVC_F_HASHED,
+        Mask:   0xffffffff &^ IP_VS_SVC_F_HASHED,
+    }
+}
+
+func unpackFlags(value nlgo.Binary) (Flags, error) {
+    var bitmask FlagsBitmask
+
+    if err := binary.Read(bytes.NewReader(([]byte)(value)), binary.NativeEndian, &bitmask); err != nil {
+        return Flags{}, err
+    }
+
+    return FlagsFromBitmask(bitmask), nil
+}
+
+func (self Flags) pack() nlgo.Binary {
+    var buf bytes.Buffer
+
+    if err := binary.Write(&buf, binary.NativeEndian, self.Bitmask()); err != nil {
+        panic(err)
+    }
+
+    return nlgo.Binary(buf.Bytes())
+}
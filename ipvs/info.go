@@ -3,6 +3,9 @@ package ipvs
 import (
     "fmt"
     "github.com/hkwi/nlgo"
+    "strconv"
+    "strings"
+    "syscall"
 )
 
 /* Packed version number */
@@ -16,9 +19,103 @@ func (version Version) String() string {
     )
 }
 
+/* Kernel release major.minor version */
+type KernelVersion struct {
+    Major   int
+    Minor   int
+}
+
+func (self KernelVersion) String() string {
+    return fmt.Sprintf("%d.%d", self.Major, self.Minor)
+}
+
+func (self KernelVersion) AtLeast(other KernelVersion) bool {
+    return self.Major > other.Major || (self.Major == other.Major && self.Minor >= other.Minor)
+}
+
+// Parse the major.minor version from a uname release, e.g. 5.15.0-91-generic
+func ParseKernelVersion(release string) (version KernelVersion, err error) {
+    parts := strings.SplitN(release, ".", 3)
+
+    if len(parts) < 2 {
+
+    } else if i := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+        // 4.1rc1
+        parts[1] = parts[1][:i]
+    }
+
+    if len(parts) < 2 {
+        return version, fmt.Errorf("Invalid kernel release: %s", release)
+    } else if version.Major, err = strconv.Atoi(parts[0]); err != nil {
+        return version, fmt.Errorf("Invalid kernel release: %s", release)
+    } else if version.Minor, err = strconv.Atoi(parts[1]); err != nil {
+        return version, fmt.Errorf("Invalid kernel release: %s", release)
+    }
+
+    return version, nil
+}
+
+func unameKernelVersion() (KernelVersion, error) {
+    var utsname syscall.Utsname
+    var release []byte
+
+    if err := syscall.Uname(&utsname); err != nil {
+        return KernelVersion{}, err
+    }
+
+    for _, c := range utsname.Release {
+        if c == 0 {
+            break
+        }
+        release = append(release, byte(c))
+    }
+
+    return ParseKernelVersion(string(release))
+}
+
+// Kernel versions adding any newer service or dest attributes; any other attributes are always available
+var serviceAttrVersions = map[uint16]KernelVersion{
+    IPVS_SVC_ATTR_STATS64:      {4, 1},
+}
+var destAttrVersions = map[uint16]KernelVersion{
+    IPVS_DEST_ATTR_ADDR_FAMILY: {3, 18},
+    IPVS_DEST_ATTR_STATS64:     {4, 1},
+    IPVS_DEST_ATTR_TUN_TYPE:    {5, 2},
+    IPVS_DEST_ATTR_TUN_PORT:    {5, 2},
+    IPVS_DEST_ATTR_TUN_FLAGS:   {5, 3},
+}
+
 type Info struct {
     Version     Version
     ConnTabSize uint32
+
+    // genetlink family version
+    FamilyVersion   uint32
+
+    // used to check for any newer attributes, which the IPVS version does not reflect
+    KernelVersion   KernelVersion
+}
+
+// The kernel supports the given IPVS_SVC_ATTR_*
+func (self Info) HasServiceAttr(attr uint16) bool {
+    if version, exists := serviceAttrVersions[attr]; !exists {
+        return true
+    } else {
+        return self.KernelVersion.AtLeast(version)
+    }
+}
+
+// The kernel supports the given IPVS_DEST_ATTR_*
+func (self Info) HasDestAttr(attr uint16) bool {
+    if version, exists := destAttrVersions[attr]; !exists {
+        return true
+    } else {
+        return self.KernelVersion.AtLeast(version)
+    }
+}
+
+func (self Info) String() string {
+    return fmt.Sprintf("version=%s, conn_tab_size=%d, genl_version=%d, kernel=%s", self.Version, self.ConnTabSize, self.FamilyVersion, self.KernelVersion)
 }
 
 func unpackInfo(attrs nlgo.AttrMap) (info Info, err error) {
@@ -49,6 +49,18 @@ const (
 	IP_VS_CONN_F_ONE_PACKET	= 0x2000      /* forward only one packet */
 )
 
+const (
+	IP_VS_CONN_F_TUNNEL_TYPE_IPIP	= 0      /* IPIP */
+	IP_VS_CONN_F_TUNNEL_TYPE_GUE	= 1      /* GUE */
+	IP_VS_CONN_F_TUNNEL_TYPE_GRE	= 2      /* GRE */
+)
+
+const (
+	IP_VS_TUNNEL_ENCAP_FLAG_NOCSUM	= 0x0000      /* no checksum */
+	IP_VS_TUNNEL_ENCAP_FLAG_CSUM	= 0x0001      /* checksum */
+	IP_VS_TUNNEL_ENCAP_FLAG_REMCSUM	= 0x0002      /* remote checksum offload */
+)
+
 const (
     IPVS_CMD_UNSPEC = iota
 
@@ -76,6 +88,12 @@ const (
     IPVS_CMD_FLUSH         /* flush services and dests */
 )
 
+// The linux names for the timeout commands
+const (
+    IPVS_CMD_SET_CONFIG = IPVS_CMD_SET_TIMEOUT
+    IPVS_CMD_GET_CONFIG = IPVS_CMD_GET_TIMEOUT
+)
+
 const (
     IPVS_CMD_ATTR_UNSPEC = iota
     IPVS_CMD_ATTR_SERVICE      /* nested service attribute */
@@ -102,6 +120,8 @@ const (
     IPVS_SVC_ATTR_STATS        /* nested attribute for service stats */
 
     IPVS_SVC_ATTR_PE_NAME      /* name of scheduler */
+
+    IPVS_SVC_ATTR_STATS64      /* nested attribute for service stats, linux 4.1 */
 )
 
 const (
@@ -122,6 +142,12 @@ const (
     IPVS_DEST_ATTR_STATS       /* nested attribute for dest stats */
 
     IPVS_DEST_ATTR_ADDR_FAMILY /* Address family of address */
+
+    IPVS_DEST_ATTR_STATS64     /* nested attribute for dest stats, linux 4.1 */
+
+    IPVS_DEST_ATTR_TUN_TYPE    /* tunnel type, linux 5.2 */
+    IPVS_DEST_ATTR_TUN_PORT    /* tunnel port, linux 5.2 */
+    IPVS_DEST_ATTR_TUN_FLAGS   /* tunnel flags, linux 5.3 */
 )
 
 const (
@@ -144,6 +170,7 @@ const (
     IPVS_STATS_ATTR_OUTPPS     /* current out packet rate */
     IPVS_STATS_ATTR_INBPS      /* current in byte rate */
     IPVS_STATS_ATTR_OUTBPS     /* current out byte rate */
+    IPVS_STATS_ATTR_PAD        /* padding for the 64-bit stats, linux 4.7 */
 )
 
 const (
@@ -180,6 +207,24 @@ var ipvs_stats_policy = nlgo.MapPolicy{
     },
 }
 
+// The IPVS_*_ATTR_STATS64 use the same attributes, with 64-bit counters and rates
+var ipvs_stats64_policy = nlgo.MapPolicy{
+    Prefix: "IPVS_STATS_ATTR",
+    Names:  ipvs_stats_policy.Names,
+    Rule: map[uint16]nlgo.Policy{
+        IPVS_STATS_ATTR_CONNS:          nlgo.U64Policy,
+        IPVS_STATS_ATTR_INPKTS:         nlgo.U64Policy,
+        IPVS_STATS_ATTR_OUTPKTS:        nlgo.U64Policy,
+        IPVS_STATS_ATTR_INBYTES:        nlgo.U64Policy,
+        IPVS_STATS_ATTR_OUTBYTES:       nlgo.U64Policy,
+        IPVS_STATS_ATTR_CPS:            nlgo.U64Policy,
+        IPVS_STATS_ATTR_INPPS:          nlgo.U64Policy,
+        IPVS_STATS_ATTR_OUTPPS:         nlgo.U64Policy,
+        IPVS_STATS_ATTR_INBPS:          nlgo.U64Policy,
+        IPVS_STATS_ATTR_OUTBPS:         nlgo.U64Policy,
+    },
+}
+
 var ipvs_service_policy = nlgo.MapPolicy{
     Prefix: "IPVS_SVC_ATTR",
     Names: map[uint16]string{
@@ -194,6 +239,7 @@ var ipvs_service_policy = nlgo.MapPolicy{
         IPVS_SVC_ATTR_NETMASK: "NETMASK",
         IPVS_SVC_ATTR_STATS: "STATS",
         IPVS_SVC_ATTR_PE_NAME: "PE_NAME",
+        IPVS_SVC_ATTR_STATS64: "STATS64",
     },
     Rule: map[uint16]nlgo.Policy{
         IPVS_SVC_ATTR_AF:               nlgo.U16Policy,
@@ -206,6 +252,7 @@ var ipvs_service_policy = nlgo.MapPolicy{
         IPVS_SVC_ATTR_TIMEOUT:          nlgo.U32Policy,
         IPVS_SVC_ATTR_NETMASK:          nlgo.U32Policy,
         IPVS_SVC_ATTR_STATS:            ipvs_stats_policy,
+        IPVS_SVC_ATTR_STATS64:          ipvs_stats64_policy,
     },
 }
 
@@ -222,6 +269,11 @@ var ipvs_dest_policy = nlgo.MapPolicy{
         IPVS_DEST_ATTR_INACT_CONNS: "INACT_CONNS",
         IPVS_DEST_ATTR_PERSIST_CONNS: "PERSIST_CONNS",
         IPVS_DEST_ATTR_STATS: "STATS",
+        IPVS_DEST_ATTR_ADDR_FAMILY: "ADDR_FAMILY",
+        IPVS_DEST_ATTR_STATS64: "STATS64",
+        IPVS_DEST_ATTR_TUN_TYPE: "TUN_TYPE",
+        IPVS_DEST_ATTR_TUN_PORT: "TUN_PORT",
+        IPVS_DEST_ATTR_TUN_FLAGS: "TUN_FLAGS",
     },
     Rule: map[uint16]nlgo.Policy{
         IPVS_DEST_ATTR_ADDR:            nlgo.BinaryPolicy,        // struct in6_addr
@@ -234,6 +286,11 @@ var ipvs_dest_policy = nlgo.MapPolicy{
         IPVS_DEST_ATTR_INACT_CONNS:     nlgo.U32Policy,
         IPVS_DEST_ATTR_PERSIST_CONNS:   nlgo.U32Policy,
         IPVS_DEST_ATTR_STATS:           ipvs_stats_policy,
+        IPVS_DEST_ATTR_ADDR_FAMILY:     nlgo.U16Policy,
+        IPVS_DEST_ATTR_STATS64:         ipvs_stats64_policy,
+        IPVS_DEST_ATTR_TUN_TYPE:        nlgo.U8Policy,
+        IPVS_DEST_ATTR_TUN_PORT:        nlgo.U16Policy,
+        IPVS_DEST_ATTR_TUN_FLAGS:       nlgo.U16Policy,
     },
 }
 
@@ -246,7 +303,7 @@ var ipvs_daemon_policy = nlgo.MapPolicy{
     },
     Rule: map[uint16]nlgo.Policy{
         IPVS_DAEMON_ATTR_STATE:         nlgo.U32Policy,
-        IPVS_DAEMON_ATTR_MCAST_IFN:     nlgo.StringPolicy,  // maxlen = IP_VS_IFNAME_MAXLEN
+        IPVS_DAEMON_ATTR_MCAST_IFN:     nlgo.NulStringPolicy,  // maxlen = IP_VS_IFNAME_MAXLEN
         IPVS_DAEMON_ATTR_SYNC_ID:       nlgo.U32Policy,
     },
 }
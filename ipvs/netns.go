@@ -0,0 +1,88 @@
+package ipvs
+/*
+ * Network namespaces, for managing the IPVS table of a container or a dedicated routing netns.
+ *
+ * The netlink socket is bound to the network namespace of the thread that opens it, so the client switches a locked OS thread into the
+ * namespace using setns(2) while opening the socket, and then switches it back. Any later requests use the namespaced socket from
+ * any thread.
+ */
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "os"
+    "runtime"
+    "syscall"
+)
+
+// The network namespace of the current thread
+const NETNS_THREAD_PATH = "/proc/thread-self/ns/net"
+
+// The connection table of the network namespace of the current thread
+const IPVS_CONN_THREAD_PATH = "/proc/thread-self/net/ip_vs_conn"
+
+// The setns(2) syscall numbers, which are missing from the syscall package on most architectures
+var sysSetns = map[string]uintptr{
+    "386":      346,
+    "amd64":    308,
+    "arm":      375,
+    "arm64":    268,
+}
+
+func setns(file *os.File) error {
+    if trap, exists := sysSetns[runtime.GOARCH]; !exists {
+        return syscall.ENOSYS
+    } else if _, _, errno := syscall.RawSyscall(trap, file.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+        return errno
+    }
+
+    return nil
+}
+
+// Call the given function from an OS thread in the network namespace at the given path, e.g. /var/run/netns/$name or /proc/$pid/ns/net
+func inNamespace(nsPath string, f func() error) error {
+    nsFile, err := os.Open(nsPath)
+    if err != nil {
+        return errs.ConfigError(err)
+    }
+    defer nsFile.Close()
+
+    runtime.LockOSThread()
+
+    threadFile, err := os.Open(NETNS_THREAD_PATH)
+    if err != nil {
+        runtime.UnlockOSThread()
+
+        return errs.KernelError(err)
+    }
+    defer threadFile.Close()
+
+    if err := setns(nsFile); err != nil {
+        runtime.UnlockOSThread()
+
+        return errs.KernelError(fmt.Errorf("setns %s: %v", nsPath, err))
+    }
+
+    err = f()
+
+    if restoreErr := setns(threadFile); restoreErr != nil {
+        // leave the thread locked, for the runtime to terminate it once this goroutine exits
+        return errs.KernelError(fmt.Errorf("setns %s: %v", NETNS_THREAD_PATH, restoreErr))
+    }
+
+    runtime.UnlockOSThread()
+
+    return err
+}
+
+// Open a client for the IPVS table of the network namespace at the given path, e.g. /var/run/netns/$name or /proc/$pid/ns/net
+func OpenInNamespace(nsPath string) (*Client, error) {
+    client := makeClient()
+    client.nsPath = nsPath
+
+    if err := inNamespace(nsPath, client.init); err != nil {
+        return nil, err
+    }
+
+    return client, nil
+}
@@ -0,0 +1,38 @@
+package ipvs
+
+import (
+    "errors"
+    "github.com/qmsk/clusterf/errs"
+    "os"
+    "syscall"
+    "testing"
+)
+
+func TestInNamespace(t *testing.T) {
+    if err := inNamespace("/nonexistent/netns", func() error { return nil }); err == nil || errs.Classify(err) != errs.Config {
+        t.Errorf("inNamespace nonexistent: %v", err)
+    }
+
+    before, err := os.Readlink(NETNS_THREAD_PATH)
+    if err != nil {
+        t.Skipf("%s: %v", NETNS_THREAD_PATH, err)
+    }
+
+    var inside string
+
+    if err := inNamespace("/proc/self/ns/net", func() (err error) {
+        inside, err = os.Readlink(NETNS_THREAD_PATH)
+
+        return
+    }); errors.Is(err, syscall.EPERM) {
+        t.Skipf("inNamespace: %v", err)
+    } else if err != nil {
+        t.Fatalf("inNamespace: %v", err)
+    } else if inside != before {
+        t.Errorf("inNamespace: %s != %s", inside, before)
+    }
+
+    if after, err := os.Readlink(NETNS_THREAD_PATH); err != nil || after != before {
+        t.Errorf("inNamespace restore: %s != %s: %v", after, before, err)
+    }
+}
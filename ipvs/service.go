@@ -1,17 +1,15 @@
 package ipvs
 
 import (
+    "github.com/qmsk/clusterf/errs"
     "fmt"
     "net"
     "github.com/hkwi/nlgo"
+    "strconv"
+    "strings"
     "syscall"
 )
 
-type Flags struct {
-    Flags   uint32
-    Mask    uint32
-}
-
 type Af uint16
 
 func (self Af) String() string {
@@ -25,6 +23,22 @@ func (self Af) String() string {
     }
 }
 
+// Parse the String() of an Af, or a numeric value
+func ParseAf(value string) (Af, error) {
+    switch value {
+    case "inet":
+        return syscall.AF_INET, nil
+    case "inet6":
+        return syscall.AF_INET6, nil
+    }
+
+    if af, err := strconv.ParseUint(value, 10, 16); err != nil {
+        return 0, errs.ConfigError(fmt.Errorf("Invalid Af: %s", value))
+    } else {
+        return Af(af), nil
+    }
+}
+
 type Protocol uint16
 
 func (self Protocol) String() string {
@@ -40,6 +54,24 @@ func (self Protocol) String() string {
     }
 }
 
+// Parse the String() of a Protocol, or a numeric value
+func ParseProtocol(value string) (Protocol, error) {
+    switch value {
+    case "tcp":
+        return syscall.IPPROTO_TCP, nil
+    case "udp":
+        return syscall.IPPROTO_UDP, nil
+    case "sctp":
+        return syscall.IPPROTO_SCTP, nil
+    }
+
+    if protocol, err := strconv.ParseUint(value, 10, 16); err != nil {
+        return 0, errs.ConfigError(fmt.Errorf("Invalid Protocol: %s", value))
+    } else {
+        return Protocol(protocol), nil
+    }
+}
+
 type Service struct {
     // id
     Af          Af
@@ -51,8 +83,11 @@ type Service struct {
     // params
     SchedName   string
     Flags       Flags
-    Timeout     uint32
-    Netmask     uint32
+    Timeout     uint32  // persistence timeout in seconds, only used by the kernel for IP_VS_SVC_F_PERSISTENT services
+    Netmask     uint32  // persistence granularity, as a netmask like 0xffffff00 for AF_INET, or a prefix length for AF_INET6
+
+    // info
+    Stats       Stats
 }
 
 // Acts as an unique identifier for the Service
@@ -64,34 +99,130 @@ func (self Service) String() string {
     }
 }
 
+// Split the addr:port, using the last : for any IPv6 addr
+func parseAddrPort(value string) (net.IP, uint16, error) {
+    i := strings.LastIndex(value, ":")
+
+    if i < 0 {
+        return nil, 0, fmt.Errorf("missing port")
+    }
+
+    host := strings.TrimSuffix(strings.TrimPrefix(value[:i], "["), "]")
+
+    if ip := net.ParseIP(host); ip == nil {
+        return nil, 0, fmt.Errorf("invalid addr %s", host)
+    } else if port, err := strconv.ParseUint(value[i+1:], 10, 16); err != nil {
+        return nil, 0, fmt.Errorf("invalid port %s", value[i+1:])
+    } else {
+        return ip, uint16(port), nil
+    }
+}
+
+// Parse the identifying fields of a Service from its String(), e.g. inet+tcp://10.0.1.1:80 or inet6+fwmark://1
+func ParseService(value string) (Service, error) {
+    var service Service
+
+    scheme, addr, found := strings.Cut(value, "://")
+    if !found {
+        return service, errs.ConfigError(fmt.Errorf("Invalid Service %s: missing ://", value))
+    }
+
+    afName, protocolName, found := strings.Cut(scheme, "+")
+    if !found {
+        return service, errs.ConfigError(fmt.Errorf("Invalid Service %s: missing af+protocol", value))
+    }
+
+    if af, err := ParseAf(afName); err != nil {
+        return service, err
+    } else {
+        service.Af = af
+    }
+
+    if protocolName == "fwmark" {
+        if fwMark, err := strconv.ParseUint(addr, 10, 32); err != nil || fwMark == 0 {
+            return service, errs.ConfigError(fmt.Errorf("Invalid Service %s: invalid fwmark %s", value, addr))
+        } else {
+            service.FwMark = uint32(fwMark)
+        }
+
+        return service, nil
+    }
+
+    if protocol, err := ParseProtocol(protocolName); err != nil {
+        return service, err
+    } else {
+        service.Protocol = protocol
+    }
+
+    if ip, port, err := parseAddrPort(addr); err != nil {
+        return service, errs.ConfigError(fmt.Errorf("Invalid Service %s: %v", value, err))
+    } else if (ip.To4() != nil) != (service.Af == syscall.AF_INET) {
+        return service, errs.ConfigError(fmt.Errorf("Invalid Service %s: addr %s is not %v", value, ip, service.Af))
+    } else {
+        service.Addr = ip
+        service.Port = port
+    }
+
+    return service, nil
+}
+
 func unpackService(attrs nlgo.AttrMap) (Service, error) {
     var service Service
 
     var addr nlgo.Binary
     var flags nlgo.Binary
+    var netmask nlgo.U32
+    var stats64 bool
+    var hasProtocol, hasPort bool
 
     for _, attr := range attrs.Slice() {
         switch attr.Field() {
         case IPVS_SVC_ATTR_AF:          service.Af = (Af)(attr.Value.(nlgo.U16))
-        case IPVS_SVC_ATTR_PROTOCOL:    service.Protocol = (Protocol)(attr.Value.(nlgo.U16))
+        case IPVS_SVC_ATTR_PROTOCOL:
+            service.Protocol = (Protocol)(attr.Value.(nlgo.U16))
+            hasProtocol = true
         case IPVS_SVC_ATTR_ADDR:        addr = attr.Value.(nlgo.Binary)
-        case IPVS_SVC_ATTR_PORT:        service.Port = unpackPort(attr.Value.(nlgo.U16))
+        case IPVS_SVC_ATTR_PORT:
+            service.Port = unpackPort(attr.Value.(nlgo.U16))
+            hasPort = true
         case IPVS_SVC_ATTR_FWMARK:      service.FwMark = (uint32)(attr.Value.(nlgo.U32))
         case IPVS_SVC_ATTR_SCHED_NAME:  service.SchedName = (string)(attr.Value.(nlgo.NulString))
         case IPVS_SVC_ATTR_FLAGS:       flags = attr.Value.(nlgo.Binary)
         case IPVS_SVC_ATTR_TIMEOUT:     service.Timeout = (uint32)(attr.Value.(nlgo.U32))
-        case IPVS_SVC_ATTR_NETMASK:     service.Netmask = (uint32)(attr.Value.(nlgo.U32))
+        case IPVS_SVC_ATTR_NETMASK:     netmask = attr.Value.(nlgo.U32)
+        case IPVS_SVC_ATTR_STATS:
+            if stats, err := unpackStats(attr.Value.(nlgo.AttrMap)); err != nil {
+                return service, fmt.Errorf("ipvs:Service.unpack: stats: %s", err)
+            } else if !stats64 {
+                service.Stats = stats
+            }
+        case IPVS_SVC_ATTR_STATS64:
+            if stats, err := unpackStats(attr.Value.(nlgo.AttrMap)); err != nil {
+                return service, fmt.Errorf("ipvs:Service.unpack: stats64: %s", err)
+            } else {
+                service.Stats = stats
+                stats64 = true
+            }
         }
     }
 
-    if addrIP, err := unpackAddr(addr, service.Af); err != nil {
+    // fwmark services are dumped without any addr, protocol or port
+    if service.FwMark != 0 {
+
+    } else if !hasProtocol || !hasPort {
+        return service, fmt.Errorf("ipvs:Service.unpack: missing protocol or port")
+    } else if addrIP, err := unpackAddr(addr, service.Af); err != nil {
         return service, fmt.Errorf("ipvs:Service.unpack: addr: %s", err)
     } else {
         service.Addr = addrIP
     }
 
-    if err := unpack(flags, &service.Flags); err != nil {
+    service.Netmask = unpackNetmask(netmask, service.Af)
+
+    if unpackedFlags, err := unpackFlags(flags); err != nil {
         return service, fmt.Errorf("ipvs:Service.unpack: flags: %s", err)
+    } else {
+        service.Flags = unpackedFlags
     }
 
     return service, nil
@@ -121,9 +252,9 @@ func (self *Service) attrs(full bool) nlgo.AttrSlice {
     if full {
         attrs = append(attrs,
             nlattr(IPVS_SVC_ATTR_SCHED_NAME,    nlgo.NulString(self.SchedName)),
-            nlattr(IPVS_SVC_ATTR_FLAGS,         pack(&self.Flags)),
+            nlattr(IPVS_SVC_ATTR_FLAGS,         self.Flags.pack()),
             nlattr(IPVS_SVC_ATTR_TIMEOUT,       nlgo.U32(self.Timeout)),
-            nlattr(IPVS_SVC_ATTR_NETMASK,       nlgo.U32(self.Netmask)),
+            nlattr(IPVS_SVC_ATTR_NETMASK,       packNetmask(self.Af, self.Netmask)),
         )
     }
 
@@ -0,0 +1,74 @@
+package ipvs
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "net"
+    "syscall"
+    "testing"
+)
+
+func TestParseService (t *testing.T) {
+    for _, testService := range []Service{
+        Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("10.0.1.1").To4(), Port: 80},
+        Service{Af: syscall.AF_INET6, Protocol: syscall.IPPROTO_UDP, Addr: net.ParseIP("2001:db8::1"), Port: 53},
+        Service{Af: syscall.AF_INET6, Protocol: syscall.IPPROTO_SCTP, Addr: net.ParseIP("::"), Port: 9},
+        Service{Af: syscall.AF_INET, FwMark: 3472883712},
+    } {
+        value := testService.String()
+
+        if service, err := ParseService(value); err != nil {
+            t.Errorf("ParseService %s: %v", value, err)
+        } else if service.String() != value {
+            t.Errorf("ParseService %s: %s", value, service)
+        } else if service.Af != testService.Af || service.Protocol != testService.Protocol || !service.Addr.Equal(testService.Addr) || service.Port != testService.Port || service.FwMark != testService.FwMark {
+            t.Errorf("ParseService %s: %#v", value, service)
+        }
+    }
+
+    for _, value := range []string{
+        "",
+        "10.0.1.1:80",
+        "tcp://10.0.1.1:80",
+        "inet+tcp://10.0.1.1",
+        "inet+tcp://10.0.1.1:http",
+        "inet+tcp://10.0.1.1:65536",
+        "inet+tcp://2001:db8::1:80",
+        "inet6+tcp://10.0.1.1:80",
+        "inet+foo://10.0.1.1:80",
+        "inet+fwmark://0",
+    } {
+        if service, err := ParseService(value); err == nil {
+            t.Errorf("ParseService %#v: expected error, got %v", value, service)
+        } else if errs.Classify(err) != errs.Config {
+            t.Errorf("ParseService %#v: unexpected error: %v", value, err)
+        }
+    }
+}
+
+func TestParseDest (t *testing.T) {
+    for _, testDest := range []Dest{
+        Dest{Addr: net.ParseIP("10.1.0.1").To4(), Port: 8080},
+        Dest{Addr: net.ParseIP("2001:db8::1"), Port: 8080},
+        Dest{Addr: net.ParseIP("10.1.0.1").To4(), Port: 0},
+    } {
+        value := testDest.String()
+
+        if dest, err := ParseDest(value); err != nil {
+            t.Errorf("ParseDest %s: %v", value, err)
+        } else if dest.String() != value || !dest.Addr.Equal(testDest.Addr) || dest.Port != testDest.Port {
+            t.Errorf("ParseDest %s: %#v", value, dest)
+        }
+    }
+
+    if dest, err := ParseDest("[2001:db8::1]:8080"); err != nil {
+        t.Errorf("ParseDest [2001:db8::1]:8080: %v", err)
+    } else if dest.String() != "2001:db8::1:8080" {
+        t.Errorf("ParseDest [2001:db8::1]:8080: %v", dest)
+    }
+
+    for _, value := range []string{"", "10.1.0.1", "foo:80", "10.1.0.1:-1"} {
+        if dest, err := ParseDest(value); err == nil {
+            t.Errorf("ParseDest %#v: expected error, got %v", value, dest)
+        }
+    }
+}
@@ -0,0 +1,56 @@
+package ipvs
+
+import (
+    "github.com/hkwi/nlgo"
+)
+
+// Service/Dest statistics
+//
+// The counters are totals since the Service/Dest was created, and the rates are estimated by the kernel.
+//
+// Uses the 64-bit IPVS_*_ATTR_STATS64 if the kernel provides them, falling back to the IPVS_*_ATTR_STATS with 32-bit counters, which
+// wrap quickly on busy services.
+type Stats struct {
+    Conns       uint64
+    InPkts      uint64
+    OutPkts     uint64
+    InBytes     uint64
+    OutBytes    uint64
+
+    CPS         uint64
+    InPPS       uint64
+    OutPPS      uint64
+    InBPS       uint64
+    OutBPS      uint64
+}
+
+func unpackStatsValue(value interface{}) uint64 {
+    switch value := value.(type) {
+    case nlgo.U32:
+        return (uint64)(value)
+    case nlgo.U64:
+        return (uint64)(value)
+    default:
+        return 0
+    }
+}
+
+// Unpack either the IPVS_*_ATTR_STATS or IPVS_*_ATTR_STATS64
+func unpackStats(attrs nlgo.AttrMap) (stats Stats, err error) {
+    for _, attr := range attrs.Slice() {
+        switch attr.Field() {
+        case IPVS_STATS_ATTR_CONNS:     stats.Conns = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_INPKTS:    stats.InPkts = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_OUTPKTS:   stats.OutPkts = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_INBYTES:   stats.InBytes = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_OUTBYTES:  stats.OutBytes = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_CPS:       stats.CPS = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_INPPS:     stats.InPPS = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_OUTPPS:    stats.OutPPS = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_INBPS:     stats.InBPS = unpackStatsValue(attr.Value)
+        case IPVS_STATS_ATTR_OUTBPS:    stats.OutBPS = unpackStatsValue(attr.Value)
+        }
+    }
+
+    return
+}
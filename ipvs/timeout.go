@@ -0,0 +1,83 @@
+package ipvs
+
+import (
+    "context"
+    "fmt"
+    "github.com/hkwi/nlgo"
+)
+
+// Kernel connection timeouts in seconds, shared by all services, like `ipvsadm --set tcp tcpfin udp`.
+//
+// Any zero values are left unchanged by SetTimeout.
+type Timeout struct {
+    TCP         uint32
+    TCPFin      uint32
+    UDP         uint32
+}
+
+func (self Timeout) String() string {
+    return fmt.Sprintf("tcp=%ds tcpfin=%ds udp=%ds", self.TCP, self.TCPFin, self.UDP)
+}
+
+func unpackTimeout(attrs nlgo.AttrMap) (timeout Timeout, err error) {
+    for _, attr := range attrs.Slice() {
+        switch attr.Field() {
+        case IPVS_CMD_ATTR_TIMEOUT_TCP:     timeout.TCP = (uint32)(attr.Value.(nlgo.U32))
+        case IPVS_CMD_ATTR_TIMEOUT_TCP_FIN: timeout.TCPFin = (uint32)(attr.Value.(nlgo.U32))
+        case IPVS_CMD_ATTR_TIMEOUT_UDP:     timeout.UDP = (uint32)(attr.Value.(nlgo.U32))
+        }
+    }
+
+    return
+}
+
+func (self Timeout) attrs() nlgo.AttrSlice {
+    var attrs nlgo.AttrSlice
+
+    if self.TCP != 0 {
+        attrs = append(attrs, nlattr(IPVS_CMD_ATTR_TIMEOUT_TCP, nlgo.U32(self.TCP)))
+    }
+    if self.TCPFin != 0 {
+        attrs = append(attrs, nlattr(IPVS_CMD_ATTR_TIMEOUT_TCP_FIN, nlgo.U32(self.TCPFin)))
+    }
+    if self.UDP != 0 {
+        attrs = append(attrs, nlattr(IPVS_CMD_ATTR_TIMEOUT_UDP, nlgo.U32(self.UDP)))
+    }
+
+    return attrs
+}
+
+// Return the kernel connection timeouts, using IPVS_CMD_GET_CONFIG
+func (client *Client) GetTimeout() (timeout Timeout, err error) {
+    return client.GetTimeoutContext(context.Background())
+}
+
+func (client *Client) GetTimeoutContext(ctx context.Context) (timeout Timeout, err error) {
+    request := Request{
+        Cmd:    IPVS_CMD_GET_CONFIG,
+    }
+
+    err = client.request(ctx, request, ipvs_cmd_policy, func (cmdAttrs nlgo.AttrMap) error {
+        if cmdTimeout, err := unpackTimeout(cmdAttrs); err != nil {
+            return err
+        } else {
+            timeout = cmdTimeout
+        }
+
+        return nil
+    })
+
+    return
+}
+
+// Set any non-zero kernel connection timeouts, using IPVS_CMD_SET_CONFIG
+func (client *Client) SetTimeout(timeout Timeout) error {
+    return client.SetTimeoutContext(context.Background(), timeout)
+}
+
+func (client *Client) SetTimeoutContext(ctx context.Context, timeout Timeout) error {
+    return client.exec(ctx, Request{
+        Cmd:        IPVS_CMD_SET_CONFIG,
+        Attrs:      timeout.attrs(),
+    })
+}
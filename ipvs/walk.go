@@ -0,0 +1,105 @@
+package ipvs
+/*
+ * Streaming iteration over the kernel IPVS tables, for consumers with large tables that do not want to build the full slices.
+ *
+ * The netlink dump is still received by the nlgo transport as a whole, but each Service or Dest is only unpacked once it is passed to
+ * the callback, and any further messages are skipped once the callback returns an error or the context is done.
+ */
+
+import (
+    "context"
+    "errors"
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "github.com/hkwi/nlgo"
+    "syscall"
+)
+
+// Returned by the walk callbacks to stop the walk early without any error
+var SkipAll = errors.New("ipvs: skip all")
+
+// Stop the walk on the first callback or context error, returning the callback error as-is rather than classifying it
+type walker struct {
+    ctx     context.Context
+    err     error
+}
+
+func (self *walker) walk(call func() error) error {
+    if err := self.ctx.Err(); err != nil {
+        self.err = err
+    } else if err := call(); err != nil {
+        self.err = err
+    }
+
+    return self.err
+}
+
+func (self *walker) result(err error) error {
+    if self.err == SkipAll {
+        return nil
+    } else if self.err != nil {
+        return self.err
+    } else {
+        return err
+    }
+}
+
+// Call the given function for each kernel IPVS service, until it returns an error, or the context is done.
+//
+// Returns SkipAll from the callback to stop the walk without any error.
+func (client *Client) WalkServices(ctx context.Context, walkFunc func(service Service) error) error {
+    return client.walkServices(ctx, nil, walkFunc)
+}
+
+// Walk the services, skipping any services not matching the filter before unpacking them
+func (client *Client) walkServices(ctx context.Context, filter func(serviceAttrs nlgo.AttrMap) bool, walkFunc func(service Service) error) error {
+    var walker = walker{ctx: ctx}
+
+    request := Request{
+        Cmd:    IPVS_CMD_GET_SERVICE,
+        Flags:  syscall.NLM_F_DUMP,
+    }
+
+    err := client.request(ctx, request, ipvs_cmd_policy, func (cmdAttrs nlgo.AttrMap) error {
+        return walker.walk(func() error {
+            if serviceAttrs := cmdAttrs.Get(IPVS_CMD_ATTR_SERVICE); serviceAttrs == nil {
+                return errs.InternalError(fmt.Errorf("IPVS_CMD_GET_SERVICE without IPVS_CMD_ATTR_SERVICE"))
+            } else if filter != nil && !filter(serviceAttrs.(nlgo.AttrMap)) {
+                return nil
+            } else if service, err := unpackService(serviceAttrs.(nlgo.AttrMap)); err != nil {
+                return errs.InternalError(err)
+            } else {
+                return walkFunc(service)
+            }
+        })
+    })
+
+    return walker.result(err)
+}
+
+// Call the given function for each dest of the kernel IPVS service, until it returns an error, or the context is done.
+//
+// Returns SkipAll from the callback to stop the walk without any error.
+func (client *Client) WalkDests(ctx context.Context, service Service, walkFunc func(dest Dest) error) error {
+    var walker = walker{ctx: ctx}
+
+    request := Request{
+        Cmd:    IPVS_CMD_GET_DEST,
+        Flags:  syscall.NLM_F_DUMP,
+        Attrs:  command{service: &service}.attrs(),
+    }
+
+    err := client.request(ctx, request, ipvs_cmd_policy, func (cmdAttrs nlgo.AttrMap) error {
+        return walker.walk(func() error {
+            if destAttrs := cmdAttrs.Get(IPVS_CMD_ATTR_DEST); destAttrs == nil {
+                return errs.InternalError(fmt.Errorf("IPVS_CMD_GET_DEST without IPVS_CMD_ATTR_DEST"))
+            } else if dest, err := unpackDest(service, destAttrs.(nlgo.AttrMap)); err != nil {
+                return errs.InternalError(err)
+            } else {
+                return walkFunc(dest)
+            }
+        })
+    })
+
+    return walker.result(err)
+}
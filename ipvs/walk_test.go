@@ -0,0 +1,49 @@
+package ipvs
+
+import (
+    "context"
+    "errors"
+    "testing"
+)
+
+// Walk over the given items, as the netlink request would for each message
+func testWalk(ctx context.Context, items []int, walkFunc func(int) error) (count int, err error) {
+    var walker = walker{ctx: ctx}
+
+    for _, item := range items {
+        if err = walker.walk(func() error { count++; return walkFunc(item) }); err != nil {
+            break
+        }
+    }
+
+    return count, walker.result(nil)
+}
+
+func TestWalk(t *testing.T) {
+    var items = []int{1, 2, 3}
+    var testError = errors.New("test")
+
+    if count, err := testWalk(context.Background(), items, func(int) error { return nil }); err != nil || count != 3 {
+        t.Errorf("walk all: count=%d err=%v", count, err)
+    }
+
+    if count, err := testWalk(context.Background(), items, func(item int) error {
+        if item == 2 {
+            return SkipAll
+        }
+        return nil
+    }); err != nil || count != 2 {
+        t.Errorf("walk SkipAll: count=%d err=%v", count, err)
+    }
+
+    if count, err := testWalk(context.Background(), items, func(int) error { return testError }); err != testError || count != 1 {
+        t.Errorf("walk error: count=%d err=%v", count, err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    if count, err := testWalk(ctx, items, func(int) error { return nil }); err != context.Canceled || count != 0 {
+        t.Errorf("walk cancel: count=%d err=%v", count, err)
+    }
+}
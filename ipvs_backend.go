@@ -2,6 +2,7 @@ package clusterf
 
 import (
     "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/errs"
     "fmt"
     "github.com/qmsk/clusterf/ipvs"
     "log"
@@ -14,72 +15,188 @@ const IPVS_WEIGHT uint32 = 10
 type ipvsBackend struct {
     driver      *IPVSDriver
     frontend    *ipvsFrontend
+    name        string
     state       map[ipvsType]*ipvs.Dest
     weight      uint32
+
+    // weight of each active dest in the state, which may differ from the current weight after a failed set
+    stateWeight map[ipvsType]uint32
+
+    // configured weight, and lower-priority standby or drained backends use zero weight
+    configWeight    uint
+    drain           bool
+    standby         bool
 }
 
-func makeBackend(frontend *ipvsFrontend) *ipvsBackend {
+func makeBackend(frontend *ipvsFrontend, name string) *ipvsBackend {
     return &ipvsBackend{
         driver:     frontend.driver,
         frontend:   frontend,
+        name:       name,
         state:      make(map[ipvsType]*ipvs.Dest),
+        stateWeight: make(map[ipvsType]uint32),
     }
 }
 
-func (self *ipvsBackend) buildDest (ipvsService *ipvs.Service, backend config.ServiceBackend) (*ipvs.Dest, error) {
-    ipvsDest := &ipvs.Dest{
-        FwdMethod:  self.driver.fwdMethod,
-    }
+// Service/backend name
+func (self *ipvsBackend) String() string {
+    return self.frontend.name + "/" + self.name
+}
 
-    switch ipvsService.Af {
+// The backend address for the given af, or nil if not configured
+func backendAddr (af ipvs.Af, backend config.ServiceBackend) (net.IP, error) {
+    switch af {
     case syscall.AF_INET:
         if backend.IPv4 == "" {
             return nil, nil
         } else if ip := net.ParseIP(backend.IPv4); ip == nil {
-            return nil, fmt.Errorf("Invalid IPv4: %v", backend.IPv4)
+            return nil, errs.ConfigError(fmt.Errorf("Invalid IPv4: %v", backend.IPv4))
         } else if ip4 := ip.To4(); ip4 == nil {
-            return nil, fmt.Errorf("Invalid IPv4: %v", ip)
+            return nil, errs.ConfigError(fmt.Errorf("Invalid IPv4: %v", ip))
         } else {
-            ipvsDest.Addr = ip4
+            return ip4, nil
         }
     case syscall.AF_INET6:
         if backend.IPv6 == "" {
             return nil, nil
         } else if ip := net.ParseIP(backend.IPv6); ip == nil {
-            return nil, fmt.Errorf("Invalid IPv6: %v", backend.IPv6)
+            return nil, errs.ConfigError(fmt.Errorf("Invalid IPv6: %v", backend.IPv6))
         } else if ip16 := ip.To16(); ip16 == nil {
-            return nil, fmt.Errorf("Invalid IPv6: %v", ip)
+            return nil, errs.ConfigError(fmt.Errorf("Invalid IPv6: %v", ip))
         } else {
-            ipvsDest.Addr = ip16
+            return ip16, nil
         }
     default:
         panic("invalid af")
     }
+}
+
+// The other address family, for mixed af dests
+func mixedAf (af ipvs.Af) ipvs.Af {
+    switch af {
+    case syscall.AF_INET:
+        return syscall.AF_INET6
+    case syscall.AF_INET6:
+        return syscall.AF_INET
+    default:
+        panic("invalid af")
+    }
+}
+
+func (self *ipvsBackend) buildDest (ipvsService *ipvs.Service, backend config.ServiceBackend) (*ipvs.Dest, error) {
+    ipvsDest := &ipvs.Dest{
+        FwdMethod:  self.driver.fwdMethod,
+    }
+
+    if addr, err := backendAddr(ipvsService.Af, backend); err != nil {
+        return nil, err
+    } else if addr != nil {
+        ipvsDest.Addr = addr
+    } else if addr, err := backendAddr(mixedAf(ipvsService.Af), backend); err != nil {
+        return nil, err
+    } else if addr != nil {
+        // only a backend address of the other af, checked by checkMixedAf once the FwdMethod is known
+        ipvsDest.Addr = addr
+        ipvsDest.Af = mixedAf(ipvsService.Af)
+    } else {
+        return nil, nil
+    }
+
+    var protocol config.Protocols
 
     switch ipvsService.Protocol {
     case syscall.IPPROTO_TCP:
-        if backend.TCP == 0 {
-            return nil, nil
-        } else {
-            ipvsDest.Port = backend.TCP
-        }
+        protocol = config.ProtocolTCP
+        ipvsDest.Port = backend.TCP
     case syscall.IPPROTO_UDP:
-        if backend.UDP == 0 {
-            return nil, nil
-        } else {
-            ipvsDest.Port = backend.UDP
-        }
+        protocol = config.ProtocolUDP
+        ipvsDest.Port = backend.UDP
+    case syscall.IPPROTO_SCTP:
+        protocol = config.ProtocolSCTP
+        ipvsDest.Port = backend.SCTP
     default:
         panic("invalid proto")
     }
 
+    if ipvsService.FwMark != 0 {
+        // fwmark services match packets of any protocol, and dests without a port use the port of each packet
+        if backend.Port != 0 {
+            ipvsDest.Port = backend.Port
+        } else {
+            ipvsDest.Port = self.frontend.config.BackendPort
+        }
+    } else if backend.Protocols != 0 && backend.Protocols & protocol == 0 {
+        // backend is limited to other protocols
+        return nil, nil
+    } else if ipvsDest.Port != 0 {
+        // configured by backend
+    } else if backend.TCP != 0 || backend.UDP != 0 || backend.SCTP != 0 {
+        // backend is not configured for this protocol
+        return nil, nil
+    } else if backendPort := self.frontend.backendPort(ipvsService.Protocol); backendPort == 0 {
+        return nil, nil
+    } else {
+        ipvsDest.Port = backendPort
+    }
+
     if backend.Weight == 0 {
 
     } else {
         ipvsDest.Weight = uint32(backend.Weight)
     }
 
-    return self.applyRoute(ipvsService, ipvsDest)
+    ipvsDest.UThresh = uint32(backend.UThresh)
+    ipvsDest.LThresh = uint32(backend.LThresh)
+
+    if ipvsDest, err := self.applyRoute(ipvsService, ipvsDest); err != nil || ipvsDest == nil {
+        return ipvsDest, err
+    } else if err := checkFwdPort(ipvsService, ipvsDest); err != nil {
+        return nil, errs.ConfigError(fmt.Errorf("backend %v: %v", self, err))
+    } else if ipvsDest.Af != 0 && !self.checkMixedAf(ipvsService, ipvsDest) {
+        return nil, nil
+    } else {
+        self.applyTunnel(ipvsDest)
+
+        return ipvsDest, nil
+    }
+}
+
+// Only the masq forwarding method can translate the frontend port to a different backend port.
+// The droute and tunnel methods forward the packets unchanged, and any such dest would silently drop the connections.
+func checkFwdPort(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) error {
+    switch ipvsDest.FwdMethod & ipvs.IP_VS_CONN_F_FWD_MASK {
+    case ipvs.IP_VS_CONN_F_DROUTE, ipvs.IP_VS_CONN_F_TUNNEL:
+        if ipvsDest.Port != ipvsService.Port {
+            return fmt.Errorf("%v forwarding cannot translate the frontend port %d to the backend port %d, use masq forwarding or the same port", ipvsDest.FwdMethod, ipvsService.Port, ipvsDest.Port)
+        }
+    }
+
+    return nil
+}
+
+// Only the tunnel forwarding method can forward to a dest of a different af than the service, on linux 3.18+.
+// Any other mixed af dests are skipped, as they would be for a backend without any address.
+func (self *ipvsBackend) checkMixedAf(ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) bool {
+    if ipvsDest.FwdMethod & ipvs.IP_VS_CONN_F_FWD_MASK != ipvs.IP_VS_CONN_F_TUNNEL {
+        log.Printf("clusterf:ipvsBackend %v: skip %v dest %v for %v: %v forwarding does not support mixed address families, use tunnel forwarding\n", self, ipvsDest.Af, ipvsDest, ipvsService, ipvsDest.FwdMethod)
+
+        return false
+    } else if !self.driver.mixedAf {
+        log.Printf("clusterf:ipvsBackend %v: skip %v dest %v for %v: kernel does not support mixed address families\n", self, ipvsDest.Af, ipvsDest, ipvsService)
+
+        return false
+    }
+
+    return true
+}
+
+// Use the driver tunnel encapsulation for any tunnel dests
+func (self *ipvsBackend) applyTunnel (ipvsDest *ipvs.Dest) {
+    if ipvsDest.FwdMethod & ipvs.IP_VS_CONN_F_FWD_MASK == ipvs.IP_VS_CONN_F_TUNNEL {
+        ipvsDest.TunType = self.driver.tunType
+        ipvsDest.TunPort = self.driver.tunPort
+        ipvsDest.TunFlags = self.driver.tunFlags
+    }
 }
 
 func (self *ipvsBackend) applyRoute (ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) (*ipvs.Dest, error) {
@@ -88,7 +205,7 @@ func (self *ipvsBackend) applyRoute (ipvsService *ipvs.Service, ipvsDest *ipvs.D
         return ipvsDest, nil
     }
 
-    log.Printf("cluster:ipvsBackend.applyRoute %v: %v\n", ipvsDest, route)
+    log.Printf("cluster:ipvsBackend %v applyRoute %v: %v\n", self, ipvsDest, route)
 
     if route.ipvs_filter {
         // ignore
@@ -111,17 +228,61 @@ func (self *ipvsBackend) applyRoute (ipvsService *ipvs.Service, ipvsDest *ipvs.D
     return ipvsDest, nil
 }
 
-func (self *ipvsBackend) updateWeight(weight uint) {
-    if weight == 0 {
-        self.weight = IPVS_WEIGHT
+// The dest weight for the configured weight
+func (self *ipvsBackend) makeWeight(weight uint, drain bool) uint32 {
+    if self.standby || drain {
+        return 0
+    } else if weight == 0 {
+        return IPVS_WEIGHT
     } else {
-        self.weight = uint32(weight) // XXX: check
+        return uint32(weight) // XXX: check
     }
 }
 
+func (self *ipvsBackend) updateWeight(weight uint, drain bool) {
+    self.configWeight = weight
+    self.drain = drain
+    self.weight = self.makeWeight(weight, drain)
+}
+
+// promote/demote any active instances of this backend
+func (self *ipvsBackend) setStandby(standby bool) error {
+    if standby == self.standby {
+        return nil
+    }
+
+    self.standby = standby
+    self.updateWeight(self.configWeight, self.drain)
+    setWeight := self.weight
+
+    for _, ipvsType := range ipvsTypes {
+        if ipvsService := self.frontend.state[ipvsType]; ipvsService != nil {
+            if ipvsDest := self.state[ipvsType]; ipvsDest != nil {
+                getWeight := self.stateWeight[ipvsType]
+
+                log.Printf("clusterf:ipvsBackend %v setStandby %v: %v %v +%d-%d\n", self, standby, ipvsService, ipvsDest, setWeight, getWeight)
+
+                // the driver dest is adjusted even if the kernel command fails
+                err := self.driver.adjustDest(ipvsService, ipvsDest, int(setWeight) - int(getWeight))
+                self.stateWeight[ipvsType] = setWeight
+
+                if err != nil {
+                    return err
+                }
+            }
+        }
+    }
+
+    return nil
+}
+
 // create any instances of this backend, assuming there is no active state
 func (self *ipvsBackend) add(backend config.ServiceBackend) error {
-    self.updateWeight(backend.Weight)
+    if err := self.driver.checkIPv4("backend " + self.String(), backend.IPv4); err != nil {
+        return err
+    }
+
+    self.updateWeight(backend.Weight, backend.Drain)
 
     for _, ipvsType := range ipvsTypes {
         if ipvsService := self.frontend.state[ipvsType]; ipvsService != nil {
@@ -135,10 +296,11 @@ func (self *ipvsBackend) add(backend config.ServiceBackend) error {
                 continue
             }
 
-            if upDest, err := self.driver.upDest(ipvsService, ipvsDest, self.weight); err != nil {
+            if upDest, err := self.driver.upDest(ipvsService, ipvsDest, self.weight, self.name); err != nil {
                 return err
             } else {
                 self.state[ipvsType] = upDest
+                self.stateWeight[ipvsType] = self.weight
             }
         }
     }
@@ -151,11 +313,28 @@ func (self *ipvsBackend) add(backend config.ServiceBackend) error {
 // - replaces any active instances that have changed
 // - adds new active isntances that are now configured
 //
+// All of the dests are built before changing any active instances, and the new weight is only used once all of the instances have
+// been updated. Any failed instances keep their previous state, and are updated by the next set.
+//
 // TODO: sets any active instances that have changed parameters
 func (self *ipvsBackend) set(backend config.ServiceBackend) error {
-    getWeight := self.weight
-    self.updateWeight(backend.Weight)
-    setWeight := self.weight
+    if err := self.driver.checkIPv4("backend " + self.String(), backend.IPv4); err != nil {
+        return err
+    }
+
+    setDests := make(map[ipvsType]*ipvs.Dest)
+    setWeight := self.makeWeight(backend.Weight, backend.Drain)
+
+    for _, ipvsType := range ipvsTypes {
+        if ipvsService := self.frontend.state[ipvsType]; ipvsService == nil {
+
+        } else if ipvsDest, err := self.buildDest(ipvsService, backend); err != nil {
+            return err
+        } else {
+            // nil if the backend does not have this ipvsType
+            setDests[ipvsType] = ipvsDest
+        }
+    }
 
     for _, ipvsType := range ipvsTypes {
         if ipvsService := self.frontend.state[ipvsType]; ipvsService != nil {
@@ -163,12 +342,8 @@ func (self *ipvsBackend) set(backend config.ServiceBackend) error {
             var match bool
 
             getDest = self.state[ipvsType]
-
-            if ipvsDest, err := self.buildDest(ipvsService, backend); err != nil {
-                return err
-            } else if ipvsDest != nil {
-                setDest = ipvsDest
-            }
+            getWeight := self.stateWeight[ipvsType]
+            setDest = setDests[ipvsType]
 
             // compare for matching id, but changed value
             if setDest == nil || getDest == nil {
@@ -182,21 +357,28 @@ func (self *ipvsBackend) set(backend config.ServiceBackend) error {
             if setDest == nil {
                 // configured as inactive
             } else if match {
-                log.Printf("clusterf:ipvsBackend.set: set %v %v +%d-%d\n", ipvsService, setDest, setWeight, getWeight)
+                log.Printf("clusterf:ipvsBackend %v set: set %v %v +%d-%d\n", self, ipvsService, setDest, setWeight, getWeight)
 
                 // XXX: fwdMethod?
-                // update existing ipvs.Dest in-place
-                if err := self.driver.adjustDest(ipvsService, getDest, int(setWeight) - int(getWeight)); err != nil  {
+                // update existing ipvs.Dest in-place, including any changed thresholds
+                getDest.UThresh = setDest.UThresh
+                getDest.LThresh = setDest.LThresh
+
+                // the driver dest is adjusted even if the kernel command fails
+                err := self.driver.adjustDest(ipvsService, getDest, int(setWeight) - int(getWeight))
+                self.stateWeight[ipvsType] = setWeight
+
+                if err != nil  {
                     return err
                 }
 
                 setDest = getDest
 
             } else {
-                log.Printf("clusterf:ipvsBackend.set: new %v %v\n", ipvsService, setDest)
+                log.Printf("clusterf:ipvsBackend %v set: new %v %v\n", self, ipvsService, setDest)
 
-                // replace active
-                if upDest, err := self.driver.upDest(ipvsService, setDest, setWeight); err != nil {
+                // replace active, keeping the old instance if this fails
+                if upDest, err := self.driver.upDest(ipvsService, setDest, setWeight, self.name); err != nil {
                     return err
                 } else {
                     setDest = upDest
@@ -206,6 +388,12 @@ func (self *ipvsBackend) set(backend config.ServiceBackend) error {
             // may be nil, if the new backend did not have this ipvsType
             self.state[ipvsType] = setDest
 
+            if setDest == nil {
+                delete(self.stateWeight, ipvsType)
+            } else {
+                self.stateWeight[ipvsType] = setWeight
+            }
+
             if getDest == nil {
                 // not active
 
@@ -213,10 +401,10 @@ func (self *ipvsBackend) set(backend config.ServiceBackend) error {
                 // remains active
 
             } else {
-                log.Printf("clusterf:ipvsBackend.set: del %v %v\n", ipvsService, getDest)
+                log.Printf("clusterf:ipvsBackend %v set: del %v %v\n", self, ipvsService, getDest)
 
                 // replace active
-                if err := self.driver.downDest(ipvsService, getDest, getWeight); err != nil {
+                if err := self.driver.downDest(ipvsService, getDest, getWeight, self.name); err != nil {
                     // XXX: inconsistent, we now have two dest's
                     return err
                 }
@@ -224,19 +412,27 @@ func (self *ipvsBackend) set(backend config.ServiceBackend) error {
         }
     }
 
+    self.updateWeight(backend.Weight, backend.Drain)
+
     return nil
 }
 
 // remove any active instances of this backend, clearing the active state
 func (self *ipvsBackend) del() error {
+    // the pins would keep sending the clients to the removed backend
+    if err := self.driver.downBackendPins(self); err != nil {
+        return err
+    }
+
     for _, ipvsType := range ipvsTypes {
         if ipvsService := self.frontend.state[ipvsType]; ipvsService != nil {
             if ipvsDest := self.state[ipvsType]; ipvsDest != nil {
-                if err := self.driver.downDest(ipvsService, ipvsDest, self.weight); err != nil {
+                if err := self.driver.downDest(ipvsService, ipvsDest, self.stateWeight[ipvsType], self.name); err != nil {
                     return err
                 }
 
                 self.state[ipvsType] = nil
+                delete(self.stateWeight, ipvsType)
             }
         }
     }
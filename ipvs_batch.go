@@ -0,0 +1,38 @@
+package clusterf
+/*
+ * Batching of the kernel IPVS commands for the initial sync, which would otherwise wait for the ack of each service and dest in turn.
+ *
+ * Any commands that fail within the batch are counted as errors once the batch is flushed, and repaired by the next Verify.
+ */
+
+import (
+    "github.com/qmsk/clusterf/ipvs"
+    "log"
+)
+
+// The ipvs.Client supports batching, unlike the test commands
+type ipvsBatcher interface {
+    Batch() *ipvs.Batch
+}
+
+// Queue any service and dest commands until flushBatch
+func (self *IPVSDriver) beginBatch() {
+    if batcher, ok := self.ipvsClient.(ipvsBatcher); ok {
+        self.batch = batcher.Batch()
+    }
+}
+
+// Send any queued service and dest commands, and stop batching
+func (self *IPVSDriver) flushBatch() error {
+    var batch = self.batch
+
+    if batch == nil {
+        return nil
+    }
+
+    self.batch = nil
+
+    log.Printf("clusterf:ipvs flushBatch: %d commands\n", batch.Len())
+
+    return batch.Flush()
+}
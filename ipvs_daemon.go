@@ -0,0 +1,96 @@
+package clusterf
+/*
+ * The kernel IPVS connection sync daemons, for active/passive failover between directors.
+ *
+ * The active director runs the master daemon, multicasting its connection table to any passive directors running the backup daemon,
+ * which can then take over the existing connections once they become active.
+ */
+
+import (
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "log"
+)
+
+// Return the configured sync daemons
+func (self IpvsConfig) syncDaemons() []ipvs.Daemon {
+    var daemons []ipvs.Daemon
+
+    if self.SyncMaster != "" {
+        daemons = append(daemons, ipvs.Daemon{State: ipvs.IP_VS_STATE_MASTER, McastIfn: self.SyncMaster, SyncID: uint32(self.SyncID)})
+    }
+    if self.SyncBackup != "" {
+        daemons = append(daemons, ipvs.Daemon{State: ipvs.IP_VS_STATE_BACKUP, McastIfn: self.SyncBackup, SyncID: uint32(self.SyncID)})
+    }
+
+    return daemons
+}
+
+// Return the running sync daemons
+func (self *IPVSDriver) SyncDaemons() ([]ipvs.Daemon, error) {
+    if self.ipvsClient == nil {
+        return nil, nil
+    }
+
+    return self.ipvsClient.ListDaemons()
+}
+
+// Start the sync daemon, replacing any running daemon with the same state using a different interface or sync ID
+func (self *IPVSDriver) StartSync(daemon ipvs.Daemon) error {
+    if self.ipvsClient == nil {
+        return nil
+    }
+
+    daemons, err := self.ipvsClient.ListDaemons()
+    if err != nil {
+        return fmt.Errorf("ipvs.ListDaemons: %w", err)
+    }
+
+    for _, running := range daemons {
+        if running.State != daemon.State {
+            continue
+        } else if running == daemon {
+            return nil
+        }
+
+        log.Printf("clusterf:ipvs StartSync: stop %v\n", running)
+
+        if err := self.ipvsClient.DelDaemon(running.State); err != nil {
+            return fmt.Errorf("ipvs.DelDaemon %v: %w", running.State, err)
+        }
+    }
+
+    log.Printf("clusterf:ipvs StartSync: %v\n", daemon)
+
+    if err := self.ipvsClient.NewDaemon(daemon); err != nil {
+        return fmt.Errorf("ipvs.NewDaemon %v: %w", daemon, err)
+    }
+
+    return nil
+}
+
+// Stop the sync daemon with the given state, if running
+func (self *IPVSDriver) StopSync(state ipvs.DaemonState) error {
+    if self.ipvsClient == nil {
+        return nil
+    }
+
+    daemons, err := self.ipvsClient.ListDaemons()
+    if err != nil {
+        return fmt.Errorf("ipvs.ListDaemons: %w", err)
+    }
+
+    for _, running := range daemons {
+        if running.State != state {
+            continue
+        }
+
+        log.Printf("clusterf:ipvs StopSync: %v\n", running)
+
+        if err := self.ipvsClient.DelDaemon(state); err != nil {
+            return fmt.Errorf("ipvs.DelDaemon %v: %w", state, err)
+        }
+    }
+
+    return nil
+}
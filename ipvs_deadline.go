@@ -0,0 +1,101 @@
+package clusterf
+/*
+ * Deadlines for the kernel IPVS commands used to converge the config, so that a stuck netlink request fails the sync or verify
+ * instead of blocking the writer goroutine.
+ *
+ * Any command that times out may still be applied by the kernel later, and any differences are repaired by the next Verify.
+ */
+
+import (
+    "context"
+    "github.com/qmsk/clusterf/ipvs"
+    "time"
+)
+
+// The ipvs.Client commands, with a deadline for each service and dest command
+type ipvsDeadline struct {
+    *ipvs.Client
+
+    timeout time.Duration
+}
+
+func (self ipvsDeadline) context() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), self.timeout)
+}
+
+func (self ipvsDeadline) Flush() error {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.FlushContext(ctx)
+}
+
+func (self ipvsDeadline) ListServices() ([]ipvs.Service, error) {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.ListServicesContext(ctx)
+}
+
+func (self ipvsDeadline) GetService(service ipvs.Service) (ipvs.Service, error) {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.GetServiceContext(ctx, service)
+}
+
+func (self ipvsDeadline) NewService(service ipvs.Service) error {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.NewServiceContext(ctx, service)
+}
+
+func (self ipvsDeadline) SetService(service ipvs.Service) error {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.SetServiceContext(ctx, service)
+}
+
+func (self ipvsDeadline) DelService(service ipvs.Service) error {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.DelServiceContext(ctx, service)
+}
+
+func (self ipvsDeadline) ListDests(service ipvs.Service) ([]ipvs.Dest, error) {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.ListDestsContext(ctx, service)
+}
+
+func (self ipvsDeadline) GetDest(service ipvs.Service, dest ipvs.Dest) (ipvs.Dest, error) {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.GetDestContext(ctx, service, dest)
+}
+
+func (self ipvsDeadline) NewDest(service ipvs.Service, dest ipvs.Dest) error {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.NewDestContext(ctx, service, dest)
+}
+
+func (self ipvsDeadline) SetDest(service ipvs.Service, dest ipvs.Dest) error {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.SetDestContext(ctx, service, dest)
+}
+
+func (self ipvsDeadline) DelDest(service ipvs.Service, dest ipvs.Dest) error {
+    ctx, cancel := self.context()
+    defer cancel()
+
+    return self.Client.DelDestContext(ctx, service, dest)
+}
@@ -2,6 +2,7 @@ package clusterf
 
 import (
     "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/errs"
     "fmt"
     "github.com/qmsk/clusterf/ipvs"
     "log"
@@ -9,20 +10,48 @@ import (
     "syscall"
 )
 
+// Schedulers that choose the backend by hashing the client or destination address, already sending each client to the same backend
+var hashingSchedulers = map[string]bool{
+    "sh":   true,
+    "dh":   true,
+    "mh":   true,
+}
+
 type ipvsFrontend struct {
     driver      *IPVSDriver
+    name        string
+    config      config.ServiceFrontend
     state       map[ipvsType]*ipvs.Service
+
+    // duplicate traffic for the services of the same address family to this host
+    mirror      net.IP
+
+    // duplicate traffic for the services of the same address family to these shadow group backends, sorted
+    shadow      []net.IP
+
+    // filter clients by source address; nil allow for any clients
+    allow       []*net.IPNet
+    deny        []*net.IPNet
+
+    // local addresses added for the frontend interface
+    local       map[localAddr]bool
 }
 
-func makeFrontend(driver *IPVSDriver) *ipvsFrontend {
+func makeFrontend(driver *IPVSDriver, name string) *ipvsFrontend {
     return &ipvsFrontend{
         driver: driver,
+        name:   name,
         state:  make(map[ipvsType]*ipvs.Service),
+        local:  make(map[localAddr]bool),
     }
 }
 
-func (self *ipvsFrontend) newBackend() *ipvsBackend {
-    return makeBackend(self)
+func (self *ipvsFrontend) String() string {
+    return self.name
+}
+
+func (self *ipvsFrontend) newBackend(name string) *ipvsBackend {
+    return makeBackend(self, name)
 }
 
 // setup a valid ipvs.Service for the given ServiceFrontend and ipvsType
@@ -34,8 +63,42 @@ func (self *ipvsFrontend) buildService (ipvsType ipvsType, frontend config.Servi
 
         SchedName:  self.driver.schedName,
         Timeout:    0,
-        Flags:      ipvs.Flags{Flags: 0, Mask: 0xffffffff},
-        Netmask:    0xffffffff,
+    }
+
+    // persistence granularity, as a netmask for AF_INET, or a prefix length for AF_INET6
+    switch ipvsType.Af {
+    case syscall.AF_INET:
+        ipvsService.Netmask = 0xffffffff
+
+        if frontend.PersistenceNetmask4 != 0 {
+            ipvsService.Netmask = 0xffffffff << (32 - frontend.PersistenceNetmask4)
+        }
+    case syscall.AF_INET6:
+        ipvsService.Netmask = 128
+
+        if frontend.PersistenceNetmask6 != 0 {
+            ipvsService.Netmask = uint32(frontend.PersistenceNetmask6)
+        }
+    }
+
+    if frontend.Persistence != 0 {
+        ipvsService.Flags.Persistent = true
+        ipvsService.Timeout = frontend.Persistence.Seconds()
+    }
+
+    if frontend.FwMark == 0 {
+
+    } else if ipvsType.Protocol != syscall.IPPROTO_TCP {
+        // the kernel registers fwmark services as tcp, matching packets of any protocol
+        return nil, nil
+    } else if ipvsType.Af == syscall.AF_INET && frontend.IPv4 == "" {
+        return nil, nil
+    } else if ipvsType.Af == syscall.AF_INET6 && frontend.IPv6 == "" {
+        return nil, nil
+    } else {
+        ipvsService.FwMark = frontend.FwMark
+
+        return ipvsService, nil
     }
 
     switch ipvsType.Af {
@@ -43,9 +106,9 @@ func (self *ipvsFrontend) buildService (ipvsType ipvsType, frontend config.Servi
         if frontend.IPv4 == "" {
             return nil, nil
         } else if ip := net.ParseIP(frontend.IPv4); ip == nil {
-            return nil, fmt.Errorf("Invalid IPv4: %v", frontend.IPv4)
+            return nil, errs.ConfigError(fmt.Errorf("Invalid IPv4: %v", frontend.IPv4))
         } else if ip4 := ip.To4(); ip4 == nil {
-            return nil, fmt.Errorf("Invalid IPv4: %v", ip)
+            return nil, errs.ConfigError(fmt.Errorf("Invalid IPv4: %v", ip))
         } else {
             ipvsService.Addr = ip4
         }
@@ -53,9 +116,9 @@ func (self *ipvsFrontend) buildService (ipvsType ipvsType, frontend config.Servi
         if frontend.IPv6 == "" {
             return nil, nil
         } else if ip := net.ParseIP(frontend.IPv6); ip == nil {
-            return nil, fmt.Errorf("Invalid IPv6: %v", frontend.IPv6)
+            return nil, errs.ConfigError(fmt.Errorf("Invalid IPv6: %v", frontend.IPv6))
         } else if ip16 := ip.To16(); ip16 == nil {
-            return nil, fmt.Errorf("Invalid IPv6: %v", ip)
+            return nil, errs.ConfigError(fmt.Errorf("Invalid IPv6: %v", ip))
         } else {
             ipvsService.Addr = ip16
         }
@@ -74,6 +137,12 @@ func (self *ipvsFrontend) buildService (ipvsType ipvsType, frontend config.Servi
         } else {
             ipvsService.Port = frontend.UDP
         }
+    case syscall.IPPROTO_SCTP:
+        if frontend.SCTP == 0 {
+            return nil, nil
+        } else {
+            ipvsService.Port = frontend.SCTP
+        }
     default:
         panic("invalid proto")
     }
@@ -81,14 +150,102 @@ func (self *ipvsFrontend) buildService (ipvsType ipvsType, frontend config.Servi
     return ipvsService, nil
 }
 
+// Return the dest port for backends that do not configure any ports of their own.
+// Defaults to the frontend port itself, like ipvsadm.
+func (self *ipvsFrontend) backendPort(protocol ipvs.Protocol) uint16 {
+    var frontendPort uint16
+
+    switch protocol {
+    case syscall.IPPROTO_TCP:
+        if self.config.BackendTCP != 0 {
+            return self.config.BackendTCP
+        }
+        frontendPort = self.config.TCP
+    case syscall.IPPROTO_UDP:
+        if self.config.BackendUDP != 0 {
+            return self.config.BackendUDP
+        }
+        frontendPort = self.config.UDP
+    case syscall.IPPROTO_SCTP:
+        if self.config.BackendSCTP != 0 {
+            return self.config.BackendSCTP
+        }
+        frontendPort = self.config.SCTP
+    }
+
+    if self.config.BackendPort != 0 {
+        return self.config.BackendPort
+    } else {
+        return frontendPort
+    }
+}
+
+// Frontend mirror applies to the ipvs.Service
+func (self *ipvsFrontend) mirrorsService(ipvsService *ipvs.Service) bool {
+    if self.mirror == nil {
+        return false
+    } else if self.mirror.To4() != nil {
+        return ipvsService.Af == syscall.AF_INET
+    } else {
+        return ipvsService.Af == syscall.AF_INET6
+    }
+}
+
+func (self *ipvsFrontend) buildMirror(frontend config.ServiceFrontend) (net.IP, error) {
+    if frontend.Mirror == "" {
+        return nil, nil
+    } else if ip := net.ParseIP(frontend.Mirror); ip == nil {
+        return nil, errs.ConfigError(fmt.Errorf("Invalid Mirror: %v", frontend.Mirror))
+    } else if ip4 := ip.To4(); ip4 != nil {
+        return ip4, nil
+    } else {
+        return ip, nil
+    }
+}
+
+func (self *ipvsFrontend) buildFilter(frontend config.ServiceFrontend) (allow []*net.IPNet, deny []*net.IPNet, err error) {
+    if allow, err = frontend.Allow.Parse(); err != nil {
+        return nil, nil, errs.ConfigError(fmt.Errorf("Invalid Allow: %v", err))
+    } else if deny, err = frontend.Deny.Parse(); err != nil {
+        return nil, nil, errs.ConfigError(fmt.Errorf("Invalid Deny: %v", err))
+    } else {
+        return allow, deny, nil
+    }
+}
+
+// Frontend has any nft rules
+func (self *ipvsFrontend) hasNft() bool {
+    return self.mirror != nil || len(self.shadow) > 0 || self.allow != nil || self.deny != nil
+}
+
 func (self *ipvsFrontend) add(frontend config.ServiceFrontend) error {
-    for _, ipvsType := range ipvsTypes {
+    self.config = frontend
+
+    if frontend.Persistence != 0 && hashingSchedulers[self.driver.schedName] {
+        log.Printf("clusterf:ipvsFrontend %v add: persistence %v is redundant with the %s scheduler, which already sends each client to the same backend\n", self, frontend.Persistence, self.driver.schedName)
+    }
+
+    mirror, err := self.buildMirror(frontend)
+    if err != nil {
+        return err
+    }
+
+    allow, deny, err := self.buildFilter(frontend)
+    if err != nil {
+        return err
+    }
+
+    if err := self.driver.checkIPv4("frontend " + self.name, frontend.IPv4); err != nil {
+        return err
+    }
+
+    for _, ipvsType := range self.driver.activeTypes() {
         if ipvsService, err := self.buildService(ipvsType, frontend); err != nil {
             return err
         } else if ipvsService != nil {
-            log.Printf("clusterf:ipvsFrontend.add: new %v\n", ipvsService)
+            log.Printf("clusterf:ipvsFrontend %v add: new %v\n", self, ipvsService)
 
-            if err := self.driver.upService(ipvsService); err != nil  {
+            if err := self.driver.upService(ipvsService, self.name); err != nil  {
                 return err
             } else {
                 self.state[ipvsType] = ipvsService
@@ -96,15 +253,80 @@ func (self *ipvsFrontend) add(frontend config.ServiceFrontend) error {
         }
     }
 
+    self.mirror = mirror
+    self.allow = allow
+    self.deny = deny
+
+    if self.hasNft() {
+        if err := self.driver.upNft(self); err != nil {
+            return err
+        }
+    }
+
+    // before adding the local backend, for the kernel to recognize the local dest
+    if frontend.Interface != "" {
+        if err := self.driver.upLocal(self); err != nil {
+            return err
+        }
+    }
+
     return nil
 }
 
+// Apply the params of the merged services, once the backends are up
+func (self *ipvsFrontend) sync() error {
+    for _, ipvsType := range ipvsTypes {
+        if ipvsService := self.state[ipvsType]; ipvsService == nil {
+
+        } else if err := self.driver.syncService(ipvsService); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Update the source address filter for the existing services, without replacing them
+func (self *ipvsFrontend) setFilter(frontend config.ServiceFrontend) error {
+    allow, deny, err := self.buildFilter(frontend)
+    if err != nil {
+        return err
+    }
+
+    self.config = frontend
+    self.allow = allow
+    self.deny = deny
+
+    log.Printf("clusterf:ipvsFrontend %v setFilter: allow=%v deny=%v\n", self, allow, deny)
+
+    if self.hasNft() {
+        return self.driver.upNft(self)
+    } else {
+        return self.driver.downNft(self)
+    }
+}
+
 func (self *ipvsFrontend) del() error {
+    // the pin rules match the old services, and would keep sending the clients to the old backends
+    if err := self.driver.downFrontendPins(self); err != nil {
+        return err
+    }
+
+    // stop mirroring before removing the services
+    if err := self.driver.downNft(self); err != nil {
+        return err
+    } else {
+        self.mirror = nil
+        self.shadow = nil
+        self.allow = nil
+        self.deny = nil
+    }
+
     for _, ipvsType := range ipvsTypes {
         if ipvsService := self.state[ipvsType]; ipvsService != nil {
-            log.Printf("clusterf:ipvsFrontend.del: del %v\n", ipvsService)
+            log.Printf("clusterf:ipvsFrontend %v del: del %v\n", self, ipvsService)
 
-            if err := self.driver.downService(ipvsService); err != nil  {
+            if err := self.driver.downService(ipvsService, self.name); err != nil  {
                 return err
             } else {
                 self.state[ipvsType] = nil
@@ -112,5 +334,10 @@ func (self *ipvsFrontend) del() error {
         }
     }
 
+    // after removing the services, so that any local dests are removed first
+    if err := self.driver.downLocal(self); err != nil {
+        return err
+    }
+
     return nil
 }
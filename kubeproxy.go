@@ -0,0 +1,165 @@
+package clusterf
+/*
+ * Coexist with kube-proxy in IPVS mode on the same node, without ever modifying or flushing the kube-proxy services.
+ *
+ * kube-proxy binds the ClusterIP and any external IPs of each Kubernetes service to its kube-ipvs0 dummy interface, and uses the
+ * NodePort range on the node addresses. Any IPVS service using one of those addresses or ports is assumed to be owned by kube-proxy.
+ */
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "github.com/qmsk/clusterf/ipvs"
+    "fmt"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+)
+
+const KUBE_PROXY_DEV = "kube-ipvs0"
+const KUBE_PROXY_PORTS = "30000-32767"
+
+type kubeProxy struct {
+    dev         string
+    portMin     uint16
+    portMax     uint16
+
+    // used for testing; instead of the dev addresses
+    addrs       func(dev string) ([]net.IP, error)
+}
+
+func parsePortRange(value string) (min uint16, max uint16, err error) {
+    var parts = strings.SplitN(value, "-", 2)
+    var port uint64
+
+    if port, err = strconv.ParseUint(parts[0], 10, 16); err != nil {
+        return
+    } else {
+        min, max = uint16(port), uint16(port)
+    }
+
+    if len(parts) == 1 {
+
+    } else if port, err = strconv.ParseUint(parts[1], 10, 16); err != nil {
+        return
+    } else if max = uint16(port); max < min {
+        err = fmt.Errorf("Invalid port range: %s", value)
+    }
+
+    return
+}
+
+func makeKubeProxy(dev string, ports string) (*kubeProxy, error) {
+    var proxy = kubeProxy{dev: dev, addrs: interfaceAddrs}
+
+    if proxy.dev == "" {
+        proxy.dev = KUBE_PROXY_DEV
+    }
+    if ports == "" {
+        ports = KUBE_PROXY_PORTS
+    }
+
+    if portMin, portMax, err := parsePortRange(ports); err != nil {
+        return nil, errs.ConfigError(fmt.Errorf("Invalid KubeProxyPorts: %v", err))
+    } else {
+        proxy.portMin = portMin
+        proxy.portMax = portMax
+    }
+
+    return &proxy, nil
+}
+
+func interfaceAddrs(dev string) ([]net.IP, error) {
+    var ips []net.IP
+
+    iface, err := net.InterfaceByName(dev)
+    if err != nil {
+        // kube-proxy may not be running yet
+        return nil, nil
+    }
+
+    addrs, err := iface.Addrs()
+    if err != nil {
+        return nil, errs.KernelError(fmt.Errorf("%s: %v", dev, err))
+    }
+
+    for _, addr := range addrs {
+        if ipNet, ok := addr.(*net.IPNet); ok {
+            ips = append(ips, ipNet.IP)
+        }
+    }
+
+    return ips, nil
+}
+
+func (self *kubeProxy) String() string {
+    return fmt.Sprintf("kube-proxy %s ports %d-%d", self.dev, self.portMin, self.portMax)
+}
+
+// Return the current kube-proxy addresses, for use with owns()
+func (self *kubeProxy) loadAddrs() (map[string]bool, error) {
+    var addrs = make(map[string]bool)
+
+    ips, err := self.addrs(self.dev)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, ip := range ips {
+        addrs[ip.String()] = true
+    }
+
+    return addrs, nil
+}
+
+// Test if the IPVS service is owned by kube-proxy
+func (self *kubeProxy) owns(addrs map[string]bool, ipvsService ipvs.Service) bool {
+    if ipvsService.FwMark != 0 {
+        // kube-proxy does not use fwmark services
+        return false
+    } else if addrs[ipvsService.Addr.String()] {
+        return true
+    } else if ipvsService.Port >= self.portMin && ipvsService.Port <= self.portMax {
+        return true
+    } else {
+        return false
+    }
+}
+
+// Check that a new driver service does not conflict with any kube-proxy service
+func (self *kubeProxy) checkService(ipvsService *ipvs.Service) error {
+    if addrs, err := self.loadAddrs(); err != nil {
+        return err
+    } else if self.owns(addrs, *ipvsService) {
+        return errs.ConfigError(fmt.Errorf("Service %v conflicts with %s", ipvsService, self))
+    }
+
+    return nil
+}
+
+// Remove any kernel services not owned by kube-proxy, instead of flushing all services
+func (self *kubeProxy) flush(ipvsClient IPVSClient) error {
+    addrs, err := self.loadAddrs()
+    if err != nil {
+        return err
+    }
+
+    services, err := ipvsClient.ListServices()
+    if err != nil {
+        return err
+    }
+
+    for _, ipvsService := range services {
+        if self.owns(addrs, ipvsService) {
+            continue
+        }
+
+        log.Printf("clusterf:ipvs %s: flush %v\n", self, ipvsService)
+
+        if err := ipvsClient.DelService(ipvsService); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,58 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "net"
+    "syscall"
+    "testing"
+)
+
+func TestKubeProxy(t *testing.T) {
+    services := NewServices()
+    client := makeTestClient()
+
+    kubeService := ipvs.Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("10.96.0.1").To4(), Port: 443, SchedName: "rr"}
+    nodePortService := ipvs.Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("192.0.2.10").To4(), Port: 30080, SchedName: "rr"}
+    oldService := ipvs.Service{Af: syscall.AF_INET, Protocol: syscall.IPPROTO_TCP, Addr: net.ParseIP("10.0.1.9").To4(), Port: 80, SchedName: "wlc"}
+
+    for _, service := range []ipvs.Service{kubeService, nodePortService, oldService} {
+        client.NewService(service)
+    }
+    client.ops = nil
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "test", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "conflict", Frontend: config.ServiceFrontend{IPv4: "10.96.0.1", TCP: 443}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, KubeProxy: true, kubeProxyAddrs: func(dev string) ([]net.IP, error) {
+        if dev != KUBE_PROXY_DEV {
+            return nil, fmt.Errorf("wrong dev: %s", dev)
+        }
+        return []net.IP{net.ParseIP("10.96.0.1")}, nil
+    }})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    // only the old clusterf service is flushed, and the conflicting frontend is rejected
+    if ops := fmt.Sprintf("%v", client.ops); ops != "[del-service inet+tcp://10.0.1.9:80 new-service inet+tcp://10.0.1.1:80 wlc]" {
+        t.Errorf("sync ops: %v", ops)
+    }
+    if stats := services.ErrorStats(); stats.Config != 1 {
+        t.Errorf("sync errors: %#v", stats)
+    }
+
+    client.ops = nil
+
+    if repairs, err := ipvsDriver.Verify(); err != nil || repairs != 0 {
+        t.Errorf("Verify: %d %v", repairs, err)
+    }
+    if count, err := ipvsDriver.Zero(""); err != nil || count != 1 {
+        t.Errorf("Zero all: %d %v", count, err)
+    }
+
+    if ops := fmt.Sprintf("%v", client.ops); ops != "[zero-service inet+tcp://10.0.1.1:80]" {
+        t.Errorf("ops: %v", ops)
+    }
+}
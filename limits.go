@@ -0,0 +1,77 @@
+package clusterf
+/*
+ * Limits on the number of services and backends, protecting against unbounded growth from any runaway config writers.
+ *
+ * Any new services or backends over the limits are rejected, and logged.
+ */
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "sync/atomic"
+)
+
+// Zero for unlimited
+type Limits struct {
+    Services    int     // maximum number of services
+    Backends    int     // maximum number of backends per service
+}
+
+type LimitStats struct {
+    RejectedServices    uint64
+    RejectedBackends    uint64
+}
+
+// Limit the number of services and backends, rejecting any new configs over the limits.
+//
+// Must be called before any NewConfig().
+func (self *Services) SetLimits(limits Limits) {
+    self.limits = limits
+}
+
+// Reject any new service over the limit
+func (self *Services) limitService(serviceName string) bool {
+    if _, exists := self.services[serviceName]; exists || self.limits.Services == 0 {
+        return false
+    } else if len(self.services) < self.limits.Services {
+        return false
+    }
+
+    atomic.AddUint64(&self.limitStats.RejectedServices, 1)
+
+    log.Printf("clusterf:Services: reject service %s: over the limit of %d services\n", serviceName, self.limits.Services)
+
+    return true
+}
+
+// Reject any new service backend over the limit
+func (self *Services) limitBackend(service *Service, backendName string) bool {
+    if _, exists := service.Backends[backendName]; exists || self.limits.Backends == 0 {
+        return false
+    } else if len(service.Backends) < self.limits.Backends {
+        return false
+    }
+
+    atomic.AddUint64(&self.limitStats.RejectedBackends, 1)
+
+    log.Printf("clusterf:Service %s: reject backend %s: over the limit of %d backends\n", service.Name, backendName, self.limits.Backends)
+
+    return true
+}
+
+// Return the number of rejected services and backends; safe to call from any goroutine
+func (self *Services) LimitStats() LimitStats {
+    return LimitStats{
+        RejectedServices:   atomic.LoadUint64(&self.limitStats.RejectedServices),
+        RejectedBackends:   atomic.LoadUint64(&self.limitStats.RejectedBackends),
+    }
+}
+
+// Write the limit stats in the Prometheus text format
+func (self LimitStats) WriteMetrics(w io.Writer) {
+    fmt.Fprintf(w, "# HELP clusterf_rejected_total Configs rejected for being over the limits\n")
+    fmt.Fprintf(w, "# TYPE clusterf_rejected_total counter\n")
+    fmt.Fprintf(w, "clusterf_rejected_total{limit=\"services\"} %d\n", self.RejectedServices)
+    fmt.Fprintf(w, "clusterf_rejected_total{limit=\"backends\"} %d\n", self.RejectedBackends)
+}
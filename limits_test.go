@@ -0,0 +1,54 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "bytes"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+func TestServicesLimits(t *testing.T) {
+    services := NewServices()
+
+    services.SetLimits(Limits{Services: 2, Backends: 3})
+
+    for i := 0; i < 4; i++ {
+        serviceName := fmt.Sprintf("test%d", i)
+
+        services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:serviceName, Frontend:config.ServiceFrontend{IPv4:fmt.Sprintf("10.0.1.%d", i), TCP:80}})
+
+        for j := 0; j < 5; j++ {
+            services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:serviceName, BackendName:fmt.Sprintf("test%d", j), Backend:config.ServiceBackend{IPv4:fmt.Sprintf("10.1.%d.%d", i, j), TCP:80}})
+        }
+    }
+
+    if len(services.services) != 2 {
+        t.Errorf("services: %d", len(services.services))
+    }
+    for serviceName, service := range services.services {
+        if len(service.Backends) != 3 {
+            t.Errorf("service %s backends: %d", serviceName, len(service.Backends))
+        }
+    }
+
+    // 2 services * (1 frontend + 5 backends) + 2 services * 2 extra backends
+    if stats := services.LimitStats(); stats != (LimitStats{RejectedServices: 12, RejectedBackends: 4}) {
+        t.Errorf("LimitStats: %#v", stats)
+    }
+
+    // existing services and backends can still be updated
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test0", BackendName:"test0", Backend:config.ServiceBackend{IPv4:"10.1.0.0", TCP:80, Weight:20}})
+
+    if backend := services.services["test0"].Backends["test0"]; backend.Weight != 20 {
+        t.Errorf("service test0 backend test0: %#v", backend)
+    }
+
+    var buf bytes.Buffer
+
+    services.LimitStats().WriteMetrics(&buf)
+
+    if metrics := buf.String(); !strings.Contains(metrics, "clusterf_rejected_total{limit=\"services\"} 12\n") || !strings.Contains(metrics, "clusterf_rejected_total{limit=\"backends\"} 4\n") {
+        t.Errorf("WriteMetrics:\n%s", metrics)
+    }
+}
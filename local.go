@@ -0,0 +1,219 @@
+package clusterf
+/*
+ * Local frontends, exposing a daemon on the same host through IPVS, consistently with the cluster services.
+ *
+ * The frontend IPs are added as local addresses on the frontend interface using the ip(8) command, for the daemon to listen on,
+ * and the local host is used as an extra backend of the service. The local backend is drained while nothing is listening on the
+ * frontend ports, so that the VIP is withdrawn like any other service without active backends.
+ */
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "io"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+const PROC_NET_PATH = "/proc/net"
+
+// Backend name of the local host, used to label the stats
+const LOCAL_BACKEND = "local"
+
+// Socket states in the /proc/net tables
+const (
+    PROC_NET_TCP_LISTEN = "0A"
+    PROC_NET_UDP_CLOSE  = "07"
+)
+
+type localAddr struct {
+    ip      string
+    dev     string
+}
+
+// Parse a hex address from the /proc/net tables, formatted as 32-bit words in host order
+func parseProcAddr(field string) (net.IP, error) {
+    buf, err := hex.DecodeString(field)
+    if err != nil || (len(buf) != 4 && len(buf) != 16) {
+        return nil, fmt.Errorf("invalid address: %s", field)
+    }
+
+    ip := make(net.IP, len(buf))
+
+    for i := 0; i < len(buf); i += 4 {
+        binary.BigEndian.PutUint32(ip[i:i+4], binary.NativeEndian.Uint32(buf[i:i+4]))
+    }
+
+    return ip, nil
+}
+
+// Return true if the /proc/net table has a socket in the given state, bound to the port on the ip or the wildcard address
+func readListening(reader io.Reader, state string, ip net.IP, port uint16) (bool, error) {
+    var scanner = bufio.NewScanner(reader)
+
+    for header := true; scanner.Scan(); header = false {
+        //  sl  local_address rem_address   st ...
+        fields := strings.Fields(scanner.Text())
+
+        if header {
+            continue
+        } else if len(fields) < 4 {
+            return false, fmt.Errorf("invalid socket: %#v", scanner.Text())
+        } else if fields[3] != state {
+            continue
+        }
+
+        parts := strings.SplitN(fields[1], ":", 2)
+
+        if len(parts) != 2 {
+            return false, fmt.Errorf("invalid local address: %s", fields[1])
+        } else if localIP, err := parseProcAddr(parts[0]); err != nil {
+            return false, err
+        } else if localPort, err := strconv.ParseUint(parts[1], 16, 16); err != nil {
+            return false, fmt.Errorf("invalid local port: %s", parts[1])
+        } else if uint16(localPort) != port {
+            continue
+        } else if localIP.Equal(ip) || localIP.IsUnspecified() {
+            return true, nil
+        }
+    }
+
+    return false, scanner.Err()
+}
+
+// Return true if any TCP socket is listening, or any UDP socket is bound, on the ip and port, or the wildcard address.
+// IPv4 addresses may also be used by any dual-stack IPv6 sockets.
+//
+// SCTP sockets are not listed in /proc/net, and are assumed to be listening.
+func procListening(protocol ipvs.Protocol, ip net.IP, port uint16) (bool, error) {
+    var names []string
+    var state string
+
+    switch protocol {
+    case syscall.IPPROTO_TCP:
+        state = PROC_NET_TCP_LISTEN
+    case syscall.IPPROTO_UDP:
+        state = PROC_NET_UDP_CLOSE
+    default:
+        return true, nil
+    }
+
+    if ip.To4() != nil {
+        names = []string{protocol.String(), protocol.String() + "6"}
+    } else {
+        names = []string{protocol.String() + "6"}
+    }
+
+    for _, name := range names {
+        path := filepath.Join(PROC_NET_PATH, name)
+
+        if file, err := os.Open(path); os.IsNotExist(err) {
+            // IPv6 disabled
+            continue
+        } else if err != nil {
+            return false, err
+        } else if listening, err := readListening(file, state, ip, port); err != nil {
+            file.Close()
+
+            return false, fmt.Errorf("%s: %v", path, err)
+        } else if file.Close(); listening {
+            return true, nil
+        }
+    }
+
+    return false, nil
+}
+
+// Add the frontend IPs as local addresses on the frontend interface, shared by any other frontends using the same IP
+func (self *IPVSDriver) upLocal(frontend *ipvsFrontend) error {
+    for _, ipvsType := range ipvsTypes {
+        ipvsService := frontend.state[ipvsType]
+
+        if ipvsService == nil {
+            continue
+        }
+
+        addr := localAddr{ipvsService.Addr.String(), frontend.config.Interface}
+
+        if frontend.local[addr] {
+            continue
+        } else if self.localAddrs[addr] > 0 {
+
+        } else if err := self.runLocal("replace", ipvsService.Addr, addr.dev); err != nil {
+            return err
+        }
+
+        log.Printf("clusterf:ipvs upLocal %s: %s dev %s\n", frontend, addr.ip, addr.dev)
+
+        frontend.local[addr] = true
+        self.localAddrs[addr]++
+    }
+
+    return nil
+}
+
+// Remove the local addresses of the frontend, unless used by any other frontends
+func (self *IPVSDriver) downLocal(frontend *ipvsFrontend) error {
+    for addr, _ := range frontend.local {
+        log.Printf("clusterf:ipvs downLocal %s: %s dev %s\n", frontend, addr.ip, addr.dev)
+
+        if self.localAddrs[addr] > 1 {
+
+        } else if err := self.runLocal("del", net.ParseIP(addr.ip), addr.dev); err != nil {
+            return err
+        }
+
+        delete(frontend.local, addr)
+
+        if self.localAddrs[addr]--; self.localAddrs[addr] == 0 {
+            delete(self.localAddrs, addr)
+        }
+    }
+
+    return nil
+}
+
+func (self *IPVSDriver) runLocal(cmd string, ip net.IP, dev string) error {
+    if self.local == nil {
+        // mock'd
+        return nil
+    }
+
+    return self.local.Run(self.ipPath, "addr", cmd, vipPrefix(ip), "dev", dev)
+}
+
+// The local host is listening on each of the frontend services, at the backend port
+func (self *ipvsFrontend) listening() bool {
+    if self.driver.localListening == nil {
+        // mock'd
+        return true
+    }
+
+    for _, ipvsType := range ipvsTypes {
+        ipvsService := self.state[ipvsType]
+
+        if ipvsService == nil {
+            continue
+        }
+
+        port := self.backendPort(ipvsService.Protocol)
+
+        if listening, err := self.driver.localListening(ipvsService.Protocol, ipvsService.Addr, port); err != nil {
+            log.Printf("clusterf:ipvsFrontend %v listening %v: %v\n", self, ipvsService, err)
+
+            return false
+        } else if !listening {
+            return false
+        }
+    }
+
+    return true
+}
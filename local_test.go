@@ -0,0 +1,107 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "net"
+    "reflect"
+    "strings"
+    "syscall"
+    "testing"
+)
+
+const testProcNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0B00007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 10001 1 0000000000000000 100 0 0 10 0
+   1: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 10002 1 0000000000000000 100 0 0 10 0
+   2: 0C00007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 10003 1 0000000000000000 20 4 30 10 -1
+`
+
+func TestReadListening(t *testing.T) {
+    for _, test := range []struct{
+        ip          string
+        port        uint16
+        listening   bool
+    }{
+        {"127.0.0.11", 53, true},
+        {"127.0.0.12", 53, false},
+        {"127.0.0.12", 22, true},
+        {"127.0.0.12", 8080, false},
+    } {
+        if listening, err := readListening(strings.NewReader(testProcNetTCP), PROC_NET_TCP_LISTEN, net.ParseIP(test.ip), test.port); err != nil {
+            t.Errorf("readListening %s:%d: %v", test.ip, test.port, err)
+        } else if listening != test.listening {
+            t.Errorf("readListening %s:%d: %v != %v", test.ip, test.port, listening, test.listening)
+        }
+    }
+
+    if _, err := readListening(strings.NewReader("header\n 0: 0B00007X:0035 00000000:0000 0A\n"), PROC_NET_TCP_LISTEN, net.ParseIP("127.0.0.11"), 53); err == nil {
+        t.Errorf("readListening invalid: no error")
+    }
+}
+
+func TestServiceLocal(t *testing.T) {
+    var services = NewServices()
+    var client = makeTestClient()
+    var commands = &testInjectCommands{}
+    var listening = map[string]bool{}
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, local: commands, localListening: func(protocol ipvs.Protocol, ip net.IP, port uint16) (bool, error) {
+        return listening[fmt.Sprintf("%v://%v:%d", protocol, ip, port)], nil
+    }})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    client.ops = nil
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "dns", Frontend: config.ServiceFrontend{IPv4: "127.0.0.11", TCP: 53, UDP: 53, Interface: "lo"}}})
+
+    if cmds := commands.take(); !reflect.DeepEqual(cmds, []string{"ip addr replace 127.0.0.11/32 dev lo"}) {
+        t.Errorf("new frontend commands: %v", cmds)
+    }
+    if ops := fmt.Sprintf("%v", client.ops); ops != "[new-service inet+tcp://127.0.0.11:53 wlc new-service inet+udp://127.0.0.11:53 wlc new-dest inet+tcp://127.0.0.11:53 127.0.0.11:53 masq 0 new-dest inet+udp://127.0.0.11:53 127.0.0.11:53 masq 0]" {
+        t.Errorf("new frontend ops: %v", ops)
+    }
+
+    client.ops = nil
+    listening["tcp://127.0.0.11:53"] = true
+    services.UpdateLocal()
+
+    if len(client.ops) != 0 {
+        t.Errorf("partially listening ops: %v", client.ops)
+    }
+
+    listening["udp://127.0.0.11:53"] = true
+    services.UpdateLocal()
+
+    if ops := fmt.Sprintf("%v", client.ops); ops != "[set-dest inet+tcp://127.0.0.11:53 127.0.0.11:53 masq 10 set-dest inet+udp://127.0.0.11:53 127.0.0.11:53 masq 10]" {
+        t.Errorf("listening ops: %v", ops)
+    }
+    if vips := services.VIPs(); vips["127.0.0.11"] == nil || !vips["127.0.0.11"].Healthy {
+        t.Errorf("listening VIPs: %v", vips)
+    }
+
+    // a second service sharing the local address
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "dns-alt", Frontend: config.ServiceFrontend{IPv4: "127.0.0.11", TCP: 5353, Interface: "lo"}}})
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "dns"}})
+
+    if cmds := commands.take(); len(cmds) != 0 {
+        t.Errorf("shared frontend commands: %v", cmds)
+    }
+
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "dns-alt"}})
+
+    if cmds := commands.take(); !reflect.DeepEqual(cmds, []string{"ip addr del 127.0.0.11/32 dev lo"}) {
+        t.Errorf("del frontend commands: %v", cmds)
+    }
+    if len(ipvsDriver.localAddrs) != 0 || len(client.services) != 0 {
+        t.Errorf("del frontend state: %v %v", ipvsDriver.localAddrs, client.services)
+    }
+}
+
+func TestProcListeningSCTP(t *testing.T) {
+    if listening, err := procListening(syscall.IPPROTO_SCTP, net.ParseIP("127.0.0.11"), 3868); err != nil || !listening {
+        t.Errorf("procListening sctp: %v %v", listening, err)
+    }
+}
@@ -0,0 +1,106 @@
+package logging
+/*
+ * Log file output, rotated by size and age.
+ */
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "time"
+)
+
+type fileWriter struct {
+    config      Config
+
+    mutex       sync.Mutex
+    file        *os.File
+    size        int64
+    opened      time.Time
+
+    // used for testing
+    now         func() time.Time
+}
+
+func (self Config) openFile() (*fileWriter, error) {
+    writer := &fileWriter{config: self, now: time.Now}
+
+    if self.Path == "" {
+        return nil, fmt.Errorf("Log file output requires a path")
+    }
+    if writer.config.MaxSize == 0 {
+        writer.config.MaxSize = LOG_MAX_SIZE
+    }
+    if writer.config.MaxFiles == 0 {
+        writer.config.MaxFiles = LOG_MAX_FILES
+    }
+
+    if err := writer.open(); err != nil {
+        return nil, err
+    }
+
+    return writer, nil
+}
+
+func (self *fileWriter) open() error {
+    if file, err := os.OpenFile(self.config.Path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644); err != nil {
+        return err
+    } else if stat, err := file.Stat(); err != nil {
+        file.Close()
+        return err
+    } else {
+        self.file = file
+        self.size = stat.Size()
+        self.opened = self.now()
+    }
+
+    return nil
+}
+
+// Shift the rotated files, dropping the oldest one, and start a new file
+func (self *fileWriter) rotate() error {
+    if err := self.file.Close(); err != nil {
+        return err
+    }
+
+    for i := self.config.MaxFiles - 1; i > 0; i-- {
+        if err := os.Rename(fmt.Sprintf("%s.%d", self.config.Path, i), fmt.Sprintf("%s.%d", self.config.Path, i + 1)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+
+    if err := os.Rename(self.config.Path, self.config.Path + ".1"); err != nil {
+        return err
+    }
+
+    return self.open()
+}
+
+func (self *fileWriter) Write(buf []byte) (int, error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.size == 0 {
+
+    } else if self.size + int64(len(buf)) > self.config.MaxSize {
+        if err := self.rotate(); err != nil {
+            return 0, err
+        }
+    } else if self.config.MaxAge > 0 && self.now().Sub(self.opened) >= self.config.MaxAge {
+        if err := self.rotate(); err != nil {
+            return 0, err
+        }
+    }
+
+    n, err := self.file.Write(buf)
+    self.size += int64(n)
+
+    return n, err
+}
+
+func (self *fileWriter) Close() error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.file.Close()
+}
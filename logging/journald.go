@@ -0,0 +1,91 @@
+package logging
+/*
+ * Native journald output, with the structured fields of each log line.
+ *
+ * The log lines are prefixed with the component that logged them, e.g. "clusterf:Service test: ...", which is included as the
+ * CLUSTERF_COMPONENT field.
+ */
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "net"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+const JOURNALD_PATH = "/run/systemd/journal/socket"
+
+var journaldComponent = regexp.MustCompile(`^([a-z-]+:[A-Za-z.]+)[ :]`)
+
+type journaldWriter struct {
+    path        string
+    ident       string
+
+    mutex       sync.Mutex
+    conn        net.Conn
+}
+
+func (self Config) openJournald() (*journaldWriter, error) {
+    writer := &journaldWriter{path: JOURNALD_PATH, ident: self.Ident}
+
+    if conn, err := net.Dial("unixgram", writer.path); err != nil {
+        return nil, err
+    } else {
+        writer.conn = conn
+    }
+
+    return writer, nil
+}
+
+// Append a field in the journald native protocol, using the binary form for any multi-line values
+func journaldField(buf *bytes.Buffer, name string, value string) {
+    if strings.Contains(value, "\n") {
+        buf.WriteString(name)
+        buf.WriteByte('\n')
+        binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+        buf.WriteString(value)
+        buf.WriteByte('\n')
+    } else {
+        fmt.Fprintf(buf, "%s=%s\n", name, value)
+    }
+}
+
+// Format the log line as a journald native protocol message
+func (self *journaldWriter) format(line string) []byte {
+    var buf bytes.Buffer
+
+    line = strings.TrimRight(line, "\n")
+
+    journaldField(&buf, "MESSAGE", line)
+    journaldField(&buf, "PRIORITY", fmt.Sprintf("%d", priority(line)))
+    journaldField(&buf, "SYSLOG_IDENTIFIER", self.ident)
+
+    if match := journaldComponent.FindStringSubmatch(line); match != nil {
+        journaldField(&buf, "CLUSTERF_COMPONENT", match[1])
+    }
+
+    return buf.Bytes()
+}
+
+func (self *journaldWriter) Write(buf []byte) (int, error) {
+    msg := self.format(string(buf))
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if _, err := self.conn.Write(msg); err != nil {
+        return 0, err
+    }
+
+    return len(buf), nil
+}
+
+func (self *journaldWriter) Close() error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.conn.Close()
+}
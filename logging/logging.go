@@ -0,0 +1,108 @@
+package logging
+/*
+ * Log outputs for the long-running daemons: stderr, a rotated file, syslog or journald.
+ *
+ * The standard log package output is replaced, so that all existing log.Printf() calls go to the configured output. The syslog and
+ * journald outputs have their own timestamps, and classify any lines mentioning an Error at the error priority.
+ */
+
+import (
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+const LOG_MAX_SIZE = 100 * 1000 * 1000
+const LOG_MAX_FILES = 5
+
+// syslog(3) priorities
+const (
+    LOG_ERR     = 3
+    LOG_INFO    = 6
+)
+
+type Config struct {
+    Output      string          // stderr, file, syslog or journald; default stderr
+
+    Path        string          // file output path
+    MaxSize     int64           // rotate the file once over the given size in bytes; default LOG_MAX_SIZE
+    MaxAge      time.Duration   // rotate the file once older than the given age; default never
+    MaxFiles    int             // keep the given number of rotated files; default LOG_MAX_FILES
+
+    Syslog      string          // syslog server as udp://host:port, tcp://host:port or unix:///path; default the local /dev/log
+    Ident       string          // syslog app-name and journald SYSLOG_IDENTIFIER; default program name
+}
+
+func (self *Config) Flags(flags *flag.FlagSet) {
+    flags.StringVar(&self.Output, "log-output", "stderr",
+        "Log to stderr, file, syslog or journald")
+    flags.StringVar(&self.Path, "log-path", "",
+        "Log to the given file for -log-output=file")
+    flags.Int64Var(&self.MaxSize, "log-max-size", LOG_MAX_SIZE,
+        "Rotate the -log-path file once over the given size in bytes")
+    flags.DurationVar(&self.MaxAge, "log-max-age", 0,
+        "Rotate the -log-path file once older than the given age, e.g. 24h (default never)")
+    flags.IntVar(&self.MaxFiles, "log-max-files", LOG_MAX_FILES,
+        "Keep the given number of rotated -log-path files, as .1 to .N")
+    flags.StringVar(&self.Syslog, "log-syslog", "",
+        "Send RFC5424 syslog messages to the given udp://host:port, tcp://host:port or unix:///path for -log-output=syslog (default /dev/log)")
+    flags.StringVar(&self.Ident, "log-ident", "",
+        "Syslog app-name or journald identifier (default program name)")
+}
+
+// Open the configured output, returning nil for stderr
+func (self Config) Open() (io.WriteCloser, error) {
+    if self.Ident == "" {
+        self.Ident = filepath.Base(os.Args[0])
+    }
+
+    switch self.Output {
+    case "", "stderr":
+        return nil, nil
+
+    case "file":
+        return self.openFile()
+
+    case "syslog":
+        return self.openSyslog()
+
+    case "journald":
+        return self.openJournald()
+
+    default:
+        return nil, fmt.Errorf("Invalid log output: %s", self.Output)
+    }
+}
+
+// Open the configured output, and replace the standard log output
+func (self Config) Setup() error {
+    writer, err := self.Open()
+    if err != nil {
+        return err
+    } else if writer == nil {
+        return nil
+    }
+
+    switch self.Output {
+    case "syslog", "journald":
+        log.SetFlags(0)
+    }
+
+    log.SetOutput(writer)
+
+    return nil
+}
+
+// Return the syslog priority for the log line
+func priority(line string) int {
+    if strings.Contains(line, "Error") {
+        return LOG_ERR
+    } else {
+        return LOG_INFO
+    }
+}
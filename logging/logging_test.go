@@ -0,0 +1,115 @@
+package logging
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "regexp"
+    "testing"
+    "time"
+)
+
+func TestFileRotate(t *testing.T) {
+    dir, err := ioutil.TempDir("", "clusterf-logging")
+    if err != nil {
+        t.Fatalf("ioutil.TempDir: %v", err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "clusterf.log")
+    now := time.Now()
+
+    writer, err := Config{Path: path, MaxSize: 20, MaxAge: time.Hour, MaxFiles: 2}.openFile()
+    if err != nil {
+        t.Fatalf("openFile: %v", err)
+    }
+    defer writer.Close()
+
+    writer.now = func() time.Time { return now }
+
+    for _, line := range []string{"line 1 .....\n", "line 2 .....\n", "line 3 .....\n"} {
+        if _, err := writer.Write([]byte(line)); err != nil {
+            t.Fatalf("Write: %v", err)
+        }
+    }
+
+    // rotate by age
+    now = now.Add(2 * time.Hour)
+
+    if _, err := writer.Write([]byte("line 4\n")); err != nil {
+        t.Fatalf("Write: %v", err)
+    }
+
+    for file, expected := range map[string]string{
+        path:           "line 4\n",
+        path + ".1":    "line 3 .....\n",
+        path + ".2":    "line 2 .....\n",
+    } {
+        if buf, err := ioutil.ReadFile(file); err != nil {
+            t.Errorf("read %s: %v", file, err)
+        } else if string(buf) != expected {
+            t.Errorf("%s: %#v != %#v", file, string(buf), expected)
+        }
+    }
+
+    if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+        t.Errorf("%s.3 was not dropped: %v", path, err)
+    }
+}
+
+func TestSyslog(t *testing.T) {
+    dir, err := ioutil.TempDir("", "clusterf-logging")
+    if err != nil {
+        t.Fatalf("ioutil.TempDir: %v", err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "log")
+
+    listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+    if err != nil {
+        t.Fatalf("net.ListenUnixgram: %v", err)
+    }
+    defer listener.Close()
+
+    writer, err := Config{Syslog: "unix://" + path, Ident: "clusterf-ipvs"}.openSyslog()
+    if err != nil {
+        t.Fatalf("openSyslog: %v", err)
+    }
+    defer writer.Close()
+
+    if _, err := writer.Write([]byte("cluster:Service test: Error (kernel): test\n")); err != nil {
+        t.Fatalf("Write: %v", err)
+    }
+
+    buf := make([]byte, 1024)
+    n, err := listener.Read(buf)
+    if err != nil {
+        t.Fatalf("Read: %v", err)
+    }
+
+    if msg := string(buf[:n]); !regexp.MustCompile(`^<27>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}\S+ \S+ clusterf-ipvs \d+ - - cluster:Service test: Error \(kernel\): test$`).MatchString(msg) {
+        t.Errorf("syslog message: %#v", msg)
+    }
+}
+
+func TestJournaldFormat(t *testing.T) {
+    writer := &journaldWriter{ident: "clusterf-ipvs"}
+
+    if msg := string(writer.format("clusterf:Service test: new Frontend: {}\n")); msg != "MESSAGE=clusterf:Service test: new Frontend: {}\nPRIORITY=6\nSYSLOG_IDENTIFIER=clusterf-ipvs\nCLUSTERF_COMPONENT=clusterf:Service\n" {
+        t.Errorf("journald message: %#v", msg)
+    }
+
+    var multiline bytes.Buffer
+
+    multiline.WriteString("MESSAGE\n")
+    binary.Write(&multiline, binary.LittleEndian, uint64(11))
+    multiline.WriteString("first\nError\nPRIORITY=3\nSYSLOG_IDENTIFIER=clusterf-ipvs\n")
+
+    if msg := writer.format("first\nError\n"); !bytes.Equal(msg, multiline.Bytes()) {
+        t.Errorf("journald multi-line message: %#v", string(msg))
+    }
+}
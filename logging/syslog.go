@@ -0,0 +1,131 @@
+package logging
+/*
+ * RFC5424 syslog output, to the local /dev/log or a remote syslog server.
+ */
+
+import (
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+const SYSLOG_PATH = "/dev/log"
+
+// syslog(3) LOG_DAEMON
+const SYSLOG_FACILITY = 3
+
+type syslogWriter struct {
+    network     string
+    addr        string
+    ident       string
+    hostname    string
+
+    mutex       sync.Mutex
+    conn        net.Conn
+
+    // used for testing
+    now         func() time.Time
+}
+
+func (self Config) openSyslog() (*syslogWriter, error) {
+    writer := &syslogWriter{network: "unixgram", addr: SYSLOG_PATH, ident: self.Ident, now: time.Now}
+
+    if self.Syslog == "" {
+
+    } else if syslogURL, err := url.Parse(self.Syslog); err != nil {
+        return nil, fmt.Errorf("Invalid syslog address %s: %v", self.Syslog, err)
+    } else if syslogURL.Scheme == "udp" || syslogURL.Scheme == "tcp" {
+        writer.network, writer.addr = syslogURL.Scheme, syslogURL.Host
+    } else if syslogURL.Scheme == "unix" {
+        writer.network, writer.addr = "unixgram", syslogURL.Path
+    } else {
+        return nil, fmt.Errorf("Invalid syslog address %s: unknown scheme", self.Syslog)
+    }
+
+    if hostname, err := os.Hostname(); err != nil {
+        return nil, err
+    } else {
+        writer.hostname = hostname
+    }
+
+    if err := writer.dial(); err != nil {
+        return nil, err
+    }
+
+    return writer, nil
+}
+
+func (self *syslogWriter) dial() error {
+    if conn, err := net.Dial(self.network, self.addr); err != nil {
+        return err
+    } else {
+        self.conn = conn
+    }
+
+    return nil
+}
+
+// Format the log line as an RFC5424 message
+func (self *syslogWriter) format(line string) string {
+    line = strings.TrimRight(line, "\n")
+
+    return fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+        SYSLOG_FACILITY * 8 + priority(line),
+        self.now().Format("2006-01-02T15:04:05.000000Z07:00"),
+        self.hostname,
+        self.ident,
+        os.Getpid(),
+        line,
+    )
+}
+
+func (self *syslogWriter) send(msg string) error {
+    if self.network == "tcp" {
+        // RFC6587 octet-counting framing
+        msg = fmt.Sprintf("%d %s", len(msg), msg)
+    }
+
+    _, err := self.conn.Write([]byte(msg))
+
+    return err
+}
+
+func (self *syslogWriter) Write(buf []byte) (int, error) {
+    msg := self.format(string(buf))
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.conn == nil {
+
+    } else if err := self.send(msg); err == nil {
+        return len(buf), nil
+    } else {
+        self.conn.Close()
+        self.conn = nil
+    }
+
+    // reconnect once, e.g. after a syslog daemon restart
+    if err := self.dial(); err != nil {
+        return 0, err
+    } else if err := self.send(msg); err != nil {
+        return 0, err
+    }
+
+    return len(buf), nil
+}
+
+func (self *syslogWriter) Close() error {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.conn == nil {
+        return nil
+    }
+
+    return self.conn.Close()
+}
@@ -0,0 +1,297 @@
+package clusterf
+/*
+ * nftables rules managed alongside the IPVS services, applied using the nft(8) command.
+ *
+ * The rules for each address family are kept in a separate "clusterf" table, which is replaced atomically on each change.
+ */
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "log"
+    "net"
+    "os/exec"
+    "sort"
+    "strings"
+    "syscall"
+)
+
+const NFT_PATH = "nft"
+const NFT_TABLE = "clusterf"
+
+// Before the conntrack and IPVS hooks
+const NFT_MIRROR_PRIORITY = -300
+
+// Before the IPVS LOCAL_IN hook
+const NFT_FILTER_PRIORITY = 0
+
+// The nft commands used by the driver, replaced by a fake for testing
+type nftCommands interface {
+    Apply(script string) error
+}
+
+type nftExec struct {
+    path    string
+}
+
+// Apply the given ruleset atomically using `nft -f -`
+func (self nftExec) Apply(script string) error {
+    cmd := exec.Command(self.path, "-f", "-")
+    cmd.Stdin = strings.NewReader(script)
+
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return errs.KernelError(fmt.Errorf("%s: %v: %s", self.path, err, strings.TrimSpace(string(output))))
+    }
+
+    return nil
+}
+
+func nftFamily(af ipvs.Af) string {
+    switch af {
+    case syscall.AF_INET:
+        return "ip"
+    case syscall.AF_INET6:
+        return "ip6"
+    default:
+        panic("invalid af")
+    }
+}
+
+func nftAddrType(family string) string {
+    if family == "ip6" {
+        return "ipv6_addr"
+    } else {
+        return "ipv4_addr"
+    }
+}
+
+// Return the nft match for traffic to the service
+func nftServiceMatch(ipvsService *ipvs.Service) string {
+    if ipvsService.FwMark != 0 {
+        // within the ip/ip6 family table
+        return fmt.Sprintf("meta mark %d", ipvsService.FwMark)
+    }
+
+    return fmt.Sprintf("%s daddr %s %v dport %d", nftFamily(ipvsService.Af), ipvsService.Addr, ipvsService.Protocol, ipvsService.Port)
+}
+
+// Return a valid nft set name for the frontend
+func nftSetName(name string, suffix string) string {
+    mapName := func(r rune) rune {
+        if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+            return r
+        } else {
+            return '_'
+        }
+    }
+
+    return strings.Map(mapName, name) + "_" + suffix
+}
+
+// Return the set elements of the same address family
+func nftElements(af ipvs.Af, ipNets []*net.IPNet) []string {
+    var elements []string
+
+    for _, ipNet := range ipNets {
+        if (ipNet.IP.To4() != nil) == (af == syscall.AF_INET) {
+            elements = append(elements, ipNet.String())
+        }
+    }
+
+    return elements
+}
+
+// nft rules for one address family
+type nftRules struct {
+    sets        []string
+    setNames    map[string]bool
+    mirror      []string
+    pin         []string
+    filter      []string
+
+    // shared by the frontend services
+    allowSets   map[*ipvsFrontend]string
+    denySets    map[*ipvsFrontend]string
+}
+
+// Declare a new set with the given elements, returning its unique name
+func (self *nftRules) addSet(family string, name string, elements []string) string {
+    setName := name
+
+    for i := 2; self.setNames[setName]; i++ {
+        setName = fmt.Sprintf("%s_%d", name, i)
+    }
+
+    self.setNames[setName] = true
+
+    set := fmt.Sprintf("set %s {\n", setName)
+    set += fmt.Sprintf("        type %s; flags interval;\n", nftAddrType(family))
+
+    if len(elements) > 0 {
+        set += fmt.Sprintf("        elements = { %s }\n", strings.Join(elements, ", "))
+    }
+
+    set += "    }"
+
+    self.sets = append(self.sets, set)
+
+    return setName
+}
+
+func (self *nftRules) addFrontend(frontend *ipvsFrontend, ipvsService *ipvs.Service) {
+    family := nftFamily(ipvsService.Af)
+    match := nftServiceMatch(ipvsService)
+
+    if frontend.mirrorsService(ipvsService) {
+        self.mirror = append(self.mirror, fmt.Sprintf("%s dup to %s comment %q", match, frontend.mirror, frontend.name))
+    }
+
+    if shadow := frontend.shadowService(ipvsService); len(shadow) > 0 {
+        self.mirror = append(self.mirror, fmt.Sprintf("%s dup to %s comment %q", match, nftShadow(ipvsService, shadow), frontend.name))
+    }
+
+    // an allow list without any prefixes of the same family drops all clients
+    if frontend.allow != nil {
+        setName, exists := self.allowSets[frontend]
+
+        if !exists {
+            setName = self.addSet(family, nftSetName(frontend.name, "allow"), nftElements(ipvsService.Af, frontend.allow))
+            self.allowSets[frontend] = setName
+        }
+
+        self.filter = append(self.filter, fmt.Sprintf("%s %s saddr != @%s drop comment %q", match, family, setName, frontend.name))
+    }
+
+    if elements := nftElements(ipvsService.Af, frontend.deny); len(elements) > 0 {
+        setName, exists := self.denySets[frontend]
+
+        if !exists {
+            setName = self.addSet(family, nftSetName(frontend.name, "deny"), elements)
+            self.denySets[frontend] = setName
+        }
+
+        self.filter = append(self.filter, fmt.Sprintf("%s %s saddr @%s drop comment %q", match, family, setName, frontend.name))
+    }
+}
+
+// Write the chain for the rules, skipping any duplicate rules from merged frontends during add-first changes
+func writeNftChain(script *strings.Builder, name string, hook string, priority int, rules []string) {
+    if len(rules) == 0 {
+        return
+    }
+
+    sort.Strings(rules)
+
+    fmt.Fprintf(script, "    chain %s {\n", name)
+    fmt.Fprintf(script, "        type filter hook %s priority %d;\n", hook, priority)
+
+    for i, rule := range rules {
+        if i > 0 && rules[i - 1] == rule {
+            continue
+        }
+
+        fmt.Fprintf(script, "        %s\n", rule)
+    }
+
+    fmt.Fprintf(script, "    }\n")
+}
+
+// Start or update the nft rules for the frontend services
+func (self *IPVSDriver) upNft(frontend *ipvsFrontend) error {
+    if self.nft == nil && self.ipvsClient != nil {
+        return errs.ConfigError(fmt.Errorf("Mirror, shadow, allow and deny require the nft command"))
+    }
+
+    log.Printf("clusterf:ipvs upNft %s: mirror=%v shadow=%v allow=%v deny=%v\n", frontend, frontend.mirror, frontend.shadow, frontend.allow, frontend.deny)
+
+    self.nftFrontends[frontend] = true
+
+    return self.applyNft()
+}
+
+// Remove the nft rules for the frontend services
+func (self *IPVSDriver) downNft(frontend *ipvsFrontend) error {
+    if !self.nftFrontends[frontend] {
+        return nil
+    }
+
+    log.Printf("clusterf:ipvs downNft %s\n", frontend)
+
+    delete(self.nftFrontends, frontend)
+
+    return self.applyNft()
+}
+
+// Return the nft script replacing the tables with the current rules
+func (self *IPVSDriver) nftScript() string {
+    var families = []string{"ip", "ip6"}
+    var rules = make(map[string]*nftRules)
+    var frontends []*ipvsFrontend
+    var script strings.Builder
+
+    for _, family := range families {
+        rules[family] = &nftRules{
+            setNames:   make(map[string]bool),
+            allowSets:  make(map[*ipvsFrontend]string),
+            denySets:   make(map[*ipvsFrontend]string),
+        }
+    }
+
+    // consistent set names
+    for frontend, _ := range self.nftFrontends {
+        frontends = append(frontends, frontend)
+    }
+
+    sort.Slice(frontends, func(i, j int) bool { return frontends[i].name < frontends[j].name })
+
+    for _, frontend := range frontends {
+        for _, ipvsType := range ipvsTypes {
+            if ipvsService := frontend.state[ipvsType]; ipvsService != nil {
+                rules[nftFamily(ipvsService.Af)].addFrontend(frontend, ipvsService)
+            }
+        }
+    }
+
+    for _, pin := range self.sortedPins() {
+        for _, rule := range pin.rules {
+            rules[nftFamily(rule.match.Af)].addPin(pin, rule)
+        }
+    }
+
+    for _, family := range families {
+        // declare before deleting, so that the delete does not fail if the table does not exist yet
+        fmt.Fprintf(&script, "table %s %s {}\n", family, NFT_TABLE)
+        fmt.Fprintf(&script, "delete table %s %s\n", family, NFT_TABLE)
+    }
+
+    for _, family := range families {
+        familyRules := rules[family]
+
+        if len(familyRules.mirror) == 0 && len(familyRules.pin) == 0 && len(familyRules.filter) == 0 {
+            continue
+        }
+
+        fmt.Fprintf(&script, "table %s %s {\n", family, NFT_TABLE)
+
+        for _, set := range familyRules.sets {
+            fmt.Fprintf(&script, "    %s\n", set)
+        }
+
+        writeNftChain(&script, "mirror", "prerouting", NFT_MIRROR_PRIORITY, familyRules.mirror)
+        writeNftChain(&script, "pin", "prerouting", NFT_PIN_PRIORITY, familyRules.pin)
+        writeNftChain(&script, "filter", "input", NFT_FILTER_PRIORITY, familyRules.filter)
+
+        fmt.Fprintf(&script, "}\n")
+    }
+
+    return script.String()
+}
+
+func (self *IPVSDriver) applyNft() error {
+    if self.nft == nil {
+        return nil
+    }
+
+    return self.nft.Apply(self.nftScript())
+}
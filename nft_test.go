@@ -0,0 +1,174 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "strings"
+    "testing"
+)
+
+type testNft struct {
+    scripts     []string
+    err         error   // fail any Apply
+}
+
+func (self *testNft) Apply(script string) error {
+    if self.err != nil {
+        return self.err
+    }
+
+    self.scripts = append(self.scripts, script)
+    return nil
+}
+
+func (self *testNft) last() string {
+    return self.scripts[len(self.scripts) - 1]
+}
+
+func TestMirror(t *testing.T) {
+    var services = NewServices()
+    var nft = &testNft{}
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: makeTestClient(), nft: nft}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    // sync clears any old rules
+    if len(nft.scripts) != 1 || strings.Contains(nft.last(), "chain mirror") {
+        t.Fatalf("sync: %#v", nft.scripts)
+    }
+
+    frontend := config.ServiceFrontend{IPv4: "10.0.1.1", IPv6: "2001:db8::1", TCP: 80, Mirror: "10.9.0.1"}
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: frontend}})
+
+    if script := nft.last(); !strings.Contains(script, "table ip clusterf {\n    chain mirror {\n        type filter hook prerouting priority -300;\n        ip daddr 10.0.1.1 tcp dport 80 dup to 10.9.0.1 comment \"web\"\n") {
+        t.Errorf("mirror:\n%s", script)
+    } else if strings.Contains(script, "table ip6 clusterf {\n") {
+        t.Errorf("mirror ip6:\n%s", script)
+    }
+
+    // removing the mirror from the frontend removes the rule, without any duplicate rules left over from the add-first merge
+    frontend.Mirror = ""
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: frontend}})
+
+    if script := nft.last(); strings.Contains(script, "dup to") {
+        t.Errorf("unmirror:\n%s", script)
+    }
+
+    frontend.Mirror = "2001:db8::9"
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: frontend}})
+
+    if script := nft.last(); !strings.Contains(script, "        ip6 daddr 2001:db8::1 tcp dport 80 dup to 2001:db8::9 comment \"web\"\n") {
+        t.Errorf("mirror ip6:\n%s", script)
+    }
+
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web"}})
+
+    if script := nft.last(); strings.Contains(script, "dup to") {
+        t.Errorf("delete:\n%s", script)
+    }
+}
+
+func TestFilter(t *testing.T) {
+    var services = NewServices()
+    var client = makeTestClient()
+    var nft = &testNft{}
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, nft: nft}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    frontend := config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 80, UDP: 80, Allow: "10.0.0.0/8,2001:db8::/32", Deny: "10.6.6.0/24"}
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web.test", Frontend: frontend}})
+
+    for _, expected := range []string{
+        "    set web_test_allow {\n        type ipv4_addr; flags interval;\n        elements = { 10.0.0.0/8 }\n    }\n",
+        "    set web_test_deny {\n        type ipv4_addr; flags interval;\n        elements = { 10.6.6.0/24 }\n    }\n",
+        "    chain filter {\n        type filter hook input priority 0;\n",
+        "        ip daddr 10.0.1.1 tcp dport 80 ip saddr != @web_test_allow drop comment \"web.test\"\n",
+        "        ip daddr 10.0.1.1 udp dport 80 ip saddr @web_test_deny drop comment \"web.test\"\n",
+    } {
+        if script := nft.last(); !strings.Contains(script, expected) {
+            t.Errorf("filter missing %#v:\n%s", expected, script)
+        }
+    }
+
+    // updating the filter does not touch the IPVS services
+    client.ops = nil
+    frontend.Allow = ""
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web.test", Frontend: frontend}})
+
+    if len(client.ops) != 0 {
+        t.Errorf("set filter ops: %v", client.ops)
+    }
+    if script := nft.last(); strings.Contains(script, "allow") || !strings.Contains(script, "@web_test_deny drop") {
+        t.Errorf("set filter:\n%s", script)
+    }
+
+    frontend.Deny = ""
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web.test", Frontend: frontend}})
+
+    if len(client.ops) != 0 {
+        t.Errorf("unfilter ops: %v", client.ops)
+    }
+    if script := nft.last(); strings.Contains(script, "chain filter") {
+        t.Errorf("unfilter:\n%s", script)
+    }
+}
+
+func TestShadow(t *testing.T) {
+    var services = NewServices()
+    var client = makeTestClient()
+    var nft = &testNft{}
+
+    services.NewConfig(&config.ConfigGroupBackend{ConfigSource: "test", GroupName: "canary", BackendName: "canary1", Backend: config.ServiceBackend{IPv4: "10.2.0.1", TCP: 80}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, nft: nft}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    frontend := config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 80, Shadow: "canary"}
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: frontend}})
+
+    if script := nft.last(); !strings.Contains(script, "        ip daddr 10.0.1.1 tcp dport 80 dup to 10.2.0.1 comment \"web\"\n") {
+        t.Errorf("shadow:\n%s", script)
+    }
+
+    // the shadow backends are not used as IPVS dests
+    for _, op := range client.ops {
+        if strings.Contains(op, "10.2.0.1") {
+            t.Errorf("shadow op: %v", op)
+        }
+    }
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigGroupBackend{ConfigSource: "test", GroupName: "canary", BackendName: "canary2", Backend: config.ServiceBackend{IPv4: "10.2.0.2", TCP: 80}}})
+
+    if script := nft.last(); !strings.Contains(script, "        ip daddr 10.0.1.1 tcp dport 80 dup to jhash ip saddr . tcp sport mod 2 map { 0 : 10.2.0.1, 1 : 10.2.0.2 } comment \"web\"\n") {
+        t.Errorf("shadow group:\n%s", script)
+    }
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigGroupBackend{ConfigSource: "test", GroupName: "canary", BackendName: "canary1", Backend: config.ServiceBackend{IPv4: "10.2.0.1", TCP: 80, Drain: true}}})
+
+    if script := nft.last(); !strings.Contains(script, " dup to 10.2.0.2 comment \"web\"\n") {
+        t.Errorf("shadow drain:\n%s", script)
+    }
+
+    // removing the shadow from the frontend does not touch the IPVS services
+    client.ops = nil
+    frontend.Shadow = ""
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: frontend}})
+
+    if len(client.ops) != 0 {
+        t.Errorf("unshadow ops: %v", client.ops)
+    }
+    if script := nft.last(); strings.Contains(script, "dup to") {
+        t.Errorf("unshadow:\n%s", script)
+    }
+}
@@ -0,0 +1,416 @@
+package clusterf
+/*
+ * Temporary pinning of a client to a chosen backend, for reproducing client-specific issues against a known server.
+ *
+ * Each pin uses a dedicated fwmark IPVS service for each service of the client's address family, with the pinned backend as its
+ * only dest. A prerouting nft rule marks the traffic from the client to the frontend service, which IPVS then schedules using the
+ * fwmark service instead. Only new connections are pinned: any existing connections or persistence templates of the client are
+ * still used until they expire.
+ *
+ * The pins are not part of the config, and are lost on restart. Removing the pinned backend, or changing or removing the frontend,
+ * also removes the pin.
+ */
+
+import (
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "log"
+    "net"
+    "sort"
+    "syscall"
+    "time"
+)
+
+// First fwmark used for the pin services, above any commonly configured fwmarks
+const PIN_FWMARK uint32 = 0xcf000000
+
+// The packet mark bits used for the pin fwmarks.
+//
+// The nft rule sets the whole packet mark, as IPVS only matches the fwmark service against the exact mark: any other mark bits, e.g.
+// the kube-proxy 0x4000 masquerade mark, would bypass the pin service. This conflicts with kube-proxy, which also sets its mark after
+// the pin rule, so pins are refused with -ipvs-kube-proxy.
+const PIN_FWMARK_MASK uint32 = 0xffff0000
+
+// The pin fwmarks are allocated in steps of the lowest PIN_FWMARK_MASK bit, to only use the masked bits
+const pinFwMarkStep uint32 = 0x00010000
+
+// Default duration of each pin
+const PIN_TTL = 1 * time.Hour
+
+// Maximum duration of each pin, for pins to be temporary
+const PIN_TTL_MAX = 24 * time.Hour
+
+// Before the IPVS LOCAL_IN hook, after the conntrack hook
+const NFT_PIN_PRIORITY = -150
+
+type pinKey struct {
+    service     string
+    client      string
+}
+
+// The fwmark service for one frontend service
+type ipvsPinRule struct {
+    match       ipvs.Service
+    service     *ipvs.Service
+    dest        *ipvs.Dest
+}
+
+type ipvsPin struct {
+    service     string
+    backend     string
+
+    // the pin is removed along with the frontend or backend
+    driverFrontend  *ipvsFrontend
+    driverBackend   *ipvsBackend
+
+    client      net.IP
+    expires     time.Time
+    rules       []ipvsPinRule
+}
+
+func (self *ipvsPin) String() string {
+    return fmt.Sprintf("pin:%s/%s@%s", self.service, self.backend, self.client)
+}
+
+// The state of a pin, exposed via the HTTP API
+type PinStatus struct {
+    Service     string      `json:"service"`
+    Backend     string      `json:"backend"`
+    Client      string      `json:"client"`
+    Expires     time.Time   `json:"expires"`
+
+    // the fwmark services used for the pin, e.g. inet+fwmark://3472883712
+    Services    []string    `json:"services"`
+}
+
+func (self *ipvsPin) status() PinStatus {
+    var status = PinStatus{
+        Service:    self.service,
+        Backend:    self.backend,
+        Client:     self.client.String(),
+        Expires:    self.expires,
+        Services:   make([]string, 0, len(self.rules)),
+    }
+
+    for _, rule := range self.rules {
+        status.Services = append(status.Services, rule.service.String())
+    }
+
+    return status
+}
+
+// Return a new fwmark for a pin service, skipping any fwmarks of other services.
+//
+// The fwmarks are allocated within the PinFwMark..PIN_FWMARK_MASK range, wrapping around to reuse the fwmarks of any removed pins.
+func (self *IPVSDriver) newPinFwMark(af ipvs.Af) (uint32, error) {
+    for fwMark := self.pinFwMark; ; {
+        nextFwMark := fwMark + pinFwMarkStep
+
+        if fwMark == PIN_FWMARK_MASK {
+            nextFwMark = self.pinFwMarkFirst
+        }
+
+        if self.services[makeServiceKey(&ipvs.Service{Af: af, FwMark: fwMark})] == nil {
+            self.pinFwMark = nextFwMark
+
+            return fwMark, nil
+        } else if nextFwMark == self.pinFwMark {
+            return 0, errs.ConfigError(fmt.Errorf("No free pin fwmarks within 0x%08x-0x%08x", self.pinFwMarkFirst, PIN_FWMARK_MASK))
+        }
+
+        fwMark = nextFwMark
+    }
+}
+
+// Pin the client to the backend, for the services of the same address family as the client
+func (self *IPVSDriver) upPin(frontend *ipvsFrontend, backend *ipvsBackend, client net.IP, expires time.Time) (*ipvsPin, error) {
+    var af ipvs.Af = syscall.AF_INET6
+
+    if self.nft == nil && self.ipvsClient != nil {
+        return nil, errs.ConfigError(fmt.Errorf("Pins require the nft command"))
+    } else if self.kubeProxy != nil {
+        return nil, errs.ConfigError(fmt.Errorf("Pins are not supported with %s, which overrides the pin fwmarks", self.kubeProxy))
+    }
+
+    if ip4 := client.To4(); ip4 != nil {
+        af = syscall.AF_INET
+        client = ip4
+    }
+
+    key := pinKey{frontend.name, client.String()}
+
+    if pin := self.pins[key]; pin == nil {
+
+    } else if err := self.downPin(pin); err != nil {
+        return nil, err
+    }
+
+    pin := &ipvsPin{
+        service:    frontend.name,
+        backend:    backend.name,
+        driverFrontend: frontend,
+        driverBackend:  backend,
+        client:     client,
+        expires:    expires,
+    }
+
+    log.Printf("clusterf:ipvs upPin %s: expires %v\n", pin, expires)
+
+    for _, ipvsType := range ipvsTypes {
+        ipvsService := frontend.state[ipvsType]
+        ipvsDest := backend.state[ipvsType]
+
+        if ipvsService == nil || ipvsDest == nil || ipvsService.Af != af {
+            continue
+        }
+
+        fwMark, err := self.newPinFwMark(ipvsService.Af)
+        if err != nil {
+            self.downPin(pin)
+
+            return nil, err
+        }
+
+        rule := ipvsPinRule{
+            match:  *ipvsService,
+            service: &ipvs.Service{
+                Af:         ipvsService.Af,
+                FwMark:     fwMark,
+                SchedName:  ipvsService.SchedName,
+                Netmask:    ipvsService.Netmask,
+            },
+        }
+
+        pinDest := *ipvsDest
+        pinDest.Stats = ipvs.Stats{}
+
+        if err := self.upService(rule.service, pin.String()); err != nil {
+            self.downPin(pin)
+
+            return nil, err
+        }
+
+        pin.rules = append(pin.rules, rule)
+
+        // pinned regardless of the backend weight
+        if dest, err := self.upDest(rule.service, &pinDest, IPVS_WEIGHT, backend.name); err != nil {
+            self.downPin(pin)
+
+            return nil, err
+        } else {
+            pin.rules[len(pin.rules) - 1].dest = dest
+        }
+    }
+
+    if len(pin.rules) == 0 {
+        return nil, errs.ConfigError(fmt.Errorf("Backend %s has no dests for the client %s", backend, client))
+    }
+
+    self.pins[key] = pin
+
+    // the pin services are only used once the nft rule marks the client traffic
+    if err := self.applyNft(); err != nil {
+        self.downPin(pin)
+
+        return nil, err
+    }
+
+    return pin, nil
+}
+
+// Remove the pin services and rules
+func (self *IPVSDriver) downPin(pin *ipvsPin) error {
+    log.Printf("clusterf:ipvs downPin %s\n", pin)
+
+    for _, rule := range pin.rules {
+        if rule.dest == nil {
+
+        } else if err := self.downDest(rule.service, rule.dest, IPVS_WEIGHT, pin.backend); err != nil {
+            return err
+        }
+
+        if err := self.downService(rule.service, pin.String()); err != nil {
+            return err
+        }
+    }
+
+    pin.rules = nil
+
+    key := pinKey{pin.service, pin.client.String()}
+
+    if self.pins[key] != pin {
+        return nil
+    }
+
+    delete(self.pins, key)
+
+    return self.applyNft()
+}
+
+// Remove any pins of the frontend, before removing its services
+func (self *IPVSDriver) downFrontendPins(frontend *ipvsFrontend) error {
+    for _, pin := range self.sortedPins() {
+        if pin.driverFrontend != frontend {
+            continue
+        }
+
+        if err := self.downPin(pin); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Remove any pins to the backend, before removing its dests
+func (self *IPVSDriver) downBackendPins(backend *ipvsBackend) error {
+    for _, pin := range self.sortedPins() {
+        if pin.driverBackend != backend {
+            continue
+        }
+
+        if err := self.downPin(pin); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Remove any pins expired at the given time
+func (self *IPVSDriver) expirePins(now time.Time) error {
+    for _, pin := range self.sortedPins() {
+        if now.Before(pin.expires) {
+            continue
+        }
+
+        log.Printf("clusterf:ipvs expirePins %s: expired %v\n", pin, pin.expires)
+
+        if err := self.downPin(pin); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Return the pins, sorted by service and client
+func (self *IPVSDriver) sortedPins() []*ipvsPin {
+    var pins = make([]*ipvsPin, 0, len(self.pins))
+
+    for _, pin := range self.pins {
+        pins = append(pins, pin)
+    }
+
+    sort.Slice(pins, func(i, j int) bool {
+        if pins[i].service != pins[j].service {
+            return pins[i].service < pins[j].service
+        } else {
+            return pins[i].client.String() < pins[j].client.String()
+        }
+    })
+
+    return pins
+}
+
+// Add the nft rule marking the client traffic to the frontend service for the pin service.
+//
+// The whole mark is replaced, for IPVS to match the pin service.
+func (self *nftRules) addPin(pin *ipvsPin, rule ipvsPinRule) {
+    family := nftFamily(rule.match.Af)
+
+    self.pin = append(self.pin, fmt.Sprintf("%s saddr %s %s meta mark set 0x%08x comment %q", family, pin.client, nftServiceMatch(&rule.match), rule.service.FwMark, pin.String()))
+}
+
+/* Services */
+
+// Pin the client to the named backend of the service for the given duration, replacing any existing pin of the client.
+//
+// Group backends are named by group/backend.
+func (self *Services) Pin(serviceName string, backendName string, client net.IP, ttl time.Duration) (PinStatus, error) {
+    var driverBackend *ipvsBackend
+
+    if self.driver == nil {
+        panic("Pin before driver sync")
+    }
+
+    service := self.services[serviceName]
+
+    if service == nil || service.Frontend == nil || service.driverFrontend == nil {
+        return PinStatus{}, errs.ConfigError(fmt.Errorf("Service not found: %s", serviceName))
+    }
+
+    service.eachDriverBackend(func(name string, backend *ipvsBackend) {
+        if name == backendName {
+            driverBackend = backend
+        }
+    })
+
+    if driverBackend == nil {
+        return PinStatus{}, errs.ConfigError(fmt.Errorf("Backend not found: %s/%s", serviceName, backendName))
+    }
+
+    if ttl == 0 {
+        ttl = PIN_TTL
+    } else if ttl < 0 || ttl > PIN_TTL_MAX {
+        return PinStatus{}, errs.ConfigError(fmt.Errorf("Invalid pin TTL %v: must be at most %v", ttl, PIN_TTL_MAX))
+    }
+
+    if pin, err := self.driver.upPin(service.driverFrontend, driverBackend, client, time.Now().Add(ttl)); err != nil {
+        self.errors.Count(err)
+
+        return PinStatus{}, err
+    } else {
+        return pin.status(), nil
+    }
+}
+
+// Remove the pin of the client for the named service
+func (self *Services) Unpin(serviceName string, client net.IP) error {
+    if self.driver == nil {
+        panic("Unpin before driver sync")
+    }
+
+    if ip4 := client.To4(); ip4 != nil {
+        client = ip4
+    }
+
+    if pin := self.driver.pins[pinKey{serviceName, client.String()}]; pin == nil {
+        return errs.ConfigError(fmt.Errorf("Pin not found: %s@%s", serviceName, client))
+    } else if err := self.driver.downPin(pin); err != nil {
+        self.errors.Count(err)
+
+        return err
+    }
+
+    return nil
+}
+
+// Return the active pins, sorted by service and client
+func (self *Services) Pins() []PinStatus {
+    var statuses = make([]PinStatus, 0)
+
+    if self.driver == nil {
+        return statuses
+    }
+
+    for _, pin := range self.driver.sortedPins() {
+        statuses = append(statuses, pin.status())
+    }
+
+    return statuses
+}
+
+// Remove any pins expired at the given time
+func (self *Services) ExpirePins(now time.Time) {
+    if self.driver == nil {
+        panic("ExpirePins before driver sync")
+    }
+
+    if err := self.driver.expirePins(now); err != nil {
+        class := self.errors.Count(err)
+
+        log.Printf("clusterf:Services: ExpirePins: Error (%s): %s\n", class, err)
+    }
+}
@@ -0,0 +1,239 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "net"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestPin(t *testing.T) {
+    var services = NewServices()
+    var client = ipvs.NewFakeClient()
+    var nft = &testNft{}
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", IPv6: "2001:db8::1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", IPv6: "2001:db8:1::1", TCP: 8080, Weight: 10}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web2", Backend: config.ServiceBackend{IPv4: "10.1.0.2", TCP: 8080, Weight: 10}})
+
+    driver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, nft: nft})
+    if err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    if _, err := services.Pin("web", "web3", net.ParseIP("192.0.2.1"), 0); err == nil {
+        t.Errorf("Pin web3: expected error")
+    }
+    if _, err := services.Pin("web", "web2", net.ParseIP("2001:db8:9::1"), 0); err == nil {
+        t.Errorf("Pin web2 for ipv6 client: expected error")
+    }
+
+    pin, err := services.Pin("web", "web2", net.ParseIP("192.0.2.1"), time.Minute)
+    if err != nil {
+        t.Fatalf("Pin: %v", err)
+    }
+
+    pinService := ipvs.Service{Af: syscall.AF_INET, FwMark: PIN_FWMARK}
+
+    if len(pin.Services) != 1 || pin.Services[0] != pinService.String() {
+        t.Errorf("Pin services: %v", pin.Services)
+    }
+
+    if dests, err := client.ListDests(pinService); err != nil {
+        t.Errorf("ListDests %v: %v", pinService, err)
+    } else if len(dests) != 1 || !dests[0].Addr.Equal(net.ParseIP("10.1.0.2")) || dests[0].Port != 8080 || dests[0].Weight == 0 {
+        t.Errorf("pin dests: %v", dests)
+    }
+
+    if script := nft.last(); !strings.Contains(script, "    chain pin {\n        type filter hook prerouting priority -150;\n        ip saddr 192.0.2.1 ip daddr 10.0.1.1 tcp dport 80 meta mark set 0xcf000000 comment \"pin:web/web2@192.0.2.1\"\n") {
+        t.Errorf("pin nft:\n%s", script)
+    } else if strings.Contains(script, "table ip6 clusterf {\n") {
+        t.Errorf("pin nft ip6:\n%s", script)
+    }
+
+    // the pin services are not repaired away
+    if repairs, err := driver.Verify(); err != nil {
+        t.Errorf("Verify: %v", err)
+    } else if repairs != 0 {
+        t.Errorf("Verify: %d repairs", repairs)
+    }
+
+    // re-pinning replaces the pin
+    if _, err := services.Pin("web", "web1", net.ParseIP("192.0.2.1"), time.Minute); err != nil {
+        t.Fatalf("Pin web1: %v", err)
+    }
+
+    if pins := services.Pins(); len(pins) != 1 || pins[0].Backend != "web1" {
+        t.Errorf("Pins: %#v", pins)
+    }
+    if _, err := client.GetService(pinService); err == nil {
+        t.Errorf("replaced pin service %v still exists", pinService)
+    }
+
+    if _, err := services.Pin("web", "web1", net.ParseIP("2001:db8:9::1"), time.Hour); err != nil {
+        t.Fatalf("Pin web1 for ipv6 client: %v", err)
+    }
+
+    if script := nft.last(); !strings.Contains(script, "        ip saddr 192.0.2.1 ip daddr 10.0.1.1 tcp dport 80 meta mark set 0xcf010000 comment") {
+        t.Errorf("re-pin nft:\n%s", script)
+    } else if !strings.Contains(script, "        ip6 saddr 2001:db8:9::1 ip6 daddr 2001:db8::1 tcp dport 80 meta mark set 0xcf020000 comment") {
+        t.Errorf("pin nft ip6:\n%s", script)
+    }
+
+    services.ExpirePins(time.Now().Add(2 * time.Minute))
+
+    if pins := services.Pins(); len(pins) != 1 || pins[0].Client != "2001:db8:9::1" {
+        t.Errorf("Pins after expire: %#v", pins)
+    }
+
+    if err := services.Unpin("web", net.ParseIP("2001:db8:9::1")); err != nil {
+        t.Errorf("Unpin: %v", err)
+    }
+    if err := services.Unpin("web", net.ParseIP("2001:db8:9::1")); err == nil {
+        t.Errorf("Unpin again: expected error")
+    }
+
+    if pins := services.Pins(); len(pins) != 0 {
+        t.Errorf("Pins after unpin: %#v", pins)
+    }
+    if script := nft.last(); strings.Contains(script, "chain pin") {
+        t.Errorf("unpin nft:\n%s", script)
+    }
+    if ipvsServices, _ := client.ListServices(); len(ipvsServices) != 2 {
+        t.Errorf("services after unpin: %v", ipvsServices)
+    }
+}
+
+func TestPinRemoved(t *testing.T) {
+    var services = NewServices()
+    var client = ipvs.NewFakeClient()
+    var nft = &testNft{}
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 8080, Weight: 10}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web2", Backend: config.ServiceBackend{IPv4: "10.1.0.2", TCP: 8080, Weight: 10}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, nft: nft}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    if _, err := services.Pin("web", "web2", net.ParseIP("192.0.2.1"), PIN_TTL_MAX + time.Minute); err == nil {
+        t.Errorf("Pin over PIN_TTL_MAX: expected error")
+    }
+
+    pinService := ipvs.Service{Af: syscall.AF_INET, FwMark: PIN_FWMARK}
+
+    if _, err := services.Pin("web", "web2", net.ParseIP("192.0.2.1"), time.Minute); err != nil {
+        t.Fatalf("Pin web2: %v", err)
+    }
+
+    // removing the pinned backend removes the pin
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web2"}})
+
+    if pins := services.Pins(); len(pins) != 0 {
+        t.Errorf("Pins after del backend: %#v", pins)
+    }
+    if _, err := client.GetService(pinService); err == nil {
+        t.Errorf("pin service %v still exists after del backend", pinService)
+    }
+    if script := nft.last(); strings.Contains(script, "chain pin") {
+        t.Errorf("del backend nft:\n%s", script)
+    }
+
+    // replacing the frontend removes the pin
+    if _, err := services.Pin("web", "web1", net.ParseIP("192.0.2.1"), time.Minute); err != nil {
+        t.Fatalf("Pin web1: %v", err)
+    }
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: config.ServiceFrontend{IPv4: "10.0.1.2", TCP: 80}}})
+
+    if pins := services.Pins(); len(pins) != 0 {
+        t.Errorf("Pins after set frontend: %#v", pins)
+    }
+    if script := nft.last(); strings.Contains(script, "chain pin") {
+        t.Errorf("set frontend nft:\n%s", script)
+    }
+
+    // removing the frontend removes the pin
+    if _, err := services.Pin("web", "web1", net.ParseIP("192.0.2.1"), time.Minute); err != nil {
+        t.Fatalf("Pin web1: %v", err)
+    }
+
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web"}})
+
+    if pins := services.Pins(); len(pins) != 0 {
+        t.Errorf("Pins after del frontend: %#v", pins)
+    }
+    if ipvsServices, _ := client.ListServices(); len(ipvsServices) != 0 {
+        t.Errorf("services after del frontend: %v", ipvsServices)
+    }
+    if script := nft.last(); strings.Contains(script, "chain pin") {
+        t.Errorf("del frontend nft:\n%s", script)
+    }
+}
+
+// The pin fwmarks wrap around within the mask to reuse the fwmarks of removed pins, and fail once exhausted
+func TestPinFwMarks(t *testing.T) {
+    var services = NewServices()
+    var client = ipvs.NewFakeClient()
+    var nft = &testNft{}
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 8080, Weight: 10}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, nft: nft, PinFwMark: 0xfffe0000}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    for _, test := range []struct{
+        client  string
+        fwMark  uint32
+    }{
+        {"192.0.2.1", 0xfffe0000},
+        {"192.0.2.2", 0xffff0000},
+    } {
+        if pin, err := services.Pin("web", "web1", net.ParseIP(test.client), time.Minute); err != nil {
+            t.Fatalf("Pin %s: %v", test.client, err)
+        } else if pinService := (ipvs.Service{Af: syscall.AF_INET, FwMark: test.fwMark}); len(pin.Services) != 1 || pin.Services[0] != pinService.String() {
+            t.Errorf("Pin %s services: %v", test.client, pin.Services)
+        }
+    }
+
+    if pin, err := services.Pin("web", "web1", net.ParseIP("192.0.2.3"), time.Minute); err == nil {
+        t.Errorf("Pin with exhausted fwmarks: %v", pin)
+    } else if errs.Classify(err) != errs.Config {
+        t.Errorf("Pin with exhausted fwmarks: %v", err)
+    }
+
+    if err := services.Unpin("web", net.ParseIP("192.0.2.1")); err != nil {
+        t.Fatalf("Unpin: %v", err)
+    }
+
+    if pin, err := services.Pin("web", "web1", net.ParseIP("192.0.2.3"), time.Minute); err != nil {
+        t.Fatalf("Pin 192.0.2.3: %v", err)
+    } else if pinService := (ipvs.Service{Af: syscall.AF_INET, FwMark: 0xfffe0000}); len(pin.Services) != 1 || pin.Services[0] != pinService.String() {
+        t.Errorf("Pin 192.0.2.3 services: %v", pin.Services)
+    }
+
+    // a failed nft update does not leave the pin or its services behind
+    if err := services.Unpin("web", net.ParseIP("192.0.2.3")); err != nil {
+        t.Fatalf("Unpin: %v", err)
+    }
+
+    nft.err = fmt.Errorf("test")
+
+    if _, err := services.Pin("web", "web1", net.ParseIP("192.0.2.4"), time.Minute); err == nil {
+        t.Errorf("Pin with nft error: expected error")
+    }
+    if pins := services.Pins(); len(pins) != 1 || pins[0].Client != "192.0.2.2" {
+        t.Errorf("Pins after nft error: %#v", pins)
+    }
+    if _, err := client.GetService(ipvs.Service{Af: syscall.AF_INET, FwMark: 0xfffe0000}); err == nil {
+        t.Errorf("pin service still exists after nft error")
+    }
+}
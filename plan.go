@@ -0,0 +1,205 @@
+package clusterf
+/*
+ * Dry-run plans for proposed config changes, listing the exact operations that applying the changes would make.
+ *
+ * The current configs are synced into a separate driver using an in-memory ipvs.FakeClient, and the changes are then applied as
+ * config events, recording each IPVS command, nft ruleset change and local address command made for the changes. The running
+ * driver and the kernel state are not touched. Any errors applying the changes are counted by class.
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "strings"
+)
+
+// A config node change of the plan
+type PlanChange struct {
+    Action      config.Action   `json:"action"`
+    Path        string          `json:"path"`
+    Value       string          `json:"value,omitempty"`
+}
+
+// An operation made by the driver for the planned changes
+type PlanOperation struct {
+    Command     string  `json:"command"`           // IPVS command, e.g. NewService or SetDest, nft or ip
+    Service     string  `json:"service,omitempty"`
+    Dest        string  `json:"dest,omitempty"`
+    Params      string  `json:"params,omitempty"`  // service or dest params, or the command args
+}
+
+func (self PlanOperation) String() string {
+    var parts = []string{self.Command}
+
+    for _, part := range []string{self.Service, self.Dest, self.Params} {
+        if part != "" {
+            parts = append(parts, part)
+        }
+    }
+
+    return strings.Join(parts, " ")
+}
+
+type Plan struct {
+    Changes     []PlanChange        `json:"changes"`
+    Operations  []PlanOperation     `json:"operations"`
+
+    // errors applying the changes by class, e.g. overlapping services
+    Errors      map[string]uint64   `json:"errors,omitempty"`
+}
+
+// Records the service and dest commands
+type planClient struct {
+    *ipvs.FakeClient
+
+    operations  []PlanOperation
+}
+
+func (self *planClient) recordService(command string, service ipvs.Service, params string) {
+    self.operations = append(self.operations, PlanOperation{Command: command, Service: service.String(), Params: params})
+}
+
+func (self *planClient) recordDest(command string, service ipvs.Service, dest ipvs.Dest, params string) {
+    self.operations = append(self.operations, PlanOperation{Command: command, Service: service.String(), Dest: dest.String(), Params: params})
+}
+
+func planServiceParams(service ipvs.Service) string {
+    return fmt.Sprintf("sched=%s flags=%v timeout=%d", service.SchedName, service.Flags, service.Timeout)
+}
+
+func planDestParams(dest ipvs.Dest) string {
+    return fmt.Sprintf("fwd=%v weight=%d", dest.FwdMethod, dest.Weight)
+}
+
+func (self *planClient) NewService(service ipvs.Service) error {
+    self.recordService("NewService", service, planServiceParams(service))
+
+    return self.FakeClient.NewService(service)
+}
+
+func (self *planClient) SetService(service ipvs.Service) error {
+    self.recordService("SetService", service, planServiceParams(service))
+
+    return self.FakeClient.SetService(service)
+}
+
+func (self *planClient) DelService(service ipvs.Service) error {
+    self.recordService("DelService", service, "")
+
+    return self.FakeClient.DelService(service)
+}
+
+func (self *planClient) NewDest(service ipvs.Service, dest ipvs.Dest) error {
+    self.recordDest("NewDest", service, dest, planDestParams(dest))
+
+    return self.FakeClient.NewDest(service, dest)
+}
+
+func (self *planClient) SetDest(service ipvs.Service, dest ipvs.Dest) error {
+    self.recordDest("SetDest", service, dest, planDestParams(dest))
+
+    return self.FakeClient.SetDest(service, dest)
+}
+
+func (self *planClient) DelDest(service ipvs.Service, dest ipvs.Dest) error {
+    self.recordDest("DelDest", service, dest, "")
+
+    return self.FakeClient.DelDest(service, dest)
+}
+
+// Records any changes to the nft ruleset
+type planNft struct {
+    client      *planClient
+    script      string
+}
+
+func (self *planNft) Apply(script string) error {
+    if script != self.script {
+        self.client.operations = append(self.client.operations, PlanOperation{Command: "nft", Params: fmt.Sprintf("%d rules", strings.Count(script, "\n"))})
+    }
+
+    self.script = script
+
+    return nil
+}
+
+// Records the local address commands
+type planLocal struct {
+    client      *planClient
+}
+
+func (self planLocal) Run(name string, args ...string) error {
+    self.client.operations = append(self.client.operations, PlanOperation{Command: name, Params: strings.Join(args, " ")})
+
+    return nil
+}
+
+// Return the plan for applying the changes on top of the current configs, using the given IpvsConfig without its Client.
+func PlanChanges(configs []config.Config, changes []config.ApplyChange, ipvsConfig IpvsConfig) (Plan, error) {
+    var plan = Plan{
+        Changes:    make([]PlanChange, 0, len(changes)),
+        Operations: make([]PlanOperation, 0),
+    }
+    var services = NewServices()
+    var client = &planClient{FakeClient: ipvs.NewFakeClient()}
+    var events []config.Event
+
+    for _, change := range changes {
+        planChange := PlanChange{Action: change.Action, Path: change.Node.Path}
+
+        if change.Action != config.DelConfig {
+            planChange.Value = change.Node.Value
+        }
+
+        plan.Changes = append(plan.Changes, planChange)
+
+        if event, err := change.Event(); err != nil {
+            return plan, errs.ConfigError(fmt.Errorf("%s: %v", change.Node.Path, err))
+        } else if event != nil {
+            events = append(events, *event)
+        }
+    }
+
+    ipvsConfig.Client = client
+    ipvsConfig.Mock = false
+    ipvsConfig.nft = &planNft{client: client}
+    ipvsConfig.local = planLocal{client: client}
+
+    for _, baseConfig := range configs {
+        services.NewConfig(baseConfig)
+    }
+
+    if _, err := services.SyncIPVS(ipvsConfig); err != nil {
+        return plan, err
+    }
+
+    // only the operations for the changes
+    client.operations = nil
+    syncErrors := services.ErrorStats()
+
+    for _, event := range events {
+        services.ConfigEvent(event)
+    }
+
+    plan.Operations = append(plan.Operations, client.operations...)
+    planErrors := services.ErrorStats()
+
+    for class, count := range map[errs.Class]uint64{
+        errs.Internal:  planErrors.Internal - syncErrors.Internal,
+        errs.Config:    planErrors.Config - syncErrors.Config,
+        errs.Backend:   planErrors.Backend - syncErrors.Backend,
+        errs.Kernel:    planErrors.Kernel - syncErrors.Kernel,
+    } {
+        if count == 0 {
+            continue
+        } else if plan.Errors == nil {
+            plan.Errors = make(map[string]uint64)
+        }
+
+        plan.Errors[class.String()] = count
+    }
+
+    return plan, nil
+}
@@ -0,0 +1,92 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "encoding/json"
+    "testing"
+)
+
+func TestPlanChanges(t *testing.T) {
+    var applyConfig config.ApplyConfig
+
+    nodes := []config.Node{
+        {Path: "services/test/frontend", Value: `{"ipv4":"10.0.1.1","tcp":80}`},
+        {Path: "services/test/backends/test1", Value: `{"ipv4":"10.1.0.1","tcp":8080,"weight":10}`},
+        {Path: "services/test/backends/test2", Value: `{"ipv4":"10.1.0.2","tcp":8080,"weight":10}`},
+    }
+    configs := []config.Config{
+        &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "test", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}},
+        &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "test", BackendName: "test1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 8080, Weight: 10}},
+        &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "test", BackendName: "test2", Backend: config.ServiceBackend{IPv4: "10.1.0.2", TCP: 8080, Weight: 10}},
+    }
+
+    if err := json.Unmarshal([]byte(`{"services": {"test": {"backends": {"test1": {"weight": 20}, "test2": null, "test3": {"ipv4": "10.1.0.3", "tcp": 8080, "weight": 10}}}}}`), &applyConfig); err != nil {
+        t.Fatalf("json.Unmarshal: %v", err)
+    }
+
+    changes, err := applyConfig.Plan(nodes, false)
+    if err != nil {
+        t.Fatalf("Plan: %v", err)
+    }
+
+    plan, err := PlanChanges(configs, changes, IpvsConfig{NodeName: "test"})
+    if err != nil {
+        t.Fatalf("PlanChanges: %v", err)
+    }
+
+    expectedChanges := []PlanChange{
+        {Action: config.SetConfig, Path: "services/test/backends/test1", Value: `{"ipv4":"10.1.0.1","tcp":8080,"weight":20}`},
+        {Action: config.DelConfig, Path: "services/test/backends/test2"},
+        {Action: config.SetConfig, Path: "services/test/backends/test3", Value: `{"ipv4":"10.1.0.3","tcp":8080,"weight":10}`},
+    }
+    expectedOperations := []string{
+        "SetDest inet+tcp://10.0.1.1:80 10.1.0.1:8080 fwd=masq weight=20",
+        "DelDest inet+tcp://10.0.1.1:80 10.1.0.2:8080",
+        "NewDest inet+tcp://10.0.1.1:80 10.1.0.3:8080 fwd=masq weight=10",
+    }
+
+    if len(plan.Changes) != len(expectedChanges) {
+        t.Errorf("plan changes: %#v", plan.Changes)
+    } else {
+        for i, change := range plan.Changes {
+            if change != expectedChanges[i] {
+                t.Errorf("plan change %d: %#v", i, change)
+            }
+        }
+    }
+
+    if len(plan.Operations) != len(expectedOperations) {
+        t.Errorf("plan operations: %v", plan.Operations)
+    } else {
+        for i, operation := range plan.Operations {
+            if operation.String() != expectedOperations[i] {
+                t.Errorf("plan operation %d: %v", i, operation)
+            }
+        }
+    }
+
+    if len(plan.Errors) != 0 {
+        t.Errorf("plan errors: %v", plan.Errors)
+    }
+}
+
+func TestPlanChangesErrors(t *testing.T) {
+    configs := []config.Config{
+        &config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "test", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 80}},
+    }
+    changes := []config.ApplyChange{
+        {Action: config.SetConfig, Node: config.Node{Path: "services/other/frontend", Value: `{"ipv4":"10.0.1.1","tcp":80}`}},
+    }
+
+    plan, err := PlanChanges(configs, changes, IpvsConfig{NodeName: "test", Strict: true})
+    if err != nil {
+        t.Fatalf("PlanChanges: %v", err)
+    }
+
+    if len(plan.Operations) != 0 {
+        t.Errorf("plan operations: %v", plan.Operations)
+    }
+    if plan.Errors["config"] != 1 {
+        t.Errorf("plan errors: %v", plan.Errors)
+    }
+}
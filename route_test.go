@@ -53,7 +53,7 @@ func TestDelConfigRoutes(t *testing.T) {
     services.NewConfig(&config.ConfigRoute{ConfigSource: "test2", RouteName:"test2", Route:config.Route{Prefix4:"10.0.2.0/24", IpvsMethod:"droute"}})
 
     // sync
-    if _, err := services.SyncIPVS(IpvsConfig{mock: true}); err != nil {
+    if _, err := services.SyncIPVS(IpvsConfig{Mock: true}); err != nil {
         t.Fatalf("services.SyncIPVS: %v", err)
     }
 
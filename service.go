@@ -5,7 +5,10 @@ package clusterf
 
 import (
     "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/errs"
     "log"
+    "sort"
+    "time"
 )
 
 type Service struct {
@@ -14,21 +17,59 @@ type Service struct {
     Frontend    *config.ServiceFrontend
     Backends    map[string]config.ServiceBackend
 
+    // active shift between groups, replacing the Frontend.Group
+    Shift       *config.ServiceShift
+    shiftTime   time.Time
+
+    // A/B experiments, using the alternate weights of the active experiment
+    Experiments map[string]config.ServiceExperiment
+    experiment  string
+
+    // shared with Services, used to lookup the Frontend.Group backends
+    groups      Groups
+
+    // shared with Services, counting driver errors by class
+    errors      *errs.Counter
+
     driverFrontend  *ipvsFrontend
     driverBackends  map[string]*ipvsBackend
+
+    // active backends from Frontend.Group, or the Shift groups, keyed by group/backend
+    driverGroupBackends map[string]*ipvsBackend
+
+    // local host backend for any Frontend.Interface, drained while not listening
+    driverLocal     *ipvsBackend
+    localListening  bool
 }
 
-func newService(name string) *Service {
+func newService(name string, groups Groups, errors *errs.Counter) *Service {
     return &Service{
         Name:           name,
         Backends:       make(map[string]config.ServiceBackend),
+        Experiments:    make(map[string]config.ServiceExperiment),
+        groups:         groups,
+        errors:         errors,
+
+        driverBackends:         make(map[string]*ipvsBackend),
+        driverGroupBackends:    make(map[string]*ipvsBackend),
+    }
+}
 
-        driverBackends: make(map[string]*ipvsBackend),
+// Service is configured to use backends from the named group
+func (self *Service) hasGroup(groupName string) bool {
+    if self.Frontend == nil {
+        return false
+    } else if self.Shift != nil {
+        return self.Shift.From == groupName || self.Shift.To == groupName
+    } else {
+        return self.Frontend.Group == groupName
     }
 }
 
 func (self *Service) driverError(err error) {
-    log.Printf("cluster:Service %s: Error: %s\n", self.Name, err)
+    class := self.errors.Count(err)
+
+    log.Printf("cluster:Service %s: Error (%s): %s\n", self.Name, class, err)
 }
 
 /* Configuration actions */
@@ -69,53 +110,188 @@ func (self *Service) configBackend(backendName string, action config.Action, bac
             return
         }
 
+        // update before setBackend, so that the priority tiers match
+        self.Backends[backendName] = backendConfig.Backend
+
         if self.Frontend != nil {
             self.setBackend(backendName, backendConfig.Backend)
+            self.syncBackends()
         }
 
-        self.Backends[backendName] = backendConfig.Backend
-
     case config.DelConfig:
         if self.Frontend != nil {
             self.delBackend(backendName)
         }
 
         delete(self.Backends, backendName)
+
+        if self.Frontend != nil {
+            self.syncBackends()
+        }
+    }
+}
+
+func (self *Service) configShift(action config.Action, shiftConfig *config.ConfigServiceShift) {
+    shift := shiftConfig.Shift
+
+    log.Printf("clusterf:Service %s: Shift: %s %+v <- %+v\n", self.Name, action, shift, self.Shift)
+
+    self.shiftTime = time.Now()
+
+    switch action {
+    case config.NewConfig:
+        self.Shift = &shift
+
+    case config.SetConfig:
+        if self.Shift != nil && *self.Shift == shift {
+            return
+        }
+
+        self.Shift = &shift
+
+    case config.DelConfig:
+        if self.Shift == nil {
+            return
+        }
+
+        self.Shift = nil
+    }
+
+    if action != config.NewConfig && self.Frontend != nil {
+        self.syncGroupBackends()
+        self.syncBackends()
     }
 }
 
 // Synchronize state to IPVS
 func (self *Service) sync(driver *IPVSDriver) {
-    self.driverFrontend = driver.newFrontend()
+    self.driverFrontend = driver.newFrontend(self.Name)
 
     if self.Frontend != nil {
         // also adds backends
         self.newFrontend(*self.Frontend)
     }
+
+    // record the start of any active experiment
+    self.syncExperiment()
 }
 
 /* Frontend actions */
 func (self *Service) newFrontend(frontend config.ServiceFrontend) {
+    self.addFrontend(frontend)
+    self.syncFrontend()
+}
+
+// Add the frontend and backends, without applying the params of any merged IPVS services
+func (self *Service) addFrontend(frontend config.ServiceFrontend) {
     log.Printf("clusterf:Service %s: new Frontend: %+v\n", self.Name, frontend)
 
     if err := self.driverFrontend.add(frontend); err != nil {
         self.driverError(err)
     }
 
+    if frontend.Shadow != "" {
+        self.syncShadow()
+    }
+
+    if frontend.Interface != "" {
+        self.newLocalBackend(frontend)
+    }
+
+    subset := self.subset()
+    activePriority := self.activePriority()
+
     for backendName, backend := range self.Backends {
-        self.newBackend(backendName, backend)
+        if subset.contains(backendName) {
+            self.newBackend(backendName, backend, activePriority)
+        }
+    }
+
+    for groupKey, backend := range self.groupBackends() {
+        if subset.contains(groupKey) {
+            self.newGroupBackend(groupKey, backend, activePriority)
+        }
+    }
+}
+
+// Apply the params of any merged IPVS services, once the backends are up
+func (self *Service) syncFrontend() {
+    if err := self.driverFrontend.sync(); err != nil {
+        self.driverError(err)
     }
 }
 
 func (self *Service) setFrontend(frontend config.ServiceFrontend) {
     log.Printf("clusterf:Service %s: set Frontend: %+v\n", self.Name, frontend)
 
-    if self.Frontend != nil {
-        // TODO: smoother setup-before-teardown transition..?
+    if self.Frontend == nil {
+        self.newFrontend(frontend)
+
+    } else if filterFrontend(*self.Frontend, frontend) {
+        // update the source address filter and shadow in-place, without replacing the IPVS services
+        if err := self.driverFrontend.setFilter(frontend); err != nil {
+            self.driverError(err)
+        }
+
+        self.syncShadow()
+
+    } else if announceFrontend(*self.Frontend, frontend) {
+        // the announcers are updated by Services.inject()
+
+    } else if self.driverFrontend.driver.applyOrder == ApplyDelFirst {
         self.delFrontend()
+        self.newFrontend(frontend)
+
+    } else {
+        // setup the new frontend and backends before tearing down the old ones, and only then update the service params; the driver merges any overlapping services and dests
+        driverFrontend := self.driverFrontend
+        driverBackends := self.driverBackends
+        driverGroupBackends := self.driverGroupBackends
+        driverLocal := self.driverLocal
+
+        self.driverFrontend = driverFrontend.driver.newFrontend(self.Name)
+        self.driverBackends = make(map[string]*ipvsBackend)
+        self.driverGroupBackends = make(map[string]*ipvsBackend)
+        self.driverLocal = nil
+
+        self.addFrontend(frontend)
+
+        for _, driverBackend := range driverBackends {
+            if err := driverBackend.del(); err != nil {
+                self.driverError(err)
+            }
+        }
+        for _, driverBackend := range driverGroupBackends {
+            if err := driverBackend.del(); err != nil {
+                self.driverError(err)
+            }
+        }
+        if driverLocal == nil {
+
+        } else if err := driverLocal.del(); err != nil {
+            self.driverError(err)
+        }
+
+        if err := driverFrontend.del(); err != nil {
+            self.driverError(err)
+        }
+
+        self.syncFrontend()
     }
+}
+
+// The frontends only differ by their source address filter or shadow group
+func filterFrontend(old config.ServiceFrontend, new config.ServiceFrontend) bool {
+    old.Allow, old.Deny, old.Shadow = new.Allow, new.Deny, new.Shadow
 
-    self.newFrontend(frontend)
+    return old == new
+}
+
+// The frontends only differ by their announcer
+func announceFrontend(old config.ServiceFrontend, new config.ServiceFrontend) bool {
+    old.Announce = new.Announce
+
+    return old == new
 }
 
 func (self *Service) delFrontend() {
@@ -130,13 +306,215 @@ func (self *Service) delFrontend() {
     for backendName, _ := range self.driverBackends {
         delete(self.driverBackends, backendName)
     }
+    for groupKey, _ := range self.driverGroupBackends {
+        delete(self.driverGroupBackends, groupKey)
+    }
+    self.driverLocal = nil
+}
+
+// Return the configured backends from the frontend group, or the shift groups, keyed by group/backend.
+//
+// The weights of the shift group backends are scaled by the shift progress, with any zero-weight backends drained.
+// Any active experiment weights replace the shifted weights.
+func (self *Service) groupBackends() map[string]config.ServiceBackend {
+    var groupBackends = make(map[string]config.ServiceBackend)
+
+    if self.Shift != nil {
+        progress := self.Shift.Progress(self.shiftTime)
+
+        for backendName, backend := range self.groups.backends(self.Shift.From) {
+            groupBackends[groupBackendKey(self.Shift.From, backendName)] = shiftBackend(backend, 1.0 - progress)
+        }
+        for backendName, backend := range self.groups.backends(self.Shift.To) {
+            groupBackends[groupBackendKey(self.Shift.To, backendName)] = shiftBackend(backend, progress)
+        }
+    } else if groupName := self.driverFrontend.config.Group; groupName != "" {
+        for backendName, backend := range self.groups.backends(groupName) {
+            groupBackends[groupBackendKey(groupName, backendName)] = backend
+        }
+    }
+
+    for groupKey, backend := range groupBackends {
+        groupBackends[groupKey] = self.experimentBackend(groupKey, backend)
+    }
+
+    return groupBackends
+}
+
+func groupBackendKey(groupName string, backendName string) string {
+    return groupName + "/" + backendName
+}
+
+// Scale the backend weight by the fraction of the shift, draining the backend once the scaled weight rounds down to zero
+func shiftBackend(backend config.ServiceBackend, fraction float64) config.ServiceBackend {
+    var weight = backend.Weight
+
+    if fraction >= 1.0 {
+        return backend
+    } else if weight == 0 {
+        weight = uint(IPVS_WEIGHT)
+    }
+
+    if backend.Weight = uint(float64(weight) * fraction + 0.5); backend.Weight == 0 {
+        backend.Drain = true
+    }
+
+    return backend
+}
+
+// Update the active backends after changes to the configured backends.
+func (self *Service) syncBackends() {
+    self.syncSubset()
+    self.syncPriority()
+}
+
+/* Backend subsetting */
+
+// Return the subset of configured backends to use on this node, given the frontend Subset.
+// Group backends are keyed by group/backend.
+func (self *Service) subset() subset {
+    var keys []string
+
+    if self.driverFrontend.config.Subset == 0 {
+        return nil
+    }
+
+    for backendName, _ := range self.Backends {
+        keys = append(keys, backendName)
+    }
+    for groupKey, _ := range self.groupBackends() {
+        keys = append(keys, groupKey)
+    }
+
+    return makeSubset(self.driverFrontend.driver.nodeName + "/" + self.Name, keys, self.driverFrontend.config.Subset)
+}
+
+// Add any backends that are now part of the subset, and remove any backends that are no longer part of the subset, in the driver applyOrder.
+func (self *Service) syncSubset() {
+    subset := self.subset()
+
+    if subset == nil {
+        return
+    }
+
+    if self.driverFrontend.driver.applyOrder == ApplyDelFirst {
+        self.syncSubsetDel(subset)
+        self.syncSubsetAdd(subset)
+    } else {
+        self.syncSubsetAdd(subset)
+        self.syncSubsetDel(subset)
+    }
+}
+
+func (self *Service) syncSubsetAdd(subset subset) {
+    activePriority := self.activePriority()
+
+    for backendName, backend := range self.Backends {
+        if self.driverBackends[backendName] == nil && subset.contains(backendName) {
+            self.newBackend(backendName, backend, activePriority)
+        }
+    }
+    for groupKey, backend := range self.groupBackends() {
+        if self.driverGroupBackends[groupKey] == nil && subset.contains(groupKey) {
+            self.newGroupBackend(groupKey, backend, activePriority)
+        }
+    }
+}
+
+func (self *Service) syncSubsetDel(subset subset) {
+    for backendName, _ := range self.driverBackends {
+        if !subset.contains(backendName) {
+            self.delBackend(backendName)
+        }
+    }
+    for groupKey, _ := range self.driverGroupBackends {
+        if !subset.contains(groupKey) {
+            self.delGroupBackend(groupKey)
+        }
+    }
+}
+
+/* Backend priority tiers */
+
+// Return the lowest backend priority that is active, given the currently configured backends.
+//
+// Backends are used from the highest priority tier downwards, until at least the frontend PriorityMinUndrained backends are active.
+// Drained backends do not count as active, and the backends are not health-checked, so failed backends only count once drained.
+//
+// This scans all of the backends, so callers adding multiple backends compute it once and pass it to newBackend/newGroupBackend.
+func (self *Service) activePriority() uint {
+    var priorities []uint
+    var subset = self.subset()
+
+    for backendName, backend := range self.Backends {
+        if subset.contains(backendName) && !backend.Drain {
+            priorities = append(priorities, backend.Priority)
+        }
+    }
+    for groupKey, backend := range self.groupBackends() {
+        if subset.contains(groupKey) && !backend.Drain {
+            priorities = append(priorities, backend.Priority)
+        }
+    }
+
+    return activePriority(priorities, self.driverFrontend.config.PriorityMinUndrained)
+}
+
+func activePriority(priorities []uint, threshold uint) uint {
+    if threshold == 0 {
+        threshold = 1
+    }
+
+    sort.Sort(sort.Reverse(uintSlice(priorities)))
+
+    for i, priority := range priorities {
+        if uint(i + 1) < threshold {
+            continue
+        } else if i + 1 < len(priorities) && priorities[i + 1] == priority {
+            // include the complete tier
+            continue
+        } else {
+            return priority
+        }
+    }
+
+    // not enough backends; use all
+    return 0
+}
+
+type uintSlice []uint
+
+func (self uintSlice) Len() int             { return len(self) }
+func (self uintSlice) Less(i, j int) bool   { return self[i] < self[j] }
+func (self uintSlice) Swap(i, j int)        { self[i], self[j] = self[j], self[i] }
+
+// Update the standby state of all active backends after changes to the configured backends.
+func (self *Service) syncPriority() {
+    activePriority := self.activePriority()
+
+    for backendName, driverBackend := range self.driverBackends {
+        if err := driverBackend.setStandby(self.Backends[backendName].Priority < activePriority); err != nil {
+            self.driverError(err)
+        }
+    }
+
+    groupBackends := self.groupBackends()
+
+    for groupKey, driverBackend := range self.driverGroupBackends {
+        if err := driverBackend.setStandby(groupBackends[groupKey].Priority < activePriority); err != nil {
+            self.driverError(err)
+        }
+    }
 }
 
 /* Backend actions */
-func (self *Service) newBackend(backendName string, backend config.ServiceBackend) {
+func (self *Service) newBackend(backendName string, backend config.ServiceBackend, activePriority uint) {
+    backend = self.experimentBackend(backendName, backend)
+
     log.Printf("clusterf:Service %s: new Backend %s: %+v\n", self.Name, backendName, backend)
 
-    self.driverBackends[backendName] = self.driverFrontend.newBackend()
+    self.driverBackends[backendName] = self.driverFrontend.newBackend(backendName)
+    self.driverBackends[backendName].standby = backend.Priority < activePriority
 
     if err := self.driverBackends[backendName].add(backend); err != nil {
         self.driverError(err)
@@ -144,10 +522,14 @@ func (self *Service) newBackend(backendName string, backend config.ServiceBacken
 }
 
 func (self *Service) setBackend(backendName string, backend config.ServiceBackend) {
+    backend = self.experimentBackend(backendName, backend)
+
     log.Printf("clusterf:Service %s: set Backend %s: %+v\n", self.Name, backendName, backend)
 
-    if driverBackend := self.driverBackends[backendName]; driverBackend == nil {
-        self.newBackend(backendName, backend)
+    if driverBackend := self.driverBackends[backendName]; !self.subset().contains(backendName) {
+        // handled by syncSubset
+    } else if driverBackend == nil {
+        self.newBackend(backendName, backend, self.activePriority())
     } else if err := driverBackend.set(backend); err != nil {
         self.driverError(err)
     }
@@ -156,9 +538,139 @@ func (self *Service) setBackend(backendName string, backend config.ServiceBacken
 func (self *Service) delBackend(backendName string) {
     log.Printf("clusterf:Service %s: del Backend %s: %+v\n", self.Name, backendName, self.Backends[backendName])
 
-    if err := self.driverBackends[backendName].del(); err != nil {
+    if driverBackend := self.driverBackends[backendName]; driverBackend == nil {
+        // not in subset
+    } else if err := driverBackend.del(); err != nil {
         self.driverError(err)
     }
 
     delete(self.driverBackends, backendName)
 }
+
+/* Local backend actions */
+func (self *Service) localBackend(frontend config.ServiceFrontend) config.ServiceBackend {
+    // the ports default to the frontend backend ports
+    return config.ServiceBackend{IPv4: frontend.IPv4, IPv6: frontend.IPv6, Drain: !self.localListening}
+}
+
+func (self *Service) newLocalBackend(frontend config.ServiceFrontend) {
+    self.localListening = self.driverFrontend.listening()
+
+    log.Printf("clusterf:Service %s: new Local Backend: interface=%s listening=%v\n", self.Name, frontend.Interface, self.localListening)
+
+    self.driverLocal = self.driverFrontend.newBackend(LOCAL_BACKEND)
+
+    if err := self.driverLocal.add(self.localBackend(frontend)); err != nil {
+        self.driverError(err)
+    }
+}
+
+// Drain or undrain the local backend, if the local host has stopped or started listening on the frontend ports
+func (self *Service) updateLocal() {
+    if self.driverLocal == nil {
+        return
+    } else if listening := self.driverFrontend.listening(); listening == self.localListening {
+        return
+    } else {
+        self.localListening = listening
+    }
+
+    log.Printf("clusterf:Service %s: set Local Backend: listening=%v\n", self.Name, self.localListening)
+
+    if err := self.driverLocal.set(self.localBackend(self.driverFrontend.config)); err != nil {
+        self.driverError(err)
+    }
+}
+
+/* Group backend actions */
+func (self *Service) newGroupBackend(groupKey string, backend config.ServiceBackend, activePriority uint) {
+    log.Printf("clusterf:Service %s: new Group Backend %s: %+v\n", self.Name, groupKey, backend)
+
+    self.driverGroupBackends[groupKey] = self.driverFrontend.newBackend(groupKey)
+    self.driverGroupBackends[groupKey].standby = backend.Priority < activePriority
+
+    if err := self.driverGroupBackends[groupKey].add(backend); err != nil {
+        self.driverError(err)
+    }
+}
+
+// Update the group backend after changes to the configured group backend
+func (self *Service) setGroupBackend(groupKey string) {
+    backend, exists := self.groupBackends()[groupKey]
+
+    log.Printf("clusterf:Service %s: set Group Backend %s: %+v\n", self.Name, groupKey, backend)
+
+    if driverBackend := self.driverGroupBackends[groupKey]; !exists {
+        // not used by the service
+    } else if !self.subset().contains(groupKey) {
+        // handled by syncSubset
+    } else if driverBackend == nil {
+        self.newGroupBackend(groupKey, backend, self.activePriority())
+    } else if err := driverBackend.set(backend); err != nil {
+        self.driverError(err)
+    }
+}
+
+func (self *Service) delGroupBackend(groupKey string) {
+    log.Printf("clusterf:Service %s: del Group Backend %s\n", self.Name, groupKey)
+
+    if driverBackend := self.driverGroupBackends[groupKey]; driverBackend == nil {
+
+    } else if err := driverBackend.del(); err != nil {
+        self.driverError(err)
+    }
+
+    delete(self.driverGroupBackends, groupKey)
+}
+
+// Update the active group backends after changes to the shift groups or progress, in the driver applyOrder.
+//
+// Only the weights of any remaining group backends are updated; any other changes to the group backends are applied via setGroupBackend.
+func (self *Service) syncGroupBackends() {
+    groupBackends := self.groupBackends()
+
+    if self.driverFrontend.driver.applyOrder == ApplyDelFirst {
+        self.syncGroupBackendsDel(groupBackends)
+        self.syncGroupBackendsSet(groupBackends)
+    } else {
+        self.syncGroupBackendsSet(groupBackends)
+        self.syncGroupBackendsDel(groupBackends)
+    }
+}
+
+func (self *Service) syncGroupBackendsSet(groupBackends map[string]config.ServiceBackend) {
+    subset := self.subset()
+    activePriority := self.activePriority()
+
+    for groupKey, backend := range groupBackends {
+        if driverBackend := self.driverGroupBackends[groupKey]; !subset.contains(groupKey) {
+            // handled by syncSubset
+        } else if driverBackend == nil {
+            self.newGroupBackend(groupKey, backend, activePriority)
+        } else if driverBackend.configWeight == backend.Weight && driverBackend.drain == backend.Drain {
+            // unchanged
+        } else if err := driverBackend.set(backend); err != nil {
+            self.driverError(err)
+        }
+    }
+}
+
+func (self *Service) syncGroupBackendsDel(groupBackends map[string]config.ServiceBackend) {
+    for groupKey, _ := range self.driverGroupBackends {
+        if _, exists := groupBackends[groupKey]; !exists {
+            self.delGroupBackend(groupKey)
+        }
+    }
+}
+
+// Update the group backend weights for the shift progress at the given time
+func (self *Service) updateShift(now time.Time) {
+    if self.Shift == nil || self.Frontend == nil {
+        return
+    }
+
+    self.shiftTime = now
+
+    self.syncGroupBackends()
+    self.syncBackends()
+}
@@ -2,10 +2,75 @@ package clusterf
 
 import (
     "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/errs"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
     "syscall"
     "testing"
+    "time"
 )
 
+// Build an ipvs.Service from the ipvs.Service String() form
+func testService(service string) (ipvsService ipvs.Service) {
+    if serviceURL, err := url.Parse(service); err != nil {
+        panic(err)
+    } else if serviceURL.Scheme == "inet+fwmark" || serviceURL.Scheme == "inet6+fwmark" {
+        if fwmark, err := strconv.Atoi(serviceURL.Host); err != nil {
+            panic(err)
+        } else if serviceURL.Scheme == "inet+fwmark" {
+            ipvsService.Af, ipvsService.Protocol, ipvsService.FwMark = syscall.AF_INET, syscall.IPPROTO_TCP, uint32(fwmark)
+        } else {
+            ipvsService.Af, ipvsService.Protocol, ipvsService.FwMark = syscall.AF_INET6, syscall.IPPROTO_TCP, uint32(fwmark)
+        }
+    } else if host, port, err := net.SplitHostPort(serviceURL.Host); err != nil {
+        panic(err)
+    } else if portValue, err := strconv.Atoi(port); err != nil {
+        panic(err)
+    } else {
+        switch serviceURL.Scheme {
+        case "inet+tcp":    ipvsService.Af, ipvsService.Protocol = syscall.AF_INET, syscall.IPPROTO_TCP
+        case "inet+udp":    ipvsService.Af, ipvsService.Protocol = syscall.AF_INET, syscall.IPPROTO_UDP
+        case "inet6+tcp":   ipvsService.Af, ipvsService.Protocol = syscall.AF_INET6, syscall.IPPROTO_TCP
+        case "inet6+udp":   ipvsService.Af, ipvsService.Protocol = syscall.AF_INET6, syscall.IPPROTO_UDP
+        case "inet+sctp":   ipvsService.Af, ipvsService.Protocol = syscall.AF_INET, syscall.IPPROTO_SCTP
+        case "inet6+sctp":  ipvsService.Af, ipvsService.Protocol = syscall.AF_INET6, syscall.IPPROTO_SCTP
+        default:
+            panic(fmt.Errorf("invalid service: %v", service))
+        }
+
+        ipvsService.Addr = net.ParseIP(host)
+        ipvsService.Port = uint16(portValue)
+    }
+
+    return
+}
+
+// Build an ipvs.Dest from the ipvs.Dest String() form
+func testDest(dest string) (ipvsDest ipvs.Dest) {
+    if host, port, err := net.SplitHostPort(dest); err != nil {
+        panic(err)
+    } else if portValue, err := strconv.Atoi(port); err != nil {
+        panic(err)
+    } else {
+        ipvsDest.Addr = net.ParseIP(host)
+        ipvsDest.Port = uint16(portValue)
+    }
+
+    return
+}
+
+// Build an ipvsKey from the ipvs.Service/Dest String() forms
+func testKey(service string, dest string) ipvsKey {
+    ipvsService := testService(service)
+    ipvsDest := testDest(dest)
+
+    return makeKey(&ipvsService, &ipvsDest)
+}
+
 // trivial testcase with a single service with a single backend on startup
 func TestNewService(t *testing.T) {
     serviceFrontend := config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}
@@ -50,7 +115,7 @@ func TestServiceSync(t *testing.T) {
     services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:serviceBackend})
 
     // sync
-    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", mock: true})
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", Mock: true})
     if err != nil {
         t.Fatalf("services.SyncIPVS: %v", err)
     }
@@ -99,7 +164,7 @@ func TestServiceSync(t *testing.T) {
     }
 
     // test ipvsDriver.dests
-    ipvsKey := ipvsKey{"inet+tcp://10.0.1.1:80", "10.1.0.1:80"}
+    ipvsKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
 
     if len(ipvsDriver.dests) != 1 {
         t.Errorf("incorrect sync dests: %v", ipvsDriver.dests)
@@ -121,7 +186,7 @@ func TestServiceAdd(t *testing.T) {
     services := NewServices()
 
     // sync
-    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", mock: true})
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", Mock: true})
     if err != nil {
         t.Fatalf("services.SyncIPVS: %v", err)
     }
@@ -131,7 +196,7 @@ func TestServiceAdd(t *testing.T) {
     services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:serviceBackend}})
 
     // test ipvsDriver.dests
-    ipvsKey := ipvsKey{"inet+tcp://10.0.1.1:80", "10.1.0.1:80"}
+    ipvsKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
 
     if len(ipvsDriver.dests) != 1 {
         t.Errorf("incorrect sync dests: %v", ipvsDriver.dests)
@@ -140,3 +205,1339 @@ func TestServiceAdd(t *testing.T) {
         t.Errorf("missing sync dest: %v", ipvsKey)
     }
 }
+
+// Test group backends being shared by multiple services
+func TestServiceGroup(t *testing.T) {
+    groupBackend := config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}
+
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test1", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Group:"test"}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test2", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", TCP:80, Group:"test"}})
+    services.NewConfig(&config.ConfigGroupBackend{ConfigSource:"test", GroupName:"test", BackendName:"test1", Backend:groupBackend})
+
+    // sync
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    for _, key := range []ipvsKey{
+        testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80"),
+        testKey("inet+tcp://10.0.1.2:80", "10.1.0.1:80"),
+    } {
+        if ipvsDriver.dests[key] == nil {
+            t.Errorf("missing sync dest: %v", key)
+        }
+    }
+
+    // update group
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigGroupBackend{ConfigSource:"test", GroupName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}}})
+
+    for _, key := range []ipvsKey{
+        testKey("inet+tcp://10.0.1.1:80", "10.1.0.2:80"),
+        testKey("inet+tcp://10.0.1.2:80", "10.1.0.2:80"),
+    } {
+        if ipvsDriver.dests[key] == nil {
+            t.Errorf("missing set dest: %v", key)
+        }
+    }
+
+    // delete group
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigGroup{ConfigSource:"test", GroupName:"test"}})
+
+    if len(ipvsDriver.dests) != 0 {
+        t.Errorf("remaining dests after group delete: %v", ipvsDriver.dests)
+    }
+}
+
+// Test the config names tracked for the stats labels, including merged dests
+func TestServiceNames(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Group:"web"}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigGroupBackend{ConfigSource:"test", GroupName:"web", BackendName:"web1", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    mergeKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
+    groupKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.2:80")
+
+    if name := ipvsDriver.serviceName(mergeKey.Service); name != "test" {
+        t.Errorf("incorrect service name: %v", name)
+    }
+    if name := ipvsDriver.destName(mergeKey); name != "test1,test2" {
+        t.Errorf("incorrect merged dest name: %v", name)
+    }
+    if name := ipvsDriver.destName(groupKey); name != "web/web1" {
+        t.Errorf("incorrect group dest name: %v", name)
+    }
+    if name := ipvsDriver.keyName(groupKey); name != "test/web/web1" {
+        t.Errorf("incorrect group dest key name: %v", name)
+    }
+    if name := services.services["test"].driverGroupBackends["web/web1"].String(); name != "test/web/web1" {
+        t.Errorf("incorrect group backend name: %v", name)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1"}})
+
+    if name := ipvsDriver.destName(mergeKey); name != "test2" {
+        t.Errorf("incorrect unmerged dest name: %v", name)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test"}})
+
+    if len(ipvsDriver.serviceNames) != 0 || len(ipvsDriver.destNames) != 0 {
+        t.Errorf("remaining names after frontend delete: %v %v", ipvsDriver.serviceNames, ipvsDriver.destNames)
+    }
+}
+
+// Test the names of merged services, which fall back to the remaining service once the most recent one is removed
+func TestServiceMergeNames(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test1", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    serviceKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80").Service
+
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test2", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}}})
+
+    if name := ipvsDriver.serviceName(serviceKey); name != "test2" {
+        t.Errorf("incorrect merged service name: %v", name)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test2"}})
+
+    if name := ipvsDriver.serviceName(serviceKey); name != "test1" {
+        t.Errorf("incorrect unmerged service name: %v", name)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test1"}})
+
+    if len(ipvsDriver.serviceNames) != 0 {
+        t.Errorf("remaining names after frontend delete: %v", ipvsDriver.serviceNames)
+    }
+}
+
+// Test the merged dest weights in the kernel IPVS state, using the ipvs.FakeClient
+func TestServiceMergeWeights(t *testing.T) {
+    services := NewServices()
+    client := ipvs.NewFakeClient()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:10}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:20}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client}); err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    testDests := func(step string, expected string) {
+        var out []string
+
+        if dests, err := client.ListDests(testService("inet+tcp://10.0.1.1:80")); err != nil {
+            t.Errorf("%s: ListDests: %v", step, err)
+        } else {
+            for _, dest := range dests {
+                out = append(out, fmt.Sprintf("%v=%d", dest, dest.Weight))
+            }
+        }
+
+        if fmt.Sprintf("%v", out) != expected {
+            t.Errorf("%s: dests %v != %v", step, out, expected)
+        }
+    }
+
+    testDests("merge", "[10.1.0.1:80=30]")
+
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:5}}})
+
+    testDests("set weight", "[10.1.0.1:80=15]")
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1"}})
+
+    testDests("unmerge", "[10.1.0.1:80=5]")
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2"}})
+
+    testDests("delete", "[]")
+}
+
+// Test the params of merged services in the kernel IPVS state, which are only applied once the dests are up, and restored once the most recent service is removed
+func TestServiceMergeParams(t *testing.T) {
+    services := NewServices()
+    client := ipvs.NewFakeClient()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test1", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test1", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:10}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test2", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80, Weight:10}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    var actions []string
+
+    ipvsDriver.trace = func(action string, ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) {
+        actions = append(actions, action)
+    }
+
+    testService := func(step string, timeout uint32) {
+        if service, err := client.GetService(testService("inet+tcp://10.0.1.1:80")); err != nil {
+            t.Errorf("%s: GetService: %v", step, err)
+        } else if service.Timeout != timeout || (timeout != 0) != service.Flags.Persistent {
+            t.Errorf("%s: service %v timeout=%d flags=%v", step, service, service.Timeout, service.Flags)
+        }
+
+        if repairs, err := ipvsDriver.Verify(); err != nil {
+            t.Errorf("%s: Verify: %v", step, err)
+        } else if repairs != 0 {
+            t.Errorf("%s: Verify: %d repairs", step, repairs)
+        }
+    }
+
+    testService("new", 0)
+
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test2", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Persistence:config.Duration(300 * time.Second)}}})
+
+    if fmt.Sprintf("%v", actions) != "[upService upDest syncService]" {
+        t.Errorf("merge actions: %v", actions)
+    }
+
+    testService("merge", 300)
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test2"}})
+
+    testService("unmerge", 0)
+
+    // replacing a frontend only updates the service params once the old dests are removed
+    actions = nil
+
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test1", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Persistence:config.Duration(60 * time.Second)}}})
+
+    if fmt.Sprintf("%v", actions) != "[upService upDest downDest downService syncService]" {
+        t.Errorf("replace actions: %v", actions)
+    }
+
+    testService("replace", 60)
+}
+
+// Test rejecting overlapping services and dests in strict mode, except when replacing the same frontend or backend
+func TestServiceStrict(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", Mock: true, Strict: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}}})
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"alias", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}}})
+
+    serviceKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
+
+    // the test2 dest and the alias service
+    if stats := services.errors.Stats(); stats.Config != 2 {
+        t.Errorf("strict errors: %+v", stats)
+    }
+    if name := ipvsDriver.serviceName(serviceKey.Service); name != "test" {
+        t.Errorf("incorrect service name: %v", name)
+    }
+    if dest := ipvsDriver.dests[serviceKey]; dest == nil || dest.Weight != 10 || ipvsDriver.destName(serviceKey) != "test1" {
+        t.Errorf("incorrect dest: %v %v", dest, ipvsDriver.destName(serviceKey))
+    }
+
+    // replacing the frontend and backend re-adds them before removing the old ones
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Persistence:config.Duration(300 * time.Second)}}})
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:20}}})
+
+    // the test2 dest is rejected again when replacing the frontend
+    if stats := services.errors.Stats(); stats.Config != 3 {
+        t.Errorf("strict errors after set: %+v", stats)
+    }
+    if dest := ipvsDriver.dests[serviceKey]; dest == nil || dest.Weight != 20 || ipvsDriver.destName(serviceKey) != "test1" {
+        t.Errorf("incorrect dest after set: %v %v", dest, ipvsDriver.destName(serviceKey))
+    }
+}
+
+// Test that a backend set rejected as an overlap keeps the old dest, which can then be removed
+func TestServiceStrictSet(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80, Weight:5}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "masq", SchedName: "wlc", Mock: true, Strict: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:20}}})
+
+    if stats := services.errors.Stats(); stats.Config != 1 {
+        t.Errorf("strict errors: %+v", stats)
+    }
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.2:80")]; dest == nil || dest.Weight != 5 {
+        t.Errorf("incorrect dest after set: %v", dest)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2"}})
+
+    if len(ipvsDriver.dests) != 1 {
+        t.Errorf("incorrect dests after del: %v", ipvsDriver.dests)
+    }
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")]; dest == nil || dest.Weight != 10 || ipvsDriver.destName(testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")) != "test1" {
+        t.Errorf("incorrect dest after del: %v", dest)
+    }
+}
+
+// Test backends without ports using the frontend backend port mapping
+func TestServiceBackendPort(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:443, UDP:53, BackendTCP:8443}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1"}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:443}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    for _, key := range []ipvsKey{
+        testKey("inet+tcp://10.0.1.1:443", "10.1.0.1:8443"),
+        testKey("inet+tcp://10.0.1.1:443", "10.1.0.2:443"),
+        testKey("inet+udp://10.0.1.1:53", "10.1.0.1:53"),
+    } {
+        if ipvsDriver.dests[key] == nil {
+            t.Errorf("missing sync dest: %v", key)
+        }
+    }
+
+    if len(ipvsDriver.dests) != 3 {
+        t.Errorf("incorrect sync dests: %v", ipvsDriver.dests)
+    }
+}
+
+// Test the frontend persistence timeout in seconds
+func TestServicePersistence(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:443, Persistence:config.Duration(90500 * time.Millisecond)}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"other", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", TCP:443}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    persistentService := testService("inet+tcp://10.0.1.1:443")
+    otherService := testService("inet+tcp://10.0.1.2:443")
+
+    if service := ipvsDriver.services[makeServiceKey(&persistentService)]; service == nil {
+        t.Errorf("missing service")
+    } else if service.Timeout != 91 || !service.Flags.Persistent {
+        t.Errorf("persistent service: timeout=%d flags=%v", service.Timeout, service.Flags)
+    }
+
+    if service := ipvsDriver.services[makeServiceKey(&otherService)]; service == nil {
+        t.Errorf("missing service")
+    } else if service.Timeout != 0 || service.Flags.Persistent {
+        t.Errorf("non-persistent service: timeout=%d flags=%v", service.Timeout, service.Flags)
+    }
+}
+
+// Test the frontend persistence netmasks for each address family
+func TestServicePersistenceNetmask(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", IPv6:"2001:db8::1", TCP:443, Persistence:config.Duration(5 * time.Minute), PersistenceNetmask4:24, PersistenceNetmask6:64}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    for _, test := range []struct{
+        service string
+        netmask uint32
+    }{
+        {"inet+tcp://10.0.1.1:443", 0xffffff00},
+        {"inet6+tcp://[2001:db8::1]:443", 64},
+    } {
+        ipvsService := testService(test.service)
+
+        if service := ipvsDriver.services[makeServiceKey(&ipvsService)]; service == nil {
+            t.Errorf("missing service %s", test.service)
+        } else if service.Netmask != test.netmask || !service.Flags.Persistent {
+            t.Errorf("service %s: netmask=%#08x flags=%v", test.service, service.Netmask, service.Flags)
+        }
+    }
+}
+
+// Test a frontend using the same port and backends for both protocols
+func TestServiceProtocols(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"dns", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:53, UDP:53, Port:53, Protocols:config.ProtocolTCP | config.ProtocolUDP}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"dns", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:5353, UDP:5353, Port:5353}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    keys := []ipvsKey{
+        testKey("inet+tcp://10.0.1.1:53", "10.1.0.1:5353"),
+        testKey("inet+udp://10.0.1.1:53", "10.1.0.1:5353"),
+    }
+
+    for _, key := range keys {
+        if dest := ipvsDriver.dests[key]; dest == nil || dest.Weight != 10 {
+            t.Errorf("invalid sync dest %v: %v", key, dest)
+        }
+    }
+
+    if len(ipvsDriver.dests) != 2 {
+        t.Errorf("incorrect sync dests: %v", ipvsDriver.dests)
+    }
+
+    // drain applies to both protocols
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"dns", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:5353, UDP:5353, Port:5353, Drain:true}}})
+
+    for _, key := range keys {
+        if dest := ipvsDriver.dests[key]; dest == nil || dest.Weight != 0 {
+            t.Errorf("dest not drained %v: %v", key, dest)
+        }
+    }
+}
+
+// Test separate sets of backends for each protocol
+func TestServiceProtocolBackends(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, UDP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"app", Backend:config.ServiceBackend{IPv4:"10.1.0.1", Protocols:config.ProtocolTCP}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"quic", Backend:config.ServiceBackend{IPv4:"10.2.0.1", UDP:8443, Protocols:config.ProtocolUDP}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"both", Backend:config.ServiceBackend{IPv4:"10.3.0.1"}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    for _, key := range []ipvsKey{
+        testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80"),
+        testKey("inet+udp://10.0.1.1:80", "10.2.0.1:8443"),
+        testKey("inet+tcp://10.0.1.1:80", "10.3.0.1:80"),
+        testKey("inet+udp://10.0.1.1:80", "10.3.0.1:80"),
+    } {
+        if ipvsDriver.dests[key] == nil {
+            t.Errorf("missing sync dest: %v", key)
+        }
+    }
+
+    if len(ipvsDriver.dests) != 4 {
+        t.Errorf("incorrect sync dests: %v", ipvsDriver.dests)
+    }
+}
+
+// Test an SCTP frontend, with backends using the frontend port
+func TestServiceSCTP(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"diameter", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", IPv6:"2001:db8::1", SCTP:3868}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"diameter", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1"}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"diameter", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", SCTP:13868}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"diameter", BackendName:"web", Backend:config.ServiceBackend{IPv4:"10.1.0.3", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    for _, key := range []ipvsKey{
+        testKey("inet+sctp://10.0.1.1:3868", "10.1.0.1:3868"),
+        testKey("inet+sctp://10.0.1.1:3868", "10.1.0.2:13868"),
+    } {
+        if dest := ipvsDriver.dests[key]; dest == nil || dest.Weight != 10 {
+            t.Errorf("invalid sync dest %v: %v", key, dest)
+        }
+    }
+
+    if len(ipvsDriver.dests) != 2 {
+        t.Errorf("incorrect sync dests: %v", ipvsDriver.dests)
+    }
+}
+
+// Test droute backends with a different port than the frontend, which IPVS cannot translate
+func TestServiceDroutePort(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:8080}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{FwdMethod: "droute", Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")]; dest == nil {
+        t.Errorf("missing sync dest for the same port")
+    }
+
+    if len(ipvsDriver.dests) != 1 {
+        t.Errorf("incorrect sync dests: %v", ipvsDriver.dests)
+    }
+
+    if errorStats := services.ErrorStats(); errorStats.Config != 1 {
+        t.Errorf("incorrect error stats: %+v", errorStats)
+    }
+
+    // a rejected port change keeps the existing dest and weight, and can still be removed
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:8080, Weight:20}}})
+
+    if errorStats := services.ErrorStats(); errorStats.Config != 2 {
+        t.Errorf("incorrect error stats after set: %+v", errorStats)
+    }
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")]; dest == nil || dest.Weight != 10 {
+        t.Errorf("incorrect dest after set: %v", dest)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1"}})
+
+    if len(ipvsDriver.dests) != 0 {
+        t.Errorf("incorrect dests after del: %v", ipvsDriver.dests)
+    }
+}
+
+func TestServiceIPv6Only(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv6:"2001:db8::1", TCP:80, Persistence:config.Duration(5 * time.Minute)}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv6:"2001:db8:1::1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", IPv6:"2001:db8:1::2", TCP:80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test4", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", IPv6:"2001:db8::2", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{IPv6Only: true, Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    if len(ipvsDriver.services) != 1 {
+        t.Errorf("incorrect services: %v", ipvsDriver.services)
+    }
+    for _, ipvsService := range ipvsDriver.services {
+        if ipvsService.Af != syscall.AF_INET6 || ipvsService.Netmask != 128 {
+            t.Errorf("incorrect service: %#v", ipvsService)
+        }
+    }
+
+    if dest := ipvsDriver.dests[testKey("inet6+tcp://[2001:db8::1]:80", "[2001:db8:1::1]:80")]; dest == nil {
+        t.Errorf("missing IPv6 dest")
+    }
+    if len(ipvsDriver.dests) != 1 {
+        t.Errorf("incorrect dests: %v", ipvsDriver.dests)
+    }
+
+    if errorStats := services.ErrorStats(); errorStats.Config != 2 {
+        t.Errorf("incorrect error stats: %+v", errorStats)
+    }
+}
+
+var testActivePriority = []struct {
+    priorities  []uint
+    threshold   uint
+    active      uint
+}{
+    {nil, 0, 0},
+    {[]uint{0, 0}, 0, 0},
+    {[]uint{10, 0}, 0, 10},
+    {[]uint{10, 0}, 1, 10},
+    {[]uint{10, 0}, 2, 0},
+    {[]uint{10, 10, 5, 5, 0}, 2, 10},
+    {[]uint{10, 10, 5, 5, 0}, 3, 5},
+    {[]uint{10, 10, 5, 5, 0}, 5, 0},
+    {[]uint{10, 10, 5, 5, 0}, 6, 0},
+}
+
+func TestActivePriority(t *testing.T) {
+    for _, test := range testActivePriority {
+        if active := activePriority(test.priorities, test.threshold); active != test.active {
+            t.Errorf("fail activePriority(%v, %v): %v != %v", test.priorities, test.threshold, active, test.active)
+        }
+    }
+}
+
+// Test standby backends being promoted when the primary backends go away
+func TestServicePriority(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Priority:10}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"standby", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    primaryKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
+    standbyKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.2:80")
+
+    if dest := ipvsDriver.dests[primaryKey]; dest == nil || dest.Weight != 10 {
+        t.Errorf("invalid primary dest: %v", dest)
+    }
+    if dest := ipvsDriver.dests[standbyKey]; dest == nil || dest.Weight != 0 {
+        t.Errorf("invalid standby dest: %v", dest)
+    }
+
+    // promote
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary"}})
+
+    if dest := ipvsDriver.dests[primaryKey]; dest != nil {
+        t.Errorf("remaining primary dest: %v", dest)
+    }
+    if dest := ipvsDriver.dests[standbyKey]; dest == nil || dest.Weight != 10 {
+        t.Errorf("standby dest not promoted: %v", dest)
+    }
+
+    // demote
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Priority:10}}})
+
+    if dest := ipvsDriver.dests[primaryKey]; dest == nil || dest.Weight != 10 {
+        t.Errorf("invalid primary dest: %v", dest)
+    }
+    if dest := ipvsDriver.dests[standbyKey]; dest == nil || dest.Weight != 0 {
+        t.Errorf("standby dest not demoted: %v", dest)
+    }
+}
+
+// Test drained backends, which also promote any standby backends
+func TestServiceDrain(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Priority:10}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"standby", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    primaryKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
+    standbyKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.2:80")
+
+    // drain
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Priority:10, Drain:true}}})
+
+    if dest := ipvsDriver.dests[primaryKey]; dest == nil || dest.Weight != 0 {
+        t.Errorf("primary dest not drained: %v", dest)
+    }
+    if dest := ipvsDriver.dests[standbyKey]; dest == nil || dest.Weight != 10 {
+        t.Errorf("standby dest not promoted: %v", dest)
+    }
+
+    // undrain
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Priority:10}}})
+
+    if dest := ipvsDriver.dests[primaryKey]; dest == nil || dest.Weight != 10 {
+        t.Errorf("primary dest not undrained: %v", dest)
+    }
+    if dest := ipvsDriver.dests[standbyKey]; dest == nil || dest.Weight != 0 {
+        t.Errorf("standby dest not demoted: %v", dest)
+    }
+}
+
+// Test the minimum number of non-drained primary backends, promoting the standby backends once any primary backend is drained
+func TestServicePriorityMinUndrained(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, PriorityMinUndrained:2}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Priority:10}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80, Priority:10}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"standby", Backend:config.ServiceBackend{IPv4:"10.1.0.3", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    primaryKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
+    standbyKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.3:80")
+
+    if dest := ipvsDriver.dests[standbyKey]; dest == nil || dest.Weight != 0 {
+        t.Errorf("invalid standby dest: %v", dest)
+    }
+
+    // drain one of the primary backends
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"primary2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80, Priority:10, Drain:true}}})
+
+    if dest := ipvsDriver.dests[primaryKey]; dest == nil || dest.Weight != 10 {
+        t.Errorf("invalid primary dest: %v", dest)
+    }
+    if dest := ipvsDriver.dests[standbyKey]; dest == nil || dest.Weight != 10 {
+        t.Errorf("standby dest not promoted: %v", dest)
+    }
+}
+
+func TestServiceFwMark(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", IPv6:"2001:db8::1", FwMark:1}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1"}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", IPv6:"2001:db8:1::2", Port:8080}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    if len(ipvsDriver.services) != 2 {
+        t.Errorf("services: %v", ipvsDriver.services)
+    }
+
+    for _, key := range []ipvsKey{
+        testKey("inet+fwmark://1", "10.1.0.1:0"),
+        testKey("inet+fwmark://1", "10.1.0.2:8080"),
+        testKey("inet6+fwmark://1", "[2001:db8:1::2]:8080"),
+    } {
+        if dest := ipvsDriver.dests[key]; dest == nil {
+            t.Errorf("missing dest %v", key)
+        }
+    }
+
+    if len(ipvsDriver.dests) != 3 {
+        t.Errorf("dests: %v", ipvsDriver.dests)
+    }
+}
+
+func TestServiceTunnel(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+
+    for _, ipvsConfig := range []IpvsConfig{
+        {Mock: true, FwdMethod: "tunnel", TunType: "gue"},
+        {Mock: true, FwdMethod: "tunnel", TunType: "gre", TunPort: 6080},
+        {Mock: true, FwdMethod: "tunnel", TunFlags: "csum"},
+        {Mock: true, FwdMethod: "tunnel", TunType: "vxlan"},
+    } {
+        if _, err := ipvsConfig.setup(services.routes); err == nil {
+            t.Errorf("setup %+v: no error", ipvsConfig)
+        } else if class := errs.Classify(err); class != errs.Config {
+            t.Errorf("setup %+v: %v error: %v", ipvsConfig, class, err)
+        }
+    }
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true, FwdMethod: "tunnel", TunType: "gue", TunPort: 6080, TunFlags: "csum"})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")]; dest == nil {
+        t.Errorf("missing dest")
+    } else if dest.TunType != ipvs.IP_VS_CONN_F_TUNNEL_TYPE_GUE || dest.TunPort != 6080 || dest.TunFlags != ipvs.IP_VS_TUNNEL_ENCAP_FLAG_CSUM {
+        t.Errorf("dest tunnel: %#v", dest)
+    }
+}
+
+// Test tunnel dests for backends with only an address of the other af than the frontend
+func TestServiceMixedAf(t *testing.T) {
+    for _, test := range []struct{
+        fwdMethod   string
+        kernel      ipvs.KernelVersion
+        dests       int
+    }{
+        {"tunnel",  ipvs.KernelVersion{Major: 5, Minor: 10}, 4},
+        {"tunnel",  ipvs.KernelVersion{Major: 3, Minor: 16}, 2},
+        {"masq",    ipvs.KernelVersion{Major: 5, Minor: 10}, 2},
+    } {
+        services := NewServices()
+        client := ipvs.NewFakeClient()
+        client.Info.KernelVersion = test.kernel
+
+        services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", IPv6:"2001:db8::1", TCP:80}})
+        services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+        services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv6:"2001:db8:1::2", TCP:80}})
+
+        ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, FwdMethod: test.fwdMethod})
+        if err != nil {
+            t.Fatalf("services.SyncIPVS: %v", err)
+        }
+
+        if len(ipvsDriver.dests) != test.dests {
+            t.Errorf("%s %v: dests: %v", test.fwdMethod, test.kernel, ipvsDriver.dests)
+        }
+
+        if test.dests < 4 {
+            continue
+        }
+
+        if dests, err := client.ListDests(testService("inet6+tcp://[2001:db8::1]:80")); err != nil {
+            t.Errorf("ListDests: %v", err)
+        } else if len(dests) != 2 {
+            t.Errorf("inet6 dests: %v", dests)
+        } else if dest := dests[0]; dest.String() != "10.1.0.1:80" || dest.Af != syscall.AF_INET {
+            t.Errorf("inet6 dest for inet backend: %#v", dest)
+        }
+
+        if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "[2001:db8:1::2]:80")]; dest == nil || dest.Af != syscall.AF_INET6 {
+            t.Errorf("inet dest for inet6 backend: %#v", dest)
+        }
+    }
+}
+
+func TestServiceThresholds(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, UThresh:100}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    testKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
+
+    if dest := ipvsDriver.dests[testKey]; dest == nil || dest.UThresh != 100 || dest.LThresh != 0 {
+        t.Errorf("new dest thresholds: %#v", dest)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, UThresh:200, LThresh:100}}})
+
+    if dest := ipvsDriver.dests[testKey]; dest == nil || dest.UThresh != 200 || dest.LThresh != 100 || dest.Weight != 10 {
+        t.Errorf("set dest thresholds: %#v", dest)
+    }
+
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}}})
+
+    if dest := ipvsDriver.dests[testKey]; dest == nil || dest.UThresh != 0 || dest.LThresh != 0 {
+        t.Errorf("unset dest thresholds: %#v", dest)
+    }
+}
+
+// Test shifting a service between groups by scaling the group backend weights
+func TestServiceShift(t *testing.T) {
+    services := NewServices()
+    start := time.Now()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Group:"blue"}})
+    services.NewConfig(&config.ConfigGroupBackend{ConfigSource:"test", GroupName:"blue", BackendName:"blue1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigGroupBackend{ConfigSource:"test", GroupName:"green", BackendName:"green1", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80, Weight:20}})
+    services.NewConfig(&config.ConfigServiceShift{ConfigSource:"test", ServiceName:"test", Shift:config.ServiceShift{From:"blue", To:"green", Start:start, Duration:config.Duration(10 * time.Minute)}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    blueKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")
+    greenKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.2:80")
+
+    for _, step := range []struct{
+        elapsed     time.Duration
+        blueWeight  uint32
+        greenWeight uint32
+    }{
+        {0,                 10, 0},
+        {5 * time.Minute,   5,  10},
+        {9 * time.Minute,   1,  18},
+        {10 * time.Minute,  0,  20},
+        {15 * time.Minute,  0,  20},
+    } {
+        services.UpdateShifts(start.Add(step.elapsed))
+
+        if dest := ipvsDriver.dests[blueKey]; dest == nil || dest.Weight != step.blueWeight {
+            t.Errorf("shift %v: blue dest weight != %d: %v", step.elapsed, step.blueWeight, dest)
+        }
+        if dest := ipvsDriver.dests[greenKey]; dest == nil || dest.Weight != step.greenWeight {
+            t.Errorf("shift %v: green dest weight != %d: %v", step.elapsed, step.greenWeight, dest)
+        }
+    }
+
+    // group backend changes apply at the shifted weight
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigGroupBackend{ConfigSource:"test", GroupName:"blue", BackendName:"blue2", Backend:config.ServiceBackend{IPv4:"10.1.0.3", TCP:80}}})
+
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.3:80")]; dest == nil || dest.Weight != 0 {
+        t.Errorf("new blue dest not drained: %v", dest)
+    }
+
+    // finish
+    services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Group:"green"}}})
+    services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceShift{ConfigSource:"test", ServiceName:"test"}})
+
+    if dest := ipvsDriver.dests[blueKey]; dest != nil {
+        t.Errorf("blue dest not removed: %v", dest)
+    }
+    if dest := ipvsDriver.dests[greenKey]; dest == nil || dest.Weight != 20 {
+        t.Errorf("green dest not active: %v", dest)
+    }
+    if len(ipvsDriver.dests) != 1 {
+        t.Errorf("remaining dests after shift: %v", ipvsDriver.dests)
+    }
+}
+
+func TestSubset(t *testing.T) {
+    keys := []string{"test1", "test2", "test3", "test4"}
+
+    testSubset := makeSubset("node1/test", keys, 2)
+
+    if len(testSubset) != 2 {
+        t.Errorf("fail makeSubset: %v", testSubset)
+    }
+
+    // removing an unused key does not change the subset
+    for i, key := range keys {
+        if testSubset.contains(key) {
+            continue
+        }
+
+        otherKeys := append(append([]string{}, keys[:i]...), keys[i+1:]...)
+
+        if otherSubset := makeSubset("node1/test", otherKeys, 2); fmt.Sprintf("%v", otherSubset) != fmt.Sprintf("%v", testSubset) {
+            t.Errorf("fail makeSubset without %v: %v != %v", key, otherSubset, testSubset)
+        }
+    }
+
+    var nilSubset subset
+
+    if !nilSubset.contains("test") {
+        t.Errorf("fail nil subset.contains")
+    }
+}
+
+// Test the distribution of the subsets of sequentially named backends across sequentially named nodes
+func TestSubsetDistribution(t *testing.T) {
+    var keys []string
+    var counts = make(map[string]int)
+
+    for i := 0; i < 100; i++ {
+        keys = append(keys, fmt.Sprintf("backend%02d", i))
+    }
+
+    for i := 0; i < 1000; i++ {
+        for key, _ := range makeSubset(fmt.Sprintf("node%03d/test", i), keys, 10) {
+            counts[key]++
+        }
+    }
+
+    // each backend is expected to be chosen by 100 nodes
+    for _, key := range keys {
+        if count := counts[key]; count < 70 || count > 130 {
+            t.Errorf("backend %s is used by %d nodes", key, count)
+        }
+    }
+}
+
+// Test backend subsetting replacing removed backends
+func TestServiceSubset(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Subset:2}})
+    for i := 1; i <= 4; i++ {
+        services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:fmt.Sprintf("test%d", i), Backend:config.ServiceBackend{IPv4:fmt.Sprintf("10.1.0.%d", i), TCP:80}})
+    }
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "node1", Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    service := services.services["test"]
+
+    if len(ipvsDriver.dests) != 2 || len(service.driverBackends) != 2 {
+        t.Errorf("incorrect subset dests: %v", ipvsDriver.dests)
+    }
+
+    for backendName, _ := range service.driverBackends {
+        services.ConfigEvent(config.Event{Action:config.DelConfig, Config:&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:backendName}})
+
+        break
+    }
+
+    if len(ipvsDriver.dests) != 2 || len(service.driverBackends) != 2 {
+        t.Errorf("incorrect subset dests after delete: %v", ipvsDriver.dests)
+    }
+}
+
+// Test the apply order when replacing the frontend, checking that the service never has zero dests when adding first
+func TestServiceApplyOrder(t *testing.T) {
+    for _, applyOrder := range []string{ApplyAddFirst, ApplyDelFirst} {
+        services := NewServices()
+
+        services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+        services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+        services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+        services.NewConfig(&config.ConfigGroupBackend{ConfigSource:"test", GroupName:"web", BackendName:"web1", Backend:config.ServiceBackend{IPv4:"10.1.0.3", TCP:80}})
+
+        ipvsDriver, err := services.SyncIPVS(IpvsConfig{ApplyOrder: applyOrder, Mock: true})
+        if err != nil {
+            t.Fatalf("services.SyncIPVS: %v", err)
+        }
+
+        // count the service dests after each change
+        serviceKey := testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80").Service
+        minDests := len(ipvsDriver.dests)
+
+        ipvsDriver.trace = func(action string, ipvsService *ipvs.Service, ipvsDest *ipvs.Dest) {
+            dests := 0
+
+            if ipvsDriver.services[serviceKey] != nil {
+                for ipvsKey, _ := range ipvsDriver.dests {
+                    if ipvsKey.Service == serviceKey {
+                        dests++
+                    }
+                }
+            }
+
+            if dests < minDests {
+                minDests = dests
+            }
+        }
+
+        services.ConfigEvent(config.Event{Action:config.SetConfig, Config:&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, Group:"web"}}})
+
+        switch applyOrder {
+        case ApplyAddFirst:
+            if minDests == 0 {
+                t.Errorf("%s: service without dests", applyOrder)
+            }
+        case ApplyDelFirst:
+            if minDests != 0 {
+                t.Errorf("%s: service was not removed: %d dests", applyOrder, minDests)
+            }
+        }
+
+        if ipvsDriver.serviceRefs[serviceKey] != 1 {
+            t.Errorf("%s: incorrect service refs: %v", applyOrder, ipvsDriver.serviceRefs)
+        }
+        if len(ipvsDriver.dests) != 3 {
+            t.Errorf("%s: incorrect dests: %v", applyOrder, ipvsDriver.dests)
+        }
+        for ipvsKey, ipvsDest := range ipvsDriver.dests {
+            if ipvsDest.Weight != 10 || ipvsDriver.destRefs[ipvsKey] != 1 {
+                t.Errorf("%s: incorrect dest %v: weight=%d refs=%d", applyOrder, ipvsDest, ipvsDest.Weight, ipvsDriver.destRefs[ipvsKey])
+            }
+        }
+    }
+}
+
+// Test a full resync, adding, updating and removing configs
+func TestServiceResync(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"old", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    services.Resync([]config.Config{
+        &config.ConfigService{ConfigSource:"test", ServiceName:"test"},
+        &config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}},
+        &config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:20}},
+        &config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test3", Backend:config.ServiceBackend{IPv4:"10.1.0.3", TCP:80}},
+    })
+
+    if len(ipvsDriver.services) != 1 {
+        t.Errorf("incorrect services: %v", ipvsDriver.services)
+    }
+    if len(ipvsDriver.dests) != 2 {
+        t.Errorf("incorrect dests: %v", ipvsDriver.dests)
+    }
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")]; dest == nil || dest.Weight != 20 {
+        t.Errorf("dest not updated: %v", dest)
+    }
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.3:80")]; dest == nil {
+        t.Errorf("dest not added")
+    }
+}
+
+// Test a resync after an update rejected by the admission policy, keeping the last admitted config
+func TestServiceResyncPolicy(t *testing.T) {
+    policy, err := config.PolicyConfig{MaxWeight: 100}.Open()
+    if err != nil {
+        t.Fatalf("PolicyConfig.Open: %v", err)
+    }
+
+    services := NewServices()
+
+    newConfigs, err := policy.AdmitScan([]config.Config{
+        &config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}},
+        &config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:10}},
+    })
+    if err != nil {
+        t.Fatalf("Policy.AdmitScan: %v", err)
+    }
+
+    for _, cfg := range newConfigs {
+        services.NewConfig(cfg)
+    }
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    rejectConfig := &config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80, Weight:200}}
+
+    if err := policy.Admit(config.SetConfig, rejectConfig); err == nil {
+        t.Fatalf("Policy.Admit: no error for rejected weight")
+    }
+
+    resyncConfigs, err := policy.AdmitScan([]config.Config{
+        &config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}},
+        rejectConfig,
+        &config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80, Weight:1000}},
+    })
+    if err != nil {
+        t.Fatalf("Policy.AdmitScan: %v", err)
+    }
+
+    services.Resync(resyncConfigs)
+
+    if len(ipvsDriver.dests) != 1 {
+        t.Errorf("incorrect dests: %v", ipvsDriver.dests)
+    }
+    if dest := ipvsDriver.dests[testKey("inet+tcp://10.0.1.1:80", "10.1.0.1:80")]; dest == nil {
+        t.Errorf("rejected dest removed by resync")
+    } else if dest.Weight != 10 {
+        t.Errorf("rejected dest updated by resync: %v", dest)
+    }
+}
+
+func TestVerifyDests(t *testing.T) {
+    kernelDests := []ipvs.Dest{
+        {Addr: net.ParseIP("10.1.0.1"), Port: 80, Weight: 10, FwdMethod: ipvs.IP_VS_CONN_F_MASQ},
+        {Addr: net.ParseIP("10.1.0.2"), Port: 80, Weight: 10, FwdMethod: ipvs.IP_VS_CONN_F_MASQ},
+        {Addr: net.ParseIP("10.1.0.3"), Port: 80, Weight: 10, FwdMethod: ipvs.IP_VS_CONN_F_MASQ},
+        {Addr: net.ParseIP("10.1.0.5"), Port: 80, Weight: 10, FwdMethod: ipvs.IP_VS_CONN_F_MASQ},
+    }
+    driverDests := make(map[ipvsDestKey]*ipvs.Dest)
+
+    for _, dest := range []*ipvs.Dest{
+        {Addr: net.ParseIP("10.1.0.1").To4(), Port: 80, Weight: 10, FwdMethod: ipvs.IP_VS_CONN_F_MASQ},
+        {Addr: net.ParseIP("10.1.0.2").To4(), Port: 80, Weight: 20, FwdMethod: ipvs.IP_VS_CONN_F_MASQ},
+        {Addr: net.ParseIP("10.1.0.4").To4(), Port: 80, Weight: 10, FwdMethod: ipvs.IP_VS_CONN_F_MASQ},
+        {Addr: net.ParseIP("10.1.0.5").To4(), Port: 80, Weight: 10, FwdMethod: ipvs.IP_VS_CONN_F_MASQ, UThresh: 100},
+    } {
+        driverDests[makeDestKey(dest)] = dest
+    }
+
+    newDests, setDests, delDests := verifyDests(kernelDests, driverDests)
+
+    if len(newDests) != 1 || newDests[0].String() != "10.1.0.4:80" {
+        t.Errorf("incorrect new dests: %v", newDests)
+    }
+    if len(setDests) != 2 || setDests[0].String() != "10.1.0.2:80" || setDests[0].Weight != 20 {
+        t.Errorf("incorrect set dests: %v", setDests)
+    } else if setDests[1].String() != "10.1.0.5:80" || setDests[1].UThresh != 100 {
+        t.Errorf("incorrect set dest thresholds: %v", setDests)
+    }
+    if len(delDests) != 1 || delDests[0].String() != "10.1.0.3:80" {
+        t.Errorf("incorrect del dests: %v", delDests)
+    }
+}
+
+func TestDriverZero(t *testing.T) {
+    services := NewServices()
+    client := makeTestClient()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, UDP:80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"other", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    client.ops = nil
+
+    if count, err := ipvsDriver.Zero("test"); err != nil || count != 2 {
+        t.Errorf("Zero test: %d %v", count, err)
+    }
+    if count, err := ipvsDriver.Zero(""); err != nil || count != 3 {
+        t.Errorf("Zero all: %d %v", count, err)
+    }
+    if _, err := ipvsDriver.Zero("missing"); err == nil {
+        t.Errorf("Zero missing: no error")
+    }
+
+    if ops := fmt.Sprintf("%v", client.ops); ops != "[zero-service inet+tcp://10.0.1.1:80 zero-service inet+udp://10.0.1.1:80 zero]" {
+        t.Errorf("Zero ops: %v", ops)
+    }
+}
+
+func TestDriverVerifyService(t *testing.T) {
+    services := NewServices()
+    client := makeTestClient()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80, UDP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80, UDP:80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"other", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    // lose the udp service, and modify the tcp dests
+    delete(client.services, "inet+udp://10.0.1.1:80")
+    delete(client.dests, "inet+udp://10.0.1.1:80")
+    delete(client.dests["inet+tcp://10.0.1.1:80"], "10.1.0.1:80")
+
+    modifiedDest := client.dests["inet+tcp://10.0.1.1:80"]["10.1.0.2:80"]
+    modifiedDest.Weight = 1
+    client.dests["inet+tcp://10.0.1.1:80"]["10.1.0.2:80"] = modifiedDest
+
+    for _, test := range []struct{
+        backend string
+        repairs int
+        ops     string
+    }{
+        {"test2", 3, "[get-service inet+tcp://10.0.1.1:80 get-dest inet+tcp://10.0.1.1:80 10.1.0.2:80 set-dest inet+tcp://10.0.1.1:80 10.1.0.2:80 masq 10 get-service inet+udp://10.0.1.1:80 new-service inet+udp://10.0.1.1:80 wlc new-dest inet+udp://10.0.1.1:80 10.1.0.2:80 masq 10]"},
+        {"", 1, "[get-service inet+tcp://10.0.1.1:80 new-dest inet+tcp://10.0.1.1:80 10.1.0.1:80 masq 10 get-service inet+udp://10.0.1.1:80]"},
+        {"", 0, "[get-service inet+tcp://10.0.1.1:80 get-service inet+udp://10.0.1.1:80]"},
+    } {
+        client.ops = nil
+
+        if repairs, err := ipvsDriver.VerifyService("test", test.backend); err != nil {
+            t.Errorf("VerifyService test %s: %v", test.backend, err)
+        } else if repairs != test.repairs {
+            t.Errorf("VerifyService test %s: repairs %d != %d", test.backend, repairs, test.repairs)
+        }
+
+        if ops := fmt.Sprintf("%v", client.ops); ops != test.ops {
+            t.Errorf("VerifyService test %s ops: %v", test.backend, ops)
+        }
+    }
+
+    if _, err := ipvsDriver.VerifyService("missing", ""); errs.Classify(err) != errs.Config {
+        t.Errorf("VerifyService missing: %v", err)
+    }
+    if _, err := ipvsDriver.VerifyService("other", "test1"); errs.Classify(err) != errs.Config {
+        t.Errorf("VerifyService other/test1: %v", err)
+    }
+}
+
+func TestDriverRaces(t *testing.T) {
+    services := NewServices()
+    client := makeTestClient()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client}); err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    // a dest left over from another process
+    client.dests["inet+tcp://10.0.1.1:80"]["10.1.0.1:80"] = ipvs.Dest{Addr: net.ParseIP("10.1.0.1").To4(), Port: 80, Weight: 1}
+    client.ops = nil
+
+    services.ConfigEvent(config.Event{Action: config.SetConfig, Config: &config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}}})
+
+    if ops := fmt.Sprintf("%v", client.ops); ops != "[new-dest inet+tcp://10.0.1.1:80 10.1.0.1:80 masq 10 set-dest inet+tcp://10.0.1.1:80 10.1.0.1:80 masq 10]" {
+        t.Errorf("new dest exists ops: %v", ops)
+    }
+
+    // the dest and then the service removed by another process
+    delete(client.dests["inet+tcp://10.0.1.1:80"], "10.1.0.1:80")
+    client.ops = nil
+
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"test", BackendName:"test1"}})
+
+    delete(client.services, "inet+tcp://10.0.1.1:80")
+
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"test"}})
+
+    if ops := fmt.Sprintf("%v", client.ops); ops != "[del-dest inet+tcp://10.0.1.1:80 10.1.0.1:80 del-service inet+tcp://10.0.1.1:80]" {
+        t.Errorf("del not found ops: %v", ops)
+    }
+    if stats := services.ErrorStats(); stats.Kernel != 0 {
+        t.Errorf("errors: %+v", stats)
+    }
+}
+
+func TestDriverTimeout(t *testing.T) {
+    services := NewServices()
+    client := makeTestClient()
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, TimeoutTCP: 1 * time.Hour, TimeoutUDP: 1500 * time.Millisecond}); err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    if len(client.ops) == 0 || client.ops[0] != "set-timeout tcp=3600s tcpfin=0s udp=2s" {
+        t.Errorf("Timeout ops: %v", client.ops)
+    }
+}
+
+func TestDriverSyncDaemon(t *testing.T) {
+    services := NewServices()
+    client := makeTestClient()
+
+    // replace the running backup daemon using a different sync ID
+    client.daemons = []ipvs.Daemon{
+        {State: ipvs.IP_VS_STATE_BACKUP, McastIfn: "eth1", SyncID: 1},
+    }
+
+    driver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client, SyncMaster: "eth1", SyncBackup: "eth1", SyncID: 2})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    expected := []string{
+        "new-daemon master eth1 syncid 2",
+        "del-daemon backup",
+        "new-daemon backup eth1 syncid 2",
+    }
+
+    if len(client.ops) < len(expected) || strings.Join(client.ops[:len(expected)], "\n") != strings.Join(expected, "\n") {
+        t.Errorf("SyncDaemon ops: %v", client.ops)
+    }
+
+    // unchanged
+    client.ops = nil
+
+    if err := driver.StartSync(ipvs.Daemon{State: ipvs.IP_VS_STATE_MASTER, McastIfn: "eth1", SyncID: 2}); err != nil {
+        t.Errorf("StartSync: %v", err)
+    } else if len(client.ops) > 0 {
+        t.Errorf("StartSync ops: %v", client.ops)
+    }
+
+    if err := driver.StopSync(ipvs.IP_VS_STATE_MASTER); err != nil {
+        t.Errorf("StopSync: %v", err)
+    } else if daemons, err := driver.SyncDaemons(); err != nil {
+        t.Errorf("SyncDaemons: %v", err)
+    } else if len(daemons) != 1 || daemons[0].State != ipvs.IP_VS_STATE_BACKUP {
+        t.Errorf("SyncDaemons: %v", daemons)
+    }
+
+    if _, err := NewServices().SyncIPVS(IpvsConfig{NodeName: "test", Client: makeTestClient(), SyncMaster: "eth1", SyncID: 256}); err == nil {
+        t.Errorf("services.SyncIPVS: no error for invalid SyncID")
+    }
+}
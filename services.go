@@ -5,22 +5,74 @@ package clusterf
 
 import (
     "github.com/qmsk/clusterf/config"
+    "github.com/qmsk/clusterf/errs"
     "fmt"
     "log"
+    "sort"
+    "time"
 )
 
 type Services struct {
     services    map[string]*Service
     routes      Routes
+    groups      Groups
+
+    // only handle services within our shard
+    nodeName    string
+    shard       Shard
+    nodeShards  map[string]Shard
+
+    limits      Limits
+    limitStats  LimitStats
+
+    // driver errors by class
+    errors      *errs.Counter
 
     driver      *IPVSDriver
+    injector    *Injector
 }
 
 func NewServices() *Services {
     return &Services{
         services:   make(map[string]*Service),
         routes:     makeRoutes(),
+        groups:     makeGroups(),
+        nodeShards: make(map[string]Shard),
+        errors:     &errs.Counter{},
+    }
+}
+
+// Only handle services within the given shard, ignoring any other services.
+//
+// Must be called before any NewConfig(). The shards advertised by other nodes are checked for any overlap with our shard.
+func (self *Services) SetShard(nodeName string, shard Shard) {
+    self.nodeName = nodeName
+    self.shard = shard
+}
+
+// Return the names of any other nodes with a shard that overlaps our shard
+func (self *Services) ShardOverlaps() []string {
+    var nodeNames []string
+
+    if self.shard.Count == 0 {
+        // not sharded
+        return nil
     }
+
+    for nodeName, shard := range self.nodeShards {
+        if shard.Overlaps(self.shard) {
+            nodeNames = append(nodeNames, nodeName)
+        }
+    }
+
+    sort.Strings(nodeNames)
+
+    return nodeNames
+}
+
+// Return the number of driver errors by class; safe to call from any goroutine
+func (self *Services) ErrorStats() errs.Stats {
+    return self.errors.Stats()
 }
 
 // Return Service for named service, possibly creating a new (empty) Service.
@@ -28,7 +80,7 @@ func (self *Services) get(name string) *Service {
     service, serviceExists := self.services[name]
 
     if !serviceExists {
-        service = newService(name)
+        service = newService(name, self.groups, self.errors)
         self.services[name] = service
 
         // initial sync
@@ -68,6 +120,7 @@ func (self *Services) configService(service *Service, action config.Action, serv
         delete(self.services, service.Name)
 
         service.delFrontend()
+        service.delExperiment()
     }
 }
 
@@ -89,6 +142,88 @@ func (self *Services) configRoute(route *Route, action config.Action, routeConfi
     // TODO: update services?
 }
 
+// Configuration action on a group itself
+// handle group-delete actions, removing the group backends from any referencing services
+func (self *Services) configGroup(group *Group, action config.Action, groupConfig *config.ConfigGroup) {
+    log.Printf("clusterf:Group %s: %s %+v\n", group.Name, action, groupConfig)
+
+    switch action {
+    case config.DelConfig:
+        for backendName, _ := range group.Backends {
+            self.configGroupBackend(group, backendName, action, &config.ConfigGroupBackend{GroupName: group.Name, BackendName: backendName, ConfigSource: groupConfig.ConfigSource})
+        }
+
+        self.groups.del(group.Name)
+    }
+}
+
+// Configuration action on a group backend
+// fans out any changes to all services referencing the group
+func (self *Services) configGroupBackend(group *Group, backendName string, action config.Action, backendConfig *config.ConfigGroupBackend) {
+    log.Printf("clusterf:Group %s: Backend %s: %s %+v <- %+v\n", group.Name, backendName, action, backendConfig.Backend, group.Backends[backendName])
+
+    switch action {
+    case config.NewConfig:
+        // services will pick up the group backends on sync
+        group.Backends[backendName] = backendConfig.Backend
+
+    case config.SetConfig:
+        if backend, exists := group.Backends[backendName]; exists && backend == backendConfig.Backend {
+            return
+        }
+
+        // update before setGroupBackend, so that the priority tiers match
+        group.Backends[backendName] = backendConfig.Backend
+
+        for _, service := range self.services {
+            if service.hasGroup(group.Name) {
+                service.setGroupBackend(groupBackendKey(group.Name, backendName))
+                service.syncBackends()
+            }
+            if service.hasShadow(group.Name) {
+                service.syncShadow()
+            }
+        }
+
+    case config.DelConfig:
+        delete(group.Backends, backendName)
+
+        for _, service := range self.services {
+            if service.hasGroup(group.Name) {
+                service.delGroupBackend(groupBackendKey(group.Name, backendName))
+                service.syncBackends()
+            }
+            if service.hasShadow(group.Name) {
+                service.syncShadow()
+            }
+        }
+    }
+}
+
+// Configuration action on the shard advertised by some node
+func (self *Services) configShard(nodeName string, action config.Action, shardConfig *config.ConfigShard) {
+    if nodeName == self.nodeName {
+        // our own shard
+        return
+    }
+
+    switch action {
+    case config.NewConfig, config.SetConfig:
+        if shard, err := ParseShard(shardConfig.Shard.Shard); err != nil {
+            log.Printf("clusterf:Shard %s: %v\n", nodeName, err)
+        } else {
+            self.nodeShards[nodeName] = shard
+
+            if self.shard.Count != 0 && shard.Overlaps(self.shard) {
+                log.Printf("clusterf:Shard %s: shard %v overlaps with our shard %v\n", nodeName, shard, self.shard)
+            }
+        }
+
+    case config.DelConfig:
+        delete(self.nodeShards, nodeName)
+    }
+}
+
 func (self *Services) config(action config.Action, baseConfig config.Config) {
     log.Printf("clusterf: config %s %#v\n", action, baseConfig)
 
@@ -101,6 +236,10 @@ func (self *Services) config(action config.Action, baseConfig config.Config) {
             for _, service := range self.services {
                 self.configService(service, action, serviceConfig)
             }
+        } else if !self.shard.Contains(serviceConfig.ServiceName) {
+            // not in our shard
+        } else if action != config.DelConfig && self.limitService(serviceConfig.ServiceName) {
+            // over limit
         } else {
             service := self.get(serviceConfig.ServiceName)
 
@@ -110,6 +249,12 @@ func (self *Services) config(action config.Action, baseConfig config.Config) {
     case *config.ConfigServiceFrontend:
         frontendConfig := baseConfig.(*config.ConfigServiceFrontend)
 
+        if !self.shard.Contains(frontendConfig.ServiceName) {
+            return
+        } else if action != config.DelConfig && self.limitService(frontendConfig.ServiceName) {
+            return
+        }
+
         service := self.get(frontendConfig.ServiceName)
 
         service.configFrontend(action, frontendConfig)
@@ -117,6 +262,12 @@ func (self *Services) config(action config.Action, baseConfig config.Config) {
     case *config.ConfigServiceBackend:
         backendConfig := baseConfig.(*config.ConfigServiceBackend)
 
+        if !self.shard.Contains(backendConfig.ServiceName) {
+            return
+        } else if action != config.DelConfig && self.limitService(backendConfig.ServiceName) {
+            return
+        }
+
         service := self.get(backendConfig.ServiceName)
 
         if backendConfig.BackendName == "" {
@@ -124,10 +275,65 @@ func (self *Services) config(action config.Action, baseConfig config.Config) {
             for backendName, _ := range service.Backends {
                 service.configBackend(backendName, action, backendConfig)
             }
+        } else if action != config.DelConfig && self.limitBackend(service, backendConfig.BackendName) {
+            // over limit
         } else {
             service.configBackend(backendConfig.BackendName, action, backendConfig)
         }
 
+    case *config.ConfigServiceShift:
+        if !self.shard.Contains(applyConfig.ServiceName) {
+            return
+        } else if action != config.DelConfig && self.limitService(applyConfig.ServiceName) {
+            return
+        }
+
+        service := self.get(applyConfig.ServiceName)
+
+        service.configShift(action, applyConfig)
+
+    case *config.ConfigServiceExperiment:
+        if !self.shard.Contains(applyConfig.ServiceName) {
+            return
+        } else if action != config.DelConfig && self.limitService(applyConfig.ServiceName) {
+            return
+        }
+
+        service := self.get(applyConfig.ServiceName)
+
+        if applyConfig.ExperimentName == "" {
+            // all service experiments
+            for experimentName, _ := range service.Experiments {
+                service.configExperiment(experimentName, action, applyConfig)
+            }
+        } else {
+            service.configExperiment(applyConfig.ExperimentName, action, applyConfig)
+        }
+
+    case *config.ConfigGroup:
+        if applyConfig.GroupName == "" {
+            // all groups
+            for _, group := range self.groups {
+                self.configGroup(group, action, applyConfig)
+            }
+        } else {
+            group := self.groups.get(applyConfig.GroupName)
+
+            self.configGroup(group, action, applyConfig)
+        }
+
+    case *config.ConfigGroupBackend:
+        group := self.groups.get(applyConfig.GroupName)
+
+        if applyConfig.BackendName == "" {
+            // all group backends
+            for backendName, _ := range group.Backends {
+                self.configGroupBackend(group, backendName, action, applyConfig)
+            }
+        } else {
+            self.configGroupBackend(group, applyConfig.BackendName, action, applyConfig)
+        }
+
     case *config.ConfigRoute:
         if applyConfig.RouteName == "" {
             // all routes
@@ -140,6 +346,19 @@ func (self *Services) config(action config.Action, baseConfig config.Config) {
             self.configRoute(route, action, applyConfig)
         }
 
+    case *config.ConfigShard:
+        if applyConfig.NodeName == "" {
+            // all shards
+            for nodeName, _ := range self.nodeShards {
+                self.configShard(nodeName, action, applyConfig)
+            }
+        } else {
+            self.configShard(applyConfig.NodeName, action, applyConfig)
+        }
+
+    case *config.ConfigStatus:
+        // published for external integrations
+
     default:
         panic(fmt.Errorf("Unknown config type: %#v", baseConfig))
     }
@@ -169,10 +388,20 @@ func (self *Services) SyncIPVS(ipvsConfig IpvsConfig) (*IPVSDriver, error) {
         return nil, err
     }
 
+    self.driver.beginBatch()
+
     for _, service := range self.services {
         service.sync(self.driver)
     }
 
+    if err := self.driver.flushBatch(); err != nil {
+        class := self.errors.Count(err)
+
+        log.Printf("clusterf:Services: SyncIPVS: Error (%s): %s\n", class, err)
+    }
+
+    self.inject()
+
     return self.driver, nil
 }
 
@@ -183,4 +412,97 @@ func (self *Services) ConfigEvent(event config.Event) {
     }
 
     self.config(event.Action, event.Config)
+    self.inject()
+}
+
+// Apply a full re-scan of the configuration, updating the running driver
+//
+// Applies a SetConfig for each scanned config, followed by a DelConfig for any current config that was not scanned.
+func (self *Services) Resync(configs []config.Config) {
+    if self.driver == nil {
+        panic("Resync before driver sync")
+    }
+
+    paths := make(map[string]bool)
+
+    for _, baseConfig := range configs {
+        if baseConfig.Value() == nil {
+            // directory
+            continue
+        }
+
+        paths[baseConfig.Path()] = true
+
+        self.config(config.SetConfig, baseConfig)
+    }
+
+    for serviceName, service := range self.services {
+        for backendName, _ := range service.Backends {
+            if backendConfig := (config.ConfigServiceBackend{ServiceName: serviceName, BackendName: backendName}); !paths[backendConfig.Path()] {
+                self.config(config.DelConfig, &backendConfig)
+            }
+        }
+
+        if shiftConfig := (config.ConfigServiceShift{ServiceName: serviceName}); service.Shift != nil && !paths[shiftConfig.Path()] {
+            self.config(config.DelConfig, &shiftConfig)
+        }
+
+        for experimentName, _ := range service.Experiments {
+            if experimentConfig := (config.ConfigServiceExperiment{ServiceName: serviceName, ExperimentName: experimentName}); !paths[experimentConfig.Path()] {
+                self.config(config.DelConfig, &experimentConfig)
+            }
+        }
+
+        if frontendConfig := (config.ConfigServiceFrontend{ServiceName: serviceName}); service.Frontend != nil && !paths[frontendConfig.Path()] {
+            self.config(config.DelConfig, &frontendConfig)
+        }
+    }
+
+    for groupName, group := range self.groups {
+        for backendName, _ := range group.Backends {
+            if backendConfig := (config.ConfigGroupBackend{GroupName: groupName, BackendName: backendName}); !paths[backendConfig.Path()] {
+                self.config(config.DelConfig, &backendConfig)
+            }
+        }
+    }
+
+    for routeName, _ := range self.routes {
+        if routeConfig := (config.ConfigRoute{RouteName: routeName}); !paths[routeConfig.Path()] {
+            self.config(config.DelConfig, &routeConfig)
+        }
+    }
+
+    for nodeName, _ := range self.nodeShards {
+        if shardConfig := (config.ConfigShard{NodeName: nodeName}); !paths[shardConfig.Path()] {
+            self.config(config.DelConfig, &shardConfig)
+        }
+    }
+
+    self.inject()
+}
+
+// Update the group backend weights of any services with an active shift, for the shift progress at the given time
+func (self *Services) UpdateShifts(now time.Time) {
+    if self.driver == nil {
+        panic("UpdateShifts before driver sync")
+    }
+
+    for _, service := range self.services {
+        service.updateShift(now)
+    }
+
+    self.inject()
+}
+
+// Update the local backends of any frontends with an interface, for any changes in the listening state of the local host
+func (self *Services) UpdateLocal() {
+    if self.driver == nil {
+        panic("UpdateLocal before driver sync")
+    }
+
+    for _, service := range self.services {
+        service.updateLocal()
+    }
+
+    self.inject()
 }
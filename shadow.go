@@ -0,0 +1,122 @@
+package clusterf
+/*
+ * Shadow traffic, duplicating the frontend traffic to a group of test backends using the nftables dup statement.
+ *
+ * The duplicated packets keep the frontend address, so the shadow backends must accept the frontend IPs locally, like droute
+ * backends, and must drop any responses, which would otherwise reach the clients. Each connection is copied to the same shadow
+ * backend by hashing the client address and port.
+ */
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "log"
+    "net"
+    "sort"
+    "strings"
+    "syscall"
+)
+
+// Service frontend is configured to shadow traffic to the named group
+func (self *Service) hasShadow(groupName string) bool {
+    return self.Frontend != nil && self.Frontend.Shadow == groupName
+}
+
+// Return the sorted addresses of the shadow group backends, except for any drained backends
+func (self *Service) shadowAddrs() []net.IP {
+    var addrs []net.IP
+
+    if self.driverFrontend.config.Shadow == "" {
+        return nil
+    }
+
+    for backendName, backend := range self.groups.backends(self.driverFrontend.config.Shadow) {
+        if backend.Drain {
+            continue
+        }
+
+        for _, addr := range []string{backend.IPv4, backend.IPv6} {
+            if addr == "" {
+
+            } else if ip := net.ParseIP(addr); ip == nil {
+                log.Printf("clusterf:Service %s: invalid shadow backend %s address: %s\n", self.Name, backendName, addr)
+            } else if ip4 := ip.To4(); ip4 != nil {
+                addrs = append(addrs, ip4)
+            } else {
+                addrs = append(addrs, ip)
+            }
+        }
+    }
+
+    sort.Slice(addrs, func(i, j int) bool { return bytes.Compare(addrs[i], addrs[j]) < 0 })
+
+    return addrs
+}
+
+// Update the frontend shadow rules for the current shadow group backends
+func (self *Service) syncShadow() {
+    if self.driverFrontend == nil {
+        return
+    } else if err := self.driverFrontend.setShadow(self.shadowAddrs()); err != nil {
+        self.driverError(err)
+    }
+}
+
+func (self *ipvsFrontend) setShadow(shadow []net.IP) error {
+    if equalAddrs(self.shadow, shadow) {
+        return nil
+    }
+
+    log.Printf("clusterf:ipvsFrontend %v setShadow: %v\n", self, shadow)
+
+    self.shadow = shadow
+
+    if self.hasNft() {
+        return self.driver.upNft(self)
+    } else {
+        return self.driver.downNft(self)
+    }
+}
+
+// Shadow backends of the same address family as the ipvs.Service
+func (self *ipvsFrontend) shadowService(ipvsService *ipvs.Service) []net.IP {
+    var addrs []net.IP
+
+    for _, addr := range self.shadow {
+        if (addr.To4() != nil) == (ipvsService.Af == syscall.AF_INET) {
+            addrs = append(addrs, addr)
+        }
+    }
+
+    return addrs
+}
+
+func equalAddrs(a []net.IP, b []net.IP) bool {
+    if len(a) != len(b) {
+        return false
+    }
+
+    for i := range a {
+        if !a[i].Equal(b[i]) {
+            return false
+        }
+    }
+
+    return true
+}
+
+// Return the nft dup address for the shadow backends, hashing the client address and port for multiple backends
+func nftShadow(ipvsService *ipvs.Service, addrs []net.IP) string {
+    if len(addrs) == 1 {
+        return addrs[0].String()
+    }
+
+    var elements []string
+
+    for i, addr := range addrs {
+        elements = append(elements, fmt.Sprintf("%d : %s", i, addr))
+    }
+
+    return fmt.Sprintf("jhash %s saddr . %v sport mod %d map { %s }", nftFamily(ipvsService.Af), ipvsService.Protocol, len(addrs), strings.Join(elements, ", "))
+}
@@ -0,0 +1,113 @@
+package clusterf
+/*
+ * Sharding of services across multiple nodes, using a hash of the service name.
+ *
+ * Each node handles the services whose hash modulo the shard count is one of the shard indexes.
+ */
+
+import (
+    "fmt"
+    "hash/fnv"
+    "strconv"
+    "strings"
+)
+
+// The zero Shard contains all services
+type Shard struct {
+    Count       uint
+    Indexes     []uint
+}
+
+// Parse a shard from "index/count", with multiple comma-separated indexes. The empty string gives the zero Shard.
+func ParseShard(spec string) (shard Shard, err error) {
+    if spec == "" {
+        return shard, nil
+    }
+
+    parts := strings.Split(spec, "/")
+
+    if len(parts) != 2 {
+        return shard, fmt.Errorf("Invalid shard %#v: expected index/count", spec)
+    } else if count, err := strconv.ParseUint(parts[1], 10, 32); err != nil || count == 0 {
+        return shard, fmt.Errorf("Invalid shard %#v count: %#v", spec, parts[1])
+    } else {
+        shard.Count = uint(count)
+    }
+
+    for _, part := range strings.Split(parts[0], ",") {
+        if index, err := strconv.ParseUint(part, 10, 32); err != nil || uint(index) >= shard.Count {
+            return shard, fmt.Errorf("Invalid shard %#v index: %#v", spec, part)
+        } else {
+            shard.Indexes = append(shard.Indexes, uint(index))
+        }
+    }
+
+    return shard, nil
+}
+
+func (self Shard) String() string {
+    var indexes []string
+
+    if self.Count == 0 {
+        return ""
+    }
+
+    for _, index := range self.Indexes {
+        indexes = append(indexes, strconv.FormatUint(uint64(index), 10))
+    }
+
+    return fmt.Sprintf("%s/%d", strings.Join(indexes, ","), self.Count)
+}
+
+func shardHash(serviceName string) uint64 {
+    hash := fnv.New64a()
+
+    hash.Write([]byte(serviceName))
+
+    return hash.Sum64()
+}
+
+func (self Shard) Contains(serviceName string) bool {
+    if self.Count == 0 {
+        return true
+    }
+
+    hashIndex := uint(shardHash(serviceName) % uint64(self.Count))
+
+    for _, index := range self.Indexes {
+        if index == hashIndex {
+            return true
+        }
+    }
+
+    return false
+}
+
+func gcd(a uint, b uint) uint {
+    for b != 0 {
+        a, b = b, a % b
+    }
+
+    return a
+}
+
+// Test if any service could be contained in both shards.
+//
+// The shards i/n and j/m overlap iff i = j modulo gcd(n, m).
+func (self Shard) Overlaps(other Shard) bool {
+    if self.Count == 0 || other.Count == 0 {
+        return true
+    }
+
+    divisor := gcd(self.Count, other.Count)
+
+    for _, index := range self.Indexes {
+        for _, otherIndex := range other.Indexes {
+            if index % divisor == otherIndex % divisor {
+                return true
+            }
+        }
+    }
+
+    return false
+}
@@ -0,0 +1,135 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "testing"
+)
+
+func TestParseShard(t *testing.T) {
+    tests := []struct{
+        spec    string
+        shard   string
+        error   bool
+    }{
+        {"", "", false},
+        {"0/4", "0/4", false},
+        {"1,3/4", "1,3/4", false},
+        {"4/4", "", true},
+        {"0/0", "", true},
+        {"0", "", true},
+        {"x/4", "", true},
+        {"0/4/8", "", true},
+    }
+
+    for _, test := range tests {
+        if shard, err := ParseShard(test.spec); err != nil {
+            if !test.error {
+                t.Errorf("ParseShard(%#v): %v", test.spec, err)
+            }
+        } else if test.error {
+            t.Errorf("ParseShard(%#v): no error", test.spec)
+        } else if shard.String() != test.shard {
+            t.Errorf("ParseShard(%#v): %v != %v", test.spec, shard, test.shard)
+        }
+    }
+}
+
+func TestShardContains(t *testing.T) {
+    var shards []Shard
+
+    for i := 0; i < 4; i++ {
+        if shard, err := ParseShard(fmt.Sprintf("%d/4", i)); err != nil {
+            t.Fatalf("ParseShard: %v", err)
+        } else {
+            shards = append(shards, shard)
+        }
+    }
+
+    counts := make([]int, len(shards))
+
+    for i := 0; i < 1000; i++ {
+        serviceName := fmt.Sprintf("test%d", i)
+        contained := 0
+
+        for shardIndex, shard := range shards {
+            if shard.Contains(serviceName) {
+                counts[shardIndex]++
+                contained++
+            }
+        }
+
+        if contained != 1 {
+            t.Errorf("service %s is contained in %d shards", serviceName, contained)
+        }
+
+        if !(Shard{}).Contains(serviceName) {
+            t.Errorf("service %s is not contained in the zero shard", serviceName)
+        }
+    }
+
+    for shardIndex, count := range counts {
+        if count < 150 {
+            t.Errorf("shard %v only contains %d services", shards[shardIndex], count)
+        }
+    }
+}
+
+func TestShardOverlaps(t *testing.T) {
+    tests := []struct{
+        a       string
+        b       string
+        overlap bool
+    }{
+        {"0/4", "0/4", true},
+        {"0/4", "1/4", false},
+        {"0,1/4", "1,2/4", true},
+        {"0/2", "2/4", true},
+        {"0/2", "1/4", false},
+        {"1/3", "0/2", true},
+        {"0/4", "", true},
+    }
+
+    for _, test := range tests {
+        a, _ := ParseShard(test.a)
+        b, _ := ParseShard(test.b)
+
+        if overlap := a.Overlaps(b); overlap != test.overlap {
+            t.Errorf("%#v.Overlaps(%#v): %v", test.a, test.b, overlap)
+        }
+        if overlap := b.Overlaps(a); overlap != test.overlap {
+            t.Errorf("%#v.Overlaps(%#v): %v", test.b, test.a, overlap)
+        }
+    }
+}
+
+func TestServicesShard(t *testing.T) {
+    shard, _ := ParseShard("0/2")
+    services := NewServices()
+
+    services.SetShard("test1", shard)
+
+    for i := 0; i < 10; i++ {
+        serviceName := fmt.Sprintf("test%d", i)
+
+        services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:serviceName, Frontend:config.ServiceFrontend{IPv4:fmt.Sprintf("10.0.1.%d", i), TCP:80}})
+        services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:serviceName, BackendName:"test1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    }
+
+    for i := 0; i < 10; i++ {
+        serviceName := fmt.Sprintf("test%d", i)
+
+        if _, exists := services.services[serviceName]; exists != shard.Contains(serviceName) {
+            t.Errorf("service %s in shard %v: exists=%v", serviceName, shard, exists)
+        }
+    }
+
+    // overlap detection
+    services.NewConfig(&config.ConfigShard{ConfigSource:"test", NodeName:"test1", Shard:config.Shard{Shard:"0/2"}})
+    services.NewConfig(&config.ConfigShard{ConfigSource:"test", NodeName:"test2", Shard:config.Shard{Shard:"1/2"}})
+    services.NewConfig(&config.ConfigShard{ConfigSource:"test", NodeName:"test3", Shard:config.Shard{Shard:"2/4"}})
+
+    if overlaps := services.ShardOverlaps(); fmt.Sprintf("%v", overlaps) != "[test3]" {
+        t.Errorf("ShardOverlaps: %v", overlaps)
+    }
+}
@@ -0,0 +1,386 @@
+package clusterf
+/*
+ * IPVS statistics, scraped periodically from the kernel and exported in the Prometheus text format, or as a JSON snapshot.
+ */
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "io"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Per-second rates, computed from successive counter snapshots
+type StatsRates struct {
+    Conns       float64 `json:"conns"`
+    InPkts      float64 `json:"in_packets"`
+    OutPkts     float64 `json:"out_packets"`
+    InBytes     float64 `json:"in_bytes"`
+    OutBytes    float64 `json:"out_bytes"`
+}
+
+// Compute the per-second rate between two successive counter values.
+// A decreasing counter is assumed to have been reset, e.g. by re-creating the service.
+func counterRate(prev uint64, value uint64, seconds float64) float64 {
+    if seconds <= 0 {
+        return 0
+    } else if value < prev {
+        return float64(value) / seconds
+    } else {
+        return float64(value - prev) / seconds
+    }
+}
+
+func makeRates(prev ipvs.Stats, stats ipvs.Stats, seconds float64) StatsRates {
+    return StatsRates{
+        Conns:      counterRate(prev.Conns, stats.Conns, seconds),
+        InPkts:     counterRate(prev.InPkts, stats.InPkts, seconds),
+        OutPkts:    counterRate(uint64(prev.OutPkts), uint64(stats.OutPkts), seconds),
+        InBytes:    counterRate(prev.InBytes, stats.InBytes, seconds),
+        OutBytes:   counterRate(prev.OutBytes, stats.OutBytes, seconds),
+    }
+}
+
+type destStats struct {
+    Dest        ipvs.Dest
+    Rates       StatsRates
+
+    // config backend name(s)
+    Name        string
+}
+
+type serviceStats struct {
+    Service     ipvs.Service
+    Rates       StatsRates
+
+    // config service name
+    Name        string
+
+    dests       map[ipvsDestKey]*destStats
+}
+
+type IPVSStats struct {
+    driver      *IPVSDriver
+
+    // latest snapshot, used by ServeHTTP
+    mutex       sync.Mutex
+    time        time.Time
+    services    map[ipvsServiceKey]*serviceStats
+
+    // experiment stats, keyed by service/experiment
+    experiments map[string]*ExperimentResult
+}
+
+func (self *IPVSDriver) NewStats() *IPVSStats {
+    return &IPVSStats{
+        driver:         self,
+        services:       make(map[ipvsServiceKey]*serviceStats),
+        experiments:    make(map[string]*ExperimentResult),
+    }
+}
+
+// Scrape the current kernel stats, computing rates since the previous Update()
+func (self *IPVSStats) Update() error {
+    services := make(map[ipvsServiceKey]*serviceStats)
+
+    if self.driver.ipvsClient == nil {
+        // mock'd
+    } else if ipvsServices, err := self.driver.ipvsClient.ListServices(); err != nil {
+        return fmt.Errorf("ipvs.ListServices: %v", err)
+    } else {
+        for _, ipvsService := range ipvsServices {
+            serviceKey := makeServiceKey(&ipvsService)
+            service := &serviceStats{
+                Service:    ipvsService,
+                Name:       self.driver.serviceName(serviceKey),
+                dests:      make(map[ipvsDestKey]*destStats),
+            }
+
+            if ipvsDests, err := self.driver.ipvsClient.ListDests(ipvsService); err != nil {
+                return fmt.Errorf("ipvs.ListDests %v: %v", ipvsService, err)
+            } else {
+                for _, ipvsDest := range ipvsDests {
+                    destKey := makeDestKey(&ipvsDest)
+
+                    service.dests[destKey] = &destStats{
+                        Dest:   ipvsDest,
+                        Name:   self.driver.destName(ipvsKey{serviceKey, destKey}),
+                    }
+                }
+            }
+
+            services[serviceKey] = service
+        }
+    }
+
+    self.update(time.Now(), services)
+
+    return nil
+}
+
+// Replace the current snapshot, computing rates for any services and dests in the previous snapshot
+func (self *IPVSStats) update(now time.Time, services map[ipvsServiceKey]*serviceStats) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    seconds := now.Sub(self.time).Seconds()
+
+    for serviceKey, service := range services {
+        prevService := self.services[serviceKey]
+
+        if prevService == nil {
+            // new service, no rates yet
+            continue
+        }
+
+        service.Rates = makeRates(prevService.Service.Stats, service.Service.Stats, seconds)
+
+        for destKey, dest := range service.dests {
+            if prevDest := prevService.dests[destKey]; prevDest != nil {
+                dest.Rates = makeRates(prevDest.Dest.Stats, dest.Dest.Stats, seconds)
+            }
+        }
+    }
+
+    self.updateExperiments(now, services)
+
+    self.time = now
+    self.services = services
+}
+
+/* Prometheus text format */
+type statsMetric struct {
+    name    string
+    help    string
+    counter func(stats ipvs.Stats) uint64
+    rate    func(rates StatsRates) float64
+}
+
+var statsMetrics = []statsMetric{
+    {"conns", "Connections scheduled",
+        func(stats ipvs.Stats) uint64 { return stats.Conns },
+        func(rates StatsRates) float64 { return rates.Conns },
+    },
+    {"in_packets", "Incoming packets",
+        func(stats ipvs.Stats) uint64 { return stats.InPkts },
+        func(rates StatsRates) float64 { return rates.InPkts },
+    },
+    {"out_packets", "Outgoing packets",
+        func(stats ipvs.Stats) uint64 { return stats.OutPkts },
+        func(rates StatsRates) float64 { return rates.OutPkts },
+    },
+    {"in_bytes", "Incoming bytes",
+        func(stats ipvs.Stats) uint64 { return stats.InBytes },
+        func(rates StatsRates) float64 { return rates.InBytes },
+    },
+    {"out_bytes", "Outgoing bytes",
+        func(stats ipvs.Stats) uint64 { return stats.OutBytes },
+        func(rates StatsRates) float64 { return rates.OutBytes },
+    },
+}
+
+type statsServiceList []*serviceStats
+
+func (self statsServiceList) Len() int              { return len(self) }
+func (self statsServiceList) Swap(i, j int)         { self[i], self[j] = self[j], self[i] }
+func (self statsServiceList) Less(i, j int) bool    { return self[i].Service.String() < self[j].Service.String() }
+
+type statsDestList []*destStats
+
+func (self statsDestList) Len() int                 { return len(self) }
+func (self statsDestList) Swap(i, j int)            { self[i], self[j] = self[j], self[i] }
+func (self statsDestList) Less(i, j int) bool       { return self[i].Dest.String() < self[j].Dest.String() }
+
+func (self *serviceStats) labels() string {
+    return fmt.Sprintf("service=%q,service_name=%q", self.Service.String(), self.Name)
+}
+
+func (self *destStats) labels(service *serviceStats) string {
+    return fmt.Sprintf("%s,dest=%q,backend_name=%q", service.labels(), self.Dest.String(), self.Name)
+}
+
+func (self *IPVSStats) sortedServices() statsServiceList {
+    services := make(statsServiceList, 0, len(self.services))
+
+    for _, service := range self.services {
+        services = append(services, service)
+    }
+
+    sort.Sort(services)
+
+    return services
+}
+
+func (self *serviceStats) sortedDests() statsDestList {
+    dests := make(statsDestList, 0, len(self.dests))
+
+    for _, dest := range self.dests {
+        dests = append(dests, dest)
+    }
+
+    sort.Sort(dests)
+
+    return dests
+}
+
+// Write out the current snapshot in the Prometheus text format
+func (self *IPVSStats) writeMetrics(w io.Writer) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    services := self.sortedServices()
+
+    for _, metric := range statsMetrics {
+        fmt.Fprintf(w, "# HELP clusterf_ipvs_service_%s_total %s\n", metric.name, metric.help)
+        fmt.Fprintf(w, "# TYPE clusterf_ipvs_service_%s_total counter\n", metric.name)
+        for _, service := range services {
+            fmt.Fprintf(w, "clusterf_ipvs_service_%s_total{%s} %d\n", metric.name, service.labels(), metric.counter(service.Service.Stats))
+        }
+
+        fmt.Fprintf(w, "# HELP clusterf_ipvs_service_%s_per_second %s per second\n", metric.name, metric.help)
+        fmt.Fprintf(w, "# TYPE clusterf_ipvs_service_%s_per_second gauge\n", metric.name)
+        for _, service := range services {
+            fmt.Fprintf(w, "clusterf_ipvs_service_%s_per_second{%s} %g\n", metric.name, service.labels(), metric.rate(service.Rates))
+        }
+
+        fmt.Fprintf(w, "# HELP clusterf_ipvs_dest_%s_total %s\n", metric.name, metric.help)
+        fmt.Fprintf(w, "# TYPE clusterf_ipvs_dest_%s_total counter\n", metric.name)
+        for _, service := range services {
+            for _, dest := range service.sortedDests() {
+                fmt.Fprintf(w, "clusterf_ipvs_dest_%s_total{%s} %d\n", metric.name, dest.labels(service), metric.counter(dest.Dest.Stats))
+            }
+        }
+
+        fmt.Fprintf(w, "# HELP clusterf_ipvs_dest_%s_per_second %s per second\n", metric.name, metric.help)
+        fmt.Fprintf(w, "# TYPE clusterf_ipvs_dest_%s_per_second gauge\n", metric.name)
+        for _, service := range services {
+            for _, dest := range service.sortedDests() {
+                fmt.Fprintf(w, "clusterf_ipvs_dest_%s_per_second{%s} %g\n", metric.name, dest.labels(service), metric.rate(dest.Rates))
+            }
+        }
+    }
+
+    fmt.Fprintf(w, "# HELP clusterf_ipvs_dest_active_conns Active connections\n")
+    fmt.Fprintf(w, "# TYPE clusterf_ipvs_dest_active_conns gauge\n")
+    for _, service := range services {
+        for _, dest := range service.sortedDests() {
+            fmt.Fprintf(w, "clusterf_ipvs_dest_active_conns{%s} %d\n", dest.labels(service), dest.Dest.ActiveConns)
+        }
+    }
+
+    fmt.Fprintf(w, "# HELP clusterf_ipvs_dest_inactive_conns Inactive connections\n")
+    fmt.Fprintf(w, "# TYPE clusterf_ipvs_dest_inactive_conns gauge\n")
+    for _, service := range services {
+        for _, dest := range service.sortedDests() {
+            fmt.Fprintf(w, "clusterf_ipvs_dest_inactive_conns{%s} %d\n", dest.labels(service), dest.Dest.InactConns)
+        }
+    }
+
+    fmt.Fprintf(w, "# HELP clusterf_ipvs_dest_persist_conns Persistence templates\n")
+    fmt.Fprintf(w, "# TYPE clusterf_ipvs_dest_persist_conns gauge\n")
+    for _, service := range services {
+        for _, dest := range service.sortedDests() {
+            fmt.Fprintf(w, "clusterf_ipvs_dest_persist_conns{%s} %d\n", dest.labels(service), dest.Dest.PersistConns)
+        }
+    }
+}
+
+// Serve the /metrics endpoint
+func (self *IPVSStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+    self.writeMetrics(w)
+}
+
+/* JSON snapshot, used by clusterf-top */
+
+// The health of each dest, as seen by the kernel scheduler
+const (
+    HealthUp        = "up"          // receiving new connections
+    HealthDrain     = "drain"       // zero weight, e.g. a drained or standby backend, only serving existing connections
+    HealthOverload  = "overload"    // over the upper connection threshold, not receiving new connections until under the lower threshold
+)
+
+// Return the health of the kernel dest
+func destHealth(dest ipvs.Dest) string {
+    if dest.Weight == 0 {
+        return HealthDrain
+    } else if dest.UThresh != 0 && dest.ActiveConns + dest.InactConns >= dest.UThresh {
+        return HealthOverload
+    } else {
+        return HealthUp
+    }
+}
+
+type StatsDest struct {
+    Name        string      `json:"name"`
+    Dest        string      `json:"dest"`
+    Weight      uint32      `json:"weight"`
+    Health      string      `json:"health"`
+    ActiveConns uint32      `json:"active_conns"`
+    InactConns  uint32      `json:"inactive_conns"`
+    PersistConns uint32     `json:"persist_conns"`
+    Rates       StatsRates  `json:"rates"`
+}
+
+type StatsService struct {
+    Name        string      `json:"name"`
+    Service     string      `json:"service"`
+    SchedName   string      `json:"sched_name"`
+    Rates       StatsRates  `json:"rates"`
+    Dests       []StatsDest `json:"dests"`
+}
+
+type StatsSnapshot struct {
+    Time        time.Time       `json:"time"`
+    Services    []StatsService  `json:"services"`
+}
+
+// Return the current snapshot, with the services and dests in sorted order
+func (self *IPVSStats) Snapshot() StatsSnapshot {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    services := self.sortedServices()
+
+    snapshot := StatsSnapshot{Time: self.time}
+
+    for _, service := range services {
+        statsService := StatsService{
+            Name:       service.Name,
+            Service:    service.Service.String(),
+            SchedName:  service.Service.SchedName,
+            Rates:      service.Rates,
+        }
+
+        for _, dest := range service.sortedDests() {
+            statsService.Dests = append(statsService.Dests, StatsDest{
+                Name:           dest.Name,
+                Dest:           dest.Dest.String(),
+                Weight:         dest.Dest.Weight,
+                Health:         destHealth(dest.Dest),
+                ActiveConns:    dest.Dest.ActiveConns,
+                InactConns:     dest.Dest.InactConns,
+                PersistConns:   dest.Dest.PersistConns,
+                Rates:          dest.Rates,
+            })
+        }
+
+        snapshot.Services = append(snapshot.Services, statsService)
+    }
+
+    return snapshot
+}
+
+// Serve the /stats endpoint
+func (self *IPVSStats) ServeJSON(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if err := json.NewEncoder(w).Encode(self.Snapshot()); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
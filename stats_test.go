@@ -0,0 +1,176 @@
+package clusterf
+
+import (
+    "bytes"
+    "github.com/qmsk/clusterf/ipvs"
+    "net"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestCounterRate(t *testing.T) {
+    tests := []struct{
+        prev    uint64
+        value   uint64
+        seconds float64
+        rate    float64
+    }{
+        {0, 0, 10, 0},
+        {100, 200, 10, 10},
+        {200, 200, 10, 0},
+        {200, 50, 10, 5},       // reset
+        {100, 200, 0, 0},       // no interval
+    }
+
+    for _, test := range tests {
+        if rate := counterRate(test.prev, test.value, test.seconds); rate != test.rate {
+            t.Errorf("counterRate(%v, %v, %v): %v != %v", test.prev, test.value, test.seconds, rate, test.rate)
+        }
+    }
+}
+
+func testStats(conns uint64, inBytes uint64) map[ipvsServiceKey]*serviceStats {
+    service := ipvs.Service{
+        Af:         syscall.AF_INET,
+        Protocol:   syscall.IPPROTO_TCP,
+        Addr:       net.ParseIP("10.0.1.1"),
+        Port:       80,
+        Stats:      ipvs.Stats{Conns: conns, InBytes: inBytes},
+    }
+    dest := ipvs.Dest{
+        Addr:       net.ParseIP("10.1.0.1"),
+        Port:       8080,
+        ActiveConns: 3,
+        PersistConns: 2,
+        Stats:      ipvs.Stats{Conns: conns, InBytes: inBytes},
+    }
+
+    return map[ipvsServiceKey]*serviceStats{
+        makeServiceKey(&service): &serviceStats{
+            Service:    service,
+            Name:       "test",
+            dests:      map[ipvsDestKey]*destStats{
+                makeDestKey(&dest): &destStats{Dest: dest, Name: "test1"},
+            },
+        },
+    }
+}
+
+func TestStatsUpdate(t *testing.T) {
+    stats := (&IPVSDriver{}).NewStats()
+    now := time.Now()
+
+    stats.update(now, testStats(10, 1000))
+
+    for _, service := range stats.services {
+        if service.Rates != (StatsRates{}) {
+            t.Errorf("initial service rates: %+v", service.Rates)
+        }
+    }
+
+    stats.update(now.Add(10 * time.Second), testStats(30, 6000))
+
+    for _, service := range stats.services {
+        if service.Rates.Conns != 2 || service.Rates.InBytes != 500 {
+            t.Errorf("service rates: %+v", service.Rates)
+        }
+
+        for _, dest := range service.dests {
+            if dest.Rates.Conns != 2 || dest.Rates.InBytes != 500 {
+                t.Errorf("dest rates: %+v", dest.Rates)
+            }
+        }
+    }
+
+    // counter reset
+    stats.update(now.Add(20 * time.Second), testStats(10, 1000))
+
+    for _, service := range stats.services {
+        if service.Rates.Conns != 1 || service.Rates.InBytes != 100 {
+            t.Errorf("reset service rates: %+v", service.Rates)
+        }
+    }
+}
+
+func TestStatsMetrics(t *testing.T) {
+    stats := (&IPVSDriver{}).NewStats()
+    now := time.Now()
+
+    stats.update(now, testStats(10, 1000))
+    stats.update(now.Add(10 * time.Second), testStats(30, 6000))
+
+    var buf bytes.Buffer
+
+    stats.writeMetrics(&buf)
+
+    lines := strings.Split(buf.String(), "\n")
+
+    for _, line := range []string{
+        `clusterf_ipvs_service_conns_total{service="inet+tcp://10.0.1.1:80",service_name="test"} 30`,
+        `clusterf_ipvs_service_conns_per_second{service="inet+tcp://10.0.1.1:80",service_name="test"} 2`,
+        `clusterf_ipvs_dest_in_bytes_total{service="inet+tcp://10.0.1.1:80",service_name="test",dest="10.1.0.1:8080",backend_name="test1"} 6000`,
+        `clusterf_ipvs_dest_in_bytes_per_second{service="inet+tcp://10.0.1.1:80",service_name="test",dest="10.1.0.1:8080",backend_name="test1"} 500`,
+        `clusterf_ipvs_dest_active_conns{service="inet+tcp://10.0.1.1:80",service_name="test",dest="10.1.0.1:8080",backend_name="test1"} 3`,
+        `clusterf_ipvs_dest_persist_conns{service="inet+tcp://10.0.1.1:80",service_name="test",dest="10.1.0.1:8080",backend_name="test1"} 2`,
+    } {
+        found := false
+
+        for _, outLine := range lines {
+            if outLine == line {
+                found = true
+            }
+        }
+
+        if !found {
+            t.Errorf("missing metric: %s", line)
+        }
+    }
+}
+
+func TestStatsSnapshot(t *testing.T) {
+    stats := (&IPVSDriver{}).NewStats()
+    now := time.Now()
+
+    stats.update(now, testStats(10, 1000))
+    stats.update(now.Add(10 * time.Second), testStats(30, 6000))
+
+    snapshot := stats.Snapshot()
+
+    if len(snapshot.Services) != 1 {
+        t.Fatalf("snapshot services: %+v", snapshot.Services)
+    }
+
+    service := snapshot.Services[0]
+
+    if service.Name != "test" || service.Service != "inet+tcp://10.0.1.1:80" || service.Rates.Conns != 2 {
+        t.Errorf("snapshot service: %+v", service)
+    }
+
+    if len(service.Dests) != 1 {
+        t.Fatalf("snapshot dests: %+v", service.Dests)
+    }
+
+    dest := service.Dests[0]
+
+    if dest.Name != "test1" || dest.Dest != "10.1.0.1:8080" || dest.ActiveConns != 3 || dest.Rates.InBytes != 500 || dest.Health != HealthDrain {
+        t.Errorf("snapshot dest: %+v", dest)
+    }
+}
+
+func TestStatsDestHealth(t *testing.T) {
+    for _, test := range []struct {
+        dest    ipvs.Dest
+        health  string
+    }{
+        {ipvs.Dest{Weight: 10, ActiveConns: 3}, HealthUp},
+        {ipvs.Dest{Weight: 0, ActiveConns: 3}, HealthDrain},
+        {ipvs.Dest{Weight: 10, UThresh: 5, ActiveConns: 3, InactConns: 1}, HealthUp},
+        {ipvs.Dest{Weight: 10, UThresh: 5, ActiveConns: 3, InactConns: 2}, HealthOverload},
+    } {
+        if health := destHealth(test.dest); health != test.health {
+            t.Errorf("destHealth %+v: %s, expected %s", test.dest, health, test.health)
+        }
+    }
+}
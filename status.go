@@ -0,0 +1,147 @@
+package clusterf
+/*
+ * Publish the final VIP and health state of each service, for external integrations such as DNS controllers.
+ *
+ * Each node publishes a status/<node>/<service> key with a TTL, so that the statuses of any stopped nodes expire. Any changed statuses
+ * are published on the next update, and the unchanged statuses are refreshed before their TTL expires.
+ */
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "log"
+    "os"
+    "time"
+)
+
+const STATUS_TTL = 60 * time.Second
+
+// Publish configs with a TTL, implemented by config.Etcd
+type StatusPublisher interface {
+    PublishTTL(config config.Config, ttl time.Duration) error
+    Retract(config config.Config) error
+}
+
+type StatusConfig struct {
+    NodeName    string          // default: hostname
+    TTL         time.Duration   // default: STATUS_TTL
+}
+
+type StatusWriter struct {
+    config      StatusConfig
+    publisher   StatusPublisher
+
+    published   map[string]config.ServiceStatus
+    refreshed   time.Time
+}
+
+func (self StatusConfig) Open(publisher StatusPublisher) (*StatusWriter, error) {
+    statusWriter := &StatusWriter{
+        config:     self,
+        publisher:  publisher,
+        published:  make(map[string]config.ServiceStatus),
+    }
+
+    if statusWriter.config.TTL == 0 {
+        statusWriter.config.TTL = STATUS_TTL
+    } else if statusWriter.config.TTL < 2 * time.Second {
+        return nil, fmt.Errorf("Status TTL is too short: %v", statusWriter.config.TTL)
+    }
+
+    if statusWriter.config.NodeName != "" {
+
+    } else if hostname, err := os.Hostname(); err != nil {
+        return nil, err
+    } else {
+        statusWriter.config.NodeName = hostname
+    }
+
+    return statusWriter, nil
+}
+
+func (self *StatusWriter) String() string {
+    return fmt.Sprintf("status/%s ttl=%v", self.config.NodeName, self.config.TTL)
+}
+
+// Publish any changed statuses, retract any removed statuses, and refresh all statuses once half of the TTL has passed
+func (self *StatusWriter) Update(statuses map[string]config.ServiceStatus) error {
+    var refresh = time.Since(self.refreshed) >= self.config.TTL / 2
+
+    for serviceName, status := range statuses {
+        if published, exists := self.published[serviceName]; exists && published == status && !refresh {
+            continue
+        }
+
+        statusConfig := config.ConfigStatus{NodeName: self.config.NodeName, ServiceName: serviceName, Status: status}
+
+        if err := self.publisher.PublishTTL(statusConfig, self.config.TTL); err != nil {
+            return fmt.Errorf("publish %s: %v", statusConfig.Path(), err)
+        }
+
+        if published, exists := self.published[serviceName]; !exists || published != status {
+            log.Printf("clusterf:StatusWriter %s: publish %s: %+v\n", self, serviceName, status)
+        }
+
+        self.published[serviceName] = status
+    }
+
+    for serviceName, _ := range self.published {
+        if _, exists := statuses[serviceName]; exists {
+            continue
+        }
+
+        statusConfig := config.ConfigStatus{NodeName: self.config.NodeName, ServiceName: serviceName}
+
+        log.Printf("clusterf:StatusWriter %s: retract %s\n", self, serviceName)
+
+        if err := self.publisher.Retract(statusConfig); err != nil {
+            return fmt.Errorf("retract %s: %v", statusConfig.Path(), err)
+        }
+
+        delete(self.published, serviceName)
+    }
+
+    if refresh {
+        self.refreshed = time.Now()
+    }
+
+    return nil
+}
+
+// Return the number of active backends for the service
+func (self *Service) activeBackends() (count uint) {
+    for _, backends := range []map[string]*ipvsBackend{self.driverBackends, self.driverGroupBackends} {
+        for _, backend := range backends {
+            if backend.weight > 0 && len(backend.state) > 0 {
+                count++
+            }
+        }
+    }
+
+    return
+}
+
+// Return the status of each service with a frontend
+func (self *Services) Status() map[string]config.ServiceStatus {
+    statuses := make(map[string]config.ServiceStatus)
+
+    for serviceName, service := range self.services {
+        if service.Frontend == nil {
+            continue
+        }
+
+        status := config.ServiceStatus{
+            IPv4:       service.Frontend.IPv4,
+            IPv6:       service.Frontend.IPv6,
+        }
+
+        if service.driverFrontend != nil && len(service.driverFrontend.state) > 0 {
+            status.Backends = service.activeBackends()
+            status.Healthy = status.Backends > 0
+        }
+
+        statuses[serviceName] = status
+    }
+
+    return statuses
+}
@@ -0,0 +1,99 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "reflect"
+    "testing"
+    "time"
+)
+
+type testStatusPublisher struct {
+    ops     []string
+}
+
+func (self *testStatusPublisher) PublishTTL(baseConfig config.Config, ttl time.Duration) error {
+    self.ops = append(self.ops, fmt.Sprintf("publish %s %+v ttl=%v", baseConfig.Path(), baseConfig.Value(), ttl))
+    return nil
+}
+
+func (self *testStatusPublisher) Retract(baseConfig config.Config) error {
+    self.ops = append(self.ops, fmt.Sprintf("retract %s", baseConfig.Path()))
+    return nil
+}
+
+func (self *testStatusPublisher) take() []string {
+    ops := self.ops
+    self.ops = nil
+    return ops
+}
+
+func TestServicesStatus(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "web", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", IPv6: "2001:db8::1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "web", BackendName: "web2", Backend: config.ServiceBackend{IPv4: "10.1.0.2", TCP: 80, Drain: true}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "dns", Frontend: config.ServiceFrontend{IPv4: "10.0.1.2", UDP: 53}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "orphan", BackendName: "orphan1", Backend: config.ServiceBackend{IPv4: "10.1.0.3", TCP: 80}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Mock: true}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    expected := map[string]config.ServiceStatus{
+        "web":  config.ServiceStatus{IPv4: "10.0.1.1", IPv6: "2001:db8::1", Healthy: true, Backends: 1},
+        "dns":  config.ServiceStatus{IPv4: "10.0.1.2"},
+    }
+
+    if status := services.Status(); !reflect.DeepEqual(status, expected) {
+        t.Errorf("Status:\n\t%#v\n!=\n\t%#v", status, expected)
+    }
+}
+
+func TestStatusWriter(t *testing.T) {
+    publisher := &testStatusPublisher{}
+
+    statusWriter, err := StatusConfig{NodeName: "test", TTL: 1 * time.Hour}.Open(publisher)
+    if err != nil {
+        t.Fatalf("StatusConfig.Open: %v", err)
+    }
+
+    if err := statusWriter.Update(map[string]config.ServiceStatus{
+        "web":  config.ServiceStatus{IPv4: "10.0.1.1", Healthy: true, Backends: 1},
+        "dns":  config.ServiceStatus{IPv4: "10.0.1.2"},
+    }); err != nil {
+        t.Fatalf("Update: %v", err)
+    }
+
+    if ops := publisher.take(); len(ops) != 2 {
+        t.Errorf("Update new: %#v", ops)
+    }
+
+    // only changes are published before the refresh
+    if err := statusWriter.Update(map[string]config.ServiceStatus{
+        "web":  config.ServiceStatus{IPv4: "10.0.1.1", Healthy: true, Backends: 2},
+    }); err != nil {
+        t.Fatalf("Update: %v", err)
+    }
+
+    if ops := publisher.take(); !reflect.DeepEqual(ops, []string{
+        "publish status/test/web {IPv4:10.0.1.1 IPv6: Healthy:true Backends:2} ttl=1h0m0s",
+        "retract status/test/dns",
+    }) {
+        t.Errorf("Update changes: %#v", ops)
+    }
+
+    // everything is refreshed once half of the TTL has passed
+    statusWriter.refreshed = time.Now().Add(-31 * time.Minute)
+
+    if err := statusWriter.Update(map[string]config.ServiceStatus{
+        "web":  config.ServiceStatus{IPv4: "10.0.1.1", Healthy: true, Backends: 2},
+    }); err != nil {
+        t.Fatalf("Update: %v", err)
+    }
+
+    if ops := publisher.take(); len(ops) != 1 {
+        t.Errorf("Update refresh: %#v", ops)
+    }
+}
@@ -0,0 +1,81 @@
+package clusterf
+/*
+ * Deterministic subsetting of backends, using rendezvous hashing.
+ *
+ * Each node chooses the backends with the highest hash scores for the node, so that different nodes
+ * use different subsets of backends, and adding/removing a backend only changes a minimal number of subsets.
+ */
+
+import (
+    "hash/fnv"
+    "sort"
+)
+
+// A nil subset contains everything
+type subset map[string]bool
+
+func (self subset) contains(key string) bool {
+    return self == nil || self[key]
+}
+
+type subsetScore struct {
+    key     string
+    score   uint64
+}
+
+type subsetScores []subsetScore
+
+func (self subsetScores) Len() int      { return len(self) }
+func (self subsetScores) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self subsetScores) Less(i, j int) bool {
+    if self[i].score != self[j].score {
+        return self[i].score > self[j].score
+    } else {
+        return self[i].key < self[j].key
+    }
+}
+
+// The FNV-1a hash of similar inputs, e.g. sequential backend names, differs mostly in the low bits, so the hash is finalized using
+// the murmur3 fmix64 to spread each input bit across all of the score bits.
+func subsetHash(seed string, key string) uint64 {
+    hash := fnv.New64a()
+
+    hash.Write([]byte(seed))
+    hash.Write([]byte{0})
+    hash.Write([]byte(key))
+
+    return fmix64(hash.Sum64())
+}
+
+func fmix64(h uint64) uint64 {
+    h ^= h >> 33
+    h *= 0xff51afd7ed558ccd
+    h ^= h >> 33
+    h *= 0xc4ceb9fe1a85ec53
+    h ^= h >> 33
+
+    return h
+}
+
+// Choose up to limit keys, using the given per-node seed
+func makeSubset(seed string, keys []string, limit uint) subset {
+    scores := make(subsetScores, len(keys))
+
+    for i, key := range keys {
+        scores[i] = subsetScore{key, subsetHash(seed, key)}
+    }
+
+    sort.Sort(scores)
+
+    out := make(subset)
+
+    for i, score := range scores {
+        if uint(i) >= limit {
+            break
+        }
+
+        out[score.key] = true
+    }
+
+    return out
+}
@@ -0,0 +1,298 @@
+package tasks
+/*
+ * Accounting of the goroutines and file descriptors used by each subsystem, e.g. the etcd watch, IPVS requests or health checks.
+ *
+ * The process totals are checked against soft limits, logging a warning once they are exceeded, before the process runs into the
+ * RLIMIT_NOFILE or leaks goroutines until it runs out of memory. The soft limits only warn: goroutines and files are never refused.
+ *
+ * The accounting is shared by the whole process, like the log package, as the subsystems are spread across the packages.
+ */
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "runtime"
+    "sort"
+    "sync"
+    "syscall"
+)
+
+type Resource string
+
+const (
+    Goroutines  Resource    = "goroutines"
+    FDs         Resource    = "fds"
+)
+
+var resources = []Resource{Goroutines, FDs}
+
+// Default soft limit for FDs, as a percentage of the RLIMIT_NOFILE
+const FDS_LIMIT_PERCENT = 80
+
+type Config struct {
+    Goroutines  int     // warn above the given number of goroutines; default: disabled
+    FDs         int     // warn above the given number of open files; default: FDS_LIMIT_PERCENT of the RLIMIT_NOFILE
+}
+
+type accounts struct {
+    mutex       sync.Mutex
+    config      Config
+    counts      map[Resource]map[string]int
+    warned      map[Resource]bool
+    warnings    map[Resource]uint64
+}
+
+var state = accounts{
+    counts:     map[Resource]map[string]int{Goroutines: make(map[string]int), FDs: make(map[string]int)},
+    warned:     make(map[Resource]bool),
+    warnings:   make(map[Resource]uint64),
+}
+
+// Set the soft limits
+func Setup(config Config) {
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    state.config = config
+}
+
+func add(resource Resource, subsystem string, delta int) {
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    state.counts[resource][subsystem] += delta
+}
+
+// Run the func in a new goroutine, accounted to the given subsystem until it returns
+func Go(subsystem string, f func()) {
+    add(Goroutines, subsystem, +1)
+
+    go func() {
+        defer add(Goroutines, subsystem, -1)
+
+        f()
+    }()
+}
+
+// Account an open file or socket to the given subsystem, returning a func to call once it is closed
+func Open(subsystem string) (close func()) {
+    var once sync.Once
+
+    add(FDs, subsystem, +1)
+
+    return func() {
+        once.Do(func() {
+            add(FDs, subsystem, -1)
+        })
+    }
+}
+
+type Stats struct {
+    // by subsystem
+    Goroutines      map[string]int
+    FDs             map[string]int
+
+    // process totals, including any unaccounted goroutines and files
+    ProcessGoroutines   int
+    ProcessFDs          int     // -1 if unknown
+    FDsRlimit           uint64  // RLIMIT_NOFILE, or zero if unknown
+
+    // effective soft limits, zero if disabled
+    Limits          Config
+
+    // number of times each soft limit was exceeded
+    Warnings        map[Resource]uint64
+}
+
+func (self Stats) count(resource Resource) int {
+    switch resource {
+    case Goroutines:
+        return self.ProcessGoroutines
+    case FDs:
+        return self.ProcessFDs
+    default:
+        panic("invalid resource")
+    }
+}
+
+func (self Stats) limit(resource Resource) int {
+    switch resource {
+    case Goroutines:
+        return self.Limits.Goroutines
+    case FDs:
+        return self.Limits.FDs
+    default:
+        panic("invalid resource")
+    }
+}
+
+func (self Stats) subsystems(resource Resource) map[string]int {
+    switch resource {
+    case Goroutines:
+        return self.Goroutines
+    case FDs:
+        return self.FDs
+    default:
+        panic("invalid resource")
+    }
+}
+
+// Number of open files, by listing /proc/self/fd
+func countFDs() int {
+    if file, err := os.Open("/proc/self/fd"); err != nil {
+        return -1
+    } else if names, err := file.Readdirnames(-1); err != nil {
+        file.Close()
+        return -1
+    } else {
+        file.Close()
+
+        // excluding the fd used to list the directory
+        return len(names) - 1
+    }
+}
+
+func rlimitFDs() uint64 {
+    var rlimit syscall.Rlimit
+
+    if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+        return 0
+    }
+
+    return rlimit.Cur
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+    var out = make(map[string]int)
+
+    for subsystem, count := range counts {
+        if count != 0 {
+            out[subsystem] = count
+        }
+    }
+
+    return out
+}
+
+// Return the current stats
+func GetStats() Stats {
+    var stats = Stats{
+        ProcessGoroutines:  runtime.NumGoroutine(),
+        ProcessFDs:         countFDs(),
+        FDsRlimit:          rlimitFDs(),
+        Warnings:           make(map[Resource]uint64),
+    }
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    stats.Goroutines = copyCounts(state.counts[Goroutines])
+    stats.FDs = copyCounts(state.counts[FDs])
+    stats.Limits = state.config
+
+    if stats.Limits.FDs == 0 && stats.FDsRlimit > 0 {
+        stats.Limits.FDs = int(stats.FDsRlimit * FDS_LIMIT_PERCENT / 100)
+    }
+
+    for resource, warnings := range state.warnings {
+        stats.Warnings[resource] = warnings
+    }
+
+    return stats
+}
+
+// Format the subsystem counts, largest first
+func formatSubsystems(counts map[string]int) string {
+    var subsystems []string
+    var str string
+
+    for subsystem, _ := range counts {
+        subsystems = append(subsystems, subsystem)
+    }
+
+    sort.Slice(subsystems, func(i, j int) bool {
+        if counts[subsystems[i]] != counts[subsystems[j]] {
+            return counts[subsystems[i]] > counts[subsystems[j]]
+        } else {
+            return subsystems[i] < subsystems[j]
+        }
+    })
+
+    for i, subsystem := range subsystems {
+        if i > 0 {
+            str += " "
+        }
+        str += fmt.Sprintf("%s=%d", subsystem, counts[subsystem])
+    }
+
+    return str
+}
+
+// Check the process totals against the soft limits, logging a warning once each limit is exceeded.
+//
+// Warns again if the limit is exceeded again, after dropping back under the limit.
+func Check() Stats {
+    stats := GetStats()
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    for _, resource := range resources {
+        count := stats.count(resource)
+        limit := stats.limit(resource)
+
+        if limit == 0 || count <= limit {
+            state.warned[resource] = false
+        } else if state.warned[resource] {
+            // still over the limit
+        } else {
+            log.Printf("tasks: %d %s exceeds the soft limit of %d: %s\n", count, resource, limit, formatSubsystems(stats.subsystems(resource)))
+
+            state.warned[resource] = true
+            state.warnings[resource]++
+            stats.Warnings[resource] = state.warnings[resource]
+        }
+    }
+
+    return stats
+}
+
+// Write the stats in the Prometheus text format
+func (self Stats) WriteMetrics(w io.Writer) {
+    for _, resource := range resources {
+        subsystems := self.subsystems(resource)
+        names := make([]string, 0, len(subsystems))
+
+        for subsystem, _ := range subsystems {
+            names = append(names, subsystem)
+        }
+
+        sort.Strings(names)
+
+        fmt.Fprintf(w, "# HELP clusterf_%s Accounted %s by subsystem\n", resource, resource)
+        fmt.Fprintf(w, "# TYPE clusterf_%s gauge\n", resource)
+        for _, subsystem := range names {
+            fmt.Fprintf(w, "clusterf_%s{subsystem=%q} %d\n", resource, subsystem, subsystems[subsystem])
+        }
+
+        fmt.Fprintf(w, "# HELP clusterf_process_%s Total %s of the process\n", resource, resource)
+        fmt.Fprintf(w, "# TYPE clusterf_process_%s gauge\n", resource)
+        fmt.Fprintf(w, "clusterf_process_%s %d\n", resource, self.count(resource))
+
+        fmt.Fprintf(w, "# HELP clusterf_soft_limit_%s Soft limit for the process %s, or zero if disabled\n", resource, resource)
+        fmt.Fprintf(w, "# TYPE clusterf_soft_limit_%s gauge\n", resource)
+        fmt.Fprintf(w, "clusterf_soft_limit_%s %d\n", resource, self.limit(resource))
+    }
+
+    fmt.Fprintf(w, "# HELP clusterf_process_fds_rlimit RLIMIT_NOFILE of the process\n")
+    fmt.Fprintf(w, "# TYPE clusterf_process_fds_rlimit gauge\n")
+    fmt.Fprintf(w, "clusterf_process_fds_rlimit %d\n", self.FDsRlimit)
+
+    fmt.Fprintf(w, "# HELP clusterf_soft_limit_warnings_total Soft limits exceeded\n")
+    fmt.Fprintf(w, "# TYPE clusterf_soft_limit_warnings_total counter\n")
+    for _, resource := range resources {
+        fmt.Fprintf(w, "clusterf_soft_limit_warnings_total{resource=\"%s\"} %d\n", resource, self.Warnings[resource])
+    }
+}
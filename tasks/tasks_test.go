@@ -0,0 +1,81 @@
+package tasks
+
+import (
+    "bytes"
+    "runtime"
+    "strings"
+    "testing"
+)
+
+func TestAccounting(t *testing.T) {
+    var started = make(chan struct{})
+    var stop = make(chan struct{})
+    var stopped = make(chan struct{})
+
+    Go("test", func() {
+        close(started)
+        <-stop
+        close(stopped)
+    })
+    <-started
+
+    release := Open("test")
+
+    if stats := GetStats(); stats.Goroutines["test"] != 1 || stats.FDs["test"] != 1 {
+        t.Errorf("started: %#v %#v", stats.Goroutines, stats.FDs)
+    }
+
+    release()
+    release()
+
+    if stats := GetStats(); stats.FDs["test"] != 0 {
+        t.Errorf("closed: %#v", stats.FDs)
+    }
+
+    close(stop)
+    <-stopped
+
+    // the deferred accounting runs after the func returns
+    for i := 0; i < 1000 && GetStats().Goroutines["test"] != 0; i++ {
+        runtime.Gosched()
+    }
+
+    if stats := GetStats(); stats.Goroutines["test"] != 0 {
+        t.Errorf("stopped: %#v", stats.Goroutines)
+    }
+}
+
+func TestCheck(t *testing.T) {
+    defer Setup(Config{})
+
+    Setup(Config{Goroutines: 1})
+
+    if stats := Check(); stats.Warnings[Goroutines] != 1 {
+        t.Errorf("Check warnings: %#v", stats.Warnings)
+    }
+    if stats := Check(); stats.Warnings[Goroutines] != 1 {
+        t.Errorf("Check warnings again: %#v", stats.Warnings)
+    }
+
+    Setup(Config{Goroutines: 1000000})
+
+    if stats := Check(); stats.Warnings[Goroutines] != 1 {
+        t.Errorf("Check warnings under limit: %#v", stats.Warnings)
+    }
+
+    Setup(Config{Goroutines: 1})
+
+    stats := Check()
+
+    if stats.Warnings[Goroutines] != 2 {
+        t.Errorf("Check warnings after reset: %#v", stats.Warnings)
+    }
+
+    var buf bytes.Buffer
+
+    stats.WriteMetrics(&buf)
+
+    if !strings.Contains(buf.String(), "clusterf_soft_limit_warnings_total{resource=\"goroutines\"} 2\n") || !strings.Contains(buf.String(), "clusterf_soft_limit_goroutines 1\n") {
+        t.Errorf("WriteMetrics:\n%s", buf.String())
+    }
+}
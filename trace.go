@@ -0,0 +1,248 @@
+package clusterf
+/*
+ * Trace a client through the IPVS services of a VIP, for debugging why a client connected to a given backend.
+ *
+ * The existing connections and persistence templates of the client are read from the kernel conn table. For new connections, only the
+ * sh scheduler is predictable, using the kernel order of the dests; the other schedulers depend on the per-dest connection counts,
+ * or on a random per-service hash key for mh.
+ */
+
+import (
+    "context"
+    "encoding/binary"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// A kernel connection or persistence template
+type TraceConn struct {
+    Protocol    string  `json:"protocol"`   // IP for persistence templates
+    Client      string  `json:"client"`
+    Service     string  `json:"service"`
+    Dest        string  `json:"dest"`
+    State       string  `json:"state"`
+    Expires     uint    `json:"expires"`    // seconds
+
+    // from the driver dest
+    DestName    string  `json:"dest_name,omitempty"`
+    FwdMethod   string  `json:"fwd_method,omitempty"`
+}
+
+func (self TraceConn) Template() bool {
+    return self.Protocol == "IP"
+}
+
+type TraceResult struct {
+    Client      string  `json:"client"`
+    Service     string  `json:"service"`
+    Name        string  `json:"name"`
+    SchedName   string  `json:"sched_name"`
+    Persistence uint32  `json:"persistence,omitempty"` // seconds, for persistent services
+
+    Conns       []TraceConn `json:"conns"`
+
+    // the dest that new connections from the client use, if known
+    Dest        string  `json:"dest,omitempty"`
+    DestName    string  `json:"dest_name,omitempty"`
+    FwdMethod   string  `json:"fwd_method,omitempty"`
+    Reason      string  `json:"reason"`
+}
+
+// Format the host:port like the conn table fields
+func traceAddr(ip net.IP, port uint16) string {
+    return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+func makeTraceConn(conn ipvs.Connection) TraceConn {
+    var traceConn = TraceConn{
+        Protocol:   strings.ToUpper(conn.Protocol.String()),
+        Client:     traceAddr(conn.ClientAddr, conn.ClientPort),
+        Service:    traceAddr(conn.VirtualAddr, conn.VirtualPort),
+        Dest:       traceAddr(conn.DestAddr, conn.DestPort),
+        State:      conn.State,
+        Expires:    uint(conn.Expires / time.Second),
+    }
+
+    if conn.Template() {
+        traceConn.Protocol = "IP"
+    }
+
+    return traceConn
+}
+
+// Return the kernel conns matching the filter
+func (self *IPVSDriver) traceConns(filter func(conn ipvs.Connection) bool) ([]TraceConn, error) {
+    var conns []TraceConn
+
+    if self.ipvsClient == nil {
+        // mock'd
+        return conns, nil
+    }
+
+    err := self.ipvsClient.WalkConnections(context.Background(), func(conn ipvs.Connection) error {
+        if filter == nil || filter(conn) {
+            conns = append(conns, makeTraceConn(conn))
+        }
+
+        return nil
+    })
+
+    return conns, err
+}
+
+// Return the sh lookup table slot for the client, like ip_vs_sh_hashkey() without the source port
+func shHashKey(client net.IP) int {
+    var addrFold uint32
+
+    if ip4 := client.To4(); ip4 != nil {
+        addrFold = binary.BigEndian.Uint32(ip4)
+    } else if ip16 := client.To16(); ip16 != nil {
+        for i := 0; i < 16; i += 4 {
+            addrFold ^= binary.BigEndian.Uint32(ip16[i:i+4])
+        }
+    }
+
+    // hash_32() using GOLDEN_RATIO_32, for the HASHING_SH_SLOTS
+    return int((addrFold * 0x61C88647) >> (32 - 8))
+}
+
+// Return the dest the client would be scheduled to, or a reason why it is unknown
+func (self *IPVSDriver) traceSchedule(client net.IP, ipvsService *ipvs.Service, dests []ipvs.Dest) (*ipvs.Dest, string) {
+    if ipvsService.SchedName != "sh" {
+        return nil, fmt.Sprintf("the %s scheduler is not predictable", ipvsService.SchedName)
+    } else if ipvsService.Flags.SchedPort {
+        return nil, "the sh scheduler also hashes the client port"
+    }
+
+    var hashingDests = make([]HashingDest, len(dests))
+
+    for i, dest := range dests {
+        hashingDests[i] = HashingDest{Addr: dest.String(), Weight: dest.Weight}
+    }
+
+    slot := shSlots(hashingDests)[shHashKey(client)]
+
+    for i, dest := range dests {
+        if dest.String() == slot {
+            return &dests[i], "sh scheduler"
+        }
+    }
+
+    if ipvsService.Flags.SchedFallback {
+        return nil, "the sh scheduler falls back from the unavailable dest"
+    } else {
+        return nil, "the sh scheduler has no available dest"
+    }
+}
+
+func (self *IPVSDriver) traceService(client net.IP, ipvsService *ipvs.Service, conns []TraceConn) (TraceResult, error) {
+    var serviceKey = makeServiceKey(ipvsService)
+    var dests []ipvs.Dest
+    var result = TraceResult{
+        Client:     client.String(),
+        Service:    ipvsService.String(),
+        Name:       self.serviceName(serviceKey),
+        SchedName:  ipvsService.SchedName,
+        Conns:      []TraceConn{},
+    }
+
+    if ipvsService.Flags.Persistent {
+        result.Persistence = ipvsService.Timeout
+    }
+
+    if self.ipvsClient == nil {
+        // mock'd, without the kernel order
+        for _, ipvsDest := range self.sortedDests(ipvsService) {
+            dests = append(dests, *ipvsDest)
+        }
+    } else if kernelDests, err := self.ipvsClient.ListDests(*ipvsService); err != nil {
+        return result, fmt.Errorf("ipvs.ListDests %v: %w", ipvsService, err)
+    } else {
+        dests = kernelDests
+    }
+
+    var destAddrs = make(map[string]*ipvs.Dest)
+
+    for i, dest := range dests {
+        destAddrs[traceAddr(dest.Addr, dest.Port)] = &dests[i]
+    }
+
+    var templateDest *ipvs.Dest
+
+    for _, conn := range conns {
+        if conn.Template() {
+            // persistence templates use a zero port for port-zero services
+            if !ipvsService.Flags.Persistent {
+                continue
+            }
+        } else if conn.Service != traceAddr(ipvsService.Addr, ipvsService.Port) {
+            continue
+        } else if !strings.EqualFold(conn.Protocol, ipvsService.Protocol.String()) {
+            continue
+        }
+
+        if dest := destAddrs[conn.Dest]; dest != nil {
+            conn.DestName = self.destName(makeKey(ipvsService, dest))
+            conn.FwdMethod = dest.FwdMethod.String()
+
+            if conn.Template() {
+                templateDest = dest
+            }
+        }
+
+        result.Conns = append(result.Conns, conn)
+    }
+
+    var dest *ipvs.Dest
+
+    if templateDest != nil {
+        dest, result.Reason = templateDest, "persistence template"
+    } else {
+        dest, result.Reason = self.traceSchedule(client, ipvsService, dests)
+    }
+
+    if dest != nil {
+        result.Dest = traceAddr(dest.Addr, dest.Port)
+        result.DestName = self.destName(makeKey(ipvsService, dest))
+        result.FwdMethod = dest.FwdMethod.String()
+    }
+
+    return result, nil
+}
+
+// Trace the client through the services of the vip, optionally limited to the given port, using the given kernel conns
+func (self *IPVSDriver) traceClient(client net.IP, vip net.IP, port uint16, conns []TraceConn) ([]TraceResult, error) {
+    var results = []TraceResult{}
+
+    for _, ipvsService := range self.sortedServices() {
+        if ipvsService.FwMark != 0 || !ipvsService.Addr.Equal(vip) {
+            continue
+        } else if port != 0 && ipvsService.Port != port {
+            continue
+        }
+
+        if result, err := self.traceService(client, ipvsService, conns); err != nil {
+            return results, err
+        } else {
+            results = append(results, result)
+        }
+    }
+
+    return results, nil
+}
+
+// Trace the connections and scheduling of the client to the services of the vip
+func (self *IPVSDriver) Trace(client net.IP, vip net.IP, port uint16) ([]TraceResult, error) {
+    conns, err := self.traceConns(func(conn ipvs.Connection) bool {
+        return conn.ClientAddr.Equal(client) && conn.VirtualAddr.Equal(vip)
+    })
+    if err != nil {
+        return nil, fmt.Errorf("ipvs.WalkConnections: %w", err)
+    }
+
+    return self.traceClient(client, vip, port, conns)
+}
@@ -0,0 +1,185 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "fmt"
+    "github.com/qmsk/clusterf/ipvs"
+    "net"
+    "reflect"
+    "strconv"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func testConn(protocol string, client string, vip string, dest string, state string) ipvs.Connection {
+    var conn = ipvs.Connection{State: state, Expires: 299 * time.Second}
+    var ports [3]string
+    var err error
+
+    switch protocol {
+    case "IP":
+        conn.Protocol = syscall.IPPROTO_IP
+    case "TCP":
+        conn.Protocol = syscall.IPPROTO_TCP
+    case "UDP":
+        conn.Protocol = syscall.IPPROTO_UDP
+    }
+
+    for i, addr := range []string{client, vip, dest} {
+        var host string
+
+        if host, ports[i], err = net.SplitHostPort(addr); err != nil {
+            panic(err)
+        }
+
+        switch i {
+        case 0:
+            conn.ClientAddr = net.ParseIP(host)
+        case 1:
+            conn.VirtualAddr = net.ParseIP(host)
+        case 2:
+            conn.DestAddr = net.ParseIP(host)
+        }
+    }
+
+    for i, port := range []*uint16{&conn.ClientPort, &conn.VirtualPort, &conn.DestPort} {
+        if value, err := strconv.ParseUint(ports[i], 10, 16); err != nil {
+            panic(err)
+        } else {
+            *port = uint16(value)
+        }
+    }
+
+    return conn
+}
+
+func TestTraceConns(t *testing.T) {
+    var client = makeTestClient()
+    var services = NewServices()
+
+    client.conns = []ipvs.Connection{
+        testConn("TCP", "10.0.0.1:54321", "10.0.1.1:80", "10.1.0.1:80", "ESTABLISHED"),
+        testConn("TCP", "10.0.0.2:54321", "10.0.1.1:80", "10.1.0.2:80", "ESTABLISHED"),
+        testConn("IP", "10.0.0.1:0", "10.0.1.1:0", "10.1.0.1:0", "NONE"),
+        testConn("UDP", "10.0.0.1:54321", "10.0.1.2:53", "10.1.0.1:53", "UDP"),
+        testConn("TCP", "[2001:db8::10]:54321", "[2001:db8::1]:80", "[2001:db8:1::1]:80", "SYN_RECV"),
+    }
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"web", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", IPv6:"2001:db8::1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"dns", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", UDP:53}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Client: client})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    for _, test := range []struct{
+        client  string
+        vip     string
+        conns   []string
+    }{
+        {"10.0.0.1", "10.0.1.1", []string{"TCP 10.0.0.1:54321 10.0.1.1:80 10.1.0.1:80 ESTABLISHED 299"}},
+        {"10.0.0.1", "10.0.1.2", []string{"UDP 10.0.0.1:54321 10.0.1.2:53 10.1.0.1:53 UDP 299"}},
+        {"10.0.0.3", "10.0.1.1", []string{}},
+        {"2001:db8::10", "2001:db8::1", []string{"TCP [2001:db8::10]:54321 [2001:db8::1]:80 [2001:db8:1::1]:80 SYN_RECV 299"}},
+    } {
+        results, err := ipvsDriver.Trace(net.ParseIP(test.client), net.ParseIP(test.vip), 0)
+        if err != nil {
+            t.Fatalf("Trace %s %s: %v", test.client, test.vip, err)
+        } else if len(results) != 1 {
+            t.Fatalf("Trace %s %s: results %v", test.client, test.vip, results)
+        }
+
+        var conns = []string{}
+
+        for _, conn := range results[0].Conns {
+            conns = append(conns, fmt.Sprintf("%s %s %s %s %s %d", conn.Protocol, conn.Client, conn.Service, conn.Dest, conn.State, conn.Expires))
+        }
+
+        if !reflect.DeepEqual(conns, test.conns) {
+            t.Errorf("Trace %s %s: conns %v != %v", test.client, test.vip, conns, test.conns)
+        }
+    }
+
+    if conns, err := ipvsDriver.traceConns(nil); err != nil || len(conns) != 5 || !conns[2].Template() {
+        t.Errorf("traceConns: %v %v", conns, err)
+    }
+}
+
+func TestTrace(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"web", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"web", BackendName:"web1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"web", BackendName:"web2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"app", Frontend:config.ServiceFrontend{IPv4:"10.0.1.2", TCP:8080, Persistence:config.Duration(5 * time.Minute)}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"app", BackendName:"app1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:8080}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"app", BackendName:"app2", Backend:config.ServiceBackend{IPv4:"10.1.0.2", TCP:8080}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{SchedName: "sh", Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    for _, test := range []struct{
+        client  string
+        vip     string
+        conns   []TraceConn
+        dest    string
+        reason  string
+    }{
+        {"10.0.0.1", "10.0.1.1", nil, "10.1.0.2:80 web2", "sh scheduler"},
+        {"10.0.0.16", "10.0.1.1", nil, "10.1.0.1:80 web1", "sh scheduler"},
+        {"10.0.0.1", "10.0.1.2", []TraceConn{
+            {Protocol: "TCP", Client: "10.0.0.1:54321", Service: "10.0.1.2:8080", Dest: "10.1.0.1:8080", State: "ESTABLISHED"},
+            {Protocol: "IP", Client: "10.0.0.1:0", Service: "10.0.1.2:8080", Dest: "10.1.0.1:8080", State: "NONE"},
+        }, "10.1.0.1:8080 app1", "persistence template"},
+    } {
+        results, err := ipvsDriver.traceClient(net.ParseIP(test.client), net.ParseIP(test.vip), 0, test.conns)
+        if err != nil {
+            t.Fatalf("trace %s %s: %v", test.client, test.vip, err)
+        } else if len(results) != 1 {
+            t.Fatalf("trace %s %s: results %v", test.client, test.vip, results)
+        }
+
+        result := results[0]
+
+        if dest := result.Dest + " " + result.DestName; dest != test.dest || result.Reason != test.reason {
+            t.Errorf("trace %s %s: dest %s (%s) != %s (%s)", test.client, test.vip, dest, result.Reason, test.dest, test.reason)
+        }
+        if result.FwdMethod != "masq" {
+            t.Errorf("trace %s %s: fwd method %s", test.client, test.vip, result.FwdMethod)
+        }
+        if len(result.Conns) != len(test.conns) {
+            t.Errorf("trace %s %s: conns %v", test.client, test.vip, result.Conns)
+        }
+        for _, conn := range result.Conns {
+            if conn.DestName != "app1" || conn.FwdMethod != "masq" {
+                t.Errorf("trace %s %s: conn %#v", test.client, test.vip, conn)
+            }
+        }
+    }
+
+    if results, err := ipvsDriver.traceClient(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), 443, nil); err != nil || len(results) != 0 {
+        t.Errorf("trace port 443: %v %v", results, err)
+    }
+}
+
+func TestTraceUnpredictable(t *testing.T) {
+    services := NewServices()
+
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource:"test", ServiceName:"web", Frontend:config.ServiceFrontend{IPv4:"10.0.1.1", TCP:80}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource:"test", ServiceName:"web", BackendName:"web1", Backend:config.ServiceBackend{IPv4:"10.1.0.1", TCP:80}})
+
+    ipvsDriver, err := services.SyncIPVS(IpvsConfig{SchedName: "wlc", Mock: true})
+    if err != nil {
+        t.Fatalf("services.SyncIPVS: %v", err)
+    }
+
+    if results, err := ipvsDriver.Trace(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), 80); err != nil {
+        t.Fatalf("Trace: %v", err)
+    } else if len(results) != 1 || results[0].Dest != "" || results[0].Reason != "the wlc scheduler is not predictable" {
+        t.Errorf("Trace: %#v", results)
+    }
+}
@@ -0,0 +1,71 @@
+package clusterf
+/*
+ * Version and build info, embedded at build time using:
+ *
+ *  go build -ldflags "-X github.com/qmsk/clusterf.Version=v1.2.3 -X github.com/qmsk/clusterf.Commit=$(git rev-parse HEAD) -X github.com/qmsk/clusterf.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+ *
+ * Any missing commit and build date fall back to the VCS info embedded by the go toolchain, if any.
+ */
+
+import (
+    "fmt"
+    "io"
+    "runtime"
+    "runtime/debug"
+)
+
+// Set using -ldflags -X
+var (
+    Version     = "dev"
+    Commit      = ""
+    BuildDate   = ""
+)
+
+type BuildInfo struct {
+    Version     string  `json:"version"`
+    Commit      string  `json:"commit"`
+    BuildDate   string  `json:"build_date"`
+    GoVersion   string  `json:"go_version"`
+}
+
+// Return the build info for the running binary
+func GetBuildInfo() BuildInfo {
+    var buildInfo = BuildInfo{
+        Version:    Version,
+        Commit:     Commit,
+        BuildDate:  BuildDate,
+        GoVersion:  runtime.Version(),
+    }
+
+    if info, ok := debug.ReadBuildInfo(); ok {
+        for _, setting := range info.Settings {
+            if setting.Key == "vcs.revision" && buildInfo.Commit == "" {
+                buildInfo.Commit = setting.Value
+            } else if setting.Key == "vcs.time" && buildInfo.BuildDate == "" {
+                buildInfo.BuildDate = setting.Value
+            }
+        }
+    }
+
+    return buildInfo
+}
+
+func (self BuildInfo) String() string {
+    var commit = self.Commit
+    var buildDate = self.BuildDate
+
+    if commit == "" {
+        commit = "unknown"
+    }
+    if buildDate == "" {
+        buildDate = "unknown"
+    }
+
+    return fmt.Sprintf("%s (commit %s, built %s, %s)", self.Version, commit, buildDate, self.GoVersion)
+}
+
+func (self BuildInfo) WriteMetrics(w io.Writer) {
+    fmt.Fprintf(w, "# HELP clusterf_build_info Version and build info of the running clusterf\n")
+    fmt.Fprintf(w, "# TYPE clusterf_build_info gauge\n")
+    fmt.Fprintf(w, "clusterf_build_info{version=%q,commit=%q,build_date=%q,go_version=%q} 1\n", self.Version, self.Commit, self.BuildDate, self.GoVersion)
+}
@@ -0,0 +1,26 @@
+package clusterf
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestBuildInfoMetrics(t *testing.T) {
+    var buf bytes.Buffer
+
+    BuildInfo{Version: "v1.2.3", Commit: "abcdef", BuildDate: "2016-01-01T00:00:00Z", GoVersion: "go1.5"}.WriteMetrics(&buf)
+
+    expected := "# HELP clusterf_build_info Version and build info of the running clusterf\n" +
+        "# TYPE clusterf_build_info gauge\n" +
+        "clusterf_build_info{version=\"v1.2.3\",commit=\"abcdef\",build_date=\"2016-01-01T00:00:00Z\",go_version=\"go1.5\"} 1\n"
+
+    if buf.String() != expected {
+        t.Errorf("WriteMetrics:\n%s", buf.String())
+    }
+}
+
+func TestBuildInfoString(t *testing.T) {
+    if str := (BuildInfo{Version: "dev", GoVersion: "go1.5"}).String(); str != "dev (commit unknown, built unknown, go1.5)" {
+        t.Errorf("String: %#v", str)
+    }
+}
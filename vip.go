@@ -0,0 +1,105 @@
+package clusterf
+/*
+ * Services grouped by their frontend VIPs, for the per-VIP announcement and health decisions.
+ *
+ * Multiple services can share the same VIP on different ports or protocols. The VIP is healthy while any of its services has an active
+ * backend, and is announced using the announcers selected by any of its frontends.
+ */
+
+import (
+    "net"
+    "sort"
+)
+
+type VIP struct {
+    IP          net.IP
+
+    // sorted names of the services using the VIP
+    Services    []string
+
+    // frontend announce options of the services, with "" for the default announcers
+    Announce    []string
+
+    // any of the IPVS services for the VIP has an active dest
+    Healthy     bool
+}
+
+// The state of a VIP, exposed via the HTTP API
+type VIPStatus struct {
+    VIP         string      `json:"vip"`
+    Services    []string    `json:"services"`
+    Healthy     bool        `json:"healthy"`
+
+    // the announcers currently announcing the VIP
+    Announced   []string    `json:"announced"`
+}
+
+// Return the VIPs of the services with a frontend, keyed by IP
+func (self *Services) VIPs() map[string]*VIP {
+    var vips = make(map[string]*VIP)
+    var healthy map[string]net.IP
+
+    if self.driver != nil {
+        healthy = self.driver.healthyVIPs()
+    }
+
+    for serviceName, service := range self.services {
+        if service.Frontend == nil {
+            continue
+        }
+
+        for _, addr := range []string{service.Frontend.IPv4, service.Frontend.IPv6} {
+            ip := net.ParseIP(addr)
+
+            if ip == nil {
+                continue
+            }
+
+            vip := vips[ip.String()]
+
+            if vip == nil {
+                vip = &VIP{IP: ip, Healthy: healthy[ip.String()] != nil}
+                vips[ip.String()] = vip
+            }
+
+            vip.Services = append(vip.Services, serviceName)
+            vip.Announce = append(vip.Announce, service.Frontend.Announce)
+        }
+    }
+
+    for _, vip := range vips {
+        sort.Strings(vip.Services)
+    }
+
+    return vips
+}
+
+// Return the status of each VIP, sorted by VIP
+func (self *Services) VIPStatus() []VIPStatus {
+    var statuses = make([]VIPStatus, 0)
+
+    for key, vip := range self.VIPs() {
+        status := VIPStatus{
+            VIP:        key,
+            Services:   vip.Services,
+            Healthy:    vip.Healthy,
+            Announced:  []string{},
+        }
+
+        if self.injector != nil {
+            status.Announced = append(status.Announced, self.injector.Announced(key)...)
+        }
+
+        statuses = append(statuses, status)
+    }
+
+    sort.Sort(vipStatuses(statuses))
+
+    return statuses
+}
+
+type vipStatuses []VIPStatus
+
+func (self vipStatuses) Len() int           { return len(self) }
+func (self vipStatuses) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self vipStatuses) Less(i, j int) bool { return self[i].VIP < self[j].VIP }
@@ -0,0 +1,45 @@
+package clusterf
+
+import (
+    "github.com/qmsk/clusterf/config"
+    "reflect"
+    "testing"
+)
+
+func TestServicesVIPs(t *testing.T) {
+    var services = NewServices()
+    var commands = &testInjectCommands{}
+
+    injector, err := InjectConfig{Routes: true, AddrDev: "eth0", commands: commands}.Open()
+    if err != nil {
+        t.Fatalf("InjectConfig.Open: %v", err)
+    }
+
+    services.SetInjector(injector)
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "http", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", IPv6: "2001:DB8::1", TCP: 80}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "https", Frontend: config.ServiceFrontend{IPv4: "10.0.1.1", TCP: 443, Announce: "addr"}})
+    services.NewConfig(&config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "https", BackendName: "web1", Backend: config.ServiceBackend{IPv4: "10.1.0.1", TCP: 443}})
+    services.NewConfig(&config.ConfigServiceFrontend{ConfigSource: "test", ServiceName: "dns", Frontend: config.ServiceFrontend{IPv4: "10.0.1.2", UDP: 53}})
+
+    if _, err := services.SyncIPVS(IpvsConfig{NodeName: "test", Mock: true}); err != nil {
+        t.Fatalf("SyncIPVS: %v", err)
+    }
+
+    // the shared VIP is healthy via the https service, and announced using the announcers of both frontends
+    expected := []VIPStatus{
+        VIPStatus{VIP: "10.0.1.1", Services: []string{"http", "https"}, Healthy: true, Announced: []string{"route", "addr"}},
+        VIPStatus{VIP: "10.0.1.2", Services: []string{"dns"}, Announced: []string{}},
+        VIPStatus{VIP: "2001:db8::1", Services: []string{"http"}, Announced: []string{}},
+    }
+
+    if status := services.VIPStatus(); !reflect.DeepEqual(status, expected) {
+        t.Errorf("VIPStatus:\n\t%#v\n!=\n\t%#v", status, expected)
+    }
+
+    // the VIP is withdrawn once none of its services are healthy
+    services.ConfigEvent(config.Event{Action: config.DelConfig, Config: &config.ConfigServiceBackend{ConfigSource: "test", ServiceName: "https", BackendName: "web1"}})
+
+    if status := services.VIPStatus(); status[0].Healthy || len(status[0].Announced) != 0 {
+        t.Errorf("VIPStatus after delete: %#v", status[0])
+    }
+}
@@ -0,0 +1,66 @@
+package clusterf
+/*
+ * Single writer goroutine for all changes to the Services and IPVSDriver state.
+ *
+ * The Services and IPVSDriver are not safe for concurrent use, even though the ipvs.Client itself serializes its netlink requests.
+ * Any event sources running in their own goroutines (config watch, stats, admin API) must apply their changes via the Writer.
+ */
+
+import (
+    "log"
+)
+
+type writerOp struct {
+    name    string
+    apply   func()
+    done    chan bool
+}
+
+type Writer struct {
+    ops     chan writerOp
+    stop    chan bool
+}
+
+func NewWriter() *Writer {
+    return &Writer{
+        ops:    make(chan writerOp),
+        stop:   make(chan bool),
+    }
+}
+
+// Apply the named operation from the writer goroutine, waiting for it to complete.
+//
+// Returns false without applying the operation if the Writer has been stopped.
+func (self *Writer) Do(name string, apply func()) bool {
+    op := writerOp{name: name, apply: apply, done: make(chan bool)}
+
+    select {
+    case self.ops <- op:
+        <-op.done
+        return true
+
+    case <-self.stop:
+        log.Printf("clusterf:Writer %s: stopped\n", name)
+        return false
+    }
+}
+
+// Apply operations until Stop()
+func (self *Writer) Run() {
+    for {
+        select {
+        case op := <-self.ops:
+            op.apply()
+
+            close(op.done)
+
+        case <-self.stop:
+            return
+        }
+    }
+}
+
+// Stop the Run() loop, and reject any further operations
+func (self *Writer) Stop() {
+    close(self.stop)
+}
@@ -0,0 +1,48 @@
+package clusterf
+
+import (
+    "sync"
+    "testing"
+)
+
+// Test concurrent operations being applied from the single writer goroutine
+func TestWriter(t *testing.T) {
+    writer := NewWriter()
+    counter := 0
+
+    go writer.Run()
+
+    var wait sync.WaitGroup
+
+    for i := 0; i < 10; i++ {
+        wait.Add(1)
+
+        go func() {
+            defer wait.Done()
+
+            for j := 0; j < 100; j++ {
+                writer.Do("test", func() {
+                    counter++
+                })
+            }
+        }()
+    }
+
+    wait.Wait()
+
+    if !writer.Do("test", func() { }) {
+        t.Errorf("Do before Stop: false")
+    }
+    if counter != 1000 {
+        t.Errorf("incorrect counter: %d", counter)
+    }
+
+    writer.Stop()
+
+    if writer.Do("test", func() { counter++ }) {
+        t.Errorf("Do after Stop: true")
+    }
+    if counter != 1000 {
+        t.Errorf("applied op after Stop: %d", counter)
+    }
+}